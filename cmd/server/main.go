@@ -0,0 +1,40 @@
+// Command server runs the Gemini wrapper API. Run it with --help for its
+// flags; the Docker image installs it as gemini-wrapper.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"gemini-wrapper/config"
+	"gemini-wrapper/internal/server"
+)
+
+func main() {
+	cfg, err := config.FromArgs(os.Args[0], os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		if !errors.Is(err, config.ErrUsage) {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		os.Exit(2)
+	}
+
+	// On SIGINT/SIGTERM the server stops accepting connections and lets
+	// in-flight requests finish for up to cfg.ShutdownTimeout.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	err = server.Run(ctx, cfg)
+	stop()
+	if err != nil {
+		slog.Error("server failed", "error", err)
+		os.Exit(1)
+	}
+}
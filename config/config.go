@@ -0,0 +1,454 @@
+// Package config loads the server settings from an optional YAML file and
+// environment variables. Environment variables win over the file, so a
+// deployment can ship one file and override single values per container.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gemini-wrapper/pkg/gemini"
+	"gemini-wrapper/service/accesslog"
+	"gemini-wrapper/service/accounting"
+	"gemini-wrapper/service/audit"
+	"gemini-wrapper/service/budget"
+	"gemini-wrapper/service/cluster"
+	"gemini-wrapper/service/embeddings"
+	"gemini-wrapper/service/execution"
+	"gemini-wrapper/service/files"
+	"gemini-wrapper/service/idempotency"
+	"gemini-wrapper/service/jobs"
+	"gemini-wrapper/service/passthrough"
+	"gemini-wrapper/service/postprocess"
+	"gemini-wrapper/service/ratelimit"
+	"gemini-wrapper/service/session"
+	"gemini-wrapper/service/storage"
+	"gemini-wrapper/service/templates"
+	"gemini-wrapper/service/tenants"
+	"gemini-wrapper/service/urlcontext"
+	"gemini-wrapper/service/workspaces"
+
+	"gopkg.in/yaml.v3"
+)
+
+type Config struct {
+	Port string `yaml:"port"`
+	// Socket serves the HTTP API on a Unix socket at this path instead of
+	// Port. SocketMode sets its permissions as an octal string like "0660".
+	// A socket passed in by systemd socket activation wins over both.
+	Socket     string `yaml:"socket"`
+	SocketMode string `yaml:"socket_mode"`
+	// ShutdownTimeout is how long in-flight requests may run after SIGTERM
+	// before their CLI processes are interrupted.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	// MaxInFlight sheds requests with 503 and a Retry-After of
+	// ShedRetryAfter once this many are being served. 0 disables the limit.
+	MaxInFlight    int           `yaml:"max_in_flight"`
+	ShedRetryAfter time.Duration `yaml:"shed_retry_after"`
+	// MaxBodyBytes answers request bodies larger than this with 413, except
+	// on the file upload routes. 0 disables the limit.
+	MaxBodyBytes int64 `yaml:"max_body_bytes"`
+	// StreamHeartbeat is how often streamed answers report their progress,
+	// which also keeps proxies from closing connections that wait long for
+	// the first chunk. 0 disables heartbeats.
+	StreamHeartbeat time.Duration `yaml:"stream_heartbeat"`
+	// ReadyMaxQueueDepth makes /readyz fail once this many requests are
+	// queued. 0 disables the check.
+	ReadyMaxQueueDepth int                `yaml:"ready_max_queue_depth"`
+	Log                LogConfig          `yaml:"log"`
+	Auth               AuthConfig         `yaml:"auth"`
+	Access             AccessConfig       `yaml:"access"`
+	GRPC               GRPCConfig         `yaml:"grpc"`
+	Debug              DebugConfig        `yaml:"debug"`
+	Reaper             ReaperConfig       `yaml:"reaper"`
+	ConfigFile         ConfigFileConfig   `yaml:"config_file"`
+	ModelAliases       ModelAliasesConfig `yaml:"model_aliases"`
+	TLS                TLSConfig          `yaml:"tls"`
+	RateLimit          ratelimit.Config   `yaml:"rate_limit"`
+	Tenants            []tenants.Tenant   `yaml:"tenants"`
+	Storage            storage.Config     `yaml:"storage"`
+	Accounting         accounting.Config  `yaml:"accounting"`
+	Budget             budget.Config      `yaml:"budget"`
+	Idempotency        idempotency.Config `yaml:"idempotency"`
+	Audit              audit.Config       `yaml:"audit"`
+	AccessLog          accesslog.Config   `yaml:"access_log"`
+	Jobs               jobs.Config        `yaml:"jobs"`
+	Sessions           session.Config     `yaml:"sessions"`
+	Postprocess        postprocess.Config `yaml:"postprocess"`
+	Execution          execution.Config   `yaml:"execution"`
+	Templates          templates.Config   `yaml:"templates"`
+	Workspaces         workspaces.Config  `yaml:"workspaces"`
+	Files              files.Config       `yaml:"files"`
+	Embeddings         embeddings.Config  `yaml:"embeddings"`
+	URLContext         urlcontext.Config  `yaml:"url_context"`
+	Passthrough        passthrough.Config `yaml:"passthrough"`
+	Cluster            cluster.Config     `yaml:"cluster"`
+	Gemini             gemini.Config      `yaml:"gemini"`
+
+	// file is the config file read, if any; reload loads the
+	// configuration again from where it came from.
+	file   string
+	reload func() (Config, error)
+}
+
+type LogConfig struct {
+	Format string `yaml:"format"`
+	Level  string `yaml:"level"`
+}
+
+type AuthConfig struct {
+	// APIKeys entries use the API_KEYS syntax ("label:key" or a bare key).
+	APIKeys      []string `yaml:"api_keys"`
+	APIKeysFile  string   `yaml:"api_keys_file"`
+	OpenAIAPIKey string   `yaml:"openai_api_key"`
+	AdminAPIKey  string   `yaml:"admin_api_key"`
+	// Scopes limit keys, by label, to some of ask, stream, sessions,
+	// workspaces, admin and tools. Keys not listed get all but admin and
+	// tools.
+	Scopes map[string][]string `yaml:"scopes"`
+}
+
+// AccessConfig restricts the API to client addresses. Entries are CIDR
+// ranges or single addresses; a denied range wins over an allowed one. The
+// client address is the connection's peer unless it is one of the
+// TrustedProxies, whose ClientIPHeader ("X-Forwarded-For" or "X-Real-IP")
+// is then believed.
+type AccessConfig struct {
+	IPAllowlist    []string `yaml:"ip_allowlist"`
+	IPDenylist     []string `yaml:"ip_denylist"`
+	TrustedProxies []string `yaml:"trusted_proxies"`
+	ClientIPHeader string   `yaml:"client_ip_header"`
+}
+
+// GRPCConfig enables the gRPC API. An empty Port serves it on the HTTP port.
+type GRPCConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Port    string `yaml:"port"`
+}
+
+// DebugConfig enables /debug/pprof and /debug/state. They need the admin
+// API key, like the /admin routes.
+type DebugConfig struct {
+	Enabled bool `yaml:"enabled"`
+}
+
+// ReaperConfig sets how often the idle sessions, workspaces and files are
+// expired in the background, so they are reclaimed even when nobody uses
+// them. 0 disables the reaper; workspaces and files still expire when used.
+type ReaperConfig struct {
+	Interval time.Duration `yaml:"interval"`
+}
+
+// TLSConfig serves HTTPS, and gRPC over TLS, instead of plain HTTP. The
+// certificate comes either from CertFile and KeyFile, which are re-read when
+// they change on disk, or from an ACME CA such as Let's Encrypt for the
+// listed ACME.Domains. RedirectPort, when set, serves plain HTTP there that
+// redirects to HTTPS and answers ACME HTTP-01 challenges.
+type TLSConfig struct {
+	CertFile     string     `yaml:"cert_file"`
+	KeyFile      string     `yaml:"key_file"`
+	ACME         ACMEConfig `yaml:"acme"`
+	RedirectPort string     `yaml:"redirect_port"`
+}
+
+// ACMEConfig obtains and renews certificates automatically. Certificates and
+// the account key are kept in CacheDir so restarts do not hit the CA's rate
+// limits. An empty DirectoryURL uses Let's Encrypt production.
+type ACMEConfig struct {
+	Domains      []string `yaml:"domains"`
+	Email        string   `yaml:"email"`
+	CacheDir     string   `yaml:"cache_dir"`
+	DirectoryURL string   `yaml:"directory_url"`
+}
+
+// Enabled reports whether the server should serve TLS.
+func (c TLSConfig) Enabled() bool {
+	return c.CertFile != "" || c.KeyFile != "" || len(c.ACME.Domains) > 0
+}
+
+// Validate rejects a half-configured certificate and settings that name both
+// certificate files and ACME domains.
+func (c TLSConfig) Validate() error {
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return errors.New("cert_file and key_file must be set together")
+	}
+	if c.CertFile != "" && len(c.ACME.Domains) > 0 {
+		return errors.New("use either cert_file/key_file or acme.domains, not both")
+	}
+	if len(c.ACME.Domains) > 0 && c.ACME.CacheDir == "" {
+		return errors.New("acme.cache_dir is required")
+	}
+	if c.RedirectPort != "" && !c.Enabled() {
+		return errors.New("redirect_port needs a certificate or acme.domains")
+	}
+	return nil
+}
+
+func Default() Config {
+	return Config{
+		Port:               "8080",
+		ShutdownTimeout:    30 * time.Second,
+		ReadyMaxQueueDepth: 20,
+		ShedRetryAfter:     5 * time.Second,
+		MaxBodyBytes:       32 << 20,
+		StreamHeartbeat:    10 * time.Second,
+		Reaper:             ReaperConfig{Interval: time.Minute},
+		Log:                LogConfig{Format: "json", Level: "info"},
+		TLS:                TLSConfig{ACME: ACMEConfig{CacheDir: "/app/cache/acme"}},
+		Storage:            storage.DefaultConfig(),
+		Accounting:         accounting.DefaultConfig(),
+		Budget:             budget.DefaultConfig(),
+		Idempotency:        idempotency.DefaultConfig(),
+		Audit:              audit.DefaultConfig(),
+		AccessLog:          accesslog.DefaultConfig(),
+		Jobs:               jobs.DefaultConfig(),
+		Sessions:           session.DefaultConfig(),
+		Postprocess:        postprocess.DefaultConfig(),
+		Execution:          execution.DefaultConfig(),
+		Templates:          templates.DefaultConfig(),
+		Workspaces:         workspaces.DefaultConfig(),
+		Files:              files.DefaultConfig(),
+		Embeddings:         embeddings.DefaultConfig(),
+		URLContext:         urlcontext.DefaultConfig(),
+		Passthrough:        passthrough.DefaultConfig(),
+		Cluster:            cluster.DefaultConfig(),
+		Gemini:             gemini.DefaultConfig(),
+	}
+}
+
+// Load returns the defaults overridden by the YAML file at path (skipped when
+// path is empty) and then by environment variables. Unknown keys in the file
+// are an error so typos do not go unnoticed.
+func Load(path string) (Config, error) {
+	cfg := Default()
+	if path != "" {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return Config{}, fmt.Errorf("read config file: %w", err)
+		}
+		decoder := yaml.NewDecoder(bytes.NewReader(raw))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+			return Config{}, fmt.Errorf("parse config file %s: %w", path, err)
+		}
+	}
+	cfg.ApplyEnv()
+	cfg.file = path
+	cfg.reload = func() (Config, error) { return Load(path) }
+	return cfg, nil
+}
+
+// ApplyEnv overrides cfg with the environment variables that are set.
+func (c *Config) ApplyEnv() {
+	if port := strings.TrimSpace(os.Getenv("PORT")); port != "" {
+		c.Port = port
+	}
+	setString(&c.Socket, "SOCKET_PATH")
+	setString(&c.SocketMode, "SOCKET_MODE")
+	if raw := strings.TrimSpace(os.Getenv("SHUTDOWN_TIMEOUT_SECONDS")); raw != "" {
+		if parsed, err := strconv.Atoi(raw); err == nil && parsed > 0 {
+			c.ShutdownTimeout = time.Duration(parsed) * time.Second
+		}
+	}
+	if raw := strings.TrimSpace(os.Getenv("READY_MAX_QUEUE_DEPTH")); raw != "" {
+		if parsed, err := strconv.Atoi(raw); err == nil && parsed >= 0 {
+			c.ReadyMaxQueueDepth = parsed
+		}
+	}
+	if raw := strings.TrimSpace(os.Getenv("MAX_IN_FLIGHT")); raw != "" {
+		if parsed, err := strconv.Atoi(raw); err == nil && parsed >= 0 {
+			c.MaxInFlight = parsed
+		}
+	}
+	if raw := strings.TrimSpace(os.Getenv("SHED_RETRY_AFTER_SECONDS")); raw != "" {
+		if parsed, err := strconv.Atoi(raw); err == nil && parsed > 0 {
+			c.ShedRetryAfter = time.Duration(parsed) * time.Second
+		}
+	}
+	if raw := strings.TrimSpace(os.Getenv("MAX_BODY_BYTES")); raw != "" {
+		if parsed, err := strconv.ParseInt(raw, 10, 64); err == nil && parsed >= 0 {
+			c.MaxBodyBytes = parsed
+		}
+	}
+	if raw := strings.TrimSpace(os.Getenv("STREAM_HEARTBEAT_SECONDS")); raw != "" {
+		if parsed, err := strconv.Atoi(raw); err == nil && parsed >= 0 {
+			c.StreamHeartbeat = time.Duration(parsed) * time.Second
+		}
+	}
+	setString(&c.Log.Format, "LOG_FORMAT")
+	setString(&c.Log.Level, "LOG_LEVEL")
+	if raw := strings.TrimSpace(os.Getenv("API_KEYS")); raw != "" {
+		c.Auth.APIKeys = []string{raw}
+	}
+	setString(&c.Auth.APIKeysFile, "API_KEYS_FILE")
+	setString(&c.Auth.OpenAIAPIKey, "OPENAI_API_KEY")
+	setString(&c.Auth.AdminAPIKey, "ADMIN_API_KEY")
+	setScopes(&c.Auth.Scopes, "API_KEY_SCOPES")
+	setList(&c.Access.IPAllowlist, "IP_ALLOWLIST")
+	setList(&c.Access.IPDenylist, "IP_DENYLIST")
+	setList(&c.Access.TrustedProxies, "TRUSTED_PROXIES")
+	setString(&c.Access.ClientIPHeader, "CLIENT_IP_HEADER")
+	if raw := strings.TrimSpace(os.Getenv("GRPC_ENABLED")); raw != "" {
+		if parsed, err := strconv.ParseBool(raw); err == nil {
+			c.GRPC.Enabled = parsed
+		}
+	}
+	setString(&c.GRPC.Port, "GRPC_PORT")
+	if raw := strings.TrimSpace(os.Getenv("DEBUG_ENDPOINTS_ENABLED")); raw != "" {
+		if parsed, err := strconv.ParseBool(raw); err == nil {
+			c.Debug.Enabled = parsed
+		}
+	}
+	if raw := strings.TrimSpace(os.Getenv("REAPER_INTERVAL_SECONDS")); raw != "" {
+		if parsed, err := strconv.Atoi(raw); err == nil && parsed >= 0 {
+			c.Reaper.Interval = time.Duration(parsed) * time.Second
+		}
+	}
+	if raw := strings.TrimSpace(os.Getenv("CONFIG_WATCH_INTERVAL_SECONDS")); raw != "" {
+		if parsed, err := strconv.Atoi(raw); err == nil && parsed >= 0 {
+			c.ConfigFile.WatchInterval = time.Duration(parsed) * time.Second
+		}
+	}
+	setAliases(&c.ModelAliases.OpenAI, "OPENAI_MODEL_ALIASES")
+	setAliases(&c.ModelAliases.Anthropic, "ANTHROPIC_MODEL_ALIASES")
+	setAliases(&c.ModelAliases.Ollama, "OLLAMA_MODEL_ALIASES")
+	setString(&c.TLS.CertFile, "TLS_CERT_FILE")
+	setString(&c.TLS.KeyFile, "TLS_KEY_FILE")
+	setString(&c.TLS.RedirectPort, "TLS_REDIRECT_PORT")
+	setList(&c.TLS.ACME.Domains, "TLS_ACME_DOMAINS")
+	setString(&c.TLS.ACME.Email, "TLS_ACME_EMAIL")
+	setString(&c.TLS.ACME.CacheDir, "TLS_ACME_CACHE_DIR")
+	setString(&c.TLS.ACME.DirectoryURL, "TLS_ACME_DIRECTORY_URL")
+	c.RateLimit.ApplyEnv()
+	c.Storage.ApplyEnv()
+	c.Accounting.ApplyEnv()
+	c.Budget.ApplyEnv()
+	c.Idempotency.ApplyEnv()
+	c.Audit.ApplyEnv()
+	c.AccessLog.ApplyEnv()
+	c.Jobs.ApplyEnv()
+	c.Sessions.ApplyEnv()
+	c.Postprocess.ApplyEnv()
+	c.Execution.ApplyEnv()
+	c.Templates.ApplyEnv()
+	c.Workspaces.ApplyEnv()
+	c.Files.ApplyEnv()
+	c.Embeddings.ApplyEnv()
+	c.URLContext.ApplyEnv()
+	c.Passthrough.ApplyEnv()
+	c.Cluster.ApplyEnv()
+	c.Gemini.ApplyEnv()
+}
+
+func setString(target *string, key string) {
+	if raw := strings.TrimSpace(os.Getenv(key)); raw != "" {
+		*target = raw
+	}
+}
+
+// setList sets target to the comma-separated entries of key when it is set.
+func setList(target *[]string, key string) {
+	raw := strings.TrimSpace(os.Getenv(key))
+	if raw == "" {
+		return
+	}
+	*target = nil
+	for _, entry := range strings.Split(raw, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			*target = append(*target, entry)
+		}
+	}
+}
+
+// setAliases sets target to the "alias=model" pairs of key when it is set.
+func setAliases(target *map[string]string, key string) {
+	raw := strings.TrimSpace(os.Getenv(key))
+	if raw == "" {
+		return
+	}
+	*target = map[string]string{}
+	for _, pair := range strings.Split(raw, ",") {
+		alias, model, ok := strings.Cut(pair, "=")
+		alias, model = strings.TrimSpace(alias), strings.TrimSpace(model)
+		if ok && alias != "" && model != "" {
+			(*target)[alias] = model
+		}
+	}
+}
+
+// setScopes reads "label=scope+scope" entries separated by commas.
+func setScopes(target *map[string][]string, key string) {
+	raw := strings.TrimSpace(os.Getenv(key))
+	if raw == "" {
+		return
+	}
+	*target = map[string][]string{}
+	for _, entry := range strings.Split(raw, ",") {
+		label, scopes, ok := strings.Cut(entry, "=")
+		if label = strings.TrimSpace(label); !ok || label == "" {
+			continue
+		}
+		(*target)[label] = []string{}
+		for _, scope := range strings.Split(scopes, "+") {
+			if scope = strings.TrimSpace(scope); scope != "" {
+				(*target)[label] = append((*target)[label], scope)
+			}
+		}
+	}
+}
+
+// ErrUsage reports an invalid command line. The problem and the usage text
+// have already been printed to stderr.
+var ErrUsage = errors.New("invalid command line")
+
+// FromArgs parses the server flags and loads the configuration. The file
+// comes from --config or CONFIG_FILE; flags given on the command line win over
+// both the file and the environment.
+func FromArgs(name string, args []string) (Config, error) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	path := fs.String("config", os.Getenv("CONFIG_FILE"), "path to a YAML config file")
+	port := fs.String("port", "", "port to listen on")
+	backend := fs.String("backend", "", "gemini backend: headless, api or mock")
+	defaultModel := fs.String("default-model", "", "model used when a request names none")
+	logLevel := fs.String("log-level", "", "log level: debug, info, warn or error")
+	cliPath := fs.String("cli-path", "", "path of the gemini CLI executable")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return Config{}, err
+		}
+		return Config{}, fmt.Errorf("%w: %w", ErrUsage, err)
+	}
+	if fs.NArg() > 0 {
+		fmt.Fprintf(fs.Output(), "unexpected arguments: %s\n", strings.Join(fs.Args(), " "))
+		fs.Usage()
+		return Config{}, fmt.Errorf("%w: unexpected arguments %q", ErrUsage, fs.Args())
+	}
+
+	cfg, err := Load(*path)
+	if err != nil {
+		return Config{}, err
+	}
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "port":
+			cfg.Port = *port
+		case "backend":
+			cfg.Gemini.Backend = *backend
+		case "default-model":
+			cfg.Gemini.DefaultModel = *defaultModel
+		case "log-level":
+			cfg.Log.Level = *logLevel
+		case "cli-path":
+			cfg.Gemini.CLIPath = *cliPath
+		}
+	})
+	cfg.reload = func() (Config, error) { return FromArgs(name, args) }
+	return cfg, nil
+}
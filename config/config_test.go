@@ -0,0 +1,222 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	return path
+}
+
+func TestLoadAppliesFileThenEnv(t *testing.T) {
+	path := writeConfigFile(t, `
+port: "9000"
+rate_limit:
+  requests_per_minute: 10
+gemini:
+  cli_path: /opt/gemini/bin/gemini
+  cli_env:
+    NODE_OPTIONS: --max-old-space-size=512
+  default_model: gemini-2.5-flash
+  pool_size: 2
+  probe_timeout: 5s
+  cache:
+    ttl: 10m
+`)
+	t.Setenv("GEMINI_POOL_SIZE", "6")
+	t.Setenv("PORT", "")
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.Port != "9000" || cfg.RateLimit.RequestsPerMinute != 10 {
+		t.Fatalf("file values not applied: %#v", cfg)
+	}
+	if cfg.Gemini.PoolSize != 6 {
+		t.Fatalf("expected env to override pool size, got %d", cfg.Gemini.PoolSize)
+	}
+	if cfg.Gemini.CLIPath != "/opt/gemini/bin/gemini" || cfg.Gemini.DefaultModel != "gemini-2.5-flash" {
+		t.Fatalf("unexpected gemini config: %#v", cfg.Gemini)
+	}
+	if cfg.Gemini.CLIEnv["NODE_OPTIONS"] != "--max-old-space-size=512" {
+		t.Fatalf("unexpected cli env: %#v", cfg.Gemini.CLIEnv)
+	}
+	if cfg.Gemini.ProbeTimeout != 5*time.Second || cfg.Gemini.Cache.TTL != 10*time.Minute {
+		t.Fatalf("unexpected durations: probe=%s ttl=%s", cfg.Gemini.ProbeTimeout, cfg.Gemini.Cache.TTL)
+	}
+	if cfg.Gemini.QueueSize != 32 || !cfg.Gemini.Cache.Enabled {
+		t.Fatalf("expected defaults for unset values: %#v", cfg.Gemini)
+	}
+}
+
+func TestLoadWithoutFileUsesDefaults(t *testing.T) {
+	t.Setenv("PORT", "")
+	cfg, err := Load("")
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.Port != "8080" || cfg.ReadyMaxQueueDepth != 20 || cfg.Gemini.CLIPath != "gemini" {
+		t.Fatalf("unexpected defaults: %#v", cfg)
+	}
+}
+
+func TestLoadRejectsUnknownKeys(t *testing.T) {
+	path := writeConfigFile(t, "gemini:\n  pool_sise: 2\n")
+	_, err := Load(path)
+	if err == nil || !strings.Contains(err.Error(), "pool_sise") {
+		t.Fatalf("expected unknown key error, got %v", err)
+	}
+}
+
+func TestFromArgsFlagsWinOverFileAndEnv(t *testing.T) {
+	path := writeConfigFile(t, "port: \"9000\"\ngemini:\n  backend: headless\n")
+	t.Setenv("PORT", "9100")
+	t.Setenv("CONFIG_FILE", "")
+
+	cfg, err := FromArgs("test", []string{"--config", path, "--port", "9200", "--backend", "mock", "--cli-path", "/usr/local/bin/gemini"})
+	if err != nil {
+		t.Fatalf("FromArgs: %v", err)
+	}
+	if cfg.Port != "9200" || cfg.Gemini.Backend != "mock" || cfg.Gemini.CLIPath != "/usr/local/bin/gemini" {
+		t.Fatalf("flags not applied: %#v", cfg)
+	}
+
+	cfg, err = FromArgs("test", []string{"--config", path})
+	if err != nil {
+		t.Fatalf("FromArgs: %v", err)
+	}
+	if cfg.Port != "9100" || cfg.Gemini.Backend != "headless" {
+		t.Fatalf("expected env and file values without flags: %#v", cfg)
+	}
+}
+
+func TestFromArgsRejectsPositionalArguments(t *testing.T) {
+	if _, err := FromArgs("test", []string{"serve"}); !errors.Is(err, ErrUsage) {
+		t.Fatalf("expected usage error for positional argument, got %v", err)
+	}
+}
+
+func TestTLSFromEnvAndValidate(t *testing.T) {
+	t.Setenv("TLS_ACME_DOMAINS", "api.example.com, , www.example.com")
+	t.Setenv("TLS_ACME_EMAIL", "ops@example.com")
+	cfg, err := Load("")
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	acme := cfg.TLS.ACME
+	if len(acme.Domains) != 2 || acme.Domains[1] != "www.example.com" || acme.Email != "ops@example.com" || acme.CacheDir == "" {
+		t.Fatalf("unexpected acme config: %#v", acme)
+	}
+	if !cfg.TLS.Enabled() || cfg.TLS.Validate() != nil {
+		t.Fatalf("expected valid TLS config, got %v", cfg.TLS.Validate())
+	}
+
+	for name, tlsCfg := range map[string]TLSConfig{
+		"cert without key": {CertFile: "cert.pem"},
+		"files and acme":   {CertFile: "cert.pem", KeyFile: "key.pem", ACME: ACMEConfig{Domains: []string{"a.example.com"}, CacheDir: "/tmp"}},
+		"redirect only":    {RedirectPort: "80"},
+		"acme without dir": {ACME: ACMEConfig{Domains: []string{"a.example.com"}}},
+	} {
+		if err := tlsCfg.Validate(); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	if (TLSConfig{}).Enabled() || (TLSConfig{}).Validate() != nil {
+		t.Fatalf("expected an empty TLS config to be valid and disabled")
+	}
+}
+
+func TestReloadReadsTheFileAgainAndReportsChanges(t *testing.T) {
+	path := writeConfigFile(t, `
+rate_limit:
+  requests_per_minute: 10
+model_aliases:
+  openai:
+    gpt-4o: gemini-2.5-pro
+`)
+	t.Setenv("ANTHROPIC_MODEL_ALIASES", "claude-sonnet-4=gemini-2.5-flash, broken")
+	t.Setenv("API_KEY_SCOPES", "web=ask, ci=ask+stream+tools, locked=")
+	cfg, err := FromArgs("server", []string{"--config", path, "--port", "9000"})
+	if err != nil {
+		t.Fatalf("FromArgs: %v", err)
+	}
+	if cfg.ModelAliases.OpenAI["gpt-4o"] != "gemini-2.5-pro" || len(cfg.ModelAliases.Anthropic) != 1 {
+		t.Fatalf("unexpected aliases: %#v", cfg.ModelAliases)
+	}
+	if !reflect.DeepEqual(cfg.Auth.Scopes, map[string][]string{"web": {"ask"}, "ci": {"ask", "stream", "tools"}, "locked": {}}) {
+		t.Fatalf("unexpected scopes: %#v", cfg.Auth.Scopes)
+	}
+
+	if err := os.WriteFile(path, []byte(`
+rate_limit:
+  requests_per_minute: 20
+gemini:
+  pool_size: 9
+  request_timeout: 2m
+`), 0o600); err != nil {
+		t.Fatalf("rewrite config: %v", err)
+	}
+	next, err := cfg.Reload()
+	if err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if next.Port != "9000" || next.RateLimit.RequestsPerMinute != 20 {
+		t.Fatalf("expected the flags and the new file, got port=%q rpm=%d", next.Port, next.RateLimit.RequestsPerMinute)
+	}
+
+	changes := cfg.Changes(next)
+	want := []string{"model_aliases.openai", "rate_limit.requests_per_minute", "gemini.pool_size", "gemini.request_timeout"}
+	if strings.Join(changes, " ") != strings.Join(want, " ") {
+		t.Fatalf("unexpected changes %v, want %v", changes, want)
+	}
+	for _, path := range changes {
+		if got := Reloadable(path); got != (path != "gemini.pool_size") {
+			t.Errorf("Reloadable(%q) = %v", path, got)
+		}
+	}
+	if Reloadable("log.format") || !Reloadable("log.level") || Reloadable("rate_limit") {
+		t.Fatal("unexpected reloadable settings")
+	}
+}
+
+func TestReaperAndSessionExpiryFromFileAndEnv(t *testing.T) {
+	path := writeConfigFile(t, `
+reaper:
+  interval: 5m
+sessions:
+  idle_ttl: 12h
+`)
+	t.Setenv("SESSION_RETENTION_SECONDS", "0")
+	t.Setenv("REAPER_INTERVAL_SECONDS", "")
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.Reaper.Interval != 5*time.Minute || cfg.Sessions.IdleTTL != 12*time.Hour || cfg.Sessions.Retention != 0 {
+		t.Fatalf("unexpected expiry settings: reaper=%s idle_ttl=%s retention=%s", cfg.Reaper.Interval, cfg.Sessions.IdleTTL, cfg.Sessions.Retention)
+	}
+
+	t.Setenv("REAPER_INTERVAL_SECONDS", "0")
+	if cfg, err = Load(""); err != nil || cfg.Reaper.Interval != 0 {
+		t.Fatalf("expected REAPER_INTERVAL_SECONDS=0 to disable the reaper, got %+v %v", cfg.Reaper, err)
+	}
+
+	// Sessions expire only when asked to.
+	t.Setenv("SESSION_RETENTION_SECONDS", "")
+	if cfg, err = Load(""); err != nil || cfg.Sessions.IdleTTL != 0 || cfg.Sessions.Retention != 0 {
+		t.Fatalf("expected sessions to be kept by default, got idle_ttl=%s retention=%s %v", cfg.Sessions.IdleTTL, cfg.Sessions.Retention, err)
+	}
+}
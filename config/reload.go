@@ -0,0 +1,89 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"time"
+)
+
+// ConfigFileConfig controls how the server picks up changes to its config
+// file. Besides the watch, SIGHUP and POST /admin/config/reload reload it.
+type ConfigFileConfig struct {
+	// WatchInterval is how often the file's modification time is checked.
+	// 0 disables the watch.
+	WatchInterval time.Duration `yaml:"watch_interval"`
+}
+
+// ModelAliasesConfig maps the model names clients of the compatible APIs
+// send, like "gpt-4o", to Gemini models. The *_MODEL_ALIASES variables,
+// "alias=model" pairs separated by commas, replace the file's entries.
+type ModelAliasesConfig struct {
+	OpenAI    map[string]string `yaml:"openai"`
+	Anthropic map[string]string `yaml:"anthropic"`
+	Ollama    map[string]string `yaml:"ollama"`
+}
+
+// reloadable are the settings a running server applies on reload, as YAML
+// paths. A path ending in "." covers every setting below it.
+var reloadable = []string{
+	"log.level",
+	"rate_limit.",
+	"model_aliases.",
+	"gemini.allowed_models",
+	"gemini.request_timeout",
+	"gemini.max_request_timeout",
+	"gemini.cli_patterns",
+}
+
+// Reloadable reports whether the setting at the YAML path can change
+// without a restart.
+func Reloadable(path string) bool {
+	for _, prefix := range reloadable {
+		if path == prefix || strings.HasSuffix(prefix, ".") && strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// File returns the path of the config file c was read from, or "".
+func (c Config) File() string {
+	return c.file
+}
+
+// Reload loads the configuration again the way c was loaded: from the same
+// file, environment and command line.
+func (c Config) Reload() (Config, error) {
+	if c.reload == nil {
+		return Load("")
+	}
+	return c.reload()
+}
+
+// Changes returns the YAML paths of the settings that differ between c and
+// next, like "gemini.request_timeout".
+func (c Config) Changes(next Config) []string {
+	var changes []string
+	diff("", reflect.ValueOf(c), reflect.ValueOf(next), &changes)
+	return changes
+}
+
+func diff(prefix string, a, b reflect.Value, changes *[]string) {
+	if a.Kind() != reflect.Struct {
+		if !reflect.DeepEqual(a.Interface(), b.Interface()) {
+			*changes = append(*changes, prefix)
+		}
+		return
+	}
+	for i := range a.NumField() {
+		field := a.Type().Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if !field.IsExported() || name == "" || name == "-" {
+			continue
+		}
+		if prefix != "" {
+			name = prefix + "." + name
+		}
+		diff(name, a.Field(i), b.Field(i), changes)
+	}
+}
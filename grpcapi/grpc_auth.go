@@ -0,0 +1,163 @@
+package grpcapi
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	appmiddleware "gemini-wrapper/middleware"
+	"gemini-wrapper/model"
+	"gemini-wrapper/proto/wrapperpb"
+	"gemini-wrapper/service/accounting"
+	"gemini-wrapper/service/audit"
+	"gemini-wrapper/service/budget"
+	"gemini-wrapper/service/execution"
+	"gemini-wrapper/service/ratelimit"
+	"gemini-wrapper/service/usage"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Config holds the access rules shared with the HTTP API. Empty APIKeys, a
+// nil Limiter, a nil Budget, a nil Accounting and a nil Audit disable the
+// respective feature.
+type Config struct {
+	APIKeys    []appmiddleware.APIKey
+	Limiter    *ratelimit.Limiter
+	Budget     *budget.Budget
+	Accounting *accounting.Store
+	Audit      *audit.Log
+	// IPFilter refuses every call, GetStatus included, from peers it does
+	// not admit.
+	IPFilter *appmiddleware.IPFilter
+}
+
+// NewServer returns a gRPC server with GeminiServer registered. Ask calls
+// need an API key in the "authorization" (Bearer) or "x-goog-api-key"
+// metadata and count against the client's rate limits like /api/ask, and
+// need the ask scope, AskStream the stream scope too; GetStatus is open like
+// the HTTP health endpoints.
+func NewServer(service *GeminiServer, cfg Config) *grpc.Server {
+	server := grpc.NewServer(
+		grpc.UnaryInterceptor(func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+			ctx, finish, err := cfg.admit(ctx, info.FullMethod)
+			if err != nil {
+				return nil, err
+			}
+			resp, err := handler(ctx, req)
+			finish(err != nil)
+			return resp, err
+		}),
+		grpc.StreamInterceptor(func(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			ctx, finish, err := cfg.admit(stream.Context(), info.FullMethod)
+			if err != nil {
+				return err
+			}
+			err = handler(srv, contextStream{ServerStream: stream, ctx: ctx})
+			finish(err != nil)
+			return err
+		}),
+	)
+	wrapperpb.RegisterGeminiWrapperServer(server, service)
+	return server
+}
+
+// admit authenticates and rate-limits a call, returning the context the
+// handler runs with and the function that accounts the finished call.
+func (cfg Config) admit(ctx context.Context, method string) (context.Context, func(failed bool), error) {
+	ip := peerIP(ctx)
+	if !cfg.IPFilter.Allowed(ip) {
+		return nil, nil, status.Error(codes.PermissionDenied, "Access from this address is not allowed.")
+	}
+	if method == wrapperpb.GeminiWrapper_GetStatus_FullMethodName {
+		return ctx, func(bool) {}, nil
+	}
+
+	client := "ip:" + ip
+	if len(cfg.APIKeys) > 0 {
+		presented := presentedAPIKey(ctx)
+		if presented == "" {
+			return nil, nil, status.Error(codes.Unauthenticated, "API key required. Send it as a Bearer token or in the x-goog-api-key metadata.")
+		}
+		key, ok := appmiddleware.FindAPIKey(cfg.APIKeys, presented)
+		if !ok {
+			return nil, nil, status.Error(codes.PermissionDenied, "API key not valid. Please pass a valid API key.")
+		}
+		scopes := []string{appmiddleware.ScopeAsk}
+		if method == wrapperpb.GeminiWrapper_AskStream_FullMethodName {
+			scopes = append(scopes, appmiddleware.ScopeStream)
+		}
+		for _, scope := range scopes {
+			if !key.Allows(scope) {
+				return nil, nil, status.Error(codes.PermissionDenied, fmt.Sprintf("API key %s lacks the %s scope.", key.Label, scope))
+			}
+		}
+		if key.Allows(appmiddleware.ScopeTools) {
+			ctx = execution.WithTrustedClient(ctx)
+		}
+		client = "key:" + key.Label
+	}
+
+	ctx, finish := cfg.Accounting.Track(cfg.Audit.Track(ctx, client), client)
+	if cfg.Limiter != nil {
+		if ok, retryAfter := cfg.Limiter.Allow(client); !ok {
+			finish(true)
+			return nil, nil, status.Error(codes.ResourceExhausted, fmt.Sprintf("Rate limit exceeded. Retry after %s.", retryAfter.Round(time.Second)))
+		}
+		ctx = usage.WithRecorder(ctx, func(u model.UsageMetadata) {
+			cfg.Limiter.AddTokens(client, u.TotalTokenCount)
+		})
+	}
+	if cfg.Budget != nil {
+		if ok, over := cfg.Budget.Allow(client); !ok {
+			finish(true)
+			return nil, nil, status.Error(codes.ResourceExhausted, over.Message())
+		}
+		ctx = usage.WithRecorder(ctx, func(u model.UsageMetadata) {
+			cfg.Budget.AddTokens(client, u.TotalTokenCount)
+		})
+	}
+	return ctx, finish, nil
+}
+
+func presentedAPIKey(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, authorization := range md.Get("authorization") {
+		if scheme, token, ok := strings.Cut(authorization, " "); ok && strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(token)
+		}
+	}
+	for _, key := range md.Get("x-goog-api-key") {
+		if key = strings.TrimSpace(key); key != "" {
+			return key
+		}
+	}
+	return ""
+}
+
+func peerIP(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return "unknown"
+	}
+	if host, _, err := net.SplitHostPort(p.Addr.String()); err == nil {
+		return host
+	}
+	return p.Addr.String()
+}
+
+// contextStream replaces the context of a server stream.
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s contextStream) Context() context.Context {
+	return s.ctx
+}
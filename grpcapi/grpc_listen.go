@@ -0,0 +1,85 @@
+package grpcapi
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/soheilhy/cmux"
+	"google.golang.org/grpc"
+)
+
+// Serve starts server on root. When shared is set it runs next to the HTTP
+// API on the same listener: gRPC calls are told apart by their content type
+// and the returned listener must be used by the HTTP server; otherwise it is
+// nil. On a shared TLS listener use Handler instead, as splitting decrypted
+// connections breaks HTTP/2 clients of the HTTP API.
+//
+// Once ctx is done the server stops accepting calls and lets running ones
+// finish for up to shutdownTimeout. The returned wait function blocks until
+// it has stopped.
+func Serve(ctx context.Context, server *grpc.Server, root net.Listener, shared bool, shutdownTimeout time.Duration) (net.Listener, func()) {
+	grpcListener := root
+	var httpListener net.Listener
+	if shared {
+		mux := cmux.New(root)
+		grpcListener = mux.MatchWithWriters(cmux.HTTP2MatchHeaderFieldSendSettings("content-type", "application/grpc"))
+		httpListener = mux.Match(cmux.Any())
+		go func() {
+			if err := mux.Serve(); err != nil && !errors.Is(err, net.ErrClosed) {
+				slog.Error("connection multiplexer stopped", "error", err)
+			}
+		}()
+	}
+
+	go func() {
+		if err := server.Serve(grpcListener); err != nil && !errors.Is(err, grpc.ErrServerStopped) {
+			slog.Error("gRPC server stopped", "error", err)
+		}
+	}()
+	slog.Info("gRPC server listening", "address", root.Addr().String(), "shared_with_http", shared)
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		<-ctx.Done()
+		gracefulStop(server, shutdownTimeout)
+		root.Close()
+	}()
+	return httpListener, func() { <-stopped }
+}
+
+// Handler serves gRPC calls with server and every other request with next.
+// It shares a TLS port with the HTTP API, where the HTTP server has already
+// negotiated HTTP/2 and the content type can be read from the request.
+func Handler(server *grpc.Server, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+			server.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// gracefulStop waits for running calls for up to timeout, then cancels them.
+func gracefulStop(server *grpc.Server, timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(done)
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		slog.Warn("gRPC calls still running after shutdown timeout", "timeout", timeout)
+		server.Stop()
+		<-done
+	}
+}
@@ -0,0 +1,144 @@
+// Package grpcapi serves the ask API over gRPC for internal services that
+// prefer typed clients to hand-rolled HTTP calls.
+package grpcapi
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"gemini-wrapper/model"
+	"gemini-wrapper/pkg/gemini"
+	"gemini-wrapper/proto/wrapperpb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// GeminiServer implements wrapperpb.GeminiWrapperServer on top of GeminiService.
+type GeminiServer struct {
+	wrapperpb.UnimplementedGeminiWrapperServer
+	service *gemini.GeminiService
+}
+
+func NewGeminiServer(service *gemini.GeminiService) *GeminiServer {
+	return &GeminiServer{service: service}
+}
+
+// Ask handles GeminiWrapper/Ask.
+func (s *GeminiServer) Ask(ctx context.Context, req *wrapperpb.AskRequest) (*wrapperpb.AskResponse, error) {
+	question, opts, err := askOptions(req)
+	if err != nil {
+		return nil, err
+	}
+	answer, geminiStatus, err := s.service.AskWithOptions(ctx, question, opts)
+	if err != nil {
+		return nil, askError(err, geminiStatus)
+	}
+	return askResponse(opts.Model, answer, geminiStatus), nil
+}
+
+// AskStream handles GeminiWrapper/AskStream.
+func (s *GeminiServer) AskStream(req *wrapperpb.AskRequest, stream grpc.ServerStreamingServer[wrapperpb.AskStreamResponse]) error {
+	question, opts, err := askOptions(req)
+	if err != nil {
+		return err
+	}
+	answer, geminiStatus, err := s.service.AskStreamWithOptions(stream.Context(), question, opts, func(chunk string) error {
+		return stream.Send(&wrapperpb.AskStreamResponse{Chunk: chunk})
+	})
+	if err != nil {
+		return askError(err, geminiStatus)
+	}
+	return stream.Send(&wrapperpb.AskStreamResponse{Result: askResponse(opts.Model, answer, geminiStatus)})
+}
+
+// GetStatus handles GeminiWrapper/GetStatus.
+func (s *GeminiServer) GetStatus(context.Context, *wrapperpb.GetStatusRequest) (*wrapperpb.GetStatusResponse, error) {
+	health := s.service.Health()
+	pool := s.service.PoolStats()
+	return &wrapperpb.GetStatusResponse{
+		Ready:     health.Ready,
+		Backend:   health.Backend,
+		Version:   health.Version,
+		LastError: health.LastError,
+		Pool: &wrapperpb.PoolStatus{
+			Size:              int32(pool.Size),
+			Busy:              int32(pool.Busy),
+			Waiting:           int32(pool.Waiting),
+			QueueLimit:        int32(pool.QueueLimit),
+			OldestWaitSeconds: pool.OldestWaitSeconds,
+		},
+		CircuitState: s.service.CircuitStatus().State,
+	}, nil
+}
+
+func askOptions(req *wrapperpb.AskRequest) (string, model.AskOptions, error) {
+	question := strings.TrimSpace(req.GetQuestion())
+	if question == "" {
+		return "", model.AskOptions{}, status.Error(codes.InvalidArgument, "question is required")
+	}
+	if req.GetTimeoutSeconds() < 0 {
+		return "", model.AskOptions{}, status.Error(codes.InvalidArgument, "timeout_seconds must not be negative")
+	}
+	return question, model.AskOptions{
+		Model:   strings.TrimSpace(req.GetModel()),
+		Timeout: time.Duration(req.GetTimeoutSeconds()) * time.Second,
+	}, nil
+}
+
+func askResponse(requestedModel string, answer string, geminiStatus *model.GeminiStatus) *wrapperpb.AskResponse {
+	resp := &wrapperpb.AskResponse{Answer: answer, Model: requestedModel, FinishReason: "STOP"}
+	if geminiStatus == nil {
+		return resp
+	}
+	if geminiStatus.Model != "" {
+		resp.Model = geminiStatus.Model
+	}
+	if geminiStatus.FinishReason != "" {
+		resp.FinishReason = geminiStatus.FinishReason
+	}
+	resp.Retries = int32(geminiStatus.Retries)
+	if usage := geminiStatus.Usage; usage != nil {
+		resp.Usage = &wrapperpb.Usage{
+			PromptTokenCount:     int32(usage.PromptTokenCount),
+			CandidatesTokenCount: int32(usage.CandidatesTokenCount),
+			TotalTokenCount:      int32(usage.TotalTokenCount),
+		}
+	}
+	return resp
+}
+
+// askError converts a failed ask into the gRPC status matching the HTTP
+// status the REST API would answer with.
+func askError(err error, geminiStatus *model.GeminiStatus) error {
+	code := codes.Internal
+	if geminiStatus != nil {
+		code = codeForHTTPStatus(geminiStatus.HTTPStatus)
+	}
+	return status.Error(code, err.Error())
+}
+
+func codeForHTTPStatus(httpStatus int) codes.Code {
+	switch httpStatus {
+	case http.StatusBadRequest:
+		return codes.InvalidArgument
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusNotFound:
+		return codes.NotFound
+	case http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	case http.StatusNotImplemented:
+		return codes.Unimplemented
+	case http.StatusServiceUnavailable:
+		return codes.Unavailable
+	case http.StatusGatewayTimeout:
+		return codes.DeadlineExceeded
+	}
+	return codes.Internal
+}
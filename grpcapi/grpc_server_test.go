@@ -0,0 +1,225 @@
+package grpcapi
+
+import (
+	"context"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	appmiddleware "gemini-wrapper/middleware"
+	"gemini-wrapper/pkg/gemini"
+	"gemini-wrapper/proto/wrapperpb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func newTestClient(t *testing.T, cfg Config) wrapperpb.GeminiWrapperClient {
+	t.Helper()
+	geminiCfg := gemini.DefaultConfig()
+	geminiCfg.Backend = "mock"
+	geminiCfg.Cache.Enabled = false
+	geminiCfg.Cache.DiskEnabled = false
+	service := gemini.NewGeminiServiceWithConfig(geminiCfg)
+	t.Cleanup(func() { service.Close() })
+
+	listener := bufconn.Listen(1 << 20)
+	server := NewServer(NewGeminiServer(service), cfg)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return wrapperpb.NewGeminiWrapperClient(conn)
+}
+
+func TestAskAndAskStream(t *testing.T) {
+	client := newTestClient(t, Config{})
+	ctx := context.Background()
+
+	resp, err := client.Ask(ctx, &wrapperpb.AskRequest{Question: "hello", Model: "gemini-2.5-flash"})
+	if err != nil {
+		t.Fatalf("Ask: %v", err)
+	}
+	if resp.GetAnswer() != "mock answer: hello" || resp.GetModel() != "gemini-2.5-flash" || resp.GetUsage().GetTotalTokenCount() == 0 {
+		t.Fatalf("unexpected response: %v", resp)
+	}
+
+	stream, err := client.AskStream(ctx, &wrapperpb.AskRequest{Question: "hello"})
+	if err != nil {
+		t.Fatalf("AskStream: %v", err)
+	}
+	var chunks string
+	var result *wrapperpb.AskResponse
+	for {
+		msg, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Recv: %v", err)
+		}
+		chunks += msg.GetChunk()
+		if msg.GetResult() != nil {
+			result = msg.GetResult()
+		}
+	}
+	if chunks != "mock answer: hello" || result.GetAnswer() != chunks {
+		t.Fatalf("unexpected stream: chunks=%q result=%v", chunks, result)
+	}
+
+	if _, err := client.Ask(ctx, &wrapperpb.AskRequest{Question: " "}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument for an empty question, got %v", err)
+	}
+}
+
+func TestAPIKeysAreRequiredExceptForStatus(t *testing.T) {
+	client := newTestClient(t, Config{APIKeys: []appmiddleware.APIKey{{Key: "secret", Label: "svc"}}})
+	ctx := context.Background()
+
+	if _, err := client.Ask(ctx, &wrapperpb.AskRequest{Question: "q"}); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("expected Unauthenticated without a key, got %v", err)
+	}
+	wrong := metadata.AppendToOutgoingContext(ctx, "x-goog-api-key", "nope")
+	if _, err := client.Ask(wrong, &wrapperpb.AskRequest{Question: "q"}); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected PermissionDenied for a wrong key, got %v", err)
+	}
+	authed := metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer secret")
+	if _, err := client.Ask(authed, &wrapperpb.AskRequest{Question: "q"}); err != nil {
+		t.Fatalf("expected success with a valid key, got %v", err)
+	}
+
+	statusResp, err := client.GetStatus(ctx, &wrapperpb.GetStatusRequest{})
+	if err != nil {
+		t.Fatalf("GetStatus: %v", err)
+	}
+	if statusResp.GetBackend() != "mock" || statusResp.GetPool().GetSize() == 0 {
+		t.Fatalf("unexpected status: %v", statusResp)
+	}
+}
+
+func TestAskStreamNeedsTheStreamScope(t *testing.T) {
+	client := newTestClient(t, Config{APIKeys: []appmiddleware.APIKey{{Key: "secret", Label: "svc", Scopes: []string{appmiddleware.ScopeAsk}}}})
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer secret")
+
+	if _, err := client.Ask(ctx, &wrapperpb.AskRequest{Question: "q"}); err != nil {
+		t.Fatalf("expected Ask with the ask scope to succeed, got %v", err)
+	}
+	stream, err := client.AskStream(ctx, &wrapperpb.AskRequest{Question: "q"})
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	if status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected PermissionDenied without the stream scope, got %v", err)
+	}
+}
+
+func TestIPFilterRefusesEveryCall(t *testing.T) {
+	filter, err := appmiddleware.NewIPFilter([]string{"10.0.0.0/8"}, nil)
+	if err != nil {
+		t.Fatalf("NewIPFilter: %v", err)
+	}
+	client := newTestClient(t, Config{IPFilter: filter})
+	if _, err := client.GetStatus(context.Background(), &wrapperpb.GetStatusRequest{}); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected PermissionDenied for a peer outside the allowlist, got %v", err)
+	}
+}
+
+func TestServeSharesThePortWithHTTP(t *testing.T) {
+	geminiCfg := gemini.DefaultConfig()
+	geminiCfg.Backend = "mock"
+	geminiCfg.Cache.Enabled = false
+	geminiCfg.Cache.DiskEnabled = false
+	service := gemini.NewGeminiServiceWithConfig(geminiCfg)
+	defer service.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	root, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	httpListener, wait := Serve(ctx, NewServer(NewGeminiServer(service), Config{}), root, true, time.Second)
+	defer func() {
+		cancel()
+		wait()
+	}()
+	go http.Serve(httpListener, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		io.WriteString(w, "http")
+	}))
+
+	addr := httpListener.Addr().String()
+	resp, err := http.Get("http://" + addr + "/")
+	if err != nil {
+		t.Fatalf("HTTP request: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "http" {
+		t.Fatalf("unexpected HTTP body %q", body)
+	}
+
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	answer, err := wrapperpb.NewGeminiWrapperClient(conn).Ask(context.Background(), &wrapperpb.AskRequest{Question: "shared"})
+	if err != nil || answer.GetAnswer() != "mock answer: shared" {
+		t.Fatalf("unexpected gRPC answer %v, err=%v", answer, err)
+	}
+}
+
+func TestHandlerSharesATLSPortWithHTTP2(t *testing.T) {
+	geminiCfg := gemini.DefaultConfig()
+	geminiCfg.Backend = "mock"
+	geminiCfg.Cache.Enabled = false
+	geminiCfg.Cache.DiskEnabled = false
+	service := gemini.NewGeminiServiceWithConfig(geminiCfg)
+	defer service.Close()
+
+	grpcServer := NewServer(NewGeminiServer(service), Config{})
+	defer grpcServer.Stop()
+	server := httptest.NewUnstartedServer(Handler(grpcServer, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	})))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	resp, err := server.Client().Get(server.URL)
+	if err != nil {
+		t.Fatalf("HTTP request: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "HTTP/2.0" {
+		t.Fatalf("unexpected HTTP body %q", body)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+	conn, err := grpc.NewClient(server.Listener.Addr().String(), grpc.WithTransportCredentials(credentials.NewClientTLSFromCert(pool, "example.com")))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	answer, err := wrapperpb.NewGeminiWrapperClient(conn).Ask(context.Background(), &wrapperpb.AskRequest{Question: "tls"})
+	if err != nil || answer.GetAnswer() != "mock answer: tls" {
+		t.Fatalf("unexpected gRPC answer %v, err=%v", answer, err)
+	}
+}
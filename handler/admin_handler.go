@@ -0,0 +1,373 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"gemini-wrapper/logging"
+	"gemini-wrapper/model"
+	"gemini-wrapper/pkg/gemini"
+	"gemini-wrapper/service/accounting"
+	"gemini-wrapper/service/budget"
+	"gemini-wrapper/service/ratelimit"
+	"gemini-wrapper/service/session"
+
+	"github.com/labstack/echo/v5"
+)
+
+// AdminHandler serves the operator endpoints under /admin.
+type AdminHandler struct {
+	limiter    *ratelimit.Limiter
+	budget     *budget.Budget
+	accounting *accounting.Store
+	service    *gemini.GeminiService
+	// reloadConfig serves POST /admin/config/reload when set.
+	reloadConfig ConfigReloader
+	// sessions serve POST /admin/command when set.
+	sessions *session.Manager
+}
+
+// ConfigReloader reads the configuration again and applies it. It returns
+// the settings applied and the changed ones that need a restart.
+type ConfigReloader func() (applied, restartRequired []string, err error)
+
+func NewAdminHandler(limiter *ratelimit.Limiter, budget *budget.Budget, accounting *accounting.Store, service *gemini.GeminiService) *AdminHandler {
+	return &AdminHandler{limiter: limiter, budget: budget, accounting: accounting, service: service}
+}
+
+// SetSessions enables POST /admin/command.
+func (h *AdminHandler) SetSessions(sessions *session.Manager) {
+	h.sessions = sessions
+}
+
+// SetConfigReloader enables POST /admin/config/reload.
+func (h *AdminHandler) SetConfigReloader(reload ConfigReloader) {
+	h.reloadConfig = reload
+}
+
+// defaultUsageWindow is the report period when the request sets no "from".
+const defaultUsageWindow = 7 * 24 * time.Hour
+
+// usageResponse is the live quota state plus, when enabled, the budgets
+// and the persisted history.
+type usageResponse struct {
+	ratelimit.UsageReport
+	Budget  *budget.Report     `json:"budget,omitempty"`
+	History *accounting.Report `json:"history,omitempty"`
+}
+
+// Usage handles GET /admin/usage. The optional query parameters from and to
+// (RFC 3339 or YYYY-MM-DD, UTC), bucket ("hour" or "day") and client select
+// the history report.
+func (h *AdminHandler) Usage(c *echo.Context) error {
+	resp := usageResponse{UsageReport: ratelimit.UsageReport{Clients: []ratelimit.ClientUsage{}}}
+	if h.limiter != nil {
+		resp.UsageReport = h.limiter.Usage()
+	}
+	if h.budget != nil {
+		report := h.budget.Usage()
+		resp.Budget = &report
+	}
+	if h.accounting == nil {
+		return c.JSON(http.StatusOK, resp)
+	}
+
+	query, err := usageQuery(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	history, err := h.accounting.Report(query)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	resp.History = &history
+	return c.JSON(http.StatusOK, resp)
+}
+
+func usageQuery(c *echo.Context) (accounting.Query, error) {
+	query := accounting.Query{To: time.Now(), Bucket: c.QueryParam("bucket"), Client: c.QueryParam("client")}
+	if query.Bucket == "" {
+		query.Bucket = accounting.BucketDay
+	}
+	if raw := c.QueryParam("to"); raw != "" {
+		to, err := parseReportTime(raw)
+		if err != nil {
+			return accounting.Query{}, fmt.Errorf("invalid to: %w", err)
+		}
+		query.To = to
+	}
+	query.From = query.To.Add(-defaultUsageWindow)
+	if raw := c.QueryParam("from"); raw != "" {
+		from, err := parseReportTime(raw)
+		if err != nil {
+			return accounting.Query{}, fmt.Errorf("invalid from: %w", err)
+		}
+		query.From = from
+	}
+	if !query.From.Before(query.To) {
+		return accounting.Query{}, errors.New("from must be before to")
+	}
+	return query, nil
+}
+
+func parseReportTime(raw string) (time.Time, error) {
+	if day, err := time.Parse(time.DateOnly, raw); err == nil {
+		return day, nil
+	}
+	return time.Parse(time.RFC3339, raw)
+}
+
+// PurgeCache handles DELETE /admin/cache.
+func (h *AdminHandler) PurgeCache(c *echo.Context) error {
+	if h == nil || h.service == nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "service not initialized"})
+	}
+	result, err := h.service.PurgeCache()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]interface{}{"error": err.Error(), "purged": result})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"purged": result})
+}
+
+// Context handles GET /admin/context.
+func (h *AdminHandler) Context(c *echo.Context) error {
+	if h == nil || h.service == nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "service not initialized"})
+	}
+	file, err := h.service.GlobalContext()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusOK, file)
+}
+
+// SetContext handles PUT /admin/context. An empty content removes the
+// global GEMINI.md.
+func (h *AdminHandler) SetContext(c *echo.Context) error {
+	if h == nil || h.service == nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "service not initialized"})
+	}
+	req := new(model.SetContextRequest)
+	if err := c.Bind(req); err != nil {
+		failure := bindFailure(err, "Invalid request format")
+		return c.JSON(failure.Status, map[string]string{"error": failure.Message})
+	}
+	return h.writeContextRefresh(c, func() (gemini.ContextRefresh, error) {
+		return h.service.SetGlobalContext(req.Content)
+	})
+}
+
+// DeleteContext handles DELETE /admin/context.
+func (h *AdminHandler) DeleteContext(c *echo.Context) error {
+	if h == nil || h.service == nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "service not initialized"})
+	}
+	return h.writeContextRefresh(c, func() (gemini.ContextRefresh, error) {
+		return h.service.SetGlobalContext("")
+	})
+}
+
+// RefreshContext handles POST /admin/context/refresh.
+func (h *AdminHandler) RefreshContext(c *echo.Context) error {
+	if h == nil || h.service == nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "service not initialized"})
+	}
+	return h.writeContextRefresh(c, h.service.RefreshContext)
+}
+
+func (h *AdminHandler) writeContextRefresh(c *echo.Context, refresh func() (gemini.ContextRefresh, error)) error {
+	result, err := refresh()
+	switch {
+	case errors.Is(err, gemini.ErrContextTooLarge):
+		return c.JSON(http.StatusRequestEntityTooLarge, map[string]string{"error": err.Error()})
+	case err != nil:
+		return c.JSON(http.StatusInternalServerError, map[string]interface{}{"error": err.Error(), "purged": result.Purged})
+	}
+	return c.JSON(http.StatusOK, result)
+}
+
+// Backend handles GET /admin/backend.
+func (h *AdminHandler) Backend(c *echo.Context) error {
+	if h == nil || h.service == nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "service not initialized"})
+	}
+	return c.JSON(http.StatusOK, struct {
+		gemini.BackendState
+		LogLevel string `json:"logLevel"`
+	}{h.service.BackendState(), levelName(logging.Level())})
+}
+
+// RestartBackend handles POST /admin/backend/restart.
+func (h *AdminHandler) RestartBackend(c *echo.Context) error {
+	if h == nil || h.service == nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "service not initialized"})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"interrupted": h.service.Restart()})
+}
+
+// MCPServers handles GET /admin/mcp.
+func (h *AdminHandler) MCPServers(c *echo.Context) error {
+	if h == nil || h.service == nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "service not initialized"})
+	}
+	servers, err := h.service.MCPServers()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"servers": servers})
+}
+
+// Auth handles GET /admin/auth: how the CLI authenticates, when its cached
+// OAuth token expires and how the last re-authentication went.
+func (h *AdminHandler) Auth(c *echo.Context) error {
+	if h == nil || h.service == nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "service not initialized"})
+	}
+	status, err := h.service.AuthStatus()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusOK, status)
+}
+
+const (
+	// consoleBuffer is how many lines a slow /admin/console client may fall
+	// behind before it misses some.
+	consoleBuffer = 256
+	// consoleKeepAlive is how often an idle console stream gets a comment.
+	consoleKeepAlive = 15 * time.Second
+)
+
+// Console handles GET /admin/console: a server-sent event stream of what the
+// CLI processes print, starting with the most recent lines. Each "line" event
+// carries a gemini.ConsoleLine.
+func (h *AdminHandler) Console(c *echo.Context) error {
+	if h == nil || h.service == nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "service not initialized"})
+	}
+	backlog, lines, cancel := h.service.Console(consoleBuffer)
+	defer cancel()
+	stream, err := startSSE(c)
+	if err != nil {
+		return err
+	}
+	for _, line := range backlog {
+		if err := stream.Event("line", line); err != nil {
+			return nil
+		}
+	}
+
+	keepAlive := time.NewTicker(consoleKeepAlive)
+	defer keepAlive.Stop()
+	done := c.Request().Context().Done()
+	for {
+		select {
+		case <-done:
+			return nil
+		case line := <-lines:
+			err = stream.Event("line", line)
+		case <-keepAlive.C:
+			err = stream.Comment("keepalive")
+		}
+		if err != nil {
+			return nil
+		}
+	}
+}
+
+// ClearQueue handles DELETE /admin/queue.
+func (h *AdminHandler) ClearQueue(c *echo.Context) error {
+	if h == nil || h.service == nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "service not initialized"})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"cleared": h.service.ClearQueue()})
+}
+
+// ReloadConfig handles POST /admin/config/reload.
+func (h *AdminHandler) ReloadConfig(c *echo.Context) error {
+	if h == nil || h.reloadConfig == nil {
+		return c.JSON(http.StatusNotImplemented, map[string]string{"error": "configuration reload is not available"})
+	}
+	applied, restartRequired, err := h.reloadConfig()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusOK, map[string][]string{"applied": append([]string{}, applied...), "restartRequired": append([]string{}, restartRequired...)})
+}
+
+// LogLevel handles GET /admin/log-level.
+func (h *AdminHandler) LogLevel(c *echo.Context) error {
+	return c.JSON(http.StatusOK, map[string]string{"level": levelName(logging.Level())})
+}
+
+// SetLogLevel handles PUT /admin/log-level with a body like {"level": "debug"}.
+func (h *AdminHandler) SetLogLevel(c *echo.Context) error {
+	var req struct {
+		Level string `json:"level"`
+	}
+	if err := c.Bind(&req); err != nil {
+		failure := bindFailure(err, "Invalid request format")
+		return c.JSON(failure.Status, map[string]string{"error": failure.Message})
+	}
+	level, ok := logging.LookupLevel(req.Level)
+	if !ok {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "level must be debug, info, warn or error"})
+	}
+	previous := logging.Level()
+	logging.SetLevel(level)
+	slog.Warn("log level changed by operator", "from", levelName(previous), "to", levelName(level))
+	return c.JSON(http.StatusOK, map[string]string{"level": levelName(level)})
+}
+
+// TestCLIPatterns handles POST /admin/cli-patterns/test with a body like
+// {"transcript": "...", "version": "0.45.0"}: how the CLI output patterns
+// read the transcript. An empty version uses the patterns in use.
+func (h *AdminHandler) TestCLIPatterns(c *echo.Context) error {
+	if h == nil || h.service == nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "service not initialized"})
+	}
+	var req struct {
+		Transcript string `json:"transcript"`
+		Version    string `json:"version"`
+	}
+	if err := c.Bind(&req); err != nil {
+		failure := bindFailure(err, "Invalid request format")
+		return c.JSON(failure.Status, map[string]string{"error": failure.Message})
+	}
+	if req.Transcript == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "transcript is required"})
+	}
+	return c.JSON(http.StatusOK, h.service.ParseTranscript(req.Transcript, req.Version))
+}
+
+// Command handles POST /admin/command with a body like
+// {"session_id": "sess_...", "command": "/stats"}: the wrapper's report on
+// the subject of a CLI slash command for the session.
+func (h *AdminHandler) Command(c *echo.Context) error {
+	if h == nil || h.service == nil || h.sessions == nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "service not initialized"})
+	}
+	req := new(model.SessionCommandRequest)
+	if err := c.Bind(req); err != nil {
+		failure := bindFailure(err, "Invalid request format")
+		return c.JSON(failure.Status, map[string]string{"error": failure.Message})
+	}
+	resp, err := h.sessions.Command(req.SessionID, req.Command, h.service)
+	switch {
+	case errors.Is(err, session.ErrInvalidCommand):
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	case errors.Is(err, session.ErrSessionNotFound):
+		return c.JSON(http.StatusNotFound, map[string]string{"error": err.Error()})
+	case err != nil:
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+func levelName(level slog.Level) string {
+	return strings.ToLower(level.String())
+}
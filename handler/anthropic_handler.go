@@ -0,0 +1,120 @@
+package handler
+
+import (
+	"net/http"
+	"time"
+
+	"gemini-wrapper/model"
+	"gemini-wrapper/pkg/gemini"
+	"gemini-wrapper/service/anthropic"
+
+	"github.com/labstack/echo/v5"
+)
+
+type AnthropicHandler struct {
+	service anthropic.Service
+	// heartbeat spaces the progress comments sent between message events
+	// while the answer is produced; 0 sends none.
+	heartbeat time.Duration
+}
+
+func NewAnthropicHandler(service anthropic.Service, heartbeat time.Duration) *AnthropicHandler {
+	return &AnthropicHandler{service: service, heartbeat: heartbeat}
+}
+
+// CreateMessage handles POST /v1/messages.
+func (h *AnthropicHandler) CreateMessage(c *echo.Context) error {
+	if h == nil || h.service == nil {
+		return writeAnthropicError(c, &anthropic.APIError{HTTPStatus: 500, Type: "api_error", Message: "Anthropic adapter is not initialized"})
+	}
+
+	var req model.AnthropicMessageRequest
+	if err := c.Bind(&req); err != nil {
+		failure := bindFailure(err, "Invalid JSON body")
+		return writeAnthropicError(c, &anthropic.APIError{HTTPStatus: failure.Status, Type: "invalid_request_error", Message: failure.Message})
+	}
+
+	if req.Stream {
+		return h.streamMessage(c, req)
+	}
+
+	resp, err := h.service.CreateMessage(c.Request().Context(), req)
+	if err != nil {
+		return writeAnthropicError(c, err)
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+// CountTokens handles POST /v1/messages/count_tokens.
+func (h *AnthropicHandler) CountTokens(c *echo.Context) error {
+	if h == nil || h.service == nil {
+		return writeAnthropicError(c, &anthropic.APIError{HTTPStatus: 500, Type: "api_error", Message: "Anthropic adapter is not initialized"})
+	}
+
+	var req model.AnthropicMessageRequest
+	if err := c.Bind(&req); err != nil {
+		failure := bindFailure(err, "Invalid JSON body")
+		return writeAnthropicError(c, &anthropic.APIError{HTTPStatus: failure.Status, Type: "invalid_request_error", Message: failure.Message})
+	}
+
+	resp, err := h.service.CountTokens(c.Request().Context(), req)
+	if err != nil {
+		return writeAnthropicError(c, err)
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+// streamMessage opens the event stream lazily so that errors raised before
+// the first event, or the first heartbeat, are still returned as regular
+// JSON error responses. Later errors end the stream with an error event, as
+// the Anthropic API does. Heartbeats are progress comments.
+func (h *AnthropicHandler) streamMessage(c *echo.Context, req model.AnthropicMessageRequest) error {
+	lazy := &lazySSE{c: c}
+	ctx, progress := gemini.WithProgress(c.Request().Context())
+	stop := heartbeat(h.heartbeat, func() error {
+		stream, err := lazy.open()
+		if err != nil {
+			return err
+		}
+		return stream.ProgressComment(progress)
+	})
+	err := h.service.CreateMessageStream(ctx, req, func(event model.AnthropicStreamEvent) error {
+		stream, err := lazy.open()
+		if err != nil {
+			return err
+		}
+		return stream.Event(event.Type, event)
+	})
+	stop()
+	stream := lazy.opened()
+	if stream == nil {
+		if err != nil {
+			return writeAnthropicError(c, err)
+		}
+		return nil
+	}
+	if err != nil {
+		body := anthropicErrorBody(err)
+		return stream.Event("error", model.AnthropicStreamEvent{Type: "error", Error: &body.Error})
+	}
+	return nil
+}
+
+func writeAnthropicError(c *echo.Context, err error) error {
+	status := http.StatusInternalServerError
+	if apiErr, ok := err.(*anthropic.APIError); ok && apiErr.HTTPStatus > 0 {
+		status = apiErr.HTTPStatus
+	}
+	return c.JSON(status, anthropicErrorBody(err))
+}
+
+func anthropicErrorBody(err error) model.AnthropicErrorResponse {
+	body := model.AnthropicErrorResponse{Type: "error", Error: model.AnthropicError{Type: "api_error", Message: "An internal service error occurred"}}
+	if apiErr, ok := err.(*anthropic.APIError); ok {
+		if apiErr.Type != "" {
+			body.Error.Type = apiErr.Type
+		}
+		body.Error.Message = apiErr.Message
+	}
+	return body
+}
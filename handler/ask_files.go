@@ -0,0 +1,140 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"gemini-wrapper/model"
+
+	"github.com/labstack/echo/v5"
+)
+
+// askFilesDir is the directory of the CLI workspace that files attached to
+// /api/ask are written to.
+const askFilesDir = "files"
+
+// askFileName is a relative path the CLI can read as an @reference without
+// quoting.
+var askFileName = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9._-]*(/[A-Za-z0-9_][A-Za-z0-9._-]*)*$`)
+
+// bindAskRequest binds an /api/ask body: JSON, or multipart/form-data whose
+// file parts are attached as files. The other parts of a multipart body are
+// "request", holding the JSON body, or "question" and "model".
+func bindAskRequest(c *echo.Context, req *model.AskRequest) error {
+	mediaType, params, _ := mime.ParseMediaType(c.Request().Header.Get(echo.HeaderContentType))
+	if mediaType != echo.MIMEMultipartForm {
+		return c.Bind(req)
+	}
+	limit := int64(0)
+	if binder, ok := c.Echo().Binder.(*Binder); ok {
+		limit = binder.MaxBodyBytes
+	}
+	tooLarge := &BindError{Status: http.StatusRequestEntityTooLarge, Code: BindCodeTooLarge, Message: fmt.Sprintf("Request body is larger than %d bytes", limit)}
+	if limit > 0 && c.Request().ContentLength > limit {
+		return tooLarge
+	}
+
+	invalid := func(format string, args ...any) error {
+		return &BindError{Status: http.StatusBadRequest, Code: BindCodeInvalidValue, Message: fmt.Sprintf(format, args...)}
+	}
+	reader := multipart.NewReader(c.Request().Body, params["boundary"])
+	var question, modelName string
+	var files []model.AskFile
+	for {
+		part, err := reader.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			return tooLarge
+		}
+		if err != nil {
+			return invalid("Invalid multipart body: %v", err)
+		}
+		content, err := io.ReadAll(part)
+		if errors.As(err, &maxErr) {
+			return tooLarge
+		}
+		if err != nil {
+			return invalid("Invalid multipart body: %v", err)
+		}
+		if part.FileName() != "" {
+			files = append(files, model.AskFile{Name: part.FileName(), Content: string(content)})
+			continue
+		}
+		switch part.FormName() {
+		case "request":
+			if err := json.Unmarshal(content, req); err != nil {
+				return &BindError{Status: http.StatusBadRequest, Code: BindCodeInvalidJSON, Message: decodeMessage(err)}
+			}
+		case "question":
+			question = string(content)
+		case "model":
+			modelName = string(content)
+		default:
+			return invalid("Unknown form field %q; send the request as JSON in a \"request\" field", part.FormName())
+		}
+	}
+	if question != "" {
+		req.Question = question
+	}
+	if modelName != "" {
+		req.Model = modelName
+	}
+	req.Files = append(req.Files, files...)
+	return nil
+}
+
+// attachFiles checks the files of req and makes the question refer to them.
+// Files the question already names as @files/<name> are not named again.
+func attachFiles(req *model.AskRequest) error {
+	if len(req.Files) == 0 {
+		return nil
+	}
+	seen := map[string]bool{}
+	var references []string
+	for i, file := range req.Files {
+		name := strings.TrimSpace(file.Name)
+		if !askFileName.MatchString(name) || path.Clean(name) != name {
+			return fmt.Errorf("files[%d].name %q must be a relative path of letters, digits, '.', '_', '-' and '/'", i, file.Name)
+		}
+		if seen[name] {
+			return fmt.Errorf("files[%d].name %q is used twice", i, name)
+		}
+		if !utf8.ValidString(file.Content) {
+			return fmt.Errorf("files[%d] %s is not UTF-8 text", i, name)
+		}
+		seen[name] = true
+		req.Files[i].Name = name
+		if reference := "@" + askFilesDir + "/" + name; !strings.Contains(req.Question, reference) {
+			references = append(references, reference)
+		}
+	}
+	if len(references) > 0 {
+		req.Question += "\n\nAttached files: " + strings.Join(references, " ")
+	}
+	return nil
+}
+
+// fileAttachments returns the files of req as attachments of the CLI
+// workspace.
+func fileAttachments(files []model.AskFile) []model.Attachment {
+	if len(files) == 0 {
+		return nil
+	}
+	attachments := make([]model.Attachment, 0, len(files))
+	for _, file := range files {
+		attachments = append(attachments, model.Attachment{Name: askFilesDir + "/" + file.Name, MimeType: "text/plain", Data: []byte(file.Content)})
+	}
+	return attachments
+}
@@ -0,0 +1,93 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"gemini-wrapper/model"
+	"gemini-wrapper/pkg/gemini"
+	"gemini-wrapper/service/audit"
+
+	"github.com/labstack/echo/v5"
+)
+
+type AuditHandler struct {
+	log     *audit.Log
+	service *gemini.GeminiService
+}
+
+func NewAuditHandler(log *audit.Log, service *gemini.GeminiService) *AuditHandler {
+	return &AuditHandler{log: log, service: service}
+}
+
+// Export handles GET /admin/audit. It streams the entries as JSON Lines; the
+// optional query parameters from and to (RFC 3339 or YYYY-MM-DD, UTC, last
+// 24 hours by default) and client select them.
+func (h *AuditHandler) Export(c *echo.Context) error {
+	query := audit.Query{To: time.Now(), Client: c.QueryParam("client")}
+	if raw := c.QueryParam("to"); raw != "" {
+		to, err := parseReportTime(raw)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("invalid to: %v", err)})
+		}
+		query.To = to
+	}
+	query.From = query.To.Add(-24 * time.Hour)
+	if raw := c.QueryParam("from"); raw != "" {
+		from, err := parseReportTime(raw)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("invalid from: %v", err)})
+		}
+		query.From = from
+	}
+	if !query.From.Before(query.To) {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "from must be before to"})
+	}
+
+	c.Response().Header().Set(echo.HeaderContentType, "application/x-ndjson")
+	c.Response().WriteHeader(http.StatusOK)
+	if _, err := h.log.Export(c.Response(), query); err != nil {
+		// The status is already sent; the truncated export is all we can do.
+		slog.WarnContext(c.Request().Context(), "audit export failed", "error", err)
+	}
+	return nil
+}
+
+// Replay handles POST /admin/audit/:id/replay. It asks the prompt of the
+// entry again with the model that answered it, bypassing the cache, and
+// answers with an audit.Replay comparing both answers. The replay is not
+// written to the audit log.
+func (h *AuditHandler) Replay(c *echo.Context) error {
+	if h.service == nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "service not initialized"})
+	}
+	original, err := h.log.Find(c.Param("id"))
+	if errors.Is(err, audit.ErrNotFound) {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": err.Error()})
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+
+	start := time.Now()
+	answer, status, err := h.service.AskWithOptions(c.Request().Context(), original.Prompt, model.AskOptions{Model: original.Model, NoCache: true})
+	replayed := audit.Entry{
+		Time:          start.UTC(),
+		Model:         original.Model,
+		Prompt:        original.Prompt,
+		Answer:        answer,
+		Status:        http.StatusOK,
+		LatencyMillis: time.Since(start).Milliseconds(),
+		Usage:         usageOf(status),
+	}
+	if status != nil && status.Model != "" {
+		replayed.Model = status.Model
+	}
+	if err != nil {
+		replayed.Answer, replayed.Error, replayed.Status = "", err.Error(), askErrorCode(status)
+	}
+	return c.JSON(http.StatusOK, audit.Compare(original, replayed))
+}
@@ -0,0 +1,97 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"gemini-wrapper/model"
+
+	"github.com/labstack/echo/v5"
+)
+
+// maxBatchSize caps the questions of one /api/ask/batch request.
+const maxBatchSize = 50
+
+// HandleAskBatch handles POST /api/ask/batch. Questions run concurrently, at
+// most one per pool worker so a batch does not fill the queue on its own, and
+// the results come back in request order. A failed question is reported in
+// its own result; the response is 200 unless the request itself is invalid.
+func (g *GeminiHandler) HandleAskBatch(c *echo.Context) error {
+	if g == nil || g.service == nil {
+		return c.JSON(http.StatusInternalServerError, model.AskResponse{Error: "service not initialized"})
+	}
+
+	req := new(model.BatchAskRequest)
+	if err := c.Bind(req); err != nil {
+		failure := bindFailure(err, "Invalid request format")
+		return c.JSON(failure.Status, model.AskResponse{Error: failure.Message})
+	}
+	if len(req.Questions) == 0 {
+		return c.JSON(http.StatusBadRequest, model.AskResponse{Error: "questions must not be empty"})
+	}
+	if len(req.Questions) > maxBatchSize {
+		return c.JSON(http.StatusBadRequest, model.AskResponse{Error: fmt.Sprintf("at most %d questions per batch", maxBatchSize)})
+	}
+
+	ctx := c.Request().Context()
+	results := make([]model.AskResponse, len(req.Questions))
+	slots := make(chan struct{}, max(g.service.PoolStats().Size, 1))
+	var wg sync.WaitGroup
+	for i := range req.Questions {
+		item := &req.Questions[i]
+		if err := applyTemplate(g.templates, item); err != nil {
+			results[i] = model.AskResponse{Error: err.Error(), Status: &model.GeminiStatus{HTTPStatus: http.StatusBadRequest, Message: err.Error()}}
+			continue
+		}
+		item.Question = strings.TrimSpace(item.Question)
+		if message := validateBatchItem(item); message != "" {
+			results[i] = model.AskResponse{Error: message, Status: &model.GeminiStatus{HTTPStatus: http.StatusBadRequest, Message: message}}
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			if code, err := g.applyURLs(ctx, item); err != nil {
+				results[i] = model.AskResponse{Error: err.Error(), Code: urlFailureCode(code), Status: &model.GeminiStatus{HTTPStatus: code, Message: err.Error()}}
+				return
+			}
+			opts := askOptions(item)
+			if opts.Priority == "" {
+				// Batches wait behind interactive requests unless they ask otherwise.
+				opts.Priority = model.PriorityLow
+			}
+			answer, status, err := g.service.AskWithOptions(ctx, item.Question, opts)
+			if err != nil {
+				results[i] = model.AskResponse{Error: err.Error(), Code: failureCode(status), Status: status}
+				return
+			}
+			results[i] = model.AskResponse{Answer: answer, Usage: usageOf(status), Status: status, ToolEvents: toolEventsOf(status), Citations: citationsOf(status), Artifacts: artifactsOf(status)}
+		}()
+	}
+	wg.Wait()
+
+	return c.JSON(http.StatusOK, model.BatchAskResponse{Results: results})
+}
+
+func validateBatchItem(item *model.AskRequest) string {
+	switch {
+	case item.Question == "":
+		return "Question is required"
+	case item.TimeoutSeconds < 0:
+		return "timeout_seconds must not be negative"
+	case item.Stream:
+		return "stream is not supported in a batch"
+	case item.DryRun:
+		return "dry_run is not supported in a batch"
+	}
+	if err := attachFiles(item); err != nil {
+		return err.Error()
+	}
+	return ""
+}
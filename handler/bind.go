@@ -0,0 +1,188 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/labstack/echo/v5"
+)
+
+// Codes of a BindError, used by the APIs whose errors carry one.
+const (
+	BindCodeInvalidJSON      = "invalid_json"
+	BindCodeInvalidValue     = "invalid_value"
+	BindCodeUnsupportedMedia = "unsupported_media_type"
+	BindCodeTooLarge         = "request_too_large"
+)
+
+// BindError is returned by Binder when a request body cannot be used. Status
+// is the HTTP status to answer with.
+type BindError struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *BindError) Error() string {
+	return e.Message
+}
+
+// Binder decodes JSON request bodies and enforces the `validate` tags of the
+// target struct. Bodies must be JSON (415 otherwise; a missing Content-Type
+// is taken as JSON). Bodies cut short by the LimitBody middleware, or
+// announced longer than MaxBodyBytes, are answered with 413.
+type Binder struct {
+	MaxBodyBytes int64
+	validate     *validator.Validate
+}
+
+func NewBinder(maxBodyBytes int64) *Binder {
+	validate := validator.New(validator.WithRequiredStructEnabled())
+	validate.RegisterTagNameFunc(func(field reflect.StructField) string {
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			return ""
+		}
+		if name == "" {
+			return field.Name
+		}
+		return name
+	})
+	return &Binder{MaxBodyBytes: maxBodyBytes, validate: validate}
+}
+
+func (b *Binder) Bind(c *echo.Context, target any) error {
+	req := c.Request()
+	if req.ContentLength != 0 {
+		mediaType, _, _ := mime.ParseMediaType(req.Header.Get(echo.HeaderContentType))
+		switch mediaType {
+		case echo.MIMEApplicationJSON:
+		case "":
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		default:
+			return &BindError{Status: http.StatusUnsupportedMediaType, Code: BindCodeUnsupportedMedia, Message: fmt.Sprintf("Content-Type %s is not supported; send application/json", mediaType)}
+		}
+		if b.MaxBodyBytes > 0 && req.ContentLength > b.MaxBodyBytes {
+			return b.tooLarge()
+		}
+	}
+	if err := (&echo.DefaultBinder{}).Bind(c, target); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return b.tooLarge()
+		}
+		return &BindError{Status: http.StatusBadRequest, Code: BindCodeInvalidJSON, Message: decodeMessage(err)}
+	}
+	return b.Validate(target)
+}
+
+// Validate checks the `validate` tags of target, which is skipped unless it
+// is a struct or a pointer to one.
+func (b *Binder) Validate(target any) error {
+	value := reflect.ValueOf(target)
+	for value.Kind() == reflect.Pointer {
+		value = value.Elem()
+	}
+	if value.Kind() != reflect.Struct {
+		return nil
+	}
+	err := b.validate.Struct(target)
+	var fieldErrs validator.ValidationErrors
+	if !errors.As(err, &fieldErrs) {
+		return err
+	}
+	problems := make([]string, 0, len(fieldErrs))
+	for _, fieldErr := range fieldErrs {
+		problems = append(problems, fieldProblem(fieldErr))
+	}
+	return &BindError{Status: http.StatusBadRequest, Code: BindCodeInvalidValue, Message: strings.Join(problems, "; ")}
+}
+
+func (b *Binder) tooLarge() *BindError {
+	return &BindError{Status: http.StatusRequestEntityTooLarge, Code: BindCodeTooLarge, Message: fmt.Sprintf("Request body is larger than %d bytes", b.MaxBodyBytes)}
+}
+
+// fieldProblem describes a failed validation with the field's JSON path, for
+// example "generateContentRequest.contents is required".
+func fieldProblem(fieldErr validator.FieldError) string {
+	field := jsonPath(fieldErr.Namespace())
+	switch fieldErr.Tag() {
+	case "required", "required_without", "required_with":
+		return field + " is required"
+	case "gte", "min":
+		return fmt.Sprintf("%s must be at least %s", field, fieldErr.Param())
+	case "lte", "max":
+		return fmt.Sprintf("%s must be at most %s", field, fieldErr.Param())
+	case "oneof":
+		return fmt.Sprintf("%s must be one of: %s", field, strings.ReplaceAll(fieldErr.Param(), " ", ", "))
+	}
+	return fmt.Sprintf("%s is invalid (%s)", field, fieldErr.Tag())
+}
+
+// jsonPath drops the Go names from a validator namespace: the target type
+// and embedded structs, which have no JSON name of their own. JSON names in
+// this API never start with an upper-case letter.
+func jsonPath(namespace string) string {
+	segments := strings.Split(namespace, ".")
+	path := segments[:0]
+	for _, segment := range segments {
+		if r, _ := utf8.DecodeRuneInString(segment); !unicode.IsUpper(r) {
+			path = append(path, segment)
+		}
+	}
+	return strings.Join(path, ".")
+}
+
+// decodeMessage explains why a body is not valid JSON for the target.
+func decodeMessage(err error) string {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		if typeErr.Field == "" {
+			return fmt.Sprintf("Invalid JSON body: expected %s, not %s", jsonKind(typeErr.Type), typeErr.Value)
+		}
+		return fmt.Sprintf("Invalid JSON body: %s must be %s, not %s", typeErr.Field, jsonKind(typeErr.Type), typeErr.Value)
+	}
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		return fmt.Sprintf("Invalid JSON body: %s at offset %d", syntaxErr.Error(), syntaxErr.Offset)
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return "Invalid JSON body: unexpected end of input"
+	}
+	return "Invalid JSON body"
+}
+
+func jsonKind(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.String:
+		return "a string"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	case reflect.Map, reflect.Struct:
+		return "an object"
+	case reflect.Pointer:
+		return jsonKind(t.Elem())
+	}
+	return "a number"
+}
+
+// bindFailure returns what to answer a failed Bind with. Errors that did not
+// come from Binder become a 400 with fallback as the message.
+func bindFailure(err error, fallback string) *BindError {
+	var bindErr *BindError
+	if errors.As(err, &bindErr) {
+		return bindErr
+	}
+	return &BindError{Status: http.StatusBadRequest, Code: BindCodeInvalidJSON, Message: fallback}
+}
@@ -0,0 +1,106 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	rpprof "runtime/pprof"
+	"strings"
+	"time"
+
+	"gemini-wrapper/model"
+	"gemini-wrapper/pkg/gemini"
+	"gemini-wrapper/service/session"
+
+	"github.com/labstack/echo/v5"
+)
+
+// DebugHandler serves the profiles and state dumps under /debug, for
+// investigating memory growth and stuck requests in a running server.
+type DebugHandler struct {
+	service  *gemini.GeminiService
+	sessions *session.Manager
+}
+
+func NewDebugHandler(service *gemini.GeminiService, sessions *session.Manager) *DebugHandler {
+	return &DebugHandler{service: service, sessions: sessions}
+}
+
+// memoryStats is the part of runtime.MemStats worth watching for growth.
+type memoryStats struct {
+	HeapAlloc    uint64 `json:"heapAlloc"`
+	HeapInuse    uint64 `json:"heapInuse"`
+	HeapObjects  uint64 `json:"heapObjects"`
+	Sys          uint64 `json:"sys"`
+	NumGC        uint32 `json:"numGC"`
+	PauseTotalNs uint64 `json:"pauseTotalNs"`
+}
+
+// debugState is the dump of GET /debug/state.
+type debugState struct {
+	Time       time.Time              `json:"time"`
+	Goroutines int                    `json:"goroutines"`
+	Memory     memoryStats            `json:"memory"`
+	Backend    *gemini.BackendState   `json:"backend,omitempty"`
+	Queue      []gemini.QueuedRequest `json:"queue"`
+	Sessions   []model.SessionInfo    `json:"sessions"`
+	// Stacks is the goroutine profile, with ?goroutines=true.
+	Stacks string `json:"stacks,omitempty"`
+}
+
+// State handles GET /debug/state: the goroutine count, memory, backend,
+// request queue and sessions. ?goroutines=true adds the stack of every
+// goroutine.
+func (h *DebugHandler) State(c *echo.Context) error {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	state := debugState{
+		Time:       time.Now().UTC(),
+		Goroutines: runtime.NumGoroutine(),
+		Memory: memoryStats{
+			HeapAlloc:    mem.HeapAlloc,
+			HeapInuse:    mem.HeapInuse,
+			HeapObjects:  mem.HeapObjects,
+			Sys:          mem.Sys,
+			NumGC:        mem.NumGC,
+			PauseTotalNs: mem.PauseTotalNs,
+		},
+		Queue:    []gemini.QueuedRequest{},
+		Sessions: []model.SessionInfo{},
+	}
+	if h.service != nil {
+		backend := h.service.BackendState()
+		state.Backend = &backend
+		state.Queue = h.service.Queue()
+	}
+	if h.sessions != nil {
+		state.Sessions = h.sessions.List()
+	}
+	if c.QueryParam("goroutines") == "true" {
+		var stacks strings.Builder
+		if err := rpprof.Lookup("goroutine").WriteTo(&stacks, 1); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		}
+		state.Stacks = stacks.String()
+	}
+	return c.JSON(http.StatusOK, state)
+}
+
+// Pprof handles /debug/pprof/*: the index, the named profiles and the CPU
+// profile and trace of net/http/pprof.
+func (h *DebugHandler) Pprof(c *echo.Context) error {
+	name := strings.TrimPrefix(c.Request().URL.Path, "/debug/pprof/")
+	switch name {
+	case "cmdline":
+		pprof.Cmdline(c.Response(), c.Request())
+	case "profile":
+		pprof.Profile(c.Response(), c.Request())
+	case "symbol":
+		pprof.Symbol(c.Response(), c.Request())
+	case "trace":
+		pprof.Trace(c.Response(), c.Request())
+	default:
+		pprof.Index(c.Response(), c.Request())
+	}
+	return nil
+}
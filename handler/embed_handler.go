@@ -0,0 +1,116 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"gemini-wrapper/model"
+	"gemini-wrapper/service/embeddings"
+	"gemini-wrapper/service/geminiapi"
+
+	"github.com/labstack/echo/v5"
+)
+
+// HandleEmbed handles POST /api/embed. It takes one text or several and
+// returns their embeddings in order. Like the Ollama endpoint of the same
+// name, it reads JSON whatever the Content-Type.
+func (g *GeminiHandler) HandleEmbed(c *echo.Context) error {
+	if g == nil || g.embeddings == nil {
+		return c.JSON(http.StatusInternalServerError, model.EmbedResponse{Error: "service not initialized"})
+	}
+
+	req := new(model.EmbedRequest)
+	if err := decodeOllamaRequest(c, req); err != nil {
+		return c.JSON(http.StatusBadRequest, model.EmbedResponse{Error: "Invalid request format"})
+	}
+	texts := append(req.Texts, req.Input...)
+	if strings.TrimSpace(req.Text) != "" {
+		texts = append([]string{req.Text}, texts...)
+	}
+	if len(texts) == 0 {
+		return c.JSON(http.StatusBadRequest, model.EmbedResponse{Error: "text, texts or input is required"})
+	}
+
+	requests := make([]model.EmbedContentRequest, len(texts))
+	for i, text := range texts {
+		requests[i] = model.EmbedContentRequest{
+			Content:              model.GeminiContent{Parts: []model.GeminiPart{{Text: text}}},
+			TaskType:             req.TaskType,
+			OutputDimensionality: req.Dimensions,
+		}
+	}
+	result, err := g.embeddings.Embed(c.Request().Context(), req.Model, requests)
+	if err != nil {
+		return c.JSON(embedErrorCode(err), model.EmbedResponse{Error: err.Error()})
+	}
+	vectors := make([][]float32, len(result))
+	for i, embedding := range result {
+		vectors[i] = embedding.Values
+	}
+	return c.JSON(http.StatusOK, model.EmbedResponse{Model: g.embeddings.Model(req.Model), Embeddings: vectors})
+}
+
+// embedContent serves the embedContent action.
+func (g *GeminiHandler) embedContent(c *echo.Context, modelName string) error {
+	var req model.EmbedContentRequest
+	if err := c.Bind(&req); err != nil {
+		failure := bindFailure(err, "Invalid request body")
+		return c.JSON(failure.Status, geminiapi.NewError(failure.Status, failure.Message))
+	}
+	result, err := g.embeddings.Embed(c.Request().Context(), modelName, []model.EmbedContentRequest{req})
+	if err != nil {
+		return writeEmbedError(c, err)
+	}
+	return c.JSON(http.StatusOK, model.EmbedContentResponse{Embedding: result[0]})
+}
+
+// batchEmbedContents serves the batchEmbedContents action. Like the Gemini
+// API, it wants every request to name the model of the URL, if any.
+func (g *GeminiHandler) batchEmbedContents(c *echo.Context, modelName string) error {
+	var req model.BatchEmbedContentsRequest
+	if err := c.Bind(&req); err != nil {
+		failure := bindFailure(err, "Invalid request body")
+		return c.JSON(failure.Status, geminiapi.NewError(failure.Status, failure.Message))
+	}
+	for i, entry := range req.Requests {
+		if entry.Model != "" && g.embeddings.Model(entry.Model) != g.embeddings.Model(modelName) {
+			message := fmt.Sprintf("requests[%d].model must be models/%s", i, g.embeddings.Model(modelName))
+			return c.JSON(http.StatusBadRequest, geminiapi.NewError(http.StatusBadRequest, message))
+		}
+	}
+	result, err := g.embeddings.Embed(c.Request().Context(), modelName, req.Requests)
+	if err != nil {
+		return writeEmbedError(c, err)
+	}
+	return c.JSON(http.StatusOK, model.BatchEmbedContentsResponse{Embeddings: result})
+}
+
+func writeEmbedError(c *echo.Context, err error) error {
+	code := embedErrorCode(err)
+	var apiErr *embeddings.APIError
+	if errors.As(err, &apiErr) {
+		// Pass the API's own message on, as the Gemini API would answer it.
+		resp := geminiapi.NewError(code, apiErr.Message)
+		if apiErr.Status != "" {
+			resp.Error.Status = apiErr.Status
+		}
+		return c.JSON(code, resp)
+	}
+	return c.JSON(code, geminiapi.NewError(code, err.Error()))
+}
+
+// embedErrorCode maps an Embed error onto an HTTP status.
+func embedErrorCode(err error) int {
+	var apiErr *embeddings.APIError
+	switch {
+	case errors.Is(err, embeddings.ErrInvalidRequest):
+		return http.StatusBadRequest
+	case errors.Is(err, embeddings.ErrNotConfigured):
+		return http.StatusNotImplemented
+	case errors.As(err, &apiErr):
+		return apiErr.Code
+	}
+	return http.StatusBadGateway
+}
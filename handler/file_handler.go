@@ -0,0 +1,237 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"gemini-wrapper/model"
+	"gemini-wrapper/service/files"
+	"gemini-wrapper/service/geminiapi"
+
+	"github.com/labstack/echo/v5"
+)
+
+// Headers of the resumable upload protocol the Gemini SDKs use.
+const (
+	headerUploadProtocol      = "X-Goog-Upload-Protocol"
+	headerUploadCommand       = "X-Goog-Upload-Command"
+	headerUploadOffset        = "X-Goog-Upload-Offset"
+	headerUploadURL           = "X-Goog-Upload-URL"
+	headerUploadStatus        = "X-Goog-Upload-Status"
+	headerUploadSizeReceived  = "X-Goog-Upload-Size-Received"
+	headerUploadContentLength = "X-Goog-Upload-Header-Content-Length"
+	headerUploadContentType   = "X-Goog-Upload-Header-Content-Type"
+)
+
+// FileHandler serves the Gemini Files API.
+type FileHandler struct {
+	store *files.Store
+}
+
+func NewFileHandler(store *files.Store) *FileHandler {
+	return &FileHandler{store: store}
+}
+
+// UploadFile handles POST /upload/v1beta/files. It takes resumable uploads
+// as the SDKs make them, multipart uploads of metadata and content, and raw
+// uploads whose body is the file. Resumable uploads continue on the URL the
+// start request answers with.
+func (h *FileHandler) UploadFile(c *echo.Context) error {
+	if uploadID := c.QueryParam("upload_id"); uploadID != "" {
+		return h.continueUpload(c, uploadID)
+	}
+	req := c.Request()
+	if strings.EqualFold(req.Header.Get(headerUploadProtocol), "resumable") {
+		return h.startUpload(c)
+	}
+	mediaType, params, _ := mime.ParseMediaType(req.Header.Get(echo.HeaderContentType))
+	if strings.HasPrefix(mediaType, "multipart/") {
+		return h.multipartUpload(c, params["boundary"])
+	}
+	meta := files.Metadata{MimeType: mediaType, Size: max(0, req.ContentLength)}
+	file, err := h.store.Create(meta, req.Body)
+	if err != nil {
+		return writeFileError(c, err)
+	}
+	return c.JSON(http.StatusOK, model.GeminiFileResponse{File: withFileURI(c, file)})
+}
+
+func (h *FileHandler) startUpload(c *echo.Context) error {
+	req := c.Request()
+	var body model.UploadFileRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+		return c.JSON(http.StatusBadRequest, geminiapi.NewError(http.StatusBadRequest, "Invalid upload metadata"))
+	}
+	meta := uploadMetadata(body)
+	if mimeType := req.Header.Get(headerUploadContentType); mimeType != "" {
+		meta.MimeType = mimeType
+	}
+	if raw := req.Header.Get(headerUploadContentLength); raw != "" {
+		size, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || size < 0 {
+			return c.JSON(http.StatusBadRequest, geminiapi.NewError(http.StatusBadRequest, "Invalid "+headerUploadContentLength))
+		}
+		meta.Size = size
+	}
+	uploadID, err := h.store.StartUpload(meta)
+	if err != nil {
+		return writeFileError(c, err)
+	}
+	header := c.Response().Header()
+	header.Set(headerUploadURL, baseURL(c)+"/upload/v1beta/files?upload_id="+uploadID+"&upload_protocol=resumable")
+	header.Set(headerUploadStatus, "active")
+	return c.NoContent(http.StatusOK)
+}
+
+func (h *FileHandler) continueUpload(c *echo.Context, uploadID string) error {
+	req := c.Request()
+	header := c.Response().Header()
+	commands := map[string]bool{}
+	for _, command := range strings.Split(req.Header.Get(headerUploadCommand), ",") {
+		commands[strings.ToLower(strings.TrimSpace(command))] = true
+	}
+	switch {
+	case commands["cancel"]:
+		h.store.CancelUpload(uploadID)
+		header.Set(headerUploadStatus, "cancelled")
+		return c.NoContent(http.StatusOK)
+	case commands["query"]:
+		received, err := h.store.UploadStatus(uploadID)
+		if err != nil {
+			return writeFileError(c, err)
+		}
+		header.Set(headerUploadStatus, "active")
+		header.Set(headerUploadSizeReceived, strconv.FormatInt(received, 10))
+		return c.NoContent(http.StatusOK)
+	case !commands["upload"] && !commands["finalize"]:
+		return c.JSON(http.StatusBadRequest, geminiapi.NewError(http.StatusBadRequest, "Unsupported "+headerUploadCommand))
+	}
+
+	var offset int64
+	if raw := req.Header.Get(headerUploadOffset); raw != "" {
+		parsed, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, geminiapi.NewError(http.StatusBadRequest, "Invalid "+headerUploadOffset))
+		}
+		offset = parsed
+	} else if !commands["upload"] {
+		// A bare finalize continues where the upload stands.
+		received, err := h.store.UploadStatus(uploadID)
+		if err != nil {
+			return writeFileError(c, err)
+		}
+		offset = received
+	}
+	var body io.Reader = req.Body
+	if !commands["upload"] {
+		body = strings.NewReader("")
+	}
+	received, file, err := h.store.WriteChunk(uploadID, offset, body, commands["finalize"])
+	if err != nil {
+		header.Set(headerUploadSizeReceived, strconv.FormatInt(received, 10))
+		return writeFileError(c, err)
+	}
+	if !commands["finalize"] {
+		header.Set(headerUploadStatus, "active")
+		header.Set(headerUploadSizeReceived, strconv.FormatInt(received, 10))
+		return c.NoContent(http.StatusOK)
+	}
+	header.Set(headerUploadStatus, "final")
+	return c.JSON(http.StatusOK, model.GeminiFileResponse{File: withFileURI(c, file)})
+}
+
+// multipartUpload reads a multipart/related upload: the JSON metadata, then
+// the file.
+func (h *FileHandler) multipartUpload(c *echo.Context, boundary string) error {
+	if boundary == "" {
+		return c.JSON(http.StatusBadRequest, geminiapi.NewError(http.StatusBadRequest, "Missing multipart boundary"))
+	}
+	reader := multipart.NewReader(c.Request().Body, boundary)
+	part, err := reader.NextPart()
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, geminiapi.NewError(http.StatusBadRequest, "Missing upload metadata"))
+	}
+	var body model.UploadFileRequest
+	if err := json.NewDecoder(part).Decode(&body); err != nil {
+		return c.JSON(http.StatusBadRequest, geminiapi.NewError(http.StatusBadRequest, "Invalid upload metadata"))
+	}
+	part, err = reader.NextPart()
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, geminiapi.NewError(http.StatusBadRequest, "Missing file content"))
+	}
+	meta := uploadMetadata(body)
+	if mediaType, _, err := mime.ParseMediaType(part.Header.Get(echo.HeaderContentType)); err == nil {
+		meta.MimeType = mediaType
+	}
+	file, err := h.store.Create(meta, part)
+	if err != nil {
+		return writeFileError(c, err)
+	}
+	return c.JSON(http.StatusOK, model.GeminiFileResponse{File: withFileURI(c, file)})
+}
+
+// ListFiles handles GET /v1beta/files.
+func (h *FileHandler) ListFiles(c *echo.Context) error {
+	list := h.store.List()
+	for i := range list {
+		list[i] = withFileURI(c, list[i])
+	}
+	return c.JSON(http.StatusOK, model.GeminiFileListResponse{Files: list})
+}
+
+// GetFile handles GET /v1beta/files/:name.
+func (h *FileHandler) GetFile(c *echo.Context) error {
+	file, err := h.store.Get(c.Param("name"))
+	if err != nil {
+		return writeFileError(c, err)
+	}
+	return c.JSON(http.StatusOK, withFileURI(c, file))
+}
+
+// DeleteFile handles DELETE /v1beta/files/:name.
+func (h *FileHandler) DeleteFile(c *echo.Context) error {
+	if err := h.store.Delete(c.Param("name")); err != nil {
+		return writeFileError(c, err)
+	}
+	return c.JSON(http.StatusOK, struct{}{})
+}
+
+func uploadMetadata(body model.UploadFileRequest) files.Metadata {
+	meta := files.Metadata{DisplayName: body.File.DisplayName, MimeType: body.File.MimeType}
+	if meta.DisplayName == "" {
+		meta.DisplayName = body.File.DisplayNameSnake
+	}
+	return meta
+}
+
+// withFileURI sets the URI clients refer to file by in prompts.
+func withFileURI(c *echo.Context, file model.GeminiFile) model.GeminiFile {
+	file.URI = baseURL(c) + "/v1beta/" + file.Name
+	return file
+}
+
+// baseURL is the wrapper's address as the client reached it.
+func baseURL(c *echo.Context) string {
+	return c.Scheme() + "://" + c.Request().Host
+}
+
+func writeFileError(c *echo.Context, err error) error {
+	code := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, files.ErrFileNotFound), errors.Is(err, files.ErrUploadNotFound):
+		code = http.StatusNotFound
+	case errors.Is(err, files.ErrInvalidOffset), errors.Is(err, files.ErrSizeMismatch):
+		code = http.StatusBadRequest
+	case errors.Is(err, files.ErrTooLarge):
+		code = http.StatusRequestEntityTooLarge
+	case errors.Is(err, files.ErrStorageFull):
+		code = http.StatusTooManyRequests
+	}
+	return c.JSON(code, geminiapi.NewError(code, err.Error()))
+}
@@ -0,0 +1,164 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+
+	"gemini-wrapper/model"
+	"gemini-wrapper/pkg/gemini"
+	"gemini-wrapper/service/geminiapi"
+
+	"github.com/labstack/echo/v5"
+)
+
+// askCandidates asks the question once per candidate, in parallel. The
+// first failure cancels the other candidates and is returned with its
+// status.
+func (g *GeminiHandler) askCandidates(ctx context.Context, question string, candidates []model.AskOptions) ([]string, []*model.GeminiStatus, *model.GeminiStatus, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	answers := make([]string, len(candidates))
+	statuses := make([]*model.GeminiStatus, len(candidates))
+	errs := make([]error, len(candidates))
+	var wg sync.WaitGroup
+	for i, opts := range candidates {
+		wg.Go(func() {
+			answers[i], statuses[i], errs[i] = g.service.AskWithOptions(ctx, question, opts)
+			if errs[i] != nil {
+				cancel()
+			}
+		})
+	}
+	wg.Wait()
+	if i := firstFailure(errs); i >= 0 {
+		return nil, nil, statuses[i], errs[i]
+	}
+	return answers, statuses, nil, nil
+}
+
+// firstFailure returns the index of the error that failed a set of
+// candidates, rather than of one cancelled because of it, or -1.
+func firstFailure(errs []error) int {
+	failed := -1
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, context.Canceled) {
+			return i
+		}
+		if failed < 0 {
+			failed = i
+		}
+	}
+	return failed
+}
+
+// generateCandidates answers generateContent with every candidate the
+// request asks for.
+func (g *GeminiHandler) generateCandidates(c *echo.Context, req model.GeminiAPIRequest, question string, candidates []model.AskOptions, stream bool) error {
+	modelName := candidates[0].Model
+	answers, statuses, failed, err := g.askCandidates(c.Request().Context(), question, candidates)
+	if err != nil {
+		code := askErrorCode(failed)
+		return c.JSON(code, geminiapi.NewError(code, err.Error()))
+	}
+
+	resp := buildGeminiAPIResponseParts(modelName, geminiapi.AnswerParts(answers[0], req), finishReasonFor(statuses[0]), statuses[0])
+	for i := 1; i < len(answers); i++ {
+		resp.Candidates = append(resp.Candidates, geminiCandidate(i, withThoughtPart(geminiapi.AnswerParts(answers[i], req), statuses[i]), finishReasonFor(statuses[i])))
+	}
+	resp.UsageMetadata = candidatesUsage(statuses)
+	if !stream {
+		return c.JSON(http.StatusOK, resp)
+	}
+	out, err := newGenerateContentStream(c, c.QueryParam("alt") == "sse")
+	if err != nil {
+		return err
+	}
+	if err := out.Send(resp); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// streamCandidates streams every candidate the request asks for at once.
+// Each element carries the chunks of one candidate, told apart by index;
+// the last element finishes all of them.
+func (g *GeminiHandler) streamCandidates(c *echo.Context, question string, candidates []model.AskOptions) error {
+	modelName := candidates[0].Model
+	stream, err := newGenerateContentStream(c, c.QueryParam("alt") == "sse")
+	if err != nil {
+		return err
+	}
+
+	ctx, progress := gemini.WithProgress(c.Request().Context())
+	stop := heartbeat(g.heartbeat, func() error { return stream.KeepAlive(progress) })
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// Each candidate holds back one chunk so the last one can carry its
+	// finishReason.
+	pending := make([]string, len(candidates))
+	statuses := make([]*model.GeminiStatus, len(candidates))
+	errs := make([]error, len(candidates))
+	var wg sync.WaitGroup
+	for i, opts := range candidates {
+		wg.Go(func() {
+			_, statuses[i], errs[i] = g.service.AskStreamWithOptions(ctx, question, opts, func(chunk string) error {
+				if pending[i] != "" {
+					resp := model.GeminiAPIResponse{Model: modelName, Candidates: []model.GeminiCandidate{geminiCandidate(i, []model.GeminiPart{{Text: pending[i]}}, "")}}
+					if err := stream.Send(resp); err != nil {
+						return err
+					}
+				}
+				pending[i] = chunk
+				return nil
+			})
+			if errs[i] != nil {
+				cancel()
+			}
+		})
+	}
+	wg.Wait()
+	stop()
+	if i := firstFailure(errs); i >= 0 {
+		if sendErr := stream.Send(geminiapi.NewError(askErrorCode(statuses[i]), errs[i].Error())); sendErr != nil {
+			return sendErr
+		}
+		return stream.Close()
+	}
+
+	last := buildGeminiAPIResponse(modelName, pending[0], finishReasonFor(statuses[0]), statuses[0])
+	for i := 1; i < len(candidates); i++ {
+		last.Candidates = append(last.Candidates, geminiCandidate(i, withThoughtPart([]model.GeminiPart{{Text: pending[i]}}, statuses[i]), finishReasonFor(statuses[i])))
+	}
+	last.UsageMetadata = candidatesUsage(statuses)
+	if err := stream.Send(last); err != nil {
+		return err
+	}
+	return stream.Close()
+}
+
+// candidatesUsage adds up the usage of the candidates. The prompt is
+// counted once, as the Gemini API does for a request with several
+// candidates.
+func candidatesUsage(statuses []*model.GeminiStatus) *model.UsageMetadata {
+	var usage *model.UsageMetadata
+	for _, status := range statuses {
+		u := usageOf(status)
+		if u == nil {
+			continue
+		}
+		if usage == nil {
+			sum := *u
+			usage = &sum
+			continue
+		}
+		usage.CandidatesTokenCount += u.CandidatesTokenCount
+		usage.ThoughtsTokenCount += u.ThoughtsTokenCount
+		usage.TotalTokenCount += u.TotalTokenCount - u.PromptTokenCount
+	}
+	return usage
+}
@@ -1,20 +1,51 @@
 package handler
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"gemini-wrapper/model"
-	"gemini-wrapper/service/gemini/gemini_impl"
+	"gemini-wrapper/pkg/gemini"
+	"gemini-wrapper/service/embeddings"
+	"gemini-wrapper/service/execution"
+	"gemini-wrapper/service/files"
+	"gemini-wrapper/service/geminiapi"
+	"gemini-wrapper/service/templates"
+	"gemini-wrapper/service/urlcontext"
 	"net/http"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/labstack/echo/v5"
 )
 
 type GeminiHandler struct {
-	service *gemini_impl.GeminiService
+	service   *gemini.GeminiService
+	templates *templates.Store
+	// files resolves fileData parts naming uploaded files; nil when the
+	// Files API is disabled.
+	files      geminiapi.FileSource
+	embeddings *embeddings.Client
+	// pages fetches the urls of /api/ask questions.
+	pages *urlcontext.Fetcher
+	// passthrough forwards model actions the wrapper does not serve to the
+	// Gemini API; nil answers them with 404.
+	passthrough http.Handler
+	// heartbeat spaces the "progress" events of /api/ask/stream and the
+	// keep-alives of streamGenerateContent; 0 sends none.
+	heartbeat time.Duration
 }
 
-func NewGeminiHandler(service *gemini_impl.GeminiService) *GeminiHandler {
-	return &GeminiHandler{service: service}
+// NewGeminiHandler serves the Gemini endpoints. fileStore and passthrough may
+// be nil.
+func NewGeminiHandler(service *gemini.GeminiService, templates *templates.Store, fileStore *files.Store, embedder *embeddings.Client, pages *urlcontext.Fetcher, passthrough http.Handler, heartbeat time.Duration) *GeminiHandler {
+	h := &GeminiHandler{service: service, templates: templates, embeddings: embedder, pages: pages, passthrough: passthrough, heartbeat: heartbeat}
+	if fileStore != nil {
+		h.files = fileStore
+	}
+	return h
 }
 
 // HandleAsk handles POST /api/ask.
@@ -24,106 +55,503 @@ func (g *GeminiHandler) HandleAsk(c *echo.Context) error {
 	}
 
 	req := new(model.AskRequest)
-	if err := c.Bind(req); err != nil {
-		return c.JSON(http.StatusBadRequest, model.AskResponse{Error: "Invalid request format"})
+	if err := bindAskRequest(c, req); err != nil {
+		failure := bindFailure(err, "Invalid request format")
+		return c.JSON(failure.Status, model.AskResponse{Error: failure.Message})
+	}
+	if err := applyTemplate(g.templates, req); err != nil {
+		return c.JSON(http.StatusBadRequest, model.AskResponse{Error: err.Error()})
 	}
 
 	req.Question = strings.TrimSpace(req.Question)
 	if req.Question == "" {
 		return c.JSON(http.StatusBadRequest, model.AskResponse{Error: "Question is required"})
 	}
+	if req.TimeoutSeconds < 0 {
+		return c.JSON(http.StatusBadRequest, model.AskResponse{Error: "timeout_seconds must not be negative"})
+	}
+	if code, err := g.applyURLs(c.Request().Context(), req); err != nil {
+		return c.JSON(code, model.AskResponse{Error: err.Error(), Code: urlFailureCode(code)})
+	}
+	if err := attachFiles(req); err != nil {
+		return c.JSON(http.StatusBadRequest, model.AskResponse{Error: err.Error(), Code: model.ReasonInvalidRequest})
+	}
+	if req.DryRun {
+		return g.dryRun(c, req)
+	}
+
+	if req.Stream {
+		return g.streamAsk(c, req)
+	}
 
-	answer, status, err := g.service.Ask(req.Question, req.Model)
+	answer, status, err := g.service.AskWithOptions(c.Request().Context(), req.Question, askOptions(req))
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, model.AskResponse{Error: err.Error(), Status: status})
+		return c.JSON(askErrorCode(status), model.AskResponse{Error: err.Error(), Code: failureCode(status), Status: status})
 	}
 
-	return c.JSON(http.StatusOK, model.AskResponse{Answer: answer, Status: status})
+	return c.JSON(http.StatusOK, model.AskResponse{Answer: answer, Usage: usageOf(status), Status: status, ToolEvents: toolEventsOf(status), Citations: citationsOf(status), Artifacts: artifactsOf(status)})
 }
 
-// HandleGeminiAPI handles POST /v1beta/models/:model.
+// HandleAskStream handles POST /api/ask/stream.
+func (g *GeminiHandler) HandleAskStream(c *echo.Context) error {
+	if g == nil || g.service == nil {
+		return c.JSON(http.StatusInternalServerError, model.AskResponse{Error: "service not initialized"})
+	}
+
+	req := new(model.AskRequest)
+	if err := bindAskRequest(c, req); err != nil {
+		failure := bindFailure(err, "Invalid request format")
+		return c.JSON(failure.Status, model.AskResponse{Error: failure.Message})
+	}
+	if err := applyTemplate(g.templates, req); err != nil {
+		return c.JSON(http.StatusBadRequest, model.AskResponse{Error: err.Error()})
+	}
+
+	req.Question = strings.TrimSpace(req.Question)
+	if req.Question == "" {
+		return c.JSON(http.StatusBadRequest, model.AskResponse{Error: "Question is required"})
+	}
+	if req.TimeoutSeconds < 0 {
+		return c.JSON(http.StatusBadRequest, model.AskResponse{Error: "timeout_seconds must not be negative"})
+	}
+	if code, err := g.applyURLs(c.Request().Context(), req); err != nil {
+		return c.JSON(code, model.AskResponse{Error: err.Error(), Code: urlFailureCode(code)})
+	}
+	if err := attachFiles(req); err != nil {
+		return c.JSON(http.StatusBadRequest, model.AskResponse{Error: err.Error(), Code: model.ReasonInvalidRequest})
+	}
+	if req.DryRun {
+		return g.dryRun(c, req)
+	}
+
+	return g.streamAsk(c, req)
+}
+
+// CancelAsk handles POST /api/ask/:request_id/cancel: it stops the
+// questions of the client's request with that X-Request-Id and returns what
+// they had streamed so far. The cancelled request fails with code
+// "cancelled".
+func (g *GeminiHandler) CancelAsk(c *echo.Context) error {
+	if g == nil || g.service == nil {
+		return c.JSON(http.StatusInternalServerError, model.AskResponse{Error: "service not initialized"})
+	}
+	result, ok := g.service.CancelRequest(c.Param("request_id"), execution.Client(c.Request().Context()))
+	if !ok {
+		return c.JSON(http.StatusNotFound, model.AskResponse{Error: "No question in progress for this request ID"})
+	}
+	return c.JSON(http.StatusOK, result)
+}
+
+// dryRun answers an ask with dry_run: the prompt and settings the question
+// would be sent with, as JSON even on the streaming endpoint.
+func (g *GeminiHandler) dryRun(c *echo.Context, req *model.AskRequest) error {
+	result, status, err := g.service.DryRun(c.Request().Context(), req.Question, askOptions(req))
+	if err != nil {
+		return c.JSON(askErrorCode(status), model.AskResponse{Error: err.Error(), Code: failureCode(status), Status: status})
+	}
+	return c.JSON(http.StatusOK, result)
+}
+
+// streamAsk emits "chunk" events while the answer is produced, then a final
+// "done" (or "error") event carrying the complete AskResponse. A "progress"
+// event carrying a StreamProgress is sent every heartbeat.
+func (g *GeminiHandler) streamAsk(c *echo.Context, req *model.AskRequest) error {
+	stream, err := startSSE(c)
+	if err != nil {
+		return err
+	}
+
+	ctx, progress := gemini.WithProgress(c.Request().Context())
+	stop := heartbeat(g.heartbeat, func() error {
+		return stream.Event("progress", progress.Snapshot())
+	})
+	answer, status, err := g.service.AskStreamWithOptions(ctx, req.Question, askOptions(req), func(chunk string) error {
+		return stream.Event("chunk", model.AskStreamChunk{Text: chunk})
+	})
+	stop()
+	if err != nil {
+		return stream.Event("error", model.AskResponse{Error: err.Error(), Code: failureCode(status), Status: status})
+	}
+	return stream.Event("done", model.AskResponse{Answer: answer, Usage: usageOf(status), Status: status, ToolEvents: toolEventsOf(status), Citations: citationsOf(status), Artifacts: artifactsOf(status)})
+}
+
+// applyURLs puts the text of the pages at req.URLs before its question. It
+// returns the status code of a failure: 400 for URLs the server refuses,
+// 502 for pages it cannot fetch.
+func (g *GeminiHandler) applyURLs(ctx context.Context, req *model.AskRequest) (int, error) {
+	pages, err := g.pages.Fetch(ctx, req.URLs)
+	switch {
+	case errors.Is(err, urlcontext.ErrFetch):
+		return http.StatusBadGateway, err
+	case err != nil:
+		return http.StatusBadRequest, err
+	}
+	req.Question = urlcontext.Prompt(pages, req.Question)
+	return http.StatusOK, nil
+}
+
+func urlFailureCode(status int) string {
+	if status == http.StatusBadGateway {
+		return model.ReasonUpstreamError
+	}
+	return model.ReasonInvalidRequest
+}
+
+func askOptions(req *model.AskRequest) model.AskOptions {
+	opts := model.AskOptions{
+		Model:           req.Model,
+		Timeout:         time.Duration(req.TimeoutSeconds) * time.Second,
+		SkipPostprocess: req.SkipPostprocess,
+		Format:          req.Format,
+		ReplyLanguage:   req.ReplyLanguage,
+		Artifacts:       req.Artifacts,
+		System:          req.System,
+		ApprovalMode:    req.ApprovalMode,
+		Sandbox:         req.Sandbox,
+		Priority:        req.Priority,
+		Grounding:       req.Grounding,
+		Attachments:     fileAttachments(req.Files),
+		MaxOutputChars:  req.MaxOutputChars,
+	}
+	if len(req.JSONSchema) > 0 && string(req.JSONSchema) != "null" {
+		opts.GenerationConfig = &model.GenerationConfig{ResponseMimeType: "application/json", ResponseSchema: req.JSONSchema}
+	}
+	if len(req.StopSequences) > 0 {
+		if opts.GenerationConfig == nil {
+			opts.GenerationConfig = &model.GenerationConfig{}
+		}
+		opts.GenerationConfig.StopSequences = req.StopSequences
+	}
+	return opts
+}
+
+// ListModels handles GET /v1beta/models.
+func (g *GeminiHandler) ListModels(c *echo.Context) error {
+	return c.JSON(http.StatusOK, geminiapi.ListModels())
+}
+
+// GetModel handles GET /v1beta/models/:model.
+func (g *GeminiHandler) GetModel(c *echo.Context) error {
+	info, ok := geminiapi.GetModel(c.Param("model"))
+	if !ok {
+		return c.JSON(http.StatusNotFound, geminiapi.NewError(http.StatusNotFound, "models/"+c.Param("model")+" is not found"))
+	}
+	return c.JSON(http.StatusOK, info)
+}
+
+// HandleGeminiAPI handles POST /v1beta/models/:model:action for the
+// generateContent, streamGenerateContent, countTokens, embedContent and
+// batchEmbedContents actions. Other actions are forwarded to the Gemini API
+// when passthrough is on and answer 404 otherwise.
 func (g *GeminiHandler) HandleGeminiAPI(c *echo.Context) error {
 	if g == nil || g.service == nil {
-		return c.JSON(http.StatusInternalServerError, map[string]interface{}{
-			"error": map[string]interface{}{
-				"message": "service not initialized",
-				"code":    500,
-			},
-		})
+		return c.JSON(http.StatusInternalServerError, geminiapi.NewError(http.StatusInternalServerError, "service not initialized"))
 	}
 
-	modelName := c.Param("model")
+	modelName, action, err := geminiapi.ParseModelAction(c.Param("model"))
+	if err != nil {
+		if g.passthrough != nil && errors.Is(err, geminiapi.ErrUnsupportedAction) {
+			g.passthrough.ServeHTTP(c.Response(), c.Request())
+			return nil
+		}
+		return c.JSON(http.StatusNotFound, geminiapi.NewError(http.StatusNotFound, err.Error()))
+	}
+	switch action {
+	case geminiapi.ActionCountTokens:
+		return g.countTokens(c)
+	case geminiapi.ActionEmbedContent:
+		return g.embedContent(c, modelName)
+	case geminiapi.ActionBatchEmbedContents:
+		return g.batchEmbedContents(c, modelName)
+	}
+	stream := action == geminiapi.ActionStreamGenerateContent
 
 	var req model.GeminiAPIRequest
 	if err := c.Bind(&req); err != nil {
-		return c.JSON(http.StatusBadRequest, map[string]interface{}{
-			"error": map[string]interface{}{
-				"message": "Invalid request body",
-				"code":    400,
-			},
-		})
-	}
-
-	if len(req.Contents) == 0 || len(req.Contents[0].Parts) == 0 {
-		return c.JSON(http.StatusBadRequest, map[string]interface{}{
-			"error": map[string]interface{}{
-				"message": "contents[0].parts[0].text is required",
-				"code":    400,
-			},
-		})
-	}
-
-	question := strings.TrimSpace(req.Contents[0].Parts[0].Text)
-	if question == "" {
-		return c.JSON(http.StatusBadRequest, map[string]interface{}{
-			"error": map[string]interface{}{
-				"message": "text content cannot be empty",
-				"code":    400,
-			},
-		})
-	}
-	req.Contents[0].Parts[0].Text = question
-
-	answer, status, err := g.service.Ask(question, modelName)
+		failure := bindFailure(err, "Invalid request body")
+		return c.JSON(failure.Status, geminiapi.NewError(failure.Status, failure.Message))
+	}
+
+	if err := geminiapi.ResolveFiles(req, g.files); err != nil {
+		return c.JSON(http.StatusBadRequest, geminiapi.NewError(http.StatusBadRequest, err.Error()))
+	}
+	question, err := geminiapi.BuildPrompt(req)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, geminiapi.NewError(http.StatusBadRequest, err.Error()))
+	}
+
+	if err := geminiapi.ValidateGenerationConfig(req.GenerationConfig); err != nil {
+		return c.JSON(http.StatusBadRequest, geminiapi.NewError(http.StatusBadRequest, err.Error()))
+	}
+
+	if err := geminiapi.ValidateSafetySettings(req.SafetySettings); err != nil {
+		return c.JSON(http.StatusBadRequest, geminiapi.NewError(http.StatusBadRequest, err.Error()))
+	}
+
+	if err := geminiapi.ValidateTools(req.Tools, req.ToolConfig); err != nil {
+		return c.JSON(http.StatusBadRequest, geminiapi.NewError(http.StatusBadRequest, err.Error()))
+	}
+
+	// Validate before downloading any fileData, which can take a while.
+	attachments, err := geminiapi.Attachments(c.Request().Context(), req, g.files)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, geminiapi.NewError(http.StatusBadRequest, err.Error()))
+	}
+
+	opts := model.AskOptions{Model: modelName, GenerationConfig: req.GenerationConfig, SafetySettings: req.SafetySettings, Attachments: attachments}
+	tools := geminiapi.FunctionCallingEnabled(req)
+	if candidates := geminiapi.CandidateOptions(opts); len(candidates) > 1 {
+		if stream && !tools {
+			return g.streamCandidates(c, question, candidates)
+		}
+		return g.generateCandidates(c, req, question, candidates, stream)
+	}
+	if stream && !tools {
+		return g.streamGenerateContent(c, question, opts)
+	}
+
+	answer, status, err := g.service.AskWithOptions(c.Request().Context(), question, opts)
+	if err != nil {
+		code := askErrorCode(status)
+		return c.JSON(code, geminiapi.NewError(code, err.Error()))
+	}
+
+	resp := buildGeminiAPIResponseParts(modelName, geminiapi.AnswerParts(answer, req), finishReasonFor(status), status)
+	if !stream {
+		return c.JSON(http.StatusOK, resp)
+	}
+	// A function call can only be recognised in the complete answer, so
+	// streams with tools get the answer as a single element.
+	out, err := newGenerateContentStream(c, c.QueryParam("alt") == "sse")
+	if err != nil {
+		return err
+	}
+	if err := out.Send(resp); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// streamGenerateContent writes one GeminiAPIResponse per answer chunk. With
+// ?alt=sse the chunks are SSE data events, otherwise they form a streamed JSON array.
+func (g *GeminiHandler) streamGenerateContent(c *echo.Context, question string, opts model.AskOptions) error {
+	modelName := opts.Model
+	stream, err := newGenerateContentStream(c, c.QueryParam("alt") == "sse")
+	if err != nil {
+		return err
+	}
+
+	ctx, progress := gemini.WithProgress(c.Request().Context())
+	stop := heartbeat(g.heartbeat, func() error { return stream.KeepAlive(progress) })
+	// Hold back one chunk so the last one can carry finishReason and status.
+	pending := ""
+	_, status, err := g.service.AskStreamWithOptions(ctx, question, opts, func(chunk string) error {
+		if pending != "" {
+			if err := stream.Send(buildGeminiAPIResponse(modelName, pending, "", nil)); err != nil {
+				return err
+			}
+		}
+		pending = chunk
+		return nil
+	})
+	stop()
+	if err != nil {
+		if sendErr := stream.Send(geminiapi.NewError(askErrorCode(status), err.Error())); sendErr != nil {
+			return sendErr
+		}
+		return stream.Close()
+	}
+
+	if err := stream.Send(buildGeminiAPIResponse(modelName, pending, finishReasonFor(status), status)); err != nil {
+		return err
+	}
+	return stream.Close()
+}
+
+func (g *GeminiHandler) countTokens(c *echo.Context) error {
+	var req model.GeminiCountTokensRequest
+	if err := c.Bind(&req); err != nil {
+		failure := bindFailure(err, "Invalid request body")
+		return c.JSON(failure.Status, geminiapi.NewError(failure.Status, failure.Message))
+	}
+
+	resp, err := geminiapi.CountTokens(req)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]interface{}{
-			"error": map[string]interface{}{
-				"message": err.Error(),
-				"code":    500,
-			},
-		})
+		return c.JSON(http.StatusBadRequest, geminiapi.NewError(http.StatusBadRequest, err.Error()))
 	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+func buildGeminiAPIResponse(modelName string, text string, finishReason string, status *model.GeminiStatus) model.GeminiAPIResponse {
+	return buildGeminiAPIResponseParts(modelName, []model.GeminiPart{{Text: text}}, finishReason, status)
+}
 
+func buildGeminiAPIResponseParts(modelName string, parts []model.GeminiPart, finishReason string, status *model.GeminiStatus) model.GeminiAPIResponse {
 	responseModel := modelName
 	if status != nil && strings.TrimSpace(status.Model) != "" {
 		responseModel = status.Model
 	}
 
-	response := model.GeminiAPIResponse{
-		Model:  responseModel,
-		Status: status,
-		Candidates: []struct {
-			Content struct {
-				Parts []struct {
-					Text string `json:"text"`
-				} `json:"parts"`
-			} `json:"content"`
-		}{
-			{
-				Content: struct {
-					Parts []struct {
-						Text string `json:"text"`
-					} `json:"parts"`
-				}{
-					Parts: []struct {
-						Text string `json:"text"`
-					}{
-						{Text: answer},
-					},
-				},
-			},
+	return model.GeminiAPIResponse{
+		Model:         responseModel,
+		UsageMetadata: usageOf(status),
+		Status:        status,
+		Candidates:    []model.GeminiCandidate{geminiCandidate(0, withThoughtPart(parts, status), finishReason)},
+	}
+}
+
+// withThoughtPart puts the thoughts recorded in status before parts, as a
+// thought part.
+func withThoughtPart(parts []model.GeminiPart, status *model.GeminiStatus) []model.GeminiPart {
+	if status == nil || status.Thoughts == "" {
+		return parts
+	}
+	return append([]model.GeminiPart{{Text: status.Thoughts, Thought: true}}, parts...)
+}
+
+func geminiCandidate(index int, parts []model.GeminiPart, finishReason string) model.GeminiCandidate {
+	return model.GeminiCandidate{
+		Index: index,
+		Content: model.GeminiContent{
+			Role:  "model",
+			Parts: parts,
 		},
+		FinishReason:  finishReason,
+		SafetyRatings: geminiapi.SafetyRatings(),
 	}
+}
 
-	return c.JSON(http.StatusOK, response)
+// askErrorCode returns the HTTP status of a failed ask. The service
+// classifies every failure in status; 500 covers a missing status.
+func askErrorCode(status *model.GeminiStatus) int {
+	if status != nil && status.HTTPStatus >= 400 && status.HTTPStatus <= 599 {
+		return status.HTTPStatus
+	}
+	return http.StatusInternalServerError
+}
+
+// failureCode is the machine-readable reason of a failed question.
+func failureCode(status *model.GeminiStatus) string {
+	if status == nil || status.Reason == "" {
+		return model.ReasonInternalError
+	}
+	return status.Reason
+}
+
+func usageOf(status *model.GeminiStatus) *model.UsageMetadata {
+	if status == nil {
+		return nil
+	}
+	return status.Usage
+}
+
+func toolEventsOf(status *model.GeminiStatus) []model.ToolEvent {
+	if status == nil {
+		return nil
+	}
+	return status.ToolEvents
+}
+
+func artifactsOf(status *model.GeminiStatus) []model.Artifact {
+	if status == nil {
+		return nil
+	}
+	return status.Artifacts
+}
+
+func citationsOf(status *model.GeminiStatus) []string {
+	if status == nil {
+		return nil
+	}
+	return status.Citations
+}
+
+func finishReasonFor(status *model.GeminiStatus) string {
+	if status != nil && status.FinishReason != "" {
+		return status.FinishReason
+	}
+	return "STOP"
+}
+
+type generateContentStream struct {
+	sse *sseWriter
+	// mu serializes the writes of the JSON array.
+	mu    sync.Mutex
+	w     http.ResponseWriter
+	flush http.Flusher
+	sent  int
+}
+
+func newGenerateContentStream(c *echo.Context, sse bool) (*generateContentStream, error) {
+	if sse {
+		w, err := startSSE(c)
+		if err != nil {
+			return nil, err
+		}
+		return &generateContentStream{sse: w}, nil
+	}
+
+	r := c.Response()
+	flusher, ok := r.(http.Flusher)
+	if !ok {
+		return nil, fmt.Errorf("response writer does not implement http.Flusher")
+	}
+	r.Header().Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	r.WriteHeader(http.StatusOK)
+	return &generateContentStream{w: r, flush: flusher}, nil
+}
+
+// Send writes a single stream element.
+func (s *generateContentStream) Send(payload interface{}) error {
+	if s.sse != nil {
+		return s.sse.Event("", payload)
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	separator := "["
+	if s.sent > 0 {
+		separator = ",\r\n"
+	}
+	s.sent++
+	if _, err := fmt.Fprintf(s.w, "%s%s", separator, body); err != nil {
+		return err
+	}
+	s.flush.Flush()
+	return nil
+}
+
+// KeepAlive writes progress as an SSE comment, or a newline between the
+// elements of the JSON array, which JSON parsers skip.
+func (s *generateContentStream) KeepAlive(progress *gemini.Progress) error {
+	if s.sse != nil {
+		return s.sse.ProgressComment(progress)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := fmt.Fprint(s.w, "\n"); err != nil {
+		return err
+	}
+	s.flush.Flush()
+	return nil
+}
+
+// Close terminates the JSON array; SSE streams need no trailer.
+func (s *generateContentStream) Close() error {
+	if s.sse != nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	closing := "]"
+	if s.sent == 0 {
+		closing = "[]"
+	}
+	_, err := fmt.Fprint(s.w, closing)
+	s.flush.Flush()
+	return err
 }
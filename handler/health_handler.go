@@ -0,0 +1,111 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+
+	"gemini-wrapper/pkg/gemini"
+
+	"github.com/labstack/echo/v5"
+)
+
+type HealthHandler struct {
+	service       *gemini.GeminiService
+	maxQueueDepth int
+}
+
+// NewHealthHandler reports not ready once maxQueueDepth requests are queued;
+// 0 disables the check.
+func NewHealthHandler(service *gemini.GeminiService, maxQueueDepth int) *HealthHandler {
+	return &HealthHandler{service: service, maxQueueDepth: maxQueueDepth}
+}
+
+// Root handles GET / and reports the supervised backend state and worker
+// queue next to the static banner. It always answers 200 so existing uptime
+// checks keep working.
+func (h *HealthHandler) Root(c *echo.Context) error {
+	body := map[string]interface{}{
+		"message": "Gemini Wrapper API",
+		"status":  "running",
+	}
+	if h != nil && h.service != nil {
+		body["backend"] = h.service.Health()
+		body["pool"] = h.service.PoolStats()
+		body["circuit"] = h.service.CircuitStatus()
+	}
+	return c.JSON(http.StatusOK, body)
+}
+
+// Livez handles GET /livez. The process is alive if it can answer at all;
+// a broken CLI is a readiness problem, not a reason to restart the container.
+func (h *HealthHandler) Livez(c *echo.Context) error {
+	return c.JSON(http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// SelfTest handles GET /api/selftest. It asks the self-test prompt through
+// the whole pipeline, at most once per interval, and answers 200 when it
+// was answered and 503 when not.
+func (h *HealthHandler) SelfTest(c *echo.Context) error {
+	if h == nil || h.service == nil {
+		return c.JSON(http.StatusServiceUnavailable, gemini.SelfTestResult{Error: "service not initialized"})
+	}
+	result := h.service.SelfTestEndToEnd(c.Request().Context())
+	code := http.StatusOK
+	if !result.Passed {
+		code = http.StatusServiceUnavailable
+	}
+	return c.JSON(code, result)
+}
+
+// Readyz handles GET /readyz. It answers 503 while the CLI is starting or
+// the backend supervisor reports it as unusable, the self-test has not
+// passed yet, the upstream circuit is open or more requests are queued than
+// maxQueueDepth.
+func (h *HealthHandler) Readyz(c *echo.Context) error {
+	if h == nil || h.service == nil {
+		return c.JSON(http.StatusServiceUnavailable, map[string]interface{}{
+			"status":   "not_ready",
+			"problems": []string{"service not initialized"},
+		})
+	}
+
+	health := h.service.Health()
+	pool := h.service.PoolStats()
+	circuit := h.service.CircuitStatus()
+	problems := []string{}
+	if health.Starting {
+		problems = append(problems, "backend starting")
+	} else if !health.Ready {
+		problem := "backend not ready"
+		if health.LastError != "" {
+			problem += ": " + health.LastError
+		}
+		problems = append(problems, problem)
+	} else if health.SelfTest != nil && !health.SelfTest.Passed {
+		problem := "self-test pending"
+		if health.SelfTest.Error != "" {
+			problem = "self-test failed: " + health.SelfTest.Error
+		}
+		problems = append(problems, problem)
+	}
+	if circuit.State == "open" {
+		problems = append(problems, "upstream circuit open: "+circuit.Reason)
+	}
+	if h.maxQueueDepth > 0 && pool.Waiting >= h.maxQueueDepth {
+		problems = append(problems, fmt.Sprintf("queue depth %d reached limit %d", pool.Waiting, h.maxQueueDepth))
+	}
+
+	code := http.StatusOK
+	status := "ready"
+	if len(problems) > 0 {
+		code = http.StatusServiceUnavailable
+		status = "not_ready"
+	}
+	return c.JSON(code, map[string]interface{}{
+		"status":   status,
+		"problems": problems,
+		"backend":  health,
+		"pool":     pool,
+		"circuit":  circuit,
+	})
+}
@@ -0,0 +1,86 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"gemini-wrapper/model"
+	"gemini-wrapper/service/jobs"
+	"gemini-wrapper/service/templates"
+
+	"github.com/labstack/echo/v5"
+)
+
+type JobHandler struct {
+	manager   *jobs.Manager
+	templates *templates.Store
+}
+
+func NewJobHandler(manager *jobs.Manager, templates *templates.Store) *JobHandler {
+	return &JobHandler{manager: manager, templates: templates}
+}
+
+// CreateJob handles POST /api/jobs. It takes the /api/ask body plus an
+// optional callback_url and answers 202 with the job, whose URL is in the
+// Location header.
+func (h *JobHandler) CreateJob(c *echo.Context) error {
+	req := new(model.CreateJobRequest)
+	if err := c.Bind(req); err != nil {
+		failure := bindFailure(err, "Invalid request format")
+		return c.JSON(failure.Status, map[string]string{"error": failure.Message})
+	}
+	if err := applyTemplate(h.templates, &req.AskRequest); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	req.Question = strings.TrimSpace(req.Question)
+	if req.Question == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Question is required"})
+	}
+	if req.TimeoutSeconds < 0 {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "timeout_seconds must not be negative"})
+	}
+	if req.DryRun {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "dry_run is not supported for jobs; use POST /api/ask"})
+	}
+	if err := attachFiles(&req.AskRequest); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	info, err := h.manager.Create(c.Request().Context(), req.Question, askOptions(&req.AskRequest), req.CallbackURL)
+	if err != nil {
+		return writeJobError(c, err)
+	}
+	c.Response().Header().Set(echo.HeaderLocation, "/api/jobs/"+info.ID)
+	return c.JSON(http.StatusAccepted, info)
+}
+
+// GetJob handles GET /api/jobs/:id.
+func (h *JobHandler) GetJob(c *echo.Context) error {
+	info, err := h.manager.Get(c.Param("id"))
+	if err != nil {
+		return writeJobError(c, err)
+	}
+	return c.JSON(http.StatusOK, info)
+}
+
+// CancelJob handles DELETE /api/jobs/:id and POST /api/jobs/:id/cancel.
+func (h *JobHandler) CancelJob(c *echo.Context) error {
+	info, err := h.manager.Cancel(c.Param("id"))
+	if err != nil {
+		return writeJobError(c, err)
+	}
+	return c.JSON(http.StatusOK, info)
+}
+
+func writeJobError(c *echo.Context, err error) error {
+	switch {
+	case errors.Is(err, jobs.ErrJobNotFound):
+		return c.JSON(http.StatusNotFound, map[string]string{"error": err.Error()})
+	case errors.Is(err, jobs.ErrInvalidCallback):
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	case errors.Is(err, jobs.ErrTooManyJobs):
+		return c.JSON(http.StatusTooManyRequests, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,17 @@
+package handler
+
+import (
+	"net/http"
+
+	"gemini-wrapper/metrics"
+
+	"github.com/labstack/echo/v5"
+)
+
+// Metrics handles GET /metrics in the Prometheus text exposition format.
+func Metrics(c *echo.Context) error {
+	c.Response().Header().Set(echo.HeaderContentType, "text/plain; version=0.0.4; charset=utf-8")
+	c.Response().WriteHeader(http.StatusOK)
+	metrics.Default.WriteText(c.Response())
+	return nil
+}
@@ -0,0 +1,165 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"gemini-wrapper/model"
+	"gemini-wrapper/service/ollama"
+
+	"github.com/labstack/echo/v5"
+)
+
+type OllamaHandler struct {
+	service ollama.Service
+}
+
+func NewOllamaHandler(service ollama.Service) *OllamaHandler {
+	return &OllamaHandler{service: service}
+}
+
+// ListModels handles GET /api/tags.
+func (h *OllamaHandler) ListModels(c *echo.Context) error {
+	if h == nil || h.service == nil {
+		return writeOllamaError(c, &ollama.APIError{HTTPStatus: 500, Message: "Ollama adapter is not initialized"})
+	}
+	return c.JSON(http.StatusOK, h.service.ListModels())
+}
+
+// Generate handles POST /api/generate.
+func (h *OllamaHandler) Generate(c *echo.Context) error {
+	if h == nil || h.service == nil {
+		return writeOllamaError(c, &ollama.APIError{HTTPStatus: 500, Message: "Ollama adapter is not initialized"})
+	}
+
+	var req model.OllamaGenerateRequest
+	if err := decodeOllamaRequest(c, &req); err != nil {
+		failure := bindFailure(err, "invalid JSON body")
+		return writeOllamaError(c, &ollama.APIError{HTTPStatus: failure.Status, Message: failure.Message})
+	}
+
+	if req.Stream == nil || *req.Stream {
+		var stream *ndjsonWriter
+		err := h.service.GenerateStream(c.Request().Context(), req, func(resp model.OllamaGenerateResponse) error {
+			if stream == nil {
+				w, err := startNDJSON(c)
+				if err != nil {
+					return err
+				}
+				stream = w
+			}
+			return stream.Line(resp)
+		})
+		return finishNDJSON(c, stream, err)
+	}
+
+	resp, err := h.service.Generate(c.Request().Context(), req)
+	if err != nil {
+		return writeOllamaError(c, err)
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+// Chat handles POST /api/chat.
+func (h *OllamaHandler) Chat(c *echo.Context) error {
+	if h == nil || h.service == nil {
+		return writeOllamaError(c, &ollama.APIError{HTTPStatus: 500, Message: "Ollama adapter is not initialized"})
+	}
+
+	var req model.OllamaChatRequest
+	if err := decodeOllamaRequest(c, &req); err != nil {
+		failure := bindFailure(err, "invalid JSON body")
+		return writeOllamaError(c, &ollama.APIError{HTTPStatus: failure.Status, Message: failure.Message})
+	}
+
+	if req.Stream == nil || *req.Stream {
+		var stream *ndjsonWriter
+		err := h.service.ChatStream(c.Request().Context(), req, func(resp model.OllamaChatResponse) error {
+			if stream == nil {
+				w, err := startNDJSON(c)
+				if err != nil {
+					return err
+				}
+				stream = w
+			}
+			return stream.Line(resp)
+		})
+		return finishNDJSON(c, stream, err)
+	}
+
+	resp, err := h.service.Chat(c.Request().Context(), req)
+	if err != nil {
+		return writeOllamaError(c, err)
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+// decodeOllamaRequest binds a JSON body whatever its Content-Type: Ollama
+// does, and its documented curl examples send none.
+func decodeOllamaRequest(c *echo.Context, v interface{}) error {
+	c.Request().Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	return c.Bind(v)
+}
+
+// ndjsonWriter writes the newline-delimited JSON stream Ollama answers
+// with, flushing after every line.
+type ndjsonWriter struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+func startNDJSON(c *echo.Context) (*ndjsonWriter, error) {
+	r := c.Response()
+	flusher, ok := r.(http.Flusher)
+	if !ok {
+		return nil, fmt.Errorf("response writer does not implement http.Flusher")
+	}
+	r.Header().Set(echo.HeaderContentType, "application/x-ndjson")
+	r.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	return &ndjsonWriter{w: r, flusher: flusher}, nil
+}
+
+// Line writes payload as one line of JSON.
+func (s *ndjsonWriter) Line(payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(s.w, "%s\n", body); err != nil {
+		return err
+	}
+	s.flusher.Flush()
+	return nil
+}
+
+// finishNDJSON reports err as a regular JSON error when the stream never
+// started, and as a final {"error": ...} line, as Ollama does, when it did.
+func finishNDJSON(c *echo.Context, stream *ndjsonWriter, err error) error {
+	if stream == nil {
+		if err != nil {
+			return writeOllamaError(c, err)
+		}
+		return nil
+	}
+	if err != nil {
+		return stream.Line(ollamaErrorBody(err))
+	}
+	return nil
+}
+
+func writeOllamaError(c *echo.Context, err error) error {
+	status := http.StatusInternalServerError
+	if apiErr, ok := err.(*ollama.APIError); ok && apiErr.HTTPStatus > 0 {
+		status = apiErr.HTTPStatus
+	}
+	return c.JSON(status, ollamaErrorBody(err))
+}
+
+func ollamaErrorBody(err error) model.OllamaErrorResponse {
+	if apiErr, ok := err.(*ollama.APIError); ok {
+		return model.OllamaErrorResponse{Error: apiErr.Message}
+	}
+	return model.OllamaErrorResponse{Error: "an internal service error occurred"}
+}
@@ -1,11 +1,11 @@
 package handler
 
 import (
-	"encoding/json"
-	"fmt"
 	"net/http"
+	"time"
 
 	"gemini-wrapper/model"
+	"gemini-wrapper/pkg/gemini"
 	"gemini-wrapper/service/openai"
 
 	"github.com/labstack/echo/v5"
@@ -13,10 +13,13 @@ import (
 
 type OpenAIHandler struct {
 	service openai.Service
+	// heartbeat spaces the progress comments of streamed chat completions,
+	// which OpenAI clients skip; 0 sends none.
+	heartbeat time.Duration
 }
 
-func NewOpenAIHandler(service openai.Service) *OpenAIHandler {
-	return &OpenAIHandler{service: service}
+func NewOpenAIHandler(service openai.Service, heartbeat time.Duration) *OpenAIHandler {
+	return &OpenAIHandler{service: service, heartbeat: heartbeat}
 }
 
 func (h *OpenAIHandler) ListModels(c *echo.Context) error {
@@ -33,10 +36,15 @@ func (h *OpenAIHandler) CreateChatCompletion(c *echo.Context) error {
 
 	var req model.OpenAIChatCompletionRequest
 	if err := c.Bind(&req); err != nil {
-		return writeOpenAIError(c, &openai.APIError{HTTPStatus: 400, Type: "invalid_request_error", Code: "invalid_json", Message: "Invalid JSON body"})
+		failure := bindFailure(err, "Invalid JSON body")
+		return writeOpenAIError(c, &openai.APIError{HTTPStatus: failure.Status, Type: "invalid_request_error", Code: failure.Code, Message: failure.Message})
 	}
 
-	resp, err := h.service.CreateChatCompletion(req)
+	if req.Stream {
+		return h.streamChatCompletion(c, req)
+	}
+
+	resp, err := h.service.CreateChatCompletion(c.Request().Context(), req)
 	if err != nil {
 		return writeOpenAIError(c, err)
 	}
@@ -50,10 +58,11 @@ func (h *OpenAIHandler) CreateCompletion(c *echo.Context) error {
 
 	var req model.OpenAICompletionRequest
 	if err := c.Bind(&req); err != nil {
-		return writeOpenAIError(c, &openai.APIError{HTTPStatus: 400, Type: "invalid_request_error", Code: "invalid_json", Message: "Invalid JSON body"})
+		failure := bindFailure(err, "Invalid JSON body")
+		return writeOpenAIError(c, &openai.APIError{HTTPStatus: failure.Status, Type: "invalid_request_error", Code: failure.Code, Message: failure.Message})
 	}
 
-	resp, err := h.service.CreateCompletion(req)
+	resp, err := h.service.CreateCompletion(c.Request().Context(), req)
 	if err != nil {
 		return writeOpenAIError(c, err)
 	}
@@ -67,10 +76,11 @@ func (h *OpenAIHandler) CreateResponse(c *echo.Context) error {
 
 	var req model.OpenAIResponseRequest
 	if err := c.Bind(&req); err != nil {
-		return writeOpenAIError(c, &openai.APIError{HTTPStatus: 400, Type: "invalid_request_error", Code: "invalid_json", Message: "Invalid JSON body"})
+		failure := bindFailure(err, "Invalid JSON body")
+		return writeOpenAIError(c, &openai.APIError{HTTPStatus: failure.Status, Type: "invalid_request_error", Code: failure.Code, Message: failure.Message})
 	}
 
-	resp, err := h.service.CreateResponse(req)
+	resp, err := h.service.CreateResponse(c.Request().Context(), req)
 	if err != nil {
 		return writeOpenAIError(c, err)
 	}
@@ -81,69 +91,89 @@ func (h *OpenAIHandler) CreateResponse(c *echo.Context) error {
 	return c.JSON(http.StatusOK, resp)
 }
 
-func writeResponseSSE(c *echo.Context, resp model.OpenAIResponse) error {
-	r := c.Response()
-	r.Header().Set(echo.HeaderContentType, "text/event-stream")
-	r.Header().Set("Cache-Control", "no-cache")
-	r.Header().Set("Connection", "keep-alive")
-	r.WriteHeader(http.StatusOK)
-	flusher, ok := r.(http.Flusher)
-	if !ok {
-		return fmt.Errorf("response writer does not implement http.Flusher")
-	}
-
-	writeEvent := func(event string, payload interface{}) error {
-		body, err := json.Marshal(payload)
+// streamChatCompletion opens the event stream lazily so that errors raised
+// before the first chunk, or the first heartbeat, are still returned as
+// regular JSON error responses. Heartbeats are progress comments.
+func (h *OpenAIHandler) streamChatCompletion(c *echo.Context, req model.OpenAIChatCompletionRequest) error {
+	lazy := &lazySSE{c: c}
+	ctx, progress := gemini.WithProgress(c.Request().Context())
+	stop := heartbeat(h.heartbeat, func() error {
+		stream, err := lazy.open()
 		if err != nil {
 			return err
 		}
-		if _, err := fmt.Fprintf(r, "event: %s\ndata: %s\n\n", event, string(body)); err != nil {
+		return stream.ProgressComment(progress)
+	})
+	err := h.service.CreateChatCompletionStream(ctx, req, func(chunk model.OpenAIChatCompletionChunk) error {
+		stream, err := lazy.open()
+		if err != nil {
 			return err
 		}
-		flusher.Flush()
+		return stream.Event("", chunk)
+	})
+	stop()
+	stream := lazy.opened()
+	if stream == nil {
+		if err != nil {
+			return writeOpenAIError(c, err)
+		}
 		return nil
 	}
+	if err != nil {
+		if writeErr := stream.Event("", openAIErrorBody(err)); writeErr != nil {
+			return writeErr
+		}
+	}
+	return stream.Done()
+}
 
-	if err := writeEvent("response.created", map[string]interface{}{"type": "response.created", "response": resp}); err != nil {
+func writeResponseSSE(c *echo.Context, resp model.OpenAIResponse) error {
+	stream, err := startSSE(c)
+	if err != nil {
+		return err
+	}
+
+	if err := stream.Event("response.created", map[string]interface{}{"type": "response.created", "response": resp}); err != nil {
 		return err
 	}
 	if resp.OutputText != "" {
-		if err := writeEvent("response.output_text.delta", map[string]interface{}{"type": "response.output_text.delta", "delta": resp.OutputText}); err != nil {
+		if err := stream.Event("response.output_text.delta", map[string]interface{}{"type": "response.output_text.delta", "delta": resp.OutputText}); err != nil {
 			return err
 		}
-		if err := writeEvent("response.output_text.done", map[string]interface{}{"type": "response.output_text.done", "text": resp.OutputText}); err != nil {
+		if err := stream.Event("response.output_text.done", map[string]interface{}{"type": "response.output_text.done", "text": resp.OutputText}); err != nil {
 			return err
 		}
 	}
-	if err := writeEvent("response.completed", map[string]interface{}{"type": "response.completed", "response": resp}); err != nil {
+	if err := stream.Event("response.completed", map[string]interface{}{"type": "response.completed", "response": resp}); err != nil {
 		return err
 	}
-
-	_, err := fmt.Fprint(r, "data: [DONE]\n\n")
-	flusher.Flush()
-	return err
+	return stream.Done()
 }
 
 func writeOpenAIError(c *echo.Context, err error) error {
+	status := http.StatusInternalServerError
+	if apiErr, ok := err.(*openai.APIError); ok && apiErr.HTTPStatus > 0 {
+		status = apiErr.HTTPStatus
+	}
+	return c.JSON(status, openAIErrorBody(err))
+}
+
+func openAIErrorBody(err error) model.OpenAIErrorResponse {
 	if apiErr, ok := err.(*openai.APIError); ok {
-		status := apiErr.HTTPStatus
-		if status <= 0 {
-			status = http.StatusInternalServerError
-		}
 		errType := apiErr.Type
 		if errType == "" {
 			errType = "server_error"
 		}
-		return c.JSON(status, model.OpenAIErrorResponse{Error: model.OpenAIError{
+		return model.OpenAIErrorResponse{Error: model.OpenAIError{
 			Message: apiErr.Message,
 			Type:    errType,
 			Code:    apiErr.Code,
-		}})
+		}}
 	}
 
-	return c.JSON(http.StatusInternalServerError, model.OpenAIErrorResponse{Error: model.OpenAIError{
+	return model.OpenAIErrorResponse{Error: model.OpenAIError{
 		Message: err.Error(),
 		Type:    "server_error",
 		Code:    "internal_error",
-	}})
+	}}
 }
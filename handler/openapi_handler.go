@@ -0,0 +1,165 @@
+package handler
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"gemini-wrapper/model"
+	"gemini-wrapper/pkg/gemini"
+	"gemini-wrapper/service/audit"
+	"gemini-wrapper/service/openapi"
+
+	"github.com/labstack/echo/v5"
+)
+
+// operations describes the routes for /openapi.json, keyed by method and
+// Echo path. Registered routes missing here are listed without bodies.
+var operations = map[string]openapi.Operation{
+	"GET /":        {Summary: "Service banner with the backend and queue state", Tag: "health"},
+	"HEAD /":       {Summary: "Service banner", Tag: "health"},
+	"GET /livez":   {Summary: "Liveness probe", Tag: "health"},
+	"GET /readyz":  {Summary: "Readiness probe; 503 while the backend is not usable", Tag: "health"},
+	"GET /metrics": {Summary: "Prometheus metrics in text format", Tag: "health"},
+
+	"GET /api/version":                 {Summary: "Build, CLI version, models and enabled features", Tag: "simple", Response: versionResponse{}},
+	"GET /api/selftest":                {Summary: "End-to-end self-test, run at most once per interval; 503 when it failed", Tag: "health", Response: gemini.SelfTestResult{}},
+	"POST /api/ask":                    {Summary: "Ask a question", Tag: "simple", Request: model.AskRequest{}, Response: model.AskResponse{}},
+	"POST /api/ask/stream":             {Summary: "Ask a question and stream the answer", Tag: "simple", Request: model.AskRequest{}, Response: model.AskStreamChunk{}, Stream: true},
+	"POST /api/ask/batch":              {Summary: "Ask several questions at once", Tag: "simple", Request: model.BatchAskRequest{}, Response: model.BatchAskResponse{}},
+	"POST /api/ask/:request_id/cancel": {Summary: "Cancel the questions of a request", Tag: "simple", Response: gemini.CancelledRequest{}},
+	"POST /api/embed":                  {Summary: "Embed texts", Tag: "simple", Request: model.EmbedRequest{}, Response: model.EmbedResponse{}},
+
+	"GET /api/tags":      {Summary: "Ollama: list models", Tag: "ollama", Response: model.OllamaTagsResponse{}},
+	"POST /api/generate": {Summary: "Ollama: generate a completion; streams NDJSON unless stream is false", Tag: "ollama", Request: model.OllamaGenerateRequest{}, Response: model.OllamaGenerateResponse{}},
+	"POST /api/chat":     {Summary: "Ollama: chat; streams NDJSON unless stream is false", Tag: "ollama", Request: model.OllamaChatRequest{}, Response: model.OllamaChatResponse{}},
+
+	"GET /v1beta/models":         {Summary: "Gemini API: list models", Tag: "gemini", Response: model.GeminiModelListResponse{}},
+	"GET /v1beta/models/:model":  {Summary: "Gemini API: get a model", Tag: "gemini", Response: model.GeminiModelInfo{}},
+	"POST /v1beta/models/:model": {Summary: "Gemini API: <model>:generateContent, :streamGenerateContent, :countTokens, :embedContent or :batchEmbedContents", Tag: "gemini", Request: model.GeminiAPIRequest{}, Response: model.GeminiAPIResponse{}},
+	"GET /v1beta/files":          {Summary: "Gemini Files API: list files", Tag: "files", Response: model.GeminiFileListResponse{}},
+	"GET /v1beta/files/:name":    {Summary: "Gemini Files API: get a file", Tag: "files", Response: model.GeminiFile{}},
+	"DELETE /v1beta/files/:name": {Summary: "Gemini Files API: delete a file", Tag: "files"},
+	"POST /upload/v1beta/files":  {Summary: "Gemini Files API: upload a file, in one request or resumable", Tag: "files", Response: model.GeminiFileResponse{}},
+
+	"POST /api/sessions":                 {Summary: "Create a session", Tag: "sessions", Request: model.CreateSessionRequest{}, Response: model.SessionInfo{}, Status: http.StatusCreated},
+	"GET /api/sessions":                  {Summary: "List sessions", Tag: "sessions", Response: model.SessionListResponse{}},
+	"POST /api/sessions/import":          {Summary: "Import a session transcript", Tag: "sessions", Request: model.SessionTranscript{}, Response: model.SessionInfo{}, Status: http.StatusCreated},
+	"GET /api/sessions/:id":              {Summary: "Get a session", Tag: "sessions", Response: model.SessionInfo{}},
+	"GET /api/sessions/:id/history":      {Summary: "Export a session transcript", Tag: "sessions", Response: model.SessionTranscript{}},
+	"DELETE /api/sessions/:id":           {Summary: "Delete a session", Tag: "sessions", Status: http.StatusNoContent},
+	"POST /api/sessions/:id/restore":     {Summary: "Restore a deleted or expired session", Tag: "sessions", Response: model.SessionInfo{}},
+	"POST /api/sessions/:id/ask":         {Summary: "Ask within a session", Tag: "sessions", Request: model.AskRequest{}, Response: model.SessionAskResponse{}},
+	"POST /api/sessions/:id/compress":    {Summary: "Summarize the history of a session", Tag: "sessions", Response: model.SessionCompressResponse{}},
+	"GET /api/sessions/:id/context":      {Summary: "Get the context file of a session", Tag: "sessions", Response: model.ContextFile{}},
+	"PUT /api/sessions/:id/context":      {Summary: "Set the context file of a session", Tag: "sessions", Request: model.SetContextRequest{}, Response: model.ContextFile{}},
+	"DELETE /api/sessions/:id/context":   {Summary: "Delete the context file of a session", Tag: "sessions", Status: http.StatusNoContent},
+	"POST /api/jobs":                     {Summary: "Queue a question as a background job", Tag: "jobs", Request: model.CreateJobRequest{}, Response: model.JobInfo{}, Status: http.StatusAccepted},
+	"GET /api/jobs/:id":                  {Summary: "Get a job", Tag: "jobs", Response: model.JobInfo{}},
+	"DELETE /api/jobs/:id":               {Summary: "Cancel a job", Tag: "jobs", Response: model.JobInfo{}},
+	"POST /api/jobs/:id/cancel":          {Summary: "Cancel a job", Tag: "jobs", Response: model.JobInfo{}},
+	"POST /api/workspaces":               {Summary: "Create a workspace", Tag: "workspaces", Response: model.WorkspaceInfo{}, Status: http.StatusCreated},
+	"GET /api/workspaces":                {Summary: "List workspaces", Tag: "workspaces", Response: model.WorkspaceListResponse{}},
+	"GET /api/workspaces/:id":            {Summary: "Get a workspace", Tag: "workspaces", Response: model.WorkspaceInfo{}},
+	"DELETE /api/workspaces/:id":         {Summary: "Delete a workspace", Tag: "workspaces", Status: http.StatusNoContent},
+	"PUT /api/workspaces/:id/files/*":    {Summary: "Write a file; the body is its content", Tag: "workspaces", Response: model.WorkspaceFile{}},
+	"GET /api/workspaces/:id/files/*":    {Summary: "Read a file", Tag: "workspaces"},
+	"DELETE /api/workspaces/:id/files/*": {Summary: "Delete a file", Tag: "workspaces", Status: http.StatusNoContent},
+	"GET /api/workspaces/:id/diff":       {Summary: "Unified diff of the changes to a workspace", Tag: "workspaces"},
+	"GET /api/workspaces/:id/archive":    {Summary: "Download the files of a workspace as tar.gz or zip; changed=true only the changed ones", Tag: "workspaces"},
+	"POST /api/workspaces/:id/ask":       {Summary: "Ask with the workspace as working directory", Tag: "workspaces", Request: model.AskRequest{}, Response: model.WorkspaceAskResponse{}},
+	"GET /api/workspaces/:id/context":    {Summary: "Get the context file of a workspace", Tag: "workspaces", Response: model.ContextFile{}},
+	"PUT /api/workspaces/:id/context":    {Summary: "Set the context file of a workspace", Tag: "workspaces", Request: model.SetContextRequest{}, Response: model.ContextFile{}},
+	"DELETE /api/workspaces/:id/context": {Summary: "Delete the context file of a workspace", Tag: "workspaces", Status: http.StatusNoContent},
+	"POST /api/templates":                {Summary: "Create a prompt template", Tag: "templates", Request: model.PromptTemplate{}, Response: model.PromptTemplate{}, Status: http.StatusCreated},
+	"GET /api/templates":                 {Summary: "List prompt templates", Tag: "templates", Response: model.TemplateListResponse{}},
+	"GET /api/templates/:name":           {Summary: "Get a prompt template", Tag: "templates", Response: model.PromptTemplate{}},
+	"PUT /api/templates/:name":           {Summary: "Create or replace a prompt template", Tag: "templates", Request: model.PromptTemplate{}, Response: model.PromptTemplate{}},
+	"DELETE /api/templates/:name":        {Summary: "Delete a prompt template", Tag: "templates", Status: http.StatusNoContent},
+
+	"GET /v1/models":                 {Summary: "OpenAI: list models", Tag: "openai", Response: model.OpenAIModelListResponse{}},
+	"POST /v1/chat/completions":      {Summary: "OpenAI: chat completion; server-sent events with stream", Tag: "openai", Request: model.OpenAIChatCompletionRequest{}, Response: model.OpenAIChatCompletionResponse{}},
+	"POST /v1/completions":           {Summary: "OpenAI: legacy completion", Tag: "openai", Request: model.OpenAICompletionRequest{}, Response: model.OpenAICompletionResponse{}},
+	"POST /v1/responses":             {Summary: "OpenAI: Responses API", Tag: "openai", Request: model.OpenAIResponseRequest{}, Response: model.OpenAIResponse{}},
+	"POST /v1/messages":              {Summary: "Anthropic: create a message; server-sent events with stream", Tag: "anthropic", Request: model.AnthropicMessageRequest{}, Response: model.AnthropicMessageResponse{}},
+	"POST /v1/messages/count_tokens": {Summary: "Anthropic: count tokens", Tag: "anthropic", Request: model.AnthropicMessageRequest{}, Response: model.AnthropicCountTokensResponse{}},
+
+	"GET /admin/usage":              {Summary: "Per-client usage, budgets and history", Tag: "admin", Response: usageResponse{}},
+	"DELETE /admin/cache":           {Summary: "Purge the response cache", Tag: "admin"},
+	"GET /admin/backend":            {Summary: "Backend, pool and active calls", Tag: "admin", Response: gemini.BackendState{}},
+	"POST /admin/backend/restart":   {Summary: "Interrupt the running CLI processes", Tag: "admin"},
+	"GET /admin/console":            {Summary: "Live CLI output", Tag: "admin", Response: gemini.ConsoleLine{}, Stream: true},
+	"GET /admin/mcp":                {Summary: "Configured MCP servers", Tag: "admin"},
+	"GET /admin/auth":               {Summary: "CLI authentication state", Tag: "admin", Response: gemini.AuthStatus{}},
+	"GET /admin/context":            {Summary: "Get the global context file", Tag: "admin", Response: model.ContextFile{}},
+	"PUT /admin/context":            {Summary: "Set the global context file", Tag: "admin", Request: model.SetContextRequest{}, Response: gemini.ContextRefresh{}},
+	"DELETE /admin/context":         {Summary: "Delete the global context file", Tag: "admin", Response: gemini.ContextRefresh{}},
+	"POST /admin/context/refresh":   {Summary: "Reload the global context file", Tag: "admin", Response: gemini.ContextRefresh{}},
+	"DELETE /admin/queue":           {Summary: "Drop the queued questions", Tag: "admin"},
+	"GET /admin/log-level":          {Summary: "Get the log level", Tag: "admin"},
+	"PUT /admin/log-level":          {Summary: "Set the log level", Tag: "admin"},
+	"POST /admin/command":           {Summary: "Report on the subject of a CLI slash command like /stats for a session", Tag: "admin", Request: model.SessionCommandRequest{}, Response: model.SessionCommandResponse{}},
+	"POST /admin/cli-patterns/test": {Summary: "Show how the CLI output patterns read a transcript", Tag: "admin", Response: gemini.TranscriptParse{}},
+	"POST /admin/config/reload":     {Summary: "Reload the configuration file", Tag: "admin"},
+	"GET /admin/audit":              {Summary: "Export the audit log as JSON Lines", Tag: "admin"},
+	"POST /admin/audit/:id/replay":  {Summary: "Ask an audited question again and compare the answers", Tag: "admin", Response: audit.Replay{}},
+	"GET /debug/state":              {Summary: "Goroutines, memory, queue and sessions", Tag: "debug", Response: debugState{}},
+	"GET /debug/pprof/*":            {Summary: "Go runtime profiles", Tag: "debug"},
+	"POST /debug/pprof/symbol":      {Summary: "Look up program counters", Tag: "debug"},
+}
+
+// OpenAPIHandler serves the OpenAPI document of the routes and an explorer
+// for it.
+type OpenAPIHandler struct {
+	spec []byte
+}
+
+// NewOpenAPIHandler describes routes, the routes registered on the server.
+// secured declares that they need an API key. Passthrough routes are left
+// out: they belong to the upstream API.
+func NewOpenAPIHandler(routes echo.Routes, secured bool) *OpenAPIHandler {
+	doc := openapi.New("Gemini Wrapper", readBuildInfo().Version)
+	if secured {
+		doc.RequireAPIKey()
+	}
+	for _, route := range routes {
+		if route.Method == echo.RouteAny {
+			continue
+		}
+		doc.Add(route.Method, route.Path, operations[route.Method+" "+route.Path])
+	}
+	spec, err := json.Marshal(doc)
+	if err != nil {
+		slog.Error("OpenAPI document not generated", "error", err)
+		spec = []byte(`{}`)
+	}
+	return &OpenAPIHandler{spec: spec}
+}
+
+// Spec handles GET /openapi.json.
+func (h *OpenAPIHandler) Spec(c *echo.Context) error {
+	return c.Blob(http.StatusOK, echo.MIMEApplicationJSON, h.spec)
+}
+
+// explorerPage loads Swagger UI from its CDN and points it at /openapi.json.
+const explorerPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Gemini Wrapper API</title>
+<link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+<div id="swagger-ui"></div>
+<script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js" crossorigin></script>
+<script>
+window.ui = SwaggerUIBundle({url: "/openapi.json", dom_id: "#swagger-ui"});
+</script>
+</body>
+</html>
+`
+
+// Explorer handles GET /docs.
+func (h *OpenAPIHandler) Explorer(c *echo.Context) error {
+	return c.HTML(http.StatusOK, explorerPage)
+}
@@ -0,0 +1,214 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"gemini-wrapper/model"
+	"gemini-wrapper/service/session"
+	"gemini-wrapper/service/tenants"
+
+	"github.com/labstack/echo/v5"
+)
+
+type SessionHandler struct {
+	manager *session.Manager
+}
+
+func NewSessionHandler(manager *session.Manager) *SessionHandler {
+	return &SessionHandler{manager: manager}
+}
+
+// CreateSession handles POST /api/sessions.
+func (h *SessionHandler) CreateSession(c *echo.Context) error {
+	req := new(model.CreateSessionRequest)
+	if err := c.Bind(req); err != nil {
+		failure := bindFailure(err, "Invalid request format")
+		return c.JSON(failure.Status, map[string]string{"error": failure.Message})
+	}
+
+	req.Tenant = tenants.Name(c.Request().Context())
+	info, err := h.manager.Create(*req)
+	if err != nil {
+		return writeSessionError(c, err)
+	}
+	return c.JSON(http.StatusCreated, info)
+}
+
+// ListSessions handles GET /api/sessions.
+func (h *SessionHandler) ListSessions(c *echo.Context) error {
+	tenant := tenants.Name(c.Request().Context())
+	sessions := []model.SessionInfo{}
+	for _, info := range h.manager.List() {
+		if info.Tenant == tenant {
+			sessions = append(sessions, info)
+		}
+	}
+	return c.JSON(http.StatusOK, model.SessionListResponse{Sessions: sessions})
+}
+
+// GetSession handles GET /api/sessions/:id.
+func (h *SessionHandler) GetSession(c *echo.Context) error {
+	info, err := h.owned(c, c.Param("id"))
+	if err != nil {
+		return writeSessionError(c, err)
+	}
+	return c.JSON(http.StatusOK, info)
+}
+
+// GetSessionHistory handles GET /api/sessions/:id/history.
+func (h *SessionHandler) GetSessionHistory(c *echo.Context) error {
+	if _, err := h.owned(c, c.Param("id")); err != nil {
+		return writeSessionError(c, err)
+	}
+	transcript, err := h.manager.History(c.Param("id"))
+	if err != nil {
+		return writeSessionError(c, err)
+	}
+	return c.JSON(http.StatusOK, transcript)
+}
+
+// ImportSession handles POST /api/sessions/import. It takes a transcript as
+// returned by GetSessionHistory and answers 201 with the new session.
+func (h *SessionHandler) ImportSession(c *echo.Context) error {
+	req := new(model.SessionTranscript)
+	if err := c.Bind(req); err != nil {
+		failure := bindFailure(err, "Invalid request format")
+		return c.JSON(failure.Status, map[string]string{"error": failure.Message})
+	}
+
+	req.Tenant = tenants.Name(c.Request().Context())
+	info, err := h.manager.Import(*req)
+	if err != nil {
+		return writeSessionError(c, err)
+	}
+	c.Response().Header().Set(echo.HeaderLocation, "/api/sessions/"+info.ID)
+	return c.JSON(http.StatusCreated, info)
+}
+
+// DeleteSession handles DELETE /api/sessions/:id.
+func (h *SessionHandler) DeleteSession(c *echo.Context) error {
+	if _, err := h.owned(c, c.Param("id")); err != nil {
+		return writeSessionError(c, err)
+	}
+	if err := h.manager.Delete(c.Param("id")); err != nil {
+		return writeSessionError(c, err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// RestoreSession handles POST /api/sessions/:id/restore. It brings back a
+// session deleted, or closed for idleness, within the retention period.
+func (h *SessionHandler) RestoreSession(c *echo.Context) error {
+	info, err := h.manager.Restore(c.Param("id"), tenants.Name(c.Request().Context()))
+	if err != nil {
+		return writeSessionError(c, err)
+	}
+	return c.JSON(http.StatusOK, info)
+}
+
+// AskSession handles POST /api/sessions/:id/ask.
+func (h *SessionHandler) AskSession(c *echo.Context) error {
+	id := c.Param("id")
+	req := new(model.AskRequest)
+	if err := c.Bind(req); err != nil {
+		failure := bindFailure(err, "Invalid request format")
+		return c.JSON(failure.Status, model.SessionAskResponse{SessionID: id, Error: failure.Message})
+	}
+
+	req.Question = strings.TrimSpace(req.Question)
+	if req.Question == "" {
+		return c.JSON(http.StatusBadRequest, model.SessionAskResponse{SessionID: id, Error: "Question is required"})
+	}
+
+	if _, err := h.owned(c, id); err != nil {
+		return writeSessionError(c, err)
+	}
+	answer, status, err := h.manager.Ask(c.Request().Context(), id, req.Question)
+	if err != nil {
+		if errors.Is(err, session.ErrSessionNotFound) {
+			return writeSessionError(c, err)
+		}
+		return c.JSON(askErrorCode(status), model.SessionAskResponse{SessionID: id, Error: err.Error(), Code: failureCode(status), Status: status})
+	}
+	return c.JSON(http.StatusOK, model.SessionAskResponse{SessionID: id, Answer: answer, Status: status})
+}
+
+// CompressSession handles POST /api/sessions/:id/compress.
+func (h *SessionHandler) CompressSession(c *echo.Context) error {
+	id := c.Param("id")
+	if _, err := h.owned(c, id); err != nil {
+		return writeSessionError(c, err)
+	}
+	result, status, err := h.manager.Compress(c.Request().Context(), id)
+	if err != nil {
+		if errors.Is(err, session.ErrSessionNotFound) {
+			return writeSessionError(c, err)
+		}
+		result.Error, result.Code, result.Status = err.Error(), failureCode(status), status
+		return c.JSON(askErrorCode(status), result)
+	}
+	result.Status = status
+	return c.JSON(http.StatusOK, result)
+}
+
+// GetSessionContext handles GET /api/sessions/:id/context.
+func (h *SessionHandler) GetSessionContext(c *echo.Context) error {
+	if _, err := h.owned(c, c.Param("id")); err != nil {
+		return writeSessionError(c, err)
+	}
+	file, err := h.manager.Context(c.Param("id"))
+	if err != nil {
+		return writeSessionError(c, err)
+	}
+	return c.JSON(http.StatusOK, file)
+}
+
+// PutSessionContext handles PUT /api/sessions/:id/context.
+func (h *SessionHandler) PutSessionContext(c *echo.Context) error {
+	req := new(model.SetContextRequest)
+	if err := c.Bind(req); err != nil {
+		failure := bindFailure(err, "Invalid request format")
+		return c.JSON(failure.Status, map[string]string{"error": failure.Message})
+	}
+	if _, err := h.owned(c, c.Param("id")); err != nil {
+		return writeSessionError(c, err)
+	}
+	file, err := h.manager.SetContext(c.Param("id"), req.Content)
+	if err != nil {
+		return writeSessionError(c, err)
+	}
+	return c.JSON(http.StatusOK, file)
+}
+
+// DeleteSessionContext handles DELETE /api/sessions/:id/context.
+func (h *SessionHandler) DeleteSessionContext(c *echo.Context) error {
+	if _, err := h.owned(c, c.Param("id")); err != nil {
+		return writeSessionError(c, err)
+	}
+	if _, err := h.manager.SetContext(c.Param("id"), ""); err != nil {
+		return writeSessionError(c, err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// owned returns session id when it belongs to the tenant of the request.
+// The sessions of other tenants are not found, so their IDs leak nothing.
+func (h *SessionHandler) owned(c *echo.Context, id string) (model.SessionInfo, error) {
+	info, err := h.manager.Get(id)
+	if err == nil && info.Tenant != tenants.Name(c.Request().Context()) {
+		return model.SessionInfo{}, session.ErrSessionNotFound
+	}
+	return info, err
+}
+
+func writeSessionError(c *echo.Context, err error) error {
+	switch {
+	case errors.Is(err, session.ErrSessionNotFound):
+		return c.JSON(http.StatusNotFound, map[string]string{"error": err.Error()})
+	case errors.Is(err, session.ErrInvalidTranscript), errors.Is(err, session.ErrEnvNotAllowed):
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+}
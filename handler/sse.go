@@ -0,0 +1,147 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"gemini-wrapper/pkg/gemini"
+
+	"github.com/labstack/echo/v5"
+)
+
+// sseWriter writes server-sent events. It is safe for concurrent use, so
+// heartbeats can be sent while the answer streams.
+type sseWriter struct {
+	mu      sync.Mutex
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+// startSSE writes the event-stream headers and returns a writer for subsequent events.
+func startSSE(c *echo.Context) (*sseWriter, error) {
+	r := c.Response()
+	flusher, ok := r.(http.Flusher)
+	if !ok {
+		return nil, fmt.Errorf("response writer does not implement http.Flusher")
+	}
+	r.Header().Set(echo.HeaderContentType, "text/event-stream")
+	r.Header().Set("Cache-Control", "no-cache")
+	r.Header().Set("Connection", "keep-alive")
+	r.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	return &sseWriter{w: r, flusher: flusher}, nil
+}
+
+// Event writes a named event with a JSON payload. An empty name writes a data-only event.
+func (s *sseWriter) Event(event string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if event != "" {
+		if _, err := fmt.Fprintf(s.w, "event: %s\n", event); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintf(s.w, "data: %s\n\n", string(body)); err != nil {
+		return err
+	}
+	s.flusher.Flush()
+	return nil
+}
+
+// Comment writes an SSE comment, which clients ignore; it keeps idle streams
+// open through proxies.
+func (s *sseWriter) Comment(text string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := fmt.Fprintf(s.w, ": %s\n\n", text)
+	s.flusher.Flush()
+	return err
+}
+
+// Done writes the terminating [DONE] marker used by OpenAI-style streams.
+func (s *sseWriter) Done() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := fmt.Fprint(s.w, "data: [DONE]\n\n")
+	s.flusher.Flush()
+	return err
+}
+
+// ProgressComment writes progress as a comment. Clients of the OpenAI,
+// Anthropic and Gemini APIs skip it; others may read the JSON after
+// "progress".
+func (s *sseWriter) ProgressComment(progress *gemini.Progress) error {
+	body, err := json.Marshal(progress.Snapshot())
+	if err != nil {
+		return err
+	}
+	return s.Comment("progress " + string(body))
+}
+
+// lazySSE opens the event stream on first use, so that errors raised before
+// any output are still answered with a regular JSON error.
+type lazySSE struct {
+	c      *echo.Context
+	mu     sync.Mutex
+	stream *sseWriter
+}
+
+// open returns the stream, starting it on the first call.
+func (l *lazySSE) open() (*sseWriter, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stream == nil {
+		stream, err := startSSE(l.c)
+		if err != nil {
+			return nil, err
+		}
+		l.stream = stream
+	}
+	return l.stream, nil
+}
+
+// opened returns the stream, or nil when it was never opened.
+func (l *lazySSE) opened() *sseWriter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.stream
+}
+
+// heartbeat calls beat every interval until stop is called or beat fails,
+// such as once the client went away. stop waits for a beat being sent. A
+// zero interval never beats.
+func heartbeat(interval time.Duration, beat func() error) (stop func()) {
+	if interval <= 0 {
+		return func() {}
+	}
+	quit, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-quit:
+				return
+			case <-ticker.C:
+				if beat() != nil {
+					return
+				}
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(quit)
+			<-done
+		})
+	}
+}
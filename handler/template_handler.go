@@ -0,0 +1,101 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"gemini-wrapper/model"
+	"gemini-wrapper/service/templates"
+
+	"github.com/labstack/echo/v5"
+)
+
+type TemplateHandler struct {
+	store *templates.Store
+}
+
+func NewTemplateHandler(store *templates.Store) *TemplateHandler {
+	return &TemplateHandler{store: store}
+}
+
+// ListTemplates handles GET /api/templates.
+func (h *TemplateHandler) ListTemplates(c *echo.Context) error {
+	return c.JSON(http.StatusOK, model.TemplateListResponse{Templates: h.store.List()})
+}
+
+// CreateTemplate handles POST /api/templates.
+func (h *TemplateHandler) CreateTemplate(c *echo.Context) error {
+	req := new(model.PromptTemplate)
+	if err := c.Bind(req); err != nil {
+		failure := bindFailure(err, "Invalid request format")
+		return c.JSON(failure.Status, map[string]string{"error": failure.Message})
+	}
+	info, err := h.store.Create(strings.TrimSpace(req.Name), req.Description, req.Template)
+	if err != nil {
+		return writeTemplateError(c, err)
+	}
+	c.Response().Header().Set(echo.HeaderLocation, "/api/templates/"+info.Name)
+	return c.JSON(http.StatusCreated, info)
+}
+
+// GetTemplate handles GET /api/templates/:name.
+func (h *TemplateHandler) GetTemplate(c *echo.Context) error {
+	info, err := h.store.Get(c.Param("name"))
+	if err != nil {
+		return writeTemplateError(c, err)
+	}
+	return c.JSON(http.StatusOK, info)
+}
+
+// PutTemplate handles PUT /api/templates/:name, creating the template or
+// replacing its text and description.
+func (h *TemplateHandler) PutTemplate(c *echo.Context) error {
+	req := new(model.PromptTemplate)
+	if err := c.Bind(req); err != nil {
+		failure := bindFailure(err, "Invalid request format")
+		return c.JSON(failure.Status, map[string]string{"error": failure.Message})
+	}
+	info, created, err := h.store.Put(c.Param("name"), req.Description, req.Template)
+	if err != nil {
+		return writeTemplateError(c, err)
+	}
+	if created {
+		return c.JSON(http.StatusCreated, info)
+	}
+	return c.JSON(http.StatusOK, info)
+}
+
+// DeleteTemplate handles DELETE /api/templates/:name.
+func (h *TemplateHandler) DeleteTemplate(c *echo.Context) error {
+	if err := h.store.Delete(c.Param("name")); err != nil {
+		return writeTemplateError(c, err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func writeTemplateError(c *echo.Context, err error) error {
+	switch {
+	case errors.Is(err, templates.ErrTemplateNotFound):
+		return c.JSON(http.StatusNotFound, map[string]string{"error": err.Error()})
+	case errors.Is(err, templates.ErrTemplateExists):
+		return c.JSON(http.StatusConflict, map[string]string{"error": err.Error()})
+	case errors.Is(err, templates.ErrInvalidTemplate):
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+}
+
+// applyTemplate renders the template an ask names into its question. Unknown
+// templates and render failures are the client's fault.
+func applyTemplate(store *templates.Store, req *model.AskRequest) error {
+	if req.Template == "" {
+		return nil
+	}
+	prompt, err := store.Render(req.Template, req.Variables, strings.TrimSpace(req.Question))
+	if err != nil {
+		return err
+	}
+	req.Question = prompt
+	return nil
+}
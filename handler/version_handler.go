@@ -0,0 +1,87 @@
+package handler
+
+import (
+	"net/http"
+	"runtime/debug"
+	"slices"
+
+	"gemini-wrapper/pkg/gemini"
+
+	"github.com/labstack/echo/v5"
+)
+
+// Version is the release of the wrapper. Release builds set it with
+// -ldflags "-X gemini-wrapper/handler.Version=v1.2.3"; other builds report
+// the module version of the binary, or "dev".
+var Version = ""
+
+// VersionHandler tells clients what they are talking to.
+type VersionHandler struct {
+	service  *gemini.GeminiService
+	features []string
+	build    buildInfo
+}
+
+// buildInfo is where the running binary came from.
+type buildInfo struct {
+	Version    string `json:"version"`
+	Commit     string `json:"commit,omitempty"`
+	CommitTime string `json:"commitTime,omitempty"`
+	Modified   bool   `json:"modified,omitempty"`
+	GoVersion  string `json:"goVersion,omitempty"`
+}
+
+// versionResponse is the build of the wrapper next to the capabilities of
+// its service. Features joins both, so it lists the APIs that are served as
+// well as the optional behaviours of the service.
+type versionResponse struct {
+	buildInfo
+	gemini.Capabilities
+}
+
+// NewVersionHandler reports the service's capabilities with features, the
+// optional APIs and middleware the server enabled.
+func NewVersionHandler(service *gemini.GeminiService, features []string) *VersionHandler {
+	return &VersionHandler{service: service, features: features, build: readBuildInfo()}
+}
+
+// Version handles GET /api/version.
+func (h *VersionHandler) Version(c *echo.Context) error {
+	resp := versionResponse{buildInfo: h.build}
+	if h.service != nil {
+		resp.Capabilities = h.service.Capabilities()
+	}
+	resp.Features = append(resp.Features, h.features...)
+	slices.Sort(resp.Features)
+	resp.Features = slices.Compact(resp.Features)
+	return c.JSON(http.StatusOK, resp)
+}
+
+func readBuildInfo() buildInfo {
+	build := buildInfo{Version: Version}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		if build.Version == "" {
+			build.Version = "dev"
+		}
+		return build
+	}
+	build.GoVersion = info.GoVersion
+	if build.Version == "" && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		build.Version = info.Main.Version
+	}
+	if build.Version == "" {
+		build.Version = "dev"
+	}
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			build.Commit = setting.Value
+		case "vcs.time":
+			build.CommitTime = setting.Value
+		case "vcs.modified":
+			build.Modified = setting.Value == "true"
+		}
+	}
+	return build
+}
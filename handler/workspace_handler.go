@@ -0,0 +1,199 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"gemini-wrapper/model"
+	"gemini-wrapper/service/templates"
+	"gemini-wrapper/service/workspaces"
+
+	"github.com/labstack/echo/v5"
+)
+
+type WorkspaceHandler struct {
+	manager   *workspaces.Manager
+	templates *templates.Store
+}
+
+func NewWorkspaceHandler(manager *workspaces.Manager, templates *templates.Store) *WorkspaceHandler {
+	return &WorkspaceHandler{manager: manager, templates: templates}
+}
+
+// CreateWorkspace handles POST /api/workspaces.
+func (h *WorkspaceHandler) CreateWorkspace(c *echo.Context) error {
+	info, err := h.manager.Create()
+	if err != nil {
+		return writeWorkspaceError(c, err)
+	}
+	c.Response().Header().Set(echo.HeaderLocation, "/api/workspaces/"+info.ID)
+	return c.JSON(http.StatusCreated, info)
+}
+
+// ListWorkspaces handles GET /api/workspaces.
+func (h *WorkspaceHandler) ListWorkspaces(c *echo.Context) error {
+	return c.JSON(http.StatusOK, model.WorkspaceListResponse{Workspaces: h.manager.List()})
+}
+
+// GetWorkspace handles GET /api/workspaces/:id. It lists the files with
+// their state relative to the uploaded ones.
+func (h *WorkspaceHandler) GetWorkspace(c *echo.Context) error {
+	info, err := h.manager.Get(c.Param("id"))
+	if err != nil {
+		return writeWorkspaceError(c, err)
+	}
+	return c.JSON(http.StatusOK, info)
+}
+
+// DeleteWorkspace handles DELETE /api/workspaces/:id.
+func (h *WorkspaceHandler) DeleteWorkspace(c *echo.Context) error {
+	if err := h.manager.Delete(c.Param("id")); err != nil {
+		return writeWorkspaceError(c, err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// PutFile handles PUT /api/workspaces/:id/files/*. The request body is the
+// file content.
+func (h *WorkspaceHandler) PutFile(c *echo.Context) error {
+	file, err := h.manager.WriteFile(c.Param("id"), c.Param("*"), c.Request().Body)
+	if err != nil {
+		return writeWorkspaceError(c, err)
+	}
+	return c.JSON(http.StatusOK, file)
+}
+
+// GetFile handles GET /api/workspaces/:id/files/*.
+func (h *WorkspaceHandler) GetFile(c *echo.Context) error {
+	content, err := h.manager.ReadFile(c.Param("id"), c.Param("*"))
+	if err != nil {
+		return writeWorkspaceError(c, err)
+	}
+	return c.Blob(http.StatusOK, http.DetectContentType(content), content)
+}
+
+// DeleteFile handles DELETE /api/workspaces/:id/files/*.
+func (h *WorkspaceHandler) DeleteFile(c *echo.Context) error {
+	if err := h.manager.DeleteFile(c.Param("id"), c.Param("*")); err != nil {
+		return writeWorkspaceError(c, err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// GetDiff handles GET /api/workspaces/:id/diff.
+func (h *WorkspaceHandler) GetDiff(c *echo.Context) error {
+	diff, err := h.manager.Diff(c.Param("id"))
+	if err != nil {
+		return writeWorkspaceError(c, err)
+	}
+	return c.Blob(http.StatusOK, "text/x-diff; charset=utf-8", diff)
+}
+
+// GetArchive handles GET /api/workspaces/:id/archive. The format query
+// parameter selects tar.gz (the default) or zip; changed=true leaves out the
+// files that are as they were uploaded.
+func (h *WorkspaceHandler) GetArchive(c *echo.Context) error {
+	id := c.Param("id")
+	format := c.QueryParam("format")
+	switch format {
+	case "", "tgz":
+		format = workspaces.ArchiveTarGz
+	}
+	changedOnly, _ := strconv.ParseBool(c.QueryParam("changed"))
+	archive, err := h.manager.Archive(id, format, changedOnly)
+	if err != nil {
+		return writeWorkspaceError(c, err)
+	}
+	contentType := "application/gzip"
+	if format == workspaces.ArchiveZip {
+		contentType = "application/zip"
+	}
+	c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", id+"."+format))
+	return c.Blob(http.StatusOK, contentType, archive)
+}
+
+// GetWorkspaceContext handles GET /api/workspaces/:id/context.
+func (h *WorkspaceHandler) GetWorkspaceContext(c *echo.Context) error {
+	file, err := h.manager.Context(c.Param("id"))
+	if err != nil {
+		return writeWorkspaceError(c, err)
+	}
+	return c.JSON(http.StatusOK, file)
+}
+
+// PutWorkspaceContext handles PUT /api/workspaces/:id/context.
+func (h *WorkspaceHandler) PutWorkspaceContext(c *echo.Context) error {
+	req := new(model.SetContextRequest)
+	if err := c.Bind(req); err != nil {
+		failure := bindFailure(err, "Invalid request format")
+		return c.JSON(failure.Status, map[string]string{"error": failure.Message})
+	}
+	file, err := h.manager.SetContext(c.Param("id"), req.Content)
+	if err != nil {
+		return writeWorkspaceError(c, err)
+	}
+	return c.JSON(http.StatusOK, file)
+}
+
+// DeleteWorkspaceContext handles DELETE /api/workspaces/:id/context.
+func (h *WorkspaceHandler) DeleteWorkspaceContext(c *echo.Context) error {
+	if _, err := h.manager.SetContext(c.Param("id"), ""); err != nil {
+		return writeWorkspaceError(c, err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// AskWorkspace handles POST /api/workspaces/:id/ask. It takes the /api/ask
+// body; answers are never streamed.
+func (h *WorkspaceHandler) AskWorkspace(c *echo.Context) error {
+	id := c.Param("id")
+	req := new(model.AskRequest)
+	if err := c.Bind(req); err != nil {
+		failure := bindFailure(err, "Invalid request format")
+		return c.JSON(failure.Status, model.WorkspaceAskResponse{WorkspaceID: id, Error: failure.Message})
+	}
+	if err := applyTemplate(h.templates, req); err != nil {
+		return c.JSON(http.StatusBadRequest, model.WorkspaceAskResponse{WorkspaceID: id, Error: err.Error()})
+	}
+	req.Question = strings.TrimSpace(req.Question)
+	if req.Question == "" {
+		return c.JSON(http.StatusBadRequest, model.WorkspaceAskResponse{WorkspaceID: id, Error: "Question is required"})
+	}
+	if req.TimeoutSeconds < 0 {
+		return c.JSON(http.StatusBadRequest, model.WorkspaceAskResponse{WorkspaceID: id, Error: "timeout_seconds must not be negative"})
+	}
+	if req.DryRun {
+		return c.JSON(http.StatusBadRequest, model.WorkspaceAskResponse{WorkspaceID: id, Error: "dry_run is not supported here"})
+	}
+	if len(req.Files) > 0 {
+		return c.JSON(http.StatusBadRequest, model.WorkspaceAskResponse{WorkspaceID: id, Error: "files are not supported here; put them into the workspace with PUT /api/workspaces/:id/files/*"})
+	}
+
+	answer, status, changes, err := h.manager.Ask(c.Request().Context(), id, req.Question, askOptions(req))
+	if err != nil {
+		if errors.Is(err, workspaces.ErrWorkspaceNotFound) || errors.Is(err, workspaces.ErrBusy) {
+			return writeWorkspaceError(c, err)
+		}
+		return c.JSON(askErrorCode(status), model.WorkspaceAskResponse{WorkspaceID: id, Error: err.Error(), Code: failureCode(status), Status: status})
+	}
+	return c.JSON(http.StatusOK, model.WorkspaceAskResponse{WorkspaceID: id, Answer: answer, Usage: usageOf(status), Status: status, Changes: changes, ToolEvents: toolEventsOf(status), Citations: citationsOf(status)})
+}
+
+func writeWorkspaceError(c *echo.Context, err error) error {
+	switch {
+	case errors.Is(err, workspaces.ErrWorkspaceNotFound), errors.Is(err, workspaces.ErrFileNotFound):
+		return c.JSON(http.StatusNotFound, map[string]string{"error": err.Error()})
+	case errors.Is(err, workspaces.ErrInvalidPath), errors.Is(err, workspaces.ErrInvalidFormat):
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	case errors.Is(err, workspaces.ErrBusy):
+		return c.JSON(http.StatusConflict, map[string]string{"error": err.Error()})
+	case errors.Is(err, workspaces.ErrTooLarge):
+		return c.JSON(http.StatusRequestEntityTooLarge, map[string]string{"error": err.Error()})
+	case errors.Is(err, workspaces.ErrTooManyWorkspaces):
+		return c.JSON(http.StatusTooManyRequests, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+}
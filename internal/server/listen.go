@@ -0,0 +1,94 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+
+	"gemini-wrapper/config"
+)
+
+// listenFDsStart is the first file descriptor systemd passes to an activated
+// service.
+const listenFDsStart = 3
+
+// listen opens the listener of the HTTP API: the socket passed in by systemd
+// socket activation, else a Unix socket at cfg.Socket, else the TCP port.
+func listen(cfg config.Config) (net.Listener, error) {
+	if listener, err := activatedListener(); listener != nil || err != nil {
+		return listener, err
+	}
+	if cfg.Socket != "" {
+		var mode uint64
+		if cfg.SocketMode != "" {
+			var err error
+			if mode, err = strconv.ParseUint(cfg.SocketMode, 8, 32); err != nil {
+				return nil, fmt.Errorf("invalid socket mode %q", cfg.SocketMode)
+			}
+		}
+		return listenUnix(cfg.Socket, fs.FileMode(mode))
+	}
+	return net.Listen("tcp", ":"+cfg.Port)
+}
+
+// activatedListener returns the first socket passed in by systemd, or nil when
+// the process was not socket activated. The LISTEN_* variables are removed so
+// CLI processes do not mistake the sockets for their own.
+func activatedListener() (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if err != nil || count < 1 {
+		return nil, nil
+	}
+	if count > 1 {
+		slog.Warn("socket activation passed several sockets, serving the first", "count", count)
+	}
+	file := os.NewFile(uintptr(listenFDsStart), "systemd-socket")
+	defer file.Close()
+	listener, err := net.FileListener(file)
+	if err != nil {
+		return nil, fmt.Errorf("socket activation: %w", err)
+	}
+	slog.Info("using socket from systemd", "address", listener.Addr().String())
+	return listener, nil
+}
+
+// listenUnix listens on a Unix socket at path, replacing a stale socket left
+// behind by a previous run, and applies mode to it when mode is not zero.
+func listenUnix(path string, mode fs.FileMode) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode().Type() != fs.ModeSocket {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use by another process", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if mode != 0 {
+		if err := os.Chmod(path, mode); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+	return listener, nil
+}
@@ -0,0 +1,32 @@
+package server
+
+import (
+	"context"
+	"time"
+)
+
+// reaper expires the idle resources of a feature.
+type reaper interface {
+	Reap()
+}
+
+// reap runs every reaper each interval until ctx is done, so sessions,
+// workspaces and files expire even when nobody uses them. A zero interval
+// disables it.
+func reap(ctx context.Context, interval time.Duration, reapers []reaper) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, r := range reapers {
+				r.Reap()
+			}
+		}
+	}
+}
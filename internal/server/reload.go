@@ -0,0 +1,139 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"gemini-wrapper/config"
+	"gemini-wrapper/logging"
+	"gemini-wrapper/pkg/gemini"
+	"gemini-wrapper/service/anthropic"
+	"gemini-wrapper/service/ollama"
+	"gemini-wrapper/service/openai"
+	"gemini-wrapper/service/ratelimit"
+)
+
+// reloader applies a changed configuration to the running server. The
+// settings config.Reloadable lists take effect at once; the others are only
+// logged, since restarting would kill the warm CLI sessions.
+type reloader struct {
+	limiter   *ratelimit.Limiter
+	service   *gemini.GeminiService
+	openAI    *openai.GeminiAdapter
+	anthropic *anthropic.GeminiAdapter
+	ollama    *ollama.GeminiAdapter
+
+	mu sync.Mutex
+	// started is the configuration the server started with and current
+	// the one last applied.
+	started config.Config
+	current config.Config
+}
+
+func newReloader(cfg config.Config) *reloader {
+	return &reloader{started: cfg, current: cfg}
+}
+
+// apply sets the reloadable settings of cfg.
+func (r *reloader) apply(cfg config.Config) {
+	if r.limiter != nil {
+		r.limiter.SetConfig(cfg.RateLimit)
+	}
+	r.service.Reconfigure(cfg.Gemini)
+	r.openAI.SetModelAliases(cfg.ModelAliases.OpenAI)
+	r.anthropic.SetModelAliases(cfg.ModelAliases.Anthropic)
+	r.ollama.SetModelAliases(cfg.ModelAliases.Ollama)
+}
+
+// reload reads the configuration again and applies what changed. It returns
+// the settings applied and the ones that differ from the running server
+// until it restarts.
+func (r *reloader) reload() (applied, restartRequired []string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	next, err := r.current.Reload()
+	if err != nil {
+		slog.Error("configuration reload failed", "error", err)
+		return nil, nil, err
+	}
+
+	for _, path := range r.current.Changes(next) {
+		if r.reloadable(path) {
+			applied = append(applied, path)
+		}
+	}
+	for _, path := range r.started.Changes(next) {
+		if !r.reloadable(path) {
+			restartRequired = append(restartRequired, path)
+		}
+	}
+	if slices.Contains(applied, "log.level") {
+		if level, ok := logging.LookupLevel(next.Log.Level); ok {
+			logging.SetLevel(level)
+		}
+	}
+	r.apply(next)
+	r.current = next
+
+	slog.Info("configuration reloaded", "file", next.File(), "applied", applied)
+	if len(restartRequired) > 0 {
+		slog.Warn("configuration changes need a restart", "settings", restartRequired)
+	}
+	return applied, restartRequired, nil
+}
+
+// reloadable reports whether the setting at path can be applied. Rate limits
+// can only change when the server started with a limiter.
+func (r *reloader) reloadable(path string) bool {
+	if strings.HasPrefix(path, "rate_limit.") && r.limiter == nil {
+		return false
+	}
+	return config.Reloadable(path)
+}
+
+// watch reloads the configuration on SIGHUP and, when an interval is set,
+// whenever the config file's modification time changes, until ctx is done.
+func (r *reloader) watch(ctx context.Context, file string, interval time.Duration) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	var tick <-chan time.Time
+	modTime := fileModTime(file)
+	if file != "" && interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+			slog.Info("reloading configuration on SIGHUP")
+			r.reload()
+		case <-tick:
+			if current := fileModTime(file); !current.Equal(modTime) {
+				modTime = current
+				r.reload()
+			}
+		}
+	}
+}
+
+// fileModTime returns the modification time of file, or the zero time when
+// it cannot be read.
+func fileModTime(file string) time.Time {
+	info, err := os.Stat(file)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
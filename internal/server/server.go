@@ -0,0 +1,494 @@
+// Package server assembles the wrapper from its configuration: the Gemini
+// service, the handlers of every API, the middleware and the HTTP and gRPC
+// listeners.
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"gemini-wrapper/config"
+	"gemini-wrapper/grpcapi"
+	"gemini-wrapper/handler"
+	"gemini-wrapper/logging"
+	"gemini-wrapper/metrics"
+	appmiddleware "gemini-wrapper/middleware"
+	"gemini-wrapper/pkg/gemini"
+	"gemini-wrapper/router"
+	"gemini-wrapper/service/accesslog"
+	"gemini-wrapper/service/accounting"
+	"gemini-wrapper/service/anthropic"
+	"gemini-wrapper/service/audit"
+	"gemini-wrapper/service/budget"
+	"gemini-wrapper/service/cluster"
+	"gemini-wrapper/service/embeddings"
+	"gemini-wrapper/service/files"
+	"gemini-wrapper/service/idempotency"
+	"gemini-wrapper/service/jobs"
+	"gemini-wrapper/service/ollama"
+	"gemini-wrapper/service/openai"
+	"gemini-wrapper/service/passthrough"
+	"gemini-wrapper/service/postprocess"
+	"gemini-wrapper/service/ratelimit"
+	"gemini-wrapper/service/session"
+	"gemini-wrapper/service/storage"
+	"gemini-wrapper/service/templates"
+	"gemini-wrapper/service/tenants"
+	"gemini-wrapper/service/urlcontext"
+	"gemini-wrapper/service/workspaces"
+
+	"github.com/labstack/echo/v5"
+	"github.com/labstack/echo/v5/middleware"
+)
+
+// Run serves cfg until ctx is done. It then stops accepting connections,
+// lets in-flight requests finish for up to cfg.ShutdownTimeout and closes the
+// services; CLI processes still running after that are interrupted.
+func Run(ctx context.Context, cfg config.Config) error {
+	logger := logging.Setup(cfg.Log.Format, cfg.Log.Level)
+
+	// Create Echo instance
+	e := echo.New()
+	e.Logger = logger
+	ipExtractor, err := appmiddleware.ClientIPExtractor(cfg.Access.TrustedProxies, cfg.Access.ClientIPHeader)
+	if err != nil {
+		return fmt.Errorf("access: %w", err)
+	}
+	e.IPExtractor = ipExtractor
+	ipFilter, err := appmiddleware.NewIPFilter(cfg.Access.IPAllowlist, cfg.Access.IPDenylist)
+	if err != nil {
+		return fmt.Errorf("access: %w", err)
+	}
+	binder := handler.NewBinder(cfg.MaxBodyBytes)
+	e.Binder = binder
+	e.Validator = binder
+
+	// What Run opens is closed when it returns, whether it stopped serving
+	// or failed to start; the close methods accept what was never opened.
+	var (
+		accessLog        *accesslog.Logger
+		shared           *cluster.Cluster
+		stateDB          *storage.DB
+		geminiService    *gemini.GeminiService
+		templateStore    *templates.Store
+		sessionManager   *session.Manager
+		usageStore       *accounting.Store
+		jobManager       *jobs.Manager
+		budgets          *budget.Budget
+		idempotencyStore *idempotency.Store
+		auditLog         *audit.Log
+		// reaped is closed once the reaper stopped, after stopReaping.
+		reaped      chan struct{}
+		stopReaping = func() {}
+	)
+	defer func() {
+		// The stores below must not be closed while they are being reaped.
+		stopReaping()
+		if reaped != nil {
+			<-reaped
+		}
+		// Stop the jobs first: the ones still running are interrupted by
+		// this and not by the service closing, so they stay queued for the
+		// next start.
+		if err := jobManager.Close(); err != nil {
+			logger.Warn("closing jobs failed", "error", err)
+		}
+		logger.Info("closing gemini service")
+		if err := geminiService.Close(); err != nil {
+			logger.Warn("closing gemini service failed", "error", err)
+		}
+		if err := usageStore.Close(); err != nil {
+			logger.Warn("closing usage accounting failed", "error", err)
+		}
+		if err := budgets.Close(); err != nil {
+			logger.Warn("closing budget counters failed", "error", err)
+		}
+		if err := idempotencyStore.Close(); err != nil {
+			logger.Warn("closing idempotency store failed", "error", err)
+		}
+		if err := auditLog.Close(); err != nil {
+			logger.Warn("closing audit log failed", "error", err)
+		}
+		if err := accessLog.Close(); err != nil {
+			logger.Warn("closing access log failed", "error", err)
+		}
+		if err := templateStore.Close(); err != nil {
+			logger.Warn("closing prompt templates failed", "error", err)
+		}
+		if err := sessionManager.Close(); err != nil {
+			logger.Warn("closing sessions failed", "error", err)
+		}
+		if err := stateDB.Close(); err != nil {
+			logger.Warn("closing storage failed", "error", err)
+		}
+		if err := shared.Close(); err != nil {
+			logger.Warn("closing Redis connection failed", "error", err)
+		}
+	}()
+
+	if cfg.AccessLog.Enabled {
+		accessLog, err = accesslog.Open(cfg.AccessLog)
+		if err != nil {
+			return fmt.Errorf("access log: %w", err)
+		}
+	}
+
+	// Middleware
+	e.Use(appmiddleware.RequestID())
+	if accessLog != nil {
+		e.Use(appmiddleware.AccessLog(accessLog))
+	} else {
+		e.Use(middleware.RequestLogger())
+	}
+	e.Use(middleware.Recover())
+	e.Use(middleware.CORS("*"))
+	e.Use(appmiddleware.RecordMetrics())
+	e.Use(appmiddleware.CacheHeader())
+	// File uploads are limited by FILES_MAX_FILE_BYTES and
+	// WORKSPACES_MAX_BYTES instead.
+	e.Use(appmiddleware.LimitBody(cfg.MaxBodyBytes, "/upload/v1beta/files", "/upload/v1beta/*", "/api/workspaces/:id/files/*"))
+
+	if cfg.Cluster.Enabled() {
+		shared, err = cluster.Open(cfg.Cluster)
+		if err != nil {
+			return fmt.Errorf("cluster: %w", err)
+		}
+		logger.Info("sharing state with other replicas through Redis", "advertise_url", shared.Self())
+	}
+
+	// stateDB is the database all stores share when storage.path is set;
+	// without it every feature keeps its own.
+	if cfg.Storage.Path != "" {
+		stateDB, err = storage.Open(cfg.Storage.Path)
+		if err != nil {
+			return fmt.Errorf("storage: %w", err)
+		}
+		logger.Info("keeping state in one database", "path", cfg.Storage.Path)
+	}
+
+	// Initialize Gemini and OpenAI-compatible handlers
+	geminiService = gemini.NewGeminiServiceWithConfig(cfg.Gemini)
+	metrics.Default.NewGaugeFunc("gemini_wrapper_workers_busy", "Backend workers currently running a request.", func() float64 {
+		return float64(geminiService.PoolStats().Busy)
+	})
+	metrics.Default.NewGaugeFunc("gemini_wrapper_queue_depth", "Requests waiting for a free backend worker.", func() float64 {
+		return float64(geminiService.PoolStats().Waiting)
+	})
+	metrics.Default.NewGaugeFunc("gemini_wrapper_queue_oldest_wait_seconds", "How long the oldest queued request has been waiting.", func() float64 {
+		return geminiService.PoolStats().OldestWaitSeconds
+	})
+	metrics.Default.NewGaugeFunc("gemini_wrapper_backend_ready", "1 when the backend supervisor reports the backend as ready.", func() float64 {
+		if geminiService.Health().Ready {
+			return 1
+		}
+		return 0
+	})
+	metrics.Default.NewGaugeFunc("gemini_wrapper_circuit_open", "1 while the upstream circuit breaker fast-fails requests.", func() float64 {
+		if geminiService.CircuitStatus().State == "open" {
+			return 1
+		}
+		return 0
+	})
+	postprocessor, err := postprocess.New(cfg.Postprocess)
+	if err != nil {
+		return fmt.Errorf("postprocess: %w", err)
+	}
+	geminiService.SetPostprocessor(postprocessor)
+	if err := cfg.Execution.Validate(); err != nil {
+		return fmt.Errorf("execution: %w", err)
+	}
+	geminiService.SetExecution(cfg.Execution)
+	if shared != nil {
+		geminiService.SetSharedCache(shared)
+	}
+	healthHandler := handler.NewHealthHandler(geminiService, cfg.ReadyMaxQueueDepth)
+	templateStore, err = openStore(stateDB, templates.StoreName, cfg.Templates.Path,
+		func() (*templates.Store, error) { return templates.Open(cfg.Templates) },
+		templates.OpenStorage)
+	if err != nil {
+		logger.Warn("prompt templates kept in memory only", "path", cfg.Templates.Path, "error", err)
+		templateStore = templates.NewMemoryStore()
+	}
+	// reapers are expired every cfg.Reaper.Interval.
+	var reapers []reaper
+	var fileStore *files.Store
+	var fileHandler *handler.FileHandler
+	if cfg.Files.Enabled {
+		fileStore, err = files.Open(cfg.Files)
+		if err != nil {
+			logger.Warn("files API disabled", "dir", cfg.Files.Dir, "error", err)
+		} else {
+			fileHandler = handler.NewFileHandler(fileStore)
+			reapers = append(reapers, fileStore)
+		}
+	}
+	embedder := embeddings.New(cfg.Embeddings, geminiService.Health().Backend == "mock")
+	passthroughHandler, err := passthrough.New(cfg.Passthrough)
+	if err != nil {
+		return fmt.Errorf("passthrough: %w", err)
+	}
+	geminiHandler := handler.NewGeminiHandler(geminiService, templateStore, fileStore, embedder, urlcontext.New(cfg.URLContext), passthroughHandler, cfg.StreamHeartbeat)
+	openAIAdapter := openai.NewGeminiAdapter(geminiService)
+	openAIHandler := handler.NewOpenAIHandler(openAIAdapter, cfg.StreamHeartbeat)
+	anthropicAdapter := anthropic.NewGeminiAdapter(geminiService)
+	anthropicHandler := handler.NewAnthropicHandler(anthropicAdapter, cfg.StreamHeartbeat)
+	ollamaAdapter := ollama.NewGeminiAdapter(geminiService)
+	ollamaHandler := handler.NewOllamaHandler(ollamaAdapter)
+	sessionManager, err = openStore(stateDB, session.StoreName, cfg.Sessions.Path,
+		func() (*session.Manager, error) { return session.Open(geminiService, cfg.Sessions) },
+		func(store storage.Store) (*session.Manager, error) {
+			return session.OpenStorage(geminiService, cfg.Sessions, store)
+		})
+	if err != nil {
+		logger.Warn("sessions kept in memory only", "path", cfg.Sessions.Path, "error", err)
+		sessionManager = session.NewManager(geminiService, cfg.Sessions)
+	}
+	if shared != nil {
+		sessionManager.SetCluster(shared)
+	}
+	sessionHandler := handler.NewSessionHandler(sessionManager)
+	reapers = append(reapers, sessionManager)
+
+	apiKeys, err := appmiddleware.LoadAPIKeys(strings.Join(cfg.Auth.APIKeys, "\n"), cfg.Auth.APIKeysFile)
+	if err != nil {
+		return fmt.Errorf("API keys: %w", err)
+	}
+	tenantRegistry, err := tenants.New(cfg.Tenants)
+	if err != nil {
+		return err
+	}
+	for _, t := range tenantRegistry.Tenants() {
+		keys := appmiddleware.ParseAPIKeys(strings.Join(t.APIKeys, "\n"))
+		for _, key := range keys {
+			apiKeys = append(apiKeys, appmiddleware.APIKey{Key: key.Key, Label: tenants.Label(t.Name, key.Label)})
+		}
+		logger.Info("tenant configured", "tenant", t.Name, "keys", len(keys), "features", t.Features)
+	}
+	apiKeys, err = appmiddleware.ScopeAPIKeys(apiKeys, cfg.Auth.Scopes)
+	if err != nil {
+		return fmt.Errorf("API key scopes: %w", err)
+	}
+
+	var rateLimiter *ratelimit.Limiter
+	if cfg.RateLimit.Enabled() || tenantRegistry.RateLimited() {
+		rateLimiter = ratelimit.NewLimiter(cfg.RateLimit)
+		if shared != nil {
+			rateLimiter = ratelimit.NewSharedLimiter(cfg.RateLimit, shared)
+		}
+	}
+
+	inFlight := appmiddleware.NewInFlightLimiter(cfg.MaxInFlight, cfg.ShedRetryAfter)
+	metrics.Default.NewGaugeFunc("gemini_wrapper_requests_in_flight", "API requests currently being served.", func() float64 {
+		return float64(inFlight.InFlight())
+	})
+
+	if cfg.Accounting.Enabled {
+		usageStore, err = openStore(stateDB, accounting.StoreName, cfg.Accounting.Path,
+			func() (*accounting.Store, error) { return accounting.Open(cfg.Accounting) },
+			func(store storage.Store) (*accounting.Store, error) {
+				return accounting.OpenStorage(cfg.Accounting, store), nil
+			})
+		if err != nil {
+			logger.Warn("usage accounting disabled", "path", cfg.Accounting.Path, "error", err)
+		}
+	}
+
+	jobManager, err = openStore(stateDB, jobs.StoreName, cfg.Jobs.Path,
+		func() (*jobs.Manager, error) { return jobs.Open(geminiService, cfg.Jobs) },
+		func(store storage.Store) (*jobs.Manager, error) {
+			return jobs.OpenStorage(geminiService, cfg.Jobs, store)
+		})
+	if err != nil {
+		logger.Warn("jobs kept in memory only", "path", cfg.Jobs.Path, "error", err)
+		jobManager = jobs.NewManager(geminiService, cfg.Jobs)
+	}
+
+	if cfg.Budget.Enabled() {
+		budgets, err = openStore(stateDB, budget.StoreName, cfg.Budget.Path,
+			func() (*budget.Budget, error) { return budget.Open(cfg.Budget) },
+			func(store storage.Store) (*budget.Budget, error) {
+				return budget.OpenStorage(cfg.Budget, store)
+			})
+		if err != nil {
+			return fmt.Errorf("budget: %w", err)
+		}
+	}
+
+	if cfg.Idempotency.Enabled && shared != nil {
+		idempotencyStore = idempotency.OpenShared(cfg.Idempotency, shared)
+	} else if cfg.Idempotency.Enabled {
+		idempotencyStore, err = openStore(stateDB, idempotency.StoreName, cfg.Idempotency.Path,
+			func() (*idempotency.Store, error) { return idempotency.Open(cfg.Idempotency) },
+			func(store storage.Store) (*idempotency.Store, error) {
+				return idempotency.OpenStorage(cfg.Idempotency, store), nil
+			})
+		if err != nil {
+			logger.Warn("idempotency keys kept in memory only", "path", cfg.Idempotency.Path, "error", err)
+			idempotencyStore = idempotency.NewMemoryStore(cfg.Idempotency)
+		}
+	}
+
+	var auditHandler *handler.AuditHandler
+	if cfg.Audit.Enabled {
+		auditLog, err = audit.Open(cfg.Audit)
+		if err != nil {
+			logger.Warn("audit log disabled", "dir", cfg.Audit.Dir, "error", err)
+		} else {
+			auditHandler = handler.NewAuditHandler(auditLog, geminiService)
+		}
+	}
+
+	var workspaceHandler *handler.WorkspaceHandler
+	if cfg.Workspaces.Enabled {
+		workspaceManager, err := workspaces.Open(geminiService, cfg.Workspaces)
+		if err != nil {
+			logger.Warn("workspaces disabled", "dir", cfg.Workspaces.Dir, "error", err)
+		} else {
+			workspaceHandler = handler.NewWorkspaceHandler(workspaceManager, templateStore)
+			reapers = append(reapers, workspaceManager)
+		}
+	}
+
+	// The admin routes are served only to someone who can authenticate
+	// to them.
+	admins := cfg.Auth.AdminAPIKey != "" || len(appmiddleware.KeysWithScope(apiKeys, appmiddleware.ScopeAdmin)) > 0
+	var debugHandler *handler.DebugHandler
+	if cfg.Debug.Enabled {
+		if admins {
+			debugHandler = handler.NewDebugHandler(geminiService, sessionManager)
+		} else {
+			logger.Warn("debug endpoints need auth.admin_api_key or an API key with the admin scope; /debug stays disabled")
+		}
+	}
+
+	features := []string{"gemini_api", "openai", "anthropic", "ollama", "sessions", "jobs", "templates", "embeddings"}
+	for feature, on := range map[string]bool{
+		"workspaces":  workspaceHandler != nil,
+		"files":       fileHandler != nil,
+		"passthrough": passthroughHandler != nil,
+		"audit":       auditLog != nil,
+		"api_keys":    len(apiKeys) > 0,
+		"rate_limit":  rateLimiter != nil,
+		"budget":      budgets != nil,
+		"accounting":  usageStore != nil,
+		"idempotency": idempotencyStore != nil,
+		"cluster":     shared != nil,
+		"grpc":        cfg.GRPC.Enabled,
+		"tls":         cfg.TLS.Enabled(),
+		"debug":       debugHandler != nil,
+	} {
+		if on {
+			features = append(features, feature)
+		}
+	}
+
+	reloads := newReloader(cfg)
+	reloads.limiter, reloads.service = rateLimiter, geminiService
+	reloads.openAI, reloads.anthropic, reloads.ollama = openAIAdapter, anthropicAdapter, ollamaAdapter
+	reloads.apply(cfg)
+	adminHandler := handler.NewAdminHandler(rateLimiter, budgets, usageStore, geminiService)
+	adminHandler.SetConfigReloader(reloads.reload)
+	adminHandler.SetSessions(sessionManager)
+
+	api := &router.API{
+		Echo:             e,
+		HealthHandler:    healthHandler,
+		GeminiHandler:    geminiHandler,
+		OpenAIHandler:    openAIHandler,
+		AnthropicHandler: anthropicHandler,
+		OllamaHandler:    ollamaHandler,
+		SessionHandler:   sessionHandler,
+		JobHandler:       handler.NewJobHandler(jobManager, templateStore),
+		TemplateHandler:  handler.NewTemplateHandler(templateStore),
+		WorkspaceHandler: workspaceHandler,
+		FileHandler:      fileHandler,
+		Passthrough:      passthroughHandler,
+		OpenAIAPIKey:     cfg.Auth.OpenAIAPIKey,
+		AdminHandler:     adminHandler,
+		VersionHandler:   handler.NewVersionHandler(geminiService, features),
+		DebugHandler:     debugHandler,
+		APIKeys:          apiKeys,
+		InFlight:         inFlight,
+		RateLimiter:      rateLimiter,
+		Tenants:          tenantRegistry,
+		Budget:           budgets,
+		Accounting:       usageStore,
+		Idempotency:      idempotencyStore,
+		Audit:            auditLog,
+		AuditHandler:     auditHandler,
+		MaxBodyBytes:     cfg.MaxBodyBytes,
+		AdminAPIKey:      cfg.Auth.AdminAPIKey,
+		IPFilter:         ipFilter,
+		Cluster:          shared,
+	}
+	api.SetupRouter()
+	go reloads.watch(ctx, cfg.File(), cfg.ConfigFile.WatchInterval)
+	reapCtx, cancelReap := context.WithCancel(ctx)
+	reaped, stopReaping = make(chan struct{}), cancelReap
+	go func() {
+		defer close(reaped)
+		reap(reapCtx, cfg.Reaper.Interval, reapers)
+	}()
+
+	sc := echo.StartConfig{
+		GracefulTimeout: cfg.ShutdownTimeout,
+		OnShutdownError: func(err error) {
+			logger.Warn("requests still running after shutdown timeout", "timeout", cfg.ShutdownTimeout, "error", err)
+		},
+	}
+	tlsConfig, redirect, err := newTLS(cfg.TLS, cfg.Port)
+	if err != nil {
+		return fmt.Errorf("TLS: %w", err)
+	}
+	listener, err := listen(cfg)
+	if err != nil {
+		return fmt.Errorf("listen: %w", err)
+	}
+	waitRedirect := func() {}
+	if redirect != nil && cfg.TLS.RedirectPort != "" {
+		waitRedirect, err = serveRedirect(ctx, ":"+cfg.TLS.RedirectPort, redirect)
+		if err != nil {
+			listener.Close()
+			return fmt.Errorf("HTTPS redirect: %w", err)
+		}
+	}
+	var handler http.Handler = e
+	waitGRPC := func() {}
+	if cfg.GRPC.Enabled {
+		grpcServer := grpcapi.NewServer(grpcapi.NewGeminiServer(geminiService), grpcapi.Config{APIKeys: apiKeys, Limiter: rateLimiter, Budget: budgets, Accounting: usageStore, Audit: auditLog, IPFilter: ipFilter})
+		switch {
+		case cfg.GRPC.Port != "" && cfg.GRPC.Port != cfg.Port:
+			grpcListener, err := net.Listen("tcp", ":"+cfg.GRPC.Port)
+			if err != nil {
+				listener.Close()
+				return fmt.Errorf("gRPC: %w", err)
+			}
+			if tlsConfig != nil {
+				grpcListener = tls.NewListener(grpcListener, tlsConfig)
+			}
+			_, waitGRPC = grpcapi.Serve(ctx, grpcServer, grpcListener, false, cfg.ShutdownTimeout)
+		case tlsConfig != nil:
+			// Splitting decrypted connections with cmux breaks HTTP/2
+			// clients of the HTTP API, so the HTTPS server routes gRPC
+			// calls itself and stops them when it shuts down.
+			handler = grpcapi.Handler(grpcServer, e)
+			waitGRPC = grpcServer.Stop
+		default:
+			listener, waitGRPC = grpcapi.Serve(ctx, grpcServer, listener, true, cfg.ShutdownTimeout)
+		}
+	}
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	sc.Listener = listener
+	if err := sc.Start(ctx, handler); err != nil {
+		return err
+	}
+	waitGRPC()
+	waitRedirect()
+	return nil
+}
@@ -0,0 +1,26 @@
+package server
+
+import (
+	"path/filepath"
+
+	"gemini-wrapper/service/storage"
+)
+
+// openStore opens a feature: in the store called name of db, importing the
+// database it kept at legacyPath before, or with open when there is no
+// shared database.
+func openStore[T any](db *storage.DB, name, legacyPath string, open func() (T, error), openStorage func(storage.Store) (T, error)) (T, error) {
+	if db == nil {
+		return open()
+	}
+	var migrations []storage.Migration
+	if legacyPath != "" && filepath.Clean(legacyPath) != filepath.Clean(db.Path()) {
+		migrations = append(migrations, storage.Import(legacyPath, name))
+	}
+	store, err := db.Store(name, migrations...)
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	return openStorage(store)
+}
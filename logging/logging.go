@@ -0,0 +1,106 @@
+// Package logging configures the process-wide slog logger and carries the
+// per-request ID through contexts so every log line of a request can be
+// correlated.
+package logging
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+type requestIDKey struct{}
+
+// WithRequestID returns a copy of ctx carrying id.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the request ID stored in ctx, or "".
+func RequestID(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// contextHandler adds the request_id attribute for records logged with a
+// context that carries one.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id := RequestID(ctx); id != "" {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// level is the level of the logger installed by Setup; SetLevel changes it
+// while the server runs.
+var level slog.LevelVar
+
+// NewLogger builds a logger writing format ("json" or "text") at level.
+func NewLogger(w io.Writer, format string, level slog.Leveler) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	if strings.EqualFold(strings.TrimSpace(format), "text") {
+		handler = slog.NewTextHandler(w, opts)
+	} else {
+		handler = slog.NewJSONHandler(w, opts)
+	}
+	return slog.New(contextHandler{handler})
+}
+
+// ParseLevel maps debug/info/warn/error to a slog level, defaulting to info.
+func ParseLevel(raw string) slog.Level {
+	parsed, _ := LookupLevel(raw)
+	return parsed
+}
+
+// LookupLevel is ParseLevel that also reports whether raw named a level.
+func LookupLevel(raw string) (slog.Level, bool) {
+	switch strings.ToLower(strings.TrimSpace(raw)) {
+	case "debug":
+		return slog.LevelDebug, true
+	case "info":
+		return slog.LevelInfo, true
+	case "warn", "warning":
+		return slog.LevelWarn, true
+	case "error":
+		return slog.LevelError, true
+	default:
+		return slog.LevelInfo, false
+	}
+}
+
+// Setup installs the default logger writing to stdout in format (json, text)
+// at levelName.
+func Setup(format, levelName string) *slog.Logger {
+	level.Set(ParseLevel(levelName))
+	logger := NewLogger(os.Stdout, format, &level)
+	slog.SetDefault(logger)
+	return logger
+}
+
+// SetLevel changes the level of the logger installed by Setup.
+func SetLevel(l slog.Level) {
+	level.Set(l)
+}
+
+// Level returns the level of the logger installed by Setup.
+func Level() slog.Level {
+	return level.Level()
+}
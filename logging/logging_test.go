@@ -0,0 +1,47 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"testing"
+)
+
+func TestLoggerAddsRequestIDFromContext(t *testing.T) {
+	var out bytes.Buffer
+	logger := NewLogger(&out, "json", slog.LevelInfo)
+
+	ctx := WithRequestID(context.Background(), "req-123")
+	logger.InfoContext(ctx, "answered", "chars", 5)
+	logger.DebugContext(ctx, "hidden")
+
+	var record map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &record); err != nil {
+		t.Fatalf("expected one JSON record, got %q: %v", out.String(), err)
+	}
+	if record["request_id"] != "req-123" || record["msg"] != "answered" || record["chars"] != float64(5) {
+		t.Fatalf("unexpected record: %#v", record)
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	if ParseLevel("DEBUG") != slog.LevelDebug || ParseLevel("warning") != slog.LevelWarn || ParseLevel("") != slog.LevelInfo {
+		t.Fatal("unexpected level mapping")
+	}
+}
+
+func TestSetLevelAppliesToSetupLogger(t *testing.T) {
+	defer SetLevel(Level())
+	logger := Setup("json", "info")
+	if logger.Enabled(context.Background(), slog.LevelDebug) {
+		t.Fatal("expected debug to be disabled at info")
+	}
+	SetLevel(slog.LevelDebug)
+	if !logger.Enabled(context.Background(), slog.LevelDebug) || Level() != slog.LevelDebug {
+		t.Fatal("expected SetLevel to enable debug logging")
+	}
+	if _, ok := LookupLevel("verbose"); ok {
+		t.Fatal("expected unknown level names to be reported")
+	}
+}
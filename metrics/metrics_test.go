@@ -0,0 +1,42 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRegistryWritesPrometheusText(t *testing.T) {
+	registry := NewRegistry()
+	requests := registry.NewCounterVec("test_requests_total", "Requests.", "route")
+	latency := registry.NewHistogramVec("test_latency_seconds", "Latency.", []float64{0.5, 1}, "model")
+	registry.NewGaugeFunc("test_busy", "Busy workers.", func() float64 { return 3 })
+
+	requests.Inc("/api/ask")
+	requests.Add(2, `/say"hi"`)
+	latency.Observe(0.75, "gemini-2.5-flash")
+
+	var out bytes.Buffer
+	registry.WriteText(&out)
+	text := out.String()
+
+	for _, want := range []string{
+		"# TYPE test_requests_total counter\n",
+		`test_requests_total{route="/api/ask"} 1` + "\n",
+		`test_requests_total{route="/say\"hi\""} 2` + "\n",
+		"# TYPE test_latency_seconds histogram\n",
+		`test_latency_seconds_bucket{model="gemini-2.5-flash",le="0.5"} 0` + "\n",
+		`test_latency_seconds_bucket{model="gemini-2.5-flash",le="1"} 1` + "\n",
+		`test_latency_seconds_bucket{model="gemini-2.5-flash",le="+Inf"} 1` + "\n",
+		`test_latency_seconds_sum{model="gemini-2.5-flash"} 0.75` + "\n",
+		`test_latency_seconds_count{model="gemini-2.5-flash"} 1` + "\n",
+		"test_busy 3\n",
+	} {
+		if !strings.Contains(text, want) {
+			t.Fatalf("missing %q in output:\n%s", want, text)
+		}
+	}
+	if requests.Value("/api/ask") != 1 || latency.Count("gemini-2.5-flash") != 1 {
+		t.Fatal("unexpected recorded values")
+	}
+}
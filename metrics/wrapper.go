@@ -0,0 +1,115 @@
+package metrics
+
+// Metrics exported by the wrapper. Label values are kept low-cardinality:
+// routes are Echo route patterns and models come from the configured list.
+var (
+	HTTPRequests = Default.NewCounterVec(
+		"gemini_wrapper_http_requests_total",
+		"HTTP requests handled, by method, route pattern and status code.",
+		"method", "route", "code",
+	)
+	HTTPRequestDuration = Default.NewHistogramVec(
+		"gemini_wrapper_http_request_duration_seconds",
+		"HTTP request latency, by method and route pattern.",
+		DefaultBuckets,
+		"method", "route",
+	)
+	GeminiRequests = Default.NewCounterVec(
+		"gemini_wrapper_gemini_requests_total",
+		"Backend generation attempts, by model and outcome (success, error, cancelled, timeout).",
+		"model", "outcome",
+	)
+	GeminiLatency = Default.NewHistogramVec(
+		"gemini_wrapper_gemini_latency_seconds",
+		"Time from backend start to answer, by model.",
+		DefaultBuckets,
+		"model",
+	)
+	GenerationDuration = Default.NewHistogramVec(
+		"gemini_wrapper_generation_seconds",
+		"Time from backend start to the last output of answered attempts, by model and backend.",
+		DefaultBuckets,
+		"model", "backend",
+	)
+	TimeToFirstToken = Default.NewHistogramVec(
+		"gemini_wrapper_time_to_first_token_seconds",
+		"Time from backend start to the first streamed output, by model and backend.",
+		DefaultBuckets,
+		"model", "backend",
+	)
+	GenerationTokens = Default.NewHistogramVec(
+		"gemini_wrapper_generation_tokens",
+		"Tokens of answered attempts, by model, backend and direction (input, output); estimated when the backend reports none.",
+		TokenBuckets,
+		"model", "backend", "direction",
+	)
+	GenerationErrors = Default.NewCounterVec(
+		"gemini_wrapper_generation_errors_total",
+		"Failed backend attempts, by model, backend and error class (the reason of the error response, like quota_exceeded).",
+		"model", "backend", "class",
+	)
+	QueueWait = Default.NewHistogramVec(
+		"gemini_wrapper_queue_wait_seconds",
+		"Time requests waited for a free backend worker.",
+		DefaultBuckets,
+	)
+	PacingDelay = Default.NewHistogramVec(
+		"gemini_wrapper_pacing_delay_seconds",
+		"Time requests were delayed to stay under the configured requests per minute.",
+		DefaultBuckets,
+	)
+	CacheLookups = Default.NewCounterVec(
+		"gemini_wrapper_cache_lookups_total",
+		"Response cache lookups by result (hit, miss).",
+		"result",
+	)
+	CoalescedRequests = Default.NewCounterVec(
+		"gemini_wrapper_coalesced_requests_total",
+		"Questions answered by the generation of an identical pending question, by kind (ask, stream).",
+		"kind",
+	)
+	QueueRejections = Default.NewCounterVec(
+		"gemini_wrapper_queue_rejections_total",
+		"Requests rejected because the backend worker queue was full.",
+	)
+	LoadShed = Default.NewCounterVec(
+		"gemini_wrapper_load_shed_total",
+		"Requests rejected with 503 because the in-flight limit was reached.",
+	)
+	CircuitRejections = Default.NewCounterVec(
+		"gemini_wrapper_circuit_rejections_total",
+		"Requests fast-failed because the upstream circuit was open.",
+	)
+	UpstreamRetries = Default.NewCounterVec(
+		"gemini_wrapper_upstream_retries_total",
+		"Retries after transient upstream errors (429, 5xx).",
+	)
+	UpstreamStatus = Default.NewCounterVec(
+		"gemini_wrapper_upstream_status_total",
+		"Upstream HTTP status codes detected in CLI output (for example 429).",
+		"code",
+	)
+	BackendRecoveries = Default.NewCounterVec(
+		"gemini_wrapper_backend_recoveries_total",
+		"Times the backend became ready again after failing health probes.",
+	)
+	BackendProbeFailures = Default.NewCounterVec(
+		"gemini_wrapper_backend_probe_failures_total",
+		"Failed backend health probes.",
+	)
+	APIFallbacks = Default.NewCounterVec(
+		"gemini_wrapper_api_fallbacks_total",
+		"Attempts served by the Gemini API instead of the CLI, by reason (cli_unavailable, cli_unauthenticated, multimodal).",
+		"reason",
+	)
+	Reclaimed = Default.NewCounterVec(
+		"gemini_wrapper_reclaimed_total",
+		"Expired resources removed by the reaper, by kind (session, workspace, file, upload).",
+		"kind",
+	)
+	ReclaimedBytes = Default.NewCounterVec(
+		"gemini_wrapper_reclaimed_bytes_total",
+		"Disk space freed by the reaper, by kind (workspace, file, upload).",
+		"kind",
+	)
+)
@@ -0,0 +1,55 @@
+package appmiddleware
+
+import (
+	"log/slog"
+	"time"
+
+	"gemini-wrapper/logging"
+	"gemini-wrapper/service/accesslog"
+
+	"github.com/labstack/echo/v5"
+)
+
+// AccessLog writes a line per request to logger, with the API key label,
+// the model that answered and the tokens it used. It must run after
+// RequestID. A nil logger disables it.
+func AccessLog(logger *accesslog.Logger) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c *echo.Context) error {
+			if logger == nil {
+				return next(c)
+			}
+
+			start := time.Now()
+			ctx, report := accesslog.WithReport(c.Request().Context())
+			c.SetRequest(c.Request().WithContext(ctx))
+			err := next(c)
+
+			req := c.Request()
+			entry := accesslog.Entry{
+				Time:          start,
+				RequestID:     logging.RequestID(req.Context()),
+				RemoteIP:      c.RealIP(),
+				Method:        req.Method,
+				Path:          req.URL.Path,
+				Proto:         req.Proto,
+				LatencyMillis: time.Since(start).Milliseconds(),
+				APIKey:        APIKeyLabel(c),
+				Model:         report.Model(),
+				Usage:         report.Usage(),
+				UserAgent:     req.UserAgent(),
+				Referer:       req.Referer(),
+			}
+			res, code := echo.ResolveResponseStatus(c.Response(), err)
+			entry.Status = code
+			if res != nil {
+				entry.Bytes = res.Size
+				entry.Cache = res.Header().Get(HeaderXCache)
+			}
+			if logErr := logger.Log(entry); logErr != nil {
+				slog.WarnContext(req.Context(), "access log write failed", "error", logErr)
+			}
+			return err
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package appmiddleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gemini-wrapper/model"
+	"gemini-wrapper/service/accesslog"
+	"gemini-wrapper/service/usage"
+
+	"github.com/labstack/echo/v5"
+)
+
+func TestAccessLogRecordsGeminiFields(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	cfg := accesslog.DefaultConfig()
+	cfg.File = path
+	logger, err := accesslog.Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.Close()
+
+	e := echo.New()
+	e.Use(RequestID())
+	e.Use(AccessLog(logger))
+	e.POST("/ask", func(c *echo.Context) error {
+		ctx := c.Request().Context()
+		usage.Record(ctx, model.UsageMetadata{PromptTokenCount: 5, CandidatesTokenCount: 7, TotalTokenCount: 12})
+		accesslog.RecordModel(ctx, "gemini-2.5-flash")
+		return c.String(http.StatusOK, "four")
+	}, RequireAPIKey(APIKeyAuthConfig{Keys: []APIKey{{Key: "secret", Label: "web"}}}))
+
+	req := httptest.NewRequest(http.MethodPost, "/ask?key=secret", nil)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entry accesslog.Entry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		t.Fatalf("expected one JSON line, got %q: %v", data, err)
+	}
+	if entry.Path != "/ask" || entry.Status != http.StatusOK || entry.Bytes != 4 || entry.APIKey != "web" || entry.Model != "gemini-2.5-flash" {
+		t.Fatalf("unexpected entry %#v", entry)
+	}
+	if entry.Usage == nil || entry.Usage.TotalTokenCount != 12 || entry.RequestID != rec.Header().Get(echo.HeaderXRequestID) {
+		t.Fatalf("expected usage and request ID, got %#v", entry)
+	}
+}
@@ -0,0 +1,28 @@
+package appmiddleware
+
+import (
+	"gemini-wrapper/service/accounting"
+
+	"github.com/labstack/echo/v5"
+)
+
+// AccountUsage charges every request, its tokens and its latency to the
+// client as identified by ClientID. Responses of 400 and above count as
+// errors. A nil store disables accounting.
+func AccountUsage(store *accounting.Store) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c *echo.Context) error {
+			if store == nil {
+				return next(c)
+			}
+
+			req := c.Request()
+			ctx, finish := store.Track(req.Context(), ClientID(c))
+			c.SetRequest(req.WithContext(ctx))
+			err := next(c)
+			_, code := echo.ResolveResponseStatus(c.Response(), err)
+			finish(code >= 400)
+			return err
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package appmiddleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gemini-wrapper/model"
+	"gemini-wrapper/service/accounting"
+	"gemini-wrapper/service/usage"
+
+	"github.com/labstack/echo/v5"
+)
+
+func TestAccountUsageChargesClient(t *testing.T) {
+	cfg := accounting.DefaultConfig()
+	cfg.Path = filepath.Join(t.TempDir(), "usage.db")
+	store, err := accounting.Open(cfg)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer store.Close()
+
+	e := echo.New()
+	e.Use(AccountUsage(store))
+	e.GET("/ok", func(c *echo.Context) error {
+		usage.Record(c.Request().Context(), model.UsageMetadata{TotalTokenCount: 12})
+		return c.String(http.StatusOK, "ok")
+	})
+	e.GET("/fail", func(c *echo.Context) error {
+		return c.String(http.StatusBadGateway, "upstream failed")
+	})
+	for _, path := range []string{"/ok", "/fail"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = "192.0.2.7:1234"
+		e.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	report, err := store.Report(accounting.Query{From: time.Now().Add(-time.Hour), To: time.Now().Add(time.Hour), Bucket: accounting.BucketDay})
+	if err != nil {
+		t.Fatalf("Report: %v", err)
+	}
+	if len(report.Clients) != 1 || report.Clients[0].Client != "ip:192.0.2.7" {
+		t.Fatalf("unexpected clients: %#v", report.Clients)
+	}
+	if total := report.Clients[0].Total; total.Requests != 2 || total.Errors != 1 || total.TotalTokens != 12 {
+		t.Fatalf("unexpected totals: %#v", total)
+	}
+}
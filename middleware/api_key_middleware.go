@@ -0,0 +1,172 @@
+package appmiddleware
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"gemini-wrapper/model"
+
+	"github.com/labstack/echo/v5"
+)
+
+// apiKeyLabelContextKey is the echo.Context key holding the label of the
+// authenticated API key, and apiKeyContextKey the key itself.
+const (
+	apiKeyLabelContextKey = "api_key_label"
+	apiKeyContextKey      = "api_key"
+)
+
+// Error formats understood by RequireAPIKey.
+const (
+	ErrorFormatGemini    = "gemini"
+	ErrorFormatOpenAI    = "openai"
+	ErrorFormatAnthropic = "anthropic"
+)
+
+// APIKey is an accepted client key with an optional human-readable label.
+type APIKey struct {
+	Key   string
+	Label string
+	// Scopes are what the key may be used for. Nil allows every scope but
+	// admin and tools.
+	Scopes []string
+}
+
+type APIKeyAuthConfig struct {
+	Keys        []APIKey
+	ErrorFormat string
+}
+
+// ParseAPIKeys parses "label:key" or bare "key" entries separated by commas
+// or newlines. Bare keys are labelled key-1, key-2, ... by position.
+func ParseAPIKeys(raw string) []APIKey {
+	return labelAPIKeys(parseAPIKeyEntries(raw))
+}
+
+// LoadAPIKeys combines keys from the API_KEYS-style value and an optional
+// file with one "label:key" or "key" entry per line ("#" starts a comment).
+func LoadAPIKeys(raw string, filePath string) ([]APIKey, error) {
+	keys := parseAPIKeyEntries(raw)
+	filePath = strings.TrimSpace(filePath)
+	if filePath != "" {
+		content, err := os.ReadFile(filePath)
+		if err != nil {
+			return nil, fmt.Errorf("read API key file: %w", err)
+		}
+		keys = append(keys, parseAPIKeyEntries(string(content))...)
+	}
+	return labelAPIKeys(keys), nil
+}
+
+func parseAPIKeyEntries(raw string) []APIKey {
+	fields := strings.FieldsFunc(raw, func(r rune) bool { return r == ',' || r == '\n' })
+	keys := make([]APIKey, 0, len(fields))
+	for _, field := range fields {
+		field = strings.TrimSpace(field)
+		if field == "" || strings.HasPrefix(field, "#") {
+			continue
+		}
+		key := APIKey{Key: field}
+		if label, value, ok := strings.Cut(field, ":"); ok {
+			key = APIKey{Key: strings.TrimSpace(value), Label: strings.TrimSpace(label)}
+		}
+		if key.Key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func labelAPIKeys(keys []APIKey) []APIKey {
+	for i := range keys {
+		if keys[i].Label == "" {
+			keys[i].Label = fmt.Sprintf("key-%d", i+1)
+		}
+	}
+	return keys
+}
+
+// RequireAPIKey accepts `Authorization: Bearer <key>`, `x-goog-api-key: <key>`,
+// `x-api-key: <key>` or `?key=<key>`. A missing key is answered with 401 and an unknown key with
+// 403. With no keys configured every request is let through.
+func RequireAPIKey(cfg APIKeyAuthConfig) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c *echo.Context) error {
+			if len(cfg.Keys) == 0 {
+				return next(c)
+			}
+
+			presented := presentedAPIKey(c.Request())
+			if presented == "" {
+				return writeAuthError(c, cfg.ErrorFormat, http.StatusUnauthorized, "API key required. Send it as a Bearer token or in the x-goog-api-key header.")
+			}
+			if key, ok := FindAPIKey(cfg.Keys, presented); ok {
+				c.Set(apiKeyLabelContextKey, key.Label)
+				c.Set(apiKeyContextKey, key)
+				return next(c)
+			}
+			return writeAuthError(c, cfg.ErrorFormat, http.StatusForbidden, "API key not valid. Please pass a valid API key.")
+		}
+	}
+}
+
+// MatchAPIKey returns the label of the key equal to presented.
+func MatchAPIKey(keys []APIKey, presented string) (string, bool) {
+	key, ok := FindAPIKey(keys, presented)
+	return key.Label, ok
+}
+
+// FindAPIKey returns the key equal to presented.
+func FindAPIKey(keys []APIKey, presented string) (APIKey, bool) {
+	for _, key := range keys {
+		if subtle.ConstantTimeCompare([]byte(presented), []byte(key.Key)) == 1 {
+			return key, true
+		}
+	}
+	return APIKey{}, false
+}
+
+// APIKeyLabel returns the label of the key that authenticated the request, or "".
+func APIKeyLabel(c *echo.Context) string {
+	label, _ := c.Get(apiKeyLabelContextKey).(string)
+	return label
+}
+
+func presentedAPIKey(req *http.Request) string {
+	authorization := req.Header.Get("Authorization")
+	if scheme, token, ok := strings.Cut(authorization, " "); ok && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(token)
+	}
+	if key := strings.TrimSpace(req.Header.Get("x-goog-api-key")); key != "" {
+		return key
+	}
+	if key := strings.TrimSpace(req.Header.Get("x-api-key")); key != "" {
+		return key
+	}
+	return strings.TrimSpace(req.URL.Query().Get("key"))
+}
+
+func writeAuthError(c *echo.Context, format string, code int, message string) error {
+	if format == ErrorFormatAnthropic {
+		errType := "authentication_error"
+		if code == http.StatusForbidden {
+			errType = "permission_error"
+		}
+		return c.JSON(code, model.AnthropicErrorResponse{Type: "error", Error: model.AnthropicError{Type: errType, Message: message}})
+	}
+	if format == ErrorFormatOpenAI {
+		return c.JSON(code, model.OpenAIErrorResponse{Error: model.OpenAIError{
+			Message: message,
+			Type:    "invalid_request_error",
+			Code:    "invalid_api_key",
+		}})
+	}
+	status := "UNAUTHENTICATED"
+	if code == http.StatusForbidden {
+		status = "PERMISSION_DENIED"
+	}
+	return c.JSON(code, model.GeminiErrorResponse{Error: model.GeminiError{Code: code, Message: message, Status: status}})
+}
@@ -0,0 +1,111 @@
+package appmiddleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"gemini-wrapper/model"
+
+	"github.com/labstack/echo/v5"
+)
+
+func serveWithAPIKey(t *testing.T, cfg APIKeyAuthConfig, setup func(req *http.Request)) (*httptest.ResponseRecorder, string) {
+	t.Helper()
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodPost, "/api/ask", nil)
+	setup(req)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+
+	var label string
+	h := RequireAPIKey(cfg)(func(c *echo.Context) error {
+		label = APIKeyLabel(c)
+		return c.NoContent(http.StatusOK)
+	})
+	if err := h(c); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return rec, label
+}
+
+func TestRequireAPIKeyAcceptsSupportedCredentials(t *testing.T) {
+	cfg := APIKeyAuthConfig{Keys: ParseAPIKeys("team-a:secret-a, secret-b")}
+	cases := map[string]func(req *http.Request){
+		"bearer":    func(req *http.Request) { req.Header.Set("Authorization", "Bearer secret-a") },
+		"goog":      func(req *http.Request) { req.Header.Set("x-goog-api-key", "secret-a") },
+		"anthropic": func(req *http.Request) { req.Header.Set("x-api-key", "secret-a") },
+		"query":     func(req *http.Request) { req.URL.RawQuery = "key=secret-a" },
+	}
+	for name, setup := range cases {
+		rec, label := serveWithAPIKey(t, cfg, setup)
+		if rec.Code != http.StatusOK || label != "team-a" {
+			t.Fatalf("%s: expected 200 with label team-a, got %d %q", name, rec.Code, label)
+		}
+	}
+
+	_, label := serveWithAPIKey(t, cfg, func(req *http.Request) { req.Header.Set("x-goog-api-key", "secret-b") })
+	if label != "key-2" {
+		t.Fatalf("expected positional label for bare key, got %q", label)
+	}
+}
+
+func TestRequireAPIKeyRejectsInGeminiFormat(t *testing.T) {
+	cfg := APIKeyAuthConfig{Keys: ParseAPIKeys("secret"), ErrorFormat: ErrorFormatGemini}
+
+	rec, _ := serveWithAPIKey(t, cfg, func(*http.Request) {})
+	var body model.GeminiErrorResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if rec.Code != http.StatusUnauthorized || body.Error.Code != 401 || body.Error.Status != "UNAUTHENTICATED" {
+		t.Fatalf("unexpected missing-key response: %d %s", rec.Code, rec.Body.String())
+	}
+
+	rec, _ = serveWithAPIKey(t, cfg, func(req *http.Request) { req.Header.Set("x-goog-api-key", "wrong") })
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if rec.Code != http.StatusForbidden || body.Error.Status != "PERMISSION_DENIED" {
+		t.Fatalf("unexpected invalid-key response: %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestRequireAPIKeyRejectsInAnthropicFormat(t *testing.T) {
+	cfg := APIKeyAuthConfig{Keys: ParseAPIKeys("secret"), ErrorFormat: ErrorFormatAnthropic}
+
+	rec, _ := serveWithAPIKey(t, cfg, func(req *http.Request) { req.Header.Set("x-api-key", "wrong") })
+	var body model.AnthropicErrorResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if rec.Code != http.StatusForbidden || body.Type != "error" || body.Error.Type != "permission_error" {
+		t.Fatalf("unexpected invalid-key response: %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestRequireAPIKeyWithoutKeysIsOpen(t *testing.T) {
+	rec, _ := serveWithAPIKey(t, APIKeyAuthConfig{}, func(*http.Request) {})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+}
+
+func TestLoadAPIKeysMergesEnvAndFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(path, []byte("# comment\nci:file-key\nbare-key\n"), 0o600); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	keys, err := LoadAPIKeys("env-key", path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []APIKey{{Key: "env-key", Label: "key-1"}, {Key: "file-key", Label: "ci"}, {Key: "bare-key", Label: "key-3"}}
+	if !reflect.DeepEqual(keys, want) {
+		t.Fatalf("unexpected keys: %#v", keys)
+	}
+}
@@ -0,0 +1,23 @@
+package appmiddleware
+
+import (
+	"gemini-wrapper/service/audit"
+
+	"github.com/labstack/echo/v5"
+)
+
+// AuditRequests attributes the questions a request asks to the client as
+// identified by ClientID, so the service records them in log. A nil log
+// disables auditing.
+func AuditRequests(log *audit.Log) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c *echo.Context) error {
+			if log == nil {
+				return next(c)
+			}
+			req := c.Request()
+			c.SetRequest(req.WithContext(log.Track(req.Context(), ClientID(c))))
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package appmiddleware
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"gemini-wrapper/service/audit"
+
+	"github.com/labstack/echo/v5"
+)
+
+func TestAuditRequestsAttributesQuestionsToClient(t *testing.T) {
+	cfg := audit.DefaultConfig()
+	cfg.Dir = t.TempDir()
+	log, err := audit.Open(cfg)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer log.Close()
+
+	e := echo.New()
+	e.Use(RequestID())
+	e.Use(AuditRequests(log))
+	e.GET("/ask", func(c *echo.Context) error {
+		audit.Record(c.Request().Context(), audit.Entry{Prompt: "hello", Answer: "hi", Status: http.StatusOK})
+		return c.String(http.StatusOK, "hi")
+	})
+	req := httptest.NewRequest(http.MethodGet, "/ask", nil)
+	req.RemoteAddr = "192.0.2.7:1234"
+	req.Header.Set(echo.HeaderXRequestID, "req-1")
+	e.ServeHTTP(httptest.NewRecorder(), req)
+
+	var out bytes.Buffer
+	n, err := log.Export(&out, audit.Query{From: time.Now().Add(-time.Hour), To: time.Now().Add(time.Hour)})
+	if err != nil || n != 1 {
+		t.Fatalf("Export = %d, %v", n, err)
+	}
+	for _, want := range []string{`"client":"ip:192.0.2.7"`, `"requestId":"req-1"`, `"prompt":"hello"`} {
+		if !strings.Contains(out.String(), want) {
+			t.Fatalf("expected %s in %s", want, out.String())
+		}
+	}
+}
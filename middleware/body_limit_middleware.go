@@ -0,0 +1,25 @@
+package appmiddleware
+
+import (
+	"net/http"
+	"slices"
+
+	"github.com/labstack/echo/v5"
+)
+
+// LimitBody stops reading request bodies after maxBytes, so every reader of
+// the body, from the Idempotency middleware to the handler's binder, sees an
+// *http.MaxBytesError instead of more data. Routes whose pattern is in
+// exempt, the uploads that enforce limits of their own, are left alone. 0
+// disables the limit.
+func LimitBody(maxBytes int64, exempt ...string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c *echo.Context) error {
+			req := c.Request()
+			if maxBytes > 0 && req.Body != nil && req.Body != http.NoBody && !slices.Contains(exempt, c.Path()) {
+				req.Body = http.MaxBytesReader(c.Response(), req.Body, maxBytes)
+			}
+			return next(c)
+		}
+	}
+}
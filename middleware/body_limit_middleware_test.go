@@ -0,0 +1,42 @@
+package appmiddleware
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v5"
+)
+
+func TestLimitBodyStopsReadingPastTheLimit(t *testing.T) {
+	e := echo.New()
+	e.Use(LimitBody(8, "/upload/v1beta/files"))
+	read := func(c *echo.Context) error {
+		body, err := io.ReadAll(c.Request().Body)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return c.NoContent(http.StatusRequestEntityTooLarge)
+		}
+		return c.String(http.StatusOK, string(body))
+	}
+	e.POST("/api/ask", read)
+	e.POST("/upload/v1beta/files", read)
+
+	for _, tc := range []struct {
+		path, body string
+		code       int
+	}{
+		{"/api/ask", "12345678", http.StatusOK},
+		{"/api/ask", "123456789", http.StatusRequestEntityTooLarge},
+		{"/upload/v1beta/files", "123456789", http.StatusOK},
+	} {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, tc.path, strings.NewReader(tc.body)))
+		if rec.Code != tc.code {
+			t.Fatalf("%s with %d bytes: expected %d, got %d", tc.path, len(tc.body), tc.code, rec.Code)
+		}
+	}
+}
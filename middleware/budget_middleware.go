@@ -0,0 +1,67 @@
+package appmiddleware
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"gemini-wrapper/model"
+	"gemini-wrapper/service/budget"
+	"gemini-wrapper/service/usage"
+
+	"github.com/labstack/echo/v5"
+)
+
+type BudgetConfig struct {
+	Budget      *budget.Budget
+	ErrorFormat string
+}
+
+// EnforceBudget counts requests and their tokens against the daily and
+// monthly budgets of the client (see ClientID) and of the whole server. A
+// request over a budget gets 429 with Retry-After set to when it resets.
+func EnforceBudget(cfg BudgetConfig) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c *echo.Context) error {
+			if cfg.Budget == nil {
+				return next(c)
+			}
+
+			client := ClientID(c)
+			if ok, over := cfg.Budget.Allow(client); !ok {
+				seconds := int(math.Ceil(time.Until(over.Reset).Seconds()))
+				c.Response().Header().Set("Retry-After", strconv.Itoa(max(seconds, 1)))
+				return writeBudgetError(c, cfg.ErrorFormat, over.Message())
+			}
+
+			req := c.Request()
+			ctx := usage.WithRecorder(req.Context(), func(u model.UsageMetadata) {
+				cfg.Budget.AddTokens(client, u.TotalTokenCount)
+			})
+			c.SetRequest(req.WithContext(ctx))
+			return next(c)
+		}
+	}
+}
+
+func writeBudgetError(c *echo.Context, format, message string) error {
+	if format == ErrorFormatAnthropic {
+		return c.JSON(http.StatusTooManyRequests, model.AnthropicErrorResponse{Type: "error", Error: model.AnthropicError{
+			Type:    "rate_limit_error",
+			Message: message,
+		}})
+	}
+	if format == ErrorFormatOpenAI {
+		return c.JSON(http.StatusTooManyRequests, model.OpenAIErrorResponse{Error: model.OpenAIError{
+			Message: message,
+			Type:    "insufficient_quota",
+			Code:    "insufficient_quota",
+		}})
+	}
+	return c.JSON(http.StatusTooManyRequests, model.GeminiErrorResponse{Error: model.GeminiError{
+		Code:    http.StatusTooManyRequests,
+		Message: message,
+		Status:  "RESOURCE_EXHAUSTED",
+	}})
+}
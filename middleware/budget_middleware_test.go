@@ -0,0 +1,53 @@
+package appmiddleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gemini-wrapper/model"
+	"gemini-wrapper/service/budget"
+	"gemini-wrapper/service/usage"
+
+	"github.com/labstack/echo/v5"
+)
+
+func TestEnforceBudgetChargesTokensAndRefusesOverTheCap(t *testing.T) {
+	cfg := budget.DefaultConfig()
+	cfg.Path = filepath.Join(t.TempDir(), "budget.db")
+	cfg.PerKey = budget.Limits{TokensPerDay: 10}
+	b, err := budget.Open(cfg)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer b.Close()
+
+	e := echo.New()
+	e.Use(EnforceBudget(BudgetConfig{Budget: b, ErrorFormat: ErrorFormatOpenAI}))
+	e.POST("/v1/chat/completions", func(c *echo.Context) error {
+		usage.Record(c.Request().Context(), model.UsageMetadata{TotalTokenCount: 12})
+		return c.NoContent(http.StatusOK)
+	})
+
+	first := httptest.NewRecorder()
+	e.ServeHTTP(first, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil))
+	if first.Code != http.StatusOK {
+		t.Fatalf("expected first request to pass, got %d", first.Code)
+	}
+
+	second := httptest.NewRecorder()
+	e.ServeHTTP(second, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil))
+	var body model.OpenAIErrorResponse
+	if err := json.Unmarshal(second.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if second.Code != http.StatusTooManyRequests || second.Header().Get("Retry-After") == "" || body.Error.Code != "insufficient_quota" {
+		t.Fatalf("unexpected response: %d %v %s", second.Code, second.Header(), second.Body.String())
+	}
+	if !strings.Contains(body.Error.Message, "resets at") {
+		t.Fatalf("message without reset time: %s", body.Error.Message)
+	}
+}
@@ -0,0 +1,29 @@
+package appmiddleware
+
+import (
+	"gemini-wrapper/service/cacheinfo"
+
+	"github.com/labstack/echo/v5"
+)
+
+// HeaderXCache reports whether the answer came from the response cache.
+const HeaderXCache = "X-Cache"
+
+// CacheHeader sets X-Cache: HIT or MISS on responses whose handler looked up
+// the response cache. Streams send their headers before the lookup and get none.
+func CacheHeader() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c *echo.Context) error {
+			ctx, report := cacheinfo.WithReport(c.Request().Context())
+			c.SetRequest(c.Request().WithContext(ctx))
+			if res, err := echo.UnwrapResponse(c.Response()); err == nil {
+				res.Before(func() {
+					if result := report.Result(); result != "" {
+						res.Header().Set(HeaderXCache, string(result))
+					}
+				})
+			}
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package appmiddleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gemini-wrapper/service/cacheinfo"
+
+	"github.com/labstack/echo/v5"
+)
+
+func TestCacheHeaderReportsRecordedResult(t *testing.T) {
+	e := echo.New()
+	e.Use(CacheHeader())
+	e.GET("/cached", func(c *echo.Context) error {
+		cacheinfo.Record(c.Request().Context(), cacheinfo.Hit)
+		return c.String(http.StatusOK, "ok")
+	})
+	e.GET("/plain", func(c *echo.Context) error {
+		return c.String(http.StatusOK, "ok")
+	})
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/cached", nil))
+	if got := rec.Header().Get(HeaderXCache); got != "HIT" {
+		t.Fatalf("expected X-Cache HIT, got %q", got)
+	}
+
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/plain", nil))
+	if got := rec.Header().Get(HeaderXCache); got != "" {
+		t.Fatalf("expected no X-Cache header, got %q", got)
+	}
+}
@@ -0,0 +1,25 @@
+package appmiddleware
+
+import (
+	"gemini-wrapper/service/execution"
+
+	"github.com/labstack/echo/v5"
+)
+
+// IdentifyClient records the client as identified by ClientID, so the
+// service can tell trusted clients when a request asks for a more permissive
+// execution policy and apply the client's priority class. Keys with the
+// tools scope are trusted. It must run after the API key check.
+func IdentifyClient() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c *echo.Context) error {
+			req := c.Request()
+			ctx := execution.WithClient(req.Context(), ClientID(c))
+			if key, ok := requestAPIKey(c); ok && key.Allows(ScopeTools) {
+				ctx = execution.WithTrustedClient(ctx)
+			}
+			c.SetRequest(req.WithContext(ctx))
+			return next(c)
+		}
+	}
+}
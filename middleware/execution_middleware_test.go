@@ -0,0 +1,38 @@
+package appmiddleware
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gemini-wrapper/service/execution"
+
+	"github.com/labstack/echo/v5"
+)
+
+func TestIdentifyClientLetsTrustedKeysLoosenThePolicy(t *testing.T) {
+	cfg := execution.Config{ApprovalMode: execution.ModeDefault, TrustedClients: []string{"key:ci"}}
+	e := echo.New()
+	e.Use(RequireAPIKey(APIKeyAuthConfig{Keys: []APIKey{{Key: "ci-secret", Label: "ci"}, {Key: "web-secret", Label: "web"}}}))
+	e.Use(IdentifyClient())
+	e.GET("/ask", func(c *echo.Context) error {
+		if _, err := cfg.Resolve(c.Request().Context(), execution.ModeYolo, nil); err != nil {
+			if errors.Is(err, execution.ErrNotAllowed) {
+				return c.NoContent(http.StatusForbidden)
+			}
+			return err
+		}
+		return c.NoContent(http.StatusOK)
+	})
+
+	for key, want := range map[string]int{"ci-secret": http.StatusOK, "web-secret": http.StatusForbidden} {
+		req := httptest.NewRequest(http.MethodGet, "/ask", nil)
+		req.Header.Set("Authorization", "Bearer "+key)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Fatalf("key %s: expected %d, got %d", key, want, rec.Code)
+		}
+	}
+}
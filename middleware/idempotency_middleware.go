@@ -0,0 +1,156 @@
+package appmiddleware
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"gemini-wrapper/model"
+	"gemini-wrapper/service/idempotency"
+
+	"github.com/labstack/echo/v5"
+)
+
+const (
+	// HeaderIdempotencyKey names a request so that retries of it are answered
+	// from the first response.
+	HeaderIdempotencyKey = "Idempotency-Key"
+	// HeaderIdempotentReplayed marks a response replayed from the store.
+	HeaderIdempotentReplayed = "Idempotent-Replayed"
+)
+
+// maxIdempotencyKeyLength bounds the keys clients may send.
+const maxIdempotencyKeyLength = 255
+
+type IdempotencyConfig struct {
+	Store       *idempotency.Store
+	ErrorFormat string
+}
+
+// Idempotency answers a POST that repeats the Idempotency-Key of an earlier
+// request of the same client with the earlier response, without running it
+// again. A repeat that arrives while the first request runs waits for it.
+// Only successful, non-streamed responses are kept; after a failure the key
+// can be retried. Reusing a key for another request is rejected with 422. It
+// must run after the API key check.
+func Idempotency(cfg IdempotencyConfig) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c *echo.Context) error {
+			req := c.Request()
+			key := strings.TrimSpace(req.Header.Get(HeaderIdempotencyKey))
+			if cfg.Store == nil || key == "" || req.Method != http.MethodPost {
+				return next(c)
+			}
+			if len(key) > maxIdempotencyKeyLength {
+				return writeIdempotencyError(c, cfg.ErrorFormat, http.StatusBadRequest, "Idempotency-Key must be at most 255 characters.")
+			}
+
+			body, err := io.ReadAll(req.Body)
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				return writeIdempotencyError(c, cfg.ErrorFormat, http.StatusRequestEntityTooLarge, fmt.Sprintf("Request body is larger than %d bytes.", tooLarge.Limit))
+			}
+			if err != nil {
+				return writeIdempotencyError(c, cfg.ErrorFormat, http.StatusBadRequest, "Failed to read the request body.")
+			}
+			req.Body = io.NopCloser(bytes.NewReader(body))
+			fingerprint := sha256.New()
+			fingerprint.Write([]byte(req.Method + " " + req.URL.Path + "\n"))
+			fingerprint.Write(body)
+
+			stored, complete, err := cfg.Store.Claim(req.Context(), ClientID(c)+"\n"+key, hex.EncodeToString(fingerprint.Sum(nil)))
+			if errors.Is(err, idempotency.ErrMismatch) {
+				return writeIdempotencyError(c, cfg.ErrorFormat, http.StatusUnprocessableEntity, "Idempotency-Key was already used for a different request.")
+			}
+			if err != nil {
+				return err
+			}
+			if stored != nil {
+				c.Response().Header().Set(HeaderIdempotentReplayed, "true")
+				return c.Blob(stored.Status, stored.ContentType, stored.Body)
+			}
+			defer complete(nil)
+
+			capture := &capturingWriter{ResponseWriter: c.Response(), limit: cfg.Store.MaxBodyBytes()}
+			c.SetResponse(capture)
+			err = next(c)
+			c.SetResponse(capture.ResponseWriter)
+
+			_, code := echo.ResolveResponseStatus(capture.ResponseWriter, err)
+			contentType := capture.Header().Get(echo.HeaderContentType)
+			if err == nil && code >= 200 && code < 300 && !capture.overflow && !isStreamContentType(contentType) && !streamsGenerateContent(req) {
+				complete(&idempotency.Response{Status: code, ContentType: contentType, Body: capture.body.Bytes()})
+			}
+			return err
+		}
+	}
+}
+
+func isStreamContentType(contentType string) bool {
+	return strings.HasPrefix(contentType, "text/event-stream") || strings.HasPrefix(contentType, "application/x-ndjson")
+}
+
+// streamsGenerateContent reports a streamGenerateContent call. Without
+// ?alt=sse it streams a JSON array whose 200 is sent before the answer, so
+// a failure midway ends the array with an error element instead of
+// changing the status.
+func streamsGenerateContent(req *http.Request) bool {
+	return strings.HasSuffix(req.URL.Path, ":streamGenerateContent")
+}
+
+// capturingWriter copies up to limit bytes of the response body.
+type capturingWriter struct {
+	http.ResponseWriter
+	body     bytes.Buffer
+	limit    int
+	overflow bool
+}
+
+func (w *capturingWriter) Write(b []byte) (int, error) {
+	if !w.overflow {
+		if w.body.Len()+len(b) > w.limit {
+			w.overflow = true
+			w.body.Reset()
+		} else {
+			w.body.Write(b)
+		}
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *capturingWriter) Flush() {
+	_ = http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *capturingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+func (w *capturingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func writeIdempotencyError(c *echo.Context, format string, code int, message string) error {
+	if format == ErrorFormatAnthropic {
+		return c.JSON(code, model.AnthropicErrorResponse{Type: "error", Error: model.AnthropicError{Type: "invalid_request_error", Message: message}})
+	}
+	if format == ErrorFormatOpenAI {
+		return c.JSON(code, model.OpenAIErrorResponse{Error: model.OpenAIError{
+			Message: message,
+			Type:    "invalid_request_error",
+			Code:    "idempotency_error",
+		}})
+	}
+	status := "INVALID_ARGUMENT"
+	if code == http.StatusUnprocessableEntity {
+		status = "FAILED_PRECONDITION"
+	}
+	return c.JSON(code, model.GeminiErrorResponse{Error: model.GeminiError{Code: code, Message: message, Status: status}})
+}
@@ -0,0 +1,118 @@
+package appmiddleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gemini-wrapper/service/idempotency"
+
+	"github.com/labstack/echo/v5"
+)
+
+func TestIdempotencyReplaysTheFirstResponse(t *testing.T) {
+	store := idempotency.NewMemoryStore(idempotency.DefaultConfig())
+	calls := 0
+	e := echo.New()
+	e.Use(Idempotency(IdempotencyConfig{Store: store}))
+	e.POST("/api/ask", func(c *echo.Context) error {
+		calls++
+		if calls == 1 {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "boom"})
+		}
+		return c.JSON(http.StatusOK, map[string]int{"call": calls})
+	})
+	ask := func(key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/ask", strings.NewReader(body))
+		req.Header.Set(HeaderIdempotencyKey, key)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := ask("k1", `{"question":"q"}`); rec.Code != http.StatusInternalServerError {
+		t.Fatalf("expected the first call to fail, got %d", rec.Code)
+	}
+	first := ask("k1", `{"question":"q"}`)
+	if first.Code != http.StatusOK || strings.TrimSpace(first.Body.String()) != `{"call":2}` {
+		t.Fatalf("expected a failed request to be retried, got %d %s", first.Code, first.Body.String())
+	}
+
+	replay := ask("k1", `{"question":"q"}`)
+	if replay.Code != http.StatusOK || replay.Body.String() != first.Body.String() || replay.Header().Get(HeaderIdempotentReplayed) != "true" {
+		t.Fatalf("expected a replay of the first response, got %d %v %s", replay.Code, replay.Header(), replay.Body.String())
+	}
+	if calls != 2 {
+		t.Fatalf("expected the handler to run twice, got %d", calls)
+	}
+
+	if rec := ask("k1", `{"question":"other"}`); rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422 for a reused key, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := ask("k2", `{"question":"q"}`); rec.Code != http.StatusOK || calls != 3 {
+		t.Fatalf("expected another key to run, got %d after %d calls", rec.Code, calls)
+	}
+}
+
+func TestIdempotencyDoesNotStoreStreams(t *testing.T) {
+	store := idempotency.NewMemoryStore(idempotency.DefaultConfig())
+	calls := 0
+	e := echo.New()
+	e.Use(Idempotency(IdempotencyConfig{Store: store}))
+	e.POST("/api/ask/stream", func(c *echo.Context) error {
+		calls++
+		return c.Blob(http.StatusOK, "text/event-stream", []byte("event: done\ndata: {}\n\n"))
+	})
+
+	for range 2 {
+		req := httptest.NewRequest(http.MethodPost, "/api/ask/stream", strings.NewReader(`{}`))
+		req.Header.Set(HeaderIdempotencyKey, "k")
+		e.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	if calls != 2 {
+		t.Fatalf("expected streams to run every time, got %d calls", calls)
+	}
+}
+
+func TestIdempotencyRetriesAStreamThatFailedMidway(t *testing.T) {
+	store := idempotency.NewMemoryStore(idempotency.DefaultConfig())
+	calls := 0
+	e := echo.New()
+	e.Use(Idempotency(IdempotencyConfig{Store: store}))
+	e.POST("/v1beta/models/:model", func(c *echo.Context) error {
+		calls++
+		if calls == 1 {
+			// The status went out before the backend failed.
+			return c.Blob(http.StatusOK, echo.MIMEApplicationJSON, []byte(`[{"candidates":[]},{"error":{"code":503,"message":"overloaded"}}]`))
+		}
+		return c.Blob(http.StatusOK, echo.MIMEApplicationJSON, []byte(`[{"candidates":[]}]`))
+	})
+
+	var rec *httptest.ResponseRecorder
+	for range 2 {
+		req := httptest.NewRequest(http.MethodPost, "/v1beta/models/gemini-2.5-flash:streamGenerateContent", strings.NewReader(`{}`))
+		req.Header.Set(HeaderIdempotencyKey, "k")
+		rec = httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+	}
+	if calls != 2 || strings.Contains(rec.Body.String(), "error") || rec.Header().Get(HeaderIdempotentReplayed) != "" {
+		t.Fatalf("expected the retry to run again, got %d calls and %s", calls, rec.Body)
+	}
+}
+
+func TestIdempotencyAnswersTooLargeBodiesWith413(t *testing.T) {
+	e := echo.New()
+	e.Use(LimitBody(8))
+	e.POST("/api/ask", func(c *echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	}, Idempotency(IdempotencyConfig{Store: idempotency.NewMemoryStore(idempotency.DefaultConfig()), ErrorFormat: ErrorFormatOpenAI}))
+
+	req := httptest.NewRequest(http.MethodPost, "/api/ask", strings.NewReader(`{"question":"too long"}`))
+	req.Header.Set(HeaderIdempotencyKey, "k")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413, got %d %s", rec.Code, rec.Body)
+	}
+}
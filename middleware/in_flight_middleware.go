@@ -0,0 +1,99 @@
+package appmiddleware
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"gemini-wrapper/metrics"
+	"gemini-wrapper/model"
+
+	"github.com/labstack/echo/v5"
+)
+
+// defaultShedRetryAfter is the Retry-After of shed requests when none is set.
+const defaultShedRetryAfter = 5 * time.Second
+
+// InFlightLimiter counts the requests being served across every route group
+// it guards and caps them at Limit. A Limit of 0 only counts.
+type InFlightLimiter struct {
+	limit      int64
+	retryAfter time.Duration
+	inFlight   atomic.Int64
+}
+
+func NewInFlightLimiter(limit int, retryAfter time.Duration) *InFlightLimiter {
+	if retryAfter <= 0 {
+		retryAfter = defaultShedRetryAfter
+	}
+	return &InFlightLimiter{limit: int64(max(limit, 0)), retryAfter: retryAfter}
+}
+
+// InFlight returns the number of requests being served.
+func (l *InFlightLimiter) InFlight() int {
+	return int(l.inFlight.Load())
+}
+
+// acquire admits a request unless the limit is reached. Admitted requests
+// must call release.
+func (l *InFlightLimiter) acquire() bool {
+	if l.inFlight.Add(1) > l.limit && l.limit > 0 {
+		l.inFlight.Add(-1)
+		return false
+	}
+	return true
+}
+
+func (l *InFlightLimiter) release() {
+	l.inFlight.Add(-1)
+}
+
+type InFlightConfig struct {
+	Limiter     *InFlightLimiter
+	ErrorFormat string
+}
+
+// LimitInFlight sheds requests beyond the limit of cfg.Limiter right away
+// with 503 and Retry-After, instead of letting them queue until they time
+// out. Streams count until they end.
+func LimitInFlight(cfg InFlightConfig) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c *echo.Context) error {
+			if cfg.Limiter == nil {
+				return next(c)
+			}
+			if !cfg.Limiter.acquire() {
+				metrics.LoadShed.Inc()
+				seconds := int(math.Ceil(cfg.Limiter.retryAfter.Seconds()))
+				c.Response().Header().Set("Retry-After", strconv.Itoa(max(seconds, 1)))
+				return writeOverloadedError(c, cfg.ErrorFormat)
+			}
+			defer cfg.Limiter.release()
+			return next(c)
+		}
+	}
+}
+
+func writeOverloadedError(c *echo.Context, format string) error {
+	const message = "The server is overloaded. Retry later."
+	if format == ErrorFormatAnthropic {
+		return c.JSON(http.StatusServiceUnavailable, model.AnthropicErrorResponse{Type: "error", Error: model.AnthropicError{
+			Type:    "overloaded_error",
+			Message: message,
+		}})
+	}
+	if format == ErrorFormatOpenAI {
+		return c.JSON(http.StatusServiceUnavailable, model.OpenAIErrorResponse{Error: model.OpenAIError{
+			Message: message,
+			Type:    "server_error",
+			Code:    "overloaded",
+		}})
+	}
+	return c.JSON(http.StatusServiceUnavailable, model.GeminiErrorResponse{Error: model.GeminiError{
+		Code:    http.StatusServiceUnavailable,
+		Message: message,
+		Status:  "UNAVAILABLE",
+	}})
+}
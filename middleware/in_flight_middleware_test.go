@@ -0,0 +1,73 @@
+package appmiddleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gemini-wrapper/model"
+
+	"github.com/labstack/echo/v5"
+)
+
+func TestLimitInFlightShedsBeyondTheLimit(t *testing.T) {
+	limiter := NewInFlightLimiter(1, 3*time.Second)
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	e := echo.New()
+	e.Use(LimitInFlight(InFlightConfig{Limiter: limiter, ErrorFormat: ErrorFormatOpenAI}))
+	e.POST("/v1/chat/completions", func(c *echo.Context) error {
+		started <- struct{}{}
+		<-unblock
+		return c.NoContent(http.StatusOK)
+	})
+
+	done := make(chan int)
+	go func() {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil))
+		done <- rec.Code
+	}()
+	<-started
+	if limiter.InFlight() != 1 {
+		t.Fatalf("expected 1 request in flight, got %d", limiter.InFlight())
+	}
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil))
+	var body model.OpenAIErrorResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") != "3" || body.Error.Code != "overloaded" {
+		t.Fatalf("expected a shed 503, got %d %v %s", rec.Code, rec.Header(), rec.Body.String())
+	}
+
+	close(unblock)
+	if code := <-done; code != http.StatusOK {
+		t.Fatalf("expected the admitted request to finish, got %d", code)
+	}
+	if limiter.InFlight() != 0 {
+		t.Fatalf("expected no request in flight, got %d", limiter.InFlight())
+	}
+}
+
+func TestLimitInFlightWithoutLimitOnlyCounts(t *testing.T) {
+	limiter := NewInFlightLimiter(0, 0)
+	e := echo.New()
+	e.Use(LimitInFlight(InFlightConfig{Limiter: limiter}))
+	e.POST("/api/ask", func(c *echo.Context) error {
+		if limiter.InFlight() != 1 {
+			t.Errorf("expected the request to be counted, got %d", limiter.InFlight())
+		}
+		return c.NoContent(http.StatusOK)
+	})
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/ask", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected the request to pass, got %d", rec.Code)
+	}
+}
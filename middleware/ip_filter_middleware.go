@@ -0,0 +1,159 @@
+package appmiddleware
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"gemini-wrapper/model"
+
+	"github.com/labstack/echo/v5"
+)
+
+// IPFilter admits clients by address. A denied range always wins; with an
+// allowlist, only addresses in it are admitted.
+type IPFilter struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// NewIPFilter parses the allow and deny lists, whose entries are CIDR ranges
+// or single addresses. It returns nil, which admits everyone, when both are
+// empty.
+func NewIPFilter(allow, deny []string) (*IPFilter, error) {
+	allowNets, err := ParseCIDRs(allow)
+	if err != nil {
+		return nil, fmt.Errorf("allowlist: %w", err)
+	}
+	denyNets, err := ParseCIDRs(deny)
+	if err != nil {
+		return nil, fmt.Errorf("denylist: %w", err)
+	}
+	if len(allowNets) == 0 && len(denyNets) == 0 {
+		return nil, nil
+	}
+	return &IPFilter{allow: allowNets, deny: denyNets}, nil
+}
+
+// Allowed reports whether the client at ip may use the API. Addresses that
+// cannot be parsed are only allowed without an allowlist or denylist.
+func (f *IPFilter) Allowed(ip string) bool {
+	if f == nil {
+		return true
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, network := range f.deny {
+		if network.Contains(addr) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, network := range f.allow {
+		if network.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseCIDRs parses CIDR ranges such as "10.0.0.0/8". A bare address is a
+// range of that address alone. Blank entries are skipped.
+func ParseCIDRs(entries []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid range %q", entry)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// ClientIPExtractor returns how to find the client address of a request.
+// Without trusted proxies it is the connection's peer. Otherwise header
+// ("X-Forwarded-For", the default, or "X-Real-IP") is believed only when the
+// request comes through one of the trusted ranges, so clients cannot claim an
+// address by sending the header themselves.
+func ClientIPExtractor(trustedProxies []string, header string) (echo.IPExtractor, error) {
+	proxies, err := ParseCIDRs(trustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("trusted proxies: %w", err)
+	}
+	if len(proxies) == 0 {
+		return echo.ExtractIPDirect(), nil
+	}
+	options := []echo.TrustOption{echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false)}
+	for _, proxy := range proxies {
+		options = append(options, echo.TrustIPRange(proxy))
+	}
+	switch http.CanonicalHeaderKey(strings.TrimSpace(header)) {
+	case "", echo.HeaderXForwardedFor:
+		return echo.ExtractIPFromXFFHeader(options...), nil
+	case echo.HeaderXRealIP:
+		return echo.ExtractIPFromRealIPHeader(options...), nil
+	}
+	return nil, fmt.Errorf("unsupported client IP header %q (expected X-Forwarded-For or X-Real-IP)", header)
+}
+
+type IPFilterConfig struct {
+	Filter      *IPFilter
+	ErrorFormat string
+}
+
+// FilterIPs answers requests from clients the filter does not admit with
+// 403 before anything else runs.
+func FilterIPs(cfg IPFilterConfig) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c *echo.Context) error {
+			if cfg.Filter.Allowed(c.RealIP()) {
+				return next(c)
+			}
+			return writeForbiddenError(c, cfg.ErrorFormat)
+		}
+	}
+}
+
+func writeForbiddenError(c *echo.Context, format string) error {
+	const message = "Access from this address is not allowed."
+	if format == ErrorFormatAnthropic {
+		return c.JSON(http.StatusForbidden, model.AnthropicErrorResponse{Type: "error", Error: model.AnthropicError{
+			Type:    "permission_error",
+			Message: message,
+		}})
+	}
+	if format == ErrorFormatOpenAI {
+		return c.JSON(http.StatusForbidden, model.OpenAIErrorResponse{Error: model.OpenAIError{
+			Message: message,
+			Type:    "invalid_request_error",
+			Code:    "ip_not_allowed",
+		}})
+	}
+	return c.JSON(http.StatusForbidden, model.GeminiErrorResponse{Error: model.GeminiError{
+		Code:    http.StatusForbidden,
+		Message: message,
+		Status:  "PERMISSION_DENIED",
+	}})
+}
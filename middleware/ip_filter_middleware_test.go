@@ -0,0 +1,87 @@
+package appmiddleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gemini-wrapper/model"
+
+	"github.com/labstack/echo/v5"
+)
+
+func TestIPFilterDenyWinsOverAllow(t *testing.T) {
+	filter, err := NewIPFilter([]string{"10.0.0.0/8", "2001:db8::/32", "192.168.1.7"}, []string{"10.9.0.0/16"})
+	if err != nil {
+		t.Fatalf("NewIPFilter: %v", err)
+	}
+	for ip, want := range map[string]bool{
+		"10.1.2.3":    true,
+		"10.9.1.1":    false,
+		"192.168.1.7": true,
+		"192.168.1.8": false,
+		"2001:db8::1": true,
+		"2001:db9::1": false,
+		"not-an-ip":   false,
+	} {
+		if got := filter.Allowed(ip); got != want {
+			t.Errorf("Allowed(%q) = %v, want %v", ip, got, want)
+		}
+	}
+
+	if filter, err := NewIPFilter(nil, []string{" "}); filter != nil || err != nil {
+		t.Fatalf("expected no filter for empty lists, got %v, %v", filter, err)
+	}
+	if !(*IPFilter)(nil).Allowed("unknown") {
+		t.Fatal("expected a nil filter to admit everyone")
+	}
+	if _, err := NewIPFilter([]string{"10.0.0.0/33"}, nil); err == nil {
+		t.Fatal("expected an invalid range to be rejected")
+	}
+}
+
+func TestFilterIPsUsesTheAddressFromTrustedProxies(t *testing.T) {
+	filter, err := NewIPFilter([]string{"203.0.113.0/24"}, nil)
+	if err != nil {
+		t.Fatalf("NewIPFilter: %v", err)
+	}
+	extractor, err := ClientIPExtractor([]string{"127.0.0.1"}, "x-forwarded-for")
+	if err != nil {
+		t.Fatalf("ClientIPExtractor: %v", err)
+	}
+	e := echo.New()
+	e.IPExtractor = extractor
+	e.Use(FilterIPs(IPFilterConfig{Filter: filter, ErrorFormat: ErrorFormatOpenAI}))
+	e.GET("/v1/models", func(c *echo.Context) error {
+		return c.String(http.StatusOK, c.RealIP())
+	})
+
+	request := func(remoteAddr, forwardedFor string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/v1/models", nil)
+		req.RemoteAddr = remoteAddr
+		if forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := request("127.0.0.1:4000", "203.0.113.9"); rec.Code != http.StatusOK || rec.Body.String() != "203.0.113.9" {
+		t.Fatalf("expected the proxied client to be admitted, got %d %s", rec.Code, rec.Body)
+	}
+	// An untrusted peer cannot claim an allowed address.
+	rec := request("198.51.100.4:4000", "203.0.113.9")
+	var body model.OpenAIErrorResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if rec.Code != http.StatusForbidden || body.Error.Code != "ip_not_allowed" {
+		t.Fatalf("expected 403, got %d %s", rec.Code, rec.Body)
+	}
+
+	if _, err := ClientIPExtractor([]string{"10.0.0.1"}, "Forwarded"); err == nil {
+		t.Fatal("expected an unsupported header to be rejected")
+	}
+}
@@ -0,0 +1,30 @@
+package appmiddleware
+
+import (
+	"strconv"
+	"time"
+
+	"gemini-wrapper/metrics"
+
+	"github.com/labstack/echo/v5"
+)
+
+// RecordMetrics counts every request and observes its latency by route pattern.
+func RecordMetrics() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c *echo.Context) error {
+			start := time.Now()
+			err := next(c)
+
+			route := c.Path()
+			if route == "" {
+				route = "unmatched"
+			}
+			method := c.Request().Method
+			_, code := echo.ResolveResponseStatus(c.Response(), err)
+			metrics.HTTPRequests.Inc(method, route, strconv.Itoa(code))
+			metrics.HTTPRequestDuration.Observe(time.Since(start).Seconds(), method, route)
+			return err
+		}
+	}
+}
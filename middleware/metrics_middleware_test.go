@@ -0,0 +1,29 @@
+package appmiddleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gemini-wrapper/metrics"
+
+	"github.com/labstack/echo/v5"
+)
+
+func TestRecordMetricsCountsByRoutePattern(t *testing.T) {
+	e := echo.New()
+	e.Use(RecordMetrics())
+	e.GET("/items/:id", func(c *echo.Context) error {
+		return c.String(http.StatusTeapot, "ok")
+	})
+
+	before := metrics.HTTPRequests.Value(http.MethodGet, "/items/:id", "418")
+	for _, path := range []string{"/items/1", "/items/2"} {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	if got := metrics.HTTPRequests.Value(http.MethodGet, "/items/:id", "418") - before; got != 2 {
+		t.Fatalf("expected 2 requests counted, got %v", got)
+	}
+}
@@ -0,0 +1,83 @@
+package appmiddleware
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"gemini-wrapper/model"
+	"gemini-wrapper/service/ratelimit"
+	"gemini-wrapper/service/tenants"
+	"gemini-wrapper/service/usage"
+
+	"github.com/labstack/echo/v5"
+)
+
+type RateLimitConfig struct {
+	Limiter     *ratelimit.Limiter
+	ErrorFormat string
+}
+
+// RateLimit applies the limiter per client: the API key label when the
+// request was authenticated, otherwise the client IP. A tenant with limits of
+// its own is one client for all its keys. Tokens used by the request are
+// charged to the same client. Rejections are 429 with Retry-After.
+func RateLimit(cfg RateLimitConfig) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c *echo.Context) error {
+			if cfg.Limiter == nil {
+				return next(c)
+			}
+
+			client, allow := ClientID(c), cfg.Limiter.Allow
+			if t := tenants.FromContext(c.Request().Context()); t != nil && t.RateLimit.Enabled() {
+				client = "tenant:" + t.Name
+				allow = func(client string) (bool, time.Duration) { return cfg.Limiter.AllowWith(client, t.RateLimit) }
+			}
+			if ok, retryAfter := allow(client); !ok {
+				seconds := int(math.Ceil(retryAfter.Seconds()))
+				c.Response().Header().Set("Retry-After", strconv.Itoa(max(seconds, 1)))
+				return writeRateLimitError(c, cfg.ErrorFormat, retryAfter)
+			}
+
+			req := c.Request()
+			ctx := usage.WithRecorder(req.Context(), func(u model.UsageMetadata) {
+				cfg.Limiter.AddTokens(client, u.TotalTokenCount)
+			})
+			c.SetRequest(req.WithContext(ctx))
+			return next(c)
+		}
+	}
+}
+
+// ClientID identifies the caller for quotas: "key:<label>" or "ip:<address>".
+func ClientID(c *echo.Context) string {
+	if label := APIKeyLabel(c); label != "" {
+		return "key:" + label
+	}
+	return "ip:" + c.RealIP()
+}
+
+func writeRateLimitError(c *echo.Context, format string, retryAfter time.Duration) error {
+	message := fmt.Sprintf("Rate limit exceeded. Retry after %s.", retryAfter.Round(time.Second))
+	if format == ErrorFormatAnthropic {
+		return c.JSON(http.StatusTooManyRequests, model.AnthropicErrorResponse{Type: "error", Error: model.AnthropicError{
+			Type:    "rate_limit_error",
+			Message: message,
+		}})
+	}
+	if format == ErrorFormatOpenAI {
+		return c.JSON(http.StatusTooManyRequests, model.OpenAIErrorResponse{Error: model.OpenAIError{
+			Message: message,
+			Type:    "requests",
+			Code:    "rate_limit_exceeded",
+		}})
+	}
+	return c.JSON(http.StatusTooManyRequests, model.GeminiErrorResponse{Error: model.GeminiError{
+		Code:    http.StatusTooManyRequests,
+		Message: message,
+		Status:  "RESOURCE_EXHAUSTED",
+	}})
+}
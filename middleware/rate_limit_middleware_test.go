@@ -0,0 +1,92 @@
+package appmiddleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gemini-wrapper/model"
+	"gemini-wrapper/service/ratelimit"
+	"gemini-wrapper/service/tenants"
+	"gemini-wrapper/service/usage"
+
+	"github.com/labstack/echo/v5"
+)
+
+func TestRateLimitRejectsWithRetryAfterAndChargesTokens(t *testing.T) {
+	limiter := ratelimit.NewLimiter(ratelimit.Config{RequestsPerMinute: 1})
+	e := echo.New()
+	e.Use(RateLimit(RateLimitConfig{Limiter: limiter}))
+	e.POST("/api/ask", func(c *echo.Context) error {
+		usage.Record(c.Request().Context(), model.UsageMetadata{TotalTokenCount: 12})
+		return c.NoContent(http.StatusOK)
+	})
+
+	first := httptest.NewRecorder()
+	e.ServeHTTP(first, httptest.NewRequest(http.MethodPost, "/api/ask", nil))
+	if first.Code != http.StatusOK {
+		t.Fatalf("expected first request to pass, got %d", first.Code)
+	}
+
+	second := httptest.NewRecorder()
+	e.ServeHTTP(second, httptest.NewRequest(http.MethodPost, "/api/ask", nil))
+	if second.Code != http.StatusTooManyRequests || second.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected 429 with Retry-After, got %d %v", second.Code, second.Header())
+	}
+
+	report := limiter.Usage()
+	if len(report.Clients) != 1 || report.Clients[0].TokensToday != 12 {
+		t.Fatalf("unexpected usage report: %#v", report)
+	}
+}
+
+func TestRateLimitRejectsInAnthropicFormat(t *testing.T) {
+	limiter := ratelimit.NewLimiter(ratelimit.Config{RequestsPerMinute: 1})
+	e := echo.New()
+	e.Use(RateLimit(RateLimitConfig{Limiter: limiter, ErrorFormat: ErrorFormatAnthropic}))
+	e.POST("/v1/messages", func(c *echo.Context) error { return c.NoContent(http.StatusOK) })
+
+	for range 2 {
+		e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/v1/messages", nil))
+	}
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v1/messages", nil))
+	var body model.AnthropicErrorResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if rec.Code != http.StatusTooManyRequests || body.Type != "error" || body.Error.Type != "rate_limit_error" {
+		t.Fatalf("unexpected response: %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestRateLimitSharesTheLimitsOfATenant(t *testing.T) {
+	registry, err := tenants.New([]tenants.Tenant{{Name: "search", RateLimit: ratelimit.Config{RequestsPerMinute: 1}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	limiter := ratelimit.NewLimiter(ratelimit.Config{RequestsPerMinute: 5})
+	e := echo.New()
+	e.Use(RequireAPIKey(APIKeyAuthConfig{Keys: []APIKey{
+		{Key: "first", Label: tenants.Label("search", "first")},
+		{Key: "second", Label: tenants.Label("search", "second")},
+		{Key: "ops", Label: "ops"},
+	}}))
+	e.Use(SelectTenant(registry))
+	e.Use(RateLimit(RateLimitConfig{Limiter: limiter}))
+	e.POST("/api/ask", func(c *echo.Context) error { return c.NoContent(http.StatusOK) })
+
+	for _, tt := range []struct {
+		key  string
+		want int
+	}{{"first", http.StatusOK}, {"second", http.StatusTooManyRequests}, {"ops", http.StatusOK}} {
+		req := httptest.NewRequest(http.MethodPost, "/api/ask", nil)
+		req.Header.Set("Authorization", "Bearer "+tt.key)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Fatalf("key %s: expected %d, got %d", tt.key, tt.want, rec.Code)
+		}
+	}
+}
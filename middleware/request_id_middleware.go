@@ -0,0 +1,39 @@
+package appmiddleware
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+
+	"gemini-wrapper/logging"
+
+	"github.com/labstack/echo/v5"
+)
+
+// maxRequestIDLength bounds client-supplied IDs so they cannot bloat logs.
+const maxRequestIDLength = 128
+
+// RequestID reuses a sane inbound X-Request-Id or generates one, returns it in
+// the X-Request-Id response header and stores it in the request context for logging.
+func RequestID() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c *echo.Context) error {
+			req := c.Request()
+			id := strings.TrimSpace(req.Header.Get(echo.HeaderXRequestID))
+			if id == "" || len(id) > maxRequestIDLength || strings.ContainsAny(id, "\r\n\"") {
+				id = newRequestID()
+			}
+			c.Response().Header().Set(echo.HeaderXRequestID, id)
+			c.SetRequest(req.WithContext(logging.WithRequestID(req.Context(), id)))
+			return next(c)
+		}
+	}
+}
+
+func newRequestID() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "req_unknown"
+	}
+	return hex.EncodeToString(buf)
+}
@@ -0,0 +1,48 @@
+package appmiddleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gemini-wrapper/logging"
+
+	"github.com/labstack/echo/v5"
+)
+
+func TestRequestIDGeneratesAndPropagates(t *testing.T) {
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+
+	var seen string
+	h := RequestID()(func(c *echo.Context) error {
+		seen = logging.RequestID(c.Request().Context())
+		return c.NoContent(http.StatusOK)
+	})
+	if err := h(c); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if seen == "" || rec.Header().Get(echo.HeaderXRequestID) != seen {
+		t.Fatalf("expected generated id in context and header, ctx=%q header=%q", seen, rec.Header().Get(echo.HeaderXRequestID))
+	}
+}
+
+func TestRequestIDReusesInboundHeader(t *testing.T) {
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(echo.HeaderXRequestID, "client-42")
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+
+	h := RequestID()(func(c *echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	})
+	if err := h(c); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := rec.Header().Get(echo.HeaderXRequestID); got != "client-42" {
+		t.Fatalf("expected inbound id to be reused, got %q", got)
+	}
+}
@@ -0,0 +1,143 @@
+package appmiddleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/labstack/echo/v5"
+)
+
+// Scopes an API key may be limited to.
+const (
+	// ScopeAsk allows questions answered at once, on every API, and their
+	// jobs, templates and files.
+	ScopeAsk = "ask"
+	// ScopeStream allows streamed answers, on top of ScopeAsk.
+	ScopeStream     = "stream"
+	ScopeSessions   = "sessions"
+	ScopeWorkspaces = "workspaces"
+	// ScopeAdmin allows the /admin and /debug routes besides ADMIN_API_KEY.
+	ScopeAdmin = "admin"
+	// ScopeTools makes the key a trusted client of the execution policy, so
+	// its requests may let the CLI edit files and run shell commands.
+	ScopeTools = "tools"
+)
+
+// Scopes lists every scope name.
+var Scopes = []string{ScopeAsk, ScopeStream, ScopeSessions, ScopeWorkspaces, ScopeAdmin, ScopeTools}
+
+// defaultScopes are the scopes of keys configured without any.
+var defaultScopes = []string{ScopeAsk, ScopeStream, ScopeSessions, ScopeWorkspaces}
+
+// Allows reports whether k may be used for scope.
+func (k APIKey) Allows(scope string) bool {
+	if k.Scopes == nil {
+		return slices.Contains(defaultScopes, scope)
+	}
+	return slices.Contains(k.Scopes, scope)
+}
+
+// ScopeAPIKeys returns keys with the Scopes that scopes lists for their
+// labels. Unknown labels and scopes are rejected.
+func ScopeAPIKeys(keys []APIKey, scopes map[string][]string) ([]APIKey, error) {
+	scoped := slices.Clone(keys)
+	for label, names := range scopes {
+		for _, name := range names {
+			if !slices.Contains(Scopes, name) {
+				return nil, fmt.Errorf("key %q has unknown scope %q (expected one of %s)", label, name, strings.Join(Scopes, ", "))
+			}
+		}
+		i := slices.IndexFunc(scoped, func(key APIKey) bool { return key.Label == label })
+		if i < 0 {
+			return nil, fmt.Errorf("scopes for unknown key %q", label)
+		}
+		scoped[i].Scopes = append([]string{}, names...)
+	}
+	return scoped, nil
+}
+
+// KeysWithScope returns the keys that may be used for scope.
+func KeysWithScope(keys []APIKey, scope string) []APIKey {
+	var allowed []APIKey
+	for _, key := range keys {
+		if key.Allows(scope) {
+			allowed = append(allowed, key)
+		}
+	}
+	return allowed
+}
+
+// requestAPIKey returns the key that authenticated the request.
+func requestAPIKey(c *echo.Context) (APIKey, bool) {
+	key, ok := c.Get(apiKeyContextKey).(APIKey)
+	return key, ok
+}
+
+// RequireScope answers 403 when the API key of the request may not be used
+// for scope. Requests without a key, when none are configured, are let
+// through. It must run after the API key check.
+func RequireScope(scope string, errorFormat string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c *echo.Context) error {
+			if key, ok := requestAPIKey(c); ok && !key.Allows(scope) {
+				return writeAuthError(c, errorFormat, http.StatusForbidden, fmt.Sprintf("API key %s lacks the %s scope.", key.Label, scope))
+			}
+			return next(c)
+		}
+	}
+}
+
+// RequireStreamScope is RequireScope(ScopeStream) for the requests that ask
+// for a streamed answer: Gemini API streamGenerateContent calls, and JSON
+// bodies with "stream": true, or without "stream": false when the API
+// streams by default like Ollama does. At most maxBodyBytes of the body are
+// read to find out (0 reads all of it).
+func RequireStreamScope(errorFormat string, streamsByDefault bool, maxBodyBytes int64) echo.MiddlewareFunc {
+	requireStream := RequireScope(ScopeStream, errorFormat)
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		scoped := requireStream(next)
+		return func(c *echo.Context) error {
+			if key, ok := requestAPIKey(c); !ok || key.Allows(ScopeStream) {
+				return next(c)
+			}
+			if streamRequested(c, streamsByDefault, maxBodyBytes) {
+				return scoped(c)
+			}
+			return next(c)
+		}
+	}
+}
+
+func streamRequested(c *echo.Context, streamsByDefault bool, maxBodyBytes int64) bool {
+	req := c.Request()
+	if strings.HasSuffix(req.URL.Path, ":streamGenerateContent") || req.URL.Query().Get("alt") == "sse" {
+		return true
+	}
+	if req.Method != http.MethodPost || req.Body == nil {
+		return false
+	}
+	limited := req.Body
+	if maxBodyBytes > 0 {
+		limited = http.MaxBytesReader(c.Response(), req.Body, maxBodyBytes)
+	}
+	body, err := io.ReadAll(limited)
+	if err != nil {
+		// The handler reads the same error after what was read, and
+		// answers a body that is too large as it always does.
+		req.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), limited))
+		return false
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	var fields struct {
+		Stream *bool `json:"stream"`
+	}
+	if json.Unmarshal(body, &fields) != nil || fields.Stream == nil {
+		return streamsByDefault
+	}
+	return *fields.Stream
+}
@@ -0,0 +1,124 @@
+package appmiddleware
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gemini-wrapper/service/execution"
+
+	"github.com/labstack/echo/v5"
+)
+
+func TestRequireScopeLimitsKeysToTheirScopes(t *testing.T) {
+	keys, err := ScopeAPIKeys([]APIKey{
+		{Key: "web-secret", Label: "web"},
+		{Key: "chat-secret", Label: "chat"},
+		{Key: "ops-secret", Label: "ops"},
+	}, map[string][]string{
+		"chat": {ScopeAsk},
+		"ops":  {ScopeAdmin, ScopeTools},
+	})
+	if err != nil {
+		t.Fatalf("ScopeAPIKeys: %v", err)
+	}
+	e := echo.New()
+	e.Use(RequireAPIKey(APIKeyAuthConfig{Keys: keys}), IdentifyClient())
+	// The handlers echo the body, which the stream check must leave to them,
+	// and tell whether the key may loosen the execution policy.
+	ok := func(c *echo.Context) error {
+		body, _ := io.ReadAll(c.Request().Body)
+		_, err := execution.Config{}.Resolve(c.Request().Context(), execution.ModeYolo, nil)
+		return c.String(http.StatusOK, fmt.Sprintf("%s trusted=%t", body, err == nil))
+	}
+	e.POST("/ask", ok, RequireScope(ScopeAsk, ErrorFormatGemini))
+	e.POST("/generate", ok, RequireScope(ScopeAsk, ErrorFormatGemini), RequireStreamScope(ErrorFormatGemini, true, 0))
+	e.POST("/models/m:streamGenerateContent", ok, RequireStreamScope(ErrorFormatGemini, false, 0))
+	e.POST("/chat/completions", ok, RequireStreamScope(ErrorFormatOpenAI, false, 0))
+	e.POST("/sessions", ok, RequireScope(ScopeSessions, ErrorFormatGemini))
+	e.POST("/admin", ok, RequireScope(ScopeAdmin, ErrorFormatGemini))
+
+	tests := []struct {
+		key, path, body string
+		want            int
+	}{
+		{key: "web-secret", path: "/ask", body: "q", want: http.StatusOK},
+		{key: "web-secret", path: "/sessions", want: http.StatusOK},
+		{key: "web-secret", path: "/admin", want: http.StatusForbidden},
+		{key: "chat-secret", path: "/ask", want: http.StatusOK},
+		{key: "chat-secret", path: "/sessions", want: http.StatusForbidden},
+		{key: "chat-secret", path: "/models/m:streamGenerateContent", want: http.StatusForbidden},
+		{key: "chat-secret", path: "/chat/completions", body: `{"stream":true}`, want: http.StatusForbidden},
+		{key: "chat-secret", path: "/chat/completions", body: `{"messages":[]}`, want: http.StatusOK},
+		{key: "chat-secret", path: "/generate", body: `{"prompt":"hi"}`, want: http.StatusForbidden},
+		{key: "chat-secret", path: "/generate", body: `{"prompt":"hi","stream":false}`, want: http.StatusOK},
+		{key: "ops-secret", path: "/admin", body: "q", want: http.StatusOK},
+		{key: "ops-secret", path: "/ask", want: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(tt.body))
+		req.Header.Set("Authorization", "Bearer "+tt.key)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Fatalf("%s %s %s: expected %d, got %d: %s", tt.key, tt.path, tt.body, tt.want, rec.Code, rec.Body.String())
+		}
+		if tt.want == http.StatusOK {
+			want := fmt.Sprintf("%s trusted=%t", tt.body, tt.key == "ops-secret")
+			if rec.Body.String() != want {
+				t.Fatalf("%s %s: expected %q, got %q", tt.key, tt.path, want, rec.Body.String())
+			}
+		}
+	}
+}
+
+func TestRequireStreamScopeReadsAtMostTheBodyLimit(t *testing.T) {
+	keys, err := ScopeAPIKeys([]APIKey{{Key: "chat-secret", Label: "chat"}}, map[string][]string{"chat": {ScopeAsk}})
+	if err != nil {
+		t.Fatalf("ScopeAPIKeys: %v", err)
+	}
+	e := echo.New()
+	e.Use(RequireAPIKey(APIKeyAuthConfig{Keys: keys}), IdentifyClient())
+	e.POST("/chat/completions", func(c *echo.Context) error {
+		_, err := io.ReadAll(c.Request().Body)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return c.NoContent(http.StatusRequestEntityTooLarge)
+		}
+		return c.NoContent(http.StatusOK)
+	}, RequireStreamScope(ErrorFormatOpenAI, false, 16))
+
+	for body, want := range map[string]int{
+		`{"stream":false}`:               http.StatusOK,
+		`{"stream":false,"messages":[]}`: http.StatusRequestEntityTooLarge,
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/chat/completions", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer chat-secret")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Fatalf("%s: expected %d, got %d", body, want, rec.Code)
+		}
+	}
+}
+
+func TestScopeAPIKeysRejectsUnknownScopesAndKeys(t *testing.T) {
+	keys := []APIKey{{Key: "web-secret", Label: "web"}}
+	if _, err := ScopeAPIKeys(keys, map[string][]string{"web": {"deploy"}}); err == nil || !strings.Contains(err.Error(), "deploy") {
+		t.Fatalf("expected the unknown scope to be rejected, got %v", err)
+	}
+	if _, err := ScopeAPIKeys(keys, map[string][]string{"mobile": {ScopeAsk}}); err == nil || !strings.Contains(err.Error(), "mobile") {
+		t.Fatalf("expected the unknown key to be rejected, got %v", err)
+	}
+	scoped, err := ScopeAPIKeys(keys, map[string][]string{"web": {}})
+	if err != nil {
+		t.Fatalf("ScopeAPIKeys: %v", err)
+	}
+	if keys[0].Scopes != nil || scoped[0].Allows(ScopeAsk) {
+		t.Fatalf("expected an empty list to allow nothing without changing the keys passed in, got %#v %#v", keys, scoped)
+	}
+}
@@ -0,0 +1,84 @@
+package appmiddleware
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+
+	"gemini-wrapper/service/cluster"
+
+	"github.com/labstack/echo/v5"
+)
+
+// RoutedHeader marks a request one replica forwarded to another, which serves
+// it without forwarding it again.
+const RoutedHeader = "X-Gemini-Wrapper-Routed"
+
+// RouteSessions forwards the requests for /api/sessions/:id to the replica
+// that holds the session. Install it with Echo.Pre: it runs before
+// authentication and the quotas, which the holding replica applies once.
+// Requests are served locally when the session has no other holder or Redis
+// cannot be reached.
+func RouteSessions(shared *cluster.Cluster) echo.MiddlewareFunc {
+	var mu sync.Mutex
+	proxies := map[string]*httputil.ReverseProxy{}
+	proxyFor := func(owner string) (*httputil.ReverseProxy, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if proxy, ok := proxies[owner]; ok {
+			return proxy, nil
+		}
+		target, err := url.Parse(owner)
+		if err != nil {
+			return nil, err
+		}
+		proxy := &httputil.ReverseProxy{
+			Rewrite: func(r *httputil.ProxyRequest) {
+				r.SetURL(target)
+				r.SetXForwarded()
+				r.Out.Header.Set(RoutedHeader, "1")
+			},
+			ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+				slog.Warn("forwarding session request failed", "replica", owner, "path", r.URL.Path, "error", err)
+				w.Header().Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+				w.WriteHeader(http.StatusBadGateway)
+				json.NewEncoder(w).Encode(map[string]string{"error": "The replica holding this session is unreachable"})
+			},
+		}
+		proxies[owner] = proxy
+		return proxy, nil
+	}
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c *echo.Context) error {
+			req := c.Request()
+			rest, ok := strings.CutPrefix(req.URL.Path, "/api/sessions/")
+			if !ok || req.Header.Get(RoutedHeader) != "" {
+				return next(c)
+			}
+			id, _, _ := strings.Cut(rest, "/")
+			if id == "" || id == "import" {
+				return next(c)
+			}
+			owner, err := shared.SessionOwner(req.Context(), id)
+			if err != nil {
+				slog.Warn("looking up session holder failed", "session", id, "error", err)
+				return next(c)
+			}
+			if owner == "" || owner == shared.Self() {
+				return next(c)
+			}
+			proxy, err := proxyFor(owner)
+			if err != nil {
+				slog.Warn("invalid session holder URL", "session", id, "replica", owner, "error", err)
+				return next(c)
+			}
+			proxy.ServeHTTP(c.Response(), req)
+			return nil
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package appmiddleware
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gemini-wrapper/service/cluster"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/labstack/echo/v5"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestRouteSessionsForwardsToTheHoldingReplica(t *testing.T) {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer client.Close()
+
+	newReplica := func(name string) (*cluster.Cluster, *httptest.Server) {
+		e := echo.New()
+		srv := httptest.NewServer(e)
+		cfg := cluster.DefaultConfig()
+		cfg.AdvertiseURL = srv.URL
+		shared := cluster.New(client, cfg)
+		e.Pre(RouteSessions(shared))
+		e.Any("/api/sessions/*", func(c *echo.Context) error {
+			return c.String(http.StatusOK, name+" "+c.Request().Header.Get(RoutedHeader))
+		})
+		return shared, srv
+	}
+	holder, holderServer := newReplica("holder")
+	defer holderServer.Close()
+	_, otherServer := newReplica("other")
+	defer otherServer.Close()
+
+	if err := holder.ClaimSession(context.Background(), "sess_1"); err != nil {
+		t.Fatalf("ClaimSession: %v", err)
+	}
+	get := func(url string) string {
+		t.Helper()
+		resp, err := http.Get(url)
+		if err != nil {
+			t.Fatalf("GET %s: %v", url, err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+	if got := get(otherServer.URL + "/api/sessions/sess_1/history"); got != "holder 1" {
+		t.Fatalf("expected the holder to answer a forwarded request, got %q", got)
+	}
+	if got := get(holderServer.URL + "/api/sessions/sess_1"); got != "holder " {
+		t.Fatalf("expected the holder to answer locally, got %q", got)
+	}
+	if got := get(otherServer.URL + "/api/sessions/unknown"); got != "other " {
+		t.Fatalf("expected an unclaimed session to be served locally, got %q", got)
+	}
+}
@@ -0,0 +1,39 @@
+package appmiddleware
+
+import (
+	"fmt"
+	"net/http"
+
+	"gemini-wrapper/service/tenants"
+
+	"github.com/labstack/echo/v5"
+)
+
+// SelectTenant records the tenant of the API key that authenticated the
+// request, so the rate limit, the service and the handlers apply its
+// profile. Requests with a key of no tenant go on without one. It must run
+// after the API key check.
+func SelectTenant(registry *tenants.Registry) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c *echo.Context) error {
+			if t := registry.ForLabel(APIKeyLabel(c)); t != nil {
+				req := c.Request()
+				c.SetRequest(req.WithContext(tenants.WithTenant(req.Context(), t)))
+			}
+			return next(c)
+		}
+	}
+}
+
+// RequireFeature answers 403 when the tenant of the request may not use
+// feature. Requests without a tenant are let through.
+func RequireFeature(feature string, errorFormat string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c *echo.Context) error {
+			if t := tenants.FromContext(c.Request().Context()); t != nil && !t.Allows(feature) {
+				return writeAuthError(c, errorFormat, http.StatusForbidden, fmt.Sprintf("Tenant %s may not use %s.", t.Name, feature))
+			}
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package appmiddleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gemini-wrapper/service/tenants"
+
+	"github.com/labstack/echo/v5"
+)
+
+func TestRequireFeatureAppliesTheTenantOfTheKey(t *testing.T) {
+	registry, err := tenants.New([]tenants.Tenant{{Name: "search", Features: []string{tenants.FeatureAsk}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := echo.New()
+	e.Use(RequireAPIKey(APIKeyAuthConfig{Keys: []APIKey{
+		{Key: "search-secret", Label: tenants.Label("search", "key-1")},
+		{Key: "ops-secret", Label: "ops"},
+	}}))
+	e.Use(SelectTenant(registry))
+	ok := func(c *echo.Context) error {
+		return c.String(http.StatusOK, tenants.Name(c.Request().Context()))
+	}
+	e.POST("/ask", ok, RequireFeature(tenants.FeatureAsk, ErrorFormatGemini))
+	e.POST("/sessions", ok, RequireFeature(tenants.FeatureSessions, ErrorFormatGemini))
+
+	tests := []struct {
+		key, path string
+		want      int
+		tenant    string
+	}{
+		{key: "search-secret", path: "/ask", want: http.StatusOK, tenant: "search"},
+		{key: "search-secret", path: "/sessions", want: http.StatusForbidden},
+		{key: "ops-secret", path: "/sessions", want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, tt.path, nil)
+		req.Header.Set("Authorization", "Bearer "+tt.key)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Fatalf("%s %s: expected %d, got %d: %s", tt.key, tt.path, tt.want, rec.Code, rec.Body.String())
+		}
+		if tt.want == http.StatusOK && rec.Body.String() != tt.tenant {
+			t.Fatalf("%s %s: expected tenant %q, got %q", tt.key, tt.path, tt.tenant, rec.Body.String())
+		}
+	}
+}
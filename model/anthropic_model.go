@@ -0,0 +1,120 @@
+package model
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// AnthropicMessageRequest is the body of POST /v1/messages in the Anthropic
+// Messages API. POST /v1/messages/count_tokens takes the same body without
+// max_tokens.
+type AnthropicMessageRequest struct {
+	Model         string             `json:"model"`
+	MaxTokens     int                `json:"max_tokens"`
+	Messages      []AnthropicMessage `json:"messages"`
+	System        AnthropicContent   `json:"system,omitempty"`
+	Stream        bool               `json:"stream,omitempty"`
+	Temperature   *float64           `json:"temperature,omitempty"`
+	TopP          *float64           `json:"top_p,omitempty"`
+	TopK          *int               `json:"top_k,omitempty"`
+	StopSequences []string           `json:"stop_sequences,omitempty"`
+	Tools         []json.RawMessage  `json:"tools,omitempty"`
+}
+
+type AnthropicMessage struct {
+	Role    string           `json:"role"`
+	Content AnthropicContent `json:"content"`
+}
+
+// AnthropicContent is the content of a message or the system prompt: a
+// string, read as one text block, or a list of content blocks.
+type AnthropicContent []AnthropicContentBlock
+
+func (c *AnthropicContent) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*c = AnthropicContent{{Type: "text", Text: text}}
+		return nil
+	}
+	var blocks []AnthropicContentBlock
+	if err := json.Unmarshal(data, &blocks); err != nil {
+		return errors.New("content must be a string or a list of content blocks")
+	}
+	*c = blocks
+	return nil
+}
+
+// AnthropicContentBlock is a text, image or document block of a request.
+type AnthropicContentBlock struct {
+	Type   string           `json:"type"`
+	Text   string           `json:"text,omitempty"`
+	Source *AnthropicSource `json:"source,omitempty"`
+}
+
+// AnthropicSource is the content of an image or document block: base64
+// data, a URL, or plain text for documents.
+type AnthropicSource struct {
+	Type      string `json:"type"`
+	MediaType string `json:"media_type,omitempty"`
+	Data      string `json:"data,omitempty"`
+	URL       string `json:"url,omitempty"`
+}
+
+// AnthropicTextBlock is a text block of a response.
+type AnthropicTextBlock struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type AnthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+type AnthropicMessageResponse struct {
+	ID           string               `json:"id"`
+	Type         string               `json:"type"`
+	Role         string               `json:"role"`
+	Model        string               `json:"model"`
+	Content      []AnthropicTextBlock `json:"content"`
+	StopReason   *string              `json:"stop_reason"`
+	StopSequence *string              `json:"stop_sequence"`
+	Usage        AnthropicUsage       `json:"usage"`
+}
+
+type AnthropicCountTokensResponse struct {
+	InputTokens int `json:"input_tokens"`
+}
+
+// AnthropicStreamEvent is an event of a streamed message. Type names the
+// event and decides which of the other fields are set.
+type AnthropicStreamEvent struct {
+	Type         string                    `json:"type"`
+	Message      *AnthropicMessageResponse `json:"message,omitempty"`
+	Index        *int                      `json:"index,omitempty"`
+	ContentBlock *AnthropicTextBlock       `json:"content_block,omitempty"`
+	Delta        *AnthropicDelta           `json:"delta,omitempty"`
+	Usage        *AnthropicUsage           `json:"usage,omitempty"`
+	Error        *AnthropicError           `json:"error,omitempty"`
+}
+
+// AnthropicDelta is the text of a content_block_delta or the stop reason of
+// a message_delta.
+type AnthropicDelta struct {
+	Type         string  `json:"type,omitempty"`
+	Text         string  `json:"text,omitempty"`
+	StopReason   string  `json:"stop_reason,omitempty"`
+	StopSequence *string `json:"stop_sequence,omitempty"`
+}
+
+type AnthropicError struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+// AnthropicErrorResponse is the error envelope of the Anthropic API; Type is
+// always "error".
+type AnthropicErrorResponse struct {
+	Type  string         `json:"type"`
+	Error AnthropicError `json:"error"`
+}
@@ -0,0 +1,26 @@
+package model
+
+import "time"
+
+// Scopes of a GEMINI.md context.
+const (
+	ContextGlobal    = "global"
+	ContextWorkspace = "workspace"
+	ContextSession   = "session"
+)
+
+// ContextFile is a GEMINI.md the CLI reads as persistent instructions. ID
+// names the workspace or session of a scoped context. Content is empty when
+// there is none.
+type ContextFile struct {
+	Scope     string     `json:"scope"`
+	ID        string     `json:"id,omitempty"`
+	Content   string     `json:"content"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+// SetContextRequest is the body of the PUT context endpoints. An empty
+// content removes the context.
+type SetContextRequest struct {
+	Content string `json:"content"`
+}
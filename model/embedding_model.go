@@ -0,0 +1,67 @@
+package model
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// EmbedContentRequest is the body of :embedContent and an entry of
+// :batchEmbedContents in the Gemini API.
+type EmbedContentRequest struct {
+	Model                string        `json:"model,omitempty"`
+	Content              GeminiContent `json:"content"`
+	TaskType             string        `json:"taskType,omitempty"`
+	Title                string        `json:"title,omitempty"`
+	OutputDimensionality int           `json:"outputDimensionality,omitempty"`
+}
+
+type ContentEmbedding struct {
+	Values []float32 `json:"values"`
+}
+
+type EmbedContentResponse struct {
+	Embedding ContentEmbedding `json:"embedding"`
+}
+
+type BatchEmbedContentsRequest struct {
+	Requests []EmbedContentRequest `json:"requests"`
+}
+
+type BatchEmbedContentsResponse struct {
+	Embeddings []ContentEmbedding `json:"embeddings"`
+}
+
+// EmbedRequest is the body of POST /api/embed: one text or several. Input
+// takes them the way Ollama clients send them.
+type EmbedRequest struct {
+	Text       string     `json:"text,omitempty"`
+	Texts      []string   `json:"texts,omitempty"`
+	Input      EmbedInput `json:"input,omitempty"`
+	Model      string     `json:"model,omitempty"`
+	TaskType   string     `json:"task_type,omitempty"`
+	Dimensions int        `json:"dimensions,omitempty"`
+}
+
+// EmbedInput is a string or a list of strings.
+type EmbedInput []string
+
+func (in *EmbedInput) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*in = EmbedInput{text}
+		return nil
+	}
+	var texts []string
+	if err := json.Unmarshal(data, &texts); err != nil {
+		return errors.New("input must be a string or a list of strings")
+	}
+	*in = texts
+	return nil
+}
+
+// EmbedResponse holds one embedding per text, in order.
+type EmbedResponse struct {
+	Model      string      `json:"model,omitempty"`
+	Embeddings [][]float32 `json:"embeddings,omitempty"`
+	Error      string      `json:"error,omitempty"`
+}
@@ -0,0 +1,46 @@
+package model
+
+import "time"
+
+// States and sources of a file of the Files API. Uploads are stored as they
+// arrive, so files are ACTIVE as soon as they exist.
+const (
+	FileStateActive  = "ACTIVE"
+	FileSourceUpload = "UPLOADED"
+)
+
+// GeminiFile is a file uploaded through the Gemini Files API, in its format.
+// Name is "files/<id>"; prompts refer to the file by Name or URI.
+type GeminiFile struct {
+	Name           string    `json:"name"`
+	DisplayName    string    `json:"displayName,omitempty"`
+	MimeType       string    `json:"mimeType"`
+	SizeBytes      int64     `json:"sizeBytes,string"`
+	CreateTime     time.Time `json:"createTime"`
+	UpdateTime     time.Time `json:"updateTime"`
+	ExpirationTime time.Time `json:"expirationTime"`
+	SHA256Hash     string    `json:"sha256Hash"`
+	URI            string    `json:"uri"`
+	State          string    `json:"state"`
+	Source         string    `json:"source"`
+}
+
+// GeminiFileResponse wraps the file an upload created.
+type GeminiFileResponse struct {
+	File GeminiFile `json:"file"`
+}
+
+// GeminiFileListResponse is the answer of GET /v1beta/files.
+type GeminiFileListResponse struct {
+	Files []GeminiFile `json:"files,omitempty"`
+}
+
+// UploadFileRequest is the metadata sent with an upload. Older SDKs spell
+// the display name display_name.
+type UploadFileRequest struct {
+	File struct {
+		DisplayName      string `json:"displayName"`
+		DisplayNameSnake string `json:"display_name"`
+		MimeType         string `json:"mimeType"`
+	} `json:"file"`
+}
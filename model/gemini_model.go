@@ -1,41 +1,510 @@
 package model
 
+import (
+	"encoding/json"
+	"time"
+)
+
 type AskRequest struct {
-	Question string `json:"question" validate:"required"`
+	Question string `json:"question" validate:"required_without=Template"`
 	Model    string `json:"model,omitempty"`
+	Stream   bool   `json:"stream,omitempty"`
+	// TimeoutSeconds overrides the server's request timeout, up to its maximum.
+	TimeoutSeconds int `json:"timeout_seconds,omitempty" validate:"gte=0"`
+	// SkipPostprocess opts out of the server's output filters when allowed.
+	SkipPostprocess bool `json:"skip_postprocess,omitempty"`
+	// Format converts the markdown answer to "plain" text or "html";
+	// "markdown", the default, returns it as the CLI wrote it.
+	Format string `json:"format,omitempty" validate:"omitempty,oneof=markdown plain html"`
+	// ReplyLanguage asks for the answer in this language, by ISO 639-1 code
+	// or English name, or in the question's with "auto".
+	ReplyLanguage string `json:"reply_language,omitempty"`
+	// Artifacts returns the code blocks of the answer as artifacts.
+	Artifacts bool `json:"artifacts,omitempty"`
+	// System holds instructions put before the question, set apart from
+	// it, like the systemInstruction of the Gemini API.
+	System string `json:"system,omitempty"`
+	// Template names a stored prompt template rendered with Variables into
+	// the question. Question is then optional and available as {{.question}}.
+	Template  string         `json:"template,omitempty"`
+	Variables map[string]any `json:"variables,omitempty"`
+	// ApprovalMode ("default", "auto_edit" or "yolo") and Sandbox override
+	// the server's execution policy. Loosening it needs a trusted client.
+	ApprovalMode string `json:"approval_mode,omitempty"`
+	Sandbox      *bool  `json:"sandbox,omitempty"`
+	// Priority ("high", "normal" or "low") decides which waiting request
+	// gets the next free worker.
+	Priority string `json:"priority,omitempty"`
+	// JSONSchema asks for a JSON answer matching this schema.
+	JSONSchema json.RawMessage `json:"json_schema,omitempty"`
+	// Grounding lets the CLI search Google before answering and returns the
+	// URLs it cites; nil keeps the server default.
+	Grounding *bool `json:"grounding,omitempty"`
+	// URLs are web pages fetched by the server and put before the question
+	// as context.
+	URLs []string `json:"urls,omitempty"`
+	// Files are text documents the CLI reads alongside the question, which
+	// refers to them as @files/<name>.
+	Files []AskFile `json:"files,omitempty" validate:"dive"`
+	// MaxOutputChars cuts the answer at this many characters and stops the
+	// CLI there, finishing with MAX_TOKENS; 0 is no limit.
+	MaxOutputChars int `json:"max_output_chars,omitempty" validate:"gte=0"`
+	// StopSequences end the answer before the first of them the model
+	// prints, stopping the CLI there and finishing with STOP.
+	StopSequences []string `json:"stop_sequences,omitempty" validate:"max=5"`
+	// DryRun returns the DryRunResponse of the question instead of asking
+	// it.
+	DryRun bool `json:"dry_run,omitempty"`
+}
+
+// AskFile is a text document attached to a question.
+type AskFile struct {
+	Name    string `json:"name" validate:"required"`
+	Content string `json:"content"`
 }
 
 type AskResponse struct {
-	Answer string        `json:"answer"`
-	Error  string        `json:"error,omitempty"`
-	Status *GeminiStatus `json:"status,omitempty"`
+	Answer string `json:"answer"`
+	Error  string `json:"error,omitempty"`
+	// Code says why the question failed, as one of the Reason constants.
+	Code   string         `json:"code,omitempty"`
+	Usage  *UsageMetadata `json:"usage,omitempty"`
+	Status *GeminiStatus  `json:"status,omitempty"`
+	// ToolEvents lists the tools the CLI called while answering.
+	ToolEvents []ToolEvent `json:"toolEvents,omitempty"`
+	// Citations are the URLs a grounded answer cites.
+	Citations []string `json:"citations,omitempty"`
+	// Artifacts are the code blocks of the answer, when artifacts asked
+	// for them.
+	Artifacts []Artifact `json:"artifacts,omitempty"`
+}
+
+// Artifact is a fenced code block of an answer. Filename is set when the
+// answer names the file the code belongs in.
+type Artifact struct {
+	Filename string `json:"filename,omitempty"`
+	Language string `json:"language,omitempty"`
+	Content  string `json:"content"`
+}
+
+// DryRunResponse is what the server would send to Gemini for a question,
+// returned by asks with dry_run instead of an answer.
+type DryRunResponse struct {
+	// Prompt is the final prompt: the rendered template, the fetched pages
+	// and the instructions the server adds for JSON schemas and grounding.
+	Prompt string `json:"prompt"`
+	// Model is the model asked first, "" for the CLI's default, and
+	// FallbackModels are tried after it.
+	Model                 string   `json:"model"`
+	FallbackModels        []string `json:"fallbackModels,omitempty"`
+	EstimatedPromptTokens int      `json:"estimatedPromptTokens"`
+	ApprovalMode          string   `json:"approvalMode"`
+	Sandbox               bool     `json:"sandbox"`
+	Priority              string   `json:"priority"`
+	Grounding             bool     `json:"grounding"`
+	// ReplyLanguage is the code of the language the answer is asked in; ""
+	// when the request set none or the question's was not recognized.
+	ReplyLanguage string `json:"replyLanguage,omitempty"`
+	// Files are the names of the attached files.
+	Files []string `json:"files,omitempty"`
+}
+
+// ToolEvent sums up the calls the CLI made to one tool, such as
+// run_shell_command, read_file or google_web_search, while answering.
+type ToolEvent struct {
+	Name       string `json:"name"`
+	Calls      int    `json:"calls"`
+	Succeeded  int    `json:"succeeded"`
+	Failed     int    `json:"failed"`
+	DurationMs int64  `json:"durationMs,omitempty"`
+}
+
+// BatchAskRequest is the body of /api/ask/batch. Each item is answered like
+// a non-streaming /api/ask request.
+type BatchAskRequest struct {
+	Questions []AskRequest `json:"questions"`
+}
+
+// BatchAskResponse holds one result per question, in request order.
+type BatchAskResponse struct {
+	Results []AskResponse `json:"results"`
+}
+
+// AskStreamChunk is the payload of each "chunk" event on a streamed /api/ask.
+type AskStreamChunk struct {
+	Text string `json:"text"`
+}
+
+// Phases of a streamed answer reported by StreamProgress.
+const (
+	// ProgressWaiting is before the CLI starts, such as in the queue.
+	ProgressWaiting = "waiting"
+	// ProgressThinking is while the CLI works without printing.
+	ProgressThinking = "thinking"
+	// ProgressTool is while the CLI runs the tool named in StreamProgress.
+	ProgressTool = "tool"
+	// ProgressAnswering is once part of the answer was sent.
+	ProgressAnswering = "answering"
+)
+
+// StreamProgress is the payload of the "progress" heartbeats of a streamed
+// answer. Tokens is an estimate of the answer sent so far.
+type StreamProgress struct {
+	Phase          string  `json:"phase"`
+	ElapsedSeconds float64 `json:"elapsed_seconds"`
+	Tool           string  `json:"tool,omitempty"`
+	Tokens         int     `json:"tokens"`
+}
+
+// GeminiPart holds text, media or, with tools, a function call of the model
+// or the caller's response to it.
+type GeminiPart struct {
+	Text             string            `json:"text,omitempty"`
+	InlineData       *Blob             `json:"inlineData,omitempty"`
+	FileData         *FileData         `json:"fileData,omitempty"`
+	FunctionCall     *FunctionCall     `json:"functionCall,omitempty"`
+	FunctionResponse *FunctionResponse `json:"functionResponse,omitempty"`
+	// Thought marks a part holding the model's reasoning, not its answer.
+	Thought bool `json:"thought,omitempty"`
+}
+
+// Blob is media sent inline, base64-encoded.
+type Blob struct {
+	MimeType string `json:"mimeType"`
+	Data     string `json:"data"`
+}
+
+// FileData refers to media by URI.
+type FileData struct {
+	MimeType string `json:"mimeType,omitempty"`
+	FileURI  string `json:"fileUri"`
+}
+
+// FunctionCall is a call the model asks the caller to make.
+type FunctionCall struct {
+	ID   string         `json:"id,omitempty"`
+	Name string         `json:"name"`
+	Args map[string]any `json:"args,omitempty"`
+}
+
+// FunctionResponse carries the result of a FunctionCall back to the model.
+type FunctionResponse struct {
+	ID       string         `json:"id,omitempty"`
+	Name     string         `json:"name"`
+	Response map[string]any `json:"response"`
+}
+
+// FunctionDeclaration describes a function the model may call. Parameters is
+// an OpenAPI schema and ParametersJSONSchema a JSON Schema; at most one is set.
+type FunctionDeclaration struct {
+	Name                 string         `json:"name"`
+	Description          string         `json:"description,omitempty"`
+	Parameters           map[string]any `json:"parameters,omitempty"`
+	ParametersJSONSchema map[string]any `json:"parametersJsonSchema,omitempty"`
+}
+
+// Tool mirrors the tools entries of the Gemini API. Only function
+// declarations are supported; GoogleSearch is sent by the API fallback for
+// grounded questions.
+type Tool struct {
+	FunctionDeclarations []FunctionDeclaration `json:"functionDeclarations,omitempty"`
+	GoogleSearch         *GoogleSearch         `json:"googleSearch,omitempty"`
+}
+
+// GoogleSearch is the Google Search grounding tool of the Gemini API.
+type GoogleSearch struct{}
+
+// ToolConfig mirrors the toolConfig object of the Gemini API.
+type ToolConfig struct {
+	FunctionCallingConfig *FunctionCallingConfig `json:"functionCallingConfig,omitempty"`
+}
+
+// FunctionCallingConfig selects whether the model may (AUTO), must (ANY) or
+// must not (NONE) call functions.
+type FunctionCallingConfig struct {
+	Mode                 string   `json:"mode,omitempty"`
+	AllowedFunctionNames []string `json:"allowedFunctionNames,omitempty"`
+}
+
+type GeminiContent struct {
+	Role  string       `json:"role,omitempty"`
+	Parts []GeminiPart `json:"parts"`
+}
+
+type GeminiCandidate struct {
+	// Index tells the candidates of a candidateCount request apart.
+	Index         int            `json:"index,omitempty"`
+	Content       GeminiContent  `json:"content"`
+	FinishReason  string         `json:"finishReason,omitempty"`
+	SafetyRatings []SafetyRating `json:"safetyRatings,omitempty"`
+}
+
+// GenerationConfig mirrors the generationConfig object of the Gemini API.
+type GenerationConfig struct {
+	Temperature     *float64 `json:"temperature,omitempty"`
+	TopP            *float64 `json:"topP,omitempty"`
+	TopK            *int     `json:"topK,omitempty"`
+	MaxOutputTokens int      `json:"maxOutputTokens,omitempty"`
+	StopSequences   []string `json:"stopSequences,omitempty"`
+	// CandidateCount asks for this many alternative answers, generated in
+	// parallel by the wrapper.
+	CandidateCount int             `json:"candidateCount,omitempty"`
+	ThinkingConfig *ThinkingConfig `json:"thinkingConfig,omitempty"`
+	// ResponseMimeType "application/json" asks for a JSON answer, which must
+	// match ResponseSchema when one is set.
+	ResponseMimeType string          `json:"responseMimeType,omitempty"`
+	ResponseSchema   json.RawMessage `json:"responseSchema,omitempty"`
+}
+
+// ThinkingConfig mirrors the thinkingConfig of the Gemini API: a token
+// budget for Gemini 2.5 (-1 lets the model decide, 0 turns thinking off) or
+// a level for Gemini 3, and whether to return the model's thoughts.
+type ThinkingConfig struct {
+	ThinkingBudget  *int   `json:"thinkingBudget,omitempty"`
+	ThinkingLevel   string `json:"thinkingLevel,omitempty"`
+	IncludeThoughts bool   `json:"includeThoughts,omitempty"`
+}
+
+// SafetySetting is a Gemini API block threshold for one harm category.
+type SafetySetting struct {
+	Category  string `json:"category"`
+	Threshold string `json:"threshold"`
+}
+
+// SafetyRating is the Gemini API rating of a candidate for one harm category.
+type SafetyRating struct {
+	Category    string `json:"category"`
+	Probability string `json:"probability"`
+	Blocked     bool   `json:"blocked,omitempty"`
 }
 
 type GeminiAPIRequest struct {
-	Contents []struct {
-		Parts []struct {
-			Text string `json:"text"`
-		} `json:"parts"`
-	} `json:"contents"`
+	Contents          []GeminiContent   `json:"contents" validate:"required"`
+	SystemInstruction *GeminiContent    `json:"systemInstruction,omitempty"`
+	GenerationConfig  *GenerationConfig `json:"generationConfig,omitempty"`
+	SafetySettings    []SafetySetting   `json:"safetySettings,omitempty"`
+	Tools             []Tool            `json:"tools,omitempty"`
+	ToolConfig        *ToolConfig       `json:"toolConfig,omitempty"`
 }
 
 type GeminiAPIResponse struct {
-	Model      string `json:"model"`
-	Candidates []struct {
-		Content struct {
-			Parts []struct {
-				Text string `json:"text"`
-			} `json:"parts"`
-		} `json:"content"`
-	} `json:"candidates"`
-	Status *GeminiStatus `json:"status,omitempty"`
+	Model         string            `json:"model"`
+	Candidates    []GeminiCandidate `json:"candidates"`
+	UsageMetadata *UsageMetadata    `json:"usageMetadata,omitempty"`
+	Status        *GeminiStatus     `json:"status,omitempty"`
+}
+
+// UsageMetadata mirrors the Gemini API usageMetadata object, filled from the CLI stats block.
+type UsageMetadata struct {
+	PromptTokenCount        int `json:"promptTokenCount"`
+	CandidatesTokenCount    int `json:"candidatesTokenCount"`
+	TotalTokenCount         int `json:"totalTokenCount"`
+	CachedContentTokenCount int `json:"cachedContentTokenCount,omitempty"`
+	ThoughtsTokenCount      int `json:"thoughtsTokenCount,omitempty"`
+	ToolUsePromptTokenCount int `json:"toolUsePromptTokenCount,omitempty"`
+}
+
+// GeminiCountTokensRequest accepts either bare contents or a full generateContentRequest.
+type GeminiCountTokensRequest struct {
+	Contents               []GeminiContent   `json:"contents,omitempty"`
+	SystemInstruction      *GeminiContent    `json:"systemInstruction,omitempty"`
+	GenerateContentRequest *GeminiAPIRequest `json:"generateContentRequest,omitempty"`
+}
+
+type GeminiCountTokensResponse struct {
+	TotalTokens int `json:"totalTokens"`
+}
+
+// GeminiModelInfo matches a Model resource of the Gemini API.
+type GeminiModelInfo struct {
+	Name                       string   `json:"name"`
+	BaseModelID                string   `json:"baseModelId"`
+	Version                    string   `json:"version"`
+	DisplayName                string   `json:"displayName"`
+	Description                string   `json:"description,omitempty"`
+	InputTokenLimit            int      `json:"inputTokenLimit,omitempty"`
+	OutputTokenLimit           int      `json:"outputTokenLimit,omitempty"`
+	SupportedGenerationMethods []string `json:"supportedGenerationMethods"`
+}
+
+type GeminiModelListResponse struct {
+	Models []GeminiModelInfo `json:"models"`
+}
+
+// GeminiErrorResponse matches the Google API error envelope.
+type GeminiErrorResponse struct {
+	Error GeminiError `json:"error"`
+}
+
+type GeminiError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Status  string `json:"status,omitempty"`
 }
 
 // For Gemini Service internal use
 
+// GeminiStatus describes how a question was answered. Every answer of
+// /api/ask, sessions, jobs and workspaces carries one, and failures too;
+// fields are only added to it, never renamed or removed.
 type GeminiStatus struct {
-	HTTPStatus int    `json:"httpStatus"`
-	Code       string `json:"code,omitempty"`
-	Message    string `json:"message,omitempty"`
-	Model      string `json:"model,omitempty"`
+	HTTPStatus   int            `json:"httpStatus"`
+	Code         string         `json:"code,omitempty"`
+	Message      string         `json:"message,omitempty"`
+	Model        string         `json:"model,omitempty"`
+	FinishReason string         `json:"finishReason,omitempty"`
+	Usage        *UsageMetadata `json:"usage,omitempty"`
+	// Thoughts is the reasoning the model wrote before its answer, when
+	// includeThoughts asked for it.
+	Thoughts string `json:"thoughts,omitempty"`
+	// Retries counts transparent retries after transient upstream errors.
+	Retries int `json:"retries,omitempty"`
+	// Backend names what answered: the CLI ("headless"), the Gemini API
+	// fallback ("api") or "mock".
+	Backend string `json:"backend,omitempty"`
+	// KeyBucket names the key of the API key pool the CLI answered with,
+	// like "key-2". The key itself is never reported.
+	KeyBucket string `json:"keyBucket,omitempty"`
+	// SessionID is the session the question was asked in.
+	SessionID string `json:"sessionId,omitempty"`
+	// QueueWaitMs is how long the attempt waited for its turn with the
+	// request pacer and for a free worker before the CLI started.
+	QueueWaitMs int64 `json:"queueWaitMs,omitempty"`
+	// GenerationMs is how long the backend took for the attempt that
+	// answered, from start to its last output.
+	GenerationMs int64 `json:"generationMs,omitempty"`
+	// Cached is set when the answer came from the response cache; the
+	// timings are then 0.
+	Cached bool `json:"cached,omitempty"`
+	// Coalesced is set when the answer was generated for an identical
+	// question that was pending when this one was asked, and shared.
+	Coalesced bool `json:"coalesced,omitempty"`
+	// Degraded lists the Degraded constants of the ways the answer fell
+	// short of what was asked for.
+	Degraded []string `json:"degraded,omitempty"`
+	// Repairs counts the times a JSON answer that did not match its schema
+	// was asked again.
+	Repairs int `json:"repairs,omitempty"`
+	// Reason is set on failures to one of the Reason constants.
+	Reason string `json:"reason,omitempty"`
+	// ToolEvents lists the tools the CLI called, by name.
+	ToolEvents []ToolEvent `json:"toolEvents,omitempty"`
+	// Citations are the URLs a grounded answer cites.
+	Citations []string `json:"citations,omitempty"`
+	// Artifacts are the code blocks of the answer, when asked for. They are
+	// returned next to the answer rather than in the status.
+	Artifacts []Artifact `json:"-"`
+}
+
+// Reasons a question failed, reported as "code" in error bodies and as the
+// reason of the status.
+const (
+	ReasonQuotaExceeded         = "quota_exceeded"
+	ReasonModelOverloaded       = "model_overloaded"
+	ReasonAuthExpired           = "auth_expired"
+	ReasonAuthFailed            = "authentication_failed"
+	ReasonSafetyBlocked         = "safety_blocked"
+	ReasonContextLengthExceeded = "context_length_exceeded"
+	ReasonModelNotFound         = "model_not_found"
+	ReasonModelNotAllowed       = "model_not_allowed"
+	ReasonInvalidRequest        = "invalid_request"
+	ReasonInvalidJSONOutput     = "invalid_json_output"
+	ReasonTimeout               = "timeout"
+	ReasonQueueFull             = "queue_full"
+	ReasonUnavailable           = "unavailable"
+	ReasonBackendStarting       = "backend_starting"
+	ReasonCancelled             = "cancelled"
+	ReasonUpstreamError         = "upstream_error"
+	ReasonInternalError         = "internal_error"
+)
+
+// Ways an answer was degraded, reported in the degraded list of the status.
+const (
+	// DegradedFallbackModel: a fallback model answered instead of the one
+	// asked for.
+	DegradedFallbackModel = "fallback_model"
+	// DegradedAPIFallback: the Gemini API answered because the CLI could not.
+	DegradedAPIFallback = "api_fallback"
+	// DegradedKeyFailover: another key of the API key pool answered after
+	// the first ran out of quota.
+	DegradedKeyFailover = "key_failover"
+	// DegradedReplyLanguage: the answer is not in the requested language and
+	// asking again failed.
+	DegradedReplyLanguage = "reply_language"
+)
+
+// Attachment is a file handed to the CLI with a prompt. Name is a relative,
+// slash-separated path. The content is Data, or the file at Path when set.
+type Attachment struct {
+	Name     string
+	MimeType string
+	Data     []byte
+	Path     string
+}
+
+// AskOptions carries per-request settings for the Gemini service.
+type AskOptions struct {
+	Model            string
+	GenerationConfig *GenerationConfig
+	SafetySettings   []SafetySetting
+	// Timeout overrides the server's request timeout when positive.
+	Timeout time.Duration
+	// SkipPostprocess returns the answer without the configured output
+	// filters, when the server allows opting out.
+	SkipPostprocess bool
+	// Format converts the answer from markdown after the filters ran; ""
+	// and "markdown" keep it.
+	Format string
+	// ReplyLanguage is the language the answer is asked in: a code or name
+	// known to the language package, "auto" for the question's, or "" for
+	// any.
+	ReplyLanguage string
+	// ApprovalMode and Sandbox ask for an execution policy other than the
+	// server's; "" and nil keep it.
+	ApprovalMode string
+	Sandbox      *bool
+	// Context is a GEMINI.md with instructions for this request only, read
+	// on top of the global one. It is ignored when WorkDir is set.
+	Context string
+	// Attachments are written into the directory the CLI runs in, where the
+	// prompt refers to them as @<Name>. They are ignored when WorkDir is set.
+	Attachments []Attachment
+	// WorkDir runs the CLI in this directory instead of a throwaway one, so
+	// it can read and edit the files there. Such answers depend on the
+	// files and are neither cached nor shared between identical requests.
+	WorkDir string
+	// Priority is the class of the request in the worker queue; "" uses the
+	// client's default.
+	Priority string
+	// Grounding enables the CLI's Google Search tool; nil uses the server's
+	// default.
+	Grounding *bool
+	// MaxOutputChars caps the answer in characters, on top of the
+	// maxOutputTokens of GenerationConfig; 0 is no limit.
+	MaxOutputChars int
+	// Candidate numbers the alternative answers of one request, so each is
+	// generated and cached on its own; 0 is the first.
+	Candidate int
+	// Env sets environment variables of the CLI process that answers, on
+	// top of the server's, for example another GEMINI_API_KEY. Only the CLI
+	// sees them, so such questions never fall back to the Gemini API.
+	Env map[string]string
+	// NoCache always runs the question, neither reading nor storing a
+	// cached answer.
+	NoCache bool
+	// SessionID is reported in the status of questions asked in a session.
+	SessionID string
+	// System holds instructions the service puts before the question. The
+	// CLI answers such questions in an empty directory of their own.
+	System string
+	// Artifacts parses the code blocks out of the answer into the status.
+	Artifacts bool
 }
+
+// Priority classes of a request. Waiting requests of a higher class get a
+// free worker first; within a class the oldest goes first.
+const (
+	PriorityHigh   = "high"
+	PriorityNormal = "normal"
+	PriorityLow    = "low"
+)
@@ -0,0 +1,65 @@
+package model
+
+import "time"
+
+// Job states reported by /api/jobs.
+const (
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+	JobCancelled = "cancelled"
+	// JobDeadLetter is a job given up after its last attempt failed with an
+	// error that retrying might have fixed, or was interrupted by a restart.
+	JobDeadLetter = "dead_letter"
+)
+
+// Callback delivery states.
+const (
+	CallbackPending   = "pending"
+	CallbackDelivered = "delivered"
+	CallbackFailed    = "failed"
+	CallbackSkipped   = "skipped"
+)
+
+// JobCallback reports the delivery of a job to its callback_url.
+type JobCallback struct {
+	URL       string `json:"url"`
+	State     string `json:"state"`
+	Attempts  int    `json:"attempts"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+// CreateJobRequest is the body of POST /api/jobs: an /api/ask request plus an
+// optional URL that receives the finished job.
+type CreateJobRequest struct {
+	AskRequest
+	CallbackURL string `json:"callback_url,omitempty"`
+}
+
+// JobInfo is the state of an asynchronous question. Answer, Usage and Error
+// are set once the job has finished.
+type JobInfo struct {
+	ID         string     `json:"id"`
+	State      string     `json:"state"`
+	Model      string     `json:"model,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	// Attempts counts the runs started for the job, including runs cut short
+	// by a restart.
+	Attempts  int            `json:"attempts,omitempty"`
+	Answer    string         `json:"answer,omitempty"`
+	Error     string         `json:"error,omitempty"`
+	ErrorCode string         `json:"error_code,omitempty"`
+	Usage     *UsageMetadata `json:"usage,omitempty"`
+	Status    *GeminiStatus  `json:"status,omitempty"`
+	Callback  *JobCallback   `json:"callback,omitempty"`
+}
+
+// Snapshot returns a copy of info that shares no mutable state with it.
+func (info JobInfo) Snapshot() JobInfo {
+	if info.Callback != nil {
+		callback := *info.Callback
+		info.Callback = &callback
+	}
+	return info
+}
@@ -0,0 +1,101 @@
+package model
+
+import "encoding/json"
+
+// OllamaOptions are the generation options of an Ollama request. Options
+// that only tune a local runtime, such as num_ctx, are ignored.
+type OllamaOptions struct {
+	Temperature *float64 `json:"temperature,omitempty"`
+	TopP        *float64 `json:"top_p,omitempty"`
+	TopK        *int     `json:"top_k,omitempty"`
+	NumPredict  int      `json:"num_predict,omitempty"`
+	Stop        []string `json:"stop,omitempty"`
+}
+
+// OllamaGenerateRequest is the body of POST /api/generate. Images are base64
+// encoded. Stream defaults to true, as in Ollama.
+type OllamaGenerateRequest struct {
+	Model   string          `json:"model"`
+	Prompt  string          `json:"prompt"`
+	System  string          `json:"system,omitempty"`
+	Images  []string        `json:"images,omitempty"`
+	Format  json.RawMessage `json:"format,omitempty"`
+	Options *OllamaOptions  `json:"options,omitempty"`
+	Stream  *bool           `json:"stream,omitempty"`
+}
+
+// OllamaChatRequest is the body of POST /api/chat. Stream defaults to true,
+// as in Ollama.
+type OllamaChatRequest struct {
+	Model    string              `json:"model"`
+	Messages []OllamaChatMessage `json:"messages"`
+	Format   json.RawMessage     `json:"format,omitempty"`
+	Options  *OllamaOptions      `json:"options,omitempty"`
+	Stream   *bool               `json:"stream,omitempty"`
+	Tools    []json.RawMessage   `json:"tools,omitempty"`
+}
+
+type OllamaChatMessage struct {
+	Role    string   `json:"role"`
+	Content string   `json:"content"`
+	Images  []string `json:"images,omitempty"`
+}
+
+// OllamaMetrics are the counts and durations Ollama reports with the final
+// response. Durations are in nanoseconds.
+type OllamaMetrics struct {
+	TotalDuration      int64 `json:"total_duration,omitempty"`
+	LoadDuration       int64 `json:"load_duration,omitempty"`
+	PromptEvalCount    int   `json:"prompt_eval_count,omitempty"`
+	PromptEvalDuration int64 `json:"prompt_eval_duration,omitempty"`
+	EvalCount          int   `json:"eval_count,omitempty"`
+	EvalDuration       int64 `json:"eval_duration,omitempty"`
+}
+
+// OllamaGenerateResponse is a response of /api/generate, or one line of its
+// stream. Only the last one is Done and carries the metrics.
+type OllamaGenerateResponse struct {
+	Model      string `json:"model"`
+	CreatedAt  string `json:"created_at"`
+	Response   string `json:"response"`
+	Done       bool   `json:"done"`
+	DoneReason string `json:"done_reason,omitempty"`
+	OllamaMetrics
+}
+
+// OllamaChatResponse is a response of /api/chat, or one line of its stream.
+// Only the last one is Done and carries the metrics.
+type OllamaChatResponse struct {
+	Model      string            `json:"model"`
+	CreatedAt  string            `json:"created_at"`
+	Message    OllamaChatMessage `json:"message"`
+	Done       bool              `json:"done"`
+	DoneReason string            `json:"done_reason,omitempty"`
+	OllamaMetrics
+}
+
+// OllamaModel is an entry of GET /api/tags.
+type OllamaModel struct {
+	Name       string             `json:"name"`
+	Model      string             `json:"model"`
+	ModifiedAt string             `json:"modified_at"`
+	Size       int64              `json:"size"`
+	Digest     string             `json:"digest"`
+	Details    OllamaModelDetails `json:"details"`
+}
+
+type OllamaModelDetails struct {
+	Format            string   `json:"format"`
+	Family            string   `json:"family"`
+	Families          []string `json:"families"`
+	ParameterSize     string   `json:"parameter_size"`
+	QuantizationLevel string   `json:"quantization_level"`
+}
+
+type OllamaTagsResponse struct {
+	Models []OllamaModel `json:"models"`
+}
+
+type OllamaErrorResponse struct {
+	Error string `json:"error"`
+}
@@ -63,6 +63,26 @@ type OpenAIChatCompletionResponse struct {
 	Usage   OpenAIUsage                  `json:"usage"`
 }
 
+// OpenAIChatCompletionChunk is a single streamed chat.completion.chunk event.
+type OpenAIChatCompletionChunk struct {
+	ID      string                            `json:"id"`
+	Object  string                            `json:"object"`
+	Created int64                             `json:"created"`
+	Model   string                            `json:"model"`
+	Choices []OpenAIChatCompletionChunkChoice `json:"choices"`
+}
+
+type OpenAIChatCompletionChunkChoice struct {
+	Index        int                    `json:"index"`
+	Delta        OpenAIChatMessageDelta `json:"delta"`
+	FinishReason *string                `json:"finish_reason"`
+}
+
+type OpenAIChatMessageDelta struct {
+	Role    string `json:"role,omitempty"`
+	Content string `json:"content,omitempty"`
+}
+
 type OpenAICompletionRequest struct {
 	Model       string      `json:"model"`
 	Prompt      interface{} `json:"prompt"`
@@ -0,0 +1,94 @@
+package model
+
+import "time"
+
+type SessionMessage struct {
+	Role      string    `json:"role"`
+	Content   string    `json:"content"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type CreateSessionRequest struct {
+	Model  string `json:"model,omitempty"`
+	System string `json:"system,omitempty"`
+	// Context is a GEMINI.md the CLI reads on every question of the session.
+	Context string `json:"context,omitempty"`
+	// Env sets environment variables of the CLI for the questions of the
+	// session, such as its own GEMINI_API_KEY. Only the names the server
+	// allows are accepted.
+	Env map[string]string `json:"env,omitempty"`
+	// Tenant owns the session. It is set by the server from the API key.
+	Tenant string `json:"-"`
+}
+
+type SessionInfo struct {
+	ID      string `json:"id"`
+	Tenant  string `json:"tenant,omitempty"`
+	Model   string `json:"model,omitempty"`
+	System  string `json:"system,omitempty"`
+	Context string `json:"context,omitempty"`
+	// Env names the environment variables the session sets; their values
+	// are never returned.
+	Env          []string  `json:"env,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+	MessageCount int       `json:"message_count"`
+	// Recycles counts the times the history was cleared because the session
+	// reached its turn limit or was idle too long.
+	Recycles int `json:"recycles,omitempty"`
+	// Compressions counts the times the history was replaced by a summary.
+	Compressions int `json:"compressions,omitempty"`
+}
+
+// SessionTranscript is the full history of a session, as returned by
+// GET /api/sessions/:id/history and accepted by POST /api/sessions/import.
+type SessionTranscript struct {
+	SessionInfo
+	Messages []SessionMessage `json:"messages"`
+}
+
+type SessionListResponse struct {
+	Sessions []SessionInfo `json:"sessions"`
+}
+
+type SessionAskResponse struct {
+	SessionID string        `json:"session_id"`
+	Answer    string        `json:"answer"`
+	Error     string        `json:"error,omitempty"`
+	Code      string        `json:"code,omitempty"`
+	Status    *GeminiStatus `json:"status,omitempty"`
+}
+
+// SessionCommandRequest is the body of POST /admin/command.
+type SessionCommandRequest struct {
+	SessionID string `json:"session_id,omitempty"`
+	// Command is a CLI slash command, like "/stats".
+	Command string `json:"command"`
+}
+
+// SessionCommandResponse is the answer of POST /admin/command. Report is
+// what the wrapper knows about the subject of the command, not the CLI's
+// output; its fields depend on the command. Source says who built it,
+// always "wrapper" for now.
+type SessionCommandResponse struct {
+	SessionID string `json:"session_id,omitempty"`
+	Command   string `json:"command"`
+	Source    string `json:"source"`
+	Report    any    `json:"report"`
+}
+
+// SessionCompressResponse is the body of POST /api/sessions/:id/compress.
+// Token counts are estimates of the history replayed with every question.
+type SessionCompressResponse struct {
+	SessionID string `json:"session_id"`
+	// Compressed is false when the history was left as it was, because it
+	// was empty or its summary was not shorter.
+	Compressed     bool          `json:"compressed"`
+	TokensBefore   int           `json:"tokens_before"`
+	TokensAfter    int           `json:"tokens_after"`
+	MessagesBefore int           `json:"messages_before"`
+	MessagesAfter  int           `json:"messages_after"`
+	Error          string        `json:"error,omitempty"`
+	Code           string        `json:"code,omitempty"`
+	Status         *GeminiStatus `json:"status,omitempty"`
+}
@@ -0,0 +1,18 @@
+package model
+
+import "time"
+
+// PromptTemplate is a Go text/template stored under /api/templates. Asks that
+// name it send variables instead of a question and get the rendered prompt
+// answered.
+type PromptTemplate struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	Template    string    `json:"template"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+type TemplateListResponse struct {
+	Templates []PromptTemplate `json:"templates"`
+}
@@ -0,0 +1,49 @@
+package model
+
+import "time"
+
+// Workspace file states, relative to the files as they were uploaded.
+const (
+	FileUnchanged = "unchanged"
+	FileAdded     = "added"
+	FileModified  = "modified"
+	FileDeleted   = "deleted"
+)
+
+// WorkspaceFile is a file of a workspace. Deleted files are listed with the
+// size they were uploaded with.
+type WorkspaceFile struct {
+	Path       string    `json:"path"`
+	Size       int64     `json:"size"`
+	ModifiedAt time.Time `json:"modified_at"`
+	State      string    `json:"state"`
+}
+
+// WorkspaceInfo is a working directory the CLI runs prompts in. Bytes is the
+// size of its current files.
+type WorkspaceInfo struct {
+	ID         string          `json:"id"`
+	CreatedAt  time.Time       `json:"created_at"`
+	LastUsedAt time.Time       `json:"last_used_at"`
+	Running    bool            `json:"running"`
+	Bytes      int64           `json:"bytes"`
+	Files      []WorkspaceFile `json:"files,omitempty"`
+}
+
+type WorkspaceListResponse struct {
+	Workspaces []WorkspaceInfo `json:"workspaces"`
+}
+
+// WorkspaceAskResponse is the answer of a prompt run in a workspace and the
+// files that differ from the uploaded ones afterwards.
+type WorkspaceAskResponse struct {
+	WorkspaceID string          `json:"workspace_id"`
+	Answer      string          `json:"answer"`
+	Error       string          `json:"error,omitempty"`
+	Code        string          `json:"code,omitempty"`
+	Usage       *UsageMetadata  `json:"usage,omitempty"`
+	Status      *GeminiStatus   `json:"status,omitempty"`
+	Changes     []WorkspaceFile `json:"changes,omitempty"`
+	ToolEvents  []ToolEvent     `json:"toolEvents,omitempty"`
+	Citations   []string        `json:"citations,omitempty"`
+}
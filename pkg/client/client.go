@@ -0,0 +1,266 @@
+// Package client is a Go client for the wrapper's own API: /api/ask, its
+// streaming variant, sessions and jobs. It retries overloaded and rate
+// limited requests, sending an Idempotency-Key with each POST so a retry
+// never answers a question twice:
+//
+//	c := client.New(client.Config{BaseURL: "http://localhost:8080", APIKey: key})
+//	resp, err := c.Ask(ctx, model.AskRequest{Question: "What is 2+2?"})
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gemini-wrapper/model"
+)
+
+const (
+	defaultMaxRetries   = 3
+	defaultRetryBackoff = 500 * time.Millisecond
+	// maxRetryAfter caps how long a Retry-After header makes the client wait.
+	maxRetryAfter = time.Minute
+	// maxErrorBody bounds how much of an error response is read.
+	maxErrorBody = 64 << 10
+)
+
+// Config configures a Client. Only BaseURL is required.
+type Config struct {
+	// BaseURL is the address of the wrapper, like "http://localhost:8080".
+	BaseURL string
+	// APIKey is sent as a bearer token when set.
+	APIKey string
+	// HTTPClient sends the requests. It defaults to a client without a
+	// timeout, since answers and streams can take minutes; bound calls with
+	// their context instead.
+	HTTPClient *http.Client
+	// MaxRetries is how many times a request is retried after a network
+	// error or a 429, 502, 503 or 504. Zero means the default of 3; a
+	// negative value disables retries.
+	MaxRetries int
+	// RetryBackoff is the wait before the first retry. It doubles on each
+	// retry unless the response carries Retry-After.
+	RetryBackoff time.Duration
+}
+
+// Client calls the wrapper API. It is safe for concurrent use.
+type Client struct {
+	baseURL    string
+	apiKey     string
+	httpClient *http.Client
+	maxRetries int
+	backoff    time.Duration
+}
+
+// New returns a client for cfg.
+func New(cfg Config) *Client {
+	c := &Client{
+		baseURL:    strings.TrimRight(cfg.BaseURL, "/"),
+		apiKey:     cfg.APIKey,
+		httpClient: cfg.HTTPClient,
+		maxRetries: cfg.MaxRetries,
+		backoff:    cfg.RetryBackoff,
+	}
+	if c.httpClient == nil {
+		c.httpClient = &http.Client{}
+	}
+	if c.maxRetries == 0 {
+		c.maxRetries = defaultMaxRetries
+	}
+	if c.maxRetries < 0 {
+		c.maxRetries = 0
+	}
+	if c.backoff <= 0 {
+		c.backoff = defaultRetryBackoff
+	}
+	return c
+}
+
+// APIError is a response of the wrapper with a non-2xx status.
+type APIError struct {
+	StatusCode int
+	Message    string
+	// Code says why a question failed, as one of the model.Reason
+	// constants, when the wrapper reported it.
+	Code string
+	// Status is the upstream status the wrapper reported with the error, if
+	// any.
+	Status *model.GeminiStatus
+}
+
+func (e *APIError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("gemini-wrapper: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("gemini-wrapper: %d %s", e.StatusCode, e.Message)
+}
+
+// IsNotFound reports whether err is a 404 from the wrapper, such as for an
+// unknown session or job.
+func IsNotFound(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
+
+// Ask answers req with POST /api/ask.
+func (c *Client) Ask(ctx context.Context, req model.AskRequest) (*model.AskResponse, error) {
+	out := new(model.AskResponse)
+	if err := c.doJSON(ctx, http.MethodPost, "/api/ask", req, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// doJSON sends in as the JSON body, unless it is nil, and decodes a 2xx
+// response into out, unless it is nil.
+func (c *Client) doJSON(ctx context.Context, method, path string, in, out any) error {
+	resp, err := c.do(ctx, method, path, in)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("decode %s %s response: %w", method, path, err)
+	}
+	return nil
+}
+
+// do sends a request, retrying it while that is safe, and returns the first
+// 2xx response. Other responses are returned as an *APIError.
+func (c *Client) do(ctx context.Context, method, path string, in any) (*http.Response, error) {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return nil, err
+		}
+	}
+	var idempotencyKey string
+	if method == http.MethodPost {
+		idempotencyKey = newIdempotencyKey()
+	}
+
+	backoff := c.backoff
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		if in != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		if c.apiKey != "" {
+			req.Header.Set("Authorization", "Bearer "+c.apiKey)
+		}
+		if idempotencyKey != "" {
+			req.Header.Set("Idempotency-Key", idempotencyKey)
+		}
+
+		resp, err := c.httpClient.Do(req)
+		wait := backoff
+		switch {
+		case err != nil:
+			if ctx.Err() != nil || attempt >= c.maxRetries {
+				return nil, err
+			}
+		case resp.StatusCode >= 200 && resp.StatusCode <= 299:
+			return resp, nil
+		default:
+			apiErr := readAPIError(resp)
+			if !retryable(resp.StatusCode) || attempt >= c.maxRetries {
+				return nil, apiErr
+			}
+			if retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+				wait = retryAfter
+			}
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// retryable reports whether a response with code means the request may
+// succeed when sent again.
+func retryable(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// parseRetryAfter reads a Retry-After of delay seconds or an HTTP date.
+func parseRetryAfter(value string) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	var wait time.Duration
+	if seconds, err := strconv.Atoi(value); err == nil {
+		wait = time.Duration(seconds) * time.Second
+	} else if at, err := http.ParseTime(value); err == nil {
+		wait = time.Until(at)
+	} else {
+		return 0, false
+	}
+	return min(max(wait, 0), maxRetryAfter), true
+}
+
+// readAPIError consumes and closes resp. The wrapper answers errors as
+// {"error": "message"} on its own routes and as {"error": {"message": ...}}
+// from the middleware shared with the compatible APIs; both are understood.
+func readAPIError(resp *http.Response) *APIError {
+	defer resp.Body.Close()
+	apiErr := &APIError{StatusCode: resp.StatusCode}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+
+	var body struct {
+		Error  json.RawMessage     `json:"error"`
+		Code   string              `json:"code"`
+		Status *model.GeminiStatus `json:"status"`
+	}
+	if json.Unmarshal(data, &body) != nil {
+		apiErr.Message = strings.TrimSpace(string(data))
+		return apiErr
+	}
+	apiErr.Code, apiErr.Status = body.Code, body.Status
+	var message string
+	var nested struct {
+		Message string `json:"message"`
+	}
+	switch {
+	case json.Unmarshal(body.Error, &message) == nil:
+		apiErr.Message = message
+	case json.Unmarshal(body.Error, &nested) == nil:
+		apiErr.Message = nested.Message
+	}
+	return apiErr
+}
+
+func newIdempotencyKey() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return "client_" + hex.EncodeToString(b)
+}
@@ -0,0 +1,144 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gemini-wrapper/model"
+)
+
+func TestAskRetriesOverloadedRequestsWithTheSameIdempotencyKey(t *testing.T) {
+	var calls atomic.Int32
+	var keys []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys = append(keys, r.Header.Get("Idempotency-Key"))
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			t.Errorf("unexpected Authorization header %q", r.Header.Get("Authorization"))
+		}
+		if calls.Add(1) == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprint(w, `{"error": {"code": "overloaded", "message": "The server is overloaded. Retry later."}}`)
+			return
+		}
+		var req model.AskRequest
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		_ = json.NewEncoder(w).Encode(model.AskResponse{Answer: "echo: " + req.Question})
+	}))
+	defer server.Close()
+
+	c := New(Config{BaseURL: server.URL + "/", APIKey: "secret", RetryBackoff: time.Millisecond})
+	resp, err := c.Ask(context.Background(), model.AskRequest{Question: "hi"})
+	if err != nil {
+		t.Fatalf("Ask failed: %v", err)
+	}
+	if resp.Answer != "echo: hi" || calls.Load() != 2 {
+		t.Fatalf("unexpected answer %q after %d calls", resp.Answer, calls.Load())
+	}
+	if keys[0] == "" || keys[0] != keys[1] {
+		t.Fatalf("expected one idempotency key for both attempts, got %q", keys)
+	}
+}
+
+func TestAskReturnsAPIErrors(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"error": "session not found"}`)
+	}))
+	defer server.Close()
+
+	c := New(Config{BaseURL: server.URL, RetryBackoff: time.Millisecond})
+	_, err := c.Sessions().Ask(context.Background(), "missing", "hi")
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.Message != "session not found" || !IsNotFound(err) {
+		t.Fatalf("expected a 404 APIError, got %v", err)
+	}
+	if calls.Load() != 1 {
+		t.Fatalf("expected no retries of a 404, got %d calls", calls.Load())
+	}
+}
+
+func TestAskStreamDeliversChunksAndTheFinalResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/ask/stream" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, ": keep-alive\n\n")
+		fmt.Fprint(w, "event: chunk\ndata: {\"text\":\"Hello, \"}\n\n")
+		fmt.Fprint(w, "event: chunk\ndata: {\"text\":\"world\"}\n\n")
+		fmt.Fprint(w, "event: done\ndata: {\"answer\":\"Hello, world\",\"status\":{\"httpStatus\":200}}\n\n")
+	}))
+	defer server.Close()
+
+	var chunks []string
+	resp, err := New(Config{BaseURL: server.URL}).AskStream(context.Background(), model.AskRequest{Question: "hi"}, func(text string) error {
+		chunks = append(chunks, text)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("AskStream failed: %v", err)
+	}
+	if strings.Join(chunks, "|") != "Hello, |world" || resp.Answer != "Hello, world" {
+		t.Fatalf("unexpected chunks %q and answer %q", chunks, resp.Answer)
+	}
+}
+
+func TestAskStreamReportsErrorEvents(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "event: chunk\ndata: {\"text\":\"partial\"}\n\n")
+		fmt.Fprint(w, "event: error\ndata: {\"error\":\"quota exhausted\",\"code\":\"quota_exceeded\",\"status\":{\"httpStatus\":429}}\n\n")
+	}))
+	defer server.Close()
+
+	resp, err := New(Config{BaseURL: server.URL}).AskStream(context.Background(), model.AskRequest{Question: "hi"}, nil)
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusTooManyRequests || apiErr.Message != "quota exhausted" || apiErr.Code != model.ReasonQuotaExceeded {
+		t.Fatalf("expected a 429 APIError, got %v", err)
+	}
+	if resp == nil || resp.Error != "quota exhausted" {
+		t.Fatalf("expected the error response, got %+v", resp)
+	}
+}
+
+func TestJobsWaitPollsUntilTheJobFinishes(t *testing.T) {
+	var polls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info := model.JobInfo{ID: "job_1", State: model.JobRunning}
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/api/jobs":
+			w.WriteHeader(http.StatusAccepted)
+		case r.Method == http.MethodGet && r.URL.Path == "/api/jobs/job_1":
+			if polls.Add(1) == 3 {
+				info.State, info.Answer = model.JobSucceeded, "4"
+			}
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		_ = json.NewEncoder(w).Encode(info)
+	}))
+	defer server.Close()
+
+	jobs := New(Config{BaseURL: server.URL}).Jobs()
+	created, err := jobs.Create(context.Background(), model.CreateJobRequest{AskRequest: model.AskRequest{Question: "2+2?"}})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	info, err := jobs.Wait(context.Background(), created.ID, time.Millisecond)
+	if err != nil {
+		t.Fatalf("Wait failed: %v", err)
+	}
+	if info.State != model.JobSucceeded || info.Answer != "4" || polls.Load() != 3 {
+		t.Fatalf("unexpected job %+v after %d polls", info, polls.Load())
+	}
+}
@@ -0,0 +1,79 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"time"
+
+	"gemini-wrapper/model"
+)
+
+// defaultPollInterval is how often Jobs.Wait polls when no interval is given.
+const defaultPollInterval = time.Second
+
+// Jobs calls the /api/jobs routes. Get it from Client.Jobs.
+type Jobs struct {
+	c *Client
+}
+
+// Jobs returns the job API of c.
+func (c *Client) Jobs() *Jobs {
+	return &Jobs{c: c}
+}
+
+// Create queues req as an asynchronous job.
+func (j *Jobs) Create(ctx context.Context, req model.CreateJobRequest) (*model.JobInfo, error) {
+	out := new(model.JobInfo)
+	if err := j.c.doJSON(ctx, http.MethodPost, "/api/jobs", req, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Get returns the job with id.
+func (j *Jobs) Get(ctx context.Context, id string) (*model.JobInfo, error) {
+	out := new(model.JobInfo)
+	if err := j.c.doJSON(ctx, http.MethodGet, jobPath(id), nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Cancel cancels the job with id and returns its state.
+func (j *Jobs) Cancel(ctx context.Context, id string) (*model.JobInfo, error) {
+	out := new(model.JobInfo)
+	if err := j.c.doJSON(ctx, http.MethodDelete, jobPath(id), nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Wait polls the job with id every interval, or every second when interval
+// is not positive, until it has finished, and returns it. A failed or
+// cancelled job is returned without error; check its State.
+func (j *Jobs) Wait(ctx context.Context, id string, interval time.Duration) (*model.JobInfo, error) {
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		info, err := j.Get(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if info.State != model.JobRunning {
+			return info, nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func jobPath(id string) string {
+	return "/api/jobs/" + url.PathEscape(id)
+}
@@ -0,0 +1,82 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+
+	"gemini-wrapper/model"
+)
+
+// Sessions calls the /api/sessions routes. Get it from Client.Sessions.
+type Sessions struct {
+	c *Client
+}
+
+// Sessions returns the session API of c.
+func (c *Client) Sessions() *Sessions {
+	return &Sessions{c: c}
+}
+
+// Create starts a session.
+func (s *Sessions) Create(ctx context.Context, req model.CreateSessionRequest) (*model.SessionInfo, error) {
+	out := new(model.SessionInfo)
+	if err := s.c.doJSON(ctx, http.MethodPost, "/api/sessions", req, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// List returns every session.
+func (s *Sessions) List(ctx context.Context) ([]model.SessionInfo, error) {
+	var out model.SessionListResponse
+	if err := s.c.doJSON(ctx, http.MethodGet, "/api/sessions", nil, &out); err != nil {
+		return nil, err
+	}
+	return out.Sessions, nil
+}
+
+// Get returns the session with id.
+func (s *Sessions) Get(ctx context.Context, id string) (*model.SessionInfo, error) {
+	out := new(model.SessionInfo)
+	if err := s.c.doJSON(ctx, http.MethodGet, sessionPath(id), nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// History returns the session with id and all of its messages.
+func (s *Sessions) History(ctx context.Context, id string) (*model.SessionTranscript, error) {
+	out := new(model.SessionTranscript)
+	if err := s.c.doJSON(ctx, http.MethodGet, sessionPath(id)+"/history", nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Import creates a session from a transcript returned by History.
+func (s *Sessions) Import(ctx context.Context, transcript model.SessionTranscript) (*model.SessionInfo, error) {
+	out := new(model.SessionInfo)
+	if err := s.c.doJSON(ctx, http.MethodPost, "/api/sessions/import", transcript, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Ask asks question in the session with id.
+func (s *Sessions) Ask(ctx context.Context, id, question string) (*model.SessionAskResponse, error) {
+	out := new(model.SessionAskResponse)
+	if err := s.c.doJSON(ctx, http.MethodPost, sessionPath(id)+"/ask", model.AskRequest{Question: question}, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Delete removes the session with id.
+func (s *Sessions) Delete(ctx context.Context, id string) error {
+	return s.c.doJSON(ctx, http.MethodDelete, sessionPath(id), nil, nil)
+}
+
+func sessionPath(id string) string {
+	return "/api/sessions/" + url.PathEscape(id)
+}
@@ -0,0 +1,166 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"gemini-wrapper/model"
+	"gemini-wrapper/pkg/lines"
+)
+
+// Stream reads the events of POST /api/ask/stream. Call Next until it
+// returns false, then Err; Result holds the final response once the stream
+// is done:
+//
+//	stream, err := c.OpenStream(ctx, req)
+//	if err != nil { ... }
+//	defer stream.Close()
+//	for stream.Next() {
+//		fmt.Print(stream.Text())
+//	}
+//	if err := stream.Err(); err != nil { ... }
+type Stream struct {
+	body   io.ReadCloser
+	lines  *lines.Reader
+	text   string
+	result *model.AskResponse
+	err    error
+}
+
+// OpenStream starts streaming the answer to req. Only opening the stream is
+// retried; an interrupted stream is reported by Err.
+func (c *Client) OpenStream(ctx context.Context, req model.AskRequest) (*Stream, error) {
+	resp, err := c.do(ctx, http.MethodPost, "/api/ask/stream", req)
+	if err != nil {
+		return nil, err
+	}
+	return &Stream{body: resp.Body, lines: lines.NewReader(resp.Body)}, nil
+}
+
+// Next advances to the next chunk of the answer. It returns false at the end
+// of the answer or on an error.
+func (s *Stream) Next() bool {
+	if s.result != nil || s.err != nil {
+		return false
+	}
+	for {
+		event, data, ok := s.readEvent()
+		if !ok {
+			return false
+		}
+		switch event {
+		case "chunk":
+			var chunk model.AskStreamChunk
+			if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+				s.err = fmt.Errorf("decode stream chunk: %w", err)
+				return false
+			}
+			s.text = chunk.Text
+			return true
+		case "done", "error":
+			result := new(model.AskResponse)
+			if err := json.Unmarshal([]byte(data), result); err != nil {
+				s.err = fmt.Errorf("decode stream %s event: %w", event, err)
+				return false
+			}
+			s.result = result
+			if event == "error" {
+				s.err = streamError(result)
+			}
+			return false
+		}
+	}
+}
+
+// readEvent returns the next event with data, skipping comments.
+func (s *Stream) readEvent() (event, data string, ok bool) {
+	var dataLines []string
+	for {
+		raw, err := s.lines.Next()
+		if errors.Is(err, io.EOF) {
+			s.err = io.ErrUnexpectedEOF
+			return "", "", false
+		}
+		if err != nil {
+			s.err = err
+			return "", "", false
+		}
+		line := string(raw)
+		switch {
+		case line == "":
+			if len(dataLines) > 0 {
+				return event, strings.Join(dataLines, "\n"), true
+			}
+			event = ""
+		case strings.HasPrefix(line, ":"):
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			dataLines = append(dataLines, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+}
+
+// Text is the chunk read by the last call to Next.
+func (s *Stream) Text() string {
+	return s.text
+}
+
+// Result is the final response, set once Next has returned false after the
+// "done" event, or after an "error" event that Err also reports.
+func (s *Stream) Result() *model.AskResponse {
+	return s.result
+}
+
+// Err is the error that ended the stream, if any. An answer that failed
+// upstream is an *APIError.
+func (s *Stream) Err() error {
+	return s.err
+}
+
+// Close releases the connection. It is safe to call more than once.
+func (s *Stream) Close() error {
+	return s.body.Close()
+}
+
+// AskStream streams the answer to req, calling onChunk with each part as it
+// arrives, and returns the final response. An error returned by onChunk
+// stops the stream and is returned.
+func (c *Client) AskStream(ctx context.Context, req model.AskRequest, onChunk func(text string) error) (*model.AskResponse, error) {
+	stream, err := c.OpenStream(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	for stream.Next() {
+		if onChunk == nil {
+			continue
+		}
+		if err := onChunk(stream.Text()); err != nil {
+			return nil, err
+		}
+	}
+	if err := stream.Err(); err != nil {
+		var apiErr *APIError
+		if errors.As(err, &apiErr) {
+			return stream.Result(), err
+		}
+		return nil, err
+	}
+	return stream.Result(), nil
+}
+
+// streamError is the *APIError of an "error" event, with the status code the
+// wrapper would have answered a non-streaming request with.
+func streamError(result *model.AskResponse) *APIError {
+	code := http.StatusInternalServerError
+	if result.Status != nil && result.Status.HTTPStatus >= 400 && result.Status.HTTPStatus <= 599 {
+		code = result.Status.HTTPStatus
+	}
+	return &APIError{StatusCode: code, Message: result.Error, Code: result.Code, Status: result.Status}
+}
@@ -0,0 +1,187 @@
+package gemini
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrBackendRestarted is returned for questions whose CLI process was
+	// interrupted by Restart.
+	ErrBackendRestarted = errors.New("backend call interrupted by an operator restart")
+	// ErrQueueCleared is returned for queued questions dropped by ClearQueue.
+	ErrQueueCleared = errors.New("request queue was cleared by an operator")
+)
+
+// ActiveCall is a backend call holding a worker. PID is set once its CLI
+// process has started.
+type ActiveCall struct {
+	ID             uint64    `json:"id"`
+	PID            int       `json:"pid,omitempty"`
+	Model          string    `json:"model,omitempty"`
+	Stream         bool      `json:"stream"`
+	StartedAt      time.Time `json:"startedAt"`
+	RunningSeconds float64   `json:"runningSeconds"`
+}
+
+// BackendState is the operator view of the service. Headless mode starts one
+// CLI process per question, so instead of a single CLI session it lists the
+// processes running right now.
+type BackendState struct {
+	Health          BackendHealth `json:"health"`
+	StartedAt       time.Time     `json:"startedAt"`
+	UptimeSeconds   float64       `json:"uptimeSeconds"`
+	DefaultModel    string        `json:"defaultModel,omitempty"`
+	QuestionsServed int64         `json:"questionsServed"`
+	QuestionsFailed int64         `json:"questionsFailed"`
+	Pool            PoolStats     `json:"pool"`
+	Active          []ActiveCall  `json:"active"`
+}
+
+// callRegistry tracks the backend calls that hold a worker.
+type callRegistry struct {
+	mu     sync.Mutex
+	nextID uint64
+	calls  map[uint64]*activeCall
+	served int64
+	failed int64
+	// console receives the output of the calls' CLI processes.
+	console *console
+}
+
+type activeCall struct {
+	info    ActiveCall
+	pid     atomic.Int64
+	cancel  context.CancelCauseFunc
+	console *console
+}
+
+type activeCallKey struct{}
+
+func newCallRegistry() *callRegistry {
+	return &callRegistry{calls: map[uint64]*activeCall{}, console: newConsole()}
+}
+
+// begin registers a call. The returned context is cancelled with
+// ErrBackendRestarted by interruptAll; finish unregisters the call and counts
+// its outcome. A nil registry tracks nothing.
+func (r *callRegistry) begin(ctx context.Context, modelName string, stream bool) (context.Context, func(err error)) {
+	if r == nil {
+		return ctx, func(error) {}
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	call := &activeCall{info: ActiveCall{Model: modelName, Stream: stream, StartedAt: time.Now()}, cancel: cancel, console: r.console}
+	r.mu.Lock()
+	r.nextID++
+	call.info.ID = r.nextID
+	r.calls[call.info.ID] = call
+	r.mu.Unlock()
+
+	return context.WithValue(ctx, activeCallKey{}, call), func(err error) {
+		r.mu.Lock()
+		delete(r.calls, call.info.ID)
+		if err == nil {
+			r.served++
+		} else {
+			r.failed++
+		}
+		r.mu.Unlock()
+		cancel(nil)
+	}
+}
+
+// setCallPID records the CLI process of the call running with ctx.
+func setCallPID(ctx context.Context, pid int) {
+	if call, ok := ctx.Value(activeCallKey{}).(*activeCall); ok {
+		call.pid.Store(int64(pid))
+	}
+}
+
+func (r *callRegistry) active() []ActiveCall {
+	if r == nil {
+		return []ActiveCall{}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	calls := make([]ActiveCall, 0, len(r.calls))
+	for _, call := range r.calls {
+		info := call.info
+		info.PID = int(call.pid.Load())
+		info.RunningSeconds = now.Sub(info.StartedAt).Seconds()
+		calls = append(calls, info)
+	}
+	sort.Slice(calls, func(i, j int) bool { return calls[i].ID < calls[j].ID })
+	return calls
+}
+
+func (r *callRegistry) interruptAll() int {
+	if r == nil {
+		return 0
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, call := range r.calls {
+		call.cancel(ErrBackendRestarted)
+	}
+	return len(r.calls)
+}
+
+// restartCause returns ErrBackendRestarted when err is the result of Restart
+// interrupting the call running with ctx, and err otherwise.
+func restartCause(ctx context.Context, err error) error {
+	if err != nil && errors.Is(context.Cause(ctx), ErrBackendRestarted) {
+		return ErrBackendRestarted
+	}
+	return err
+}
+
+// BackendState returns the operator view of the service.
+func (s *GeminiService) BackendState() BackendState {
+	state := BackendState{
+		Health:       s.Health(),
+		StartedAt:    s.startedAt,
+		DefaultModel: s.defaultModel,
+		Pool:         s.PoolStats(),
+		Active:       s.calls.active(),
+	}
+	if !s.startedAt.IsZero() {
+		state.UptimeSeconds = time.Since(s.startedAt).Seconds()
+	}
+	if s.calls != nil {
+		s.calls.mu.Lock()
+		state.QuestionsServed = s.calls.served
+		state.QuestionsFailed = s.calls.failed
+		s.calls.mu.Unlock()
+	}
+	return state
+}
+
+// Restart interrupts every running CLI process, failing its question with
+// ErrBackendRestarted, and probes the backend right away. Queued questions
+// keep waiting and start fresh processes. It returns how many calls were
+// interrupted.
+func (s *GeminiService) Restart() int {
+	interrupted := s.calls.interruptAll()
+	if s.supervisor != nil {
+		select {
+		case s.supervisor.wake <- struct{}{}:
+		default:
+		}
+	}
+	slog.Warn("backend restarted by operator", "interrupted", interrupted)
+	return interrupted
+}
+
+// ClearQueue fails every question waiting for a worker with ErrQueueCleared
+// and returns how many were dropped.
+func (s *GeminiService) ClearQueue() int {
+	cleared := s.pool.clear()
+	slog.Warn("request queue cleared by operator", "cleared", cleared)
+	return cleared
+}
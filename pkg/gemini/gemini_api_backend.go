@@ -0,0 +1,328 @@
+package gemini
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gemini-wrapper/model"
+	"gemini-wrapper/pkg/lines"
+)
+
+// backendAPI calls the Generative Language REST API with an API key.
+const backendAPI = "api"
+
+const (
+	defaultAPIBaseURL = "https://generativelanguage.googleapis.com"
+	// defaultAPIModel is asked when neither the request nor the server names
+	// a model; the CLI would pick its own default.
+	defaultAPIModel = "gemini-2.5-flash"
+)
+
+// APIFallbackConfig configures the REST API fallback. With it enabled,
+// requests the CLI cannot serve go to the Gemini API instead: while the CLI
+// is down, after it failed to start or to authenticate, and, with
+// Multimodal, requests carrying attachments.
+type APIFallbackConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	APIKey  string `yaml:"api_key"`
+	BaseURL string `yaml:"base_url"`
+	// Multimodal sends requests with attachments to the API, which reads
+	// media natively, instead of having the CLI read them from files.
+	Multimodal bool `yaml:"multimodal"`
+}
+
+// active reports whether the fallback is enabled and can authenticate.
+func (c APIFallbackConfig) active() bool {
+	return c.Enabled && strings.TrimSpace(c.APIKey) != ""
+}
+
+// apiBackend answers with the generateContent and streamGenerateContent
+// methods of the Gemini API. It reads the global GEMINI.md like the CLI
+// does and sends it as the system instruction.
+type apiBackend struct {
+	apiKey      string
+	baseURL     string
+	contextPath string
+	client      *http.Client
+}
+
+func newAPIBackend(cfg APIFallbackConfig, cliHome string) *apiBackend {
+	baseURL := strings.TrimRight(strings.TrimSpace(cfg.BaseURL), "/")
+	if baseURL == "" {
+		baseURL = defaultAPIBaseURL
+	}
+	if cliHome == "" {
+		cliHome = defaultCLIHome
+	}
+	return &apiBackend{
+		apiKey:      strings.TrimSpace(cfg.APIKey),
+		baseURL:     baseURL,
+		contextPath: filepath.Join(cliHome, ".gemini", contextFileName),
+		client:      &http.Client{},
+	}
+}
+
+func (*apiBackend) Name() string {
+	return backendAPI
+}
+
+func (b *apiBackend) Generate(ctx context.Context, question string, opts model.AskOptions) (string, *model.GeminiStatus, error) {
+	resp, modelName, err := b.post(ctx, "generateContent", question, opts)
+	if err != nil {
+		return "", &model.GeminiStatus{Model: modelName}, err
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", &model.GeminiStatus{Model: modelName}, fmt.Errorf("gemini API: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", apiErrorStatus(modelName, resp.StatusCode, raw), apiError(resp.StatusCode, raw)
+	}
+
+	var result apiResponse
+	if err := json.Unmarshal(raw, &result); err != nil {
+		return "", &model.GeminiStatus{Model: modelName}, fmt.Errorf("gemini API: invalid response: %w", err)
+	}
+	status := &model.GeminiStatus{Model: modelName, Usage: result.UsageMetadata}
+	answer, finishReason, err := result.text()
+	status.FinishReason = finishReason
+	if err != nil {
+		status.HTTPStatus = http.StatusBadRequest
+		return "", status, err
+	}
+	if strings.TrimSpace(answer) == "" {
+		return "", status, emptyAPIAnswerError(finishReason)
+	}
+	return answer, status, nil
+}
+
+// Stream reads the server-sent events of streamGenerateContent and forwards
+// the text of each.
+func (b *apiBackend) Stream(ctx context.Context, question string, opts model.AskOptions, onChunk func(chunk string) error) (string, *model.GeminiStatus, error) {
+	resp, modelName, err := b.post(ctx, "streamGenerateContent", question, opts)
+	if err != nil {
+		return "", &model.GeminiStatus{Model: modelName}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		raw, _ := io.ReadAll(resp.Body)
+		return "", apiErrorStatus(modelName, resp.StatusCode, raw), apiError(resp.StatusCode, raw)
+	}
+
+	status := &model.GeminiStatus{Model: modelName}
+	var answer strings.Builder
+	reader := lines.NewReader(resp.Body)
+	for {
+		line, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return "", status, ctx.Err()
+			}
+			return "", status, fmt.Errorf("gemini API: %w", err)
+		}
+		data, ok := bytes.CutPrefix(line, []byte("data:"))
+		if !ok || len(bytes.TrimSpace(data)) == 0 {
+			continue
+		}
+		var chunk apiResponse
+		if err := json.Unmarshal(data, &chunk); err != nil {
+			return "", status, fmt.Errorf("gemini API: invalid stream event: %w", err)
+		}
+		if chunk.UsageMetadata != nil {
+			status.Usage = chunk.UsageMetadata
+		}
+		text, finishReason, err := chunk.text()
+		if finishReason != "" {
+			status.FinishReason = finishReason
+		}
+		if err != nil {
+			status.HTTPStatus = http.StatusBadRequest
+			return "", status, err
+		}
+		if text == "" {
+			continue
+		}
+		answer.WriteString(text)
+		if err := onChunk(text); err != nil {
+			return "", status, err
+		}
+	}
+	result := strings.TrimSpace(answer.String())
+	if result == "" {
+		return "", status, emptyAPIAnswerError(status.FinishReason)
+	}
+	return result, status, nil
+}
+
+// post sends question to method of the model of opts and returns the
+// response together with the model asked.
+func (b *apiBackend) post(ctx context.Context, method, question string, opts model.AskOptions) (*http.Response, string, error) {
+	modelName := strings.TrimPrefix(strings.TrimSpace(opts.Model), "models/")
+	if modelName == "" {
+		modelName = defaultAPIModel
+	}
+	body, err := b.requestBody(question, opts)
+	if err != nil {
+		return nil, modelName, err
+	}
+	endpoint := b.baseURL + "/v1beta/models/" + url.PathEscape(modelName) + ":" + method
+	if method == "streamGenerateContent" {
+		endpoint += "?alt=sse"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, modelName, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("x-goog-api-key", b.apiKey)
+	resp, err := b.client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, modelName, ctx.Err()
+		}
+		return nil, modelName, fmt.Errorf("gemini API: %w", err)
+	}
+	return resp, modelName, nil
+}
+
+// requestBody renders the prompt the CLI would get as a generateContent
+// request. Attachments follow the prompt, each introduced by the @name the
+// prompt refers to it by, and GEMINI.md files become the system instruction.
+func (b *apiBackend) requestBody(question string, opts model.AskOptions) ([]byte, error) {
+	if grounded(opts) {
+		question = groundingPrompt(question)
+	}
+	parts := []model.GeminiPart{{Text: question}}
+	for _, attachment := range opts.Attachments {
+		data := attachment.Data
+		if attachment.Path != "" {
+			content, err := os.ReadFile(attachment.Path)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read attachment %s: %w", attachment.Name, err)
+			}
+			data = content
+		}
+		parts = append(parts,
+			model.GeminiPart{Text: "@" + attachment.Name + ":"},
+			model.GeminiPart{InlineData: &model.Blob{MimeType: attachment.MimeType, Data: base64.StdEncoding.EncodeToString(data)}},
+		)
+	}
+	req := model.GeminiAPIRequest{
+		Contents:         []model.GeminiContent{{Role: "user", Parts: parts}},
+		GenerationConfig: opts.GenerationConfig,
+		SafetySettings:   opts.SafetySettings,
+	}
+	if grounded(opts) {
+		req.Tools = []model.Tool{{GoogleSearch: &model.GoogleSearch{}}}
+	}
+	var instructions []model.GeminiPart
+	if content, err := os.ReadFile(b.contextPath); err == nil && strings.TrimSpace(string(content)) != "" {
+		instructions = append(instructions, model.GeminiPart{Text: string(content)})
+	} else if err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Warn("global GEMINI.md not sent to the gemini API", "error", err)
+	}
+	if strings.TrimSpace(opts.Context) != "" {
+		instructions = append(instructions, model.GeminiPart{Text: opts.Context})
+	}
+	if len(instructions) > 0 {
+		req.SystemInstruction = &model.GeminiContent{Parts: instructions}
+	}
+	return json.Marshal(req)
+}
+
+// apiResponse is a generateContent response, or one event of a stream.
+type apiResponse struct {
+	Candidates     []model.GeminiCandidate `json:"candidates"`
+	UsageMetadata  *model.UsageMetadata    `json:"usageMetadata,omitempty"`
+	PromptFeedback *struct {
+		BlockReason string `json:"blockReason,omitempty"`
+	} `json:"promptFeedback,omitempty"`
+}
+
+// text joins the text parts of the first candidate. A blocked prompt is an
+// error; a candidate without text is not, as streams end with one.
+func (r apiResponse) text() (string, string, error) {
+	if r.PromptFeedback != nil && r.PromptFeedback.BlockReason != "" {
+		return "", "", fmt.Errorf("%w: gemini API blocked the prompt: %s", ErrSafetyBlocked, r.PromptFeedback.BlockReason)
+	}
+	if len(r.Candidates) == 0 {
+		return "", "", nil
+	}
+	candidate := r.Candidates[0]
+	var text strings.Builder
+	for _, part := range candidate.Content.Parts {
+		if part.Thought {
+			// Tagged like the thoughts the CLI is asked to write.
+			text.WriteString(thoughtOpen + part.Text + thoughtClose)
+			continue
+		}
+		text.WriteString(part.Text)
+	}
+	return text.String(), candidate.FinishReason, nil
+}
+
+// emptyAPIAnswerError is the error of an answer without text, which the API
+// sends when safety filters stopped the candidate.
+func emptyAPIAnswerError(finishReason string) error {
+	switch finishReason {
+	case "SAFETY", "PROHIBITED_CONTENT", "BLOCKLIST", "SPII":
+		return fmt.Errorf("%w: gemini API stopped the answer: %s", ErrSafetyBlocked, finishReason)
+	}
+	return fmt.Errorf("received empty response from gemini API")
+}
+
+// apiError wraps an error answer of the API. Rejected keys wrap
+// ErrAuthentication and unknown models ErrModelNotFound, like the CLI's;
+// other answers wrap the typed error their body or status points to.
+func apiError(code int, body []byte) error {
+	message := apiErrorMessage(body)
+	err := fmt.Errorf("gemini API error %d: %s", code, message)
+	switch code {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return fmt.Errorf("%w: %w", ErrAuthentication, err)
+	case http.StatusNotFound:
+		return fmt.Errorf("%w: %w", ErrModelNotFound, err)
+	}
+	if classified := classifyUpstreamError(err, string(body), nil); classified != err {
+		return classified
+	}
+	switch code {
+	case http.StatusTooManyRequests:
+		return fmt.Errorf("%w: %w", ErrQuotaExceeded, err)
+	case http.StatusServiceUnavailable:
+		return fmt.Errorf("%w: %w", ErrModelOverloaded, err)
+	}
+	return err
+}
+
+func apiErrorStatus(modelName string, code int, body []byte) *model.GeminiStatus {
+	status := &model.GeminiStatus{HTTPStatus: code, Model: modelName, Message: apiErrorMessage(body)}
+	var envelope model.GeminiErrorResponse
+	if err := json.Unmarshal(body, &envelope); err == nil {
+		status.Code = envelope.Error.Status
+	}
+	return status
+}
+
+func apiErrorMessage(body []byte) string {
+	var envelope model.GeminiErrorResponse
+	if err := json.Unmarshal(body, &envelope); err == nil && envelope.Error.Message != "" {
+		return envelope.Error.Message
+	}
+	return strings.TrimSpace(string(body))
+}
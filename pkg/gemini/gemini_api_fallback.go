@@ -0,0 +1,112 @@
+package gemini
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"gemini-wrapper/metrics"
+	"gemini-wrapper/model"
+)
+
+// Reasons a request is served by the Gemini API instead of the CLI.
+const (
+	apiReasonCLIDown         = "cli_unavailable"
+	apiReasonCLIStarting     = "cli_starting"
+	apiReasonUnauthenticated = "cli_unauthenticated"
+	apiReasonMultimodal      = "multimodal"
+)
+
+// apiRoute returns why the request skips the CLI and goes straight to the
+// API, or "" when the CLI should take it. Requests working in a directory
+// need the CLI, which reads and edits the files there, and so do requests
+// with their own environment, such as another account's key.
+func (s *GeminiService) apiRoute(opts model.AskOptions) string {
+	if s.apiBackend == nil || opts.WorkDir != "" || len(opts.Env) > 0 {
+		return ""
+	}
+	if s.supervisor.down() {
+		return apiReasonCLIDown
+	}
+	if s.supervisor.starting() {
+		return apiReasonCLIStarting
+	}
+	if s.apiMultimodal && len(opts.Attachments) > 0 {
+		return apiReasonMultimodal
+	}
+	return ""
+}
+
+// apiFallbackReason returns why a failed CLI attempt is repeated on the API,
+// or "" when its error stands. Only failures of the CLI itself fall back;
+// upstream errors would hit the API just the same.
+func (s *GeminiService) apiFallbackReason(ctx context.Context, opts model.AskOptions, err error) string {
+	if s.apiBackend == nil || opts.WorkDir != "" || len(opts.Env) > 0 || err == nil || ctx.Err() != nil {
+		return ""
+	}
+	switch {
+	case errors.Is(err, ErrAuthentication):
+		return apiReasonUnauthenticated
+	case isCLIStartError(err):
+		return apiReasonCLIDown
+	}
+	return ""
+}
+
+func (s *GeminiService) generateWithAPI(ctx context.Context, question string, opts model.AskOptions, reason string) (string, *model.GeminiStatus, error) {
+	ctx, done, err := s.track(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	defer done()
+	metrics.APIFallbacks.Inc(reason)
+	slog.InfoContext(ctx, "answering through the gemini API", "reason", reason, "model", printableModel(opts.Model))
+	ctx, finish := s.calls.begin(ctx, opts.Model, false)
+	start := time.Now()
+	answer, status, err := s.apiBackend.Generate(ctx, question, opts)
+	status = withStatusTimings(status, 0, time.Since(start))
+	finish(err)
+	s.recordAttempt(ctx, attempt{model: opts.Model, backend: backendAPI, start: start}, question, answer, status, err)
+	return answer, withAPIStatus(status, reason), err
+}
+
+func (s *GeminiService) streamWithAPI(ctx context.Context, question string, opts model.AskOptions, reason string, onChunk func(chunk string) error) (string, *model.GeminiStatus, error) {
+	ctx, done, err := s.track(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	defer done()
+	metrics.APIFallbacks.Inc(reason)
+	slog.InfoContext(ctx, "streaming through the gemini API", "reason", reason, "model", printableModel(opts.Model))
+	ctx, finish := s.calls.begin(ctx, opts.Model, true)
+	progressFrom(ctx).running()
+	start := time.Now()
+	limiter := newOutputLimiter(opts, onChunk)
+	thoughts := newThoughtFilter(opts, limiter.chunk)
+	run := attempt{model: opts.Model, backend: backendAPI, start: start}
+	answer, status, err := limiter.result(thoughts.result(s.apiBackend.Stream(ctx, question, opts, run.timeFirstChunk(thoughts.chunk))))
+	status = withStatusTimings(status, 0, time.Since(start))
+	finish(err)
+	s.recordAttempt(ctx, run, question, answer, status, err)
+	return answer, withAPIStatus(status, reason), err
+}
+
+// withAPIStatus records that the API served the request, a degradation
+// unless the CLI was passed over for attachments only the API reads.
+func withAPIStatus(status *model.GeminiStatus, reason string) *model.GeminiStatus {
+	status = withStatusBackend(status, backendAPI)
+	if reason == apiReasonMultimodal {
+		return status
+	}
+	return withStatusDegraded(status, model.DegradedAPIFallback)
+}
+
+// withStatusBackend records in status which backend served the request.
+func withStatusBackend(status *model.GeminiStatus, backend string) *model.GeminiStatus {
+	if status == nil {
+		status = &model.GeminiStatus{}
+	}
+	status.Backend = backend
+	return status
+}
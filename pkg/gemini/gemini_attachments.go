@@ -0,0 +1,67 @@
+package gemini
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"gemini-wrapper/model"
+)
+
+// attachmentsVariant identifies the attachments of a request in cache keys.
+// The prompt names them, but a name alone need not pin their content. Files
+// given by Path are expected never to change.
+func attachmentsVariant(attachments []model.Attachment) string {
+	if len(attachments) == 0 {
+		return ""
+	}
+	h := sha256.New()
+	for _, attachment := range attachments {
+		fmt.Fprintf(h, "%s\x00%s\x00%d\x00", attachment.Name, attachment.Path, len(attachment.Data))
+		h.Write(attachment.Data)
+	}
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// writeAttachments writes attachments under dir, where the CLI resolves the
+// @references of the prompt to them.
+func writeAttachments(dir string, attachments []model.Attachment) error {
+	for _, attachment := range attachments {
+		name := filepath.FromSlash(attachment.Name)
+		if !filepath.IsLocal(name) {
+			return fmt.Errorf("invalid attachment name %q", attachment.Name)
+		}
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			return err
+		}
+		if attachment.Path != "" {
+			if err := copyFile(path, attachment.Path); err != nil {
+				return err
+			}
+		} else if err := os.WriteFile(path, attachment.Data, 0o600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyFile(dst, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
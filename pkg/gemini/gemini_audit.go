@@ -0,0 +1,41 @@
+package gemini
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"gemini-wrapper/model"
+	"gemini-wrapper/service/accesslog"
+	"gemini-wrapper/service/audit"
+)
+
+// auditAsk records a finished question in the audit log attached to ctx, if
+// any, and reports the model that answered to the access log. answer is
+// what the client received.
+func auditAsk(ctx context.Context, start time.Time, question string, opts model.AskOptions, answer string, status *model.GeminiStatus, err error) {
+	entry := audit.Entry{
+		Time:          start,
+		Model:         opts.Model,
+		Prompt:        question,
+		Status:        http.StatusOK,
+		LatencyMillis: time.Since(start).Milliseconds(),
+	}
+	if status != nil {
+		if status.Model != "" {
+			entry.Model = status.Model
+		}
+		entry.Usage = status.Usage
+	}
+	if err != nil {
+		entry.Error = err.Error()
+		entry.Status = http.StatusInternalServerError
+		if status != nil && status.HTTPStatus >= 400 {
+			entry.Status = status.HTTPStatus
+		}
+	} else {
+		entry.Answer = answer
+	}
+	audit.Record(ctx, entry)
+	accesslog.RecordModel(ctx, entry.Model)
+}
@@ -0,0 +1,382 @@
+package gemini
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultOAuthTokenURL = "https://oauth2.googleapis.com/token"
+	// reauthCooldown is how long after a failed recovery questions that fail
+	// to authenticate fail right away instead of trying again.
+	reauthCooldown = 30 * time.Second
+	// authAPIKeyType is the selectedType of the CLI for Gemini API keys.
+	authAPIKeyType = "gemini-api-key"
+)
+
+// Ways a failed authentication is recovered from.
+const (
+	reauthOAuthRefresh = "oauth_refresh"
+	reauthAPIKey       = "api_key"
+	reauthRestart      = "restart"
+)
+
+// ReauthConfig sets how the wrapper recovers when the CLI reports expired
+// or missing credentials. A question that failed that way is asked once more
+// after the first applicable recovery: refreshing the cached OAuth token,
+// switching the CLI to an API key, or else a fresh CLI process, which picks
+// up credentials an operator replaced.
+type ReauthConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// OAuthClientID and OAuthClientSecret identify the OAuth client the CLI
+	// signed in with. Without them the cached token is not refreshed.
+	OAuthClientID     string `yaml:"oauth_client_id"`
+	OAuthClientSecret string `yaml:"oauth_client_secret"`
+	TokenURL          string `yaml:"token_url"`
+	// APIKey is switched to when the OAuth credentials cannot be refreshed.
+	// The switch is written to the CLI's settings.json and lasts until an
+	// operator selects another auth type there.
+	APIKey string `yaml:"api_key"`
+}
+
+// AuthStatus is the operator view of how the CLI authenticates.
+type AuthStatus struct {
+	// Method is the selectedType of the CLI settings, like "oauth-personal"
+	// or "gemini-api-key", or "" when none is selected.
+	Method       string        `json:"method"`
+	APIKeyActive bool          `json:"apiKeyActive"`
+	OAuth        *OAuthStatus  `json:"oauth,omitempty"`
+	Reauth       *ReauthStatus `json:"reauth,omitempty"`
+	LastRecovery *AuthRecovery `json:"lastRecovery,omitempty"`
+	// Keys is the health of the API key pool, when one is configured.
+	Keys []APIKeyStatus `json:"keys,omitempty"`
+}
+
+// OAuthStatus describes the cached OAuth credentials of the CLI.
+type OAuthStatus struct {
+	ExpiresAt       *time.Time `json:"expiresAt,omitempty"`
+	Expired         bool       `json:"expired"`
+	HasRefreshToken bool       `json:"hasRefreshToken"`
+}
+
+// ReauthStatus lists the recoveries that are configured.
+type ReauthStatus struct {
+	OAuthRefresh bool `json:"oauthRefresh"`
+	APIKey       bool `json:"apiKey"`
+	Recoveries   int  `json:"recoveries"`
+}
+
+// AuthRecovery is the last attempt to recover from a failed authentication.
+type AuthRecovery struct {
+	Method    string    `json:"method"`
+	At        time.Time `json:"at"`
+	Succeeded bool      `json:"succeeded"`
+	Error     string    `json:"error,omitempty"`
+	Cause     string    `json:"cause,omitempty"`
+}
+
+// authenticator recovers the CLI from failed authentications. It is shared
+// by the copies of headlessBackend, which add its environment to every CLI
+// process.
+type authenticator struct {
+	cfg    ReauthConfig
+	home   string
+	client *http.Client
+
+	mu           sync.Mutex
+	apiKeyActive bool
+	recoveries   int
+	last         *AuthRecovery
+}
+
+func newAuthenticator(cfg ReauthConfig, home string) *authenticator {
+	if cfg.TokenURL == "" {
+		cfg.TokenURL = defaultOAuthTokenURL
+	}
+	return &authenticator{cfg: cfg, home: home, client: &http.Client{Timeout: 30 * time.Second}}
+}
+
+// env returns the variables the CLI needs for the credentials recovered so
+// far.
+func (a *authenticator) env() []string {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.apiKeyActive {
+		return []string{"GEMINI_API_KEY=" + a.cfg.APIKey}
+	}
+	return nil
+}
+
+// recover makes the CLI ready to authenticate again after cause. It
+// returns false when the question should fail with cause because the
+// recovery, or one within reauthCooldown, failed.
+func (a *authenticator) recover(ctx context.Context, cause error) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.last != nil && time.Since(a.last.At) < reauthCooldown {
+		// Questions that failed alongside the one that triggered the last
+		// recovery share its outcome.
+		return a.last.Succeeded
+	}
+
+	recovery := &AuthRecovery{Method: reauthRestart, At: time.Now(), Cause: cause.Error()}
+	var err error
+	switch {
+	case a.canRefresh():
+		recovery.Method = reauthOAuthRefresh
+		err = a.refreshOAuth(ctx)
+	case a.cfg.APIKey != "" && !a.apiKeyActive:
+		recovery.Method = reauthAPIKey
+		if err = writeSelectedAuthType(a.home, authAPIKeyType); err == nil {
+			a.apiKeyActive = true
+		}
+	}
+	a.recoveries++
+	a.last = recovery
+	if err != nil {
+		recovery.Error = err.Error()
+		slog.WarnContext(ctx, "gemini CLI re-authentication failed", "method", recovery.Method, "error", err)
+		return false
+	}
+	recovery.Succeeded = true
+	slog.InfoContext(ctx, "gemini CLI re-authenticated; asking again", "method", recovery.Method, "cause", cause)
+	return true
+}
+
+// finish records whether the question asked again after the last recovery
+// authenticated.
+func (a *authenticator) finish(err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.last == nil {
+		return
+	}
+	a.last.Succeeded = !errors.Is(err, ErrAuthentication)
+	if err != nil && !a.last.Succeeded {
+		a.last.Error = err.Error()
+	}
+}
+
+// canRefresh reports whether the cached OAuth token can be refreshed. The
+// caller holds a.mu.
+func (a *authenticator) canRefresh() bool {
+	if a.cfg.OAuthClientID == "" || a.cfg.OAuthClientSecret == "" {
+		return false
+	}
+	creds, err := readOAuthCreds(a.home)
+	return err == nil && creds.refreshToken() != ""
+}
+
+// refreshOAuth exchanges the cached refresh token for a new access token
+// and stores it where the CLI reads it.
+func (a *authenticator) refreshOAuth(ctx context.Context) error {
+	creds, err := readOAuthCreds(a.home)
+	if err != nil {
+		return err
+	}
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {creds.refreshToken()},
+		"client_id":     {a.cfg.OAuthClientID},
+		"client_secret": {a.cfg.OAuthClientSecret},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.cfg.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("refresh OAuth token: %w", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("refresh OAuth token: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+		IDToken     string `json:"id_token"`
+		Scope       string `json:"scope"`
+		TokenType   string `json:"token_type"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil || token.AccessToken == "" {
+		return errors.New("refresh OAuth token: the token endpoint returned no access token")
+	}
+
+	creds["access_token"] = token.AccessToken
+	creds["expiry_date"] = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second).UnixMilli()
+	for key, value := range map[string]string{"id_token": token.IDToken, "scope": token.Scope, "token_type": token.TokenType} {
+		if value != "" {
+			creds[key] = value
+		}
+	}
+	payload, err := json.MarshalIndent(creds, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(oauthCredsPath(a.home), append(payload, '\n'), 0o600)
+}
+
+// status adds what the authenticator knows to st.
+func (a *authenticator) status(st *AuthStatus) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	st.APIKeyActive = a.apiKeyActive
+	st.Reauth = &ReauthStatus{
+		OAuthRefresh: a.cfg.OAuthClientID != "" && a.cfg.OAuthClientSecret != "",
+		APIKey:       a.cfg.APIKey != "",
+		Recoveries:   a.recoveries,
+	}
+	if a.last != nil {
+		last := *a.last
+		st.LastRecovery = &last
+	}
+}
+
+// reauthenticate reports whether a CLI attempt that failed with err should
+// be asked again because the credentials were recovered.
+func (s *GeminiService) reauthenticate(ctx context.Context, err error) bool {
+	if s.auth == nil || ctx.Err() != nil || !errors.Is(err, ErrAuthentication) {
+		return false
+	}
+	return s.auth.recover(ctx, err)
+}
+
+// AuthStatus reports how the CLI authenticates, when its cached OAuth token
+// expires, how the last recovery from a failed authentication went and how
+// healthy the keys of the API key pool are.
+func (s *GeminiService) AuthStatus() (AuthStatus, error) {
+	var st AuthStatus
+	method, err := selectedAuthType(s.cliHomeDir())
+	if err != nil {
+		return st, err
+	}
+	st.Method = method
+	if creds, err := readOAuthCreds(s.cliHomeDir()); err == nil {
+		oauth := &OAuthStatus{HasRefreshToken: creds.refreshToken() != ""}
+		if expiry, ok := creds.expiry(); ok {
+			oauth.ExpiresAt = &expiry
+			oauth.Expired = time.Now().After(expiry)
+		}
+		st.OAuth = oauth
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return st, err
+	}
+	if s.auth != nil {
+		s.auth.status(&st)
+	}
+	if s.keys != nil {
+		st.Keys = s.keys.status()
+	}
+	return st, nil
+}
+
+// oauthCreds is the oauth_creds.json the CLI caches its sign-in in. It is
+// kept as a map so fields the wrapper does not know survive a refresh.
+type oauthCreds map[string]any
+
+func oauthCredsPath(home string) string {
+	return filepath.Join(home, ".gemini", "oauth_creds.json")
+}
+
+func readOAuthCreds(home string) (oauthCreds, error) {
+	raw, err := os.ReadFile(oauthCredsPath(home))
+	if err != nil {
+		return nil, err
+	}
+	creds := oauthCreds{}
+	if err := json.Unmarshal(raw, &creds); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", oauthCredsPath(home), err)
+	}
+	return creds, nil
+}
+
+func (c oauthCreds) refreshToken() string {
+	token, _ := c["refresh_token"].(string)
+	return token
+}
+
+// expiry reads expiry_date, in milliseconds since the epoch.
+func (c oauthCreds) expiry() (time.Time, bool) {
+	millis, ok := c["expiry_date"].(float64)
+	if !ok || millis <= 0 {
+		return time.Time{}, false
+	}
+	return time.UnixMilli(int64(millis)).UTC(), true
+}
+
+// selectedAuthType returns security.auth.selectedType of the CLI settings at
+// home.
+func selectedAuthType(home string) (string, error) {
+	settings, err := readSettings(settingsPath(home))
+	if err != nil {
+		return "", err
+	}
+	var security struct {
+		Auth struct {
+			SelectedType string `json:"selectedType"`
+		} `json:"auth"`
+	}
+	if raw, ok := settings["security"]; ok {
+		if err := json.Unmarshal(raw, &security); err != nil {
+			return "", fmt.Errorf("parse security settings: %w", err)
+		}
+	}
+	return security.Auth.SelectedType, nil
+}
+
+// writeSelectedAuthType sets security.auth.selectedType of the CLI settings
+// at home, keeping every other setting.
+func writeSelectedAuthType(home, authType string) error {
+	path := settingsPath(home)
+	settings, err := readSettings(path)
+	if err != nil {
+		return err
+	}
+	security := map[string]json.RawMessage{}
+	if raw, ok := settings["security"]; ok {
+		if err := json.Unmarshal(raw, &security); err != nil {
+			return fmt.Errorf("parse security settings of %s: %w", path, err)
+		}
+	}
+	auth := map[string]any{}
+	if raw, ok := security["auth"]; ok {
+		if err := json.Unmarshal(raw, &auth); err != nil {
+			return fmt.Errorf("parse auth settings of %s: %w", path, err)
+		}
+	}
+	auth["selectedType"] = authType
+	if security["auth"], err = json.Marshal(auth); err != nil {
+		return err
+	}
+	if settings["security"], err = json.Marshal(security); err != nil {
+		return err
+	}
+	payload, err := json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(payload, '\n'), 0o600)
+}
+
+// errAuthPrompt is the error of a CLI stopped at a sign-in prompt, which
+// never completes in a container.
+func errAuthPrompt() error {
+	return fmt.Errorf("%w: the CLI is waiting for an interactive sign-in; sign in again and update ~/.gemini", ErrAuthExpired)
+}
@@ -0,0 +1,62 @@
+package gemini
+
+import (
+	"context"
+	"maps"
+	"slices"
+
+	"gemini-wrapper/model"
+)
+
+// Backend runs a single generation attempt against one model. GeminiService
+// layers caching, request deduplication and model fallback on top of it.
+type Backend interface {
+	Name() string
+	Generate(ctx context.Context, question string, opts model.AskOptions) (string, *model.GeminiStatus, error)
+	Stream(ctx context.Context, question string, opts model.AskOptions, onChunk func(chunk string) error) (string, *model.GeminiStatus, error)
+}
+
+// newBackend returns the implementation for cfg.Backend, which must be a mode
+// returned by parseBackendMode.
+func newBackend(cfg Config) Backend {
+	switch cfg.Backend {
+	case backendMock:
+		return newMockBackend(cfg.Mock)
+	case backendAPI:
+		return newAPIBackend(cfg.APIFallback, cfg.CLIHome)
+	default:
+		backend := headlessBackend{cliPath: cfg.CLIPath, cliHome: cfg.CLIHome, streamSentinel: cfg.StreamSentinel, streamJSON: cfg.StreamFormat == streamFormatJSON, stateless: cfg.Stateless, patterns: newCLIPatterns(cfg.CLIPatterns)}
+		if cfg.Reauth.Enabled {
+			backend.auth = newAuthenticator(cfg.Reauth, cfg.CLIHome)
+		}
+		for _, key := range slices.Sorted(maps.Keys(cfg.CLIEnv)) {
+			backend.cliEnv = append(backend.cliEnv, key+"="+cfg.CLIEnv[key])
+		}
+		return backend
+	}
+}
+
+// headlessBackend invokes `gemini --prompt ...` once per attempt. The zero
+// value runs `gemini` from PATH with HOME=/app.
+type headlessBackend struct {
+	cliPath string
+	cliHome string
+	cliEnv  []string
+	// streamSentinel ends streams at a marker the CLI is asked to print.
+	streamSentinel bool
+	// streamJSON streams answers from the events of stream-json output
+	// instead of the text the CLI prints.
+	streamJSON bool
+	// stateless runs every question outside a workspace in an empty
+	// directory of its own.
+	stateless bool
+	// auth recovers from failed authentications; nil disables that.
+	auth *authenticator
+	// patterns recognise the prompts and banners of the CLI version in
+	// use; nil uses the built-in set.
+	patterns *cliPatterns
+}
+
+func (headlessBackend) Name() string {
+	return backendHeadless
+}
@@ -0,0 +1,206 @@
+package gemini
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"gemini-wrapper/metrics"
+	"gemini-wrapper/model"
+)
+
+// CircuitOpenCode is the status code reported while the circuit is open.
+const CircuitOpenCode = "CIRCUIT_OPEN"
+
+// circuitProbePrompt is the cheap question used to test whether the upstream
+// recovered.
+const circuitProbePrompt = "Reply with the single word OK."
+
+// BreakerConfig controls the circuit breaker that fast-fails requests while
+// the upstream keeps failing.
+type BreakerConfig struct {
+	// FailureThreshold is the number of consecutive failed questions that opens
+	// the circuit. 0 disables the breaker.
+	FailureThreshold int `yaml:"failure_threshold"`
+	// Cooldown is the wait between probes while the circuit is open.
+	Cooldown     time.Duration `yaml:"cooldown"`
+	ProbeTimeout time.Duration `yaml:"probe_timeout"`
+}
+
+// CircuitOpenError is returned without contacting the upstream while the
+// circuit is open.
+type CircuitOpenError struct {
+	Reason     string
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("upstream circuit is open after repeated failures (last error: %s)", e.Reason)
+}
+
+// CircuitStatus is the breaker state reported by health endpoints.
+type CircuitStatus struct {
+	State               string     `json:"state"`
+	ConsecutiveFailures int        `json:"consecutiveFailures"`
+	OpenedAt            *time.Time `json:"openedAt,omitempty"`
+	Reason              string     `json:"reason,omitempty"`
+}
+
+type breaker struct {
+	cfg BreakerConfig
+
+	mu                  sync.Mutex
+	consecutiveFailures int
+	open                bool
+	openedAt            time.Time
+	nextProbeAt         time.Time
+	reason              string
+}
+
+func newBreaker(cfg BreakerConfig) *breaker {
+	if cfg.FailureThreshold <= 0 {
+		return nil
+	}
+	return &breaker{cfg: cfg}
+}
+
+// allow returns a *CircuitOpenError while the circuit is open. A nil breaker
+// allows everything.
+func (b *breaker) allow() error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.open {
+		return nil
+	}
+	return &CircuitOpenError{Reason: b.reason, RetryAfter: max(time.Until(b.nextProbeAt), time.Second)}
+}
+
+// record feeds the result of one question into the breaker and reports
+// whether it opened the circuit.
+func (b *breaker) record(err error) bool {
+	if b == nil || (err != nil && !countsAsUpstreamFailure(err)) {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		b.consecutiveFailures = 0
+		return false
+	}
+	b.consecutiveFailures++
+	if b.open || b.consecutiveFailures < b.cfg.FailureThreshold {
+		return false
+	}
+	b.open = true
+	b.openedAt = time.Now()
+	b.nextProbeAt = b.openedAt.Add(b.cfg.Cooldown)
+	b.reason = err.Error()
+	return true
+}
+
+// probed records the result of a probe and reports whether the circuit closed.
+func (b *breaker) probed(err error) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err != nil {
+		b.reason = err.Error()
+		b.nextProbeAt = time.Now().Add(b.cfg.Cooldown)
+		return false
+	}
+	b.open = false
+	b.consecutiveFailures = 0
+	b.reason = ""
+	return true
+}
+
+func (b *breaker) status() CircuitStatus {
+	if b == nil {
+		return CircuitStatus{State: "disabled"}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	status := CircuitStatus{State: "closed", ConsecutiveFailures: b.consecutiveFailures}
+	if b.open {
+		openedAt := b.openedAt
+		status.State = "open"
+		status.OpenedAt = &openedAt
+		status.Reason = b.reason
+	}
+	return status
+}
+
+// countsAsUpstreamFailure leaves out errors that say nothing about the
+// upstream: clients going away, local backpressure, operator actions and
+// shutdown.
+func countsAsUpstreamFailure(err error) bool {
+	var queueErr *QueueFullError
+	var circuitErr *CircuitOpenError
+	return err != nil &&
+		!errors.Is(err, context.Canceled) &&
+		!errors.Is(err, ErrServiceClosed) &&
+		!errors.Is(err, ErrBackendRestarted) &&
+		!errors.Is(err, ErrQueueCleared) &&
+		!errors.Is(err, ErrRequestCancelled) &&
+		!errors.Is(err, ErrBackendStarting) &&
+		!errors.As(err, &queueErr) &&
+		!errors.As(err, &circuitErr)
+}
+
+// CircuitStatus returns the circuit breaker state.
+func (s *GeminiService) CircuitStatus() CircuitStatus {
+	return s.breaker.status()
+}
+
+// checkCircuit fast-fails with a 503 CIRCUIT_OPEN status while the circuit is open.
+func (s *GeminiService) checkCircuit() (*model.GeminiStatus, error) {
+	if err := s.breaker.allow(); err != nil {
+		metrics.CircuitRejections.Inc()
+		return &model.GeminiStatus{HTTPStatus: http.StatusServiceUnavailable, Code: CircuitOpenCode, Message: err.Error()}, err
+	}
+	return nil, nil
+}
+
+// recordCircuit reports the outcome of a question and starts probing when it
+// opened the circuit. Timeouts the client chose itself are not counted.
+func (s *GeminiService) recordCircuit(ctx context.Context, err error) {
+	if errors.Is(context.Cause(ctx), errRequestedTimeout) {
+		return
+	}
+	if s.breaker.record(err) {
+		slog.WarnContext(ctx, "upstream circuit opened", "failures", s.breaker.cfg.FailureThreshold, "cooldown", s.breaker.cfg.Cooldown, "error", err)
+		go s.probeCircuit()
+	}
+}
+
+// probeCircuit asks circuitProbePrompt every cooldown until it succeeds, then
+// closes the circuit.
+func (s *GeminiService) probeCircuit() {
+	for {
+		timer := time.NewTimer(s.breaker.cfg.Cooldown)
+		select {
+		case <-timer.C:
+		case <-s.lifetime().Done():
+			timer.Stop()
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(s.lifetime(), s.breaker.cfg.ProbeTimeout)
+		_, _, err := s.generate(ctx, circuitProbePrompt, model.AskOptions{Model: s.defaultModel})
+		cancel()
+		if s.lifetime().Err() != nil {
+			return
+		}
+		if s.breaker.probed(err) {
+			slog.Info("upstream circuit closed after successful probe")
+			return
+		}
+		slog.Warn("upstream circuit probe failed", "error", err)
+	}
+}
@@ -0,0 +1,161 @@
+package gemini
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"gemini-wrapper/logging"
+	"gemini-wrapper/service/execution"
+)
+
+// ErrRequestCancelled is returned for questions cancelled by CancelRequest.
+var ErrRequestCancelled = errors.New("request cancelled by the client")
+
+// cancelWait bounds how long CancelRequest waits for a cancelled question
+// to stop: the CLI's grace period to exit after the interrupt, and a little
+// more.
+const cancelWait = cliInterruptGrace + time.Second
+
+// CancelledRequest reports a question stopped by CancelRequest.
+// PartialAnswer is the part of a streamed answer sent before it stopped;
+// answers that are not streamed have none.
+type CancelledRequest struct {
+	RequestID     string `json:"request_id"`
+	Cancelled     int    `json:"cancelled"`
+	PartialAnswer string `json:"partial_answer"`
+}
+
+// requestRegistry tracks the questions being answered by the ID of the HTTP
+// request that asked them. Several questions can share an ID, like those of
+// a batch.
+type requestRegistry struct {
+	mu       sync.Mutex
+	requests map[string][]*pendingRequest
+}
+
+type pendingRequest struct {
+	client string
+	cancel context.CancelCauseFunc
+	done   chan struct{}
+
+	mu      sync.Mutex
+	partial strings.Builder
+}
+
+func newRequestRegistry() *requestRegistry {
+	return &requestRegistry{requests: map[string][]*pendingRequest{}}
+}
+
+// begin registers the question asked with ctx under its request ID. The
+// returned context is cancelled with ErrRequestCancelled by cancel; finish
+// unregisters the question. Contexts without a request ID and a nil
+// registry are not tracked.
+func (r *requestRegistry) begin(ctx context.Context) (context.Context, *pendingRequest, func()) {
+	id := logging.RequestID(ctx)
+	if r == nil || id == "" {
+		return ctx, nil, func() {}
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	req := &pendingRequest{client: execution.Client(ctx), cancel: cancel, done: make(chan struct{})}
+	r.mu.Lock()
+	r.requests[id] = append(r.requests[id], req)
+	r.mu.Unlock()
+	return ctx, req, func() {
+		r.mu.Lock()
+		pending := r.requests[id]
+		for i, other := range pending {
+			if other == req {
+				pending = append(pending[:i:i], pending[i+1:]...)
+				break
+			}
+		}
+		if len(pending) == 0 {
+			delete(r.requests, id)
+		} else {
+			r.requests[id] = pending
+		}
+		r.mu.Unlock()
+		cancel(nil)
+		close(req.done)
+	}
+}
+
+// cancel stops the questions of request id asked by client and waits up to
+// cancelWait for them to stop. It returns false when there are none.
+func (r *requestRegistry) cancel(id, client string) (CancelledRequest, bool) {
+	if r == nil {
+		return CancelledRequest{}, false
+	}
+	r.mu.Lock()
+	var matched []*pendingRequest
+	for _, req := range r.requests[id] {
+		if req.client == client {
+			matched = append(matched, req)
+		}
+	}
+	r.mu.Unlock()
+	if len(matched) == 0 {
+		return CancelledRequest{}, false
+	}
+
+	for _, req := range matched {
+		req.cancel(ErrRequestCancelled)
+	}
+	wait, stop := context.WithTimeout(context.Background(), cancelWait)
+	defer stop()
+	result := CancelledRequest{RequestID: id, Cancelled: len(matched)}
+	for _, req := range matched {
+		select {
+		case <-req.done:
+		case <-wait.Done():
+			slog.Warn("cancelled request is still stopping", "request_id", id)
+		}
+		result.PartialAnswer += req.answered()
+	}
+	return result, true
+}
+
+// chunks wraps onChunk to keep what it is sent as the partial answer.
+func (p *pendingRequest) chunks(onChunk func(chunk string) error) func(chunk string) error {
+	if p == nil {
+		return onChunk
+	}
+	return func(chunk string) error {
+		p.mu.Lock()
+		p.partial.WriteString(chunk)
+		p.mu.Unlock()
+		return onChunk(chunk)
+	}
+}
+
+func (p *pendingRequest) answered() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.partial.String()
+}
+
+// cancelCause returns ErrRequestCancelled when err is the result of
+// CancelRequest stopping the question asked with ctx, and err otherwise.
+func cancelCause(ctx context.Context, err error) error {
+	if err != nil && errors.Is(context.Cause(ctx), ErrRequestCancelled) {
+		return ErrRequestCancelled
+	}
+	return err
+}
+
+// CancelRequest stops the questions asked by client in the HTTP request
+// with ID requestID, interrupting their CLI processes or dropping them from
+// the queue, and returns what they had answered. It waits briefly for them
+// to release their workers. It returns false when client has no such
+// question in progress.
+func (s *GeminiService) CancelRequest(requestID, client string) (CancelledRequest, bool) {
+	result, ok := s.requests.cancel(requestID, client)
+	if ok {
+		slog.Info("request cancelled", "cancelled_request_id", requestID, "questions", result.Cancelled)
+	}
+	return result, ok
+}
@@ -0,0 +1,59 @@
+package gemini
+
+import "slices"
+
+// Capabilities describes how the service is configured, for clients that
+// check they are compatible with it.
+type Capabilities struct {
+	Backend string `json:"backend"`
+	// CLIVersion is what `gemini --version` printed at the last successful
+	// probe of the CLI backend.
+	CLIVersion     string   `json:"cliVersion,omitempty"`
+	DefaultModel   string   `json:"defaultModel,omitempty"`
+	FallbackModels []string `json:"fallbackModels,omitempty"`
+	// Models are the advertised models; AllowedModels, when set, are the
+	// only ones clients may request.
+	Models        []string `json:"models"`
+	AllowedModels []string `json:"allowedModels,omitempty"`
+	// Features names the optional behaviours of the service that are on.
+	Features []string `json:"features"`
+}
+
+// Capabilities reports the backend, CLI version, models and optional
+// features of the service.
+func (s *GeminiService) Capabilities() Capabilities {
+	health := s.Health()
+	caps := Capabilities{
+		Backend:        health.Backend,
+		DefaultModel:   s.defaultModel,
+		FallbackModels: append([]string(nil), s.fallbackModels...),
+		Models:         SupportedModels(),
+		AllowedModels:  s.AllowedModels(),
+		Features:       []string{},
+	}
+	if health.Backend == backendHeadless {
+		caps.CLIVersion = health.Version
+	}
+	headless, _ := s.backend.(headlessBackend)
+	for feature, on := range map[string]bool{
+		"api_fallback": s.apiBackend != nil,
+		"api_key_pool": s.keys != nil,
+		"cache":        s.cacheEnabled,
+		"disk_cache":   s.cacheEnabled && s.diskCacheEnabled,
+		"shared_cache": s.cacheEnabled && s.sharedCache != nil,
+		"dedupe":       s.dedupeEnabled,
+		"grounding":    s.grounding,
+		"mcp_servers":  len(s.mcpServers) > 0,
+		"postprocess":  len(s.postprocessor.Names()) > 0,
+		"reauth":       s.auth != nil,
+		"sandbox":      s.execution.Sandbox,
+		"json_repair":  s.jsonRepairAttempts > 0,
+		"stream_json":  headless.streamJSON,
+	} {
+		if on {
+			caps.Features = append(caps.Features, feature)
+		}
+	}
+	slices.Sort(caps.Features)
+	return caps
+}
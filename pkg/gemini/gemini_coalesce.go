@@ -0,0 +1,111 @@
+package gemini
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"gemini-wrapper/metrics"
+	"gemini-wrapper/model"
+)
+
+// coalesceKey identifies the questions that may share one generation: the
+// same model, options and prompt, whatever whitespace the prompt has, so a
+// frontend retrying a question while the first attempt is pending waits for
+// that attempt instead of starting another.
+func (s *GeminiService) coalesceKey(question string, opts model.AskOptions) string {
+	return s.buildCacheKey(strings.Join(strings.Fields(question), " "), opts.Model, optionsVariant(opts))
+}
+
+// streamFlight is a streamed answer shared by identical questions asked at
+// the same time. It keeps the chunks sent so far, so callers that join late
+// get them first.
+type streamFlight struct {
+	// ctx is the context of the shared generation.
+	ctx context.Context
+
+	mu     sync.Mutex
+	chunks []string
+	// changed is closed, and replaced, when a chunk arrives or the flight
+	// ends.
+	changed chan struct{}
+	done    bool
+	result  askExecutionResult
+}
+
+func (f *streamFlight) send(chunk string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.chunks = append(f.chunks, chunk)
+	close(f.changed)
+	f.changed = make(chan struct{})
+	return nil
+}
+
+func (f *streamFlight) finish(result askExecutionResult) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.done, f.result = true, result
+	close(f.changed)
+}
+
+// coalesceStream runs generate for the streamed question key, or joins the
+// generation already running for it, and sends onChunk every chunk of it.
+// Like Ask, the generation runs on a flight context that is cancelled only
+// once every caller has gone away; a caller whose onChunk fails leaves.
+func (s *GeminiService) coalesceStream(ctx context.Context, key string, onChunk func(chunk string) error, generate func(ctx context.Context, onChunk func(chunk string) error) (string, *model.GeminiStatus, error)) (string, *model.GeminiStatus, error) {
+	key = "stream\n" + key
+	flightCtx, leave := s.joinFlight(ctx, key)
+	defer leave()
+
+	s.flightMu.Lock()
+	if s.streams == nil {
+		s.streams = map[string]*streamFlight{}
+	}
+	flight, joined := s.streams[key]
+	// A flight whose callers all left is ending with their cancellation.
+	if joined && flight.ctx.Err() != nil {
+		joined = false
+	}
+	if !joined {
+		flight = &streamFlight{ctx: flightCtx, changed: make(chan struct{})}
+		s.streams[key] = flight
+		go func() {
+			answer, status, err := generate(flightCtx, flight.send)
+			s.flightMu.Lock()
+			if s.streams[key] == flight {
+				delete(s.streams, key)
+			}
+			s.flightMu.Unlock()
+			flight.finish(askExecutionResult{answer: answer, status: status, err: err})
+		}()
+	}
+	s.flightMu.Unlock()
+	if joined {
+		metrics.CoalescedRequests.Inc("stream")
+	}
+
+	sent := 0
+	for {
+		flight.mu.Lock()
+		chunks, done, result, changed := flight.chunks[sent:], flight.done, flight.result, flight.changed
+		flight.mu.Unlock()
+		for _, chunk := range chunks {
+			if err := onChunk(chunk); err != nil {
+				return "", nil, err
+			}
+		}
+		sent += len(chunks)
+		if done {
+			if joined {
+				return result.answer, coalescedStatus(result.status), result.err
+			}
+			return result.answer, result.status, result.err
+		}
+		select {
+		case <-ctx.Done():
+			return "", nil, ctx.Err()
+		case <-changed:
+		}
+	}
+}
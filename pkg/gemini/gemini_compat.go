@@ -0,0 +1,53 @@
+package gemini
+
+import (
+	"strings"
+	"sync"
+
+	"gemini-wrapper/model"
+)
+
+// ModelAliases maps the model names clients of the OpenAI, Anthropic and
+// Ollama APIs ask for to Gemini models. Aliases match regardless of case.
+// The zero value has no aliases and is ready to use.
+type ModelAliases struct {
+	mu      sync.RWMutex
+	aliases map[string]string
+}
+
+// Set replaces the aliases with aliases, given as alias to model.
+func (a *ModelAliases) Set(aliases map[string]string) {
+	normalized := make(map[string]string, len(aliases))
+	for alias, target := range aliases {
+		alias = strings.ToLower(strings.TrimSpace(alias))
+		if target = strings.TrimSpace(target); alias != "" && target != "" {
+			normalized[alias] = target
+		}
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.aliases = normalized
+}
+
+// Lookup returns the model the alias name stands for.
+func (a *ModelAliases) Lookup(name string) (string, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	target, ok := a.aliases[strings.ToLower(name)]
+	return target, ok
+}
+
+// LocalRejection returns the message of a status the wrapper answered
+// itself: a full queue, an open circuit or a model outside the allowlist.
+// Unlike the details of upstream errors, it tells clients why they were
+// turned away and is theirs to see.
+func LocalRejection(status *model.GeminiStatus) (string, bool) {
+	if status == nil {
+		return "", false
+	}
+	switch status.Code {
+	case QueueFullCode, CircuitOpenCode, ModelNotSupportedCode:
+		return status.Message, true
+	}
+	return "", false
+}
@@ -0,0 +1,348 @@
+package gemini
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultCLIPath = "gemini"
+	defaultCLIHome = "/app"
+)
+
+// Config holds the settings of GeminiService. Zero durations and sizes fall
+// back to the defaults of DefaultConfig.
+type Config struct {
+	// Backend is "headless" (default), "api" or "mock". The api backend
+	// authenticates with the key of APIFallback.
+	Backend string `yaml:"backend"`
+	// Mock scripts the answers of the mock backend.
+	Mock MockConfig `yaml:"mock"`
+	// CLIPath is the gemini executable, looked up in PATH unless absolute.
+	CLIPath string `yaml:"cli_path"`
+	// CLIHome is used as HOME and XDG_CONFIG_HOME of the CLI process, where it
+	// keeps its credentials under .gemini.
+	CLIHome string `yaml:"cli_home"`
+	// CLIEnv adds variables to the CLI process environment.
+	CLIEnv map[string]string `yaml:"cli_env"`
+	// CLIPatterns add to or replace the built-in sets of prompts and banners
+	// the CLI prints, chosen by the version the CLI reports.
+	CLIPatterns []CLIPatterns `yaml:"cli_patterns"`
+	// MCPServers are merged into the mcpServers of the CLI's settings.json
+	// under CLIHome at startup, replacing entries of the same name.
+	MCPServers map[string]MCPServer `yaml:"mcp_servers"`
+	// DefaultModel is used when a request names no model. Empty lets the CLI pick.
+	DefaultModel   string   `yaml:"default_model"`
+	FallbackModels []string `yaml:"fallback_models"`
+	// ClientPriorities sets the default priority class ("high", "normal" or
+	// "low") of clients named like "key:<label>" or "ip:<address>".
+	ClientPriorities map[string]string `yaml:"client_priorities"`
+	// JSONRepairAttempts is how often an answer that does not match its
+	// response schema is asked again before the request fails.
+	JSONRepairAttempts int `yaml:"json_repair_attempts"`
+	// StreamSentinel asks the CLI to end streamed answers with a unique
+	// marker and stops reading at the marker instead of at process exit.
+	StreamSentinel bool `yaml:"stream_sentinel"`
+	// StreamFormat is "text" (default), streaming the answer line by line,
+	// or "stream-json", streaming it as the model produces it. stream-json
+	// needs a CLI that supports it and ends answers without a sentinel.
+	StreamFormat string `yaml:"stream_format"`
+	// Stateless runs every question that has no workspace in a fresh, empty
+	// directory, so files the CLI writes and the state it keeps per project
+	// directory never reach another question.
+	Stateless bool `yaml:"stateless"`
+	// Grounding lets questions that do not say otherwise search Google
+	// before answering.
+	Grounding bool `yaml:"grounding"`
+	// AllowedModels restricts the models clients may request. Empty allows any.
+	AllowedModels  []string      `yaml:"allowed_models"`
+	PoolSize       int           `yaml:"pool_size"`
+	QueueSize      int           `yaml:"queue_size"`
+	HealthInterval time.Duration `yaml:"health_interval"`
+	ProbeTimeout   time.Duration `yaml:"probe_timeout"`
+	// Pacing delays CLI attempts to stay under the account's rate limit.
+	Pacing PacingConfig `yaml:"pacing"`
+	// SelfTest asks the CLI a question before the service reports ready.
+	SelfTest SelfTestConfig `yaml:"self_test"`
+	// Shadow mirrors questions to a second backend or model for comparison.
+	Shadow ShadowConfig `yaml:"shadow"`
+	// RequestTimeout bounds a question that sets no timeout of its own.
+	// MaxRequestTimeout caps the timeouts clients may ask for.
+	RequestTimeout    time.Duration `yaml:"request_timeout"`
+	MaxRequestTimeout time.Duration `yaml:"max_request_timeout"`
+	Retry             RetryConfig   `yaml:"retry"`
+	Breaker           BreakerConfig `yaml:"breaker"`
+	Cache             CacheConfig   `yaml:"cache"`
+	// APIFallback answers through the Gemini REST API when the CLI cannot.
+	APIFallback APIFallbackConfig `yaml:"api_fallback"`
+	// Reauth recovers the CLI when its credentials expire.
+	Reauth ReauthConfig `yaml:"reauth"`
+	// APIKeys is a pool of Gemini API keys the CLI takes turns with, each in
+	// a CLI home of its own. A key that runs out of quota is passed over for
+	// KeyCooldown and the question is asked again with the next key.
+	APIKeys     []string      `yaml:"api_keys"`
+	KeyCooldown time.Duration `yaml:"key_cooldown"`
+}
+
+type CacheConfig struct {
+	Enabled             bool          `yaml:"enabled"`
+	TTL                 time.Duration `yaml:"ttl"`
+	MaxEntries          int           `yaml:"max_entries"`
+	Dedupe              bool          `yaml:"dedupe"`
+	DiskEnabled         bool          `yaml:"disk_enabled"`
+	DiskPath            string        `yaml:"disk_path"`
+	DiskCleanupInterval time.Duration `yaml:"disk_cleanup_interval"`
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Backend:           backendHeadless,
+		CLIPath:           defaultCLIPath,
+		CLIHome:           defaultCLIHome,
+		PoolSize:          4,
+		QueueSize:         32,
+		HealthInterval:    60 * time.Second,
+		ProbeTimeout:      defaultProbeTimeout,
+		RequestTimeout:    90 * time.Second,
+		MaxRequestTimeout: 10 * time.Minute,
+		SelfTest: SelfTestConfig{
+			Prompt:   defaultSelfTestPrompt,
+			Timeout:  defaultSelfTestTimeout,
+			Interval: defaultSelfTestInterval,
+		},
+		Shadow: ShadowConfig{
+			SampleRate:  1,
+			MaxInFlight: defaultShadowMaxInFlight,
+			LogPath:     defaultShadowLogPath,
+		},
+		Retry: RetryConfig{
+			MaxRetries:     2,
+			InitialBackoff: time.Second,
+			MaxBackoff:     8 * time.Second,
+			Budget:         30 * time.Second,
+		},
+		Breaker: BreakerConfig{
+			FailureThreshold: 5,
+			Cooldown:         30 * time.Second,
+			ProbeTimeout:     60 * time.Second,
+		},
+		Cache: CacheConfig{
+			Enabled:             true,
+			TTL:                 30 * time.Minute,
+			MaxEntries:          5000,
+			Dedupe:              true,
+			DiskEnabled:         true,
+			DiskPath:            "/app/cache/gemini-cache.db",
+			DiskCleanupInterval: 7 * 24 * time.Hour,
+		},
+		APIFallback: APIFallbackConfig{
+			BaseURL:    defaultAPIBaseURL,
+			Multimodal: true,
+		},
+		JSONRepairAttempts: 2,
+		StreamSentinel:     true,
+		StreamFormat:       streamFormatText,
+		Stateless:          true,
+		Reauth: ReauthConfig{
+			Enabled:  true,
+			TokenURL: defaultOAuthTokenURL,
+		},
+		KeyCooldown: defaultKeyCooldown,
+	}
+}
+
+// ApplyEnv overrides c with the environment variables that are set.
+func (c *Config) ApplyEnv() {
+	c.Backend = parseEnvString("GEMINI_BACKEND", c.Backend)
+	c.Mock.FixturesFile = parseEnvString("GEMINI_MOCK_FIXTURES", c.Mock.FixturesFile)
+	c.Mock.Latency = parseEnvMillis("GEMINI_MOCK_LATENCY_MS", c.Mock.Latency)
+	c.Mock.Jitter = parseEnvMillis("GEMINI_MOCK_JITTER_MS", c.Mock.Jitter)
+	c.Mock.ChunkDelay = parseEnvMillis("GEMINI_MOCK_CHUNK_DELAY_MS", c.Mock.ChunkDelay)
+	c.Mock.ErrorRate = parseEnvRatio("GEMINI_MOCK_ERROR_RATE", c.Mock.ErrorRate)
+	c.Mock.ErrorStatus = parseEnvInt("GEMINI_MOCK_ERROR_STATUS", c.Mock.ErrorStatus)
+	c.CLIPath = parseEnvString("GEMINI_CLI_PATH", c.CLIPath)
+	c.CLIHome = parseEnvString("GEMINI_CLI_HOME", c.CLIHome)
+	c.DefaultModel = parseEnvString("GEMINI_DEFAULT_MODEL", c.DefaultModel)
+	if raw := strings.TrimSpace(os.Getenv("FALLBACK_MODEL")); raw != "" {
+		c.FallbackModels = parseFallbackModels(raw)
+	}
+	if raw := strings.TrimSpace(os.Getenv("GEMINI_ALLOWED_MODELS")); raw != "" {
+		c.AllowedModels = parseFallbackModels(raw)
+	}
+	if raw := strings.TrimSpace(os.Getenv("GEMINI_CLIENT_PRIORITIES")); raw != "" {
+		c.ClientPriorities = parseEnvMap(raw)
+	}
+	c.PoolSize = parseEnvInt("GEMINI_POOL_SIZE", c.PoolSize)
+	c.QueueSize = parseEnvInt("GEMINI_QUEUE_SIZE", c.QueueSize)
+	c.HealthInterval = parseEnvSeconds("GEMINI_HEALTH_INTERVAL_SECONDS", c.HealthInterval)
+	c.ProbeTimeout = parseEnvSeconds("GEMINI_PROBE_TIMEOUT_SECONDS", c.ProbeTimeout)
+	c.Pacing.RequestsPerMinute = parseEnvInt("GEMINI_REQUESTS_PER_MINUTE", c.Pacing.RequestsPerMinute)
+	c.Pacing.Burst = parseEnvInt("GEMINI_PACING_BURST", c.Pacing.Burst)
+	c.SelfTest.Enabled = parseEnvBool("GEMINI_SELF_TEST", c.SelfTest.Enabled)
+	c.SelfTest.Prompt = parseEnvString("GEMINI_SELF_TEST_PROMPT", c.SelfTest.Prompt)
+	c.SelfTest.Timeout = parseEnvSeconds("GEMINI_SELF_TEST_TIMEOUT_SECONDS", c.SelfTest.Timeout)
+	c.SelfTest.Interval = parseEnvSeconds("GEMINI_SELF_TEST_INTERVAL_SECONDS", c.SelfTest.Interval)
+	c.Shadow.Enabled = parseEnvBool("GEMINI_SHADOW", c.Shadow.Enabled)
+	c.Shadow.Backend = parseEnvString("GEMINI_SHADOW_BACKEND", c.Shadow.Backend)
+	c.Shadow.Model = parseEnvString("GEMINI_SHADOW_MODEL", c.Shadow.Model)
+	c.Shadow.SampleRate = parseEnvRatio("GEMINI_SHADOW_SAMPLE_RATE", c.Shadow.SampleRate)
+	c.Shadow.MaxInFlight = parseEnvInt("GEMINI_SHADOW_MAX_IN_FLIGHT", c.Shadow.MaxInFlight)
+	c.Shadow.LogPath = parseEnvString("GEMINI_SHADOW_LOG_PATH", c.Shadow.LogPath)
+	c.RequestTimeout = parseEnvSeconds("GEMINI_REQUEST_TIMEOUT_SECONDS", c.RequestTimeout)
+	c.MaxRequestTimeout = parseEnvSeconds("GEMINI_MAX_REQUEST_TIMEOUT_SECONDS", c.MaxRequestTimeout)
+	c.JSONRepairAttempts = parseEnvCount("GEMINI_JSON_REPAIR_ATTEMPTS", c.JSONRepairAttempts)
+	c.StreamSentinel = parseEnvBool("GEMINI_STREAM_SENTINEL", c.StreamSentinel)
+	c.StreamFormat = parseEnvString("GEMINI_STREAM_FORMAT", c.StreamFormat)
+	c.Stateless = parseEnvBool("GEMINI_STATELESS", c.Stateless)
+	c.Grounding = parseEnvBool("GEMINI_GROUNDING", c.Grounding)
+	c.Retry.MaxRetries = parseEnvCount("GEMINI_RETRY_MAX_RETRIES", c.Retry.MaxRetries)
+	c.Retry.InitialBackoff = parseEnvMillis("GEMINI_RETRY_INITIAL_BACKOFF_MS", c.Retry.InitialBackoff)
+	c.Retry.MaxBackoff = parseEnvMillis("GEMINI_RETRY_MAX_BACKOFF_MS", c.Retry.MaxBackoff)
+	c.Retry.Budget = parseEnvSeconds("GEMINI_RETRY_BUDGET_SECONDS", c.Retry.Budget)
+	c.Breaker.FailureThreshold = parseEnvCount("GEMINI_BREAKER_THRESHOLD", c.Breaker.FailureThreshold)
+	c.Breaker.Cooldown = parseEnvSeconds("GEMINI_BREAKER_COOLDOWN_SECONDS", c.Breaker.Cooldown)
+	c.Breaker.ProbeTimeout = parseEnvSeconds("GEMINI_BREAKER_PROBE_TIMEOUT_SECONDS", c.Breaker.ProbeTimeout)
+
+	c.Cache.Enabled = parseEnvBool("CACHE_ENABLED", c.Cache.Enabled)
+	c.Cache.TTL = parseEnvSeconds("CACHE_TTL_SECONDS", c.Cache.TTL)
+	c.Cache.MaxEntries = parseEnvInt("CACHE_MAX_ENTRIES", c.Cache.MaxEntries)
+	c.Cache.Dedupe = parseEnvBool("CACHE_DEDUPE_ENABLED", c.Cache.Dedupe)
+	c.Cache.DiskEnabled = parseEnvBool("CACHE_DISK_ENABLED", c.Cache.DiskEnabled)
+	c.Cache.DiskPath = parseEnvString("CACHE_DISK_PATH", c.Cache.DiskPath)
+	c.Cache.DiskCleanupInterval = parseEnvSeconds("CACHE_DISK_CLEANUP_INTERVAL_SECONDS", c.Cache.DiskCleanupInterval)
+
+	c.APIFallback.Enabled = parseEnvBool("GEMINI_API_FALLBACK", c.APIFallback.Enabled)
+	c.APIFallback.APIKey = parseEnvString("GEMINI_API_FALLBACK_KEY", c.APIFallback.APIKey)
+	if c.APIFallback.APIKey == "" {
+		// GEMINI_API_KEY is the key the Gemini tooling reads by default.
+		c.APIFallback.APIKey = parseEnvString("GEMINI_API_KEY", "")
+	}
+	c.APIFallback.BaseURL = parseEnvString("GEMINI_API_BASE_URL", c.APIFallback.BaseURL)
+	c.APIFallback.Multimodal = parseEnvBool("GEMINI_API_FALLBACK_MULTIMODAL", c.APIFallback.Multimodal)
+
+	c.Reauth.Enabled = parseEnvBool("GEMINI_REAUTH_ENABLED", c.Reauth.Enabled)
+	c.Reauth.OAuthClientID = parseEnvString("GEMINI_OAUTH_CLIENT_ID", c.Reauth.OAuthClientID)
+	c.Reauth.OAuthClientSecret = parseEnvString("GEMINI_OAUTH_CLIENT_SECRET", c.Reauth.OAuthClientSecret)
+	c.Reauth.TokenURL = parseEnvString("GEMINI_OAUTH_TOKEN_URL", c.Reauth.TokenURL)
+	c.Reauth.APIKey = parseEnvString("GEMINI_REAUTH_API_KEY", c.Reauth.APIKey)
+	if raw := strings.TrimSpace(os.Getenv("GEMINI_API_KEYS")); raw != "" {
+		c.APIKeys = parseFallbackModels(raw)
+	}
+	c.KeyCooldown = parseEnvSeconds("GEMINI_KEY_COOLDOWN_SECONDS", c.KeyCooldown)
+}
+
+// withDefaults fills zero values that would otherwise disable the service.
+func (c Config) withDefaults() Config {
+	defaults := DefaultConfig()
+	c.Backend = parseBackendMode(c.Backend)
+	c.StreamFormat = parseStreamFormat(c.StreamFormat)
+	if strings.TrimSpace(c.CLIPath) == "" {
+		c.CLIPath = defaults.CLIPath
+	}
+	if strings.TrimSpace(c.CLIHome) == "" {
+		c.CLIHome = defaults.CLIHome
+	}
+	c.DefaultModel = strings.TrimSpace(c.DefaultModel)
+	c.AllowedModels = normalizeModelNames(c.AllowedModels)
+	if c.PoolSize <= 0 {
+		c.PoolSize = defaults.PoolSize
+	}
+	if c.QueueSize <= 0 {
+		c.QueueSize = defaults.QueueSize
+	}
+	if c.HealthInterval <= 0 {
+		c.HealthInterval = defaults.HealthInterval
+	}
+	if c.ProbeTimeout <= 0 {
+		c.ProbeTimeout = defaults.ProbeTimeout
+	}
+	if strings.TrimSpace(c.SelfTest.Prompt) == "" {
+		c.SelfTest.Prompt = defaults.SelfTest.Prompt
+	}
+	if c.SelfTest.Timeout <= 0 {
+		c.SelfTest.Timeout = defaults.SelfTest.Timeout
+	}
+	if c.SelfTest.Interval <= 0 {
+		c.SelfTest.Interval = defaults.SelfTest.Interval
+	}
+	if c.Shadow.MaxInFlight <= 0 {
+		c.Shadow.MaxInFlight = defaults.Shadow.MaxInFlight
+	}
+	if strings.TrimSpace(c.Shadow.LogPath) == "" {
+		c.Shadow.LogPath = defaults.Shadow.LogPath
+	}
+	if c.RequestTimeout <= 0 {
+		c.RequestTimeout = defaults.RequestTimeout
+	}
+	if c.MaxRequestTimeout <= 0 {
+		c.MaxRequestTimeout = defaults.MaxRequestTimeout
+	}
+	c.MaxRequestTimeout = max(c.MaxRequestTimeout, c.RequestTimeout)
+	c.Retry.MaxRetries = max(c.Retry.MaxRetries, 0)
+	if c.Retry.InitialBackoff <= 0 {
+		c.Retry.InitialBackoff = defaults.Retry.InitialBackoff
+	}
+	c.Retry.MaxBackoff = max(c.Retry.MaxBackoff, c.Retry.InitialBackoff)
+	if c.Breaker.Cooldown <= 0 {
+		c.Breaker.Cooldown = defaults.Breaker.Cooldown
+	}
+	if c.Breaker.ProbeTimeout <= 0 {
+		c.Breaker.ProbeTimeout = defaults.Breaker.ProbeTimeout
+	}
+	if c.Cache.TTL <= 0 {
+		c.Cache.TTL = defaults.Cache.TTL
+	}
+	if c.Cache.MaxEntries <= 0 {
+		c.Cache.MaxEntries = defaults.Cache.MaxEntries
+	}
+	if strings.TrimSpace(c.Cache.DiskPath) == "" {
+		c.Cache.DiskPath = defaults.Cache.DiskPath
+	}
+	return c
+}
+
+func parseEnvString(key string, defaultValue string) string {
+	if raw := strings.TrimSpace(os.Getenv(key)); raw != "" {
+		return raw
+	}
+	return defaultValue
+}
+
+// parseEnvCount is parseEnvInt for settings where 0 is meaningful.
+func parseEnvCount(key string, defaultValue int) int {
+	parsed, err := strconv.Atoi(strings.TrimSpace(os.Getenv(key)))
+	if err != nil || parsed < 0 {
+		return defaultValue
+	}
+	return parsed
+}
+
+// parseEnvMap parses comma-separated "name=value" entries.
+func parseEnvMap(raw string) map[string]string {
+	entries := map[string]string{}
+	for _, field := range strings.Split(raw, ",") {
+		if name, value, ok := strings.Cut(field, "="); ok && strings.TrimSpace(name) != "" {
+			entries[strings.TrimSpace(name)] = strings.TrimSpace(value)
+		}
+	}
+	return entries
+}
+
+// parseEnvRatio accepts values from 0 to 1.
+func parseEnvRatio(key string, defaultValue float64) float64 {
+	parsed, err := strconv.ParseFloat(strings.TrimSpace(os.Getenv(key)), 64)
+	if err != nil || parsed < 0 || parsed > 1 {
+		return defaultValue
+	}
+	return parsed
+}
+
+func parseEnvMillis(key string, defaultValue time.Duration) time.Duration {
+	millis := parseEnvInt(key, 0)
+	if millis == 0 {
+		return defaultValue
+	}
+	return time.Duration(millis) * time.Millisecond
+}
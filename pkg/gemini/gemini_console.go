@@ -0,0 +1,176 @@
+package gemini
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"gemini-wrapper/pkg/terminal"
+)
+
+const (
+	// consoleBacklog is how many recent lines a new console subscriber
+	// receives before the live ones.
+	consoleBacklog = 200
+	// maxConsoleLine cuts longer lines, such as a large JSON answer, so the
+	// console never holds more than this per line.
+	maxConsoleLine = 16 << 10
+)
+
+// ConsoleLine is one line printed by a CLI process, as a terminal would show
+// it. Stream is "stdout" or "stderr"; PID may be missing on
+// the very first lines of a process.
+type ConsoleLine struct {
+	Time   time.Time `json:"time"`
+	CallID uint64    `json:"callId"`
+	PID    int       `json:"pid,omitempty"`
+	Stream string    `json:"stream"`
+	Text   string    `json:"text"`
+}
+
+// console fans the output of every CLI process out to the operators watching
+// /admin/console and keeps the last lines for those who connect later.
+type console struct {
+	mu          sync.Mutex
+	recent      []ConsoleLine
+	next        int
+	subscribers map[chan ConsoleLine]struct{}
+}
+
+func newConsole() *console {
+	return &console{subscribers: map[chan ConsoleLine]struct{}{}}
+}
+
+func (c *console) publish(line ConsoleLine) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.recent) < consoleBacklog {
+		c.recent = append(c.recent, line)
+	} else {
+		c.recent[c.next] = line
+		c.next = (c.next + 1) % consoleBacklog
+	}
+	for ch := range c.subscribers {
+		// A slow subscriber misses lines rather than stalling the CLI.
+		select {
+		case ch <- line:
+		default:
+		}
+	}
+}
+
+// subscribe returns the recent lines, oldest first, and a channel receiving
+// the following ones. cancel closes the channel. A nil console only closes it.
+func (c *console) subscribe(buffer int) ([]ConsoleLine, <-chan ConsoleLine, func()) {
+	ch := make(chan ConsoleLine, buffer)
+	if c == nil {
+		var once sync.Once
+		return nil, ch, func() { once.Do(func() { close(ch) }) }
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	backlog := append(append([]ConsoleLine(nil), c.recent[c.next:]...), c.recent[:c.next]...)
+	c.subscribers[ch] = struct{}{}
+	var once sync.Once
+	return backlog, ch, func() {
+		once.Do(func() {
+			c.mu.Lock()
+			delete(c.subscribers, ch)
+			c.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+// Console returns the last lines printed by the CLI processes and a channel
+// receiving the following ones until cancel is called. Lines are dropped for
+// a subscriber whose buffer is full.
+func (s *GeminiService) Console(buffer int) (backlog []ConsoleLine, lines <-chan ConsoleLine, cancel func()) {
+	var c *console
+	if s.calls != nil {
+		c = s.calls.console
+	}
+	return c.subscribe(buffer)
+}
+
+// consoleWriter publishes what a CLI process writes to one of its streams,
+// line by line. Output is rendered on a terminal screen, so spinners and
+// other redraws publish the line as last drawn.
+type consoleWriter struct {
+	console *console
+	call    *activeCall
+	stream  string
+
+	mu        sync.Mutex
+	screen    *terminal.Screen
+	published int
+}
+
+// consoleOutput returns the writer for stream of the CLI process run by the
+// call with ctx. It discards everything outside a registered call. Call flush
+// once the process has exited.
+func consoleOutput(ctx context.Context, stream string) *consoleWriter {
+	w := &consoleWriter{stream: stream}
+	if call, ok := ctx.Value(activeCallKey{}).(*activeCall); ok {
+		w.call, w.console = call, call.console
+		w.screen = terminal.NewScreen(0)
+	}
+	return w
+}
+
+func (w *consoleWriter) Write(p []byte) (int, error) {
+	if w.console == nil {
+		return len(p), nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, _ = w.screen.Write(p)
+	w.publish(w.screen.CursorRow())
+	return len(p), nil
+}
+
+// flush publishes the lines the cursor has not left yet.
+func (w *consoleWriter) flush() {
+	if w.console == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.publish(w.screen.Len())
+}
+
+// publish emits the lines before end that have not been published. A line
+// redrawn after it was published is not published again.
+func (w *consoleWriter) publish(end int) {
+	for ; w.published < end; w.published++ {
+		text := w.screen.Line(w.published)
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		if len(text) > maxConsoleLine {
+			text = strings.ToValidUTF8(text[:maxConsoleLine], "")
+		}
+		w.console.publish(ConsoleLine{
+			Time:   time.Now().UTC(),
+			CallID: w.call.info.ID,
+			PID:    int(w.call.pid.Load()),
+			Stream: w.stream,
+			Text:   text,
+		})
+	}
+}
+
+// lockedWriter serialises writes to w when the CLI's stdout and stderr are
+// copied into it by separate goroutines.
+type lockedWriter struct {
+	mu *sync.Mutex
+	w  io.Writer
+}
+
+func (l lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
+}
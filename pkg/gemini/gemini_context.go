@@ -0,0 +1,157 @@
+package gemini
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gemini-wrapper/model"
+)
+
+// contextFileName is the file the CLI reads persistent instructions from, in
+// its home for every run and in the directory it runs in for that run.
+const contextFileName = "GEMINI.md"
+
+// maxContextSize bounds a GEMINI.md set through the API. The CLI sends it
+// with every prompt, so a larger one mostly burns tokens.
+const maxContextSize = 1 << 20
+
+// ErrContextTooLarge is returned for a context larger than maxContextSize.
+var ErrContextTooLarge = errors.New("context exceeds 1 MiB")
+
+// ContextRefresh reports what a context refresh did: the context the next
+// CLI runs read and the cached answers dropped because they were made with
+// an older one.
+type ContextRefresh struct {
+	Context model.ContextFile `json:"context"`
+	Purged  CachePurgeResult  `json:"purged"`
+}
+
+func (s *GeminiService) cliHomeDir() string {
+	if s.cliHome == "" {
+		return defaultCLIHome
+	}
+	return s.cliHome
+}
+
+func (s *GeminiService) globalContextPath() string {
+	return filepath.Join(s.cliHomeDir(), ".gemini", contextFileName)
+}
+
+// GlobalContext returns the GEMINI.md every CLI run reads.
+func (s *GeminiService) GlobalContext() (model.ContextFile, error) {
+	file := model.ContextFile{Scope: model.ContextGlobal}
+	path := s.globalContextPath()
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return file, nil
+	}
+	if err != nil {
+		return file, err
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return file, err
+	}
+	updatedAt := info.ModTime().UTC()
+	file.Content, file.UpdatedAt = string(content), &updatedAt
+	return file, nil
+}
+
+// SetGlobalContext replaces the global GEMINI.md, or removes it when content
+// is blank, and refreshes the context.
+func (s *GeminiService) SetGlobalContext(content string) (ContextRefresh, error) {
+	if len(content) > maxContextSize {
+		return ContextRefresh{}, ErrContextTooLarge
+	}
+	path := s.globalContextPath()
+	if strings.TrimSpace(content) == "" {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return ContextRefresh{}, err
+		}
+	} else if err := writeFileAtomic(path, []byte(content), 0o644); err != nil {
+		return ContextRefresh{}, err
+	}
+	return s.RefreshContext()
+}
+
+// RefreshContext is the wrapper's /memory refresh. Every headless CLI run
+// reads GEMINI.md anew, so there is nothing to reload in the CLI; the cached
+// answers are dropped instead, since they may follow older instructions.
+// Call it after editing the global GEMINI.md on disk.
+func (s *GeminiService) RefreshContext() (ContextRefresh, error) {
+	purged, err := s.PurgeCache()
+	if err != nil {
+		return ContextRefresh{Purged: purged}, err
+	}
+	file, err := s.GlobalContext()
+	return ContextRefresh{Context: file, Purged: purged}, err
+}
+
+// contextVariant identifies the per-request context of opts in cache keys.
+func contextVariant(opts model.AskOptions) string {
+	if opts.Context == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(opts.Context))
+	return hex.EncodeToString(sum[:8])
+}
+
+// prepareRequestWorkspace returns the directory the CLI runs in for opts:
+// opts.WorkDir, or a throwaway workspace holding the generation settings, the
+// GEMINI.md of opts.Context and opts.Attachments. Without any of them it is
+// an empty throwaway workspace when stateless is set or the request brings
+// its own system instructions, else "".
+func prepareRequestWorkspace(opts model.AskOptions, stateless bool) (string, func(), error) {
+	if opts.WorkDir != "" {
+		return opts.WorkDir, func() {}, nil
+	}
+	dir, cleanup, err := prepareGenerationWorkspace(opts.Model, opts.GenerationConfig, opts.SafetySettings)
+	if err != nil || (opts.Context == "" && len(opts.Attachments) == 0 && ((!stateless && opts.System == "") || dir != "")) {
+		return dir, cleanup, err
+	}
+	if dir == "" {
+		if dir, err = os.MkdirTemp("", "gemini-request-"); err != nil {
+			return "", func() {}, err
+		}
+		cleanup = func() { _ = os.RemoveAll(dir) }
+	}
+	if opts.Context != "" {
+		err = os.WriteFile(filepath.Join(dir, contextFileName), []byte(opts.Context), 0o600)
+	}
+	if err == nil {
+		err = writeAttachments(dir, opts.Attachments)
+	}
+	if err != nil {
+		cleanup()
+		return "", func() {}, err
+	}
+	return dir, cleanup, nil
+}
+
+// writeFileAtomic replaces the file at path so readers, such as a CLI
+// starting meanwhile, never see it half written.
+func writeFileAtomic(path string, content []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
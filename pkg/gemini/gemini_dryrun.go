@@ -0,0 +1,65 @@
+package gemini
+
+import (
+	"context"
+	"strings"
+
+	"gemini-wrapper/model"
+)
+
+// DryRun checks a question the way AskWithOptions does and returns what it
+// would send to the CLI, without running it: the final prompt, the models
+// it would try and the execution settings. Nothing is cached, queued or
+// audited.
+func (s *GeminiService) DryRun(ctx context.Context, question string, opts model.AskOptions) (model.DryRunResponse, *model.GeminiStatus, error) {
+	opts = applyTenant(ctx, opts)
+	if status, err := s.checkModel(opts.Model); err != nil {
+		return model.DryRunResponse{}, status, err
+	}
+	opts, status, err := s.resolveExecution(ctx, opts)
+	if err != nil {
+		return model.DryRunResponse{}, status, err
+	}
+	if opts, status, err = s.resolvePriority(ctx, opts); err != nil {
+		return model.DryRunResponse{}, status, err
+	}
+	opts = s.resolveGrounding(opts)
+	structured, status, err := resolveStructuredOutput(opts)
+	if err != nil {
+		return model.DryRunResponse{}, status, err
+	}
+	reply, status, err := resolveReplyLanguage(question, opts)
+	if err != nil {
+		return model.DryRunResponse{}, status, err
+	}
+
+	prompt := strings.TrimSpace(question)
+	if reply != nil {
+		prompt = reply.prompt(prompt)
+	}
+	prompt = systemPreamble(opts.System, prompt)
+	if structured != nil {
+		prompt = structured.prompt(prompt)
+	}
+	if grounded(opts) {
+		prompt = groundingPrompt(prompt)
+	}
+	models := s.buildAttemptModels(opts.Model)
+	result := model.DryRunResponse{
+		Prompt:                prompt,
+		Model:                 models[0],
+		FallbackModels:        models[1:],
+		EstimatedPromptTokens: EstimateTokens(prompt),
+		ApprovalMode:          opts.ApprovalMode,
+		Sandbox:               opts.Sandbox != nil && *opts.Sandbox,
+		Priority:              opts.Priority,
+		Grounding:             grounded(opts),
+	}
+	if reply != nil {
+		result.ReplyLanguage = reply.Code
+	}
+	for _, attachment := range opts.Attachments {
+		result.Files = append(result.Files, attachment.Name)
+	}
+	return result, nil, nil
+}
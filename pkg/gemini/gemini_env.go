@@ -0,0 +1,42 @@
+package gemini
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"slices"
+
+	"gemini-wrapper/model"
+)
+
+// requestEnv returns the environment variables of opts as KEY=value, in a
+// stable order. They come after the server's and so override them.
+func requestEnv(opts model.AskOptions) []string {
+	if len(opts.Env) == 0 {
+		return nil
+	}
+	env := make([]string, 0, len(opts.Env))
+	for key, value := range opts.Env {
+		env = append(env, key+"="+value)
+	}
+	slices.Sort(env)
+	return env
+}
+
+// envVariant tells the answers asked with different environments apart in
+// cache keys without putting values such as API keys into them.
+func envVariant(env map[string]string) string {
+	if len(env) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(env))
+	for key := range env {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	h := sha256.New()
+	for _, key := range keys {
+		fmt.Fprintf(h, "%s\x00%s\x00", key, env[key])
+	}
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
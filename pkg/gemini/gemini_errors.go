@@ -0,0 +1,155 @@
+package gemini
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os/exec"
+
+	"gemini-wrapper/model"
+	"gemini-wrapper/pkg/parser"
+)
+
+var (
+	// ErrAuthentication is returned when the CLI is not logged in or its
+	// credentials were rejected.
+	ErrAuthentication = errors.New("authentication error")
+	// ErrModelNotFound is returned when the requested model does not exist.
+	ErrModelNotFound = errors.New("model not found")
+	// ErrAuthExpired is returned when the CLI's credentials have expired or
+	// were revoked. It wraps ErrAuthentication.
+	ErrAuthExpired = fmt.Errorf("%w: credentials expired", ErrAuthentication)
+	// ErrQuotaExceeded is returned when the account ran out of quota or hit
+	// a rate limit.
+	ErrQuotaExceeded = errors.New("quota exceeded")
+	// ErrModelOverloaded is returned when the model has no capacity left.
+	ErrModelOverloaded = errors.New("model overloaded")
+	// ErrSafetyBlocked is returned when the prompt or the answer was blocked
+	// by safety filters.
+	ErrSafetyBlocked = errors.New("blocked by safety filters")
+	// ErrContextLengthExceeded is returned when the prompt does not fit the
+	// model's context window.
+	ErrContextLengthExceeded = errors.New("context length exceeded")
+)
+
+// upstreamErrors are the typed errors of the reasons parser.Classify finds.
+var upstreamErrors = map[string]error{
+	model.ReasonAuthExpired:           ErrAuthExpired,
+	model.ReasonQuotaExceeded:         ErrQuotaExceeded,
+	model.ReasonModelOverloaded:       ErrModelOverloaded,
+	model.ReasonSafetyBlocked:         ErrSafetyBlocked,
+	model.ReasonContextLengthExceeded: ErrContextLengthExceeded,
+}
+
+// classifyUpstreamError wraps err, the failure of a CLI run, in the typed
+// error its output points to, if any.
+func classifyUpstreamError(err error, output string, response *parser.Response) error {
+	typed, ok := upstreamErrors[parser.Classify(output, response)]
+	if !ok || errors.Is(err, typed) {
+		return err
+	}
+	return fmt.Errorf("%w: %w", typed, err)
+}
+
+// statusClientClosedRequest is the status of questions the client
+// cancelled, as nginx logs requests whose client went away.
+const statusClientClosedRequest = 499
+
+// failureStatus returns a copy of status whose HTTPStatus tells the client
+// what went wrong: 400 for models outside the allowlist, safety blocks and too long prompts, 429 for exhausted quota and a full queue, 401/403 for
+// credentials, 404 for unknown models, 499 for questions the client
+// cancelled, 502 for a CLI stuck at its interactive prompt, 503 while the CLI cannot serve
+// requests, the model is overloaded or an operator interrupted them, 504 for timeouts and the upstream status otherwise. Errors that
+// carry no hint are 500. Its Reason is set by failureReason.
+func (s *GeminiService) failureStatus(err error, status *model.GeminiStatus) *model.GeminiStatus {
+	failed := model.GeminiStatus{}
+	if status != nil {
+		failed = *status
+	}
+
+	var queueErr *QueueFullError
+	var circuitErr *CircuitOpenError
+	var modelErr *ModelNotAllowedError
+	switch {
+	case errors.As(err, &modelErr):
+		failed.HTTPStatus = http.StatusBadRequest
+	case errors.Is(err, ErrRequestCancelled):
+		failed.HTTPStatus = statusClientClosedRequest
+	case errors.Is(err, context.DeadlineExceeded):
+		failed.HTTPStatus = http.StatusGatewayTimeout
+	case errors.As(err, &queueErr):
+		failed.HTTPStatus = http.StatusTooManyRequests
+	case errors.Is(err, ErrServiceClosed), errors.Is(err, ErrBackendRestarted), errors.Is(err, ErrQueueCleared), errors.Is(err, ErrBackendStarting),
+		errors.As(err, &circuitErr), isCLIStartError(err):
+		failed.HTTPStatus = http.StatusServiceUnavailable
+	case errors.Is(err, ErrAuthentication):
+		if failed.HTTPStatus != http.StatusForbidden {
+			failed.HTTPStatus = http.StatusUnauthorized
+		}
+	case errors.Is(err, ErrModelNotFound):
+		failed.HTTPStatus = http.StatusNotFound
+	case errors.Is(err, ErrInputPrompt):
+		failed.HTTPStatus = http.StatusBadGateway
+	case failed.HTTPStatus >= 400 && failed.HTTPStatus <= 599:
+	case errors.Is(err, ErrQuotaExceeded):
+		failed.HTTPStatus = http.StatusTooManyRequests
+	case errors.Is(err, ErrModelOverloaded):
+		failed.HTTPStatus = http.StatusServiceUnavailable
+	case errors.Is(err, ErrSafetyBlocked), errors.Is(err, ErrContextLengthExceeded):
+		failed.HTTPStatus = http.StatusBadRequest
+	case s.supervisor != nil && !s.supervisor.ready.Load():
+		failed.HTTPStatus = http.StatusServiceUnavailable
+	default:
+		failed.HTTPStatus = http.StatusInternalServerError
+	}
+	failed.Reason = failureReason(err, &failed)
+	return &failed
+}
+
+// failureReason is the model.Reason constant for err, given its final
+// status.
+func failureReason(err error, status *model.GeminiStatus) string {
+	for reason, typed := range upstreamErrors {
+		if errors.Is(err, typed) {
+			return reason
+		}
+	}
+	var queueErr *QueueFullError
+	var modelErr *ModelNotAllowedError
+	switch {
+	case errors.Is(err, ErrBackendStarting):
+		return model.ReasonBackendStarting
+	case errors.Is(err, ErrRequestCancelled):
+		return model.ReasonCancelled
+	case errors.Is(err, ErrAuthentication):
+		return model.ReasonAuthFailed
+	case errors.Is(err, ErrModelNotFound):
+		return model.ReasonModelNotFound
+	case errors.As(err, &modelErr):
+		return model.ReasonModelNotAllowed
+	case errors.Is(err, ErrInvalidOutput):
+		return model.ReasonInvalidJSONOutput
+	case errors.Is(err, context.DeadlineExceeded):
+		return model.ReasonTimeout
+	case errors.As(err, &queueErr):
+		return model.ReasonQueueFull
+	case status.HTTPStatus == http.StatusTooManyRequests:
+		return model.ReasonQuotaExceeded
+	case status.HTTPStatus == http.StatusServiceUnavailable:
+		return model.ReasonUnavailable
+	case status.HTTPStatus >= 400 && status.HTTPStatus <= 499:
+		return model.ReasonInvalidRequest
+	case status.HTTPStatus == http.StatusInternalServerError:
+		return model.ReasonInternalError
+	}
+	return model.ReasonUpstreamError
+}
+
+// isCLIStartError reports whether the CLI process could not be started at all,
+// for example because the executable is missing.
+func isCLIStartError(err error) bool {
+	var execErr *exec.Error
+	return errors.As(err, &execErr) || errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrPermission)
+}
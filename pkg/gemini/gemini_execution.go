@@ -0,0 +1,37 @@
+package gemini
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"gemini-wrapper/model"
+	"gemini-wrapper/service/execution"
+)
+
+// SetExecution installs the execution policy of the CLI runs: approval mode,
+// sandbox and the clients that may loosen them per request. Call it before
+// serving requests.
+func (s *GeminiService) SetExecution(cfg execution.Config) {
+	s.execution = cfg
+}
+
+// resolveExecution replaces the policy requested in opts with the one the
+// CLI runs with, so it also separates cached answers.
+func (s *GeminiService) resolveExecution(ctx context.Context, opts model.AskOptions) (model.AskOptions, *model.GeminiStatus, error) {
+	policy, err := s.execution.Resolve(ctx, opts.ApprovalMode, opts.Sandbox)
+	if err != nil {
+		code := http.StatusBadRequest
+		if errors.Is(err, execution.ErrNotAllowed) {
+			code = http.StatusForbidden
+		}
+		return opts, &model.GeminiStatus{HTTPStatus: code, Message: err.Error()}, err
+	}
+	opts.ApprovalMode, opts.Sandbox = policy.ApprovalMode, &policy.Sandbox
+	return opts, nil, nil
+}
+
+// executionArgs returns the CLI flags of the policy resolved into opts.
+func executionArgs(opts model.AskOptions) []string {
+	return execution.Policy{ApprovalMode: opts.ApprovalMode, Sandbox: opts.Sandbox != nil && *opts.Sandbox}.Args()
+}
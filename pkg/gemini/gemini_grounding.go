@@ -0,0 +1,75 @@
+package gemini
+
+import (
+	"regexp"
+	"strings"
+
+	"gemini-wrapper/model"
+)
+
+// groundingTool is the CLI's built-in Google Search tool.
+const groundingTool = "google_web_search"
+
+// citationURL matches a URL in an answer, up to the characters that end a
+// Markdown link or quotation.
+var citationURL = regexp.MustCompile("https?://[^\\s<>\"'`()\\[\\]]+")
+
+// resolveGrounding applies the server default to a request that did not say
+// whether it wants grounding.
+func (s *GeminiService) resolveGrounding(opts model.AskOptions) model.AskOptions {
+	if opts.Grounding == nil {
+		grounding := s.grounding
+		opts.Grounding = &grounding
+	}
+	return opts
+}
+
+func grounded(opts model.AskOptions) bool {
+	return opts.Grounding != nil && *opts.Grounding
+}
+
+// groundingArgs lets a grounded question run the search tool without a
+// confirmation, which a headless CLI could not give.
+func groundingArgs(opts model.AskOptions) []string {
+	if !grounded(opts) {
+		return nil
+	}
+	return []string{"--allowed-tools", groundingTool}
+}
+
+// groundingPrompt asks the model to search before answering and to name its
+// sources, since the CLI does not return the grounding metadata of its
+// searches.
+func groundingPrompt(question string) string {
+	return question + "\n\nSearch the web before answering, and end the answer with the URLs of the sources you used."
+}
+
+// Citations returns the distinct URLs answer cites, in order.
+func Citations(answer string) []string {
+	var citations []string
+	seen := map[string]bool{}
+	for _, url := range citationURL.FindAllString(answer, -1) {
+		url = strings.TrimRight(url, ".,;:!?*")
+		if !seen[url] {
+			seen[url] = true
+			citations = append(citations, url)
+		}
+	}
+	return citations
+}
+
+// withStatusCitations records the URLs answer cites when it was grounded.
+func withStatusCitations(status *model.GeminiStatus, opts model.AskOptions, answer string) *model.GeminiStatus {
+	if !grounded(opts) {
+		return status
+	}
+	citations := Citations(answer)
+	if len(citations) == 0 {
+		return status
+	}
+	if status == nil {
+		status = &model.GeminiStatus{}
+	}
+	status.Citations = citations
+	return status
+}
@@ -0,0 +1,1365 @@
+package gemini
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gemini-wrapper/metrics"
+	"gemini-wrapper/model"
+	"gemini-wrapper/pkg/parser"
+	"gemini-wrapper/service/cacheinfo"
+	"gemini-wrapper/service/cluster"
+	"gemini-wrapper/service/execution"
+	"gemini-wrapper/service/postprocess"
+	"gemini-wrapper/service/usage"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.etcd.io/bbolt"
+	"golang.org/x/sync/singleflight"
+)
+
+const askCacheBucket = "ask_cache"
+
+// cliInterruptGrace is how long an interrupted CLI process may take to exit.
+const cliInterruptGrace = 2 * time.Second
+
+// backendHeadless runs one `gemini --prompt ... --output-format json` process per request.
+const backendHeadless = "headless"
+
+// QueueFullCode is the status code reported when the worker queue rejects a request.
+const QueueFullCode = "QUEUE_FULL"
+
+type GeminiService struct {
+	mu      sync.Mutex
+	backend Backend
+	// apiBackend answers what the CLI cannot when the API fallback is
+	// enabled; apiMultimodal sends it the requests with attachments.
+	apiBackend     Backend
+	apiMultimodal  bool
+	pool           *workerPool
+	pacer          *pacer
+	supervisor     *supervisor
+	selfTest       *selfTest
+	endToEnd       *endToEndTest
+	shadow         *shadow
+	retry          RetryConfig
+	breaker        *breaker
+	calls          *callRegistry
+	requests       *requestRegistry
+	defaultModel   string
+	fallbackModels []string
+	postprocessor  *postprocess.Pipeline
+	execution      execution.Config
+	// clientPriorities are the default priority classes by client.
+	clientPriorities map[string]string
+	// jsonRepairAttempts is how often an answer that does not match its
+	// response schema is asked again.
+	jsonRepairAttempts int
+	// grounding is the default of questions that do not set Grounding.
+	grounding bool
+
+	// cliHome holds the CLI settings; mcpServers are the MCP servers the
+	// wrapper config merged into them.
+	cliHome    string
+	mcpServers map[string]MCPServer
+	// auth recovers the CLI backend from failed authentications.
+	auth *authenticator
+	// keys is the pool of Gemini API keys the CLI takes turns with, or nil.
+	keys *keyPool
+
+	// settingsMu guards the settings Reconfigure changes while serving:
+	// allowedModels, requestTimeout and maxRequestTimeout.
+	settingsMu    sync.RWMutex
+	allowedModels []string
+	// requestTimeout bounds asks that set no timeout of their own and
+	// maxRequestTimeout caps the ones that do. 0 means no limit.
+	requestTimeout    time.Duration
+	maxRequestTimeout time.Duration
+
+	cacheEnabled bool
+	cacheTTL     time.Duration
+	cacheMaxSize int
+	cache        map[string]cacheEntry
+
+	diskCacheEnabled    bool
+	diskCachePath       string
+	diskCleanupInterval time.Duration
+	diskDB              *bbolt.DB
+	// sharedCache is the Redis layer shared with other replicas, when set.
+	sharedCache *cluster.Cluster
+
+	dedupeEnabled bool
+	requestGroup  singleflight.Group
+	flightMu      sync.Mutex
+	flights       map[string]*askFlight
+	streams       map[string]*streamFlight
+
+	startedAt time.Time
+
+	// shutdownCtx is cancelled by Close; it is nil for services built without
+	// NewGeminiServiceWithConfig.
+	shutdownCtx context.Context
+	shutdown    context.CancelFunc
+	closeMu     sync.Mutex
+	closed      bool
+	running     sync.WaitGroup
+}
+
+type cacheEntry struct {
+	answer    string
+	status    *model.GeminiStatus
+	expiresAt time.Time
+	lastUsed  time.Time
+}
+
+// CachePurgeResult reports how many entries PurgeCache removed per layer.
+type CachePurgeResult struct {
+	MemoryEntries int `json:"memoryEntries"`
+	DiskEntries   int `json:"diskEntries"`
+	SharedEntries int `json:"sharedEntries,omitempty"`
+}
+
+type diskCacheRecord struct {
+	Answer        string          `json:"answer"`
+	StatusJSON    json.RawMessage `json:"status_json,omitempty"`
+	ExpiresAtUnix int64           `json:"expires_at_unix"`
+}
+
+type askExecutionResult struct {
+	answer string
+	status *model.GeminiStatus
+	err    error
+}
+
+// askFlight is the context shared by deduplicated callers of one question.
+// It is cancelled once every caller waiting on it has gone away.
+type askFlight struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	waiters int
+}
+
+// NewGeminiService builds the service from DefaultConfig overridden by
+// environment variables.
+func NewGeminiService() *GeminiService {
+	cfg := DefaultConfig()
+	cfg.ApplyEnv()
+	return NewGeminiServiceWithConfig(cfg)
+}
+
+func NewGeminiServiceWithConfig(cfg Config) *GeminiService {
+	cfg = cfg.withDefaults()
+	return newGeminiService(cfg, newBackend(cfg))
+}
+
+// NewGeminiServiceWithBackend is NewGeminiServiceWithConfig with answers from
+// backend instead of the backend cfg.Backend names, for programs that bring
+// their own. The API fallback and MCP servers only apply to the CLI backend.
+func NewGeminiServiceWithBackend(cfg Config, backend Backend) *GeminiService {
+	cfg = cfg.withDefaults()
+	cfg.Backend = backend.Name()
+	return newGeminiService(cfg, backend)
+}
+
+func newGeminiService(cfg Config, backend Backend) *GeminiService {
+	sup := newSupervisor()
+	sup.probeTimeout = cfg.ProbeTimeout
+
+	service := &GeminiService{
+		backend:             backend,
+		pool:                newWorkerPool(cfg.PoolSize, cfg.QueueSize),
+		pacer:               newPacer(cfg.Pacing),
+		supervisor:          sup,
+		selfTest:            newSelfTest(cfg.SelfTest),
+		endToEnd:            &endToEndTest{cfg: cfg.SelfTest},
+		retry:               cfg.Retry,
+		breaker:             newBreaker(cfg.Breaker),
+		calls:               newCallRegistry(),
+		requests:            newRequestRegistry(),
+		defaultModel:        cfg.DefaultModel,
+		fallbackModels:      cfg.FallbackModels,
+		allowedModels:       cfg.AllowedModels,
+		clientPriorities:    parseClientPriorities(cfg.ClientPriorities),
+		jsonRepairAttempts:  cfg.JSONRepairAttempts,
+		grounding:           cfg.Grounding,
+		requestTimeout:      cfg.RequestTimeout,
+		maxRequestTimeout:   cfg.MaxRequestTimeout,
+		cacheEnabled:        cfg.Cache.Enabled,
+		cacheTTL:            cfg.Cache.TTL,
+		cacheMaxSize:        cfg.Cache.MaxEntries,
+		cache:               map[string]cacheEntry{},
+		diskCacheEnabled:    cfg.Cache.DiskEnabled,
+		diskCachePath:       cfg.Cache.DiskPath,
+		diskCleanupInterval: cfg.Cache.DiskCleanupInterval,
+		dedupeEnabled:       cfg.Cache.Dedupe,
+		cliHome:             cfg.CLIHome,
+		startedAt:           time.Now(),
+	}
+	if headless, ok := backend.(headlessBackend); ok {
+		service.auth = headless.auth
+	}
+	if cfg.Backend == backendHeadless && cfg.APIFallback.active() {
+		service.apiBackend = newAPIBackend(cfg.APIFallback, cfg.CLIHome)
+		service.apiMultimodal = cfg.APIFallback.Multimodal
+		slog.Info("gemini API fallback enabled", "base_url", cfg.APIFallback.BaseURL, "multimodal", cfg.APIFallback.Multimodal)
+	}
+	if cfg.Backend == backendHeadless && len(cfg.MCPServers) > 0 {
+		if err := writeMCPServers(cfg.CLIHome, cfg.MCPServers); err != nil {
+			slog.Warn("MCP servers not configured", "error", err)
+		} else {
+			service.mcpServers = cfg.MCPServers
+			slog.Info("MCP servers configured", "servers", slices.Sorted(maps.Keys(cfg.MCPServers)), "settings", settingsPath(cfg.CLIHome))
+		}
+	}
+	if cfg.Backend == backendHeadless && len(cfg.APIKeys) > 0 {
+		// After the MCP servers, so every key's CLI home gets them too.
+		service.keys = newKeyPool(cfg.APIKeys, cfg.KeyCooldown, cfg.CLIHome)
+		if service.keys != nil {
+			slog.Info("API key pool enabled", "keys", len(service.keys.keys), "cooldown", service.keys.cooldown)
+		}
+	}
+	service.shutdownCtx, service.shutdown = context.WithCancel(context.Background())
+	service.shadow = newShadow(cfg, backend)
+	if err := service.initDiskCache(); err != nil {
+		slog.Warn("disk cache disabled", "error", err)
+		service.diskCacheEnabled = false
+	} else if service.diskCacheEnabled && service.diskCleanupInterval > 0 {
+		go service.startDiskCleanupLoop()
+	}
+	if _, ok := backend.(headlessBackend); !ok {
+		// Only the CLI takes seconds to start; other backends are probed
+		// before the service is returned so they answer at once.
+		service.probeBackend()
+	} else {
+		slog.Info("gemini CLI starting in the background; questions get 503 until it is ready")
+	}
+	go service.superviseBackend(cfg.HealthInterval)
+
+	slog.Info("gemini service initialized",
+		"backend", cfg.Backend,
+		"cli_path", cfg.CLIPath,
+		"default_model", printableModel(cfg.DefaultModel),
+		"workers", cfg.PoolSize,
+		"queue_size", cfg.QueueSize,
+		"fallback_models", cfg.FallbackModels,
+		"allowed_models", cfg.AllowedModels,
+		"request_timeout", cfg.RequestTimeout,
+		"max_retries", cfg.Retry.MaxRetries,
+		"breaker_threshold", cfg.Breaker.FailureThreshold,
+	)
+	slog.Info("cache config",
+		"enabled", service.cacheEnabled,
+		"ttl", service.cacheTTL,
+		"max_entries", service.cacheMaxSize,
+		"dedupe", service.dedupeEnabled,
+		"disk_enabled", service.diskCacheEnabled,
+		"disk_path", service.diskCachePath,
+		"disk_cleanup_interval", service.diskCleanupInterval,
+	)
+	return service
+}
+
+func (s *GeminiService) initDiskCache() error {
+	if !s.diskCacheEnabled {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(s.diskCachePath), 0o755); err != nil {
+		return err
+	}
+	db, err := bbolt.Open(s.diskCachePath, 0o600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+	if err := db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(askCacheBucket))
+		return err
+	}); err != nil {
+		_ = db.Close()
+		return err
+	}
+	s.diskDB = db
+	return nil
+}
+
+// Ask sends a question to Gemini CLI using headless mode and returns the response.
+// Cancelling ctx stops the CLI process and returns ctx.Err().
+func (s *GeminiService) Ask(ctx context.Context, question string, modelName string) (string, *model.GeminiStatus, error) {
+	return s.AskWithOptions(ctx, question, model.AskOptions{Model: modelName})
+}
+
+// AskWithOptions is Ask with per-request settings such as generation config.
+// A failed ask always comes with a status whose HTTPStatus classifies the
+// failure for the client.
+func (s *GeminiService) AskWithOptions(ctx context.Context, question string, opts model.AskOptions) (string, *model.GeminiStatus, error) {
+	start := time.Now()
+	opts = applyTenant(ctx, opts)
+	ctx, cancel := s.withRequestTimeout(ctx, opts.Timeout)
+	defer cancel()
+	ctx, _, finish := s.requests.begin(ctx)
+	defer finish()
+	answer, status, err := s.askWithOptions(ctx, question, opts)
+	if err != nil {
+		err = cancelCause(ctx, err)
+		status = s.completeStatus(s.failureStatus(err, status), opts)
+		auditAsk(ctx, start, question, opts, "", status, err)
+		return answer, status, err
+	}
+	answer = s.postprocessor.Apply(answer, opts.SkipPostprocess)
+	status = s.completeStatus(status, opts)
+	if opts.Artifacts {
+		status.Artifacts = postprocess.Artifacts(answer)
+	}
+	answer = postprocess.Format(answer, opts.Format)
+	auditAsk(ctx, start, question, opts, answer, status, nil)
+	return answer, status, nil
+}
+
+func (s *GeminiService) askWithOptions(ctx context.Context, question string, opts model.AskOptions) (string, *model.GeminiStatus, error) {
+	if status, err := s.checkModel(opts.Model); err != nil {
+		return "", status, err
+	}
+	opts, status, err := s.resolveExecution(ctx, opts)
+	if err != nil {
+		return "", status, err
+	}
+	if opts, status, err = s.resolvePriority(ctx, opts); err != nil {
+		return "", status, err
+	}
+	opts = s.resolveGrounding(opts)
+	structured, status, err := resolveStructuredOutput(opts)
+	if err != nil {
+		return "", status, err
+	}
+	reply, status, err := resolveReplyLanguage(question, opts)
+	if err != nil {
+		return "", status, err
+	}
+	question = strings.TrimSpace(question)
+	asked := question
+	if reply != nil {
+		question = reply.prompt(question)
+	}
+	question = systemPreamble(opts.System, question)
+	cacheable := opts.WorkDir == "" && !opts.NoCache
+	cacheKey := s.buildCacheKey(question, opts.Model, optionsVariant(opts))
+	if cacheable {
+		answer, status, ok := s.getCached(cacheKey)
+		s.reportCache(ctx, ok)
+		if ok {
+			return answer, cachedStatus(status), nil
+		}
+	}
+	if status, err := s.checkCircuit(); err != nil {
+		return "", status, err
+	}
+
+	execute := func(ctx context.Context) (string, *model.GeminiStatus, error) {
+		start := time.Now()
+		answer, status, err := s.askValidated(ctx, question, opts, structured)
+		if err != nil {
+			s.mirror(ctx, question, opts, answer, status, err, time.Since(start))
+			return answer, status, err
+		}
+		if reply != nil && structured == nil {
+			answer, status = s.matchLanguage(ctx, reply, systemPreamble(opts.System, asked), answer, status, opts)
+		}
+		s.mirror(ctx, question, opts, answer, status, nil, time.Since(start))
+		if cacheable {
+			s.setCached(cacheKey, answer, status)
+		}
+		return answer, status, nil
+	}
+
+	if !s.dedupeEnabled || !cacheable {
+		return execute(ctx)
+	}
+
+	// The shared execution must not die with the first caller that disconnects,
+	// so it runs on a flight context cancelled only when all callers have left.
+	key := s.coalesceKey(question, opts)
+	flightCtx, leave := s.joinFlight(ctx, key)
+	defer leave()
+	led := false
+	resultCh := s.requestGroup.DoChan(key, func() (interface{}, error) {
+		led = true
+		answer, status, err := execute(flightCtx)
+		return askExecutionResult{answer: answer, status: status, err: err}, nil
+	})
+
+	select {
+	case <-ctx.Done():
+		return "", nil, ctx.Err()
+	case res := <-resultCh:
+		result, ok := res.Val.(askExecutionResult)
+		if !ok {
+			return "", nil, fmt.Errorf("failed to process request")
+		}
+		if !led {
+			metrics.CoalescedRequests.Inc("ask")
+			return result.answer, coalescedStatus(result.status), result.err
+		}
+		return result.answer, result.status, result.err
+	}
+}
+
+// Reconfigure applies the settings of cfg that can change while the service
+// runs: the model allowlist, the request timeouts and the CLI output
+// patterns. Questions already asked keep the timeout and patterns they
+// started with; the rest of cfg is ignored.
+func (s *GeminiService) Reconfigure(cfg Config) {
+	cfg = cfg.withDefaults()
+	if headless, ok := s.activeBackend().(headlessBackend); ok {
+		headless.patterns.reconfigure(cfg.CLIPatterns)
+	}
+	s.settingsMu.Lock()
+	defer s.settingsMu.Unlock()
+	s.allowedModels = cfg.AllowedModels
+	s.requestTimeout = cfg.RequestTimeout
+	s.maxRequestTimeout = cfg.MaxRequestTimeout
+}
+
+// errRequestedTimeout is the cause of a timeout that the client set shorter
+// than the server default. It says nothing about the upstream.
+var errRequestedTimeout = fmt.Errorf("requested timeout: %w", context.DeadlineExceeded)
+
+// withRequestTimeout bounds ctx by the requested timeout, capped at
+// maxRequestTimeout, or by requestTimeout when the request set none.
+func (s *GeminiService) withRequestTimeout(ctx context.Context, requested time.Duration) (context.Context, context.CancelFunc) {
+	s.settingsMu.RLock()
+	defaultTimeout, maxTimeout := s.requestTimeout, s.maxRequestTimeout
+	s.settingsMu.RUnlock()
+
+	timeout := defaultTimeout
+	if requested > 0 {
+		timeout = requested
+	}
+	if maxTimeout > 0 && timeout > maxTimeout {
+		timeout = maxTimeout
+	}
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+	if requested > 0 && timeout < defaultTimeout {
+		return context.WithTimeoutCause(ctx, timeout, errRequestedTimeout)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// joinFlight registers a caller for key and returns the shared flight context
+// together with the function the caller must run when it stops waiting.
+func (s *GeminiService) joinFlight(ctx context.Context, key string) (context.Context, func()) {
+	s.flightMu.Lock()
+	defer s.flightMu.Unlock()
+	if s.flights == nil {
+		s.flights = map[string]*askFlight{}
+	}
+	flight, ok := s.flights[key]
+	if !ok {
+		// Detach from the first caller's cancellation but keep its values (request ID).
+		flightCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		flight = &askFlight{ctx: flightCtx, cancel: cancel}
+		s.flights[key] = flight
+	}
+	flight.waiters++
+
+	var once sync.Once
+	return flight.ctx, func() {
+		once.Do(func() {
+			s.flightMu.Lock()
+			defer s.flightMu.Unlock()
+			flight.waiters--
+			if flight.waiters == 0 {
+				flight.cancel()
+				if s.flights[key] == flight {
+					delete(s.flights, key)
+					// The cancelled generation may take a while to stop; an
+					// identical question asked meanwhile starts a new one
+					// instead of getting its cancellation.
+					s.requestGroup.Forget(key)
+				}
+			}
+		})
+	}
+}
+
+func (s *GeminiService) askWithFallback(ctx context.Context, question string, opts model.AskOptions) (string, *model.GeminiStatus, error) {
+	attemptModels := s.buildAttemptModels(opts.Model)
+	if len(attemptModels) == 0 {
+		attemptModels = []string{""}
+	}
+
+	var preservedAnswer string
+	var preservedStatus *model.GeminiStatus
+	hasPreservedSuccess := false
+
+	for i, attemptModel := range attemptModels {
+		if i == 0 {
+			slog.InfoContext(ctx, "processing question", "question", question, "model", printableModel(attemptModel))
+		} else {
+			slog.InfoContext(ctx, "retrying with fallback model", "attempt", i, "fallbacks", len(attemptModels)-1, "model", printableModel(attemptModel))
+		}
+
+		attemptOpts := opts
+		attemptOpts.Model = attemptModel
+		answer, status, err := s.withRetry(ctx, func() (string, *model.GeminiStatus, error) {
+			if mustStream(attemptOpts) {
+				return s.stream(ctx, question, attemptOpts, func(string) error { return nil })
+			}
+			return s.generate(ctx, question, attemptOpts)
+		}, func() bool { return true })
+		if err == nil {
+			if shouldFallbackAfterSuccess(status, i, len(attemptModels)) {
+				status = withStatusModel(status, attemptModel)
+				preservedAnswer = answer
+				preservedStatus = status
+				hasPreservedSuccess = true
+				slog.WarnContext(ctx, "successful attempt reported 429; trying fallback model next", "model", printableModel(attemptModel))
+				continue
+			}
+			if i > 0 {
+				status = withStatusDegraded(withStatusModel(status, attemptModel), model.DegradedFallbackModel)
+				slog.InfoContext(ctx, "fallback succeeded", "model", printableModel(attemptModel))
+			}
+			return answer, status, nil
+		}
+
+		status = withStatusModel(status, attemptModel)
+		if ctx.Err() != nil {
+			return "", status, ctx.Err()
+		}
+		if i == len(attemptModels)-1 || !isRetryableModelError(err, status) {
+			if hasPreservedSuccess {
+				return preservedAnswer, preservedStatus, nil
+			}
+			return "", status, err
+		}
+
+		slog.WarnContext(ctx, "model failed with retriable error; moving to fallback model", "error", err)
+	}
+
+	if hasPreservedSuccess {
+		return preservedAnswer, preservedStatus, nil
+	}
+	return "", nil, fmt.Errorf("failed to process request")
+}
+
+// buildCacheKey hashes model and question, ignoring surrounding whitespace and
+// line-ending style. Non-empty variants (e.g. a serialized generation config)
+// are mixed in so they get separate entries.
+func (s *GeminiService) buildCacheKey(question string, modelName string, variants ...string) string {
+	normalizedModel := strings.TrimSpace(modelName)
+	if normalizedModel == "" {
+		normalizedModel = "auto"
+	}
+	key := normalizedModel + "\n" + strings.ReplaceAll(strings.TrimSpace(question), "\r\n", "\n")
+	for _, variant := range variants {
+		if variant != "" {
+			key += "\n" + variant
+		}
+	}
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *GeminiService) getCached(key string) (string, *model.GeminiStatus, bool) {
+	if !s.cacheEnabled {
+		return "", nil, false
+	}
+
+	now := time.Now()
+	s.mu.Lock()
+	entry, ok := s.cache[key]
+	if ok {
+		if now.After(entry.expiresAt) {
+			delete(s.cache, key)
+		} else {
+			entry.lastUsed = now
+			s.cache[key] = entry
+			answer := entry.answer
+			status := cloneGeminiStatus(entry.status)
+			s.mu.Unlock()
+			return answer, status, true
+		}
+	}
+	s.mu.Unlock()
+
+	answer, status, expiresAt, ok := s.getDiskCached(key, now)
+	if !ok {
+		answer, status, expiresAt, ok = s.getSharedCached(key, now)
+	}
+	if !ok {
+		return "", nil, false
+	}
+
+	s.mu.Lock()
+	if _, exists := s.cache[key]; !exists && s.cacheMaxSize > 0 && len(s.cache) >= s.cacheMaxSize {
+		s.evictCacheLocked(time.Now())
+	}
+	s.cache[key] = cacheEntry{answer: answer, status: cloneGeminiStatus(status), expiresAt: expiresAt, lastUsed: now}
+	s.mu.Unlock()
+	return answer, status, true
+}
+
+func (s *GeminiService) setCached(key, answer string, status *model.GeminiStatus) {
+	if !s.cacheEnabled || strings.TrimSpace(answer) == "" {
+		return
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(s.cacheTTL)
+	s.mu.Lock()
+	if _, exists := s.cache[key]; !exists && s.cacheMaxSize > 0 && len(s.cache) >= s.cacheMaxSize {
+		s.evictCacheLocked(now)
+	}
+	s.cache[key] = cacheEntry{answer: answer, status: cloneGeminiStatus(status), expiresAt: expiresAt, lastUsed: now}
+	s.mu.Unlock()
+
+	s.setDiskCached(key, answer, status, expiresAt)
+	s.setSharedCached(key, answer, status, expiresAt)
+}
+
+// evictCacheLocked drops expired entries and then the least recently used
+// ones until there is room for one more.
+func (s *GeminiService) evictCacheLocked(now time.Time) {
+	for key, entry := range s.cache {
+		if now.After(entry.expiresAt) {
+			delete(s.cache, key)
+		}
+	}
+	for s.cacheMaxSize > 0 && len(s.cache) >= s.cacheMaxSize {
+		oldestKey := ""
+		var oldest time.Time
+		for key, entry := range s.cache {
+			if oldestKey == "" || entry.lastUsed.Before(oldest) {
+				oldestKey, oldest = key, entry.lastUsed
+			}
+		}
+		delete(s.cache, oldestKey)
+	}
+}
+
+func (s *GeminiService) getDiskCached(key string, now time.Time) (string, *model.GeminiStatus, time.Time, bool) {
+	if !s.diskCacheEnabled || s.diskDB == nil {
+		return "", nil, time.Time{}, false
+	}
+
+	var record diskCacheRecord
+	found := false
+	stale := false
+	err := s.diskDB.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(askCacheBucket))
+		if bucket == nil {
+			return nil
+		}
+		raw := bucket.Get([]byte(key))
+		if len(raw) == 0 {
+			return nil
+		}
+		if err := json.Unmarshal(raw, &record); err != nil {
+			return nil
+		}
+		found = true
+		if record.ExpiresAtUnix <= now.Unix() {
+			stale = true
+		}
+		return nil
+	})
+	if err != nil || !found {
+		return "", nil, time.Time{}, false
+	}
+
+	if stale {
+		s.deleteDiskCacheKey(key)
+		return "", nil, time.Time{}, false
+	}
+
+	var status *model.GeminiStatus
+	if len(record.StatusJSON) > 0 {
+		var parsed model.GeminiStatus
+		if err := json.Unmarshal(record.StatusJSON, &parsed); err == nil {
+			status = &parsed
+		}
+	}
+	return record.Answer, status, time.Unix(record.ExpiresAtUnix, 0), true
+}
+
+func (s *GeminiService) setDiskCached(key, answer string, status *model.GeminiStatus, expiresAt time.Time) {
+	if !s.diskCacheEnabled || s.diskDB == nil || strings.TrimSpace(answer) == "" {
+		return
+	}
+
+	var statusJSON []byte
+	if status != nil {
+		b, err := json.Marshal(status)
+		if err == nil {
+			statusJSON = b
+		}
+	}
+	record := diskCacheRecord{Answer: answer, StatusJSON: statusJSON, ExpiresAtUnix: expiresAt.Unix()}
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+
+	_ = s.diskDB.Update(func(tx *bbolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(askCacheBucket))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(key), payload)
+	})
+}
+
+// reportCache counts a cache lookup and reports it to the request.
+func (s *GeminiService) reportCache(ctx context.Context, hit bool) {
+	if !s.cacheEnabled {
+		return
+	}
+	if hit {
+		metrics.CacheLookups.Inc("hit")
+		cacheinfo.Record(ctx, cacheinfo.Hit)
+	} else {
+		metrics.CacheLookups.Inc("miss")
+		cacheinfo.Record(ctx, cacheinfo.Miss)
+	}
+}
+
+// PurgeCache drops every cached answer from memory, disk and Redis.
+func (s *GeminiService) PurgeCache() (CachePurgeResult, error) {
+	var result CachePurgeResult
+	s.mu.Lock()
+	result.MemoryEntries = len(s.cache)
+	s.cache = map[string]cacheEntry{}
+	s.mu.Unlock()
+
+	var err error
+	if result.SharedEntries, err = s.purgeSharedCache(); err != nil {
+		return result, err
+	}
+	if !s.diskCacheEnabled || s.diskDB == nil {
+		return result, nil
+	}
+	err = s.diskDB.Update(func(tx *bbolt.Tx) error {
+		if bucket := tx.Bucket([]byte(askCacheBucket)); bucket != nil {
+			result.DiskEntries = bucket.Stats().KeyN
+			if err := tx.DeleteBucket([]byte(askCacheBucket)); err != nil {
+				return err
+			}
+		}
+		_, err := tx.CreateBucket([]byte(askCacheBucket))
+		return err
+	})
+	return result, err
+}
+
+func (s *GeminiService) deleteDiskCacheKey(key string) {
+	if !s.diskCacheEnabled || s.diskDB == nil {
+		return
+	}
+	_ = s.diskDB.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(askCacheBucket))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.Delete([]byte(key))
+	})
+}
+
+func (s *GeminiService) startDiskCleanupLoop() {
+	ticker := time.NewTicker(s.diskCleanupInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.cleanupExpiredDiskCache(time.Now().Unix())
+		case <-s.shutdownCtx.Done():
+			return
+		}
+	}
+}
+
+func (s *GeminiService) cleanupExpiredDiskCache(nowUnix int64) {
+	if !s.diskCacheEnabled || s.diskDB == nil {
+		return
+	}
+	_ = s.diskDB.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(askCacheBucket))
+		if bucket == nil {
+			return nil
+		}
+		cursor := bucket.Cursor()
+		for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
+			var record diskCacheRecord
+			if err := json.Unmarshal(value, &record); err != nil || record.ExpiresAtUnix <= nowUnix {
+				if err := cursor.Delete(); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func cloneGeminiStatus(status *model.GeminiStatus) *model.GeminiStatus {
+	if status == nil {
+		return nil
+	}
+	statusCopy := *status
+	if status.Usage != nil {
+		usageCopy := *status.Usage
+		statusCopy.Usage = &usageCopy
+	}
+	statusCopy.ToolEvents = slices.Clone(status.ToolEvents)
+	statusCopy.Citations = slices.Clone(status.Citations)
+	statusCopy.Degraded = slices.Clone(status.Degraded)
+	statusCopy.Artifacts = slices.Clone(status.Artifacts)
+	return &statusCopy
+}
+
+// parseBackendMode validates GEMINI_BACKEND. Headless JSON mode is the only
+// CLI integration this service implements; the interactive PTY approach is not
+// supported because scraping the TUI is unreliable. "api" answers through the
+// Gemini REST API without the CLI, and "mock" selects the in-memory backend
+// for development.
+func parseBackendMode(raw string) string {
+	switch strings.ToLower(strings.TrimSpace(raw)) {
+	case "", backendHeadless, "cli", "json":
+		return backendHeadless
+	case backendAPI, "rest":
+		return backendAPI
+	case backendMock:
+		return backendMock
+	default:
+		slog.Warn("unsupported GEMINI_BACKEND; using default", "value", raw, "backend", backendHeadless)
+		return backendHeadless
+	}
+}
+
+func parseEnvBool(key string, defaultValue bool) bool {
+	raw := strings.TrimSpace(strings.ToLower(os.Getenv(key)))
+	if raw == "" {
+		return defaultValue
+	}
+	return raw == "1" || raw == "true" || raw == "yes" || raw == "on"
+}
+
+func parseEnvInt(key string, defaultValue int) int {
+	raw := strings.TrimSpace(os.Getenv(key))
+	if raw == "" {
+		return defaultValue
+	}
+	parsed, err := strconv.Atoi(raw)
+	if err != nil || parsed <= 0 {
+		return defaultValue
+	}
+	return parsed
+}
+
+func parseEnvSeconds(key string, defaultValue time.Duration) time.Duration {
+	seconds := parseEnvInt(key, 0)
+	if seconds == 0 {
+		return defaultValue
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// PoolStats returns the current worker pool occupancy.
+func (s *GeminiService) PoolStats() PoolStats {
+	return s.pool.stats()
+}
+
+// Queue lists the questions waiting for a worker, next in line first.
+func (s *GeminiService) Queue() []QueuedRequest {
+	return s.pool.queued()
+}
+
+// generate runs one backend attempt: on the CLI once a pool worker is free,
+// or on the Gemini API when the fallback takes the request.
+func (s *GeminiService) generate(ctx context.Context, question string, opts model.AskOptions) (string, *model.GeminiStatus, error) {
+	if reason := s.apiRoute(opts); reason != "" {
+		return s.generateWithAPI(ctx, question, opts, reason)
+	}
+	generateCLI := func() (string, *model.GeminiStatus, error) {
+		return s.withAPIKeys(ctx, opts, func(ctx context.Context) (string, *model.GeminiStatus, error) {
+			return s.generateWithCLI(ctx, question, opts)
+		}, func() bool { return true })
+	}
+	answer, status, err := generateCLI()
+	if s.reauthenticate(ctx, err) {
+		answer, status, err = generateCLI()
+		s.auth.finish(err)
+	}
+	if reason := s.apiFallbackReason(ctx, opts, err); reason != "" {
+		slog.WarnContext(ctx, "gemini CLI failed; falling back to the gemini API", "error", err)
+		return s.generateWithAPI(ctx, question, opts, reason)
+	}
+	return answer, withStatusBackend(status, s.activeBackend().Name()), err
+}
+
+func (s *GeminiService) generateWithCLI(ctx context.Context, question string, opts model.AskOptions) (string, *model.GeminiStatus, error) {
+	if s.supervisor.starting() {
+		return "", nil, ErrBackendStarting
+	}
+	ctx, done, err := s.track(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	defer done()
+	queued := time.Now()
+	release, status, err := s.acquireWorker(ctx, opts.Priority)
+	if err != nil {
+		return "", status, err
+	}
+	defer release()
+	queueWait := time.Since(queued)
+	ctx, finish := s.calls.begin(ctx, opts.Model, false)
+	start := time.Now()
+	answer, status, err := s.activeBackend().Generate(ctx, question, opts)
+	status = withStatusTimings(status, queueWait, time.Since(start))
+	err = restartCause(ctx, err)
+	finish(err)
+	s.supervisor.recordOutcome(err)
+	s.recordAttempt(ctx, attempt{model: opts.Model, backend: s.activeBackend().Name(), start: start}, question, answer, status, err)
+	return answer, status, err
+}
+
+// stream is generate for streaming attempts. A CLI attempt falls back to the
+// API only when nothing was streamed yet.
+func (s *GeminiService) stream(ctx context.Context, question string, opts model.AskOptions, onChunk func(chunk string) error) (string, *model.GeminiStatus, error) {
+	if reason := s.apiRoute(opts); reason != "" {
+		return s.streamWithAPI(ctx, question, opts, reason, onChunk)
+	}
+	streamed := false
+	streamCLI := func() (string, *model.GeminiStatus, error) {
+		return s.withAPIKeys(ctx, opts, func(ctx context.Context) (string, *model.GeminiStatus, error) {
+			return s.streamWithCLI(ctx, question, opts, func(chunk string) error {
+				streamed = true
+				return onChunk(chunk)
+			})
+		}, func() bool { return !streamed })
+	}
+	answer, status, err := streamCLI()
+	if !streamed && s.reauthenticate(ctx, err) {
+		answer, status, err = streamCLI()
+		s.auth.finish(err)
+	}
+	if reason := s.apiFallbackReason(ctx, opts, err); reason != "" && !streamed {
+		slog.WarnContext(ctx, "gemini CLI failed; falling back to the gemini API", "error", err)
+		return s.streamWithAPI(ctx, question, opts, reason, onChunk)
+	}
+	return answer, withStatusBackend(status, s.activeBackend().Name()), err
+}
+
+// streamWithCLI holds the worker until the stream ends.
+func (s *GeminiService) streamWithCLI(ctx context.Context, question string, opts model.AskOptions, onChunk func(chunk string) error) (string, *model.GeminiStatus, error) {
+	if s.supervisor.starting() {
+		return "", nil, ErrBackendStarting
+	}
+	ctx, done, err := s.track(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	defer done()
+	queued := time.Now()
+	release, status, err := s.acquireWorker(ctx, opts.Priority)
+	if err != nil {
+		return "", status, err
+	}
+	defer release()
+	queueWait := time.Since(queued)
+	ctx, finish := s.calls.begin(ctx, opts.Model, true)
+	progressFrom(ctx).running()
+	start := time.Now()
+	limiter := newOutputLimiter(opts, onChunk)
+	thoughts := newThoughtFilter(opts, limiter.chunk)
+	run := attempt{model: opts.Model, backend: s.activeBackend().Name(), start: start}
+	answer, status, err := limiter.result(thoughts.result(s.activeBackend().Stream(ctx, question, opts, run.timeFirstChunk(thoughts.chunk))))
+	status = withStatusTimings(status, queueWait, time.Since(start))
+	err = restartCause(ctx, err)
+	finish(err)
+	s.supervisor.recordOutcome(err)
+	s.recordAttempt(ctx, run, question, answer, status, err)
+	return answer, status, err
+}
+
+// acquireWorker waits for its turn with the pacer, then for a pool worker,
+// behind the waiting requests of a higher priority class. A full queue is reported with a 429 QUEUE_FULL
+// status so callers can tell backpressure from upstream errors.
+func (s *GeminiService) acquireWorker(ctx context.Context, priority string) (func(), *model.GeminiStatus, error) {
+	if err := s.pacer.wait(ctx); err != nil {
+		return nil, nil, err
+	}
+	start := time.Now()
+	release, err := s.pool.acquire(ctx, priorityLevel(priority))
+	var queueErr *QueueFullError
+	if errors.As(err, &queueErr) {
+		metrics.QueueRejections.Inc()
+		slog.WarnContext(ctx, "rejecting request, queue is full", "position", queueErr.Position, "limit", queueErr.Limit)
+		return nil, &model.GeminiStatus{HTTPStatus: http.StatusTooManyRequests, Code: QueueFullCode, Message: err.Error()}, err
+	}
+	metrics.QueueWait.Observe(time.Since(start).Seconds())
+	return release, nil, err
+}
+
+// attempt is a backend attempt as the metrics see it.
+type attempt struct {
+	model   string
+	backend string
+	start   time.Time
+	// firstChunk is when a stream sent its first output, if it did.
+	firstChunk time.Time
+}
+
+// timeFirstChunk returns onChunk noting when the first chunk passes.
+func (a *attempt) timeFirstChunk(onChunk func(chunk string) error) func(chunk string) error {
+	return func(chunk string) error {
+		if a.firstChunk.IsZero() && chunk != "" {
+			a.firstChunk = time.Now()
+		}
+		return onChunk(chunk)
+	}
+}
+
+// recordAttempt reports a finished backend attempt to the metrics and the
+// usage recorders of the request. Usage is estimated when the CLI
+// reported none.
+func (s *GeminiService) recordAttempt(ctx context.Context, run attempt, question, answer string, status *model.GeminiStatus, err error) {
+	modelLabel := printableModel(run.model)
+	if err == nil {
+		tokens := estimateUsage(question, answer)
+		if status != nil && status.Usage != nil {
+			tokens = *status.Usage
+		}
+		usage.Record(ctx, tokens)
+		metrics.GenerationDuration.Observe(time.Since(run.start).Seconds(), modelLabel, run.backend)
+		metrics.GenerationTokens.Observe(float64(tokens.PromptTokenCount), modelLabel, run.backend, "input")
+		metrics.GenerationTokens.Observe(float64(tokens.CandidatesTokenCount), modelLabel, run.backend, "output")
+	} else {
+		class := s.failureStatus(err, status).Reason
+		if errors.Is(err, context.Canceled) {
+			class = model.ReasonCancelled
+		}
+		metrics.GenerationErrors.Inc(modelLabel, run.backend, class)
+	}
+	if !run.firstChunk.IsZero() {
+		metrics.TimeToFirstToken.Observe(run.firstChunk.Sub(run.start).Seconds(), modelLabel, run.backend)
+	}
+
+	outcome := "success"
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		outcome = "timeout"
+	case errors.Is(err, context.Canceled):
+		outcome = "cancelled"
+	case err != nil:
+		outcome = "error"
+	}
+	metrics.GeminiRequests.Inc(modelLabel, outcome)
+	if err == nil {
+		metrics.GeminiLatency.Observe(time.Since(run.start).Seconds(), modelLabel)
+	}
+	if status != nil && status.HTTPStatus != 0 {
+		metrics.UpstreamStatus.Inc(strconv.Itoa(status.HTTPStatus))
+	}
+}
+
+// activeBackend returns the configured backend, defaulting to headless CLI
+// for services built without NewGeminiService.
+func (s *GeminiService) activeBackend() Backend {
+	if s.backend == nil {
+		return headlessBackend{}
+	}
+	return s.backend
+}
+
+// Generate runs one headless CLI invocation and parses its JSON output.
+func (b headlessBackend) Generate(ctx context.Context, question string, opts model.AskOptions) (string, *model.GeminiStatus, error) {
+	modelName := opts.Model
+	prompt := question
+	if grounded(opts) {
+		prompt = groundingPrompt(question)
+	}
+
+	// Prepare the command arguments
+	args := []string{
+		"--prompt", prompt,
+		"--output-format", "json",
+	}
+
+	// Add model if specified
+	if modelName != "" {
+		args = append(args, "--model", modelName)
+	}
+	args = append(args, executionArgs(opts)...)
+	args = append(args, groundingArgs(opts)...)
+
+	cmd := b.command(ctx, args...)
+	cmd.Env = append(cmd.Env, requestEnv(opts)...)
+	workspace, cleanup, err := prepareRequestWorkspace(opts, b.stateless)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to prepare the CLI workspace: %v", err)
+	}
+	defer cleanup()
+	cmd.Dir = workspace
+
+	// Run command and capture output
+	var combined bytes.Buffer
+	var combinedMu sync.Mutex
+	stdoutConsole, stderrConsole := consoleOutput(ctx, "stdout"), consoleOutput(ctx, "stderr")
+	patterns := b.patterns.current()
+	prompts := newPromptWatcher(patterns, func() { _ = cmd.Process.Kill() })
+	cmd.Stdout = io.MultiWriter(lockedWriter{mu: &combinedMu, w: &combined}, stdoutConsole, prompts)
+	cmd.Stderr = io.MultiWriter(lockedWriter{mu: &combinedMu, w: &combined}, stderrConsole, prompts)
+	err = cmd.Start()
+	if err == nil {
+		setCallPID(ctx, cmd.Process.Pid)
+		err = cmd.Wait()
+	}
+	stdoutConsole.flush()
+	stderrConsole.flush()
+	output := combined.Bytes()
+	if ctx.Err() != nil {
+		return "", nil, ctx.Err()
+	}
+	outputStr := string(output)
+	slog.DebugContext(ctx, "gemini CLI output", "model", printableModel(modelName), "exit_error", err, "output", outputStr)
+	status := parser.UpstreamStatus(outputStr, nil)
+	if err := prompts.prompted(); err != nil {
+		return "", status, err
+	}
+	if err != nil {
+		// Provide helpful error messages for common issues
+		if strings.Contains(outputStr, "ModelNotFoundError") || strings.Contains(outputStr, "not found") {
+			return "", status, fmt.Errorf("%w: the model '%s' doesn't exist or isn't available. Use 'gemini-2.5-flash', 'gemini-2.5-flash-lite', 'gemini-2.5-pro', or omit model for auto-selection", ErrModelNotFound, modelName)
+		}
+
+		if parser.Classify(outputStr, nil) == model.ReasonAuthExpired {
+			return "", status, fmt.Errorf("%w: sign in to the CLI again and update ~/.gemini", ErrAuthExpired)
+		}
+		if strings.Contains(outputStr, "authentication") || strings.Contains(outputStr, "auth") {
+			return "", status, fmt.Errorf("%w: make sure ~/.gemini is mounted correctly and you're authenticated", ErrAuthentication)
+		}
+
+		response, ok := parser.ParseOutput(outputStr)
+		if ok {
+			status = parser.UpstreamStatus(outputStr, &response)
+			if response.Error != nil {
+				answer := strings.TrimSpace(response.Response)
+				if status != nil && status.HTTPStatus == http.StatusTooManyRequests && answer != "" {
+					return answer, status, nil
+				}
+				return "", status, classifyUpstreamError(fmt.Errorf("gemini error: %s - %s", response.Error.Type, response.Error.Message), outputStr, &response)
+			}
+
+			answer := strings.TrimSpace(response.Response)
+			if answer != "" {
+				return answer, status, nil
+			}
+		}
+
+		return "", status, classifyUpstreamError(fmt.Errorf("failed to execute gemini CLI: %w (output: %s)", err, outputStr), outputStr, nil)
+	}
+
+	response, ok := parser.ParseOutput(outputStr)
+	if !ok {
+		// No valid JSON found, return raw output
+		slog.WarnContext(ctx, "no valid JSON found in gemini CLI output")
+		return patterns.clean(outputStr), status, nil
+	}
+
+	status = parser.UpstreamStatus(outputStr, &response)
+
+	// Check for errors in response
+	if response.Error != nil {
+		answer := strings.TrimSpace(response.Response)
+		if status != nil && status.HTTPStatus == http.StatusTooManyRequests && answer != "" {
+			return answer, status, nil
+		}
+		errorMsg := fmt.Sprintf("gemini error: %s - %s", response.Error.Type, response.Error.Message)
+
+		// Provide helpful message for common errors
+		if strings.Contains(errorMsg, "ModelNotFoundError") || strings.Contains(errorMsg, "not found") {
+			return "", status, fmt.Errorf("%w: the specified model doesn't exist or isn't available. Try using 'gemini-2.5-flash' or don't specify a model for auto-selection", ErrModelNotFound)
+		}
+
+		return "", status, classifyUpstreamError(errors.New(errorMsg), outputStr, &response)
+	}
+
+	// Return the response text
+	answer := strings.TrimSpace(response.Response)
+	if answer == "" {
+		return "", status, fmt.Errorf("received empty response from gemini")
+	}
+	status = withStatusUsage(status, parser.Usage(response))
+	status = withStatusToolEvents(status, parser.ToolEvents(response))
+
+	slog.InfoContext(ctx, "response received", "model", printableModel(modelName), "chars", len(answer))
+	return answer, status, nil
+}
+
+// command creates a gemini CLI command with the configured environment applied.
+// When ctx is cancelled the CLI gets SIGINT, like Ctrl+C in a terminal, and is
+// killed if it has not exited after cliInterruptGrace.
+func (b headlessBackend) command(ctx context.Context, args ...string) *exec.Cmd {
+	path := b.cliPath
+	if path == "" {
+		path = defaultCLIPath
+	}
+	home := b.cliHome
+	if home == "" {
+		home = defaultCLIHome
+	}
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(os.Interrupt)
+	}
+	cmd.WaitDelay = cliInterruptGrace
+	cmd.Env = append(os.Environ(),
+		"HOME="+home,
+		"GEMINI_CONFIG_DIR="+filepath.Join(home, ".gemini"),
+		"XDG_CONFIG_HOME="+home,
+	)
+	cmd.Env = append(cmd.Env, b.cliEnv...)
+	cmd.Env = append(cmd.Env, b.auth.env()...)
+	if key := apiKeyFrom(ctx); key != nil {
+		cmd.Env = append(cmd.Env, key.env()...)
+	}
+	return cmd
+}
+
+// AskWithEnv sends a question with custom environment variables. They are
+// set on the CLI process of this question only, never on the server's.
+func (s *GeminiService) AskWithEnv(question string, modelName string, env map[string]string) (string, *model.GeminiStatus, error) {
+	return s.AskWithOptions(context.Background(), question, model.AskOptions{Model: modelName, Env: env})
+}
+
+func parseFallbackModels(raw string) []string {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return nil
+	}
+
+	if strings.HasPrefix(raw, "[") && strings.HasSuffix(raw, "]") {
+		raw = strings.TrimSpace(raw[1 : len(raw)-1])
+	}
+
+	parts := strings.Split(raw, ",")
+	fallbacks := make([]string, 0, len(parts))
+	seen := map[string]struct{}{}
+	for _, p := range parts {
+		candidate := strings.TrimSpace(p)
+		candidate = strings.Trim(candidate, "\"'")
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "" {
+			continue
+		}
+		if _, ok := seen[candidate]; ok {
+			continue
+		}
+		seen[candidate] = struct{}{}
+		fallbacks = append(fallbacks, candidate)
+	}
+	return fallbacks
+}
+
+func (s *GeminiService) buildAttemptModels(primary string) []string {
+	primary = strings.TrimSpace(primary)
+	if primary == "" {
+		primary = s.defaultModel
+	}
+	attempts := make([]string, 0, 1+len(s.fallbackModels))
+	attempts = append(attempts, primary)
+	seen := map[string]struct{}{attempts[0]: {}}
+	for _, fallback := range s.fallbackModels {
+		fallback = strings.TrimSpace(fallback)
+		if fallback == "" {
+			continue
+		}
+		if _, ok := seen[fallback]; ok {
+			continue
+		}
+		seen[fallback] = struct{}{}
+		attempts = append(attempts, fallback)
+	}
+	return attempts
+}
+
+func withStatusModel(status *model.GeminiStatus, modelName string) *model.GeminiStatus {
+	if strings.TrimSpace(modelName) == "" {
+		return status
+	}
+	if status == nil {
+		return &model.GeminiStatus{Model: modelName}
+	}
+	status.Model = modelName
+	return status
+}
+
+func withStatusUsage(status *model.GeminiStatus, usage *model.UsageMetadata) *model.GeminiStatus {
+	if usage == nil {
+		return status
+	}
+	if status == nil {
+		status = &model.GeminiStatus{}
+	}
+	status.Usage = usage
+	return status
+}
+
+func withStatusToolEvents(status *model.GeminiStatus, events []model.ToolEvent) *model.GeminiStatus {
+	if len(events) == 0 {
+		return status
+	}
+	if status == nil {
+		status = &model.GeminiStatus{}
+	}
+	status.ToolEvents = events
+	return status
+}
+
+func printableModel(modelName string) string {
+	if strings.TrimSpace(modelName) == "" {
+		return "auto"
+	}
+	return modelName
+}
+
+func isRetryableModelError(err error, status *model.GeminiStatus) bool {
+	// A full local queue rejects every model alike.
+	var queueErr *QueueFullError
+	if errors.As(err, &queueErr) {
+		return false
+	}
+	if status != nil && status.HTTPStatus == http.StatusTooManyRequests {
+		return true
+	}
+
+	message := strings.ToLower(err.Error())
+	return strings.Contains(message, "rate limit") ||
+		strings.Contains(message, "ratelimit") ||
+		strings.Contains(message, "resource_exhausted") ||
+		strings.Contains(message, "capacity") ||
+		strings.Contains(message, "quota")
+}
+
+func shouldFallbackAfterSuccess(status *model.GeminiStatus, attemptIndex int, totalAttempts int) bool {
+	if status == nil || status.HTTPStatus != http.StatusTooManyRequests {
+		return false
+	}
+	return attemptIndex < totalAttempts-1
+}
@@ -0,0 +1,2744 @@
+package gemini
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gemini-wrapper/logging"
+	"gemini-wrapper/metrics"
+	"gemini-wrapper/model"
+	"gemini-wrapper/service/audit"
+	"gemini-wrapper/service/cacheinfo"
+	"gemini-wrapper/service/cluster"
+	"gemini-wrapper/service/execution"
+	"gemini-wrapper/service/postprocess"
+	"gemini-wrapper/service/tenants"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestParseFallbackModelsBracketSyntax(t *testing.T) {
+	got := parseFallbackModels("[gemini-2.5-flash, gemini-3.1-lite-flash]")
+	want := []string{"gemini-2.5-flash", "gemini-3.1-lite-flash"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected fallback models: got=%v want=%v", got, want)
+	}
+}
+
+func TestParseFallbackModelsCommaSyntaxWithQuotesAndDedup(t *testing.T) {
+	got := parseFallbackModels(" 'gemini-2.5-flash' , \"gemini-2.5-flash\" , gemini-2.5-pro ")
+	want := []string{"gemini-2.5-flash", "gemini-2.5-pro"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected fallback models: got=%v want=%v", got, want)
+	}
+}
+
+func TestBuildAttemptModelsSkipsDuplicatePrimary(t *testing.T) {
+	svc := &GeminiService{fallbackModels: []string{"gemini-2.5-flash", "gemini-2.5-pro", "gemini-2.5-pro"}}
+	got := svc.buildAttemptModels("gemini-2.5-flash")
+	want := []string{"gemini-2.5-flash", "gemini-2.5-pro"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected attempt models: got=%v want=%v", got, want)
+	}
+}
+
+func TestBuildCacheKeyIncludesModel(t *testing.T) {
+	svc := &GeminiService{}
+	k1 := svc.buildCacheKey("hello", "gemini-a")
+	k2 := svc.buildCacheKey("hello", "gemini-b")
+	if k1 == k2 {
+		t.Fatal("expected different cache keys for different models")
+	}
+}
+
+func TestCacheSetGetAndExpire(t *testing.T) {
+	svc := &GeminiService{
+		cacheEnabled: true,
+		cacheTTL:     20 * time.Millisecond,
+		cacheMaxSize: 10,
+		cache:        map[string]cacheEntry{},
+	}
+
+	key := svc.buildCacheKey("q", "m")
+	status := &model.GeminiStatus{HTTPStatus: 429, Model: "gemini-x"}
+	svc.setCached(key, "answer", status)
+
+	gotAnswer, gotStatus, ok := svc.getCached(key)
+	if !ok || gotAnswer != "answer" || gotStatus == nil || gotStatus.Model != "gemini-x" {
+		t.Fatalf("unexpected cache hit: ok=%v answer=%q status=%#v", ok, gotAnswer, gotStatus)
+	}
+
+	// Ensure cache status is a copy, not the original pointer.
+	status.Model = "changed"
+	_, gotStatusAgain, ok := svc.getCached(key)
+	if !ok || gotStatusAgain.Model != "gemini-x" {
+		t.Fatalf("expected cached status to be immutable copy, got %#v", gotStatusAgain)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if _, _, ok := svc.getCached(key); ok {
+		t.Fatal("expected expired cache entry")
+	}
+}
+
+func TestSetCachedRespectsMaxSize(t *testing.T) {
+	svc := &GeminiService{
+		cacheEnabled: true,
+		cacheTTL:     time.Minute,
+		cacheMaxSize: 1,
+		cache:        map[string]cacheEntry{},
+	}
+
+	svc.setCached("k1", "a1", nil)
+	svc.setCached("k2", "a2", nil)
+	if len(svc.cache) > 1 {
+		t.Fatalf("expected cache size <= 1, got %d", len(svc.cache))
+	}
+}
+
+func TestNoCacheAlwaysAsks(t *testing.T) {
+	backend := &flakyBackend{}
+	svc := &GeminiService{
+		backend:      backend,
+		cacheEnabled: true,
+		cacheTTL:     time.Minute,
+		cacheMaxSize: 10,
+		cache:        map[string]cacheEntry{},
+	}
+	if _, _, err := svc.AskWithOptions(context.Background(), "q", model.AskOptions{}); err != nil {
+		t.Fatalf("Ask: %v", err)
+	}
+	if _, _, err := svc.AskWithOptions(context.Background(), "q", model.AskOptions{NoCache: true}); err != nil {
+		t.Fatalf("Ask: %v", err)
+	}
+	if backend.calls != 2 {
+		t.Fatalf("expected NoCache to skip the cached answer, got %d calls", backend.calls)
+	}
+	if _, _, err := svc.AskWithOptions(context.Background(), "other", model.AskOptions{NoCache: true}); err != nil {
+		t.Fatalf("Ask: %v", err)
+	}
+	if len(svc.cache) != 1 {
+		t.Fatalf("expected NoCache answers not to be stored, got %d entries", len(svc.cache))
+	}
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	svc := &GeminiService{
+		cacheEnabled: true,
+		cacheTTL:     time.Minute,
+		cacheMaxSize: 2,
+		cache:        map[string]cacheEntry{},
+	}
+
+	svc.setCached("k1", "a1", nil)
+	time.Sleep(time.Millisecond)
+	svc.setCached("k2", "a2", nil)
+	time.Sleep(time.Millisecond)
+	if _, _, ok := svc.getCached("k1"); !ok {
+		t.Fatal("expected k1 to be cached")
+	}
+	time.Sleep(time.Millisecond)
+	svc.setCached("k3", "a3", nil)
+
+	if _, ok := svc.cache["k2"]; ok {
+		t.Fatal("expected least recently used k2 to be evicted")
+	}
+	if _, ok := svc.cache["k1"]; !ok {
+		t.Fatal("expected recently read k1 to survive")
+	}
+}
+
+func TestPurgeCacheClearsMemoryAndDisk(t *testing.T) {
+	svc := &GeminiService{
+		cacheEnabled:     true,
+		cacheTTL:         time.Minute,
+		cacheMaxSize:     10,
+		cache:            map[string]cacheEntry{},
+		diskCacheEnabled: true,
+		diskCachePath:    filepath.Join(t.TempDir(), "gemini-cache.db"),
+	}
+	if err := svc.initDiskCache(); err != nil {
+		t.Fatalf("initDiskCache failed: %v", err)
+	}
+	defer svc.diskDB.Close()
+
+	svc.setCached("k1", "a1", nil)
+	svc.setCached("k2", "a2", nil)
+	result, err := svc.PurgeCache()
+	if err != nil {
+		t.Fatalf("PurgeCache: %v", err)
+	}
+	if result.MemoryEntries != 2 || result.DiskEntries != 2 {
+		t.Fatalf("unexpected purge result: %#v", result)
+	}
+	if _, _, ok := svc.getCached("k1"); ok {
+		t.Fatal("expected cache to be empty after purge")
+	}
+	svc.setCached("k3", "a3", nil)
+	if _, _, ok := svc.getCached("k3"); !ok {
+		t.Fatal("expected cache to work after purge")
+	}
+}
+
+func TestAskReportsCacheResult(t *testing.T) {
+	svc := &GeminiService{
+		backend:      newBackend(Config{Backend: backendMock}),
+		cacheEnabled: true,
+		cacheTTL:     time.Minute,
+		cacheMaxSize: 10,
+		cache:        map[string]cacheEntry{},
+	}
+
+	for _, want := range []cacheinfo.Result{cacheinfo.Miss, cacheinfo.Hit} {
+		ctx, report := cacheinfo.WithReport(context.Background())
+		if _, _, err := svc.Ask(ctx, "hello\r\nworld", ""); err != nil {
+			t.Fatalf("Ask: %v", err)
+		}
+		if report.Result() != want {
+			t.Fatalf("expected %s, got %q", want, report.Result())
+		}
+	}
+	if _, _, ok := svc.getCached(svc.buildCacheKey("hello\nworld", "")); !ok {
+		t.Fatal("expected line endings to be normalized in the cache key")
+	}
+}
+
+func TestParseEnvBoolDefaultsAndTruthy(t *testing.T) {
+	t.Setenv("CACHE_BOOL_TEST", "")
+	if !parseEnvBool("CACHE_BOOL_TEST", true) {
+		t.Fatal("expected default true")
+	}
+	t.Setenv("CACHE_BOOL_TEST", "yes")
+	if !parseEnvBool("CACHE_BOOL_TEST", false) {
+		t.Fatal("expected truthy value to be true")
+	}
+}
+
+func TestDiskCacheReadThrough(t *testing.T) {
+	tempDir := t.TempDir()
+	dbPath := filepath.Join(tempDir, "gemini-cache.db")
+
+	svcWriter := &GeminiService{
+		cacheEnabled:     true,
+		cacheTTL:         time.Minute,
+		cacheMaxSize:     100,
+		cache:            map[string]cacheEntry{},
+		diskCacheEnabled: true,
+		diskCachePath:    dbPath,
+		dedupeEnabled:    false,
+	}
+	if err := svcWriter.initDiskCache(); err != nil {
+		t.Fatalf("initDiskCache writer failed: %v", err)
+	}
+
+	key := svcWriter.buildCacheKey("disk question", "gemini-2.5-flash")
+	svcWriter.setCached(key, "disk-answer", &model.GeminiStatus{Model: "gemini-2.5-flash"})
+	if err := svcWriter.diskDB.Close(); err != nil {
+		t.Fatalf("close writer db failed: %v", err)
+	}
+
+	svcReader := &GeminiService{
+		cacheEnabled:     true,
+		cacheTTL:         time.Minute,
+		cacheMaxSize:     100,
+		cache:            map[string]cacheEntry{},
+		diskCacheEnabled: true,
+		diskCachePath:    dbPath,
+		dedupeEnabled:    false,
+	}
+	if err := svcReader.initDiskCache(); err != nil {
+		t.Fatalf("initDiskCache reader failed: %v", err)
+	}
+	defer svcReader.diskDB.Close()
+
+	answer, status, ok := svcReader.getCached(key)
+	if !ok || answer != "disk-answer" || status == nil || status.Model != "gemini-2.5-flash" {
+		t.Fatalf("unexpected disk cache read-through: ok=%v answer=%q status=%#v", ok, answer, status)
+	}
+	if len(svcReader.cache) != 1 {
+		t.Fatalf("expected memory cache repopulated from disk, size=%d", len(svcReader.cache))
+	}
+}
+
+func TestSharedCacheServesOtherReplicas(t *testing.T) {
+	server := miniredis.RunT(t)
+	shared := cluster.New(redis.NewClient(&redis.Options{Addr: server.Addr()}), cluster.DefaultConfig())
+	defer shared.Close()
+	newReplica := func() *GeminiService {
+		svc := &GeminiService{cacheEnabled: true, cacheTTL: time.Minute, cacheMaxSize: 100, cache: map[string]cacheEntry{}}
+		svc.SetSharedCache(shared)
+		return svc
+	}
+	writer, reader := newReplica(), newReplica()
+
+	key := writer.buildCacheKey("shared question", "gemini-2.5-flash")
+	writer.setCached(key, "shared-answer", &model.GeminiStatus{Model: "gemini-2.5-flash"})
+	answer, status, ok := reader.getCached(key)
+	if !ok || answer != "shared-answer" || status == nil || status.Model != "gemini-2.5-flash" {
+		t.Fatalf("unexpected shared cache read: ok=%v answer=%q status=%#v", ok, answer, status)
+	}
+	if len(reader.cache) != 1 {
+		t.Fatalf("expected memory cache repopulated from Redis, size=%d", len(reader.cache))
+	}
+
+	result, err := reader.PurgeCache()
+	if err != nil || result.SharedEntries != 1 {
+		t.Fatalf("unexpected purge result: %#v err=%v", result, err)
+	}
+	writer.cache = map[string]cacheEntry{}
+	if _, _, ok := writer.getCached(key); ok {
+		t.Fatal("expected the purge to reach the other replica")
+	}
+}
+
+// installFakeGeminiCLI puts a shell script named gemini on PATH for the duration of the test.
+func installFakeGeminiCLI(t *testing.T, script string) {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "gemini"), []byte("#!/bin/sh\n"+script), 0o755); err != nil {
+		t.Fatalf("write fake gemini failed: %v", err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestAskStreamEmitsLinesAndCaches(t *testing.T) {
+	installFakeGeminiCLI(t, "echo 'first line'\necho 'second line'\n")
+
+	svc := &GeminiService{
+		cacheEnabled: true,
+		cacheTTL:     time.Minute,
+		cacheMaxSize: 10,
+		cache:        map[string]cacheEntry{},
+	}
+
+	var chunks []string
+	answer, _, err := svc.AskStream(context.Background(), "question", "gemini-2.5-flash", func(chunk string) error {
+		chunks = append(chunks, chunk)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if answer != "first line\nsecond line" {
+		t.Fatalf("unexpected answer: %q", answer)
+	}
+	if len(chunks) != 2 || strings.TrimSpace(chunks[0]) != "first line" {
+		t.Fatalf("unexpected chunks: %q", chunks)
+	}
+
+	cached, _, ok := svc.getCached(svc.buildCacheKey("question", "gemini-2.5-flash"))
+	if !ok || cached != answer {
+		t.Fatalf("expected streamed answer to be cached, ok=%v cached=%q", ok, cached)
+	}
+}
+
+func TestAskStreamReportsProgress(t *testing.T) {
+	installFakeGeminiCLI(t, "echo 'Executing tool: read_file' >&2\nsleep 0.3\necho 'the answer'\n")
+
+	svc := &GeminiService{cache: map[string]cacheEntry{}}
+	ctx, progress := WithProgress(context.Background())
+	if got := progress.Snapshot(); got.Phase != model.ProgressWaiting || got.Tokens != 0 {
+		t.Fatalf("unexpected progress before the stream: %+v", got)
+	}
+	tools := make(chan string, 1)
+	go func() {
+		for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+			if got := progress.Snapshot(); got.Phase == model.ProgressTool {
+				tools <- got.Tool
+				return
+			}
+		}
+		tools <- ""
+	}()
+	if _, _, err := svc.AskStream(ctx, "question", "", func(string) error { return nil }); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if tool := <-tools; tool != "read_file" {
+		t.Fatalf("expected the tool to be reported, got %q", tool)
+	}
+	got := progress.Snapshot()
+	if got.Phase != model.ProgressAnswering || got.Tool != "" || got.Tokens != EstimateTokens("the answer") || got.ElapsedSeconds <= 0 {
+		t.Fatalf("unexpected progress after the stream: %+v", got)
+	}
+}
+
+func TestAskReportsToolEvents(t *testing.T) {
+	installFakeGeminiCLI(t, "echo 'Executing tool: read_file' >&2\necho '{\"response\": \"hi\", \"stats\": {\"tools\": {\"byName\": {\"read_file\": {\"count\": 1, \"success\": 1}}}}}'\n")
+	svc := &GeminiService{cache: map[string]cacheEntry{}}
+	answer, status, err := svc.Ask(context.Background(), "question", "")
+	if err != nil || answer != "hi" {
+		t.Fatalf("unexpected answer %q err=%v", answer, err)
+	}
+	if len(status.ToolEvents) != 1 || status.ToolEvents[0] != (model.ToolEvent{Name: "read_file", Calls: 1, Succeeded: 1}) {
+		t.Fatalf("unexpected tool events: %#v", status.ToolEvents)
+	}
+
+	installFakeGeminiCLI(t, "echo 'Executing tool: read_file' >&2\necho 'Executing tool: run_shell_command' >&2\necho 'Error executing tool run_shell_command: denied' >&2\necho 'the answer'\n")
+	_, status, err = svc.AskStream(context.Background(), "other question", "", func(string) error { return nil })
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []model.ToolEvent{{Name: "read_file", Calls: 1, Succeeded: 1}, {Name: "run_shell_command", Calls: 1, Failed: 1}}
+	if len(status.ToolEvents) != 2 || status.ToolEvents[0] != want[0] || status.ToolEvents[1] != want[1] {
+		t.Fatalf("unexpected streamed tool events: %#v", status.ToolEvents)
+	}
+}
+
+func TestGroundedAskSearchesAndReturnsCitations(t *testing.T) {
+	installFakeGeminiCLI(t, `case "$*" in
+*"--allowed-tools google_web_search"*"Search the web"*|*"Search the web"*"--allowed-tools google_web_search"*)
+  echo '{"response": "It is sunny [1].\n\nSources:\n1. https://weather.example/today.\n2. [Forecast](https://forecast.example/a?b=c)\n3. https://weather.example/today"}' ;;
+*) echo '{"response": "See https://weather.example/today"}' ;;
+esac
+`)
+	svc := &GeminiService{cache: map[string]cacheEntry{}}
+	grounding := true
+	_, status, err := svc.AskWithOptions(context.Background(), "weather?", model.AskOptions{Grounding: &grounding})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []string{"https://weather.example/today", "https://forecast.example/a?b=c"}
+	if !reflect.DeepEqual(status.Citations, want) {
+		t.Fatalf("citations %q, want %q", status.Citations, want)
+	}
+
+	// Without grounding the search tool is not enabled and nothing is cited.
+	answer, status, err := svc.AskWithOptions(context.Background(), "weather?", model.AskOptions{})
+	if err != nil || answer != "See https://weather.example/today" {
+		t.Fatalf("unexpected answer %q err=%v", answer, err)
+	}
+	if status != nil && len(status.Citations) > 0 {
+		t.Fatalf("ungrounded answer has citations %q", status.Citations)
+	}
+}
+
+func TestOutputLimitInterruptsTheCLI(t *testing.T) {
+	// Without the limit this runaway answer would only end at the timeout.
+	installFakeGeminiCLI(t, "echo 'first line'\necho 'second line'\nsleep 30\necho 'never'\n")
+
+	svc := &GeminiService{cache: map[string]cacheEntry{}}
+	start := time.Now()
+	answer, status, err := svc.AskWithOptions(context.Background(), "question", model.AskOptions{MaxOutputChars: 14})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if answer != "first line\nsec" || status == nil || status.FinishReason != "MAX_TOKENS" {
+		t.Fatalf("unexpected answer %q status=%+v", answer, status)
+	}
+
+	var chunks []string
+	answer, status, err = svc.AskStreamWithOptions(context.Background(), "question", model.AskOptions{GenerationConfig: &model.GenerationConfig{MaxOutputTokens: 4}}, func(chunk string) error {
+		chunks = append(chunks, chunk)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected stream error: %v", err)
+	}
+	if answer != "first line\nsecon" || strings.Join(chunks, "") != "first line\nsecon" || status.FinishReason != "MAX_TOKENS" {
+		t.Fatalf("unexpected stream answer %q chunks=%q status=%+v", answer, chunks, status)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Fatalf("the CLI was not interrupted, took %v", elapsed)
+	}
+}
+
+func TestStopSequenceInterruptsTheCLI(t *testing.T) {
+	installFakeGeminiCLI(t, "echo 'alpha'\necho 'beta END gamma'\nsleep 30\necho 'never'\n")
+
+	svc := &GeminiService{cache: map[string]cacheEntry{}}
+	opts := model.AskOptions{GenerationConfig: &model.GenerationConfig{StopSequences: []string{"END", "ZZZ"}}}
+	start := time.Now()
+	var chunks []string
+	answer, status, err := svc.AskStreamWithOptions(context.Background(), "question", opts, func(chunk string) error {
+		chunks = append(chunks, chunk)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if answer != "alpha\nbeta" || strings.Join(chunks, "") != "alpha\nbeta " || status.FinishReason != "STOP" {
+		t.Fatalf("unexpected answer %q chunks=%q status=%+v", answer, chunks, status)
+	}
+	opts.Model = "other"
+	if answer, status, err = svc.AskWithOptions(context.Background(), "question", opts); err != nil || answer != "alpha\nbeta" || status.FinishReason != "STOP" {
+		t.Fatalf("unexpected answer %q status=%+v err=%v", answer, status, err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Fatalf("the CLI was not interrupted, took %v", elapsed)
+	}
+
+	// A stop sequence split across chunks is never partly sent.
+	chunks = nil
+	limiter := newOutputLimiter(model.AskOptions{GenerationConfig: &model.GenerationConfig{StopSequences: []string{"END"}}}, func(chunk string) error {
+		chunks = append(chunks, chunk)
+		return nil
+	})
+	for _, chunk := range []string{"ab", "cE", "NDx"} {
+		if err = limiter.chunk(chunk); err != nil {
+			break
+		}
+	}
+	if !errors.Is(err, errStopSequence) || strings.Join(chunks, "") != "abc" {
+		t.Fatalf("unexpected chunks %q err=%v", chunks, err)
+	}
+}
+
+func TestIncludeThoughtsSeparatesTheReasoning(t *testing.T) {
+	installFakeGeminiCLI(t, `case "$*" in
+*"write your reasoning between <thought> and </thought>"*)
+  printf '<thought>The user greets me.\nA greeting fits.</thought>\nHello!\n' ;;
+*) echo 'Hello!' ;;
+esac
+`)
+	svc := &GeminiService{cache: map[string]cacheEntry{}}
+	opts := model.AskOptions{GenerationConfig: &model.GenerationConfig{ThinkingConfig: &model.ThinkingConfig{IncludeThoughts: true}}}
+	var chunks []string
+	answer, status, err := svc.AskStreamWithOptions(context.Background(), "hi", opts, func(chunk string) error {
+		chunks = append(chunks, chunk)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if answer != "Hello!" || strings.Contains(strings.Join(chunks, ""), "greets") || status.Thoughts != "The user greets me.\nA greeting fits." {
+		t.Fatalf("unexpected answer %q chunks=%q status=%+v", answer, chunks, status)
+	}
+
+	opts.Model = "other"
+	if answer, status, err = svc.AskWithOptions(context.Background(), "hi", opts); err != nil || answer != "Hello!" || status.Thoughts == "" {
+		t.Fatalf("unexpected answer %q status=%+v err=%v", answer, status, err)
+	}
+	if answer, status, err = svc.AskWithOptions(context.Background(), "hi", model.AskOptions{}); err != nil || answer != "Hello!" || (status != nil && status.Thoughts != "") {
+		t.Fatalf("thoughts without includeThoughts: %q status=%+v err=%v", answer, status, err)
+	}
+
+	// Tags split across chunks are recognised.
+	chunks = nil
+	filter := newThoughtFilter(opts, func(chunk string) error {
+		chunks = append(chunks, chunk)
+		return nil
+	})
+	for _, chunk := range []string{"<tho", "ught>why</th", "ought>ans", "wer <"} {
+		if err := filter.chunk(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	answer, status, _ = filter.result("<thought>why</thought>answer <", nil, nil)
+	if strings.Join(chunks, "") != "answer <" || answer != "answer <" || status.Thoughts != "why" {
+		t.Fatalf("unexpected chunks %q answer %q status=%+v", chunks, answer, status)
+	}
+}
+
+func TestAskWithEnvSetsTheCLIEnvironmentOnly(t *testing.T) {
+	installFakeGeminiCLI(t, "echo \"{\\\"response\\\": \\\"key=$GEMINI_API_KEY\\\"}\"\n")
+	t.Setenv("GEMINI_API_KEY", "server-key")
+
+	svc := &GeminiService{cache: map[string]cacheEntry{}}
+	answer, _, err := svc.AskWithEnv("question", "", map[string]string{"GEMINI_API_KEY": "session-key"})
+	if err != nil || answer != "key=session-key" {
+		t.Fatalf("unexpected answer %q err=%v", answer, err)
+	}
+	if os.Getenv("GEMINI_API_KEY") != "server-key" {
+		t.Fatal("the process environment was changed")
+	}
+	// The same question without the env is neither served from the cache
+	// nor shared with the request above.
+	if answer, _, err = svc.Ask(context.Background(), "question", ""); err != nil || answer != "key=server-key" {
+		t.Fatalf("unexpected answer %q err=%v", answer, err)
+	}
+}
+
+func TestAskStreamRendersRedrawnOutput(t *testing.T) {
+	installFakeGeminiCLI(t, "printf 'Thinking |\\rThinking /\\r\\033[2K'\nprintf 'answer\\n\\033[32mdone\\033[0m\\n'\n")
+
+	svc := &GeminiService{cache: map[string]cacheEntry{}}
+	var chunks []string
+	answer, _, err := svc.AskStream(context.Background(), "question", "", func(chunk string) error {
+		chunks = append(chunks, chunk)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if answer != "answer\ndone" || strings.Join(chunks, "") != "answer\ndone\n" {
+		t.Fatalf("expected the spinner and colours to be gone, got answer %q and chunks %q", answer, chunks)
+	}
+}
+
+func TestAskStreamEndsAtTheSentinel(t *testing.T) {
+	installFakeGeminiCLI(t, `sentinel=$(printf '%s' "$2" | grep -o '<<END-[0-9a-f]*>>' | head -n 1)
+printf 'first line\n'
+printf 'last line %s\n' "$sentinel"
+printf 'telemetry flushed\n'
+exec sleep 30
+`)
+
+	svc := &GeminiService{cache: map[string]cacheEntry{}, backend: headlessBackend{streamSentinel: true}}
+	var chunks []string
+	start := time.Now()
+	answer, _, err := svc.AskStream(context.Background(), "question", "", func(chunk string) error {
+		chunks = append(chunks, chunk)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if answer != "first line\nlast line" || strings.Join(chunks, "") != "first line\nlast line" {
+		t.Fatalf("expected the answer to end at the sentinel, got answer %q and chunks %q", answer, chunks)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Fatalf("expected the lingering CLI to be stopped, took %v", elapsed)
+	}
+}
+
+func TestAskStreamForwardsStreamJSONDeltas(t *testing.T) {
+	installFakeGeminiCLI(t, `[ "$4" = stream-json ] || { echo "unexpected format $4" >&2; exit 1; }
+echo 'Loaded cached credentials.'
+echo '{"type":"init","session_id":"s1","model":"gemini-2.5-flash"}'
+echo '{"type":"message","role":"user","content":"question"}'
+echo '{"type":"tool_use","tool_name":"read_file","tool_id":"t1","parameters":{}}'
+echo '{"type":"tool_result","tool_id":"t1","status":"error","output":"missing"}'
+echo '{"type":"message","role":"assistant","content":"  Hel","delta":true}'
+echo '{"type":"message","role":"assistant","content":"lo, wor","delta":true}'
+echo '{"type":"message","role":"assistant","content":"ld","delta":true}'
+echo '{"type":"message","role":"assistant","content":"Hello, world"}'
+echo '{"type":"result","status":"success","stats":{"total_tokens":12,"input_tokens":9,"output_tokens":3,"duration_ms":40,"tool_calls":1}}'
+exec sleep 30
+`)
+
+	svc := &GeminiService{cache: map[string]cacheEntry{}, backend: headlessBackend{streamJSON: true, streamSentinel: true}}
+	var chunks []string
+	start := time.Now()
+	answer, status, err := svc.AskStream(context.Background(), "question", "", func(chunk string) error {
+		chunks = append(chunks, chunk)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if answer != "Hello, world" || strings.Join(chunks, "|") != "Hel|lo, wor|ld" {
+		t.Fatalf("expected the deltas as chunks, got answer %q and chunks %q", answer, chunks)
+	}
+	if status == nil || status.Usage == nil || status.Usage.TotalTokenCount != 12 || len(status.ToolEvents) != 1 || status.ToolEvents[0].Failed != 1 {
+		t.Fatalf("expected usage and tool events from the events, got %#v", status)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Fatalf("expected the lingering CLI to be stopped after the result, took %v", elapsed)
+	}
+}
+
+func TestAskStreamReportsStreamJSONErrors(t *testing.T) {
+	installFakeGeminiCLI(t, `echo '{"type":"message","role":"assistant","content":"partial","delta":true}'
+echo '{"type":"result","status":"error","error":{"type":"FatalTurnLimitedError","message":"too many turns"}}'
+exit 53
+`)
+
+	svc := &GeminiService{cache: map[string]cacheEntry{}, backend: headlessBackend{streamJSON: true}}
+	_, _, err := svc.AskStream(context.Background(), "question", "", func(string) error { return nil })
+	if err == nil || !strings.Contains(err.Error(), "too many turns") {
+		t.Fatalf("expected the error of the result event, got %v", err)
+	}
+}
+
+func TestAskStreamReportsCLIFailure(t *testing.T) {
+	installFakeGeminiCLI(t, "echo 'boom' >&2\nexit 1\n")
+
+	svc := &GeminiService{cache: map[string]cacheEntry{}}
+	_, _, err := svc.AskStream(context.Background(), "question", "", func(string) error { return nil })
+	if err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestApplyGenerationLimitsStopSequenceAndMaxTokens(t *testing.T) {
+	answer, status := applyGenerationLimits("alpha END beta", nil, model.AskOptions{GenerationConfig: &model.GenerationConfig{StopSequences: []string{"END"}}})
+	if answer != "alpha" || status == nil || status.FinishReason != "STOP" {
+		t.Fatalf("unexpected stop handling: answer=%q status=%#v", answer, status)
+	}
+
+	answer, status = applyGenerationLimits("abcdefghijkl", nil, model.AskOptions{GenerationConfig: &model.GenerationConfig{MaxOutputTokens: 2}})
+	if answer != "abcdefgh" || status == nil || status.FinishReason != "MAX_TOKENS" {
+		t.Fatalf("unexpected max token handling: answer=%q status=%#v", answer, status)
+	}
+}
+
+func TestBuildCacheKeyIncludesGenerationConfig(t *testing.T) {
+	svc := &GeminiService{}
+	temperature := 0.2
+	plain := svc.buildCacheKey("hello", "gemini-a", generationVariant(nil))
+	tuned := svc.buildCacheKey("hello", "gemini-a", generationVariant(&model.GenerationConfig{Temperature: &temperature}))
+	if plain != svc.buildCacheKey("hello", "gemini-a") {
+		t.Fatal("expected nil generation config to keep the legacy cache key")
+	}
+	if plain == tuned {
+		t.Fatal("expected generation config to change the cache key")
+	}
+}
+
+func TestPrepareGenerationWorkspaceWritesSettings(t *testing.T) {
+	temperature := 0.3
+	dir, cleanup, err := prepareGenerationWorkspace("gemini-2.5-flash", &model.GenerationConfig{Temperature: &temperature}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer cleanup()
+
+	payload, err := os.ReadFile(filepath.Join(dir, ".gemini", "settings.json"))
+	if err != nil {
+		t.Fatalf("settings not written: %v", err)
+	}
+	if !strings.Contains(string(payload), "\"temperature\": 0.3") || !strings.Contains(string(payload), "gemini-2.5-flash") {
+		t.Fatalf("unexpected settings: %s", payload)
+	}
+
+	if dir, _, _ := prepareGenerationWorkspace("", &model.GenerationConfig{MaxOutputTokens: 10}, nil); dir != "" {
+		t.Fatalf("expected no workspace without sampling parameters, got %q", dir)
+	}
+}
+
+func TestParseBackendModeDefaultsToHeadless(t *testing.T) {
+	for _, raw := range []string{"", "headless", "CLI", "pty"} {
+		if got := parseBackendMode(raw); got != backendHeadless {
+			t.Fatalf("parseBackendMode(%q) = %q", raw, got)
+		}
+	}
+}
+
+func TestMockBackendServesWithoutCLI(t *testing.T) {
+	t.Setenv("PATH", t.TempDir())
+	if got := parseBackendMode(" Mock "); got != backendMock {
+		t.Fatalf("parseBackendMode(mock) = %q", got)
+	}
+	svc := &GeminiService{backend: newBackend(Config{Backend: backendMock})}
+
+	answer, status, err := svc.AskWithOptions(context.Background(), "ping", model.AskOptions{Model: "gemini-2.5-flash"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if answer != "mock answer: ping" {
+		t.Fatalf("unexpected answer: %q", answer)
+	}
+	if status == nil || status.Model != "gemini-2.5-flash" || status.Usage == nil || status.Usage.TotalTokenCount == 0 {
+		t.Fatalf("unexpected status: %#v", status)
+	}
+
+	var chunks []string
+	streamed, _, err := svc.AskStream(context.Background(), "ping", "", func(chunk string) error {
+		chunks = append(chunks, chunk)
+		return nil
+	})
+	if err != nil || streamed != "mock answer: ping" || len(chunks) != 1 {
+		t.Fatalf("unexpected stream result: %q %v %#v", streamed, err, chunks)
+	}
+}
+
+func TestMockBackendServesFixtures(t *testing.T) {
+	fixtures := filepath.Join(t.TempDir(), "fixtures.yaml")
+	content := "fixtures:\n  - pattern: \"^weather\"\n    answers: [sunny, rainy]\n  - match: quota\n    status: 429\n    error: quota exceeded\n"
+	if err := os.WriteFile(fixtures, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	svc := &GeminiService{backend: newMockBackend(MockConfig{
+		FixturesFile: fixtures,
+		Fixtures:     []MockFixture{{Model: "gemini-2.5-pro", Answer: "pro answer"}},
+	})}
+
+	for _, want := range []string{"sunny", "rainy", "sunny"} {
+		if answer, _, err := svc.AskWithOptions(context.Background(), "weather today?", model.AskOptions{}); err != nil || answer != want {
+			t.Fatalf("expected %q, got %q (%v)", want, answer, err)
+		}
+	}
+	if answer, _, _ := svc.AskWithOptions(context.Background(), "weather today?", model.AskOptions{Model: "gemini-2.5-pro"}); answer != "pro answer" {
+		t.Fatalf("expected the model fixture to come first, got %q", answer)
+	}
+	if answer, _, _ := svc.AskWithOptions(context.Background(), "ping", model.AskOptions{}); answer != "mock answer: ping" {
+		t.Fatalf("expected unmatched questions to be echoed, got %q", answer)
+	}
+
+	_, status, err := svc.AskWithOptions(context.Background(), "over quota", model.AskOptions{})
+	if err == nil || status == nil || status.HTTPStatus != http.StatusTooManyRequests || status.Code != "RESOURCE_EXHAUSTED" {
+		t.Fatalf("expected a scripted 429, got status=%#v err=%v", status, err)
+	}
+}
+
+func TestMockBackendInjectsLatencyAndErrors(t *testing.T) {
+	svc := &GeminiService{backend: newMockBackend(MockConfig{ErrorRate: 1, ErrorStatus: http.StatusUnauthorized})}
+	_, status, err := svc.AskWithOptions(context.Background(), "ping", model.AskOptions{})
+	if !errors.Is(err, ErrAuthentication) || status == nil || status.HTTPStatus != http.StatusUnauthorized {
+		t.Fatalf("expected an injected 401, got status=%#v err=%v", status, err)
+	}
+
+	svc = &GeminiService{backend: newMockBackend(MockConfig{Latency: time.Second})}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, _, err := svc.AskWithOptions(ctx, "ping", model.AskOptions{}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the latency to honor the deadline, got %v", err)
+	}
+}
+
+func TestStructuredOutputRepairsAnswersThatMissTheSchema(t *testing.T) {
+	schema := json.RawMessage(`{"type": "object", "properties": {"count": {"type": "integer"}}, "required": ["count"]}`)
+	opts := model.AskOptions{GenerationConfig: &model.GenerationConfig{ResponseMimeType: "application/json", ResponseSchema: schema}}
+	svc := &GeminiService{
+		backend: newMockBackend(MockConfig{Fixtures: []MockFixture{{
+			Match:   "inventory",
+			Answers: []string{"Sure! There are three.", "```json\n{\"count\": \"three\"}\n```", "```json\n{\"count\": 3}\n```"},
+		}}}),
+		jsonRepairAttempts: 2,
+	}
+
+	answer, status, err := svc.AskWithOptions(context.Background(), "inventory?", opts)
+	if err != nil || answer != `{"count": 3}` || status == nil || status.Repairs != 2 {
+		t.Fatalf("expected the second repair to be accepted, got %q %#v %v", answer, status, err)
+	}
+
+	svc.jsonRepairAttempts = 1
+	var chunks []string
+	_, status, err = svc.AskStreamWithOptions(context.Background(), "inventory count?", opts, func(chunk string) error {
+		chunks = append(chunks, chunk)
+		return nil
+	})
+	if !errors.Is(err, ErrInvalidOutput) || status == nil || status.HTTPStatus != http.StatusBadGateway || status.Code != invalidOutputCode || len(chunks) != 0 {
+		t.Fatalf("expected a 502 once repairs ran out, got %#v %v %#v", status, err, chunks)
+	}
+
+	invalid := model.AskOptions{GenerationConfig: &model.GenerationConfig{ResponseMimeType: "application/json", ResponseSchema: json.RawMessage(`{"type": "text"}`)}}
+	if _, status, err := svc.AskWithOptions(context.Background(), "inventory?", invalid); err == nil || status == nil || status.HTTPStatus != http.StatusBadRequest {
+		t.Fatalf("expected an invalid schema to be a 400, got %#v %v", status, err)
+	}
+}
+
+func TestStripCodeFence(t *testing.T) {
+	cases := map[string]string{
+		"{\"a\": 1}":               "{\"a\": 1}",
+		"```json\n{\"a\": 1}\n```": "{\"a\": 1}",
+		"```\n[1, 2]\n```\n":       "[1, 2]",
+		"```json {\"a\": 1}```":    "```json {\"a\": 1}```",
+		"text ```json\n{}\n```":    "text ```json\n{}\n```",
+	}
+	for in, want := range cases {
+		if got := stripCodeFence(in); got != want {
+			t.Fatalf("stripCodeFence(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+type blockingBackend struct {
+	started chan struct{}
+	unblock chan struct{}
+}
+
+func (b *blockingBackend) Name() string { return "blocking" }
+
+func (b *blockingBackend) Generate(_ context.Context, question string, _ model.AskOptions) (string, *model.GeminiStatus, error) {
+	b.started <- struct{}{}
+	<-b.unblock
+	return "answer " + question, nil, nil
+}
+
+func (b *blockingBackend) Stream(ctx context.Context, question string, opts model.AskOptions, onChunk func(chunk string) error) (string, *model.GeminiStatus, error) {
+	return b.Generate(ctx, question, opts)
+}
+
+func TestWorkerPoolLimitsConcurrentBackendCalls(t *testing.T) {
+	backend := &blockingBackend{started: make(chan struct{}, 3), unblock: make(chan struct{})}
+	svc := &GeminiService{backend: backend, pool: newWorkerPool(2, 0)}
+
+	done := make(chan error, 3)
+	for _, q := range []string{"a", "b", "c"} {
+		go func(q string) {
+			_, _, err := svc.Ask(context.Background(), q, "")
+			done <- err
+		}(q)
+	}
+
+	<-backend.started
+	<-backend.started
+	deadline := time.Now().Add(time.Second)
+	for svc.PoolStats().Waiting != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected one waiting request, got %#v", svc.PoolStats())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if stats := svc.PoolStats(); stats.Size != 2 || stats.Busy != 2 {
+		t.Fatalf("unexpected pool stats: %#v", stats)
+	}
+
+	close(backend.unblock)
+	for i := 0; i < 3; i++ {
+		if err := <-done; err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if stats := svc.PoolStats(); stats.Busy != 0 || stats.Waiting != 0 {
+		t.Fatalf("expected idle pool, got %#v", stats)
+	}
+}
+
+func TestFullQueueRejectsRequests(t *testing.T) {
+	backend := &blockingBackend{started: make(chan struct{}, 2), unblock: make(chan struct{})}
+	svc := &GeminiService{backend: backend, pool: newWorkerPool(1, 1)}
+
+	done := make(chan error, 2)
+	for _, q := range []string{"a", "b"} {
+		go func(q string) {
+			_, _, err := svc.Ask(context.Background(), q, "")
+			done <- err
+		}(q)
+	}
+
+	<-backend.started
+	deadline := time.Now().Add(time.Second)
+	for svc.PoolStats().Waiting != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected one waiting request, got %#v", svc.PoolStats())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if stats := svc.PoolStats(); stats.QueueLimit != 1 || stats.OldestWaitSeconds <= 0 {
+		t.Fatalf("unexpected pool stats: %#v", stats)
+	}
+
+	_, status, err := svc.Ask(context.Background(), "c", "")
+	var queueErr *QueueFullError
+	if !errors.As(err, &queueErr) || queueErr.Position != 2 || queueErr.Limit != 1 {
+		t.Fatalf("expected queue full error at position 2, got %v", err)
+	}
+	if status == nil || status.HTTPStatus != 429 || status.Code != QueueFullCode {
+		t.Fatalf("expected 429 QUEUE_FULL status, got %#v", status)
+	}
+
+	close(backend.unblock)
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+}
+
+func TestWorkerPoolServesHigherPrioritiesFirst(t *testing.T) {
+	pool := newWorkerPool(1, 0)
+	release, err := pool.acquire(context.Background(), priorityLevel(model.PriorityNormal))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	order := make(chan string, 4)
+	for i, class := range []string{model.PriorityLow, model.PriorityNormal, model.PriorityHigh, model.PriorityNormal} {
+		name := fmt.Sprintf("%s-%d", class, i)
+		go func() {
+			release, err := pool.acquire(context.Background(), priorityLevel(class))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			order <- name
+			release()
+		}()
+		for pool.stats().Waiting != i+1 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	release()
+	var got []string
+	for range 4 {
+		got = append(got, <-order)
+	}
+	want := []string{"high-2", "normal-1", "normal-3", "low-0"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected workers in order %v, got %v", want, got)
+	}
+	if stats := pool.stats(); stats.Busy != 0 || stats.Waiting != 0 {
+		t.Fatalf("expected an idle pool, got %#v", stats)
+	}
+}
+
+func TestWorkerPoolListsQueuedRequests(t *testing.T) {
+	pool := newWorkerPool(1, 0)
+	release, err := pool.acquire(context.Background(), priorityLevel(model.PriorityNormal))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for i, class := range []string{model.PriorityLow, model.PriorityHigh} {
+		waiterCtx := execution.WithClient(logging.WithRequestID(ctx, "req-"+class), "key:"+class)
+		go pool.acquire(waiterCtx, priorityLevel(class))
+		for pool.stats().Waiting != i+1 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	queued := pool.queued()
+	if len(queued) != 2 {
+		t.Fatalf("expected 2 queued requests, got %#v", queued)
+	}
+	if queued[0].RequestID != "req-high" || queued[0].Client != "key:high" || queued[0].Priority != model.PriorityHigh {
+		t.Fatalf("expected the high priority request first, got %#v", queued[0])
+	}
+	if queued[1].RequestID != "req-low" || queued[1].Priority != model.PriorityLow || queued[1].WaitSeconds <= 0 {
+		t.Fatalf("expected the low priority request second, got %#v", queued[1])
+	}
+	if got := (*workerPool)(nil).queued(); got == nil || len(got) != 0 {
+		t.Fatalf("expected an empty queue without a pool, got %#v", got)
+	}
+}
+
+func TestResolvePriorityUsesClientDefaults(t *testing.T) {
+	svc := &GeminiService{clientPriorities: parseClientPriorities(map[string]string{"key:etl": "batch", "key:bad": "urgent"})}
+	ctx := execution.WithClient(context.Background(), "key:etl")
+
+	for requested, want := range map[string]string{"": model.PriorityLow, "Interactive": model.PriorityHigh} {
+		opts, _, err := svc.resolvePriority(ctx, model.AskOptions{Priority: requested})
+		if err != nil || opts.Priority != want {
+			t.Fatalf("priority %q: expected %s, got %q (%v)", requested, want, opts.Priority, err)
+		}
+	}
+	if opts, _, _ := svc.resolvePriority(context.Background(), model.AskOptions{}); opts.Priority != model.PriorityNormal {
+		t.Fatalf("expected normal without a client default, got %q", opts.Priority)
+	}
+	if _, ok := svc.clientPriorities["key:bad"]; ok {
+		t.Fatal("expected an invalid client priority to be dropped")
+	}
+
+	_, status, err := svc.AskWithOptions(context.Background(), "ping", model.AskOptions{Priority: "urgent"})
+	if err == nil || status == nil || status.HTTPStatus != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an unknown priority, got status=%#v err=%v", status, err)
+	}
+}
+
+func TestAskStopsCLIWhenContextIsCancelled(t *testing.T) {
+	installFakeGeminiCLI(t, "exec sleep 30\n")
+
+	for _, dedupe := range []bool{false, true} {
+		svc := &GeminiService{dedupeEnabled: dedupe}
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		start := time.Now()
+		_, _, err := svc.Ask(ctx, "question", "")
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("dedupe=%t: expected deadline error, got %v", dedupe, err)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Fatalf("dedupe=%t: cancellation took %s", dedupe, elapsed)
+		}
+	}
+}
+
+func TestDedupedAskSurvivesOneCallerCancelling(t *testing.T) {
+	backend := &blockingBackend{started: make(chan struct{}, 1), unblock: make(chan struct{})}
+	svc := &GeminiService{backend: backend, dedupeEnabled: true}
+
+	survivor := make(chan string, 1)
+	go func() {
+		answer, _, _ := svc.Ask(context.Background(), "q", "")
+		survivor <- answer
+	}()
+	<-backend.started
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := svc.Ask(ctx, "q", ""); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected cancelled caller to return context.Canceled, got %v", err)
+	}
+
+	close(backend.unblock)
+	if answer := <-survivor; answer != "answer q" {
+		t.Fatalf("unexpected survivor answer: %q", answer)
+	}
+}
+
+// lingeringBackend takes until release to stop its first generation once it
+// is cancelled, like a CLI given time to exit, and answers later ones at once.
+type lingeringBackend struct {
+	calls   atomic.Int32
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b *lingeringBackend) Name() string { return "lingering" }
+
+func (b *lingeringBackend) Generate(ctx context.Context, question string, _ model.AskOptions) (string, *model.GeminiStatus, error) {
+	if b.calls.Add(1) > 1 {
+		return "answer " + question, nil, nil
+	}
+	close(b.started)
+	<-ctx.Done()
+	<-b.release
+	return "", nil, ctx.Err()
+}
+
+func (b *lingeringBackend) Stream(ctx context.Context, question string, opts model.AskOptions, onChunk func(chunk string) error) (string, *model.GeminiStatus, error) {
+	return b.Generate(ctx, question, opts)
+}
+
+func TestDedupedAskAfterEveryCallerLeftStartsANewGeneration(t *testing.T) {
+	backend := &lingeringBackend{started: make(chan struct{}), release: make(chan struct{})}
+	defer close(backend.release)
+	svc := &GeminiService{backend: backend, dedupeEnabled: true}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	left := make(chan error, 1)
+	go func() {
+		_, _, err := svc.Ask(ctx, "q", "")
+		left <- err
+	}()
+	<-backend.started
+	cancel()
+	if err := <-left; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the cancelled caller to get context.Canceled, got %v", err)
+	}
+
+	answered := make(chan string, 1)
+	go func() {
+		answer, _, err := svc.Ask(context.Background(), "q", "")
+		if err != nil {
+			answer = err.Error()
+		}
+		answered <- answer
+	}()
+	select {
+	case answer := <-answered:
+		if answer != "answer q" {
+			t.Fatalf("expected a new generation to answer, got %q", answer)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the question waited for the cancelled generation")
+	}
+}
+
+// chunkingBackend streams "one " at once and "two" once unblocked, counting
+// its calls.
+type chunkingBackend struct {
+	calls   atomic.Int32
+	unblock chan struct{}
+}
+
+func (b *chunkingBackend) Name() string { return "chunking" }
+
+func (b *chunkingBackend) Generate(ctx context.Context, question string, opts model.AskOptions) (string, *model.GeminiStatus, error) {
+	return b.Stream(ctx, question, opts, func(string) error { return nil })
+}
+
+func (b *chunkingBackend) Stream(_ context.Context, _ string, _ model.AskOptions, onChunk func(chunk string) error) (string, *model.GeminiStatus, error) {
+	b.calls.Add(1)
+	if err := onChunk("one "); err != nil {
+		return "", nil, err
+	}
+	<-b.unblock
+	if err := onChunk("two"); err != nil {
+		return "", nil, err
+	}
+	return "one two", &model.GeminiStatus{Model: "m"}, nil
+}
+
+// waitForWaiters waits until n callers wait for the flight of key.
+func waitForWaiters(t *testing.T, svc *GeminiService, key string, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		svc.flightMu.Lock()
+		flight := svc.flights[key]
+		waiting := flight != nil && flight.waiters == n
+		svc.flightMu.Unlock()
+		if waiting {
+			return
+		}
+	}
+	t.Fatalf("expected %d callers waiting for the flight", n)
+}
+
+func TestIdenticalPendingQuestionsShareOneGeneration(t *testing.T) {
+	backend := &chunkingBackend{unblock: make(chan struct{})}
+	svc := &GeminiService{backend: backend, dedupeEnabled: true}
+	key := svc.coalesceKey("q  one", model.AskOptions{})
+
+	type result struct {
+		chunks, answer string
+		status         *model.GeminiStatus
+		err            error
+	}
+	results := make(chan result, 2)
+	stream := func(question string) {
+		var chunks []string
+		answer, status, err := svc.AskStream(context.Background(), question, "", func(chunk string) error {
+			chunks = append(chunks, chunk)
+			return nil
+		})
+		results <- result{strings.Join(chunks, "|"), answer, status, err}
+	}
+	go stream("q one")
+	waitForWaiters(t, svc, "stream\n"+key, 1)
+	go stream("  q\n one ")
+	waitForWaiters(t, svc, "stream\n"+key, 2)
+	close(backend.unblock)
+
+	coalesced := 0
+	for range 2 {
+		got := <-results
+		if got.err != nil || got.answer != "one two" || got.chunks != "one |two" {
+			t.Fatalf("expected every caller to get the whole stream, got %+v", got)
+		}
+		if got.status.Coalesced {
+			coalesced++
+		}
+	}
+	if coalesced != 1 || backend.calls.Load() != 1 {
+		t.Fatalf("expected one generation shared with one caller, got %d calls and %d coalesced", backend.calls.Load(), coalesced)
+	}
+
+	backend = &chunkingBackend{unblock: make(chan struct{})}
+	svc = &GeminiService{backend: backend, dedupeEnabled: true}
+	statuses := make(chan *model.GeminiStatus, 2)
+	ask := func(question string) {
+		_, status, _ := svc.Ask(context.Background(), question, "")
+		statuses <- status
+	}
+	go ask("q one")
+	waitForWaiters(t, svc, key, 1)
+	go ask("q one\n")
+	waitForWaiters(t, svc, key, 2)
+	close(backend.unblock)
+	first, second := <-statuses, <-statuses
+	if first.Coalesced == second.Coalesced || first == second || backend.calls.Load() != 1 {
+		t.Fatalf("expected one generation and a copy of its status for the second caller, got %#v and %#v after %d calls", first, second, backend.calls.Load())
+	}
+}
+
+func TestSupervisorTracksProbeFailuresAndRecovery(t *testing.T) {
+	installFakeGeminiCLI(t, "echo 0.1.0\n")
+	svc := &GeminiService{supervisor: newSupervisor()}
+
+	if err := svc.probeBackend(); err != nil {
+		t.Fatalf("unexpected probe error: %v", err)
+	}
+	if health := svc.Health(); !health.Ready || health.Version != "0.1.0" || health.Backend != backendHeadless {
+		t.Fatalf("unexpected health after first probe: %#v", health)
+	}
+
+	t.Setenv("PATH", t.TempDir())
+	if _, _, err := svc.Ask(context.Background(), "q", ""); err == nil {
+		t.Fatal("expected missing CLI to fail")
+	}
+	if health := svc.Health(); health.Ready || health.LastError == "" {
+		t.Fatalf("expected missing CLI to mark backend unready: %#v", health)
+	}
+	if err := svc.probeBackend(); err == nil {
+		t.Fatal("expected probe to fail without CLI")
+	}
+	if health := svc.Health(); health.ConsecutiveFailures != 1 {
+		t.Fatalf("unexpected failure count: %#v", health)
+	}
+
+	installFakeGeminiCLI(t, "echo 0.2.0\n")
+	if err := svc.probeBackend(); err != nil {
+		t.Fatalf("unexpected probe error: %v", err)
+	}
+	health := svc.Health()
+	if !health.Ready || health.Recoveries != 1 || health.ConsecutiveFailures != 0 || health.Version != "0.2.0" {
+		t.Fatalf("unexpected health after recovery: %#v", health)
+	}
+}
+
+type staticBackend struct{ answer string }
+
+func (staticBackend) Name() string { return "static" }
+
+func (b staticBackend) Generate(context.Context, string, model.AskOptions) (string, *model.GeminiStatus, error) {
+	return b.answer, nil, nil
+}
+
+func (b staticBackend) Stream(_ context.Context, _ string, _ model.AskOptions, onChunk func(chunk string) error) (string, *model.GeminiStatus, error) {
+	return b.answer, nil, onChunk(b.answer)
+}
+
+func TestNewGeminiServiceWithBackendAnswersFromIt(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Cache.DiskEnabled = false
+	svc := NewGeminiServiceWithBackend(cfg, staticBackend{answer: "42"})
+	defer svc.Close()
+
+	answer, _, err := svc.Ask(context.Background(), "question", "")
+	if err != nil || answer != "42" {
+		t.Fatalf("expected the custom backend to answer, got %q %v", answer, err)
+	}
+	if health := svc.Health(); health.Backend != "static" || health.APIFallback {
+		t.Fatalf("unexpected health: %#v", health)
+	}
+}
+
+func TestSelfTestRetriesUntilAnAnswerComesBack(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Cache.DiskEnabled = false
+	cfg.SelfTest.Enabled = true
+	backend := &flakyBackend{failures: 1}
+	svc := NewGeminiServiceWithBackend(cfg, backend)
+	defer svc.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		result := svc.Health().SelfTest
+		if result == nil {
+			t.Fatal("expected a self-test result in the health")
+		}
+		if result.Passed {
+			if result.RunAt == nil || result.Error != "" || backend.calls != 2 {
+				t.Fatalf("unexpected self-test result %#v after %d calls", result, backend.calls)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the self-test did not pass: %#v", result)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestPacerDelaysBurstsPerAccount(t *testing.T) {
+	p := newPacer(PacingConfig{RequestsPerMinute: 60, Burst: 2})
+	now := time.Now()
+	for i, want := range []time.Duration{0, 0, time.Second, 2 * time.Second} {
+		if delay := p.reserve("", now); delay != want {
+			t.Fatalf("attempt %d: expected a delay of %s, got %s", i+1, want, delay)
+		}
+	}
+	p.cancel("")
+	if delay := p.reserve("", now.Add(2*time.Second)); delay != 0 {
+		t.Fatalf("expected the refilled bucket to let the attempt start, got %s", delay)
+	}
+	if delay := p.reserve("key-2", now); delay != 0 {
+		t.Fatalf("expected another key to have a bucket of its own, got %s", delay)
+	}
+	if newPacer(PacingConfig{}) != nil {
+		t.Fatal("expected no pacer without requests per minute")
+	}
+}
+
+func TestPacingReportsTheQueueWait(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Cache.Enabled = false
+	cfg.Cache.DiskEnabled = false
+	cfg.Pacing = PacingConfig{RequestsPerMinute: 600, Burst: 1}
+	svc := NewGeminiServiceWithBackend(cfg, staticBackend{answer: "42"})
+	defer svc.Close()
+
+	if _, status, err := svc.Ask(context.Background(), "first", ""); err != nil || status.QueueWaitMs != 0 {
+		t.Fatalf("expected the first question to start at once, got %#v %v", status, err)
+	}
+	answer, status, err := svc.Ask(context.Background(), "second", "")
+	if err != nil || answer != "42" {
+		t.Fatalf("expected the second question to be delayed, not failed, got %q %v", answer, err)
+	}
+	if status == nil || status.QueueWaitMs < 50 {
+		t.Fatalf("expected the pacing delay in the status, got %#v", status)
+	}
+}
+
+func TestStatusReportsHowTheAnswerWasProduced(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Cache.DiskEnabled = false
+	cfg.Retry.MaxRetries = 0
+	cfg.DefaultModel = "gemini-2.5-pro"
+	cfg.FallbackModels = []string{"gemini-2.5-flash"}
+	svc := NewGeminiServiceWithBackend(cfg, &flakyBackend{failures: 1, failStatus: http.StatusTooManyRequests})
+	defer svc.Close()
+
+	opts := model.AskOptions{SessionID: "session-1"}
+	_, status, err := svc.AskWithOptions(context.Background(), "question", opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if status.Backend != "flaky" || status.Model != "gemini-2.5-flash" || status.SessionID != "session-1" || status.Cached ||
+		!reflect.DeepEqual(status.Degraded, []string{model.DegradedFallbackModel}) {
+		t.Fatalf("unexpected status: %#v", status)
+	}
+
+	_, cached, err := svc.AskWithOptions(context.Background(), "question", model.AskOptions{SessionID: "session-2"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !cached.Cached || cached.GenerationMs != 0 || cached.QueueWaitMs != 0 || cached.SessionID != "session-2" || cached.Model != "gemini-2.5-flash" {
+		t.Fatalf("unexpected status of the cached answer: %#v", cached)
+	}
+	if status.SessionID != "session-1" {
+		t.Fatalf("expected the first status to be left alone, got %#v", status)
+	}
+}
+
+func TestAskFailsWhileCLIIsStarting(t *testing.T) {
+	release := filepath.Join(t.TempDir(), "release")
+	installFakeGeminiCLI(t, fmt.Sprintf("if [ \"$1\" = --version ]; then\n  while [ ! -e %q ]; do sleep 0.05; done\n  echo 1.0.0\n  exit 0\nfi\necho '{\"response\": \"ready\"}'\n", release))
+	cfg := DefaultConfig()
+	cfg.Cache.Enabled = false
+	cfg.Cache.DiskEnabled = false
+	svc := NewGeminiServiceWithConfig(cfg)
+	defer svc.Close()
+
+	if health := svc.Health(); !health.Starting || health.Ready {
+		t.Fatalf("expected a starting backend, got %#v", health)
+	}
+	_, status, err := svc.Ask(context.Background(), "q", "")
+	if !errors.Is(err, ErrBackendStarting) || status == nil || status.HTTPStatus != http.StatusServiceUnavailable || status.Reason != model.ReasonBackendStarting {
+		t.Fatalf("expected 503 while starting, got status=%#v err=%v", status, err)
+	}
+
+	if err := os.WriteFile(release, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := svc.WaitStarted(ctx); err != nil {
+		t.Fatalf("backend never started: %v", err)
+	}
+	answer, _, err := svc.Ask(context.Background(), "q", "")
+	if err != nil || answer != "ready" {
+		t.Fatalf("expected an answer once started, got %q, %v", answer, err)
+	}
+}
+
+func TestCloseInterruptsRunningCLI(t *testing.T) {
+	installFakeGeminiCLI(t, "[ \"$1\" = --version ] && echo 1.0.0 && exit 0\nexec sleep 30\n")
+	cfg := DefaultConfig()
+	cfg.Cache.Enabled = false
+	cfg.Cache.DiskEnabled = false
+	svc := NewGeminiServiceWithConfig(cfg)
+	if err := svc.WaitStarted(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := svc.Ask(context.Background(), "question", "")
+		done <- err
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for svc.PoolStats().Busy != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("request never started: %#v", svc.PoolStats())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	start := time.Now()
+	if err := svc.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("Close took %s", elapsed)
+	}
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected running request to be cancelled, got %v", err)
+	}
+	if _, _, err := svc.Ask(context.Background(), "another", ""); !errors.Is(err, ErrServiceClosed) {
+		t.Fatalf("expected ErrServiceClosed after Close, got %v", err)
+	}
+}
+
+// flakyBackend fails with failStatus until it has been called failures times.
+type flakyBackend struct {
+	failures   int
+	failStatus int
+	calls      int
+}
+
+func (b *flakyBackend) Name() string { return "flaky" }
+
+func (b *flakyBackend) Generate(_ context.Context, question string, _ model.AskOptions) (string, *model.GeminiStatus, error) {
+	b.calls++
+	if b.calls <= b.failures {
+		return "", &model.GeminiStatus{HTTPStatus: b.failStatus}, errors.New("upstream failed")
+	}
+	return "answer " + question, nil, nil
+}
+
+func (b *flakyBackend) Stream(ctx context.Context, question string, opts model.AskOptions, onChunk func(chunk string) error) (string, *model.GeminiStatus, error) {
+	return b.Generate(ctx, question, opts)
+}
+
+func TestAttemptMetricsByModelAndBackend(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Cache.Enabled = false
+	cfg.Cache.DiskEnabled = false
+	svc := NewGeminiServiceWithBackend(cfg, staticBackend{answer: "four words of answer"})
+	defer svc.Close()
+	const modelName = "gemini-metrics-test"
+
+	if _, _, err := svc.AskStreamWithOptions(context.Background(), "question", model.AskOptions{Model: modelName, NoCache: true}, func(string) error { return nil }); err != nil {
+		t.Fatalf("AskStream: %v", err)
+	}
+	if n := metrics.GenerationDuration.Count(modelName, "static"); n != 1 {
+		t.Fatalf("expected one generation observed, got %d", n)
+	}
+	if n := metrics.TimeToFirstToken.Count(modelName, "static"); n != 1 {
+		t.Fatalf("expected one time to first token observed, got %d", n)
+	}
+	if in, out := metrics.GenerationTokens.Count(modelName, "static", "input"), metrics.GenerationTokens.Count(modelName, "static", "output"); in != 1 || out != 1 {
+		t.Fatalf("expected the tokens of the answer observed, got %d in, %d out", in, out)
+	}
+
+	failing := NewGeminiServiceWithBackend(cfg, &flakyBackend{failures: 100, failStatus: http.StatusBadRequest})
+	defer failing.Close()
+	if _, _, err := failing.AskWithOptions(context.Background(), "question", model.AskOptions{Model: modelName, NoCache: true}); err == nil {
+		t.Fatal("expected the question to fail")
+	}
+	if n := metrics.GenerationErrors.Value(modelName, "flaky", model.ReasonInvalidRequest); n != 1 {
+		t.Fatalf("expected one invalid_request error, got %v", n)
+	}
+	if n := metrics.TimeToFirstToken.Count(modelName, "flaky"); n != 0 {
+		t.Fatalf("expected no time to first token without output, got %d", n)
+	}
+}
+
+func TestDryRunReturnsThePromptWithoutAsking(t *testing.T) {
+	backend := &flakyBackend{}
+	grounding := true
+	svc := &GeminiService{backend: backend, defaultModel: "gemini-2.5-flash", fallbackModels: []string{"gemini-2.5-flash-lite"}}
+	opts := model.AskOptions{
+		Grounding:        &grounding,
+		GenerationConfig: &model.GenerationConfig{ResponseMimeType: "application/json", ResponseSchema: []byte(`{"type":"object"}`)},
+		Attachments:      []model.Attachment{{Name: "files/notes.txt"}},
+	}
+
+	result, _, err := svc.DryRun(context.Background(), "  summarize @files/notes.txt ", opts)
+	if err != nil {
+		t.Fatalf("DryRun: %v", err)
+	}
+	if backend.calls != 0 {
+		t.Fatalf("expected no call to the backend, got %d", backend.calls)
+	}
+	if !strings.HasPrefix(result.Prompt, "summarize @files/notes.txt") || !strings.Contains(result.Prompt, `{"type":"object"}`) || !strings.HasSuffix(result.Prompt, groundingPrompt("")) {
+		t.Fatalf("expected the schema and grounding instructions in the prompt, got %q", result.Prompt)
+	}
+	if result.Model != "gemini-2.5-flash" || !reflect.DeepEqual(result.FallbackModels, []string{"gemini-2.5-flash-lite"}) {
+		t.Fatalf("unexpected models %q %v", result.Model, result.FallbackModels)
+	}
+	if result.EstimatedPromptTokens != EstimateTokens(result.Prompt) || result.Priority != model.PriorityNormal || !result.Grounding || !reflect.DeepEqual(result.Files, []string{"files/notes.txt"}) {
+		t.Fatalf("unexpected dry run %#v", result)
+	}
+
+	svc.allowedModels = []string{"gemini-2.5-flash"}
+	if _, status, err := svc.DryRun(context.Background(), "q", model.AskOptions{Model: "gemini-2.5-pro"}); err == nil || status.HTTPStatus != http.StatusBadRequest {
+		t.Fatalf("expected the allowlist to be checked, got status=%#v err=%v", status, err)
+	}
+}
+
+func TestTenantSetsTheDefaultModelAndSystemPrompt(t *testing.T) {
+	svc := &GeminiService{backend: &flakyBackend{}, defaultModel: "gemini-2.5-flash"}
+	ctx := tenants.WithTenant(context.Background(), &tenants.Tenant{Name: "support", DefaultModel: "gemini-2.5-pro", SystemPrompt: "Answer as support."})
+
+	result, _, err := svc.DryRun(ctx, "q", model.AskOptions{})
+	if err != nil || result.Model != "gemini-2.5-pro" {
+		t.Fatalf("expected the tenant's model, got %q err=%v", result.Model, err)
+	}
+	if result, _, _ := svc.DryRun(ctx, "q", model.AskOptions{Model: "gemini-2.5-flash"}); result.Model != "gemini-2.5-flash" {
+		t.Fatalf("expected the requested model to win, got %q", result.Model)
+	}
+	if opts := applyTenant(ctx, model.AskOptions{Context: "Be brief."}); opts.Context != "Answer as support.\n\nBe brief." {
+		t.Fatalf("expected the system prompt before the context, got %q", opts.Context)
+	}
+	if opts := applyTenant(context.Background(), model.AskOptions{Context: "Be brief."}); opts.Context != "Be brief." || opts.Model != "" {
+		t.Fatalf("expected no change without a tenant, got %#v", opts)
+	}
+}
+
+// englishBackend answers in English until it is told firmly to use another
+// language.
+type englishBackend struct {
+	prompts []string
+}
+
+func (b *englishBackend) Name() string { return "english" }
+
+func (b *englishBackend) Generate(_ context.Context, question string, _ model.AskOptions) (string, *model.GeminiStatus, error) {
+	b.prompts = append(b.prompts, question)
+	if strings.Contains(question, "German only") {
+		return "Die Antwort steht im zweiten Kapitel, und sie ist nicht lang.", nil, nil
+	}
+	return "The answer is in the second chapter, and it is not long.", nil, nil
+}
+
+func (b *englishBackend) Stream(ctx context.Context, question string, opts model.AskOptions, _ func(chunk string) error) (string, *model.GeminiStatus, error) {
+	return b.Generate(ctx, question, opts)
+}
+
+func TestReplyLanguageAsksAgainInTheRequestedLanguage(t *testing.T) {
+	backend := &englishBackend{}
+	svc := &GeminiService{backend: backend}
+
+	answer, _, err := svc.AskWithOptions(context.Background(), "Where is the answer?", model.AskOptions{ReplyLanguage: "de"})
+	if err != nil || !strings.HasPrefix(answer, "Die Antwort") {
+		t.Fatalf("expected the German answer, got %q %v", answer, err)
+	}
+	if len(backend.prompts) != 2 || !strings.HasSuffix(backend.prompts[0], "Answer in German.") {
+		t.Fatalf("expected the instruction and one retry, got %q", backend.prompts)
+	}
+
+	backend.prompts = nil
+	if answer, _, _ := svc.AskWithOptions(context.Background(), "Where is it?", model.AskOptions{ReplyLanguage: "English"}); !strings.HasPrefix(answer, "The answer") || len(backend.prompts) != 1 {
+		t.Fatalf("expected a matching answer without a retry, got %q after %d prompts", answer, len(backend.prompts))
+	}
+
+	result, _, err := svc.DryRun(context.Background(), "Wo steht die Antwort in dem Buch, das ich nicht finde?", model.AskOptions{ReplyLanguage: "auto"})
+	if err != nil || result.ReplyLanguage != "de" || !strings.HasSuffix(result.Prompt, "Answer in German.") {
+		t.Fatalf("expected the question's language, got %#v %v", result, err)
+	}
+	if _, status, err := svc.AskWithOptions(context.Background(), "q", model.AskOptions{ReplyLanguage: "klingon"}); !errors.Is(err, ErrUnknownLanguage) || status.HTTPStatus != http.StatusBadRequest {
+		t.Fatalf("expected a 400 for an unknown language, got %#v %v", status, err)
+	}
+}
+
+func TestAskRetriesTransientUpstreamErrors(t *testing.T) {
+	retry := RetryConfig{MaxRetries: 2, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+
+	backend := &flakyBackend{failures: 2, failStatus: 503}
+	svc := &GeminiService{backend: backend, retry: retry}
+	answer, status, err := svc.Ask(context.Background(), "q", "")
+	if err != nil || answer != "answer q" {
+		t.Fatalf("expected success after retries, got answer=%q err=%v", answer, err)
+	}
+	if status == nil || status.Retries != 2 || backend.calls != 3 {
+		t.Fatalf("expected 2 retries reported, got status=%#v calls=%d", status, backend.calls)
+	}
+
+	backend = &flakyBackend{failures: 5, failStatus: 429}
+	svc = &GeminiService{backend: backend, retry: retry}
+	if _, status, err = svc.Ask(context.Background(), "q", ""); err == nil || status == nil || status.Retries != 2 {
+		t.Fatalf("expected error after exhausting retries, got status=%#v err=%v", status, err)
+	}
+
+	backend = &flakyBackend{failures: 1, failStatus: 400}
+	svc = &GeminiService{backend: backend, retry: retry}
+	if _, _, err = svc.Ask(context.Background(), "q", ""); err == nil || backend.calls != 1 {
+		t.Fatalf("expected permanent error without retry, got err=%v calls=%d", err, backend.calls)
+	}
+}
+
+func TestCircuitOpensAfterFailuresAndClosesAfterProbe(t *testing.T) {
+	backend := &flakyBackend{failures: 2, failStatus: 500}
+	svc := &GeminiService{backend: backend, breaker: newBreaker(BreakerConfig{
+		FailureThreshold: 2,
+		Cooldown:         50 * time.Millisecond,
+		ProbeTimeout:     time.Second,
+	})}
+
+	for i := 0; i < 2; i++ {
+		if _, _, err := svc.Ask(context.Background(), "q", ""); err == nil {
+			t.Fatalf("expected upstream failure %d", i+1)
+		}
+	}
+	if state := svc.CircuitStatus().State; state != "open" {
+		t.Fatalf("expected open circuit after 2 failures, got %q", state)
+	}
+
+	_, status, err := svc.Ask(context.Background(), "q", "")
+	var circuitErr *CircuitOpenError
+	if !errors.As(err, &circuitErr) || status == nil || status.HTTPStatus != 503 || status.Code != CircuitOpenCode {
+		t.Fatalf("expected 503 CIRCUIT_OPEN, got status=%#v err=%v", status, err)
+	}
+	if backend.calls != 2 {
+		t.Fatalf("expected fast-fail without calling the backend, got %d calls", backend.calls)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for svc.CircuitStatus().State != "closed" {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected probe to close the circuit, got %#v", svc.CircuitStatus())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if answer, _, err := svc.Ask(context.Background(), "q", ""); err != nil || answer != "answer q" {
+		t.Fatalf("expected success after the circuit closed, got answer=%q err=%v", answer, err)
+	}
+}
+
+func TestFailureStatusClassifiesErrors(t *testing.T) {
+	svc := &GeminiService{}
+	cases := []struct {
+		name   string
+		err    error
+		status *model.GeminiStatus
+		want   int
+		reason string
+	}{
+		{"timeout", fmt.Errorf("ask: %w", context.DeadlineExceeded), nil, http.StatusGatewayTimeout, model.ReasonTimeout},
+		{"quota", errors.New("gemini error"), &model.GeminiStatus{HTTPStatus: 429, Code: "RESOURCE_EXHAUSTED"}, http.StatusTooManyRequests, model.ReasonQuotaExceeded},
+		{"queue", &QueueFullError{Position: 3, Limit: 2}, nil, http.StatusTooManyRequests, model.ReasonQueueFull},
+		{"auth", fmt.Errorf("%w: not logged in", ErrAuthentication), nil, http.StatusUnauthorized, model.ReasonAuthFailed},
+		{"auth expired", fmt.Errorf("%w: sign in again", ErrAuthExpired), nil, http.StatusUnauthorized, model.ReasonAuthExpired},
+		{"forbidden", fmt.Errorf("%w: denied", ErrAuthentication), &model.GeminiStatus{HTTPStatus: 403}, http.StatusForbidden, model.ReasonAuthFailed},
+		{"model", fmt.Errorf("%w: nope", ErrModelNotFound), nil, http.StatusNotFound, model.ReasonModelNotFound},
+		{"circuit", &CircuitOpenError{Reason: "boom"}, nil, http.StatusServiceUnavailable, model.ReasonUnavailable},
+		{"closed", ErrServiceClosed, nil, http.StatusServiceUnavailable, model.ReasonUnavailable},
+		{"starting", ErrBackendStarting, nil, http.StatusServiceUnavailable, model.ReasonBackendStarting},
+		{"overloaded", fmt.Errorf("%w: busy", ErrModelOverloaded), nil, http.StatusServiceUnavailable, model.ReasonModelOverloaded},
+		{"overloaded upstream 429", fmt.Errorf("%w: busy", ErrModelOverloaded), &model.GeminiStatus{HTTPStatus: 429}, http.StatusTooManyRequests, model.ReasonModelOverloaded},
+		{"safety", fmt.Errorf("%w: blocked", ErrSafetyBlocked), nil, http.StatusBadRequest, model.ReasonSafetyBlocked},
+		{"context length", fmt.Errorf("%w: too long", ErrContextLengthExceeded), nil, http.StatusBadRequest, model.ReasonContextLengthExceeded},
+		{"upstream", errors.New("gemini error"), &model.GeminiStatus{HTTPStatus: 502}, http.StatusBadGateway, model.ReasonUpstreamError},
+		{"unknown", errors.New("boom"), nil, http.StatusInternalServerError, model.ReasonInternalError},
+	}
+	for _, tc := range cases {
+		got := svc.failureStatus(tc.err, tc.status)
+		if got.HTTPStatus != tc.want || got.Reason != tc.reason {
+			t.Fatalf("%s: expected %d %s, got %d %s", tc.name, tc.want, tc.reason, got.HTTPStatus, got.Reason)
+		}
+	}
+
+	original := &model.GeminiStatus{HTTPStatus: 0, Code: "X"}
+	if svc.failureStatus(errors.New("boom"), original); original.HTTPStatus != 0 {
+		t.Fatalf("expected the original status to stay untouched, got %#v", original)
+	}
+}
+
+func TestAskReturnsTypedUpstreamErrors(t *testing.T) {
+	cases := []struct {
+		name   string
+		output string
+		want   error
+		status int
+	}{
+		{"expired credentials", `echo '{"error": {"type": "Error", "message": "invalid_grant: Token has been expired or revoked."}}'`, ErrAuthExpired, http.StatusUnauthorized},
+		{"context length", `echo '{"error": {"type": "INVALID_ARGUMENT", "message": "The input token count (1200000) exceeds the maximum number of tokens allowed (1048576)."}}'`, ErrContextLengthExceeded, http.StatusBadRequest},
+		{"safety", `echo '{"error": {"type": "Error", "message": "Response was blocked due to SAFETY"}}'`, ErrSafetyBlocked, http.StatusBadRequest},
+	}
+	for _, tc := range cases {
+		installFakeGeminiCLI(t, tc.output+"\nexit 1\n")
+		svc := &GeminiService{cache: map[string]cacheEntry{}}
+		_, status, err := svc.AskWithOptions(context.Background(), "question", model.AskOptions{})
+		if !errors.Is(err, tc.want) || status == nil || status.HTTPStatus != tc.status || status.Reason != failureReason(err, status) {
+			t.Fatalf("%s: expected %v with %d, got status=%#v err=%v", tc.name, tc.want, tc.status, status, err)
+		}
+	}
+}
+
+func TestAskRefreshesExpiredOAuthTokenAndAsksAgain(t *testing.T) {
+	home := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(home, ".gemini"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	creds := `{"access_token": "stale", "refresh_token": "refresh-me", "expiry_date": 1000}`
+	if err := os.WriteFile(oauthCredsPath(home), []byte(creds), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tokens := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("refresh_token") != "refresh-me" || r.FormValue("client_id") != "client" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_, _ = w.Write([]byte(`{"access_token": "new-token", "expires_in": 3600}`))
+	}))
+	defer tokens.Close()
+	installFakeGeminiCLI(t, `if grep -q new-token "$HOME/.gemini/oauth_creds.json"; then
+  echo '{"response": "signed in"}'
+else
+  echo '{"error": {"type": "Error", "message": "invalid_grant: Token has been expired or revoked."}}'
+  exit 1
+fi
+`)
+
+	auth := newAuthenticator(ReauthConfig{Enabled: true, OAuthClientID: "client", OAuthClientSecret: "secret", TokenURL: tokens.URL}, home)
+	svc := &GeminiService{backend: headlessBackend{cliHome: home, auth: auth}, auth: auth, cliHome: home, cache: map[string]cacheEntry{}}
+	answer, _, err := svc.Ask(context.Background(), "q", "")
+	if err != nil || answer != "signed in" {
+		t.Fatalf("expected the answer after the refresh, got %q, %v", answer, err)
+	}
+
+	status, err := svc.AuthStatus()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if status.OAuth == nil || status.OAuth.Expired || status.OAuth.ExpiresAt == nil || !status.OAuth.HasRefreshToken {
+		t.Fatalf("expected a refreshed token, got %#v", status.OAuth)
+	}
+	if last := status.LastRecovery; last == nil || last.Method != reauthOAuthRefresh || !last.Succeeded {
+		t.Fatalf("expected a successful OAuth refresh, got %#v", last)
+	}
+	if status.Reauth == nil || status.Reauth.Recoveries != 1 {
+		t.Fatalf("expected one recovery, got %#v", status.Reauth)
+	}
+}
+
+func TestAskStopsCLIWaitingForAuthAndSwitchesToAPIKey(t *testing.T) {
+	home := t.TempDir()
+	installFakeGeminiCLI(t, `if [ "$GEMINI_API_KEY" = "key" ]; then
+  echo '{"response": "with key"}'
+else
+  echo 'Waiting for auth... (Press ESC or CTRL+C to cancel)'
+  exec sleep 30
+fi
+`)
+
+	auth := newAuthenticator(ReauthConfig{Enabled: true, APIKey: "key"}, home)
+	svc := &GeminiService{backend: headlessBackend{cliHome: home, auth: auth}, auth: auth, cliHome: home, cache: map[string]cacheEntry{}}
+	start := time.Now()
+	answer, _, err := svc.Ask(context.Background(), "q", "")
+	if err != nil || answer != "with key" {
+		t.Fatalf("expected the answer with the API key, got %q, %v", answer, err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Fatalf("expected the waiting CLI to be stopped, took %v", elapsed)
+	}
+
+	status, err := svc.AuthStatus()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if status.Method != authAPIKeyType || !status.APIKeyActive {
+		t.Fatalf("expected the CLI switched to the API key, got %#v", status)
+	}
+	if last := status.LastRecovery; last == nil || last.Method != reauthAPIKey || !last.Succeeded {
+		t.Fatalf("expected a successful switch to the API key, got %#v", last)
+	}
+
+	// Without a way to recover, the question fails as before.
+	installFakeGeminiCLI(t, "echo 'Waiting for auth...'\nexec sleep 30\n")
+	svc = &GeminiService{backend: headlessBackend{cliHome: t.TempDir()}, cache: map[string]cacheEntry{}}
+	_, status2, err := svc.Ask(context.Background(), "q", "")
+	if !errors.Is(err, ErrAuthExpired) || status2 == nil || status2.HTTPStatus != http.StatusUnauthorized {
+		t.Fatalf("expected an expired sign-in, got status=%#v err=%v", status2, err)
+	}
+}
+
+func TestAskReportsMissingCLIAsUnavailable(t *testing.T) {
+	svc := &GeminiService{backend: headlessBackend{cliPath: filepath.Join(t.TempDir(), "gemini")}}
+	_, status, err := svc.Ask(context.Background(), "q", "")
+	if err == nil || status == nil || status.HTTPStatus != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 for a missing CLI, got status=%#v err=%v", status, err)
+	}
+}
+
+// slowBackend answers after delay unless its context ends first.
+type slowBackend struct {
+	delay time.Duration
+}
+
+func (b slowBackend) Name() string { return "slow" }
+
+func (b slowBackend) Generate(ctx context.Context, question string, _ model.AskOptions) (string, *model.GeminiStatus, error) {
+	select {
+	case <-time.After(b.delay):
+		return "answer " + question, nil, nil
+	case <-ctx.Done():
+		return "", nil, ctx.Err()
+	}
+}
+
+func (b slowBackend) Stream(ctx context.Context, question string, opts model.AskOptions, onChunk func(chunk string) error) (string, *model.GeminiStatus, error) {
+	return b.Generate(ctx, question, opts)
+}
+
+func TestAskHonorsRequestTimeout(t *testing.T) {
+	svc := &GeminiService{
+		backend:           slowBackend{delay: 200 * time.Millisecond},
+		requestTimeout:    time.Second,
+		maxRequestTimeout: 2 * time.Second,
+	}
+
+	_, status, err := svc.AskWithOptions(context.Background(), "q", model.AskOptions{Timeout: 20 * time.Millisecond})
+	if !errors.Is(err, context.DeadlineExceeded) || status == nil || status.HTTPStatus != http.StatusGatewayTimeout {
+		t.Fatalf("expected 504 after the requested timeout, got status=%#v err=%v", status, err)
+	}
+
+	if answer, _, err := svc.AskWithOptions(context.Background(), "q", model.AskOptions{}); err != nil || answer != "answer q" {
+		t.Fatalf("expected the server timeout to leave room for the answer, got answer=%q err=%v", answer, err)
+	}
+
+	svc.maxRequestTimeout = 20 * time.Millisecond
+	start := time.Now()
+	if _, _, err := svc.AskWithOptions(context.Background(), "q", model.AskOptions{Timeout: time.Minute}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the server maximum to cap the timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 150*time.Millisecond {
+		t.Fatalf("expected the capped timeout to fire quickly, took %s", elapsed)
+	}
+}
+
+func TestRequestedTimeoutDoesNotOpenCircuit(t *testing.T) {
+	svc := &GeminiService{
+		backend:        slowBackend{delay: time.Second},
+		requestTimeout: time.Minute,
+		breaker:        newBreaker(BreakerConfig{FailureThreshold: 1, Cooldown: time.Minute}),
+	}
+	if _, _, err := svc.AskWithOptions(context.Background(), "q", model.AskOptions{Timeout: 10 * time.Millisecond}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected timeout, got %v", err)
+	}
+	if status := svc.CircuitStatus(); status.State != "closed" || status.ConsecutiveFailures != 0 {
+		t.Fatalf("expected a client timeout to leave the circuit alone, got %#v", status)
+	}
+}
+
+func TestRestartInterruptsRunningCallsAndClearQueueDropsWaiters(t *testing.T) {
+	svc := &GeminiService{
+		backend: slowBackend{delay: time.Minute},
+		pool:    newWorkerPool(1, 0),
+		calls:   newCallRegistry(),
+	}
+
+	type result struct {
+		status *model.GeminiStatus
+		err    error
+	}
+	done := make(chan result, 2)
+	for _, q := range []string{"running", "queued"} {
+		go func(q string) {
+			_, status, err := svc.AskWithOptions(context.Background(), q, model.AskOptions{Model: "gemini-2.5-flash"})
+			done <- result{status, err}
+		}(q)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for len(svc.BackendState().Active) != 1 || svc.PoolStats().Waiting != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected one running and one queued call, got %#v", svc.BackendState())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if call := svc.BackendState().Active[0]; call.Model != "gemini-2.5-flash" || call.Stream {
+		t.Fatalf("unexpected active call: %#v", call)
+	}
+
+	if cleared := svc.ClearQueue(); cleared != 1 {
+		t.Fatalf("expected one queued call to be cleared, got %d", cleared)
+	}
+	if got := <-done; !errors.Is(got.err, ErrQueueCleared) || got.status.HTTPStatus != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 for the cleared call, got status=%#v err=%v", got.status, got.err)
+	}
+
+	if interrupted := svc.Restart(); interrupted != 1 {
+		t.Fatalf("expected one interrupted call, got %d", interrupted)
+	}
+	if got := <-done; !errors.Is(got.err, ErrBackendRestarted) || got.status.HTTPStatus != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 for the interrupted call, got status=%#v err=%v", got.status, got.err)
+	}
+	if state := svc.BackendState(); len(state.Active) != 0 || state.QuestionsFailed != 1 {
+		t.Fatalf("unexpected state after restart: %#v", state)
+	}
+}
+
+func TestAskRejectsModelsOutsideTheAllowlist(t *testing.T) {
+	cfg := Config{AllowedModels: []string{"models/gemini-2.5-flash", "gemini-2.5-pro", " "}}.withDefaults()
+	svc := &GeminiService{backend: &mockBackend{}, allowedModels: cfg.AllowedModels}
+
+	_, status, err := svc.AskWithOptions(context.Background(), "q", model.AskOptions{Model: "gpt-4"})
+	var modelErr *ModelNotAllowedError
+	if !errors.As(err, &modelErr) || status == nil || status.HTTPStatus != http.StatusBadRequest || status.Code != ModelNotSupportedCode {
+		t.Fatalf("expected 400 for an unknown model, got status=%#v err=%v", status, err)
+	}
+	if !strings.Contains(err.Error(), "gemini-2.5-flash, gemini-2.5-pro") {
+		t.Fatalf("expected the supported models in the error, got %q", err)
+	}
+	if _, _, err := svc.AskStreamWithOptions(context.Background(), "q", model.AskOptions{Model: "gpt-4"}, func(string) error { return nil }); !errors.As(err, &modelErr) {
+		t.Fatalf("expected streams to be rejected too, got %v", err)
+	}
+
+	for _, name := range []string{"gemini-2.5-flash", "models/gemini-2.5-pro", ""} {
+		if _, _, err := svc.AskWithOptions(context.Background(), "q", model.AskOptions{Model: name}); err != nil {
+			t.Fatalf("expected %q to be allowed, got %v", name, err)
+		}
+	}
+}
+
+func TestReconfigureChangesAllowlistAndTimeouts(t *testing.T) {
+	svc := &GeminiService{backend: &mockBackend{}, allowedModels: []string{"gemini-2.5-flash"}, requestTimeout: time.Minute, maxRequestTimeout: time.Minute}
+	if _, _, err := svc.AskWithOptions(context.Background(), "q", model.AskOptions{Model: "gemini-2.5-pro"}); err == nil {
+		t.Fatal("expected gemini-2.5-pro to be rejected before the change")
+	}
+
+	svc.Reconfigure(Config{AllowedModels: []string{"models/gemini-2.5-pro"}, RequestTimeout: 2 * time.Minute, MaxRequestTimeout: time.Minute})
+	if got := svc.AllowedModels(); !reflect.DeepEqual(got, []string{"gemini-2.5-pro"}) {
+		t.Fatalf("expected the normalized allowlist, got %v", got)
+	}
+	if _, _, err := svc.AskWithOptions(context.Background(), "q", model.AskOptions{Model: "gemini-2.5-pro"}); err != nil {
+		t.Fatalf("expected gemini-2.5-pro to be allowed after the change, got %v", err)
+	}
+
+	ctx, cancel := svc.withRequestTimeout(context.Background(), time.Hour)
+	defer cancel()
+	deadline, ok := ctx.Deadline()
+	if !ok || time.Until(deadline) <= time.Minute || time.Until(deadline) > 2*time.Minute {
+		t.Fatalf("expected the maximum to be raised to the 2m default, got deadline in %s", time.Until(deadline))
+	}
+}
+
+func TestPostprocessorFiltersAnswersButCachesThemUnfiltered(t *testing.T) {
+	pipeline, err := postprocess.New(postprocess.Config{Filters: []string{"profanity"}, ProfanityWords: []string{"mock"}, AllowOptOut: true})
+	if err != nil {
+		t.Fatalf("postprocess.New: %v", err)
+	}
+	svc := &GeminiService{
+		backend:      newBackend(Config{Backend: backendMock}),
+		cacheEnabled: true,
+		cacheTTL:     time.Minute,
+		cacheMaxSize: 10,
+		cache:        map[string]cacheEntry{},
+	}
+	svc.SetPostprocessor(pipeline)
+
+	answer, _, err := svc.AskWithOptions(context.Background(), "ping", model.AskOptions{})
+	if err != nil || answer != "m*** answer: ping" {
+		t.Fatalf("expected a filtered answer, got %q %v", answer, err)
+	}
+	answer, _, err = svc.AskWithOptions(context.Background(), "ping", model.AskOptions{SkipPostprocess: true})
+	if err != nil || answer != "mock answer: ping" {
+		t.Fatalf("expected the cached answer unfiltered on opt-out, got %q %v", answer, err)
+	}
+
+	var chunks []string
+	streamed, _, err := svc.AskStreamWithOptions(context.Background(), "ping", model.AskOptions{}, func(chunk string) error {
+		chunks = append(chunks, chunk)
+		return nil
+	})
+	if err != nil || streamed != "m*** answer: ping" || len(chunks) != 1 || chunks[0] != "m*** answer: ping" {
+		t.Fatalf("expected filtered chunks, got %q %v %#v", streamed, err, chunks)
+	}
+}
+
+func TestFormatConvertsAnswersAndStreams(t *testing.T) {
+	svc := &GeminiService{backend: newBackend(Config{Backend: backendMock})}
+	opts := model.AskOptions{Format: postprocess.FormatHTML}
+	want := "<p>mock answer: <strong>ping</strong></p>\n"
+
+	answer, _, err := svc.AskWithOptions(context.Background(), "**ping**", opts)
+	if err != nil || answer != want {
+		t.Fatalf("expected an html answer, got %q %v", answer, err)
+	}
+
+	var streamed strings.Builder
+	answer, _, err = svc.AskStreamWithOptions(context.Background(), "**ping**", opts, func(chunk string) error {
+		streamed.WriteString(chunk)
+		return nil
+	})
+	if err != nil || answer != want || streamed.String() != want {
+		t.Fatalf("expected html chunks, got %q and %q %v", streamed.String(), answer, err)
+	}
+
+	if answer, _, _ := svc.AskWithOptions(context.Background(), "**ping**", model.AskOptions{Format: postprocess.FormatPlain}); answer != "mock answer: ping" {
+		t.Fatalf("expected a plain answer, got %q", answer)
+	}
+}
+
+func TestArtifactsAreParsedBeforeFormatting(t *testing.T) {
+	svc := &GeminiService{backend: newBackend(Config{Backend: backendMock})}
+	opts := model.AskOptions{Format: postprocess.FormatHTML, Artifacts: true}
+	want := []model.Artifact{{Filename: "main.go", Language: "go", Content: "package main\n"}}
+
+	_, status, err := svc.AskWithOptions(context.Background(), "code:\n```go main.go\npackage main\n```", opts)
+	if err != nil || !reflect.DeepEqual(status.Artifacts, want) {
+		t.Fatalf("expected the code block as artifact, got %#v %v", status, err)
+	}
+	_, status, err = svc.AskStreamWithOptions(context.Background(), "code:\n```go main.go\npackage main\n```", opts, func(string) error { return nil })
+	if err != nil || !reflect.DeepEqual(status.Artifacts, want) {
+		t.Fatalf("expected the streamed code block as artifact, got %#v %v", status, err)
+	}
+}
+
+func TestSystemInstructionsPrecedeTheQuestionInAWorkspaceOfTheirOwn(t *testing.T) {
+	svc := &GeminiService{backend: newBackend(Config{Backend: backendMock})}
+	answer, _, err := svc.AskWithOptions(context.Background(), " ping ", model.AskOptions{System: "Be terse."})
+	want := "mock answer: <system_instructions>\nBe terse.\n</system_instructions>\n\n<question>\nping\n</question>"
+	if err != nil || answer != want {
+		t.Fatalf("expected the system instructions before the question, got %q %v", answer, err)
+	}
+	if answer, _, _ := svc.AskWithOptions(context.Background(), "ping", model.AskOptions{}); answer != "mock answer: ping" {
+		t.Fatalf("expected the question alone without system instructions, got %q", answer)
+	}
+
+	dir, cleanup, err := prepareRequestWorkspace(model.AskOptions{System: "Be terse."}, false)
+	defer cleanup()
+	if err != nil || dir == "" {
+		t.Fatalf("expected a throwaway workspace for system instructions, got %q %v", dir, err)
+	}
+	if dir, _, _ := prepareRequestWorkspace(model.AskOptions{}, false); dir != "" {
+		t.Fatalf("expected no workspace without stateless, got %q", dir)
+	}
+}
+
+func TestSafetySettingsReachCLISettingsAndCacheKey(t *testing.T) {
+	safety := []model.SafetySetting{{Category: "HARM_CATEGORY_HARASSMENT", Threshold: "BLOCK_NONE"}}
+	dir, cleanup, err := prepareGenerationWorkspace("", nil, safety)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer cleanup()
+
+	payload, err := os.ReadFile(filepath.Join(dir, ".gemini", "settings.json"))
+	if err != nil {
+		t.Fatalf("settings not written: %v", err)
+	}
+	if !strings.Contains(string(payload), `"safetySettings"`) || !strings.Contains(string(payload), `"threshold": "BLOCK_NONE"`) {
+		t.Fatalf("unexpected settings: %s", payload)
+	}
+
+	if optionsVariant(model.AskOptions{}) == optionsVariant(model.AskOptions{SafetySettings: safety}) {
+		t.Fatal("expected safety settings to change the cache key")
+	}
+}
+
+func TestAskRecordsQuestionsInTheAuditLog(t *testing.T) {
+	log, err := audit.Open(audit.Config{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer log.Close()
+	svc := &GeminiService{backend: &mockBackend{}, allowedModels: []string{"gemini-2.5-flash"}}
+	ctx := log.Track(context.Background(), "key:team")
+
+	if _, _, err := svc.AskWithOptions(ctx, "ping", model.AskOptions{Model: "gemini-2.5-flash"}); err != nil {
+		t.Fatalf("AskWithOptions: %v", err)
+	}
+	if _, _, err := svc.AskStreamWithOptions(ctx, "pong", model.AskOptions{Model: "gpt-4"}, func(string) error { return nil }); err == nil {
+		t.Fatal("expected the model to be rejected")
+	}
+
+	var out bytes.Buffer
+	if n, err := log.Export(&out, audit.Query{From: time.Now().Add(-time.Hour), To: time.Now().Add(time.Hour)}); err != nil || n != 2 {
+		t.Fatalf("Export = %d, %v", n, err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	for _, want := range []string{`"client":"key:team"`, `"model":"gemini-2.5-flash"`, `"prompt":"ping"`, `"answer":"mock answer: ping"`, `"status":200`} {
+		if !strings.Contains(lines[0], want) {
+			t.Fatalf("expected %s in %s", want, lines[0])
+		}
+	}
+	if !strings.Contains(lines[1], `"status":400`) || !strings.Contains(lines[1], `"error":`) {
+		t.Fatalf("expected the rejected stream to be audited as a 400, got %s", lines[1])
+	}
+}
+
+func TestConsoleStreamsCLIOutput(t *testing.T) {
+	installFakeGeminiCLI(t, "printf '\\033[32mLoaded cached credentials.\\033[0m\\n' >&2\nprintf 'working |\\rworking /\\n' >&2\necho '{\"response\": \"hi\"}'\n")
+	svc := &GeminiService{calls: newCallRegistry()}
+
+	_, lines, cancel := svc.Console(16)
+	if _, _, err := svc.AskWithOptions(context.Background(), "question", model.AskOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	got := map[string]string{}
+	for range 3 {
+		select {
+		case line := <-lines:
+			if line.CallID != 1 {
+				t.Fatalf("expected the line of call 1, got %#v", line)
+			}
+			got[line.Text] = line.Stream
+		case <-time.After(time.Second):
+			t.Fatalf("expected 3 console lines, got %v", got)
+		}
+	}
+	want := map[string]string{"Loaded cached credentials.": "stderr", "working /": "stderr", `{"response": "hi"}`: "stdout"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected console lines: %v", got)
+	}
+	cancel()
+	if _, open := <-lines; open {
+		t.Fatal("expected cancel to close the channel")
+	}
+
+	backlog, _, cancel := svc.Console(1)
+	defer cancel()
+	if len(backlog) != 3 {
+		t.Fatalf("expected the lines in the backlog of a new subscriber, got %#v", backlog)
+	}
+}
+
+func TestWriteMCPServersMergesIntoSettings(t *testing.T) {
+	home := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(home, ".gemini"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	existing := `{"security": {"auth": {"selectedType": "oauth-personal"}}, "mcpServers": {"local": {"command": "local-mcp"}, "docs": {"url": "http://old"}}}`
+	if err := os.WriteFile(settingsPath(home), []byte(existing), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	servers := map[string]MCPServer{
+		"docs":   {HTTPURL: "https://mcp.example.com/mcp", Headers: map[string]string{"Authorization": "Bearer secret"}, Trust: true},
+		"github": {Command: "github-mcp-server", Args: []string{"stdio"}, IncludeTools: []string{"get_issue"}},
+	}
+	if err := writeMCPServers(home, servers); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	settings, err := readSettings(settingsPath(home))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(string(settings["security"]), `"selectedType": "oauth-personal"`) {
+		t.Fatalf("expected other settings to be kept, got %s", settings["security"])
+	}
+
+	svc := &GeminiService{cliHome: home, mcpServers: servers}
+	list, err := svc.MCPServers()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []MCPServerInfo{
+		{Name: "docs", Transport: "http", Target: "https://mcp.example.com/mcp", Source: "wrapper", Trust: true},
+		{Name: "github", Transport: "stdio", Target: "github-mcp-server stdio", Source: "wrapper", IncludeTools: []string{"get_issue"}},
+		{Name: "local", Transport: "stdio", Target: "local-mcp", Source: "settings"},
+	}
+	if !reflect.DeepEqual(list, want) {
+		t.Fatalf("unexpected servers:\n got %#v\nwant %#v", list, want)
+	}
+
+	if err := writeMCPServers(home, map[string]MCPServer{"broken": {Command: "x", URL: "http://y"}}); err == nil {
+		t.Fatal("expected an error for a server with two transports")
+	}
+}
+
+func TestExecutionPolicyNeedsTrustedClientAndReachesCLI(t *testing.T) {
+	installFakeGeminiCLI(t, "shift 4\necho \"{\\\"response\\\": \\\"flags: $*\\\"}\"\n")
+	svc := &GeminiService{}
+	svc.SetExecution(execution.Config{ApprovalMode: execution.ModeDefault, TrustedClients: []string{"key:ci"}})
+	sandbox := true
+	yolo := model.AskOptions{ApprovalMode: execution.ModeYolo, Sandbox: &sandbox}
+
+	_, status, err := svc.AskWithOptions(execution.WithClient(context.Background(), "key:web"), "q", yolo)
+	if !errors.Is(err, execution.ErrNotAllowed) || status == nil || status.HTTPStatus != http.StatusForbidden {
+		t.Fatalf("expected 403 for an untrusted client, got %v, %#v", err, status)
+	}
+	_, status, err = svc.AskWithOptions(context.Background(), "q", model.AskOptions{ApprovalMode: "always"})
+	if !errors.Is(err, execution.ErrInvalidMode) || status == nil || status.HTTPStatus != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an unknown mode, got %v, %#v", err, status)
+	}
+
+	answer, _, err := svc.AskWithOptions(execution.WithClient(context.Background(), "key:ci"), "q", yolo)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if answer != "flags: --approval-mode yolo --sandbox" {
+		t.Fatalf("expected the policy flags on the CLI, got %q", answer)
+	}
+	answer, _, err = svc.AskWithOptions(context.Background(), "q", model.AskOptions{})
+	if err != nil || answer != "flags:" {
+		t.Fatalf("expected no flags for the default policy, got %q, %v", answer, err)
+	}
+}
+
+func TestStatelessQuestionsDoNotSeeEachOther(t *testing.T) {
+	installFakeGeminiCLI(t, `if [ -e history ]; then
+  echo "{\"response\": \"after $(cat history)\"}"
+else
+  echo "$2" > history
+  echo "{\"response\": \"$2 only\"}"
+fi
+`)
+	svc := &GeminiService{backend: headlessBackend{stateless: true}, cache: map[string]cacheEntry{}}
+	for _, question := range []string{"first", "second"} {
+		answer, _, err := svc.Ask(context.Background(), question, "")
+		if err != nil || answer != question+" only" {
+			t.Fatalf("expected %q to run in a fresh directory, got %q, %v", question, answer, err)
+		}
+	}
+}
+
+func TestWorkDirRunsCLIThereWithoutCache(t *testing.T) {
+	installFakeGeminiCLI(t, "echo \"{\\\"response\\\": \\\"$(cat note.txt)\\\"}\"\n")
+	dir := t.TempDir()
+	svc := &GeminiService{cacheEnabled: true, cacheTTL: time.Minute, cacheMaxSize: 10, cache: map[string]cacheEntry{}}
+
+	for _, note := range []string{"first", "second"} {
+		if err := os.WriteFile(filepath.Join(dir, "note.txt"), []byte(note), 0o600); err != nil {
+			t.Fatalf("write note: %v", err)
+		}
+		answer, _, err := svc.AskWithOptions(context.Background(), "q", model.AskOptions{WorkDir: dir})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if answer != note {
+			t.Fatalf("expected the CLI to read %q in the work dir, got %q", note, answer)
+		}
+	}
+	if len(svc.cache) != 0 {
+		t.Fatalf("expected work dir answers to stay out of the cache, got %d entries", len(svc.cache))
+	}
+}
+
+func TestGlobalContextIsWrittenAndPurgesCache(t *testing.T) {
+	home := t.TempDir()
+	svc := &GeminiService{cliHome: home, cacheEnabled: true, cacheTTL: time.Minute, cacheMaxSize: 10, cache: map[string]cacheEntry{}}
+	svc.setCached("key", "stale answer", nil)
+
+	result, err := svc.SetGlobalContext("Always answer in French.")
+	if err != nil {
+		t.Fatalf("SetGlobalContext: %v", err)
+	}
+	if result.Purged.MemoryEntries != 1 || result.Context.Content != "Always answer in French." || result.Context.UpdatedAt == nil {
+		t.Fatalf("unexpected refresh result: %#v", result)
+	}
+	written, err := os.ReadFile(filepath.Join(home, ".gemini", "GEMINI.md"))
+	if err != nil || string(written) != "Always answer in French." {
+		t.Fatalf("expected GEMINI.md in the CLI home, got %q, %v", written, err)
+	}
+
+	if _, err := svc.SetGlobalContext(""); err != nil {
+		t.Fatalf("SetGlobalContext: %v", err)
+	}
+	file, err := svc.GlobalContext()
+	if err != nil || file.Content != "" || file.UpdatedAt != nil {
+		t.Fatalf("expected the context to be removed, got %#v, %v", file, err)
+	}
+	if _, err := svc.SetGlobalContext(strings.Repeat("x", maxContextSize+1)); !errors.Is(err, ErrContextTooLarge) {
+		t.Fatalf("expected ErrContextTooLarge, got %v", err)
+	}
+}
+
+func TestRequestContextIsReadFromCLIWorkingDirectory(t *testing.T) {
+	installFakeGeminiCLI(t, "echo \"{\\\"response\\\": \\\"$(cat GEMINI.md)\\\"}\"\n")
+	svc := &GeminiService{cacheEnabled: true, cacheTTL: time.Minute, cacheMaxSize: 10, cache: map[string]cacheEntry{}}
+
+	for _, instructions := range []string{"be brief", "be verbose"} {
+		answer, _, err := svc.AskWithOptions(context.Background(), "q", model.AskOptions{Context: instructions})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if answer != instructions {
+			t.Fatalf("expected the CLI to read %q, got %q", instructions, answer)
+		}
+	}
+}
+
+func TestAttachmentsAreWrittenForTheCLI(t *testing.T) {
+	installFakeGeminiCLI(t, "echo \"{\\\"response\\\": \\\"$(cat attachments/a.txt)\\\"}\"\n")
+	svc := &GeminiService{cacheEnabled: true, cacheTTL: time.Minute, cacheMaxSize: 10, cache: map[string]cacheEntry{}}
+
+	for _, content := range []string{"first", "second"} {
+		opts := model.AskOptions{Attachments: []model.Attachment{{Name: "attachments/a.txt", MimeType: "text/plain", Data: []byte(content)}}}
+		answer, _, err := svc.AskWithOptions(context.Background(), "describe @attachments/a.txt", opts)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if answer != content {
+			t.Fatalf("expected the CLI to read %q, got %q", content, answer)
+		}
+	}
+
+	opts := model.AskOptions{Attachments: []model.Attachment{{Name: "../escape.txt", Data: []byte("x")}}}
+	if _, _, err := svc.AskWithOptions(context.Background(), "q", opts); err == nil {
+		t.Fatal("expected an attachment outside the workspace to be rejected")
+	}
+}
+
+func TestAPIFallbackAnswersWhenCLIIsMissing(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path != "/v1beta/models/gemini-2.5-pro:generateContent" || r.Header.Get("x-goog-api-key") != "secret" {
+			t.Errorf("unexpected request %s with key %q", r.URL.Path, r.Header.Get("x-goog-api-key"))
+		}
+		fmt.Fprint(w, `{"candidates":[{"content":{"parts":[{"text":"from the API"}]},"finishReason":"STOP"}],"usageMetadata":{"promptTokenCount":3,"candidatesTokenCount":4,"totalTokenCount":7}}`)
+	}))
+	defer server.Close()
+
+	svc := &GeminiService{
+		backend:    headlessBackend{cliPath: filepath.Join(t.TempDir(), "gemini")},
+		apiBackend: newAPIBackend(APIFallbackConfig{Enabled: true, APIKey: "secret", BaseURL: server.URL}, t.TempDir()),
+	}
+	answer, status, err := svc.Ask(context.Background(), "q", "gemini-2.5-pro")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if answer != "from the API" || status == nil || status.Backend != backendAPI || status.Usage == nil || status.Usage.TotalTokenCount != 7 {
+		t.Fatalf("unexpected answer %q with status %#v", answer, status)
+	}
+	if requests != 1 {
+		t.Fatalf("expected one API request, got %d", requests)
+	}
+
+	svc.backend = newBackend(Config{Backend: backendMock})
+	_, status, err = svc.Ask(context.Background(), "q", "gemini-2.5-flash")
+	if err != nil || status == nil || status.Backend != backendMock {
+		t.Fatalf("expected the working backend to answer, got status=%#v err=%v", status, err)
+	}
+}
+
+func TestAPIBackendServesWithoutCLI(t *testing.T) {
+	t.Setenv("PATH", t.TempDir())
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"candidates":[{"content":{"parts":[{"text":"from the API"}]},"finishReason":"STOP"}]}`)
+	}))
+	defer server.Close()
+
+	cfg := Config{Backend: parseBackendMode(" REST "), CLIHome: t.TempDir(), APIFallback: APIFallbackConfig{APIKey: "secret", BaseURL: server.URL}}
+	svc := &GeminiService{backend: newBackend(cfg)}
+	answer, status, err := svc.Ask(context.Background(), "q", "gemini-2.5-flash")
+	if err != nil || answer != "from the API" || status == nil || status.Backend != backendAPI {
+		t.Fatalf("unexpected answer %q with status %#v, err=%v", answer, status, err)
+	}
+
+	cfg.APIFallback.APIKey = ""
+	if _, err := newBackend(cfg).(backendProber).Probe(context.Background()); err == nil {
+		t.Fatal("expected the probe to fail without an API key")
+	}
+}
+
+func TestAPIFallbackStreamsMultimodalRequests(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body model.GeminiAPIRequest
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("invalid request body: %v", err)
+		}
+		parts := body.Contents[0].Parts
+		if r.URL.Query().Get("alt") != "sse" || len(parts) != 3 || parts[1].Text != "@attachments/a.png:" || parts[2].InlineData == nil {
+			t.Errorf("unexpected request %s: %#v", r.URL, parts)
+		}
+		if body.SystemInstruction == nil || body.SystemInstruction.Parts[0].Text != "Be brief." {
+			t.Errorf("expected the request context as system instruction, got %#v", body.SystemInstruction)
+		}
+		fmt.Fprint(w, "data: {\"candidates\":[{\"content\":{\"parts\":[{\"text\":\"a small \"}]}}]}\n\n")
+		fmt.Fprint(w, "data: {\"candidates\":[{\"content\":{\"parts\":[{\"text\":\"image\"}]},\"finishReason\":\"STOP\"}]}\n\n")
+	}))
+	defer server.Close()
+
+	svc := &GeminiService{
+		backend:       headlessBackend{cliPath: filepath.Join(t.TempDir(), "gemini")},
+		apiBackend:    newAPIBackend(APIFallbackConfig{Enabled: true, APIKey: "secret", BaseURL: server.URL}, t.TempDir()),
+		apiMultimodal: true,
+	}
+	opts := model.AskOptions{
+		Context:     "Be brief.",
+		Attachments: []model.Attachment{{Name: "attachments/a.png", MimeType: "image/png", Data: []byte("png")}},
+	}
+	var chunks []string
+	answer, status, err := svc.AskStreamWithOptions(context.Background(), "describe @attachments/a.png", opts, func(chunk string) error {
+		chunks = append(chunks, chunk)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if answer != "a small image" || len(chunks) != 2 || status.Backend != backendAPI || status.FinishReason != "STOP" {
+		t.Fatalf("unexpected stream: %q %#v %#v", answer, chunks, status)
+	}
+}
+
+func TestAPIStreamReadsEventsLongerThanAnyBuffer(t *testing.T) {
+	huge := strings.Repeat(`{\"k\":\"ü\"},`, 1_500_000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		fmt.Fprint(w, "data: {\"candidates\":[{\"content\":{\"parts\":[{\"text\":\""+huge+"\"}]}}]}\r\n\r\n")
+		fmt.Fprint(w, "data: {\"candidates\":[{\"content\":{\"parts\":[{\"text\":\"end\"}]},\"finishReason\":\"STOP\"}]}\r\r")
+	}))
+	defer server.Close()
+
+	backend := newAPIBackend(APIFallbackConfig{Enabled: true, APIKey: "secret", BaseURL: server.URL}, t.TempDir())
+	chunks := 0
+	answer, _, err := backend.Stream(context.Background(), "minified JSON", model.AskOptions{}, func(string) error {
+		chunks++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := strings.Repeat(`{"k":"ü"},`, 1_500_000) + "end"
+	if chunks != 2 || answer != want {
+		t.Fatalf("expected both events in full, got %d chunks and %d bytes", chunks, len(answer))
+	}
+}
+
+func TestAPIFallbackSeparatesThoughtParts(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body model.GeminiAPIRequest
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("invalid request body: %v", err)
+		}
+		if cfg := body.GenerationConfig; cfg == nil || cfg.ThinkingConfig == nil || !cfg.ThinkingConfig.IncludeThoughts || strings.Contains(body.Contents[0].Parts[0].Text, thoughtOpen) {
+			t.Errorf("unexpected request %#v", body)
+		}
+		fmt.Fprint(w, "data: {\"candidates\":[{\"content\":{\"parts\":[{\"text\":\"Simple sum.\",\"thought\":true}]}}]}\n\n")
+		fmt.Fprint(w, "data: {\"candidates\":[{\"content\":{\"parts\":[{\"text\":\"4\"}]},\"finishReason\":\"STOP\"}]}\n\n")
+	}))
+	defer server.Close()
+
+	svc := &GeminiService{
+		backend:    headlessBackend{cliPath: filepath.Join(t.TempDir(), "gemini")},
+		apiBackend: newAPIBackend(APIFallbackConfig{Enabled: true, APIKey: "secret", BaseURL: server.URL}, t.TempDir()),
+	}
+	opts := model.AskOptions{GenerationConfig: &model.GenerationConfig{ThinkingConfig: &model.ThinkingConfig{IncludeThoughts: true}}}
+	answer, status, err := svc.AskWithOptions(context.Background(), "2+2?", opts)
+	if err != nil || answer != "4" || status.Thoughts != "Simple sum." {
+		t.Fatalf("unexpected answer %q status=%#v err=%v", answer, status, err)
+	}
+}
+
+func TestAPIFallbackReportsRejectedKeys(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `{"error":{"code":403,"message":"API key not valid","status":"PERMISSION_DENIED"}}`)
+	}))
+	defer server.Close()
+
+	svc := &GeminiService{
+		backend:    headlessBackend{cliPath: filepath.Join(t.TempDir(), "gemini")},
+		apiBackend: newAPIBackend(APIFallbackConfig{Enabled: true, APIKey: "wrong", BaseURL: server.URL}, t.TempDir()),
+	}
+	_, status, err := svc.Ask(context.Background(), "q", "")
+	if !errors.Is(err, ErrAuthentication) || status == nil || status.HTTPStatus != http.StatusForbidden || status.Backend != backendAPI {
+		t.Fatalf("expected a 403 from the API, got status=%#v err=%v", status, err)
+	}
+}
+
+func TestCancelRequestStopsTheStreamAndReturnsThePartialAnswer(t *testing.T) {
+	svc := &GeminiService{
+		backend:  newMockBackend(MockConfig{ChunkDelay: time.Minute, Fixtures: []MockFixture{{Answer: "first line\nsecond line"}}}),
+		requests: newRequestRegistry(),
+	}
+	ctx := execution.WithClient(logging.WithRequestID(context.Background(), "req-1"), "key:web")
+	started := make(chan struct{})
+	type result struct {
+		status *model.GeminiStatus
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		_, status, err := svc.AskStreamWithOptions(ctx, "q", model.AskOptions{}, func(string) error {
+			close(started)
+			return nil
+		})
+		done <- result{status, err}
+	}()
+	<-started
+
+	if _, ok := svc.CancelRequest("req-1", "key:other"); ok {
+		t.Fatal("another client cancelled the request")
+	}
+	cancelled, ok := svc.CancelRequest("req-1", "key:web")
+	if !ok || cancelled.Cancelled != 1 || cancelled.PartialAnswer != "first line\n" {
+		t.Fatalf("unexpected cancel result ok=%v %+v", ok, cancelled)
+	}
+	select {
+	case res := <-done:
+		if !errors.Is(res.err, ErrRequestCancelled) || res.status.Reason != model.ReasonCancelled || res.status.HTTPStatus != 499 {
+			t.Fatalf("unexpected outcome of the cancelled stream: err=%v status=%+v", res.err, res.status)
+		}
+	default:
+		t.Fatal("CancelRequest returned before the stream stopped")
+	}
+	if _, ok := svc.CancelRequest("req-1", "key:web"); ok {
+		t.Fatal("finished request still registered")
+	}
+}
+
+func TestAPIKeyPoolFailsOverWhenAKeyRunsOutOfQuota(t *testing.T) {
+	home := t.TempDir()
+	installFakeGeminiCLI(t, `if [ "$GEMINI_API_KEY" = "spent" ]; then
+  echo '{"error": {"code": 429, "message": "Quota exceeded for quota metric"}}'
+  exit 1
+fi
+echo "{\"response\": \"answered from $HOME\"}"
+`)
+
+	svc := &GeminiService{backend: headlessBackend{cliHome: home}, keys: newKeyPool([]string{"spent", "fresh"}, time.Minute, home), cache: map[string]cacheEntry{}}
+	for range 2 {
+		answer, status, err := svc.Ask(context.Background(), "q", "")
+		if err != nil || answer != "answered from "+filepath.Join(home, "keys", "key-2") {
+			t.Fatalf("expected the answer of the second key, got %q, %v", answer, err)
+		}
+		if status == nil || status.KeyBucket != "key-2" {
+			t.Fatalf("expected key-2 to be reported, got %#v", status)
+		}
+	}
+	if method, err := selectedAuthType(filepath.Join(home, "keys", "key-1")); err != nil || method != authAPIKeyType {
+		t.Fatalf("expected the key's CLI home to use the API key, got %q, %v", method, err)
+	}
+
+	auth, err := svc.AuthStatus()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// The spent key cools down, so the second question went to key-2 first.
+	if len(auth.Keys) != 2 || auth.Keys[0].Healthy || auth.Keys[0].QuotaErrors != 1 || auth.Keys[0].CoolingUntil == nil || !auth.Keys[1].Healthy || auth.Keys[1].Served != 2 {
+		t.Fatalf("unexpected key health %#v", auth.Keys)
+	}
+}
+
+func TestCapabilitiesListTheModelsAndFeatures(t *testing.T) {
+	t.Setenv("GEMINI_MODELS", "")
+	svc := &GeminiService{
+		backend:            headlessBackend{},
+		supervisor:         newSupervisor(),
+		defaultModel:       "gemini-2.5-pro",
+		fallbackModels:     []string{"gemini-2.5-flash"},
+		allowedModels:      []string{"gemini-2.5-pro", "gemini-2.5-flash"},
+		cacheEnabled:       true,
+		jsonRepairAttempts: 2,
+	}
+	svc.supervisor.version = "0.39.1"
+	caps := svc.Capabilities()
+	if caps.Backend != backendHeadless || caps.CLIVersion != "0.39.1" || caps.DefaultModel != "gemini-2.5-pro" || len(caps.AllowedModels) != 2 || len(caps.Models) != len(DefaultModels) {
+		t.Fatalf("unexpected capabilities %#v", caps)
+	}
+	if !reflect.DeepEqual(caps.Features, []string{"cache", "json_repair"}) {
+		t.Fatalf("unexpected features %v", caps.Features)
+	}
+}
+
+func TestCLIPatternsFollowTheCLIVersion(t *testing.T) {
+	installFakeGeminiCLI(t, `if [ "$1" = --version ]; then
+  echo 0.50.1
+  exit 0
+fi
+case "$2" in
+  hang*) printf '\033[36m│ > \033[39mEnter a message or @path\n'; exec sleep 30 ;;
+esac
+echo 'NOTICE: a new release is available'
+echo 'Loaded cached credentials.'
+echo 'The form says: enter a message.'
+`)
+	patterns := newCLIPatterns([]CLIPatterns{
+		{MinVersion: "0.50.0", InputPrompts: []string{"Enter a message"}, Skip: []string{`^NOTICE:`}},
+		{MinVersion: "0.60.0", Skip: []string{`^Enter`}},
+	})
+	svc := &GeminiService{backend: headlessBackend{patterns: patterns}, cache: map[string]cacheEntry{}}
+	if set := patterns.current(); set.minVersion != "0.60.0" {
+		t.Fatalf("expected the newest set before the probe, got %q", set.minVersion)
+	}
+	if _, err := svc.activeBackend().(backendProber).Probe(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if health := svc.Health(); health.Patterns != "0.50.0" {
+		t.Fatalf("expected the 0.50.0 patterns, got %q", health.Patterns)
+	}
+
+	// The 0.50.0 set replaces the built-in banners; an answer mentioning
+	// the prompt is not a prompt.
+	answer, _, err := svc.AskStream(context.Background(), "question", "", func(string) error { return nil })
+	if err != nil || answer != "Loaded cached credentials.\nThe form says: enter a message." {
+		t.Fatalf("unexpected answer %q err=%v", answer, err)
+	}
+
+	start := time.Now()
+	_, status, err := svc.AskStream(context.Background(), "hang", "", func(string) error { return nil })
+	if !errors.Is(err, ErrInputPrompt) || status == nil || status.HTTPStatus != http.StatusBadGateway {
+		t.Fatalf("expected the interactive prompt to fail the question, got status=%#v err=%v", status, err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Fatalf("expected the waiting CLI to be stopped, took %v", elapsed)
+	}
+}
+
+func TestParseTranscriptShowsTheRuleOfEachLine(t *testing.T) {
+	patterns := newCLIPatterns([]CLIPatterns{
+		{MinVersion: "0.50.0", AuthPrompts: []string{"waiting for auth"}, Skip: []string{`^NOTICE:`, `^Tip:`}, Keep: []string{`^NOTICE: keep`}},
+	})
+	svc := &GeminiService{backend: headlessBackend{patterns: patterns}}
+	transcript := "NOTICE: a new release is available\nNOTICE: keep this\nTip: use /help\nThe answer.\n"
+
+	parse := svc.ParseTranscript(transcript, "0.51.0")
+	want := []TranscriptLine{
+		{Text: "NOTICE: a new release is available", Skipped: true, Rule: "skip: ^NOTICE:"},
+		{Text: "NOTICE: keep this", Rule: "keep: ^NOTICE: keep"},
+		{Text: "Tip: use /help", Skipped: true, Rule: "skip: ^Tip:"},
+		{Text: "The answer."},
+	}
+	if parse.MinVersion != "0.50.0" || !reflect.DeepEqual(parse.Lines, want) || parse.Answer != "NOTICE: keep this\nThe answer." || parse.Error != "" {
+		t.Fatalf("unexpected parse %+v", parse)
+	}
+	if parse := svc.ParseTranscript(transcript, "0.40.0"); parse.MinVersion != "default" || parse.Lines[0].Skipped {
+		t.Fatalf("expected the built-in set for an older CLI, got %+v", parse)
+	}
+	if parse := svc.ParseTranscript("Waiting for auth...", "0.51.0"); !strings.Contains(parse.Error, "sign-in") {
+		t.Fatalf("expected the auth prompt to be reported, got %+v", parse)
+	}
+
+	// Reloaded patterns apply to the version in use without a restart.
+	patterns.use("0.51.0")
+	svc.Reconfigure(Config{CLIPatterns: []CLIPatterns{{MinVersion: "0.50.0", Skip: []string{`^The answer`}}}})
+	if parse := svc.ParseTranscript(transcript, ""); parse.Answer != "NOTICE: a new release is available\nNOTICE: keep this\nTip: use /help" {
+		t.Fatalf("expected the reloaded patterns, got %+v", parse)
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	for _, tc := range []struct {
+		a, b string
+		want int
+	}{
+		{"0.39.1", "0.40.0", -1},
+		{"0.40.0-preview.2", "0.40.0", 0},
+		{"1.0", "0.99.9", 1},
+		{"", "0.1.0", -1},
+		{"nightly", "9.9.9", 1},
+	} {
+		if got := compareVersions(tc.a, tc.b); got != tc.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
+
+func TestShadowLogsBothAnswersWithoutChangingTheResponse(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Cache.DiskEnabled = false
+	cfg.Shadow = ShadowConfig{Enabled: true, Backend: backendMock, Model: "gemini-2.5-pro", SampleRate: 1, LogPath: filepath.Join(t.TempDir(), "shadow.jsonl")}
+	svc := NewGeminiServiceWithBackend(cfg, staticBackend{answer: "primary answer"})
+
+	ctx := logging.WithRequestID(context.Background(), "req-1")
+	answer, _, err := svc.AskWithOptions(ctx, "ping", model.AskOptions{Model: "gemini-2.5-flash"})
+	if err != nil || answer != "primary answer" {
+		t.Fatalf("expected the primary answer, got %q %v", answer, err)
+	}
+	// Close waits for the shadow question and flushes the log.
+	if err := svc.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	payload, err := os.ReadFile(cfg.Shadow.LogPath)
+	if err != nil {
+		t.Fatalf("shadow log not written: %v", err)
+	}
+	var entry ShadowEntry
+	if err := json.Unmarshal(payload, &entry); err != nil {
+		t.Fatalf("expected one JSON line, got %q: %v", payload, err)
+	}
+	if entry.RequestID != "req-1" || entry.Question != "ping" || entry.Identical {
+		t.Fatalf("unexpected entry: %+v", entry)
+	}
+	if entry.Primary.Backend != "static" || entry.Primary.Model != "gemini-2.5-flash" || entry.Primary.Answer != "primary answer" {
+		t.Fatalf("unexpected primary side: %+v", entry.Primary)
+	}
+	if entry.Shadow.Backend != backendMock || entry.Shadow.Model != "gemini-2.5-pro" || entry.Shadow.Answer != "mock answer: ping" || entry.Shadow.Error != "" {
+		t.Fatalf("unexpected shadow side: %+v", entry.Shadow)
+	}
+}
+
+func TestSelfTestEndToEndAsksAtMostOncePerInterval(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Cache.DiskEnabled = false
+	cfg.SelfTest.Interval = time.Hour
+	backend := &flakyBackend{}
+	svc := NewGeminiServiceWithBackend(cfg, backend)
+	defer svc.Close()
+
+	first := svc.SelfTestEndToEnd(context.Background())
+	if !first.Passed || first.Cached || first.RunAt == nil {
+		t.Fatalf("expected a fresh passing run, got %+v", first)
+	}
+	calls := backend.calls
+	second := svc.SelfTestEndToEnd(context.Background())
+	if !second.Passed || !second.Cached || !second.RunAt.Equal(*first.RunAt) || backend.calls != calls {
+		t.Fatalf("expected the cached result without asking again, got %+v after %d calls", second, backend.calls-calls)
+	}
+
+	stale := first.RunAt.Add(-2 * time.Hour)
+	svc.endToEnd.last.RunAt = &stale
+	if third := svc.SelfTestEndToEnd(context.Background()); third.Cached || backend.calls != calls+1 {
+		t.Fatalf("expected a new run once the interval passed, got %+v", third)
+	}
+}
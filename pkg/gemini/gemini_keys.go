@@ -0,0 +1,212 @@
+package gemini
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"gemini-wrapper/model"
+)
+
+// defaultKeyCooldown is how long a key that ran out of quota is passed over.
+const defaultKeyCooldown = time.Minute
+
+// APIKeyStatus is the health of one key of the API key pool. The key itself
+// is never reported, only its bucket.
+type APIKeyStatus struct {
+	Bucket       string     `json:"bucket"`
+	Healthy      bool       `json:"healthy"`
+	CoolingUntil *time.Time `json:"coolingUntil,omitempty"`
+	Served       int        `json:"served"`
+	QuotaErrors  int        `json:"quotaErrors"`
+	LastError    string     `json:"lastError,omitempty"`
+}
+
+// poolKey is one key of the pool. Its CLI runs with a home of its own, so
+// the sessions and caches of different accounts never mix.
+type poolKey struct {
+	bucket string
+	value  string
+	home   string
+
+	coolingUntil time.Time
+	served       int
+	quotaErrors  int
+	lastError    string
+}
+
+// env returns the variables that make a CLI process use k.
+func (k *poolKey) env() []string {
+	return []string{
+		"HOME=" + k.home,
+		"GEMINI_CONFIG_DIR=" + filepath.Join(k.home, ".gemini"),
+		"XDG_CONFIG_HOME=" + k.home,
+		"GEMINI_API_KEY=" + k.value,
+	}
+}
+
+// keyPool hands the Gemini API keys out in turn and passes over the ones
+// that recently ran out of quota.
+type keyPool struct {
+	cooldown time.Duration
+
+	mu   sync.Mutex
+	keys []*poolKey
+	next int
+}
+
+// newKeyPool prepares a CLI home per key under cliHome/keys, with the
+// settings of cliHome and the API key auth type selected. Keys whose home
+// cannot be written are left out.
+func newKeyPool(keys []string, cooldown time.Duration, cliHome string) *keyPool {
+	if cooldown <= 0 {
+		cooldown = defaultKeyCooldown
+	}
+	pool := &keyPool{cooldown: cooldown}
+	for i, value := range keys {
+		key := &poolKey{bucket: "key-" + strconv.Itoa(i+1), value: value}
+		key.home = filepath.Join(cliHome, "keys", key.bucket)
+		if err := prepareKeyHome(cliHome, key.home); err != nil {
+			slog.Warn("API key left out of the pool", "bucket", key.bucket, "error", err)
+			continue
+		}
+		pool.keys = append(pool.keys, key)
+	}
+	if len(pool.keys) == 0 {
+		return nil
+	}
+	return pool
+}
+
+// prepareKeyHome copies the CLI settings of home to keyHome and selects the
+// API key auth type there.
+func prepareKeyHome(home, keyHome string) error {
+	settings, err := os.ReadFile(settingsPath(home))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err == nil {
+		if err := writeFileAtomic(settingsPath(keyHome), settings, 0o600); err != nil {
+			return err
+		}
+	}
+	if err := writeSelectedAuthType(keyHome, authAPIKeyType); err != nil {
+		return fmt.Errorf("prepare CLI home %s: %w", keyHome, err)
+	}
+	return nil
+}
+
+// pick returns the next key that was not tried yet, preferring the ones
+// that are not cooling down. It returns nil once every key was tried.
+func (p *keyPool) pick(tried map[*poolKey]bool) *poolKey {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	var coolest *poolKey
+	for i := range p.keys {
+		key := p.keys[(p.next+i)%len(p.keys)]
+		if tried[key] {
+			continue
+		}
+		if !now.Before(key.coolingUntil) {
+			p.next = (p.next + i + 1) % len(p.keys)
+			return key
+		}
+		// With every key cooling down, the one that recovers first is the
+		// best bet.
+		if coolest == nil || key.coolingUntil.Before(coolest.coolingUntil) {
+			coolest = key
+		}
+	}
+	return coolest
+}
+
+// finish records how an attempt with key went.
+func (p *keyPool) finish(key *poolKey, err error, status *model.GeminiStatus) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch {
+	case err == nil:
+		key.served++
+		key.coolingUntil = time.Time{}
+	case quotaExhausted(err, status):
+		key.quotaErrors++
+		key.coolingUntil = time.Now().Add(p.cooldown)
+		key.lastError = err.Error()
+	}
+}
+
+// status reports the health of every key.
+func (p *keyPool) status() []APIKeyStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	statuses := make([]APIKeyStatus, 0, len(p.keys))
+	for _, key := range p.keys {
+		st := APIKeyStatus{Bucket: key.bucket, Healthy: !now.Before(key.coolingUntil), Served: key.served, QuotaErrors: key.quotaErrors, LastError: key.lastError}
+		if !st.Healthy {
+			until := key.coolingUntil
+			st.CoolingUntil = &until
+		}
+		statuses = append(statuses, st)
+	}
+	return statuses
+}
+
+// quotaExhausted reports whether an attempt failed because its account ran
+// out of quota or hit a rate limit.
+func quotaExhausted(err error, status *model.GeminiStatus) bool {
+	return errors.Is(err, ErrQuotaExceeded) || (err != nil && status != nil && status.HTTPStatus == http.StatusTooManyRequests)
+}
+
+type apiKeyContextKey struct{}
+
+// apiKeyFrom returns the pool key the CLI of ctx runs with, or nil.
+func apiKeyFrom(ctx context.Context) *poolKey {
+	key, _ := ctx.Value(apiKeyContextKey{}).(*poolKey)
+	return key
+}
+
+// withAPIKeys runs a CLI attempt with a key of the pool and, when the key
+// ran out of quota, again with the next one, as long as canFailover allows.
+// Questions that bring their own GEMINI_API_KEY keep it.
+func (s *GeminiService) withAPIKeys(ctx context.Context, opts model.AskOptions, attempt func(ctx context.Context) (string, *model.GeminiStatus, error), canFailover func() bool) (string, *model.GeminiStatus, error) {
+	if _, own := opts.Env["GEMINI_API_KEY"]; s.keys == nil || own {
+		return attempt(ctx)
+	}
+	tried := map[*poolKey]bool{}
+	key := s.keys.pick(tried)
+	for {
+		tried[key] = true
+		answer, status, err := attempt(context.WithValue(ctx, apiKeyContextKey{}, key))
+		s.keys.finish(key, err, status)
+		status = withStatusKeyBucket(status, key.bucket)
+		if len(tried) > 1 {
+			status = withStatusDegraded(status, model.DegradedKeyFailover)
+		}
+		if err == nil || ctx.Err() != nil || !quotaExhausted(err, status) || !canFailover() {
+			return answer, status, err
+		}
+		next := s.keys.pick(tried)
+		if next == nil {
+			return answer, status, err
+		}
+		slog.WarnContext(ctx, "API key ran out of quota; failing over to the next key", "bucket", key.bucket, "next", next.bucket, "error", err)
+		key = next
+	}
+}
+
+func withStatusKeyBucket(status *model.GeminiStatus, bucket string) *model.GeminiStatus {
+	if status == nil {
+		status = &model.GeminiStatus{}
+	}
+	status.KeyBucket = bucket
+	return status
+}
@@ -0,0 +1,87 @@
+package gemini
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"gemini-wrapper/model"
+	"gemini-wrapper/service/language"
+)
+
+// replyLanguageAuto asks for the answer in the language of the question.
+const replyLanguageAuto = "auto"
+
+// ErrUnknownLanguage is returned for a reply language the server does not
+// know.
+var ErrUnknownLanguage = errors.New("unknown reply language")
+
+// replyLanguage is the language a request wants its answer in. A zero Code
+// is the language of a question that was not recognized: the model is told
+// to answer in it, but the answer is not checked.
+type replyLanguage struct {
+	language.Language
+}
+
+// resolveReplyLanguage returns the language opts asks the answer of
+// question in, or nil for any. An unknown language is a 400.
+func resolveReplyLanguage(question string, opts model.AskOptions) (*replyLanguage, *model.GeminiStatus, error) {
+	requested := strings.TrimSpace(opts.ReplyLanguage)
+	switch {
+	case requested == "":
+		return nil, nil, nil
+	case strings.EqualFold(requested, replyLanguageAuto):
+		detected, _ := language.Detect(question)
+		return &replyLanguage{detected}, nil, nil
+	}
+	found, ok := language.Lookup(requested)
+	if !ok {
+		err := fmt.Errorf("%w %q", ErrUnknownLanguage, requested)
+		return nil, &model.GeminiStatus{HTTPStatus: http.StatusBadRequest, Code: "INVALID_ARGUMENT", Message: err.Error()}, err
+	}
+	return &replyLanguage{found}, nil, nil
+}
+
+// prompt tells the model which language to answer question in.
+func (r *replyLanguage) prompt(question string) string {
+	if r.Code == "" {
+		return question + "\n\nAnswer in the language of this question."
+	}
+	return question + "\n\nAnswer in " + r.Name + "."
+}
+
+// retryPrompt asks question again after an answer in another language.
+func (r *replyLanguage) retryPrompt(question string) string {
+	return question + "\n\nAnswer in " + r.Name + " only, even where the question, the context or your sources use another language."
+}
+
+// mismatch returns the language answer is written in when it was
+// recognized and is not the one asked for.
+func (r *replyLanguage) mismatch(answer string) (language.Language, bool) {
+	if r.Code == "" {
+		return language.Language{}, false
+	}
+	detected, ok := language.Detect(answer)
+	return detected, ok && detected.Code != r.Code
+}
+
+// matchLanguage asks question once more, with a firmer instruction, when
+// answer is recognizably not in the language asked for. The second answer
+// is kept even if it does not match either; the first is kept if asking
+// again fails.
+func (s *GeminiService) matchLanguage(ctx context.Context, reply *replyLanguage, question, answer string, status *model.GeminiStatus, opts model.AskOptions) (string, *model.GeminiStatus) {
+	detected, mismatch := reply.mismatch(answer)
+	if !mismatch {
+		return answer, status
+	}
+	slog.WarnContext(ctx, "answer is not in the requested language; asking again", "requested", reply.Code, "detected", detected.Code)
+	retried, retriedStatus, err := s.askValidated(ctx, reply.retryPrompt(question), opts, nil)
+	if err != nil {
+		slog.WarnContext(ctx, "asking again in the requested language failed", "requested", reply.Code, "error", err)
+		return answer, withStatusDegraded(status, model.DegradedReplyLanguage)
+	}
+	return retried, retriedStatus
+}
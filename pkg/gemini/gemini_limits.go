@@ -0,0 +1,158 @@
+package gemini
+
+import (
+	"errors"
+	"strings"
+	"unicode/utf8"
+
+	"gemini-wrapper/model"
+)
+
+// Finish reasons of an answer cut by the wrapper.
+const (
+	finishReasonMaxTokens = "MAX_TOKENS"
+	finishReasonStop      = "STOP"
+)
+
+var (
+	// errOutputLimit stops a stream whose answer reached its limit. It
+	// never leaves the service: the answer so far is returned instead.
+	errOutputLimit = errors.New("answer reached its length limit")
+	// errStopSequence stops a stream whose answer printed a stop sequence,
+	// returning the answer before it.
+	errStopSequence = errors.New("answer reached a stop sequence")
+)
+
+// outputLimit returns the most characters an answer for opts may have:
+// MaxOutputChars or maxOutputTokens at about four characters per token,
+// whichever is smaller. 0 means no limit.
+func outputLimit(opts model.AskOptions) int {
+	limit := opts.MaxOutputChars
+	if cfg := opts.GenerationConfig; cfg != nil && cfg.MaxOutputTokens > 0 {
+		// Same rough 4-characters-per-token estimate the OpenAI adapter uses.
+		if tokens := cfg.MaxOutputTokens * 4; limit <= 0 || tokens < limit {
+			limit = tokens
+		}
+	}
+	return max(limit, 0)
+}
+
+// stopSequences returns the non-empty stop sequences of opts.
+func stopSequences(opts model.AskOptions) []string {
+	if opts.GenerationConfig == nil {
+		return nil
+	}
+	var stops []string
+	for _, stop := range opts.GenerationConfig.StopSequences {
+		if stop != "" {
+			stops = append(stops, stop)
+		}
+	}
+	return stops
+}
+
+// outputLimiter passes the chunks of a streamed answer on until the answer
+// reaches its limit or prints a stop sequence. The stream is then stopped
+// with errOutputLimit or errStopSequence, which interrupts the CLI. With
+// stop sequences, the end of what arrived is held back until it cannot be
+// the start of one, so no part of a stop sequence reaches the client.
+type outputLimiter struct {
+	limit   int
+	stops   []string
+	hold    int
+	onChunk func(chunk string) error
+	pending string
+	sent    strings.Builder
+	chars   int
+	reached bool
+}
+
+func newOutputLimiter(opts model.AskOptions, onChunk func(chunk string) error) *outputLimiter {
+	l := &outputLimiter{limit: outputLimit(opts), stops: stopSequences(opts), onChunk: onChunk}
+	for _, stop := range l.stops {
+		l.hold = max(l.hold, len(stop)-1)
+	}
+	return l
+}
+
+func (l *outputLimiter) chunk(chunk string) error {
+	if l.limit <= 0 && len(l.stops) == 0 {
+		return l.onChunk(chunk)
+	}
+	l.pending += chunk
+	if end := l.stopIndex(); end >= 0 {
+		if err := l.send(l.pending[:end]); err != nil {
+			return err
+		}
+		l.pending = ""
+		return errStopSequence
+	}
+	n := len(l.pending) - l.hold
+	for n > 0 && n < len(l.pending) && !utf8.RuneStart(l.pending[n]) {
+		n--
+	}
+	if n <= 0 {
+		return nil
+	}
+	out := l.pending[:n]
+	l.pending = l.pending[n:]
+	return l.send(out)
+}
+
+// stopIndex returns where the first stop sequence in the pending text
+// starts, or -1.
+func (l *outputLimiter) stopIndex() int {
+	first := -1
+	for _, stop := range l.stops {
+		if i := strings.Index(l.pending, stop); i >= 0 && (first < 0 || i < first) {
+			first = i
+		}
+	}
+	return first
+}
+
+// send passes text on, cut at the limit.
+func (l *outputLimiter) send(text string) error {
+	if l.limit > 0 {
+		if n := utf8.RuneCountInString(text); l.chars+n > l.limit {
+			text = string([]rune(text)[:l.limit-l.chars])
+			l.reached = true
+		}
+		l.chars += utf8.RuneCountInString(text)
+	}
+	l.sent.WriteString(text)
+	if text != "" {
+		if err := l.onChunk(text); err != nil {
+			return err
+		}
+	}
+	if l.reached {
+		return errOutputLimit
+	}
+	return nil
+}
+
+// result sends what was held back of a finished stream, and turns a stream
+// stopped at the limit or a stop sequence into the answer sent so far.
+func (l *outputLimiter) result(answer string, status *model.GeminiStatus, err error) (string, *model.GeminiStatus, error) {
+	if err == nil {
+		pending := l.pending
+		l.pending = ""
+		if err = l.send(pending); err == nil {
+			return answer, status, nil
+		}
+	}
+	finishReason := finishReasonMaxTokens
+	switch {
+	case errors.Is(err, errOutputLimit):
+	case errors.Is(err, errStopSequence):
+		finishReason = finishReasonStop
+	default:
+		return answer, status, err
+	}
+	if status == nil {
+		status = &model.GeminiStatus{}
+	}
+	status.FinishReason = finishReason
+	return strings.TrimSpace(l.sent.String()), status, nil
+}
@@ -0,0 +1,179 @@
+package gemini
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	mcpSourceWrapper  = "wrapper"
+	mcpSourceSettings = "settings"
+)
+
+// MCPServer declares a Model Context Protocol server for the CLI. It has the
+// shape of an mcpServers entry of the CLI's settings.json; exactly one of
+// Command (stdio), URL (SSE) and HTTPURL (streamable HTTP) is set.
+type MCPServer struct {
+	Command string            `yaml:"command" json:"command,omitempty"`
+	Args    []string          `yaml:"args" json:"args,omitempty"`
+	Env     map[string]string `yaml:"env" json:"env,omitempty"`
+	Cwd     string            `yaml:"cwd" json:"cwd,omitempty"`
+	URL     string            `yaml:"url" json:"url,omitempty"`
+	HTTPURL string            `yaml:"http_url" json:"httpUrl,omitempty"`
+	Headers map[string]string `yaml:"headers" json:"headers,omitempty"`
+	// TimeoutMillis bounds each tool call. 0 keeps the CLI default.
+	TimeoutMillis int `yaml:"timeout_ms" json:"timeout,omitempty"`
+	// Trust skips the CLI's confirmation of tool calls.
+	Trust bool `yaml:"trust" json:"trust,omitempty"`
+	// IncludeTools limits the server to these tools; ExcludeTools hides
+	// tools from it.
+	IncludeTools []string `yaml:"include_tools" json:"includeTools,omitempty"`
+	ExcludeTools []string `yaml:"exclude_tools" json:"excludeTools,omitempty"`
+	Description  string   `yaml:"description" json:"description,omitempty"`
+}
+
+// MCPServerInfo is the operator view of an MCP server the CLI loads. Env and
+// headers are left out because they usually carry credentials. Source is
+// "wrapper" for servers from the wrapper config and "settings" for servers
+// that were already in settings.json.
+type MCPServerInfo struct {
+	Name         string   `json:"name"`
+	Transport    string   `json:"transport"`
+	Target       string   `json:"target"`
+	Source       string   `json:"source"`
+	Trust        bool     `json:"trust"`
+	IncludeTools []string `json:"includeTools,omitempty"`
+	ExcludeTools []string `json:"excludeTools,omitempty"`
+	Description  string   `json:"description,omitempty"`
+}
+
+func (m MCPServer) validate() error {
+	set := 0
+	for _, target := range []string{m.Command, m.URL, m.HTTPURL} {
+		if strings.TrimSpace(target) != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		return errors.New("exactly one of command, url and http_url must be set")
+	}
+	return nil
+}
+
+func (m MCPServer) info(name, source string) MCPServerInfo {
+	info := MCPServerInfo{
+		Name:         name,
+		Source:       source,
+		Trust:        m.Trust,
+		IncludeTools: m.IncludeTools,
+		ExcludeTools: m.ExcludeTools,
+		Description:  m.Description,
+	}
+	switch {
+	case m.HTTPURL != "":
+		info.Transport, info.Target = "http", m.HTTPURL
+	case m.URL != "":
+		info.Transport, info.Target = "sse", m.URL
+	default:
+		info.Transport, info.Target = "stdio", strings.Join(append([]string{m.Command}, m.Args...), " ")
+	}
+	return info
+}
+
+// settingsPath returns the user settings.json of the CLI run with home.
+func settingsPath(home string) string {
+	return filepath.Join(home, ".gemini", "settings.json")
+}
+
+// readSettings returns the top-level keys of the settings.json at path, or
+// an empty map when it does not exist.
+func readSettings(path string) (map[string]json.RawMessage, error) {
+	settings := map[string]json.RawMessage{}
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return settings, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(strings.TrimSpace(string(raw))) == 0 {
+		return settings, nil
+	}
+	if err := json.Unmarshal(raw, &settings); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return settings, nil
+}
+
+// writeMCPServers merges servers into the mcpServers of the CLI settings at
+// home. Entries of the same name are replaced; every other setting and
+// server is kept.
+func writeMCPServers(home string, servers map[string]MCPServer) error {
+	for name, server := range servers {
+		if strings.TrimSpace(name) == "" {
+			return errors.New("MCP server name must not be empty")
+		}
+		if err := server.validate(); err != nil {
+			return fmt.Errorf("MCP server %s: %w", name, err)
+		}
+	}
+
+	path := settingsPath(home)
+	settings, err := readSettings(path)
+	if err != nil {
+		return err
+	}
+	existing := map[string]json.RawMessage{}
+	if raw, ok := settings["mcpServers"]; ok {
+		if err := json.Unmarshal(raw, &existing); err != nil {
+			return fmt.Errorf("parse mcpServers of %s: %w", path, err)
+		}
+	}
+	for name, server := range servers {
+		raw, err := json.Marshal(server)
+		if err != nil {
+			return err
+		}
+		existing[name] = raw
+	}
+	if settings["mcpServers"], err = json.Marshal(existing); err != nil {
+		return err
+	}
+	payload, err := json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, append(payload, '\n'), 0o600)
+}
+
+// MCPServers lists the MCP servers the CLI loads from its settings.json,
+// ordered by name. The CLI discovers their tools itself on every run, so the
+// list shows the configured tool filters rather than the tools.
+func (s *GeminiService) MCPServers() ([]MCPServerInfo, error) {
+	settings, err := readSettings(settingsPath(s.cliHomeDir()))
+	if err != nil {
+		return nil, err
+	}
+	servers := map[string]MCPServer{}
+	if raw, ok := settings["mcpServers"]; ok {
+		if err := json.Unmarshal(raw, &servers); err != nil {
+			return nil, fmt.Errorf("parse mcpServers: %w", err)
+		}
+	}
+	list := make([]MCPServerInfo, 0, len(servers))
+	for name, server := range servers {
+		source := mcpSourceSettings
+		if _, ok := s.mcpServers[name]; ok {
+			source = mcpSourceWrapper
+		}
+		list = append(list, server.info(name, source))
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
@@ -0,0 +1,307 @@
+package gemini
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"gemini-wrapper/model"
+
+	"gopkg.in/yaml.v3"
+)
+
+// backendMock answers from memory without starting any process.
+const backendMock = "mock"
+
+// defaultMockErrorStatus is the status of injected errors.
+const defaultMockErrorStatus = http.StatusServiceUnavailable
+
+// MockConfig scripts the mock backend for integration and load tests. The
+// zero value echoes every question back immediately.
+type MockConfig struct {
+	// FixturesFile is a YAML file with a top-level fixtures list, read at
+	// startup and tried after Fixtures.
+	FixturesFile string        `yaml:"fixtures_file"`
+	Fixtures     []MockFixture `yaml:"fixtures"`
+	// Latency delays every answer, plus a random share of Jitter.
+	Latency time.Duration `yaml:"latency"`
+	Jitter  time.Duration `yaml:"jitter"`
+	// ChunkDelay is waited between the chunks of a stream.
+	ChunkDelay time.Duration `yaml:"chunk_delay"`
+	// ErrorRate is the share of requests, from 0 to 1, that fail with
+	// ErrorStatus instead of being answered.
+	ErrorRate   float64 `yaml:"error_rate"`
+	ErrorStatus int     `yaml:"error_status"`
+}
+
+// MockFixture is a canned response. A fixture applies to questions that
+// contain Match and match Pattern, asked of Model; empty fields match
+// anything. The first fixture that applies answers.
+type MockFixture struct {
+	Match   string `yaml:"match"`
+	Pattern string `yaml:"pattern"`
+	Model   string `yaml:"model"`
+	// Answers are returned in turn, starting over after the last one;
+	// Answer is a single answer.
+	Answer  string   `yaml:"answer"`
+	Answers []string `yaml:"answers"`
+	// Latency replaces the configured latency for this fixture.
+	Latency time.Duration `yaml:"latency"`
+	// Status fails the request with this HTTP status, Code and Error.
+	Status int    `yaml:"status"`
+	Code   string `yaml:"code"`
+	Error  string `yaml:"error"`
+}
+
+type mockFixtureFile struct {
+	Fixtures []MockFixture `yaml:"fixtures"`
+}
+
+// mockBackend answers from fixtures and echoes other questions back. It is
+// meant for local development and tests where Gemini CLI is not installed or
+// not authenticated. The zero value only echoes.
+type mockBackend struct {
+	cfg      MockConfig
+	fixtures []*mockFixture
+}
+
+type mockFixture struct {
+	MockFixture
+	pattern *regexp.Regexp
+
+	mu   sync.Mutex
+	turn int
+}
+
+func newMockBackend(cfg MockConfig) *mockBackend {
+	fixtures := cfg.Fixtures
+	if path := strings.TrimSpace(cfg.FixturesFile); path != "" {
+		loaded, err := loadMockFixtures(path)
+		if err != nil {
+			slog.Error("mock fixtures not loaded", "path", path, "error", err)
+		} else {
+			fixtures = append(append([]MockFixture(nil), fixtures...), loaded...)
+		}
+	}
+	if cfg.ErrorStatus < 400 || cfg.ErrorStatus > 599 {
+		cfg.ErrorStatus = defaultMockErrorStatus
+	}
+	backend := &mockBackend{cfg: cfg}
+	for i, fixture := range fixtures {
+		compiled := &mockFixture{MockFixture: fixture}
+		if fixture.Pattern != "" {
+			pattern, err := regexp.Compile(fixture.Pattern)
+			if err != nil {
+				slog.Error("mock fixture skipped", "index", i, "pattern", fixture.Pattern, "error", err)
+				continue
+			}
+			compiled.pattern = pattern
+		}
+		backend.fixtures = append(backend.fixtures, compiled)
+	}
+	if len(backend.fixtures) > 0 || cfg.Latency > 0 || cfg.ErrorRate > 0 {
+		slog.Info("mock backend scripted", "fixtures", len(backend.fixtures), "latency", cfg.Latency, "jitter", cfg.Jitter, "error_rate", cfg.ErrorRate)
+	}
+	return backend
+}
+
+func loadMockFixtures(path string) ([]MockFixture, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file mockFixtureFile
+	if err := yaml.Unmarshal(raw, &file); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return file.Fixtures, nil
+}
+
+func (*mockBackend) Name() string {
+	return backendMock
+}
+
+func (b *mockBackend) Generate(ctx context.Context, question string, opts model.AskOptions) (string, *model.GeminiStatus, error) {
+	answer, err := b.answer(ctx, question, opts.Model)
+	if err != nil {
+		return "", mockErrorStatus(err, opts.Model), err
+	}
+	return answer, mockStatus(question, answer, opts.Model), nil
+}
+
+func (b *mockBackend) Stream(ctx context.Context, question string, opts model.AskOptions, onChunk func(chunk string) error) (string, *model.GeminiStatus, error) {
+	answer, err := b.answer(ctx, question, opts.Model)
+	if err != nil {
+		return "", mockErrorStatus(err, opts.Model), err
+	}
+	first := true
+	for _, line := range strings.SplitAfter(answer, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if !first {
+			if err := sleepContext(ctx, b.cfg.ChunkDelay); err != nil {
+				return "", nil, err
+			}
+		}
+		first = false
+		if err := onChunk(line); err != nil {
+			return "", nil, err
+		}
+	}
+	return answer, mockStatus(question, answer, opts.Model), nil
+}
+
+// answer waits out the latency and returns the scripted answer or error.
+func (b *mockBackend) answer(ctx context.Context, question, modelName string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	fixture := b.match(question, modelName)
+	latency := b.cfg.Latency
+	if fixture != nil && fixture.Latency > 0 {
+		latency = fixture.Latency
+	}
+	if b.cfg.Jitter > 0 {
+		latency += rand.N(b.cfg.Jitter)
+	}
+	if err := sleepContext(ctx, latency); err != nil {
+		return "", err
+	}
+
+	if fixture != nil && fixture.Status != 0 {
+		return "", &mockError{status: fixture.Status, code: fixture.Code, message: fixture.Error}
+	}
+	if b.cfg.ErrorRate > 0 && rand.Float64() < b.cfg.ErrorRate {
+		return "", &mockError{status: b.cfg.ErrorStatus, message: "injected mock error"}
+	}
+	if fixture != nil {
+		if answer := fixture.next(); answer != "" {
+			return answer, nil
+		}
+	}
+	return mockAnswer(question), nil
+}
+
+func (b *mockBackend) match(question, modelName string) *mockFixture {
+	for _, fixture := range b.fixtures {
+		if fixture.Model != "" && !strings.EqualFold(fixture.Model, modelName) {
+			continue
+		}
+		if fixture.Match != "" && !strings.Contains(question, fixture.Match) {
+			continue
+		}
+		if fixture.pattern != nil && !fixture.pattern.MatchString(question) {
+			continue
+		}
+		return fixture
+	}
+	return nil
+}
+
+// next returns the answer for the current request and advances the script.
+func (f *mockFixture) next() string {
+	if len(f.Answers) == 0 {
+		return f.Answer
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	answer := f.Answers[f.turn%len(f.Answers)]
+	f.turn++
+	return answer
+}
+
+// mockError is a scripted failure. Statuses that the CLI reports as
+// authentication or unknown model errors wrap the same sentinel errors.
+type mockError struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *mockError) Error() string {
+	message := e.message
+	if message == "" {
+		message = http.StatusText(e.status)
+	}
+	return fmt.Sprintf("mock error %d: %s", e.status, message)
+}
+
+func (e *mockError) Unwrap() error {
+	switch e.status {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return ErrAuthentication
+	case http.StatusNotFound:
+		return ErrModelNotFound
+	case http.StatusTooManyRequests:
+		return ErrQuotaExceeded
+	case http.StatusServiceUnavailable:
+		return ErrModelOverloaded
+	}
+	return nil
+}
+
+func mockErrorStatus(err error, modelName string) *model.GeminiStatus {
+	mockErr, ok := err.(*mockError)
+	if !ok {
+		return nil
+	}
+	code := mockErr.code
+	if code == "" {
+		code = mockErrorCodes[mockErr.status]
+	}
+	return &model.GeminiStatus{HTTPStatus: mockErr.status, Code: code, Message: mockErr.Error(), Model: modelName}
+}
+
+// mockErrorCodes are the codes the Gemini API reports with these statuses.
+var mockErrorCodes = map[int]string{
+	http.StatusBadRequest:          "INVALID_ARGUMENT",
+	http.StatusUnauthorized:        "UNAUTHENTICATED",
+	http.StatusForbidden:           "PERMISSION_DENIED",
+	http.StatusNotFound:            "NOT_FOUND",
+	http.StatusTooManyRequests:     "RESOURCE_EXHAUSTED",
+	http.StatusInternalServerError: "INTERNAL",
+	http.StatusServiceUnavailable:  "UNAVAILABLE",
+	http.StatusGatewayTimeout:      "DEADLINE_EXCEEDED",
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func mockAnswer(question string) string {
+	return fmt.Sprintf("mock answer: %s", strings.TrimSpace(question))
+}
+
+func mockStatus(question, answer, modelName string) *model.GeminiStatus {
+	usage := estimateUsage(question, answer)
+	return &model.GeminiStatus{Model: modelName, Usage: &usage}
+}
+
+// estimateUsage counts tokens with EstimateTokens.
+func estimateUsage(question, answer string) model.UsageMetadata {
+	promptTokens := EstimateTokens(question)
+	answerTokens := EstimateTokens(answer)
+	return model.UsageMetadata{
+		PromptTokenCount:     promptTokens,
+		CandidatesTokenCount: answerTokens,
+		TotalTokenCount:      promptTokens + answerTokens,
+	}
+}
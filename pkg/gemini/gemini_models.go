@@ -0,0 +1,67 @@
+package gemini
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"gemini-wrapper/model"
+)
+
+// ModelNotSupportedCode is the status code of questions for a model outside
+// the allowlist.
+const ModelNotSupportedCode = "MODEL_NOT_SUPPORTED"
+
+// ModelNotAllowedError is returned without starting the CLI for a model that
+// is not in Config.AllowedModels.
+type ModelNotAllowedError struct {
+	Model   string
+	Allowed []string
+}
+
+func (e *ModelNotAllowedError) Error() string {
+	return fmt.Sprintf("model %q is not supported; supported models: %s", e.Model, strings.Join(e.Allowed, ", "))
+}
+
+// AllowedModels returns the models clients may request, or nil when any
+// model is accepted.
+func (s *GeminiService) AllowedModels() []string {
+	s.settingsMu.RLock()
+	defer s.settingsMu.RUnlock()
+	return append([]string(nil), s.allowedModels...)
+}
+
+// checkModel rejects a requested model outside the allowlist with a 400
+// status. An empty name selects the default model and is always accepted.
+func (s *GeminiService) checkModel(modelName string) (*model.GeminiStatus, error) {
+	modelName = normalizeModelName(modelName)
+	allowedModels := s.AllowedModels()
+	if len(allowedModels) == 0 || modelName == "" || slices.Contains(allowedModels, modelName) {
+		return nil, nil
+	}
+	err := &ModelNotAllowedError{Model: modelName, Allowed: allowedModels}
+	return &model.GeminiStatus{HTTPStatus: http.StatusBadRequest, Code: ModelNotSupportedCode, Message: err.Error()}, err
+}
+
+// normalizeModelName accepts resource names like "models/gemini-2.5-flash".
+func normalizeModelName(name string) string {
+	return strings.TrimPrefix(strings.TrimSpace(name), "models/")
+}
+
+func normalizeModelNames(names []string) []string {
+	var normalized []string
+	seen := map[string]struct{}{}
+	for _, name := range names {
+		name = normalizeModelName(name)
+		if name == "" {
+			continue
+		}
+		if _, ok := seen[name]; ok {
+			continue
+		}
+		seen[name] = struct{}{}
+		normalized = append(normalized, name)
+	}
+	return normalized
+}
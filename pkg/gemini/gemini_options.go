@@ -0,0 +1,151 @@
+package gemini
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gemini-wrapper/model"
+)
+
+// generationVariant serializes a generation config for use in cache keys.
+func generationVariant(cfg *model.GenerationConfig) string {
+	if cfg == nil {
+		return ""
+	}
+	b, err := json.Marshal(cfg)
+	if err != nil || string(b) == "{}" {
+		return ""
+	}
+	return string(b)
+}
+
+// optionsVariant extends generationVariant with the safety settings, the
+// execution policy and the request context, which change answers just like
+// sampling parameters do.
+func optionsVariant(opts model.AskOptions) string {
+	variant := generationVariant(opts.GenerationConfig)
+	if args := executionArgs(opts); len(args) > 0 {
+		variant += "|exec=" + strings.Join(args, " ")
+	}
+	if context := contextVariant(opts); context != "" {
+		variant += "|context=" + context
+	}
+	if attachments := attachmentsVariant(opts.Attachments); attachments != "" {
+		variant += "|attachments=" + attachments
+	}
+	if grounded(opts) {
+		variant += "|grounding"
+	}
+	if opts.Candidate > 0 {
+		variant += "|candidate=" + strconv.Itoa(opts.Candidate)
+	}
+	if env := envVariant(opts.Env); env != "" {
+		variant += "|env=" + env
+	}
+	if opts.MaxOutputChars > 0 {
+		variant += "|max_chars=" + strconv.Itoa(opts.MaxOutputChars)
+	}
+	if len(opts.SafetySettings) == 0 {
+		return variant
+	}
+	b, err := json.Marshal(opts.SafetySettings)
+	if err != nil {
+		return variant
+	}
+	return variant + "|safety=" + string(b)
+}
+
+// prepareGenerationWorkspace writes a throwaway workspace whose
+// .gemini/settings.json overrides the sampling parameters, thinking
+// configuration and safety settings for modelName. Gemini CLI has no flags for them, so this is the
+// only per-invocation hook. It returns an empty dir when neither is set.
+func prepareGenerationWorkspace(modelName string, cfg *model.GenerationConfig, safety []model.SafetySetting) (string, func(), error) {
+	noop := func() {}
+	hasGeneration := cfg != nil && (cfg.Temperature != nil || cfg.TopP != nil || cfg.TopK != nil || cfg.ThinkingConfig != nil)
+	if !hasGeneration && len(safety) == 0 {
+		return "", noop, nil
+	}
+
+	generateConfig := map[string]interface{}{}
+	if hasGeneration {
+		if cfg.Temperature != nil {
+			generateConfig["temperature"] = *cfg.Temperature
+		}
+		if cfg.TopP != nil {
+			generateConfig["topP"] = *cfg.TopP
+		}
+		if cfg.TopK != nil {
+			generateConfig["topK"] = *cfg.TopK
+		}
+		if cfg.ThinkingConfig != nil {
+			generateConfig["thinkingConfig"] = cfg.ThinkingConfig
+		}
+	}
+	if len(safety) > 0 {
+		generateConfig["safetySettings"] = safety
+	}
+	match := map[string]interface{}{}
+	if strings.TrimSpace(modelName) != "" {
+		match["model"] = modelName
+	}
+	settings := map[string]interface{}{
+		"modelConfigs": map[string]interface{}{
+			"overrides": []interface{}{
+				map[string]interface{}{
+					"match":       match,
+					"modelConfig": map[string]interface{}{"generateContentConfig": generateConfig},
+				},
+			},
+		},
+	}
+	payload, err := json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return "", noop, err
+	}
+
+	dir, err := os.MkdirTemp("", "gemini-request-")
+	if err != nil {
+		return "", noop, err
+	}
+	cleanup := func() { _ = os.RemoveAll(dir) }
+	if err := os.MkdirAll(filepath.Join(dir, ".gemini"), 0o755); err != nil {
+		cleanup()
+		return "", noop, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, ".gemini", "settings.json"), payload, 0o600); err != nil {
+		cleanup()
+		return "", noop, err
+	}
+	return dir, cleanup, nil
+}
+
+// applyGenerationLimits enforces stopSequences and the output limit on a
+// finished answer and records the resulting finish reason in the status.
+func applyGenerationLimits(answer string, status *model.GeminiStatus, opts model.AskOptions) (string, *model.GeminiStatus) {
+	finishReason := ""
+	for _, stop := range stopSequences(opts) {
+		if idx := strings.Index(answer, stop); idx >= 0 {
+			answer = strings.TrimSpace(answer[:idx])
+			finishReason = finishReasonStop
+		}
+	}
+
+	if limit := outputLimit(opts); limit > 0 {
+		if runes := []rune(answer); len(runes) > limit {
+			answer = strings.TrimSpace(string(runes[:limit]))
+			finishReason = finishReasonMaxTokens
+		}
+	}
+
+	if finishReason == "" {
+		return answer, status
+	}
+	if status == nil {
+		status = &model.GeminiStatus{}
+	}
+	status.FinishReason = finishReason
+	return answer, status
+}
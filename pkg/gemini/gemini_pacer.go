@@ -0,0 +1,98 @@
+package gemini
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"gemini-wrapper/metrics"
+)
+
+// PacingConfig spreads CLI attempts so they stay under the requests per
+// minute of the Gemini account. Bursts of up to Burst attempts start at once;
+// further attempts wait for their turn instead of failing upstream with 429.
+// Each key of the API key pool is paced on its own. RequestsPerMinute 0
+// turns pacing off.
+type PacingConfig struct {
+	RequestsPerMinute int `yaml:"requests_per_minute"`
+	Burst             int `yaml:"burst"`
+}
+
+// pacer is a token bucket per CLI account. Attempts take a token and wait
+// until the bucket has refilled it, so waiting attempts keep their order.
+type pacer struct {
+	interval time.Duration
+	burst    int
+
+	mu      sync.Mutex
+	buckets map[string]*pacerBucket
+}
+
+type pacerBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newPacer(cfg PacingConfig) *pacer {
+	if cfg.RequestsPerMinute <= 0 {
+		return nil
+	}
+	return &pacer{
+		interval: time.Minute / time.Duration(cfg.RequestsPerMinute),
+		burst:    max(cfg.Burst, 1),
+		buckets:  map[string]*pacerBucket{},
+	}
+}
+
+// wait blocks until the account of ctx may start another attempt. When ctx
+// ends first, the token is handed back.
+func (p *pacer) wait(ctx context.Context) error {
+	if p == nil {
+		return nil
+	}
+	account := ""
+	if key := apiKeyFrom(ctx); key != nil {
+		account = key.bucket
+	}
+	delay := p.reserve(account, time.Now())
+	if delay <= 0 {
+		return nil
+	}
+	metrics.PacingDelay.Observe(delay.Seconds())
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		p.cancel(account)
+		return ctx.Err()
+	}
+}
+
+// reserve takes a token of account and returns how long to wait until the
+// bucket has it.
+func (p *pacer) reserve(account string, now time.Time) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	bucket := p.buckets[account]
+	if bucket == nil {
+		bucket = &pacerBucket{tokens: float64(p.burst), last: now}
+		p.buckets[account] = bucket
+	}
+	bucket.tokens = min(bucket.tokens+float64(now.Sub(bucket.last))/float64(p.interval), float64(p.burst))
+	bucket.last = now
+	bucket.tokens--
+	if bucket.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-bucket.tokens * float64(p.interval))
+}
+
+func (p *pacer) cancel(account string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if bucket := p.buckets[account]; bucket != nil {
+		bucket.tokens = min(bucket.tokens+1, float64(p.burst))
+	}
+}
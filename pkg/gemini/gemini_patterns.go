@@ -0,0 +1,398 @@
+package gemini
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ErrInputPrompt is returned when the CLI fell back to its interactive UI
+// and waits for a message, which never comes in headless mode.
+var ErrInputPrompt = errors.New("the CLI is waiting for interactive input")
+
+// CLIPatterns recognise what a CLI release prints besides the answer. Its
+// wording changes between releases, so the set is chosen by the version
+// `gemini --version` reports.
+type CLIPatterns struct {
+	// MinVersion is the first CLI version the set applies to, like
+	// "0.40.0". The set with the highest MinVersion the CLI reaches is
+	// used; an empty MinVersion applies to every version.
+	MinVersion string `yaml:"min_version"`
+	// AuthPrompts are printed when the CLI waits for a browser sign-in.
+	// They are matched case-insensitively.
+	AuthPrompts []string `yaml:"auth_prompts"`
+	// InputPrompts are printed when the CLI waits for a message in its
+	// interactive UI. They are matched case-insensitively.
+	InputPrompts []string `yaml:"input_prompts"`
+	// Skip are regular expressions of output lines that are not part of the
+	// answer, like banners and notices.
+	Skip []string `yaml:"skip"`
+	// Keep are regular expressions of output lines that are part of the
+	// answer even when a Skip expression matches them.
+	Keep []string `yaml:"keep"`
+}
+
+// defaultCLIPatterns are the sets built in. A configured set with the same
+// MinVersion replaces one of them.
+var defaultCLIPatterns = []CLIPatterns{{
+	AuthPrompts:  []string{"waiting for auth"},
+	InputPrompts: []string{"type your message"},
+	Skip:         []string{`^Loaded cached credentials\.?$`, `^Data collection is disabled\.?$`},
+}}
+
+// patternSet is a CLIPatterns ready to match.
+type patternSet struct {
+	minVersion   string
+	authPrompts  []string
+	inputPrompts []string
+	skip         []*regexp.Regexp
+	keep         []*regexp.Regexp
+}
+
+var defaultPatternSet = compilePatterns(defaultCLIPatterns[0])
+
+// compilePatterns leaves out the Skip and Keep expressions that do not
+// compile.
+func compilePatterns(cfg CLIPatterns) *patternSet {
+	set := &patternSet{minVersion: strings.TrimPrefix(strings.TrimSpace(cfg.MinVersion), "v")}
+	for _, prompt := range cfg.AuthPrompts {
+		if prompt = strings.ToLower(strings.TrimSpace(prompt)); prompt != "" {
+			set.authPrompts = append(set.authPrompts, prompt)
+		}
+	}
+	for _, prompt := range cfg.InputPrompts {
+		if prompt = strings.ToLower(strings.TrimSpace(prompt)); prompt != "" {
+			set.inputPrompts = append(set.inputPrompts, prompt)
+		}
+	}
+	set.skip = compileLines(cfg.MinVersion, "skip", cfg.Skip)
+	set.keep = compileLines(cfg.MinVersion, "keep", cfg.Keep)
+	return set
+}
+
+func compileLines(minVersion, list string, exprs []string) []*regexp.Regexp {
+	var compiled []*regexp.Regexp
+	for _, expr := range exprs {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			slog.Error("CLI "+list+" pattern ignored", "min_version", minVersion, "pattern", expr, "error", err)
+			continue
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled
+}
+
+// skipped reports whether line is CLI output other than the answer.
+func (p *patternSet) skipped(line string) bool {
+	skipped, _ := p.match(line)
+	return skipped
+}
+
+// match reports whether line is skipped and returns the rule that decided,
+// like "skip: ^NOTICE:", or "" when no expression matches. Keep expressions
+// win over Skip ones.
+func (p *patternSet) match(line string) (bool, string) {
+	line = strings.TrimSpace(line)
+	for _, re := range p.keep {
+		if re.MatchString(line) {
+			return false, "keep: " + re.String()
+		}
+	}
+	for _, re := range p.skip {
+		if re.MatchString(line) {
+			return true, "skip: " + re.String()
+		}
+	}
+	return false, ""
+}
+
+// clean returns text without the lines p skips.
+func (p *patternSet) clean(text string) string {
+	if len(p.skip) == 0 {
+		return strings.TrimSpace(text)
+	}
+	lines := strings.Split(text, "\n")
+	kept := lines[:0]
+	for _, line := range lines {
+		if !p.skipped(line) {
+			kept = append(kept, line)
+		}
+	}
+	return strings.TrimSpace(strings.Join(kept, "\n"))
+}
+
+// cliPatterns picks the pattern set for the CLI version the supervisor
+// detected. It is shared by the copies of headlessBackend.
+type cliPatterns struct {
+	// sets are ordered by MinVersion, oldest first.
+	sets []*patternSet
+
+	mu      sync.Mutex
+	version string
+	active  *patternSet
+}
+
+func newCLIPatterns(configured []CLIPatterns) *cliPatterns {
+	p := &cliPatterns{sets: compilePatternSets(configured)}
+	// Until the CLI reports its version, the newest set is the best guess.
+	p.active = p.sets[len(p.sets)-1]
+	return p
+}
+
+// compilePatternSets returns the built-in sets with configured added or
+// replacing them, ordered by MinVersion.
+func compilePatternSets(configured []CLIPatterns) []*patternSet {
+	byVersion := map[string]*patternSet{}
+	for _, cfg := range append(slices.Clone(defaultCLIPatterns), configured...) {
+		set := compilePatterns(cfg)
+		byVersion[set.minVersion] = set
+	}
+	var sets []*patternSet
+	for _, set := range byVersion {
+		sets = append(sets, set)
+	}
+	slices.SortFunc(sets, func(a, b *patternSet) int { return compareVersions(a.minVersion, b.minVersion) })
+	return sets
+}
+
+// reconfigure replaces the configured sets and selects the one for the
+// version last detected.
+func (p *cliPatterns) reconfigure(configured []CLIPatterns) {
+	if p == nil {
+		return
+	}
+	sets := compilePatternSets(configured)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sets = sets
+	p.active = sets[len(sets)-1]
+	if p.version != "" {
+		p.active = selectPatterns(sets, p.version)
+	}
+}
+
+// use selects the set for version, the output of `gemini --version`.
+func (p *cliPatterns) use(version string) {
+	if p == nil {
+		return
+	}
+	version = strings.TrimPrefix(strings.TrimSpace(version), "v")
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if version == p.version {
+		return
+	}
+	p.version = version
+	active := selectPatterns(p.sets, version)
+	if active != p.active {
+		slog.Info("CLI output patterns selected", "cli_version", version, "min_version", active.minVersion)
+	}
+	p.active = active
+}
+
+// current returns the set in use. Without configured patterns it is the
+// built-in set.
+func (p *cliPatterns) current() *patternSet {
+	if p == nil {
+		return defaultPatternSet
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.active
+}
+
+// forVersion returns the set a CLI reporting version would use, without
+// selecting it. An empty version returns the set in use.
+func (p *cliPatterns) forVersion(version string) *patternSet {
+	version = strings.TrimPrefix(strings.TrimSpace(version), "v")
+	if p == nil || version == "" {
+		return p.current()
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return selectPatterns(p.sets, version)
+}
+
+// selectPatterns returns the set with the highest MinVersion version
+// reaches, or the newest set when version does not parse.
+func selectPatterns(sets []*patternSet, version string) *patternSet {
+	active := sets[len(sets)-1]
+	if _, ok := parseVersion(version); ok {
+		for _, set := range sets {
+			if compareVersions(version, set.minVersion) >= 0 {
+				active = set
+			}
+		}
+	}
+	return active
+}
+
+// TranscriptLine is a line of CLI output and what the patterns make of it.
+type TranscriptLine struct {
+	Text    string `json:"text"`
+	Skipped bool   `json:"skipped"`
+	// Rule is the expression that decided, like "skip: ^NOTICE:", if any.
+	Rule string `json:"rule,omitempty"`
+}
+
+// TranscriptParse is how the wrapper reads a CLI transcript.
+type TranscriptParse struct {
+	// MinVersion is the min_version of the pattern set used, or "default".
+	MinVersion string           `json:"min_version"`
+	Lines      []TranscriptLine `json:"lines"`
+	Answer     string           `json:"answer"`
+	// Error is set when the transcript would stop the CLI at an auth or
+	// input prompt; the question would fail instead of answering.
+	Error string `json:"error,omitempty"`
+}
+
+// ParseTranscript shows how the CLI output patterns read transcript, as
+// printed by a CLI reporting version, or by the CLI in use when version is
+// empty. Backends other than the CLI use the built-in set.
+func (s *GeminiService) ParseTranscript(transcript, version string) TranscriptParse {
+	var patterns *cliPatterns
+	if headless, ok := s.activeBackend().(headlessBackend); ok {
+		patterns = headless.patterns
+	}
+	set := patterns.forVersion(version)
+	parse := TranscriptParse{MinVersion: cmp.Or(set.minVersion, "default"), Lines: []TranscriptLine{}, Answer: set.clean(transcript)}
+	for _, line := range strings.Split(strings.TrimRight(transcript, "\n"), "\n") {
+		skipped, rule := set.match(line)
+		parse.Lines = append(parse.Lines, TranscriptLine{Text: line, Skipped: skipped, Rule: rule})
+	}
+	prompts := newPromptWatcher(set, nil)
+	_, _ = prompts.Write([]byte(transcript))
+	if err := prompts.prompted(); err != nil {
+		parse.Error = err.Error()
+	}
+	return parse
+}
+
+// parseVersion reads the leading numbers of a version like "0.39.1" or
+// "0.40.0-preview.2". An empty version is the lowest.
+func parseVersion(version string) ([]int, bool) {
+	if version == "" {
+		return nil, true
+	}
+	core, _, _ := strings.Cut(version, "-")
+	var parts []int
+	for _, field := range strings.Split(core, ".") {
+		n, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, false
+		}
+		parts = append(parts, n)
+	}
+	return parts, true
+}
+
+// compareVersions orders versions by their numbers. Versions that do not
+// parse sort last.
+func compareVersions(a, b string) int {
+	pa, okA := parseVersion(a)
+	pb, okB := parseVersion(b)
+	if okA != okB {
+		if okA {
+			return -1
+		}
+		return 1
+	}
+	return slices.Compare(pa, pb)
+}
+
+// maxPromptLine is how much of the line being printed a promptWatcher
+// keeps to find input prompts at its start.
+const maxPromptLine = 256
+
+// terminalEscape matches the colour and cursor sequences of the CLI's
+// interactive UI.
+var terminalEscape = regexp.MustCompile(`\x1b\[[0-9;?]*[A-Za-z]`)
+
+// promptWatcher stops a CLI that waits for an interactive sign-in or
+// message instead of letting it run into the request timeout. Input prompts
+// only count at the start of a line, so answers that mention them do not.
+type promptWatcher struct {
+	patterns *patternSet
+	stop     func()
+
+	mu   sync.Mutex
+	tail string
+	line string
+	keep int
+	err  error
+}
+
+func newPromptWatcher(patterns *patternSet, stop func()) *promptWatcher {
+	w := &promptWatcher{patterns: patterns, stop: stop}
+	for _, prompt := range slices.Concat(patterns.authPrompts, patterns.inputPrompts) {
+		w.keep = max(w.keep, len(prompt))
+	}
+	return w
+}
+
+func (w *promptWatcher) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return len(p), nil
+	}
+	text := strings.ToLower(string(p))
+	window, lines := w.tail+text, w.line+text
+	switch {
+	case containsAny(window, w.patterns.authPrompts):
+		w.err = errAuthPrompt()
+	case startsAnyLine(lines, w.patterns.inputPrompts):
+		w.err = fmt.Errorf("%w; the CLI release may not be supported, see cli_patterns", ErrInputPrompt)
+	default:
+		w.tail = window[max(len(window)-w.keep, 0):]
+		if i := strings.LastIndexByte(lines, '\n'); i >= 0 {
+			lines = lines[i+1:]
+		}
+		w.line = lines[:min(len(lines), maxPromptLine)]
+		return len(p), nil
+	}
+	if w.stop != nil {
+		w.stop()
+	}
+	return len(p), nil
+}
+
+// prompted returns the error of a CLI stopped at a prompt, or nil.
+func (w *promptWatcher) prompted() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// startsAnyLine reports whether a line of text starts with one of prompts,
+// after the escape sequences, borders and markers of the interactive UI.
+func startsAnyLine(text string, prompts []string) bool {
+	if len(prompts) == 0 {
+		return false
+	}
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimLeft(terminalEscape.ReplaceAllString(line, ""), " \t\r│┃|>*")
+		for _, prompt := range prompts {
+			if strings.HasPrefix(line, prompt) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func containsAny(text string, phrases []string) bool {
+	for _, phrase := range phrases {
+		if strings.Contains(text, phrase) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,203 @@
+package gemini
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"gemini-wrapper/logging"
+	"gemini-wrapper/service/execution"
+)
+
+// PoolStats reports how many backend workers exist, how many are running a
+// request and how many requests are waiting for a free worker.
+type PoolStats struct {
+	Size              int     `json:"size"`
+	Busy              int     `json:"busy"`
+	Waiting           int     `json:"waiting"`
+	QueueLimit        int     `json:"queueLimit"`
+	OldestWaitSeconds float64 `json:"oldestWaitSeconds"`
+}
+
+// QueueFullError is returned when every worker is busy and the wait queue is
+// at its limit. Position is where the rejected request would have queued.
+type QueueFullError struct {
+	Position int
+	Limit    int
+}
+
+func (e *QueueFullError) Error() string {
+	return fmt.Sprintf("request queue is full: position %d exceeds queue limit %d", e.Position, e.Limit)
+}
+
+// workerPool caps the number of concurrent backend calls. Each headless
+// request starts its own CLI process, so without a cap a burst of clients
+// would fork an unbounded number of Node.js processes. Callers beyond
+// maxWaiting are rejected instead of queueing indefinitely. A freed worker
+// goes to the waiting caller of the highest priority, the oldest first.
+type workerPool struct {
+	size       int
+	maxWaiting int
+
+	mu      sync.Mutex
+	busy    int
+	waiting map[uint64]*poolWaiter
+	nextID  uint64
+}
+
+// poolWaiter is a queued caller. Closing granted hands it a worker; closing
+// dropped makes it give up with ErrQueueCleared.
+type poolWaiter struct {
+	since     time.Time
+	priority  int
+	requestID string
+	client    string
+	granted   chan struct{}
+	dropped   chan struct{}
+}
+
+// QueuedRequest is a question waiting for a free worker.
+type QueuedRequest struct {
+	RequestID   string  `json:"requestId,omitempty"`
+	Client      string  `json:"client,omitempty"`
+	Priority    string  `json:"priority"`
+	WaitSeconds float64 `json:"waitSeconds"`
+}
+
+func newWorkerPool(size, maxWaiting int) *workerPool {
+	if size <= 0 {
+		size = 1
+	}
+	return &workerPool{size: size, maxWaiting: maxWaiting, waiting: map[uint64]*poolWaiter{}}
+}
+
+// acquire blocks until a worker is free and returns the function that frees it.
+// It gives up with ctx.Err() if ctx is cancelled first and with a
+// *QueueFullError if the queue is at its limit, and with ErrQueueCleared
+// when clear drops it from the queue. A nil pool does not limit concurrency.
+func (p *workerPool) acquire(ctx context.Context, priority int) (func(), error) {
+	if p == nil {
+		return func() {}, nil
+	}
+
+	p.mu.Lock()
+	if p.busy < p.size {
+		p.busy++
+		p.mu.Unlock()
+		return p.releaser(), nil
+	}
+	if p.maxWaiting > 0 && len(p.waiting) >= p.maxWaiting {
+		position := len(p.waiting) + 1
+		p.mu.Unlock()
+		return nil, &QueueFullError{Position: position, Limit: p.maxWaiting}
+	}
+	id := p.nextID
+	p.nextID++
+	waiter := &poolWaiter{since: time.Now(), priority: priority, requestID: logging.RequestID(ctx), client: execution.Client(ctx), granted: make(chan struct{}), dropped: make(chan struct{})}
+	p.waiting[id] = waiter
+	p.mu.Unlock()
+
+	select {
+	case <-waiter.granted:
+		return p.releaser(), nil
+	case <-ctx.Done():
+		p.mu.Lock()
+		_, queued := p.waiting[id]
+		delete(p.waiting, id)
+		p.mu.Unlock()
+		if !queued {
+			// The worker was handed over while ctx ended; pass it on.
+			p.releaser()()
+		}
+		return nil, ctx.Err()
+	case <-waiter.dropped:
+		return nil, ErrQueueCleared
+	}
+}
+
+func (p *workerPool) releaser() func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			if id, waiter, ok := p.next(); ok {
+				delete(p.waiting, id)
+				close(waiter.granted)
+				return
+			}
+			p.busy--
+		})
+	}
+}
+
+// next returns the waiter that gets the next free worker. p.mu must be held.
+func (p *workerPool) next() (uint64, *poolWaiter, bool) {
+	var nextID uint64
+	var next *poolWaiter
+	for id, waiter := range p.waiting {
+		if next == nil || waiter.priority > next.priority || (waiter.priority == next.priority && id < nextID) {
+			nextID, next = id, waiter
+		}
+	}
+	return nextID, next, next != nil
+}
+
+func (p *workerPool) stats() PoolStats {
+	if p == nil {
+		return PoolStats{}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats := PoolStats{Size: p.size, Busy: p.busy, Waiting: len(p.waiting), QueueLimit: p.maxWaiting}
+	now := time.Now()
+	for _, waiter := range p.waiting {
+		stats.OldestWaitSeconds = max(stats.OldestWaitSeconds, now.Sub(waiter.since).Seconds())
+	}
+	return stats
+}
+
+// queued lists the queued callers in the order they get a worker.
+func (p *workerPool) queued() []QueuedRequest {
+	if p == nil {
+		return []QueuedRequest{}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ids := make([]uint64, 0, len(p.waiting))
+	for id := range p.waiting {
+		ids = append(ids, id)
+	}
+	slices.SortFunc(ids, func(a, b uint64) int {
+		if pa, pb := p.waiting[a].priority, p.waiting[b].priority; pa != pb {
+			return pb - pa
+		}
+		return cmp.Compare(a, b)
+	})
+	now := time.Now()
+	queued := make([]QueuedRequest, 0, len(ids))
+	for _, id := range ids {
+		waiter := p.waiting[id]
+		queued = append(queued, QueuedRequest{RequestID: waiter.requestID, Client: waiter.client, Priority: priorityClass(waiter.priority), WaitSeconds: now.Sub(waiter.since).Seconds()})
+	}
+	return queued
+}
+
+// clear drops every queued caller and returns how many there were. Callers
+// that already hold a worker are not affected.
+func (p *workerPool) clear() int {
+	if p == nil {
+		return 0
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	cleared := len(p.waiting)
+	for id, waiter := range p.waiting {
+		close(waiter.dropped)
+		delete(p.waiting, id)
+	}
+	return cleared
+}
@@ -0,0 +1,37 @@
+package gemini
+
+import "gemini-wrapper/service/postprocess"
+
+// SetPostprocessor installs the filters answers pass through before they are
+// returned. Answers are cached unfiltered, so requests that opt out still get
+// the original text. Call it before serving requests; nil disables
+// post-processing.
+func (s *GeminiService) SetPostprocessor(pipeline *postprocess.Pipeline) {
+	s.postprocessor = pipeline
+}
+
+// postprocessStream wraps onChunk so streamed chunks pass through the filters.
+// Chunks filtered down to nothing are not sent.
+func (s *GeminiService) postprocessStream(optOut bool, onChunk func(chunk string) error) func(chunk string) error {
+	if s.postprocessor == nil {
+		return onChunk
+	}
+	filter := s.postprocessor.Stream(optOut)
+	return func(chunk string) error {
+		if chunk = filter(chunk); chunk == "" {
+			return nil
+		}
+		return onChunk(chunk)
+	}
+}
+
+// formatStream wraps onChunk so streamed chunks are converted by format.
+// Chunks converted to nothing, like an unfinished line, are not sent.
+func formatStream(format func(chunk string) string, onChunk func(chunk string) error) func(chunk string) error {
+	return func(chunk string) error {
+		if chunk = format(chunk); chunk == "" {
+			return nil
+		}
+		return onChunk(chunk)
+	}
+}
@@ -0,0 +1,88 @@
+package gemini
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"gemini-wrapper/model"
+	"gemini-wrapper/service/execution"
+)
+
+// priorityLevels ranks the priority classes for the worker queue.
+var priorityLevels = map[string]int{
+	model.PriorityLow:    0,
+	model.PriorityNormal: 1,
+	model.PriorityHigh:   2,
+}
+
+// priorityAliases name the classes after the traffic they are meant for.
+var priorityAliases = map[string]string{
+	"interactive": model.PriorityHigh,
+	"batch":       model.PriorityLow,
+	"background":  model.PriorityLow,
+}
+
+// parsePriority returns the class raw names, accepting aliases and any case.
+// "" is normal.
+func parsePriority(raw string) (string, error) {
+	class := strings.ToLower(strings.TrimSpace(raw))
+	if class == "" {
+		return model.PriorityNormal, nil
+	}
+	if alias, ok := priorityAliases[class]; ok {
+		class = alias
+	}
+	if _, ok := priorityLevels[class]; !ok {
+		return "", fmt.Errorf("invalid priority %q (expected high, normal or low)", raw)
+	}
+	return class, nil
+}
+
+// parseClientPriorities keeps the entries of raw with a valid class.
+func parseClientPriorities(raw map[string]string) map[string]string {
+	priorities := map[string]string{}
+	for client, class := range raw {
+		parsed, err := parsePriority(class)
+		if err != nil {
+			slog.Warn("client priority ignored", "client", client, "error", err)
+			continue
+		}
+		priorities[strings.TrimSpace(client)] = parsed
+	}
+	return priorities
+}
+
+// resolvePriority replaces the priority requested in opts with the class the
+// request queues with: the requested one, else the default of its client.
+func (s *GeminiService) resolvePriority(ctx context.Context, opts model.AskOptions) (model.AskOptions, *model.GeminiStatus, error) {
+	requested := opts.Priority
+	if strings.TrimSpace(requested) == "" {
+		requested = s.clientPriorities[execution.Client(ctx)]
+	}
+	class, err := parsePriority(requested)
+	if err != nil {
+		return opts, &model.GeminiStatus{HTTPStatus: http.StatusBadRequest, Message: err.Error()}, err
+	}
+	opts.Priority = class
+	return opts, nil, nil
+}
+
+// priorityClass is the class ranked level.
+func priorityClass(level int) string {
+	for class, l := range priorityLevels {
+		if l == level {
+			return class
+		}
+	}
+	return model.PriorityNormal
+}
+
+func priorityLevel(class string) int {
+	if level, ok := priorityLevels[class]; ok {
+		return level
+	}
+	return priorityLevels[model.PriorityNormal]
+}
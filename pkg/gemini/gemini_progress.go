@@ -0,0 +1,164 @@
+package gemini
+
+import (
+	"context"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"gemini-wrapper/model"
+)
+
+var (
+	// toolLine matches the lines the CLI prints on stderr when it calls a
+	// tool, such as "Executing tool: read_file".
+	toolLine = regexp.MustCompile(`(?i)\b(?:tool call|executing tool|calling tool|running tool)\s*:?\s*"?([A-Za-z_][\w.-]*)`)
+	// toolErrorLine matches the line of a failed tool call, such as
+	// "Error executing tool run_shell_command: ...".
+	toolErrorLine = regexp.MustCompile(`(?i)\berror executing tool\s*:?\s*"?([A-Za-z_][\w.-]*)`)
+)
+
+// Progress follows a streamed answer while it is produced: how long it has
+// run, what the CLI is doing and how much of the answer went out. Handlers
+// read it for the heartbeats they send while the stream is quiet.
+type Progress struct {
+	mu      sync.Mutex
+	started time.Time
+	phase   string
+	tool    string
+	chars   int
+}
+
+type progressKey struct{}
+
+// WithProgress returns a context whose streamed answers report to the
+// returned Progress.
+func WithProgress(ctx context.Context) (context.Context, *Progress) {
+	p := &Progress{started: time.Now(), phase: model.ProgressWaiting}
+	return context.WithValue(ctx, progressKey{}, p), p
+}
+
+// progressFrom returns the Progress of ctx, or nil. A nil Progress ignores
+// every report.
+func progressFrom(ctx context.Context) *Progress {
+	p, _ := ctx.Value(progressKey{}).(*Progress)
+	return p
+}
+
+// Snapshot returns the progress so far.
+func (p *Progress) Snapshot() model.StreamProgress {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	snapshot := model.StreamProgress{
+		Phase:          p.phase,
+		ElapsedSeconds: time.Since(p.started).Round(100 * time.Millisecond).Seconds(),
+		Tool:           p.tool,
+	}
+	if p.chars > 0 {
+		snapshot.Tokens = (p.chars + 3) / 4
+	}
+	return snapshot
+}
+
+// running records that the backend started working on the answer.
+func (p *Progress) running() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.phase == model.ProgressWaiting {
+		p.phase = model.ProgressThinking
+	}
+}
+
+func (p *Progress) setTool(name string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.phase, p.tool = model.ProgressTool, name
+}
+
+// chunks wraps onChunk to count what it is sent.
+func (p *Progress) chunks(onChunk func(chunk string) error) func(chunk string) error {
+	if p == nil {
+		return onChunk
+	}
+	return func(chunk string) error {
+		p.mu.Lock()
+		p.phase, p.tool = model.ProgressAnswering, ""
+		p.chars += utf8.RuneCountInString(chunk)
+		p.mu.Unlock()
+		return onChunk(chunk)
+	}
+}
+
+// toolWatcher counts the tool calls the CLI reports on stderr and reports
+// them to a Progress, if any. Read events once the CLI has exited.
+type toolWatcher struct {
+	progress *Progress
+	partial  string
+	calls    map[string]int
+	failures map[string]int
+}
+
+func newToolWatcher(progress *Progress) *toolWatcher {
+	return &toolWatcher{progress: progress, calls: map[string]int{}, failures: map[string]int{}}
+}
+
+func (w *toolWatcher) Write(p []byte) (int, error) {
+	text := w.partial + string(p)
+	// Progress updates may end in a lone carriage return.
+	end := strings.LastIndexAny(text, "\r\n")
+	if end < 0 {
+		// Keep a bounded tail of a line that is still being printed.
+		w.partial = text[max(len(text)-maxConsoleLine, 0):]
+		return len(p), nil
+	}
+	for _, line := range strings.FieldsFunc(text[:end], func(r rune) bool { return r == '\r' || r == '\n' }) {
+		if match := toolErrorLine.FindStringSubmatch(line); match != nil {
+			w.failed(match[1])
+		} else if match := toolLine.FindStringSubmatch(line); match != nil {
+			w.called(match[1])
+		}
+	}
+	w.partial = text[end+1:]
+	return len(p), nil
+}
+
+// called records a call of the tool name, as the CLI starts it.
+func (w *toolWatcher) called(name string) {
+	w.calls[name]++
+	w.progress.setTool(name)
+}
+
+func (w *toolWatcher) failed(name string) {
+	w.failures[name]++
+}
+
+// events returns the calls seen by tool name. A failure the CLI reported
+// without announcing the call counts as a call too.
+func (w *toolWatcher) events() []model.ToolEvent {
+	names := map[string]struct{}{}
+	for name := range w.calls {
+		names[name] = struct{}{}
+	}
+	for name := range w.failures {
+		names[name] = struct{}{}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	events := make([]model.ToolEvent, 0, len(names))
+	for name := range names {
+		calls, failed := max(w.calls[name], w.failures[name]), w.failures[name]
+		events = append(events, model.ToolEvent{Name: name, Calls: calls, Succeeded: calls - failed, Failed: failed})
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].Name < events[j].Name })
+	return events
+}
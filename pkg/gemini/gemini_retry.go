@@ -0,0 +1,80 @@
+package gemini
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"gemini-wrapper/metrics"
+	"gemini-wrapper/model"
+)
+
+// RetryConfig controls how often one model is retried after a transient
+// upstream error (429, 500, 502, 503 or 504 detected in the CLI output)
+// before the error is surfaced or the next fallback model is tried.
+type RetryConfig struct {
+	// MaxRetries is the number of retries after the first attempt. 0 disables retries.
+	MaxRetries     int           `yaml:"max_retries"`
+	InitialBackoff time.Duration `yaml:"initial_backoff"`
+	MaxBackoff     time.Duration `yaml:"max_backoff"`
+	// Budget caps the time spent on one model including backoff. 0 means no cap.
+	Budget time.Duration `yaml:"budget"`
+}
+
+// isTransientUpstreamError reports whether a failed attempt may succeed when
+// repeated. A full local queue is not an upstream problem and is never retried.
+func isTransientUpstreamError(err error, status *model.GeminiStatus) bool {
+	var queueErr *QueueFullError
+	if err == nil || errors.As(err, &queueErr) || status == nil {
+		return false
+	}
+	switch status.HTTPStatus {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// withRetry runs attempt until it succeeds, fails permanently or the retry
+// policy is exhausted. canRetry can veto a retry, e.g. once a stream has sent
+// output. The backoff sleep does not hold a pool worker.
+func (s *GeminiService) withRetry(ctx context.Context, attempt func() (string, *model.GeminiStatus, error), canRetry func() bool) (string, *model.GeminiStatus, error) {
+	policy := s.retry
+	start := time.Now()
+	backoff := policy.InitialBackoff
+	for retries := 0; ; retries++ {
+		answer, status, err := attempt()
+		if err == nil || retries >= policy.MaxRetries || !isTransientUpstreamError(err, status) || !canRetry() {
+			return answer, withStatusRetries(status, retries), err
+		}
+		if policy.Budget > 0 && time.Since(start)+backoff > policy.Budget {
+			slog.WarnContext(ctx, "retry budget exhausted", "retries", retries, "budget", policy.Budget)
+			return answer, withStatusRetries(status, retries), err
+		}
+
+		slog.WarnContext(ctx, "transient upstream error; retrying", "retry", retries+1, "max_retries", policy.MaxRetries, "backoff", backoff, "http_status", status.HTTPStatus, "error", err)
+		metrics.UpstreamRetries.Inc()
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return "", withStatusRetries(status, retries), ctx.Err()
+		case <-timer.C:
+		}
+		backoff = min(backoff*2, policy.MaxBackoff)
+	}
+}
+
+func withStatusRetries(status *model.GeminiStatus, retries int) *model.GeminiStatus {
+	if retries == 0 {
+		return status
+	}
+	if status == nil {
+		status = &model.GeminiStatus{}
+	}
+	status.Retries = retries
+	return status
+}
@@ -0,0 +1,200 @@
+package gemini
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"gemini-wrapper/model"
+)
+
+const (
+	defaultSelfTestPrompt   = `Reply with the single word "pong".`
+	defaultSelfTestTimeout  = 60 * time.Second
+	defaultSelfTestInterval = 5 * time.Minute
+)
+
+// SelfTestConfig asks the CLI a question once it starts: a CLI that prints
+// its version can still fail to answer, for example without credentials.
+// Until an answer comes back, /readyz reports the service as not ready.
+// The same prompt answers /api/selftest, at most once per Interval.
+type SelfTestConfig struct {
+	Enabled  bool          `yaml:"enabled"`
+	Prompt   string        `yaml:"prompt"`
+	Timeout  time.Duration `yaml:"timeout"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+// SelfTestResult is the outcome of the self-test. With an API key pool every
+// key is asked in parallel, and the self-test passes once one of them
+// answers.
+type SelfTestResult struct {
+	Passed    bool              `json:"passed"`
+	RunAt     *time.Time        `json:"runAt,omitempty"`
+	LatencyMs int64             `json:"latencyMs"`
+	Error     string            `json:"error,omitempty"`
+	Accounts  []SelfTestAccount `json:"accounts,omitempty"`
+	// Cached reports a result of /api/selftest from an earlier run.
+	Cached bool `json:"cached,omitempty"`
+}
+
+// SelfTestAccount is the self-test of one key of the API key pool.
+type SelfTestAccount struct {
+	Bucket    string `json:"bucket"`
+	Passed    bool   `json:"passed"`
+	LatencyMs int64  `json:"latencyMs"`
+	Error     string `json:"error,omitempty"`
+}
+
+// selfTest runs the self-test until it passed once, after the probe of the
+// backend succeeded.
+type selfTest struct {
+	cfg SelfTestConfig
+
+	mu     sync.Mutex
+	result SelfTestResult
+}
+
+func newSelfTest(cfg SelfTestConfig) *selfTest {
+	if !cfg.Enabled {
+		return nil
+	}
+	return &selfTest{cfg: cfg}
+}
+
+// passed reports whether the self-test is off or passed.
+func (t *selfTest) passed() bool {
+	if t == nil {
+		return true
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.result.Passed
+}
+
+// snapshot returns the latest result, or nil when the self-test is off.
+func (t *selfTest) snapshot() *SelfTestResult {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	result := t.result
+	result.Accounts = append([]SelfTestAccount(nil), t.result.Accounts...)
+	return &result
+}
+
+// runSelfTest asks the self-test prompt with every CLI account unless the
+// self-test is off or passed already.
+func (s *GeminiService) runSelfTest() error {
+	test := s.selfTest
+	if test.passed() {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(s.lifetime(), test.cfg.Timeout)
+	defer cancel()
+
+	start := time.Now()
+	var keys []*poolKey
+	if s.keys != nil {
+		keys = s.keys.keys
+	}
+	result := SelfTestResult{RunAt: &start}
+	var err error
+	if len(keys) == 0 {
+		err = s.askSelfTest(ctx)
+	} else {
+		result.Accounts = make([]SelfTestAccount, len(keys))
+		var wg sync.WaitGroup
+		for i, key := range keys {
+			wg.Go(func() {
+				keyStart := time.Now()
+				err := s.askSelfTest(context.WithValue(ctx, apiKeyContextKey{}, key))
+				account := SelfTestAccount{Bucket: key.bucket, Passed: err == nil, LatencyMs: time.Since(keyStart).Milliseconds()}
+				if err != nil {
+					account.Error = err.Error()
+				}
+				result.Accounts[i] = account
+			})
+		}
+		wg.Wait()
+		var errs []error
+		for _, account := range result.Accounts {
+			if account.Passed {
+				errs = nil
+				break
+			}
+			errs = append(errs, fmt.Errorf("%s: %s", account.Bucket, account.Error))
+		}
+		err = errors.Join(errs...)
+	}
+	result.LatencyMs = time.Since(start).Milliseconds()
+	result.Passed = err == nil
+	if err != nil {
+		result.Error = err.Error()
+		slog.Warn("gemini self-test failed", "error", err, "latency_ms", result.LatencyMs)
+	} else {
+		slog.Info("gemini self-test passed", "latency_ms", result.LatencyMs)
+	}
+
+	test.mu.Lock()
+	test.result = result
+	test.mu.Unlock()
+	return err
+}
+
+// endToEndTest is the self-test of /api/selftest. Its result is kept for
+// an interval so monitoring systems can poll it without spending quota.
+type endToEndTest struct {
+	cfg SelfTestConfig
+
+	mu   sync.Mutex
+	last *SelfTestResult
+}
+
+// SelfTestEndToEnd asks the self-test prompt through the whole pipeline of
+// AskWithOptions, bypassing the answer cache, and returns the result. A
+// result younger than the interval is returned instead, passed or not, and
+// callers arriving during a run wait for it.
+func (s *GeminiService) SelfTestEndToEnd(ctx context.Context) SelfTestResult {
+	test := s.endToEnd
+	test.mu.Lock()
+	defer test.mu.Unlock()
+	if test.last != nil && time.Since(*test.last.RunAt) < test.cfg.Interval {
+		result := *test.last
+		result.Cached = true
+		return result
+	}
+
+	// A monitor that gives up must not cut the run short for the callers
+	// waiting on it.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), test.cfg.Timeout)
+	defer cancel()
+	start := time.Now()
+	answer, _, err := s.AskWithOptions(ctx, test.cfg.Prompt, model.AskOptions{NoCache: true})
+	if err == nil && strings.TrimSpace(answer) == "" {
+		err = errors.New("the self-test prompt got an empty answer")
+	}
+	result := SelfTestResult{Passed: err == nil, RunAt: &start, LatencyMs: time.Since(start).Milliseconds()}
+	if err != nil {
+		result.Error = err.Error()
+		slog.Warn("end-to-end self-test failed", "error", err, "latency_ms", result.LatencyMs)
+	}
+	test.last = &result
+	return result
+}
+
+func (s *GeminiService) askSelfTest(ctx context.Context) error {
+	answer, _, err := s.generateWithCLI(ctx, s.selfTest.cfg.Prompt, model.AskOptions{Model: s.defaultModel})
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(answer) == "" {
+		return errors.New("the self-test prompt got an empty answer")
+	}
+	return nil
+}
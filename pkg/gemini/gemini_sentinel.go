@@ -0,0 +1,71 @@
+package gemini
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"os/exec"
+	"strings"
+	"time"
+
+	"gemini-wrapper/pkg/terminal"
+)
+
+// sentinelExitGrace is how long the CLI may keep running after it printed
+// the sentinel, for example to flush telemetry, before it is killed.
+const sentinelExitGrace = 2 * time.Second
+
+// newSentinel returns a marker the model will not print by accident.
+func newSentinel() (string, error) {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "<<END-" + hex.EncodeToString(b) + ">>", nil
+}
+
+// sentinelPrompt asks the model to print sentinel once it has answered
+// question.
+func sentinelPrompt(question, sentinel string) string {
+	return question + "\n\nWhen your answer is complete, end it with a line containing only " + sentinel + " and nothing after it. Do not mention this marker otherwise."
+}
+
+// findSentinel looks for sentinel on the lines of screen from line from on.
+// It returns the line it is on and the text before it on that line.
+func findSentinel(screen *terminal.Screen, from int, sentinel string) (row int, before string, ok bool) {
+	for row = from; row < screen.Len(); row++ {
+		line := screen.Line(row)
+		if i := strings.Index(line, sentinel); i >= 0 {
+			return row, strings.TrimRight(line[:i], " "), true
+		}
+	}
+	return 0, "", false
+}
+
+// sentinelAnswer is the text of screen before the sentinel found on line row.
+func sentinelAnswer(screen *terminal.Screen, row int, before string) string {
+	lines := make([]string, 0, row+1)
+	for i := range row {
+		lines = append(lines, screen.Line(i))
+	}
+	lines = append(lines, before)
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+// stopAfterSentinel waits for the CLI to exit after it printed the
+// sentinel and kills it after sentinelExitGrace. The answer is complete by
+// then, so how the CLI exits does not matter.
+func stopAfterSentinel(cmd *exec.Cmd) {
+	done := make(chan struct{})
+	go func() {
+		_ = cmd.Wait()
+		close(done)
+	}()
+	timer := time.NewTimer(sentinelExitGrace)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		_ = cmd.Process.Kill()
+		<-done
+	}
+}
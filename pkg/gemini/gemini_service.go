@@ -0,0 +1,37 @@
+// Package gemini answers questions with the Gemini CLI. GeminiService runs
+// each question on a Backend, by default one headless CLI process per
+// attempt, and adds a worker pool, caching, deduplication, retries, a
+// circuit breaker and model fallback on top:
+//
+//	svc := gemini.NewGeminiServiceWithConfig(gemini.DefaultConfig())
+//	defer svc.Close()
+//	answer, status, err := svc.Ask(ctx, "What is 2+2?", "gemini-2.5-flash")
+//
+// Programs that answer some other way pass their Backend to
+// NewGeminiServiceWithBackend.
+package gemini
+
+import (
+	"context"
+
+	"gemini-wrapper/model"
+)
+
+// Asker is the question-answering API of GeminiService. The OpenAI adapter
+// and sessions depend on it instead of the concrete service, so programs
+// importing them can answer with their own implementation.
+type Asker interface {
+	// Ask answers question with modelName, or the default model when it is
+	// empty.
+	Ask(ctx context.Context, question string, modelName string) (string, *model.GeminiStatus, error)
+	// AskWithEnv is Ask with extra environment variables for the CLI
+	// process that answers.
+	AskWithEnv(question string, modelName string, env map[string]string) (string, *model.GeminiStatus, error)
+	// AskStream is Ask that also calls onChunk with each part of the answer
+	// as soon as it is known.
+	AskStream(ctx context.Context, question string, modelName string, onChunk func(chunk string) error) (string, *model.GeminiStatus, error)
+	// AskWithOptions is Ask with per-request settings.
+	AskWithOptions(ctx context.Context, question string, opts model.AskOptions) (string, *model.GeminiStatus, error)
+}
+
+var _ Asker = (*GeminiService)(nil)
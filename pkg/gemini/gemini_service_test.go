@@ -1,13 +1,13 @@
 package gemini
 
 import (
-	"gemini-wrapper/service/gemini/gemini_impl"
+	"context"
 	"os"
 	"testing"
 )
 
 func TestNewGeminiService(t *testing.T) {
-	service := gemini_impl.NewGeminiService()
+	service := NewGeminiService()
 	if service == nil {
 		t.Fatal("NewGeminiService returned nil")
 	}
@@ -19,10 +19,10 @@ func TestGeminiServiceAsk(t *testing.T) {
 		t.Skip("Skipping test: GEMINI_API_KEY not set")
 	}
 
-	service := gemini_impl.NewGeminiService()
+	service := NewGeminiService()
 
 	// Test with a simple question
-	answer, _, err := service.Ask("What is 2+2?", "")
+	answer, _, err := service.Ask(context.Background(), "What is 2+2?", "")
 	if err != nil {
 		t.Logf("Error asking Gemini: %v", err)
 		// Don't fail the test as it might be an environment issue
@@ -40,10 +40,10 @@ func TestGeminiServiceAskWithModel(t *testing.T) {
 		t.Skip("Skipping test: GEMINI_API_KEY not set")
 	}
 
-	service := gemini_impl.NewGeminiService()
+	service := NewGeminiService()
 
 	// Test with a specific model
-	answer, _, err := service.Ask("Hello", "gemini-3-flash")
+	answer, _, err := service.Ask(context.Background(), "Hello", "gemini-3-flash")
 	if err != nil {
 		t.Logf("Error asking Gemini with model: %v", err)
 		t.Skip("Skipping due to Gemini CLI error")
@@ -53,3 +53,16 @@ func TestGeminiServiceAskWithModel(t *testing.T) {
 		t.Error("Expected non-empty answer")
 	}
 }
+
+func TestSupportedModelsDefaultsAndEnv(t *testing.T) {
+	t.Setenv("GEMINI_MODELS", "")
+	if got := SupportedModels(); len(got) != len(DefaultModels) {
+		t.Fatalf("expected default models, got %v", got)
+	}
+
+	t.Setenv("GEMINI_MODELS", "[models/gemini-2.5-pro, gemini-3-flash, gemini-2.5-pro]")
+	got := SupportedModels()
+	if len(got) != 2 || got[0] != "gemini-2.5-pro" || got[1] != "gemini-3-flash" {
+		t.Fatalf("unexpected models from env: %v", got)
+	}
+}
@@ -0,0 +1,208 @@
+package gemini
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gemini-wrapper/logging"
+	"gemini-wrapper/model"
+)
+
+const (
+	defaultShadowLogPath     = "/app/cache/shadow.jsonl"
+	defaultShadowMaxInFlight = 2
+)
+
+// ShadowConfig also sends answered questions to a second backend or model
+// and logs both answers for offline comparison, for example before moving
+// from the CLI to the API or from a flash to a pro model. Clients only ever
+// get the primary answer; the shadow runs after it in the background.
+type ShadowConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Backend is "headless", "api" or "mock"; empty keeps the primary one.
+	// The API backend authenticates with the key of api_fallback.
+	Backend string `yaml:"backend"`
+	// Model is asked instead of the model of the question; empty keeps it.
+	Model string `yaml:"model"`
+	// SampleRate is the share of questions mirrored, from 0 to 1.
+	SampleRate float64 `yaml:"sample_rate"`
+	// MaxInFlight bounds the shadow questions running at once; questions
+	// beyond it are not mirrored rather than queued.
+	MaxInFlight int    `yaml:"max_in_flight"`
+	LogPath     string `yaml:"log_path"`
+}
+
+// ShadowEntry is one line of the shadow log.
+type ShadowEntry struct {
+	Time      time.Time    `json:"time"`
+	RequestID string       `json:"requestId,omitempty"`
+	Question  string       `json:"question"`
+	Primary   ShadowAnswer `json:"primary"`
+	Shadow    ShadowAnswer `json:"shadow"`
+	// Identical reports whether both answers are the same, ignoring
+	// surrounding whitespace.
+	Identical bool `json:"identical"`
+}
+
+// ShadowAnswer is the answer of one side of a shadow comparison.
+type ShadowAnswer struct {
+	Backend   string `json:"backend"`
+	Model     string `json:"model,omitempty"`
+	Answer    string `json:"answer"`
+	LatencyMs int64  `json:"latencyMs"`
+	Error     string `json:"error,omitempty"`
+}
+
+// shadow mirrors questions to its backend and appends the comparisons to
+// its log.
+type shadow struct {
+	cfg     ShadowConfig
+	backend Backend
+	slots   chan struct{}
+	running sync.WaitGroup
+
+	mu  sync.Mutex
+	log *os.File
+}
+
+// newShadow returns nil when shadowing is off or its backend or log cannot
+// be set up; a shadow must never keep the service from starting.
+func newShadow(cfg Config, primary Backend) *shadow {
+	if !cfg.Shadow.Enabled || cfg.Shadow.SampleRate <= 0 {
+		return nil
+	}
+	backend := primary
+	switch cfg.Shadow.Backend {
+	case "":
+	case backendAPI:
+		if strings.TrimSpace(cfg.APIFallback.APIKey) == "" {
+			slog.Warn("shadow traffic disabled: the api backend needs the key of api_fallback")
+			return nil
+		}
+		backend = newAPIBackend(cfg.APIFallback, cfg.CLIHome)
+	default:
+		shadowCfg := cfg
+		shadowCfg.Backend = cfg.Shadow.Backend
+		backend = newBackend(shadowCfg)
+	}
+	if err := os.MkdirAll(filepath.Dir(cfg.Shadow.LogPath), 0o755); err != nil {
+		slog.Warn("shadow traffic disabled", "error", err)
+		return nil
+	}
+	log, err := os.OpenFile(cfg.Shadow.LogPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		slog.Warn("shadow traffic disabled", "error", err)
+		return nil
+	}
+	slog.Info("shadow traffic enabled", "backend", backend.Name(), "model", cfg.Shadow.Model, "sample_rate", cfg.Shadow.SampleRate, "log_path", cfg.Shadow.LogPath)
+	return &shadow{
+		cfg:     cfg.Shadow,
+		backend: backend,
+		slots:   make(chan struct{}, cfg.Shadow.MaxInFlight),
+		log:     log,
+	}
+}
+
+// mirror asks question again with the shadow backend in the background and
+// logs it next to the primary answer, which took latency. Failed primary
+// answers are mirrored too: a shadow that answers where the primary failed
+// is worth knowing about.
+func (s *GeminiService) mirror(ctx context.Context, question string, opts model.AskOptions, answer string, status *model.GeminiStatus, err error, latency time.Duration) {
+	sh := s.shadow
+	if sh == nil || s.lifetime().Err() != nil || rand.Float64() >= sh.cfg.SampleRate {
+		return
+	}
+	select {
+	case sh.slots <- struct{}{}:
+	default:
+		slog.Debug("shadow question skipped: too many in flight")
+		return
+	}
+
+	entry := ShadowEntry{
+		Time:      time.Now().UTC(),
+		RequestID: logging.RequestID(ctx),
+		Question:  question,
+		Primary: ShadowAnswer{
+			Backend:   s.activeBackend().Name(),
+			Model:     cmp.Or(opts.Model, s.defaultModel),
+			Answer:    answer,
+			LatencyMs: latency.Milliseconds(),
+		},
+	}
+	if status != nil {
+		entry.Primary.Backend = cmp.Or(status.Backend, entry.Primary.Backend)
+		entry.Primary.Model = cmp.Or(status.Model, entry.Primary.Model)
+	}
+	if err != nil {
+		entry.Primary.Error = err.Error()
+	}
+	opts.Model = cmp.Or(sh.cfg.Model, opts.Model)
+	// The shadow outlives the request, keeping its values (request ID), but
+	// not the service.
+	detached, stop := context.WithCancel(context.WithoutCancel(ctx))
+	unhook := context.AfterFunc(s.lifetime(), stop)
+
+	sh.running.Go(func() {
+		defer func() { <-sh.slots }()
+		defer unhook()
+		defer stop()
+		shadowCtx, cancel := s.withRequestTimeout(detached, opts.Timeout)
+		defer cancel()
+		start := time.Now()
+		answer, status, err := sh.backend.Generate(shadowCtx, question, opts)
+		entry.Shadow = ShadowAnswer{
+			Backend:   sh.backend.Name(),
+			Model:     cmp.Or(opts.Model, s.defaultModel),
+			Answer:    answer,
+			LatencyMs: time.Since(start).Milliseconds(),
+		}
+		if status != nil {
+			entry.Shadow.Model = cmp.Or(status.Model, entry.Shadow.Model)
+		}
+		if err != nil {
+			entry.Shadow.Error = err.Error()
+		}
+		entry.Identical = entry.Primary.Error == "" && entry.Shadow.Error == "" &&
+			strings.TrimSpace(entry.Primary.Answer) == strings.TrimSpace(entry.Shadow.Answer)
+		sh.write(entry)
+	})
+}
+
+func (sh *shadow) write(entry ShadowEntry) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		slog.Warn("shadow entry not logged", "error", err)
+		return
+	}
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if sh.log == nil {
+		return
+	}
+	if _, err := sh.log.Write(append(line, '\n')); err != nil {
+		slog.Warn("shadow entry not logged", "error", err)
+	}
+}
+
+// close waits for the shadow questions in flight, which end with the
+// service, and closes the log.
+func (sh *shadow) close() error {
+	if sh == nil {
+		return nil
+	}
+	sh.running.Wait()
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	err := sh.log.Close()
+	sh.log = nil
+	return err
+}
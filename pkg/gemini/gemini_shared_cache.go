@@ -0,0 +1,107 @@
+package gemini
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strings"
+	"time"
+
+	"gemini-wrapper/model"
+	"gemini-wrapper/service/cluster"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// sharedCacheTimeout bounds a Redis round trip of the answer cache; a slow
+// Redis counts as a miss.
+const sharedCacheTimeout = time.Second
+
+// SetSharedCache adds Redis as a cache layer behind memory and disk, so an
+// answer cached by one replica is a hit on every other. Call it before
+// serving requests; nil keeps the cache local.
+func (s *GeminiService) SetSharedCache(shared *cluster.Cluster) {
+	s.sharedCache = shared
+}
+
+func (s *GeminiService) getSharedCached(key string, now time.Time) (string, *model.GeminiStatus, time.Time, bool) {
+	if s.sharedCache == nil {
+		return "", nil, time.Time{}, false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), sharedCacheTimeout)
+	defer cancel()
+	raw, err := s.sharedCache.Client().Get(ctx, s.sharedCache.Key("cache", key)).Bytes()
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			slog.Warn("shared cache lookup failed", "error", err)
+		}
+		return "", nil, time.Time{}, false
+	}
+	var record diskCacheRecord
+	if err := json.Unmarshal(raw, &record); err != nil || record.ExpiresAtUnix <= now.Unix() {
+		return "", nil, time.Time{}, false
+	}
+	var status *model.GeminiStatus
+	if len(record.StatusJSON) > 0 {
+		var parsed model.GeminiStatus
+		if err := json.Unmarshal(record.StatusJSON, &parsed); err == nil {
+			status = &parsed
+		}
+	}
+	return record.Answer, status, time.Unix(record.ExpiresAtUnix, 0), true
+}
+
+func (s *GeminiService) setSharedCached(key, answer string, status *model.GeminiStatus, expiresAt time.Time) {
+	if s.sharedCache == nil || strings.TrimSpace(answer) == "" {
+		return
+	}
+	record := diskCacheRecord{Answer: answer, ExpiresAtUnix: expiresAt.Unix()}
+	if status != nil {
+		if b, err := json.Marshal(status); err == nil {
+			record.StatusJSON = b
+		}
+	}
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), sharedCacheTimeout)
+	defer cancel()
+	if err := s.sharedCache.Client().Set(ctx, s.sharedCache.Key("cache", key), payload, time.Until(expiresAt)).Err(); err != nil {
+		slog.Warn("shared cache write failed", "error", err)
+	}
+}
+
+// purgeSharedCache deletes every answer in Redis and returns how many there
+// were.
+func (s *GeminiService) purgeSharedCache() (int, error) {
+	if s.sharedCache == nil {
+		return 0, nil
+	}
+	ctx := context.Background()
+	client := s.sharedCache.Client()
+	purged := 0
+	iter := client.Scan(ctx, 0, s.sharedCache.Key("cache", "*"), 500).Iterator()
+	var batch []string
+	for iter.Next(ctx) {
+		batch = append(batch, iter.Val())
+		if len(batch) == 500 {
+			if err := client.Del(ctx, batch...).Err(); err != nil {
+				return purged, err
+			}
+			purged += len(batch)
+			batch = batch[:0]
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return purged, err
+	}
+	if len(batch) > 0 {
+		if err := client.Del(ctx, batch...).Err(); err != nil {
+			return purged, err
+		}
+		purged += len(batch)
+	}
+	return purged, nil
+}
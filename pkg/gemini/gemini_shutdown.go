@@ -0,0 +1,80 @@
+package gemini
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+)
+
+// ErrServiceClosed is returned for questions asked after Close.
+var ErrServiceClosed = errors.New("gemini service is shutting down")
+
+// track ties a backend call to the service lifetime: the returned context is
+// cancelled by Close, which also waits for done to be called.
+func (s *GeminiService) track(ctx context.Context) (context.Context, func(), error) {
+	if s.shutdownCtx == nil {
+		return ctx, func() {}, nil
+	}
+	s.closeMu.Lock()
+	if s.closed {
+		s.closeMu.Unlock()
+		return nil, nil, ErrServiceClosed
+	}
+	s.running.Add(1)
+	s.closeMu.Unlock()
+
+	ctx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(s.shutdownCtx, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+		s.running.Done()
+	}, nil
+}
+
+// lifetime returns the context cancelled by Close.
+func (s *GeminiService) lifetime() context.Context {
+	if s.shutdownCtx == nil {
+		return context.Background()
+	}
+	return s.shutdownCtx
+}
+
+// Close interrupts the CLI processes that are still running, waits for them to
+// exit and releases the disk cache. Call it once the HTTP server has drained;
+// new questions fail with ErrServiceClosed afterwards.
+func (s *GeminiService) Close() error {
+	if s == nil || s.shutdownCtx == nil {
+		return nil
+	}
+	s.closeMu.Lock()
+	if s.closed {
+		s.closeMu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.closeMu.Unlock()
+	s.shutdown()
+
+	// Interrupted processes are killed after cliInterruptGrace, so this wait
+	// is bounded unless a backend ignores its context.
+	done := make(chan struct{})
+	go func() {
+		s.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(cliInterruptGrace + time.Second):
+		slog.Warn("backend calls still running after shutdown")
+	}
+	if err := s.shadow.close(); err != nil {
+		slog.Warn("shadow log not closed", "error", err)
+	}
+
+	if s.diskDB != nil {
+		return s.diskDB.Close()
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package gemini
+
+import (
+	"slices"
+	"time"
+
+	"gemini-wrapper/model"
+)
+
+// completeStatus returns a copy of status with the fields every answer
+// reports, for the caller to change freely: a status may be shared by
+// the requests an identical question answered.
+func (s *GeminiService) completeStatus(status *model.GeminiStatus, opts model.AskOptions) *model.GeminiStatus {
+	status = cloneGeminiStatus(status)
+	if status == nil {
+		status = &model.GeminiStatus{}
+	}
+	if status.Backend == "" {
+		status.Backend = s.activeBackend().Name()
+	}
+	if status.Model == "" {
+		status.Model = opts.Model
+	}
+	status.SessionID = opts.SessionID
+	return status
+}
+
+// withStatusTimings reports how long an attempt waited for the pacer and a
+// worker, and how long the backend took to answer.
+func withStatusTimings(status *model.GeminiStatus, queueWait, generation time.Duration) *model.GeminiStatus {
+	if status == nil {
+		status = &model.GeminiStatus{}
+	}
+	status.QueueWaitMs = queueWait.Milliseconds()
+	status.GenerationMs = generation.Milliseconds()
+	return status
+}
+
+// withStatusDegraded flags status with one of the model.Degraded constants.
+func withStatusDegraded(status *model.GeminiStatus, flag string) *model.GeminiStatus {
+	if status == nil {
+		status = &model.GeminiStatus{}
+	}
+	if !slices.Contains(status.Degraded, flag) {
+		status.Degraded = append(status.Degraded, flag)
+	}
+	return status
+}
+
+// coalescedStatus is the status of an answer generated for an identical
+// question asked at the same time. Every caller gets a copy of its own.
+func coalescedStatus(status *model.GeminiStatus) *model.GeminiStatus {
+	if status == nil {
+		return &model.GeminiStatus{Coalesced: true}
+	}
+	status = cloneGeminiStatus(status)
+	status.Coalesced = true
+	return status
+}
+
+// cachedStatus marks the status of a cached answer, whose timings were
+// those of the question that filled the cache.
+func cachedStatus(status *model.GeminiStatus) *model.GeminiStatus {
+	if status == nil {
+		status = &model.GeminiStatus{}
+	}
+	status.Cached = true
+	status.QueueWaitMs, status.GenerationMs = 0, 0
+	return status
+}
@@ -0,0 +1,388 @@
+package gemini
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os/exec"
+	"strings"
+	"time"
+
+	"gemini-wrapper/model"
+	"gemini-wrapper/pkg/parser"
+	"gemini-wrapper/pkg/terminal"
+	"gemini-wrapper/service/postprocess"
+)
+
+// AskStream sends a question to Gemini CLI and calls onChunk for every answer
+// line as soon as the CLI has printed it. The full answer, as the CLI last drew
+// it, is returned once the CLI exits.
+func (s *GeminiService) AskStream(ctx context.Context, question string, modelName string, onChunk func(chunk string) error) (string, *model.GeminiStatus, error) {
+	return s.AskStreamWithOptions(ctx, question, model.AskOptions{Model: modelName}, onChunk)
+}
+
+// AskStreamWithOptions is AskStream with per-request settings. The answer
+// is reported to the Progress of ctx, if any.
+func (s *GeminiService) AskStreamWithOptions(ctx context.Context, question string, opts model.AskOptions, onChunk func(chunk string) error) (string, *model.GeminiStatus, error) {
+	start := time.Now()
+	opts = applyTenant(ctx, opts)
+	ctx, cancel := s.withRequestTimeout(ctx, opts.Timeout)
+	defer cancel()
+	ctx, pending, finish := s.requests.begin(ctx)
+	defer finish()
+	send := pending.chunks(progressFrom(ctx).chunks(onChunk))
+	format, flush := postprocess.FormatStream(opts.Format)
+	answer, status, err := s.askStreamWithOptions(ctx, question, opts, s.postprocessStream(opts.SkipPostprocess, formatStream(format, send)))
+	if rest := flush(); err == nil && rest != "" {
+		err = send(rest)
+	}
+	if err != nil {
+		err = cancelCause(ctx, err)
+		status = s.completeStatus(s.failureStatus(err, status), opts)
+		auditAsk(ctx, start, question, opts, "", status, err)
+		return answer, status, err
+	}
+	answer = s.postprocessor.Apply(answer, opts.SkipPostprocess)
+	status = s.completeStatus(status, opts)
+	if opts.Artifacts {
+		status.Artifacts = postprocess.Artifacts(answer)
+	}
+	answer = postprocess.Format(answer, opts.Format)
+	auditAsk(ctx, start, question, opts, answer, status, nil)
+	return answer, status, nil
+}
+
+func (s *GeminiService) askStreamWithOptions(ctx context.Context, question string, opts model.AskOptions, onChunk func(chunk string) error) (string, *model.GeminiStatus, error) {
+	if status, err := s.checkModel(opts.Model); err != nil {
+		return "", status, err
+	}
+	opts, status, err := s.resolveExecution(ctx, opts)
+	if err != nil {
+		return "", status, err
+	}
+	if opts, status, err = s.resolvePriority(ctx, opts); err != nil {
+		return "", status, err
+	}
+	opts = s.resolveGrounding(opts)
+	structured, status, err := resolveStructuredOutput(opts)
+	if err != nil {
+		return "", status, err
+	}
+	reply, status, err := resolveReplyLanguage(question, opts)
+	if err != nil {
+		return "", status, err
+	}
+	question = strings.TrimSpace(question)
+	if reply != nil {
+		// Chunks are sent as they come, so a stream cannot be asked again
+		// in another language; it only gets the instruction.
+		question = reply.prompt(question)
+	}
+	question = systemPreamble(opts.System, question)
+	cacheKey := ""
+	if opts.WorkDir == "" && !opts.NoCache {
+		cacheKey = s.buildCacheKey(question, opts.Model, optionsVariant(opts))
+		answer, status, ok := s.getCached(cacheKey)
+		s.reportCache(ctx, ok)
+		if ok {
+			status = cachedStatus(status)
+			if err := onChunk(answer); err != nil {
+				return "", status, err
+			}
+			return answer, status, nil
+		}
+	}
+	if status, err := s.checkCircuit(); err != nil {
+		return "", status, err
+	}
+
+	generate := func(ctx context.Context, onChunk func(chunk string) error) (string, *model.GeminiStatus, error) {
+		start := time.Now()
+		if structured != nil {
+			answer, status, err := s.streamStructured(ctx, question, opts, structured, cacheKey, onChunk)
+			s.mirror(ctx, question, opts, answer, status, err, time.Since(start))
+			return answer, status, err
+		}
+		answer, status, err := s.streamWithFallback(ctx, question, opts, cacheKey, onChunk)
+		s.recordCircuit(ctx, err)
+		s.mirror(ctx, question, opts, answer, status, err, time.Since(start))
+		return answer, status, err
+	}
+	if !s.dedupeEnabled || cacheKey == "" {
+		return generate(ctx, onChunk)
+	}
+	return s.coalesceStream(ctx, s.coalesceKey(question, opts), onChunk, generate)
+}
+
+// streamStructured sends structured output as a single chunk once it has
+// been validated, since partial JSON is of no use and a repair replaces the
+// whole answer.
+func (s *GeminiService) streamStructured(ctx context.Context, question string, opts model.AskOptions, out *structuredOutput, cacheKey string, onChunk func(chunk string) error) (string, *model.GeminiStatus, error) {
+	answer, status, err := s.askValidated(ctx, question, opts, out)
+	if err != nil {
+		return "", status, err
+	}
+	if cacheKey != "" {
+		s.setCached(cacheKey, answer, status)
+	}
+	if err := onChunk(answer); err != nil {
+		return "", status, err
+	}
+	return answer, status, nil
+}
+
+// streamWithFallback caches the answer under cacheKey unless it is empty.
+func (s *GeminiService) streamWithFallback(ctx context.Context, question string, opts model.AskOptions, cacheKey string, onChunk func(chunk string) error) (string, *model.GeminiStatus, error) {
+	attemptModels := s.buildAttemptModels(opts.Model)
+	for i, attemptModel := range attemptModels {
+		if i == 0 {
+			slog.InfoContext(ctx, "streaming question", "question", question, "model", printableModel(attemptModel))
+		} else {
+			slog.InfoContext(ctx, "retrying stream with fallback model", "attempt", i, "fallbacks", len(attemptModels)-1, "model", printableModel(attemptModel))
+		}
+
+		streamed := false
+		attemptOpts := opts
+		attemptOpts.Model = attemptModel
+		answer, status, err := s.withRetry(ctx, func() (string, *model.GeminiStatus, error) {
+			return s.stream(ctx, question, attemptOpts, func(chunk string) error {
+				streamed = true
+				return onChunk(chunk)
+			})
+		}, func() bool { return !streamed })
+		if err == nil {
+			if i > 0 {
+				status = withStatusDegraded(withStatusModel(status, attemptModel), model.DegradedFallbackModel)
+				slog.InfoContext(ctx, "fallback succeeded", "model", printableModel(attemptModel))
+			}
+			// Chunks past the output limit or a stop sequence were never sent.
+			answer, status = applyGenerationLimits(answer, status, opts)
+			status = withStatusCitations(status, opts, answer)
+			if cacheKey != "" {
+				s.setCached(cacheKey, answer, status)
+			}
+			return answer, status, nil
+		}
+
+		status = withStatusModel(status, attemptModel)
+		if ctx.Err() != nil {
+			return "", status, ctx.Err()
+		}
+		// Once output reached the client we cannot transparently switch models.
+		if streamed || i == len(attemptModels)-1 || !isRetryableModelError(err, status) {
+			return "", status, err
+		}
+		slog.WarnContext(ctx, "model failed with retriable error; moving to fallback model", "error", err)
+	}
+
+	return "", nil, fmt.Errorf("failed to process request")
+}
+
+// Stream runs the CLI with plain text output and forwards each line as it is
+// printed. With streamSentinel, the answer ends at the sentinel the CLI is
+// asked to print, so neither a CLI that lingers after answering nor a line
+// that only looks final decides where it ends. With streamJSON, it streams
+// the events of stream-json output instead.
+func (b headlessBackend) Stream(ctx context.Context, question string, opts model.AskOptions, onChunk func(chunk string) error) (string, *model.GeminiStatus, error) {
+	if b.streamJSON {
+		return b.streamEvents(ctx, question, opts, onChunk)
+	}
+	modelName := opts.Model
+	prompt, sentinel := streamPrompt(question, opts), ""
+	if b.streamSentinel {
+		var err error
+		if sentinel, err = newSentinel(); err != nil {
+			return "", nil, fmt.Errorf("failed to create the stream sentinel: %v", err)
+		}
+		prompt = sentinelPrompt(prompt, sentinel)
+	}
+	run, err := b.startStream(ctx, prompt, streamFormatText, opts)
+	if err != nil {
+		return "", nil, err
+	}
+	defer run.close()
+	cmd, patterns, prompts, tools := run.cmd, run.patterns, run.prompts, run.tools
+
+	// The CLI may redraw what it printed, so the answer is read off a
+	// terminal screen. Each line is streamed once the CLI moves past it;
+	// the returned answer is the screen as last drawn.
+	screen := terminal.NewScreen(0)
+	emitted := 0
+	emit := func(end int, final bool) error {
+		for ; emitted < end; emitted++ {
+			line := screen.Line(emitted)
+			if strings.TrimSpace(line) == "" || patterns.skipped(line) {
+				continue
+			}
+			if !final || emitted < end-1 {
+				line += "\n"
+			}
+			if err := onChunk(line); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	buf := make([]byte, 32<<10)
+	reader := run.stdout
+	sentinelRow, beforeSentinel, sawSentinel := 0, "", false
+	for !sawSentinel {
+		n, readErr := reader.Read(buf)
+		if n > 0 {
+			_, _ = screen.Write(buf[:n])
+			end := screen.CursorRow()
+			if sentinel != "" {
+				if sentinelRow, beforeSentinel, sawSentinel = findSentinel(screen, emitted, sentinel); sawSentinel {
+					end = sentinelRow
+				}
+			}
+			err := emit(end, false)
+			if err == nil && sawSentinel && strings.TrimSpace(beforeSentinel) != "" {
+				err = onChunk(beforeSentinel)
+			}
+			if err != nil {
+				_ = cmd.Process.Kill()
+				_ = cmd.Wait()
+				return "", nil, err
+			}
+		}
+		if readErr != nil && !sawSentinel {
+			if !errors.Is(readErr, io.EOF) {
+				_ = cmd.Process.Kill()
+				_ = cmd.Wait()
+				return "", nil, fmt.Errorf("failed to read gemini CLI output: %v", readErr)
+			}
+			break
+		}
+	}
+
+	if sawSentinel {
+		stopAfterSentinel(cmd)
+		if ctx.Err() != nil {
+			return "", nil, ctx.Err()
+		}
+		status := withStatusToolEvents(parser.UpstreamStatus(run.stderr.String(), nil), tools.events())
+		result := patterns.clean(sentinelAnswer(screen, sentinelRow, beforeSentinel))
+		if result == "" {
+			return "", status, fmt.Errorf("received empty response from gemini")
+		}
+		slog.InfoContext(ctx, "stream completed at sentinel", "model", printableModel(modelName), "chars", len(result))
+		return result, status, nil
+	}
+	if err := emit(screen.Len(), true); err != nil {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return "", nil, err
+	}
+
+	waitErr := cmd.Wait()
+	if ctx.Err() != nil {
+		return "", nil, ctx.Err()
+	}
+	stderrStr := run.stderr.String()
+	slog.DebugContext(ctx, "gemini CLI stream finished", "model", printableModel(modelName), "exit_error", waitErr, "stderr", stderrStr)
+	status := parser.UpstreamStatus(stderrStr, nil)
+	if err := prompts.prompted(); err != nil {
+		return "", status, err
+	}
+	if waitErr != nil {
+		if response, ok := parser.ParseOutput(stderrStr); ok {
+			status = parser.UpstreamStatus(stderrStr, &response)
+			if response.Error != nil {
+				return "", status, classifyUpstreamError(fmt.Errorf("gemini error: %s - %s", response.Error.Type, response.Error.Message), stderrStr, &response)
+			}
+		}
+		return "", status, classifyUpstreamError(fmt.Errorf("failed to execute gemini CLI: %v (output: %s)", waitErr, strings.TrimSpace(stderrStr)), stderrStr, nil)
+	}
+	if sentinel != "" {
+		slog.WarnContext(ctx, "gemini CLI exited without printing the stream sentinel; the answer may be incomplete", "model", printableModel(modelName))
+	}
+
+	result := patterns.clean(screen.String())
+	if result == "" {
+		return "", status, fmt.Errorf("received empty response from gemini")
+	}
+
+	status = withStatusToolEvents(status, tools.events())
+	slog.InfoContext(ctx, "stream completed", "model", printableModel(modelName), "chars", len(result))
+	return result, status, nil
+}
+
+// streamPrompt is question with the instructions the options ask for.
+func streamPrompt(question string, opts model.AskOptions) string {
+	prompt := question
+	if grounded(opts) {
+		prompt = groundingPrompt(prompt)
+	}
+	if includeThoughts(opts) {
+		prompt = thinkingPrompt(prompt)
+	}
+	return prompt
+}
+
+// streamRun is a CLI started by startStream.
+type streamRun struct {
+	cmd *exec.Cmd
+	// stdout is the CLI's output, copied to the console and the prompt
+	// watcher as it is read. stderr collects what the CLI reports.
+	stdout   io.Reader
+	stderr   bytes.Buffer
+	patterns *patternSet
+	prompts  *promptWatcher
+	tools    *toolWatcher
+	// close flushes the console and removes the request workspace, once
+	// the CLI is done.
+	close func()
+}
+
+// startStream starts the CLI to answer prompt, printing in format. Tool
+// calls are read off stderr, except with stream-json, which reports them
+// as events for the caller to pass to tools.
+func (b headlessBackend) startStream(ctx context.Context, prompt, format string, opts model.AskOptions) (*streamRun, error) {
+	args := []string{
+		"--prompt", prompt,
+		"--output-format", format,
+	}
+	if opts.Model != "" {
+		args = append(args, "--model", opts.Model)
+	}
+	args = append(args, executionArgs(opts)...)
+	args = append(args, groundingArgs(opts)...)
+
+	cmd := b.command(ctx, args...)
+	cmd.Env = append(cmd.Env, requestEnv(opts)...)
+	workspace, cleanup, err := prepareRequestWorkspace(opts, b.stateless)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare the CLI workspace: %v", err)
+	}
+	cmd.Dir = workspace
+
+	run := &streamRun{cmd: cmd, patterns: b.patterns.current(), tools: newToolWatcher(progressFrom(ctx))}
+	stdoutConsole, stderrConsole := consoleOutput(ctx, "stdout"), consoleOutput(ctx, "stderr")
+	run.close = func() {
+		stderrConsole.flush()
+		stdoutConsole.flush()
+		cleanup()
+	}
+	run.prompts = newPromptWatcher(run.patterns, func() { _ = cmd.Process.Kill() })
+	stderr := []io.Writer{&run.stderr, stderrConsole, run.prompts}
+	if format != streamFormatJSON {
+		stderr = append(stderr, run.tools)
+	}
+	cmd.Stderr = io.MultiWriter(stderr...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		run.close()
+		return nil, fmt.Errorf("failed to open gemini CLI output: %v", err)
+	}
+	if err := cmd.Start(); err != nil {
+		run.close()
+		return nil, fmt.Errorf("failed to start gemini CLI: %w", err)
+	}
+	setCallPID(ctx, cmd.Process.Pid)
+	run.stdout = io.TeeReader(stdout, io.MultiWriter(stdoutConsole, run.prompts))
+	return run, nil
+}
@@ -0,0 +1,142 @@
+package gemini
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+
+	"gemini-wrapper/model"
+	"gemini-wrapper/pkg/parser"
+)
+
+// Output formats the headless backend streams answers with.
+const (
+	// streamFormatText reads the answer off the plain text the CLI prints
+	// and streams it line by line.
+	streamFormatText = "text"
+	// streamFormatJSON reads the events of --output-format stream-json and
+	// streams the answer as the model produces it.
+	streamFormatJSON = "stream-json"
+)
+
+func parseStreamFormat(raw string) string {
+	switch strings.ToLower(strings.TrimSpace(raw)) {
+	case "", streamFormatText:
+		return streamFormatText
+	case streamFormatJSON, "stream_json", "json":
+		return streamFormatJSON
+	default:
+		slog.Warn("unsupported GEMINI_STREAM_FORMAT; using default", "value", raw, "format", streamFormatText)
+		return streamFormatText
+	}
+}
+
+// streamEvents runs the CLI with stream-json output and forwards every
+// piece of the answer the CLI reports, so clients get the answer token by
+// token rather than line by line. The answer ends at the result event; a
+// CLI that keeps running afterwards is stopped like after a sentinel. Once
+// the answer came in deltas, a whole assistant message only repeats it and
+// is skipped.
+func (b headlessBackend) streamEvents(ctx context.Context, question string, opts model.AskOptions, onChunk func(chunk string) error) (string, *model.GeminiStatus, error) {
+	modelName := opts.Model
+	run, err := b.startStream(ctx, streamPrompt(question, opts), streamFormatJSON, opts)
+	if err != nil {
+		return "", nil, err
+	}
+	defer run.close()
+	cmd, prompts, tools := run.cmd, run.prompts, run.tools
+
+	// Lines are read whole however long they are: one message event may
+	// carry a long answer.
+	reader := bufio.NewReader(run.stdout)
+	var answer strings.Builder
+	var result *parser.StreamEvent
+	sawDelta := false
+	toolNames := map[string]string{}
+	for result == nil {
+		line, readErr := reader.ReadString('\n')
+		if event, ok := parser.ParseStreamEvent(line); ok {
+			switch event.Type {
+			case parser.StreamMessage:
+				if event.Role != "assistant" || (sawDelta && !event.Delta) {
+					break
+				}
+				sawDelta = sawDelta || event.Delta
+				chunk := event.Content
+				if answer.Len() == 0 {
+					chunk = strings.TrimLeft(chunk, " \t\r\n")
+				}
+				if chunk == "" {
+					break
+				}
+				answer.WriteString(chunk)
+				if err := onChunk(chunk); err != nil {
+					_ = cmd.Process.Kill()
+					_ = cmd.Wait()
+					return "", nil, err
+				}
+			case parser.StreamToolUse:
+				toolNames[event.ToolID] = event.ToolName
+				tools.called(event.ToolName)
+			case parser.StreamToolResult:
+				if name, ok := toolNames[event.ToolID]; ok && event.Status == "error" {
+					tools.failed(name)
+				}
+			case parser.StreamError:
+				slog.WarnContext(ctx, "gemini CLI reported an error", "model", printableModel(modelName), "severity", event.Severity, "message", event.Message)
+			case parser.StreamResult:
+				result = &event
+			}
+		}
+		if readErr != nil && result == nil {
+			if !errors.Is(readErr, io.EOF) {
+				_ = cmd.Process.Kill()
+				_ = cmd.Wait()
+				return "", nil, fmt.Errorf("failed to read gemini CLI output: %v", readErr)
+			}
+			break
+		}
+	}
+
+	var waitErr error
+	if result != nil {
+		stopAfterSentinel(cmd)
+	} else {
+		waitErr = cmd.Wait()
+	}
+	if ctx.Err() != nil {
+		return "", nil, ctx.Err()
+	}
+	stderrStr := run.stderr.String()
+	slog.DebugContext(ctx, "gemini CLI stream finished", "model", printableModel(modelName), "exit_error", waitErr, "stderr", stderrStr)
+	status := parser.UpstreamStatus(stderrStr, nil)
+	if err := prompts.prompted(); err != nil {
+		return "", status, err
+	}
+	if result != nil && result.Error != nil {
+		response := parser.Response{Response: answer.String(), Error: result.Error}
+		status = parser.UpstreamStatus(stderrStr, &response)
+		return "", status, classifyUpstreamError(fmt.Errorf("gemini error: %s - %s", result.Error.Type, result.Error.Message), stderrStr, &response)
+	}
+	if waitErr != nil {
+		return "", status, classifyUpstreamError(fmt.Errorf("failed to execute gemini CLI: %v (output: %s)", waitErr, strings.TrimSpace(stderrStr)), stderrStr, nil)
+	}
+	if result == nil {
+		slog.WarnContext(ctx, "gemini CLI exited without a result event; the answer may be incomplete", "model", printableModel(modelName))
+	}
+
+	text := strings.TrimSpace(answer.String())
+	if text == "" {
+		return "", status, fmt.Errorf("received empty response from gemini")
+	}
+	if result != nil {
+		status = withStatusUsage(status, parser.StreamUsage(*result))
+	}
+	status = withStatusToolEvents(status, tools.events())
+	slog.InfoContext(ctx, "stream completed", "model", printableModel(modelName), "chars", len(text), "format", streamFormatJSON)
+	return text, status, nil
+}
@@ -0,0 +1,147 @@
+package gemini
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"gemini-wrapper/model"
+	"gemini-wrapper/service/jsonschema"
+)
+
+// mimeTypeJSON is the responseMimeType that asks for structured output.
+const mimeTypeJSON = "application/json"
+
+// invalidOutputCode is the status code reported when no answer matched the
+// response schema.
+const invalidOutputCode = "INVALID_JSON_OUTPUT"
+
+// ErrInvalidOutput is returned when the answer is still not JSON matching the
+// response schema after the configured repairs.
+var ErrInvalidOutput = errors.New("answer does not match the response schema")
+
+// structuredOutput is the JSON a request asked for.
+type structuredOutput struct {
+	schema *jsonschema.Schema
+	// rawSchema is the schema as shown to the model; empty accepts any JSON.
+	rawSchema string
+}
+
+// resolveStructuredOutput returns the JSON output opts asks for, or nil for
+// free text. An invalid schema is a 400.
+func resolveStructuredOutput(opts model.AskOptions) (*structuredOutput, *model.GeminiStatus, error) {
+	cfg := opts.GenerationConfig
+	if cfg == nil || !strings.EqualFold(strings.TrimSpace(cfg.ResponseMimeType), mimeTypeJSON) {
+		return nil, nil, nil
+	}
+	raw := []byte(cfg.ResponseSchema)
+	if len(bytes.TrimSpace(raw)) == 0 {
+		raw = []byte("{}")
+	}
+	schema, err := jsonschema.Compile(raw)
+	if err != nil {
+		err = fmt.Errorf("responseSchema: %w", err)
+		return nil, &model.GeminiStatus{HTTPStatus: http.StatusBadRequest, Code: "INVALID_ARGUMENT", Message: err.Error()}, err
+	}
+	out := &structuredOutput{schema: schema}
+	var compact bytes.Buffer
+	if len(cfg.ResponseSchema) > 0 && json.Compact(&compact, cfg.ResponseSchema) == nil {
+		out.rawSchema = compact.String()
+	}
+	return out, nil, nil
+}
+
+// prompt instructs the model to answer question with JSON only, since the
+// CLI has no option for it.
+func (o *structuredOutput) prompt(question string) string {
+	var b strings.Builder
+	b.WriteString(question)
+	b.WriteString("\n\nAnswer with a single JSON value and nothing else: no explanations and no Markdown code fences.")
+	if o.rawSchema != "" {
+		b.WriteString("\nThe JSON must match this JSON schema:\n")
+		b.WriteString(o.rawSchema)
+	}
+	return b.String()
+}
+
+// repairPrompt asks again after answer failed validation with err.
+func (o *structuredOutput) repairPrompt(question, answer string, err error) string {
+	return fmt.Sprintf("%s\n\nYour previous answer was:\n%s\n\nIt is not valid: %v\nAnswer again with the corrected JSON only.", o.prompt(question), answer, err)
+}
+
+// check returns answer without the code fences models like to add, or why it
+// does not match the schema.
+func (o *structuredOutput) check(answer string) (string, error) {
+	answer = stripCodeFence(answer)
+	if err := o.schema.Validate([]byte(answer)); err != nil {
+		return "", err
+	}
+	return answer, nil
+}
+
+// stripCodeFence removes a Markdown code fence around the whole answer.
+func stripCodeFence(answer string) string {
+	answer = strings.TrimSpace(answer)
+	if !strings.HasPrefix(answer, "```") || !strings.HasSuffix(answer, "```") {
+		return answer
+	}
+	body := strings.TrimSuffix(answer, "```")
+	newline := strings.IndexByte(body, '\n')
+	if newline < 0 {
+		return answer
+	}
+	return strings.TrimSpace(body[newline+1:])
+}
+
+// askValidated asks through askWithFallback and applies the generation
+// limits. With structured output, answers that do not match the schema are
+// asked again with a repair prompt, up to jsonRepairAttempts times.
+func (s *GeminiService) askValidated(ctx context.Context, question string, opts model.AskOptions, out *structuredOutput) (string, *model.GeminiStatus, error) {
+	prompt := question
+	if out != nil {
+		prompt = out.prompt(question)
+	}
+	for repairs := 0; ; repairs++ {
+		answer, status, err := s.askWithFallback(ctx, prompt, opts)
+		s.recordCircuit(ctx, err)
+		if err != nil {
+			return answer, status, err
+		}
+		answer, status = applyGenerationLimits(answer, status, opts)
+		status = withStatusCitations(status, opts, answer)
+		if out == nil {
+			return answer, status, nil
+		}
+
+		valid, checkErr := out.check(answer)
+		if checkErr == nil {
+			if repairs > 0 {
+				status = withRepairs(status, repairs)
+			}
+			return valid, status, nil
+		}
+		if repairs >= s.jsonRepairAttempts {
+			failed := withRepairs(status, repairs)
+			failed.HTTPStatus = http.StatusBadGateway
+			failed.Code = invalidOutputCode
+			failed.Message = checkErr.Error()
+			return "", failed, fmt.Errorf("%w: %v", ErrInvalidOutput, checkErr)
+		}
+		slog.WarnContext(ctx, "answer does not match the response schema; asking for a repair", "repair", repairs+1, "error", checkErr)
+		prompt = out.repairPrompt(question, answer, checkErr)
+	}
+}
+
+func withRepairs(status *model.GeminiStatus, repairs int) *model.GeminiStatus {
+	updated := model.GeminiStatus{}
+	if status != nil {
+		updated = *status
+	}
+	updated.Repairs = repairs
+	return &updated
+}
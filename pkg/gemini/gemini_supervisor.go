@@ -0,0 +1,279 @@
+package gemini
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gemini-wrapper/metrics"
+)
+
+// defaultProbeTimeout bounds a single `gemini --version` health probe.
+const defaultProbeTimeout = 30 * time.Second
+
+// ErrBackendStarting is returned for questions that arrive before the first
+// probe of the CLI finished, which can take as long as the probe timeout.
+var ErrBackendStarting = errors.New("the gemini CLI is still starting; retry shortly")
+
+// BackendHealth is the supervisor's view of the backend.
+type BackendHealth struct {
+	Backend string `json:"backend"`
+	Ready   bool   `json:"ready"`
+	// Starting is set until the first probe of the backend finished.
+	Starting            bool       `json:"starting,omitempty"`
+	Version             string     `json:"version,omitempty"`
+	LastCheckAt         *time.Time `json:"lastCheckAt,omitempty"`
+	LastSuccessAt       *time.Time `json:"lastSuccessAt,omitempty"`
+	LastError           string     `json:"lastError,omitempty"`
+	ConsecutiveFailures int        `json:"consecutiveFailures"`
+	Recoveries          int        `json:"recoveries"`
+	// APIFallback is set when the Gemini API answers what the CLI cannot.
+	APIFallback bool `json:"apiFallback,omitempty"`
+	// Patterns is the min_version of the CLI output patterns in use, or
+	// "default" for the built-in set for every version.
+	Patterns string `json:"patterns,omitempty"`
+	// SelfTest is set when the self-test is enabled.
+	SelfTest *SelfTestResult `json:"selfTest,omitempty"`
+}
+
+// backendProber is implemented by backends that can check they are usable
+// without answering a question.
+type backendProber interface {
+	Probe(ctx context.Context) (version string, err error)
+}
+
+// Probe runs `gemini --version`, which fails fast when the CLI is missing or
+// its Node.js installation is broken.
+func (b headlessBackend) Probe(ctx context.Context) (string, error) {
+	output, err := b.command(ctx, "--version").CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("gemini --version failed: %w (output: %s)", err, strings.TrimSpace(string(output)))
+	}
+	version := strings.TrimSpace(string(output))
+	if version == "" {
+		return "", fmt.Errorf("gemini --version printed nothing")
+	}
+	b.patterns.use(version)
+	return version, nil
+}
+
+func (*mockBackend) Probe(context.Context) (string, error) {
+	return backendMock, nil
+}
+
+// Probe fails while the API backend has no key to authenticate with, so the
+// service reports it as not ready instead of failing every question.
+func (b *apiBackend) Probe(context.Context) (string, error) {
+	if b.apiKey == "" {
+		return "", errors.New("the api backend needs a key in GEMINI_API_FALLBACK_KEY or GEMINI_API_KEY")
+	}
+	return backendAPI, nil
+}
+
+// supervisor tracks backend health. Headless mode has no long-lived CLI
+// process to restart, so supervision means probing the CLI in the background,
+// marking the service unready while probes fail and retrying with backoff.
+type supervisor struct {
+	ready        atomic.Bool
+	wake         chan struct{}
+	probeTimeout time.Duration
+	// started is closed once the first probe finished.
+	started     chan struct{}
+	startedOnce sync.Once
+
+	mu                  sync.Mutex
+	version             string
+	lastCheckAt         time.Time
+	lastSuccessAt       time.Time
+	lastError           string
+	consecutiveFailures int
+	recoveries          int
+	checked             bool
+}
+
+func newSupervisor() *supervisor {
+	return &supervisor{wake: make(chan struct{}, 1), probeTimeout: defaultProbeTimeout, started: make(chan struct{})}
+}
+
+// Health returns the current backend health snapshot.
+func (s *GeminiService) Health() BackendHealth {
+	health := BackendHealth{Backend: s.activeBackend().Name(), APIFallback: s.apiBackend != nil, SelfTest: s.selfTest.snapshot()}
+	if headless, ok := s.activeBackend().(headlessBackend); ok {
+		health.Patterns = cmp.Or(headless.patterns.current().minVersion, "default")
+	}
+	sup := s.supervisor
+	if sup == nil {
+		return health
+	}
+
+	health.Ready = sup.ready.Load()
+	health.Starting = sup.starting()
+	sup.mu.Lock()
+	defer sup.mu.Unlock()
+	health.Version = sup.version
+	health.LastError = sup.lastError
+	health.ConsecutiveFailures = sup.consecutiveFailures
+	health.Recoveries = sup.recoveries
+	if !sup.lastCheckAt.IsZero() {
+		lastCheckAt := sup.lastCheckAt
+		health.LastCheckAt = &lastCheckAt
+	}
+	if !sup.lastSuccessAt.IsZero() {
+		lastSuccessAt := sup.lastSuccessAt
+		health.LastSuccessAt = &lastSuccessAt
+	}
+	return health
+}
+
+// superviseBackend probes the backend every interval until Close and runs
+// the self-test after the first good probe. After a failed probe or
+// self-test it retries sooner, doubling the delay from one second up to
+// interval.
+func (s *GeminiService) superviseBackend(interval time.Duration) {
+	backoff := time.Second
+	for {
+		wait := interval
+		err := s.probeBackend()
+		if err == nil {
+			err = s.runSelfTest()
+		}
+		if err != nil {
+			wait = min(backoff, interval)
+			backoff *= 2
+		} else {
+			backoff = time.Second
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-s.supervisor.wake:
+			timer.Stop()
+		case <-s.shutdownCtx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+func (s *GeminiService) probeBackend() error {
+	prober, ok := s.activeBackend().(backendProber)
+	if !ok {
+		s.supervisor.recordProbe("", nil)
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(s.lifetime(), s.supervisor.probeTimeout)
+	defer cancel()
+	version, err := prober.Probe(ctx)
+	s.supervisor.recordProbe(version, err)
+	return err
+}
+
+func (sup *supervisor) recordProbe(version string, err error) {
+	defer sup.startedOnce.Do(func() { close(sup.started) })
+	sup.mu.Lock()
+	defer sup.mu.Unlock()
+	sup.lastCheckAt = time.Now()
+	if err != nil {
+		sup.consecutiveFailures++
+		sup.lastError = err.Error()
+		metrics.BackendProbeFailures.Inc()
+		if sup.ready.Swap(false) || sup.consecutiveFailures == 1 {
+			slog.Warn("gemini backend is not ready", "error", err)
+		}
+		return
+	}
+
+	if version != "" {
+		sup.version = version
+	}
+	sup.lastError = ""
+	sup.consecutiveFailures = 0
+	if !sup.ready.Swap(true) {
+		if sup.checked {
+			sup.recoveries++
+			metrics.BackendRecoveries.Inc()
+			slog.Info("gemini backend recovered", "recoveries", sup.recoveries)
+		} else {
+			slog.Info("gemini backend ready", "version", sup.version)
+		}
+	}
+	sup.checked = true
+}
+
+// starting reports whether the first probe of the backend has not finished
+// yet.
+func (sup *supervisor) starting() bool {
+	if sup == nil {
+		return false
+	}
+	select {
+	case <-sup.started:
+		return false
+	default:
+		return true
+	}
+}
+
+// WaitStarted blocks until the first probe of the backend finished or ctx
+// is done. Questions asked before then fail with ErrBackendStarting unless
+// the API fallback answers them.
+func (s *GeminiService) WaitStarted(ctx context.Context) error {
+	if s.supervisor == nil {
+		return nil
+	}
+	select {
+	case <-s.supervisor.started:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// down reports whether the backend failed its last probe or could not be
+// started. A backend that was not probed yet is not down.
+func (sup *supervisor) down() bool {
+	if sup == nil || sup.ready.Load() {
+		return false
+	}
+	sup.mu.Lock()
+	defer sup.mu.Unlock()
+	return sup.lastError != ""
+}
+
+// recordOutcome feeds request results into the supervisor: successes refresh
+// lastSuccessAt and a CLI that cannot be started marks the backend unready and
+// triggers an immediate re-probe.
+func (sup *supervisor) recordOutcome(err error) {
+	if sup == nil {
+		return
+	}
+	if err == nil {
+		sup.mu.Lock()
+		sup.lastSuccessAt = time.Now()
+		sup.mu.Unlock()
+		return
+	}
+
+	var execErr *exec.Error
+	if !errors.As(err, &execErr) {
+		return
+	}
+	sup.mu.Lock()
+	sup.lastError = err.Error()
+	sup.mu.Unlock()
+	if sup.ready.Swap(false) {
+		slog.Warn("gemini CLI could not be started", "error", err)
+	}
+	select {
+	case sup.wake <- struct{}{}:
+	default:
+	}
+}
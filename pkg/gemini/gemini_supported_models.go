@@ -0,0 +1,33 @@
+package gemini
+
+import (
+	"os"
+	"strings"
+)
+
+// DefaultModels are advertised when GEMINI_MODELS is not set.
+var DefaultModels = []string{"gemini-2.5-flash", "gemini-2.5-flash-lite", "gemini-2.5-pro"}
+
+// SupportedModels returns the models the wrapper advertises, read from the
+// comma-separated GEMINI_MODELS environment variable or DefaultModels.
+func SupportedModels() []string {
+	raw := strings.Trim(strings.TrimSpace(os.Getenv("GEMINI_MODELS")), "[]")
+	models := make([]string, 0, len(DefaultModels))
+	seen := map[string]struct{}{}
+	for _, p := range strings.Split(raw, ",") {
+		name := strings.Trim(strings.TrimSpace(p), "\"'")
+		name = strings.TrimPrefix(name, "models/")
+		if name == "" {
+			continue
+		}
+		if _, ok := seen[name]; ok {
+			continue
+		}
+		seen[name] = struct{}{}
+		models = append(models, name)
+	}
+	if len(models) == 0 {
+		return append([]string(nil), DefaultModels...)
+	}
+	return models
+}
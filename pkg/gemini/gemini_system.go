@@ -0,0 +1,13 @@
+package gemini
+
+import "strings"
+
+// systemPreamble puts the system instructions of a request before question,
+// set apart by tags so the model can tell them from the question.
+func systemPreamble(system, question string) string {
+	system = strings.TrimSpace(system)
+	if system == "" {
+		return question
+	}
+	return "<system_instructions>\n" + system + "\n</system_instructions>\n\n<question>\n" + question + "\n</question>"
+}
@@ -0,0 +1,29 @@
+package gemini
+
+import (
+	"context"
+
+	"gemini-wrapper/model"
+	"gemini-wrapper/service/tenants"
+)
+
+// applyTenant fills opts with the profile of the tenant of ctx: its default
+// model when the request names none, and its system prompt before the
+// context of the question.
+func applyTenant(ctx context.Context, opts model.AskOptions) model.AskOptions {
+	t := tenants.FromContext(ctx)
+	if t == nil {
+		return opts
+	}
+	if opts.Model == "" {
+		opts.Model = t.DefaultModel
+	}
+	switch {
+	case t.SystemPrompt == "":
+	case opts.Context == "":
+		opts.Context = t.SystemPrompt
+	default:
+		opts.Context = t.SystemPrompt + "\n\n" + opts.Context
+	}
+	return opts
+}
@@ -0,0 +1,150 @@
+package gemini
+
+import (
+	"strings"
+
+	"gemini-wrapper/model"
+)
+
+// The tags around the model's reasoning in an answer. The CLI is asked to
+// write them, and thought parts of the Gemini API are wrapped in them.
+const (
+	thoughtOpen  = "<thought>"
+	thoughtClose = "</thought>"
+)
+
+func includeThoughts(opts model.AskOptions) bool {
+	cfg := opts.GenerationConfig
+	return cfg != nil && cfg.ThinkingConfig != nil && cfg.ThinkingConfig.IncludeThoughts
+}
+
+// thinkingPrompt asks the model to write down its reasoning, since the CLI
+// does not print the thoughts it receives.
+func thinkingPrompt(question string) string {
+	return question + "\n\nBefore the answer, write your reasoning between " + thoughtOpen + " and " + thoughtClose + "."
+}
+
+// mustStream reports whether the answer for opts has to be read while the
+// CLI prints it: to cut it short, or to take the thoughts out of it.
+func mustStream(opts model.AskOptions) bool {
+	return outputLimit(opts) > 0 || len(stopSequences(opts)) > 0 || includeThoughts(opts)
+}
+
+// stripThoughts returns answer without its thought blocks. An unclosed
+// block runs to the end of the answer.
+func stripThoughts(answer string) string {
+	var rest strings.Builder
+	for {
+		before, after, found := strings.Cut(answer, thoughtOpen)
+		rest.WriteString(before)
+		if !found {
+			break
+		}
+		_, answer, _ = strings.Cut(after, thoughtClose)
+	}
+	return strings.TrimSpace(rest.String())
+}
+
+// thoughtFilter takes the thought blocks of a streamed answer out of its
+// chunks when opts ask for thoughts, and collects them. The end of what
+// arrived is held back while it may be the start of a tag.
+type thoughtFilter struct {
+	enabled   bool
+	onChunk   func(chunk string) error
+	pending   string
+	inThought bool
+	thought   strings.Builder
+	thoughts  []string
+}
+
+func newThoughtFilter(opts model.AskOptions, onChunk func(chunk string) error) *thoughtFilter {
+	return &thoughtFilter{enabled: includeThoughts(opts), onChunk: onChunk}
+}
+
+func (f *thoughtFilter) chunk(chunk string) error {
+	if !f.enabled {
+		return f.onChunk(chunk)
+	}
+	f.pending += chunk
+	for {
+		tag := thoughtOpen
+		if f.inThought {
+			tag = thoughtClose
+		}
+		before, after, found := strings.Cut(f.pending, tag)
+		if !found {
+			break
+		}
+		if err := f.send(before); err != nil {
+			return err
+		}
+		f.pending = after
+		f.toggle()
+	}
+	n := len(f.pending) - partialTag(f.pending, f.inThought)
+	out := f.pending[:n]
+	f.pending = f.pending[n:]
+	return f.send(out)
+}
+
+// send passes text outside thought blocks on and collects the rest.
+func (f *thoughtFilter) send(text string) error {
+	if f.inThought {
+		f.thought.WriteString(text)
+		return nil
+	}
+	if text == "" {
+		return nil
+	}
+	return f.onChunk(text)
+}
+
+// toggle enters or leaves a thought block.
+func (f *thoughtFilter) toggle() {
+	if f.inThought {
+		if thought := strings.TrimSpace(f.thought.String()); thought != "" {
+			f.thoughts = append(f.thoughts, thought)
+		}
+		f.thought.Reset()
+	}
+	f.inThought = !f.inThought
+}
+
+// partialTag returns the length of the end of s that may be the start of
+// the next tag.
+func partialTag(s string, inThought bool) int {
+	tag := thoughtOpen
+	if inThought {
+		tag = thoughtClose
+	}
+	for n := min(len(s), len(tag)-1); n > 0; n-- {
+		if strings.HasSuffix(s, tag[:n]) {
+			return n
+		}
+	}
+	return 0
+}
+
+// result sends what was held back of a finished stream, takes the thoughts
+// out of its answer and records them in status. They are recorded too when
+// the stream was cut short.
+func (f *thoughtFilter) result(answer string, status *model.GeminiStatus, err error) (string, *model.GeminiStatus, error) {
+	if !f.enabled {
+		return answer, status, err
+	}
+	if err == nil {
+		pending := f.pending
+		f.pending = ""
+		err = f.send(pending)
+	}
+	if f.inThought {
+		f.toggle()
+	}
+	if len(f.thoughts) > 0 {
+		if status == nil {
+			status = &model.GeminiStatus{}
+		}
+		status.Thoughts = strings.Join(f.thoughts, "\n\n")
+	}
+	return stripThoughts(answer), status, err
+}
@@ -0,0 +1,12 @@
+package gemini
+
+import "strings"
+
+// EstimateTokens approximates a token count at roughly four characters per token.
+func EstimateTokens(text string) int {
+	trimmed := strings.TrimSpace(text)
+	if trimmed == "" {
+		return 0
+	}
+	return (len([]rune(trimmed)) + 3) / 4
+}
@@ -0,0 +1,61 @@
+// Package lines reads text line by line like bufio.Scanner, without its
+// limit on the length of a line: a streamed answer can be one line of
+// minified JSON many megabytes long. Lines end at "\n", "\r\n" or a lone
+// "\r", as in server-sent events and the progress updates of CLIs. Only
+// whole lines are returned, so a multi-byte character is never split at the
+// boundary of a read.
+package lines
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+)
+
+// Reader reads lines from an io.Reader. It is not safe for concurrent use.
+type Reader struct {
+	r    *bufio.Reader
+	line []byte
+	// skipLF is set after a "\r", whose "\n" may follow in the next read.
+	skipLF bool
+}
+
+// NewReader returns a Reader of r.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReaderSize(r, 64<<10)}
+}
+
+// Next returns the next line without its ending. The line is only valid
+// until the next call. After the last line it returns io.EOF; a last line
+// without an ending is returned first. Other errors of the underlying reader
+// are returned as they are.
+func (r *Reader) Next() ([]byte, error) {
+	r.line = r.line[:0]
+	for {
+		if _, err := r.r.Peek(1); err != nil {
+			if errors.Is(err, io.EOF) && len(r.line) > 0 {
+				return r.line, nil
+			}
+			return nil, err
+		}
+		buf, _ := r.r.Peek(r.r.Buffered())
+		if r.skipLF {
+			r.skipLF = false
+			if buf[0] == '\n' {
+				_, _ = r.r.Discard(1)
+				continue
+			}
+		}
+		end := bytes.IndexAny(buf, "\r\n")
+		if end < 0 {
+			r.line = append(r.line, buf...)
+			_, _ = r.r.Discard(len(buf))
+			continue
+		}
+		r.line = append(r.line, buf[:end]...)
+		r.skipLF = buf[end] == '\r'
+		_, _ = r.r.Discard(end + 1)
+		return r.line, nil
+	}
+}
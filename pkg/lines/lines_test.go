@@ -0,0 +1,67 @@
+package lines
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func readAll(t *testing.T, r io.Reader) []string {
+	t.Helper()
+	reader := NewReader(r)
+	var got []string
+	for {
+		line, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			return got
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		got = append(got, string(line))
+	}
+}
+
+func TestNextSplitsAtEveryLineEnding(t *testing.T) {
+	cases := []struct {
+		name string
+		raw  string
+		want []string
+	}{
+		{name: "line feeds", raw: "one\ntwo\n", want: []string{"one", "two"}},
+		{name: "carriage return and line feed", raw: "one\r\ntwo\r\n", want: []string{"one", "two"}},
+		{name: "lone carriage returns", raw: "50%\r100%\rdone\n", want: []string{"50%", "100%", "done"}},
+		{name: "empty lines", raw: "event: done\n\n\r\ndata: x\n", want: []string{"event: done", "", "", "data: x"}},
+		{name: "last line without ending", raw: "one\ntwo", want: []string{"one", "two"}},
+		{name: "nothing", raw: "", want: nil},
+	}
+	for _, tc := range cases {
+		got := readAll(t, strings.NewReader(tc.raw))
+		if strings.Join(got, "|") != strings.Join(tc.want, "|") || len(got) != len(tc.want) {
+			t.Fatalf("%s: expected %q, got %q", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestNextReadsHugeLinesAndSplitReads(t *testing.T) {
+	huge := strings.Repeat(`{"a":"äöü€"},`, 200_000)
+	raw := huge + "\r\n" + "tail\r"
+	// One byte per read splits every multi-byte character and every "\r\n".
+	got := readAll(t, iotest.OneByteReader(strings.NewReader(raw)))
+	if len(got) != 2 || got[0] != huge || got[1] != "tail" {
+		t.Fatalf("expected the huge line and the tail, got %d lines", len(got))
+	}
+}
+
+func TestNextReturnsReadErrors(t *testing.T) {
+	boom := errors.New("boom")
+	reader := NewReader(io.MultiReader(strings.NewReader("one\npartial"), iotest.ErrReader(boom)))
+	if line, err := reader.Next(); err != nil || string(line) != "one" {
+		t.Fatalf("unexpected first line %q %v", line, err)
+	}
+	if _, err := reader.Next(); !errors.Is(err, boom) {
+		t.Fatalf("expected the read error, got %v", err)
+	}
+}
@@ -0,0 +1,483 @@
+// Package parser reads what the Gemini CLI prints in headless mode: the JSON
+// response with the answer and token stats, and the upstream errors reported
+// on stderr. It has no dependencies on the rest of the wrapper besides model.
+package parser
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gemini-wrapper/model"
+)
+
+// Response is the JSON document the CLI prints with --output-format json.
+type Response struct {
+	Response string `json:"response"`
+	Stats    struct {
+		Models map[string]struct {
+			Tokens struct {
+				Prompt     int `json:"prompt"`
+				Candidates int `json:"candidates"`
+				Total      int `json:"total"`
+				Cached     int `json:"cached"`
+				Thoughts   int `json:"thoughts"`
+				Tool       int `json:"tool"`
+			} `json:"tokens"`
+		} `json:"models"`
+		Tools struct {
+			ByName map[string]struct {
+				Count      int   `json:"count"`
+				Success    int   `json:"success"`
+				Fail       int   `json:"fail"`
+				DurationMs int64 `json:"durationMs"`
+			} `json:"byName"`
+		} `json:"tools"`
+	} `json:"stats"`
+	Error *ResponseError `json:"error,omitempty"`
+}
+
+// ResponseError is the error the CLI reports in a Response or a result
+// StreamEvent.
+type ResponseError struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+	Code    int    `json:"code,omitempty"`
+}
+
+// Types of the events the CLI prints with --output-format stream-json.
+const (
+	StreamInit       = "init"
+	StreamMessage    = "message"
+	StreamToolUse    = "tool_use"
+	StreamToolResult = "tool_result"
+	StreamError      = "error"
+	StreamResult     = "result"
+)
+
+// StreamEvent is one line the CLI prints with --output-format stream-json.
+type StreamEvent struct {
+	Type string `json:"type"`
+	// Role and Content are set on messages. Delta marks a piece of an
+	// assistant message, printed as the model produces it.
+	Role    string `json:"role,omitempty"`
+	Content string `json:"content,omitempty"`
+	Delta   bool   `json:"delta,omitempty"`
+	// ToolName is set on tool_use events, ToolID on them and on the
+	// tool_result that follows.
+	ToolName string `json:"tool_name,omitempty"`
+	ToolID   string `json:"tool_id,omitempty"`
+	// Status is "success" or "error" on tool_result and result events.
+	Status string `json:"status,omitempty"`
+	// Severity and Message are set on error events, which the CLI recovers
+	// from; a failed run ends with a result carrying Error.
+	Severity string         `json:"severity,omitempty"`
+	Message  string         `json:"message,omitempty"`
+	Error    *ResponseError `json:"error,omitempty"`
+	Stats    *struct {
+		TotalTokens  int   `json:"total_tokens"`
+		InputTokens  int   `json:"input_tokens"`
+		OutputTokens int   `json:"output_tokens"`
+		Cached       int   `json:"cached"`
+		DurationMs   int64 `json:"duration_ms"`
+		ToolCalls    int   `json:"tool_calls"`
+	} `json:"stats,omitempty"`
+}
+
+// ParseStreamEvent parses a line of stream-json output. Lines that are not
+// events, such as warnings the CLI prints on the same stream, are rejected.
+func ParseStreamEvent(line string) (StreamEvent, bool) {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "{") {
+		return StreamEvent{}, false
+	}
+	var event StreamEvent
+	if err := json.Unmarshal([]byte(line), &event); err != nil || event.Type == "" {
+		return StreamEvent{}, false
+	}
+	return event, true
+}
+
+// StreamUsage returns the token stats of a result event, or nil when it
+// has none.
+func StreamUsage(event StreamEvent) *model.UsageMetadata {
+	if event.Stats == nil {
+		return nil
+	}
+	return &model.UsageMetadata{
+		PromptTokenCount:        event.Stats.InputTokens,
+		CandidatesTokenCount:    event.Stats.OutputTokens,
+		TotalTokenCount:         event.Stats.TotalTokens,
+		CachedContentTokenCount: event.Stats.Cached,
+	}
+}
+
+// ParseOutput finds the Response in the output of the CLI: the whole
+// output, else its last JSON object, else its last JSON code fence, each
+// possibly encoded as a JSON string. Log lines around it are ignored.
+func ParseOutput(outputStr string) (Response, bool) {
+	candidates := buildParseCandidates(outputStr)
+	attemptErrors := make([]string, 0, len(candidates))
+
+	for _, candidate := range candidates {
+		response, err := tryParseResponse(candidate.payload)
+		if err == nil {
+			return response, true
+		}
+		attemptErrors = append(attemptErrors, fmt.Sprintf("%s: %v", candidate.name, err))
+	}
+
+	if len(attemptErrors) > 0 {
+		slog.Warn("failed to parse gemini JSON response", "attempts", strings.Join(attemptErrors, " | "))
+	}
+	return Response{}, false
+}
+
+type parseCandidate struct {
+	name    string
+	payload string
+}
+
+func buildParseCandidates(outputStr string) []parseCandidate {
+	trimmed := strings.TrimSpace(outputStr)
+	if trimmed == "" {
+		return nil
+	}
+
+	candidates := make([]parseCandidate, 0, 3)
+	seen := map[string]struct{}{}
+	add := func(name, payload string) {
+		payload = strings.TrimSpace(payload)
+		if payload == "" {
+			return
+		}
+		if _, ok := seen[payload]; ok {
+			return
+		}
+		seen[payload] = struct{}{}
+		candidates = append(candidates, parseCandidate{name: name, payload: payload})
+	}
+
+	add("full_output", trimmed)
+	if extracted, ok := extractLastJSONObject(trimmed); ok {
+		add("last_json_object", extracted)
+	}
+	if fenced, ok := extractFencedJSON(trimmed); ok {
+		add("fenced_json", fenced)
+	}
+
+	return candidates
+}
+
+func tryParseResponse(payload string) (Response, error) {
+	var response Response
+	if err := json.Unmarshal([]byte(payload), &response); err == nil {
+		return response, nil
+	}
+
+	var encoded string
+	if err := json.Unmarshal([]byte(payload), &encoded); err != nil {
+		return Response{}, err
+	}
+
+	encoded = strings.TrimSpace(encoded)
+	if encoded == "" {
+		return Response{}, fmt.Errorf("decoded payload is empty")
+	}
+	if err := json.Unmarshal([]byte(encoded), &response); err != nil {
+		return Response{}, err
+	}
+	return response, nil
+}
+
+// Usage sums the per-model token stats of response, or returns nil when
+// the CLI printed none.
+func Usage(response Response) *model.UsageMetadata {
+	if len(response.Stats.Models) == 0 {
+		return nil
+	}
+	usage := &model.UsageMetadata{}
+	for _, stats := range response.Stats.Models {
+		usage.PromptTokenCount += stats.Tokens.Prompt
+		usage.CandidatesTokenCount += stats.Tokens.Candidates
+		usage.TotalTokenCount += stats.Tokens.Total
+		usage.CachedContentTokenCount += stats.Tokens.Cached
+		usage.ThoughtsTokenCount += stats.Tokens.Thoughts
+		usage.ToolUsePromptTokenCount += stats.Tokens.Tool
+	}
+	return usage
+}
+
+// ToolEvents returns the tool calls in the stats of response by tool name,
+// or nil when the CLI called none.
+func ToolEvents(response Response) []model.ToolEvent {
+	if len(response.Stats.Tools.ByName) == 0 {
+		return nil
+	}
+	events := make([]model.ToolEvent, 0, len(response.Stats.Tools.ByName))
+	for name, stats := range response.Stats.Tools.ByName {
+		events = append(events, model.ToolEvent{Name: name, Calls: stats.Count, Succeeded: stats.Success, Failed: stats.Fail, DurationMs: stats.DurationMs})
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].Name < events[j].Name })
+	return events
+}
+
+// UpstreamStatus derives the upstream status from the output of the CLI
+// and, when it could be parsed, its Response: 429 when the output reports
+// exhausted quota or capacity, else the error of response. It returns nil
+// when neither says anything.
+func UpstreamStatus(outputStr string, response *Response) *model.GeminiStatus {
+	if inferred := detectRateLimitStatus(outputStr); inferred != nil {
+		return inferred
+	}
+
+	if response != nil && response.Error != nil {
+		status := &model.GeminiStatus{Message: response.Error.Message}
+		if response.Error.Type != "" {
+			status.Code = response.Error.Type
+		}
+		if response.Error.Code >= 100 && response.Error.Code <= 599 {
+			status.HTTPStatus = response.Error.Code
+		} else if parsed, ok := parseHTTPStatusFromCode(response.Error.Type); ok {
+			status.HTTPStatus = parsed
+		}
+		if status.HTTPStatus != 0 || status.Code != "" || status.Message != "" {
+			return status
+		}
+	}
+
+	return nil
+}
+
+// Classify tells why a CLI run failed from its output and, when it could
+// be parsed, its Response. It returns one of the model.Reason constants for
+// expired credentials, safety blocks, too long prompts, overloaded models
+// and exhausted quota, or "" when the output matches none of them. Only
+// call it for runs that failed: answers may mention the same words.
+func Classify(outputStr string, response *Response) string {
+	text := outputStr
+	if response != nil && response.Error != nil {
+		text += "\n" + response.Error.Type + "\n" + response.Error.Message
+	}
+	lower := strings.ToLower(text)
+
+	switch {
+	case containsAny(lower, authExpiredPhrases):
+		return model.ReasonAuthExpired
+	case containsAny(lower, safetyPhrases):
+		return model.ReasonSafetyBlocked
+	case containsAny(lower, contextLengthPhrases):
+		return model.ReasonContextLengthExceeded
+	case containsAny(lower, overloadedPhrases):
+		return model.ReasonModelOverloaded
+	case detectRateLimitStatus(text) != nil:
+		return model.ReasonQuotaExceeded
+	}
+	return ""
+}
+
+var (
+	authExpiredPhrases = []string{
+		"invalid_grant", "token has been expired", "token expired", "expired or revoked",
+		"credentials have expired", "credentials expired", "refresh token", "please re-authenticate",
+		"please reauthenticate", "login expired", "session expired", "waiting for auth",
+	}
+	safetyPhrases = []string{
+		"blocked due to safety", "blocked for safety", "blockreason", "block_reason",
+		"finishreason: safety", `"finishreason": "safety"`, `"finishreason":"safety"`,
+		"prohibited_content", "safety filter", "safety settings", "blocked by the safety",
+	}
+	contextLengthPhrases = []string{
+		"exceeds the maximum number of tokens", "input token count", "context length",
+		"context window", "maximum context", "too many tokens", "token limit exceeded",
+		"prompt is too long", "request payload size exceeds",
+	}
+	overloadedPhrases = []string{
+		"overloaded", "model capacity",
+		"no capacity available", "capacity exceeded", "exceeded capacity", `"code": 503`,
+		`"status": "unavailable"`, "status 503", "service unavailable",
+	}
+)
+
+func containsAny(lower string, phrases []string) bool {
+	for _, phrase := range phrases {
+		if strings.Contains(lower, phrase) {
+			return true
+		}
+	}
+	return false
+}
+
+func detectRateLimitStatus(outputStr string) *model.GeminiStatus {
+	lower := strings.ToLower(outputStr)
+
+	if strings.Contains(outputStr, "\"code\": 429") ||
+		strings.Contains(outputStr, "\"status\": 429") ||
+		strings.Contains(outputStr, "status 429") ||
+		strings.Contains(outputStr, "HTTP/1.1 429") ||
+		strings.Contains(outputStr, "HTTP/2 429") ||
+		strings.Contains(outputStr, "Too Many Requests") ||
+		strings.Contains(outputStr, "rateLimitExceeded") ||
+		strings.Contains(outputStr, "RESOURCE_EXHAUSTED") {
+		return &model.GeminiStatus{
+			HTTPStatus: http.StatusTooManyRequests,
+			Code:       "RESOURCE_EXHAUSTED",
+			Message:    "Upstream rate limited or model capacity exhausted",
+		}
+	}
+
+	// Require stronger contextual phrases to avoid classifying ordinary text as 429.
+	if strings.Contains(lower, "quota exceeded") ||
+		strings.Contains(lower, "exceeded quota") ||
+		strings.Contains(lower, "capacity exceeded") ||
+		strings.Contains(lower, "exceeded capacity") ||
+		strings.Contains(lower, "rate limit exceeded") {
+		return &model.GeminiStatus{
+			HTTPStatus: http.StatusTooManyRequests,
+			Code:       "RESOURCE_EXHAUSTED",
+			Message:    "Upstream rate limited or model capacity exhausted",
+		}
+	}
+
+	errorContext := strings.Contains(lower, "\"error\"") || strings.Contains(lower, "error:") || strings.Contains(lower, "\"headers\"")
+	if errorContext && hasAnyWord(lower, "quota", "capacity") && hasAnyWord(lower, "rate", "limit", "exceeded", "exhausted") {
+		return &model.GeminiStatus{
+			HTTPStatus: http.StatusTooManyRequests,
+			Code:       "RESOURCE_EXHAUSTED",
+			Message:    "Upstream rate limited or model capacity exhausted",
+		}
+	}
+
+	return nil
+}
+
+func hasAnyWord(input string, words ...string) bool {
+	if len(words) == 0 {
+		return false
+	}
+	set := map[string]struct{}{}
+	for _, token := range tokenizeLower(input) {
+		set[token] = struct{}{}
+	}
+	for _, w := range words {
+		if _, ok := set[strings.ToLower(strings.TrimSpace(w))]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func tokenizeLower(input string) []string {
+	normalized := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == ' ' {
+			return r
+		}
+		if r >= 'A' && r <= 'Z' {
+			return r + ('a' - 'A')
+		}
+		return ' '
+	}, input)
+	return strings.Fields(normalized)
+}
+
+func parseHTTPStatusFromCode(code string) (int, bool) {
+	parsed, err := strconv.Atoi(strings.TrimSpace(code))
+	if err != nil {
+		return 0, false
+	}
+	if parsed < 100 || parsed > 599 {
+		return 0, false
+	}
+	return parsed, true
+}
+
+func extractLastJSONObject(outputStr string) (string, bool) {
+	depth := 0
+	inString := false
+	escaped := false
+	end := -1
+
+	// Scan backwards to find the last complete JSON object while ignoring braces in strings.
+	for i := len(outputStr) - 1; i >= 0; i-- {
+		ch := outputStr[i]
+		if inString {
+			if escaped {
+				escaped = false
+				continue
+			}
+			if ch == '\\' {
+				escaped = true
+				continue
+			}
+			if ch == '"' {
+				inString = false
+			}
+			continue
+		}
+
+		if ch == '"' {
+			inString = true
+			continue
+		}
+
+		if ch == '}' {
+			if end == -1 {
+				end = i
+			}
+			depth++
+			continue
+		}
+
+		if ch == '{' && end != -1 {
+			depth--
+			if depth == 0 {
+				return outputStr[i : end+1], true
+			}
+		}
+	}
+
+	return "", false
+}
+
+func extractFencedJSON(outputStr string) (string, bool) {
+	last := ""
+	for i := 0; i < len(outputStr); {
+		startRel := strings.Index(outputStr[i:], "```")
+		if startRel == -1 {
+			break
+		}
+		start := i + startRel
+
+		headerStart := start + 3
+		lineRel := strings.IndexByte(outputStr[headerStart:], '\n')
+		if lineRel == -1 {
+			break
+		}
+		lineEnd := headerStart + lineRel
+		language := strings.TrimSpace(outputStr[headerStart:lineEnd])
+
+		contentStart := lineEnd + 1
+		closeRel := strings.Index(outputStr[contentStart:], "```")
+		if closeRel == -1 {
+			break
+		}
+		contentEnd := contentStart + closeRel
+		content := strings.TrimSpace(outputStr[contentStart:contentEnd])
+
+		lowerLanguage := strings.ToLower(language)
+		if content != "" && (lowerLanguage == "json" || lowerLanguage == "" || strings.HasPrefix(lowerLanguage, "json ")) {
+			last = content
+		}
+
+		i = contentEnd + 3
+	}
+
+	if last == "" {
+		return "", false
+	}
+	return last, true
+}
@@ -0,0 +1,162 @@
+package parser
+
+import (
+	"testing"
+
+	"gemini-wrapper/model"
+)
+
+func TestParseOutputParsesLastJSONObject(t *testing.T) {
+	out := "log line\n{\"response\":\"hello\"}\n"
+	resp, ok := ParseOutput(out)
+	if !ok {
+		t.Fatal("expected parse success")
+	}
+	if resp.Response != "hello" {
+		t.Fatalf("unexpected response: %q", resp.Response)
+	}
+}
+
+func TestParseOutputParsesFencedJSON(t *testing.T) {
+	out := "some heading\n```json\n{\"response\":\"from fence\"}\n```\n"
+	resp, ok := ParseOutput(out)
+	if !ok {
+		t.Fatal("expected parse success")
+	}
+	if resp.Response != "from fence" {
+		t.Fatalf("unexpected response: %q", resp.Response)
+	}
+}
+
+func TestParseOutputParsesEscapedJSONBlob(t *testing.T) {
+	out := "\"{\\\"response\\\":\\\"escaped\\\"}\""
+	resp, ok := ParseOutput(out)
+	if !ok {
+		t.Fatal("expected parse success")
+	}
+	if resp.Response != "escaped" {
+		t.Fatalf("unexpected response: %q", resp.Response)
+	}
+}
+
+func TestParseOutputFailsForMalformedPayload(t *testing.T) {
+	out := "not-json at all"
+	_, ok := ParseOutput(out)
+	if ok {
+		t.Fatal("expected parse failure")
+	}
+}
+
+func TestExtractFencedJSONReturnsLastJSONFence(t *testing.T) {
+	out := "```json\n{\"response\":\"first\"}\n```\ntext\n```json\n{\"response\":\"last\"}\n```"
+	fenced, ok := extractFencedJSON(out)
+	if !ok {
+		t.Fatal("expected fenced JSON")
+	}
+	if fenced != "{\"response\":\"last\"}" {
+		t.Fatalf("unexpected fenced JSON: %q", fenced)
+	}
+}
+
+func TestUsageFromResponseSumsModelStats(t *testing.T) {
+	out := `{"response":"hi","stats":{"models":{"gemini-2.5-flash":{"tokens":{"prompt":10,"candidates":3,"total":15,"thoughts":2}},"gemini-2.5-flash-lite":{"tokens":{"prompt":5,"candidates":1,"total":6}}}}}`
+	resp, ok := ParseOutput(out)
+	if !ok {
+		t.Fatal("expected parse success")
+	}
+	usage := Usage(resp)
+	if usage == nil || usage.PromptTokenCount != 15 || usage.CandidatesTokenCount != 4 || usage.TotalTokenCount != 21 || usage.ThoughtsTokenCount != 2 {
+		t.Fatalf("unexpected usage: %#v", usage)
+	}
+
+	if Usage(Response{}) != nil {
+		t.Fatal("expected nil usage without stats")
+	}
+}
+
+func TestParseStreamEventReadsEventsAndSkipsOtherLines(t *testing.T) {
+	event, ok := ParseStreamEvent(`{"type":"message","timestamp":"2025-10-01T10:00:00Z","role":"assistant","content":"Hel","delta":true}` + "\n")
+	if !ok || event.Type != StreamMessage || event.Role != "assistant" || event.Content != "Hel" || !event.Delta {
+		t.Fatalf("unexpected message event: %#v %v", event, ok)
+	}
+	for _, line := range []string{"Loaded cached credentials.", `{"response":"hi"}`, `{"type":`, ""} {
+		if _, ok := ParseStreamEvent(line); ok {
+			t.Fatalf("expected %q not to be an event", line)
+		}
+	}
+
+	result, ok := ParseStreamEvent(`{"type":"result","status":"error","error":{"type":"FatalTurnLimitedError","message":"too many turns"},"stats":{"total_tokens":21,"input_tokens":15,"output_tokens":6,"duration_ms":900,"tool_calls":1}}`)
+	if !ok || result.Status != "error" || result.Error == nil || result.Error.Type != "FatalTurnLimitedError" {
+		t.Fatalf("unexpected result event: %#v %v", result, ok)
+	}
+	usage := StreamUsage(result)
+	if usage == nil || usage.PromptTokenCount != 15 || usage.CandidatesTokenCount != 6 || usage.TotalTokenCount != 21 {
+		t.Fatalf("unexpected usage: %#v", usage)
+	}
+	if StreamUsage(event) != nil {
+		t.Fatal("expected no usage without stats")
+	}
+}
+
+func TestToolEventsFromResponseStats(t *testing.T) {
+	out := `{"response":"hi","stats":{"tools":{"totalCalls":3,"byName":{"run_shell_command":{"count":1,"success":0,"fail":1,"durationMs":40},"read_file":{"count":2,"success":2,"fail":0,"durationMs":12}}}}}`
+	resp, ok := ParseOutput(out)
+	if !ok {
+		t.Fatal("expected parse success")
+	}
+	events := ToolEvents(resp)
+	want := []model.ToolEvent{
+		{Name: "read_file", Calls: 2, Succeeded: 2, DurationMs: 12},
+		{Name: "run_shell_command", Calls: 1, Failed: 1, DurationMs: 40},
+	}
+	if len(events) != len(want) || events[0] != want[0] || events[1] != want[1] {
+		t.Fatalf("unexpected tool events: %#v", events)
+	}
+
+	if ToolEvents(Response{}) != nil {
+		t.Fatal("expected no tool events without stats")
+	}
+}
+
+func TestUpstreamStatusPrefersRateLimitsOverResponseErrors(t *testing.T) {
+	resp, ok := ParseOutput(`{"error":{"type":"404","message":"model not found"}}`)
+	if !ok {
+		t.Fatal("expected parse success")
+	}
+	if status := UpstreamStatus("", &resp); status == nil || status.HTTPStatus != 404 || status.Message != "model not found" {
+		t.Fatalf("expected the response error, got %#v", status)
+	}
+	if status := UpstreamStatus("Error: quota exceeded for this model", &resp); status == nil || status.HTTPStatus != 429 || status.Code != "RESOURCE_EXHAUSTED" {
+		t.Fatalf("expected a rate limit, got %#v", status)
+	}
+	if status := UpstreamStatus("the answer mentions a rate and a quota", nil); status != nil {
+		t.Fatalf("expected ordinary text to carry no status, got %#v", status)
+	}
+}
+
+func TestClassify(t *testing.T) {
+	cases := []struct {
+		output string
+		want   string
+	}{
+		{"Error: invalid_grant - Token has been expired or revoked.", model.ReasonAuthExpired},
+		{`{"error": {"code": 503, "message": "The model is overloaded. Please try again later.", "status": "UNAVAILABLE"}}`, model.ReasonModelOverloaded},
+		{`{"error": {"code": 429, "message": "Quota exceeded for quota metric 'Generate Content API requests per minute'", "status": "RESOURCE_EXHAUSTED"}}`, model.ReasonQuotaExceeded},
+		{"The input token count (1200000) exceeds the maximum number of tokens allowed (1048576).", model.ReasonContextLengthExceeded},
+		{`{"promptFeedback": {"blockReason": "SAFETY"}}`, model.ReasonSafetyBlocked},
+		{"Error: connect ECONNREFUSED 127.0.0.1:443", ""},
+	}
+	for _, tc := range cases {
+		if got := Classify(tc.output, nil); got != tc.want {
+			t.Fatalf("Classify(%q) = %q, want %q", tc.output, got, tc.want)
+		}
+	}
+
+	response, ok := ParseOutput(`{"error": {"type": "Error", "message": "context window exceeded"}}`)
+	if !ok {
+		t.Fatal("expected parse success")
+	}
+	if got := Classify("exit status 1", &response); got != model.ReasonContextLengthExceeded {
+		t.Fatalf("expected the response error to be classified, got %q", got)
+	}
+}
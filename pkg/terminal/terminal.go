@@ -0,0 +1,343 @@
+// Package terminal renders what a program writes to a terminal. The Gemini
+// CLI draws spinners and progress with carriage returns, cursor movements
+// and erase sequences, so reading its output line by line duplicates or
+// loses text; a Screen applies those controls the way a VT100 would and
+// returns the lines as they were last shown.
+package terminal
+
+import (
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// DefaultHeight is the height of a Screen created with a height of zero.
+const DefaultHeight = 24
+
+// Screen is a VT100-style screen buffer of unlimited width. Lines that scroll
+// off its top are kept, so Lines returns everything written; the cursor can
+// only reach the last height lines, as on a real terminal. Line feeds also
+// return the carriage, like a terminal translating "\n" to "\r\n".
+//
+// A Screen is not safe for concurrent use.
+type Screen struct {
+	height int
+	rows   [][]rune
+	row    int
+	col    int
+
+	savedRow, savedCol int
+
+	state   parseState
+	params  []byte
+	partial []byte
+}
+
+type parseState int
+
+const (
+	stateText parseState = iota
+	stateEscape
+	stateCSI
+	stateOSC
+	stateOSCEscape
+	stateCharset
+)
+
+// NewScreen returns an empty screen whose cursor can reach height lines, or
+// DefaultHeight lines when height is not positive.
+func NewScreen(height int) *Screen {
+	if height <= 0 {
+		height = DefaultHeight
+	}
+	return &Screen{height: height, rows: [][]rune{nil}}
+}
+
+// Write renders p. Multi-byte characters may be split across writes. It
+// never fails.
+func (s *Screen) Write(p []byte) (int, error) {
+	data := p
+	if len(s.partial) > 0 {
+		data = append(s.partial, p...)
+		s.partial = nil
+	}
+	for len(data) > 0 {
+		r, size := utf8.DecodeRune(data)
+		if r == utf8.RuneError && size <= 1 && !utf8.FullRune(data) {
+			s.partial = append([]byte(nil), data...)
+			break
+		}
+		s.feed(r)
+		data = data[size:]
+	}
+	return len(p), nil
+}
+
+// CursorRow is the index of the line the cursor is on. Lines before it have
+// been left with a line feed or a cursor movement, and are complete unless
+// the program moves back up to redraw them.
+func (s *Screen) CursorRow() int {
+	return s.row
+}
+
+// Len is the number of lines, including the one the cursor is on.
+func (s *Screen) Len() int {
+	return len(s.rows)
+}
+
+// Line returns line i as shown, without trailing spaces.
+func (s *Screen) Line(i int) string {
+	if i < 0 || i >= len(s.rows) {
+		return ""
+	}
+	return strings.TrimRight(string(s.rows[i]), " ")
+}
+
+// Lines returns every line as shown, without trailing blank lines.
+func (s *Screen) Lines() []string {
+	lines := make([]string, len(s.rows))
+	for i := range s.rows {
+		lines[i] = s.Line(i)
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// String returns Lines joined with newlines.
+func (s *Screen) String() string {
+	return strings.Join(s.Lines(), "\n")
+}
+
+// Render returns what raw shows on a new screen.
+func Render(raw string) string {
+	s := NewScreen(0)
+	_, _ = s.Write([]byte(raw))
+	return s.String()
+}
+
+func (s *Screen) feed(r rune) {
+	switch s.state {
+	case stateEscape:
+		s.escape(r)
+		return
+	case stateCSI:
+		if r >= 0x40 && r <= 0x7e {
+			s.state = stateText
+			s.csi(r)
+			s.params = s.params[:0]
+		} else if r < 0x20 {
+			s.control(r)
+		} else if len(s.params) < 64 {
+			s.params = append(s.params, byte(r))
+		}
+		return
+	case stateOSC:
+		switch r {
+		case 0x07:
+			s.state = stateText
+		case 0x1b:
+			s.state = stateOSCEscape
+		}
+		return
+	case stateOSCEscape:
+		if r == '\\' {
+			s.state = stateText
+		} else {
+			s.state = stateOSC
+		}
+		return
+	case stateCharset:
+		s.state = stateText
+		return
+	}
+
+	if r < 0x20 || r == 0x7f {
+		s.control(r)
+		return
+	}
+	s.put(r)
+}
+
+func (s *Screen) control(r rune) {
+	switch r {
+	case '\r':
+		s.col = 0
+	case '\n', '\v', '\f':
+		s.col = 0
+		s.lineFeed()
+	case '\b':
+		s.col = max(s.col-1, 0)
+	case '\t':
+		s.col = (s.col/8 + 1) * 8
+	case 0x1b:
+		s.state = stateEscape
+	}
+}
+
+func (s *Screen) escape(r rune) {
+	s.state = stateText
+	switch r {
+	case '[':
+		s.state = stateCSI
+		s.params = s.params[:0]
+	case ']', 'P', '_', '^':
+		// OSC, DCS, APC and PM strings all end with BEL or ST.
+		s.state = stateOSC
+	case '(', ')', '*', '+':
+		s.state = stateCharset
+	case '7':
+		s.savedRow, s.savedCol = s.row, s.col
+	case '8':
+		s.moveTo(s.savedRow, s.savedCol)
+	case 'D':
+		s.lineFeed()
+	case 'E':
+		s.col = 0
+		s.lineFeed()
+	case 'M':
+		s.moveTo(s.row-1, s.col)
+	case 'c':
+		s.eraseScreen(2)
+		s.moveTo(s.top(), 0)
+	}
+}
+
+// csi applies a control sequence ending in final. Sequences with a private
+// marker, like "?25l" to hide the cursor, and SGR colours do not change the
+// text and are ignored.
+func (s *Screen) csi(final rune) {
+	if len(s.params) > 0 && (s.params[0] < '0' || s.params[0] > ';') {
+		return
+	}
+	args := strings.Split(string(s.params), ";")
+	arg := func(i, fallback int) int {
+		if i >= len(args) {
+			return fallback
+		}
+		n, err := strconv.Atoi(args[i])
+		if err != nil || n == 0 {
+			return fallback
+		}
+		return n
+	}
+
+	switch final {
+	case 'A':
+		s.moveTo(s.row-arg(0, 1), s.col)
+	case 'B', 'e':
+		s.moveTo(s.row+arg(0, 1), s.col)
+	case 'C', 'a':
+		s.col += arg(0, 1)
+	case 'D':
+		s.col = max(s.col-arg(0, 1), 0)
+	case 'E':
+		s.moveTo(s.row+arg(0, 1), 0)
+	case 'F':
+		s.moveTo(s.row-arg(0, 1), 0)
+	case 'G', '`':
+		s.col = arg(0, 1) - 1
+	case 'H', 'f':
+		s.moveTo(s.top()+arg(0, 1)-1, arg(1, 1)-1)
+	case 'd':
+		s.moveTo(s.top()+arg(0, 1)-1, s.col)
+	case 'J':
+		s.eraseScreen(arg(0, 0))
+	case 'K':
+		s.eraseLine(arg(0, 0))
+	case 'P':
+		line := s.rows[s.row]
+		if s.col < len(line) {
+			n := min(arg(0, 1), len(line)-s.col)
+			s.rows[s.row] = append(line[:s.col], line[s.col+n:]...)
+		}
+	case 'X':
+		line := s.rows[s.row]
+		for i := s.col; i < min(s.col+arg(0, 1), len(line)); i++ {
+			line[i] = ' '
+		}
+	case '@':
+		line := s.rows[s.row]
+		if s.col < len(line) {
+			blanks := []rune(strings.Repeat(" ", arg(0, 1)))
+			s.rows[s.row] = append(line[:s.col], append(blanks, line[s.col:]...)...)
+		}
+	case 's':
+		s.savedRow, s.savedCol = s.row, s.col
+	case 'u':
+		s.moveTo(s.savedRow, s.savedCol)
+	}
+}
+
+// top is the first line the cursor can reach.
+func (s *Screen) top() int {
+	return max(len(s.rows)-s.height, 0)
+}
+
+// moveTo moves the cursor, keeping it on the screen. Lines below the last
+// one are created as a terminal would show them, blank.
+func (s *Screen) moveTo(row, col int) {
+	row = max(row, s.top())
+	row = min(row, s.top()+s.height-1)
+	for row >= len(s.rows) {
+		s.rows = append(s.rows, nil)
+	}
+	s.row, s.col = row, max(col, 0)
+}
+
+func (s *Screen) lineFeed() {
+	s.row++
+	if s.row == len(s.rows) {
+		s.rows = append(s.rows, nil)
+	}
+}
+
+func (s *Screen) put(r rune) {
+	line := s.rows[s.row]
+	for len(line) < s.col {
+		line = append(line, ' ')
+	}
+	if s.col < len(line) {
+		line[s.col] = r
+	} else {
+		line = append(line, r)
+	}
+	s.rows[s.row] = line
+	s.col++
+}
+
+func (s *Screen) eraseLine(mode int) {
+	line := s.rows[s.row]
+	switch mode {
+	case 0:
+		if s.col < len(line) {
+			s.rows[s.row] = line[:s.col]
+		}
+	case 1:
+		for i := 0; i <= s.col && i < len(line); i++ {
+			line[i] = ' '
+		}
+	case 2:
+		s.rows[s.row] = nil
+	}
+}
+
+func (s *Screen) eraseScreen(mode int) {
+	switch mode {
+	case 0:
+		s.eraseLine(0)
+		for i := s.row + 1; i < len(s.rows); i++ {
+			s.rows[i] = nil
+		}
+	case 1:
+		s.eraseLine(1)
+		for i := s.top(); i < s.row; i++ {
+			s.rows[i] = nil
+		}
+	case 2, 3:
+		for i := s.top(); i < len(s.rows); i++ {
+			s.rows[i] = nil
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package terminal
+
+import (
+	"testing"
+)
+
+func TestRender(t *testing.T) {
+	cases := []struct {
+		name string
+		raw  string
+		want string
+	}{
+		{name: "plain lines", raw: "first\nsecond\n", want: "first\nsecond"},
+		{name: "carriage return spinner", raw: "working |\rworking /\rworking -\ndone\n", want: "working -\ndone"},
+		{name: "colours", raw: "\x1b[1;32mok\x1b[0m\n", want: "ok"},
+		{name: "erase line", raw: "Loading...\r\x1b[2Kanswer\n", want: "answer"},
+		{name: "erase to end of line", raw: "abcdef\r\x1b[3C\x1b[K\n", want: "abc"},
+		{name: "cursor up redraw", raw: "header\nstep 1/3\nstep 2/3\n\x1b[2A\x1b[2Kdone\n\x1b[2K\n", want: "header\ndone"},
+		{name: "backspace", raw: "ab\bc\n", want: "ac"},
+		{name: "title and hidden cursor", raw: "\x1b]0;gemini\x07\x1b[?25lhi\x1b[?25h\n", want: "hi"},
+		{name: "absolute position", raw: "one\ntwo\n\x1b[1;1HONE", want: "ONE\ntwo"},
+		{name: "save and restore", raw: "\x1b7xx\n\x1b8ab\n", want: "ab"},
+		{name: "tab", raw: "a\tb\n", want: "a       b"},
+		{name: "delete characters", raw: "abcdef\r\x1b[2P\n", want: "cdef"},
+	}
+	for _, tc := range cases {
+		if got := Render(tc.raw); got != tc.want {
+			t.Fatalf("%s: expected %q, got %q", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestScreenKeepsSplitCharactersAndScrolledLines(t *testing.T) {
+	s := NewScreen(2)
+	euro := []byte("€\n")
+	_, _ = s.Write(euro[:1])
+	_, _ = s.Write(euro[1:])
+	_, _ = s.Write([]byte("b\nc\n"))
+	// The cursor cannot move above the last two lines.
+	_, _ = s.Write([]byte("\x1b[10AX"))
+
+	if got := s.String(); got != "€\nb\nX" {
+		t.Fatalf("unexpected screen %q", got)
+	}
+	if s.CursorRow() != 2 || s.Len() != 4 {
+		t.Fatalf("unexpected cursor row %d of %d lines", s.CursorRow(), s.Len())
+	}
+}
@@ -0,0 +1,6 @@
+// Package wrapperpb holds the messages and gRPC stubs generated from
+// gemini_wrapper.proto. Regenerate them with protoc-gen-go and
+// protoc-gen-go-grpc after changing the proto file.
+package wrapperpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative gemini_wrapper.proto
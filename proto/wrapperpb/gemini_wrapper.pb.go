@@ -0,0 +1,580 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.11
+// 	protoc        (unknown)
+// source: gemini_wrapper.proto
+
+package wrapperpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type AskRequest struct {
+	state    protoimpl.MessageState `protogen:"open.v1"`
+	Question string                 `protobuf:"bytes,1,opt,name=question,proto3" json:"question,omitempty"`
+	// model is optional; the server default is used when empty.
+	Model string `protobuf:"bytes,2,opt,name=model,proto3" json:"model,omitempty"`
+	// timeout_seconds overrides the server's request timeout, up to its maximum.
+	TimeoutSeconds int32 `protobuf:"varint,3,opt,name=timeout_seconds,json=timeoutSeconds,proto3" json:"timeout_seconds,omitempty"`
+	unknownFields  protoimpl.UnknownFields
+	sizeCache      protoimpl.SizeCache
+}
+
+func (x *AskRequest) Reset() {
+	*x = AskRequest{}
+	mi := &file_gemini_wrapper_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AskRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AskRequest) ProtoMessage() {}
+
+func (x *AskRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_gemini_wrapper_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AskRequest.ProtoReflect.Descriptor instead.
+func (*AskRequest) Descriptor() ([]byte, []int) {
+	return file_gemini_wrapper_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *AskRequest) GetQuestion() string {
+	if x != nil {
+		return x.Question
+	}
+	return ""
+}
+
+func (x *AskRequest) GetModel() string {
+	if x != nil {
+		return x.Model
+	}
+	return ""
+}
+
+func (x *AskRequest) GetTimeoutSeconds() int32 {
+	if x != nil {
+		return x.TimeoutSeconds
+	}
+	return 0
+}
+
+type Usage struct {
+	state                protoimpl.MessageState `protogen:"open.v1"`
+	PromptTokenCount     int32                  `protobuf:"varint,1,opt,name=prompt_token_count,json=promptTokenCount,proto3" json:"prompt_token_count,omitempty"`
+	CandidatesTokenCount int32                  `protobuf:"varint,2,opt,name=candidates_token_count,json=candidatesTokenCount,proto3" json:"candidates_token_count,omitempty"`
+	TotalTokenCount      int32                  `protobuf:"varint,3,opt,name=total_token_count,json=totalTokenCount,proto3" json:"total_token_count,omitempty"`
+	unknownFields        protoimpl.UnknownFields
+	sizeCache            protoimpl.SizeCache
+}
+
+func (x *Usage) Reset() {
+	*x = Usage{}
+	mi := &file_gemini_wrapper_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Usage) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Usage) ProtoMessage() {}
+
+func (x *Usage) ProtoReflect() protoreflect.Message {
+	mi := &file_gemini_wrapper_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Usage.ProtoReflect.Descriptor instead.
+func (*Usage) Descriptor() ([]byte, []int) {
+	return file_gemini_wrapper_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *Usage) GetPromptTokenCount() int32 {
+	if x != nil {
+		return x.PromptTokenCount
+	}
+	return 0
+}
+
+func (x *Usage) GetCandidatesTokenCount() int32 {
+	if x != nil {
+		return x.CandidatesTokenCount
+	}
+	return 0
+}
+
+func (x *Usage) GetTotalTokenCount() int32 {
+	if x != nil {
+		return x.TotalTokenCount
+	}
+	return 0
+}
+
+type AskResponse struct {
+	state  protoimpl.MessageState `protogen:"open.v1"`
+	Answer string                 `protobuf:"bytes,1,opt,name=answer,proto3" json:"answer,omitempty"`
+	// model is the model that answered, which differs from the requested one
+	// after a fallback.
+	Model         string `protobuf:"bytes,2,opt,name=model,proto3" json:"model,omitempty"`
+	Usage         *Usage `protobuf:"bytes,3,opt,name=usage,proto3" json:"usage,omitempty"`
+	FinishReason  string `protobuf:"bytes,4,opt,name=finish_reason,json=finishReason,proto3" json:"finish_reason,omitempty"`
+	Retries       int32  `protobuf:"varint,5,opt,name=retries,proto3" json:"retries,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AskResponse) Reset() {
+	*x = AskResponse{}
+	mi := &file_gemini_wrapper_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AskResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AskResponse) ProtoMessage() {}
+
+func (x *AskResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_gemini_wrapper_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AskResponse.ProtoReflect.Descriptor instead.
+func (*AskResponse) Descriptor() ([]byte, []int) {
+	return file_gemini_wrapper_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *AskResponse) GetAnswer() string {
+	if x != nil {
+		return x.Answer
+	}
+	return ""
+}
+
+func (x *AskResponse) GetModel() string {
+	if x != nil {
+		return x.Model
+	}
+	return ""
+}
+
+func (x *AskResponse) GetUsage() *Usage {
+	if x != nil {
+		return x.Usage
+	}
+	return nil
+}
+
+func (x *AskResponse) GetFinishReason() string {
+	if x != nil {
+		return x.FinishReason
+	}
+	return ""
+}
+
+func (x *AskResponse) GetRetries() int32 {
+	if x != nil {
+		return x.Retries
+	}
+	return 0
+}
+
+type AskStreamResponse struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// chunk is a piece of the answer; empty on the final message.
+	Chunk string `protobuf:"bytes,1,opt,name=chunk,proto3" json:"chunk,omitempty"`
+	// result is set on the final message only.
+	Result        *AskResponse `protobuf:"bytes,2,opt,name=result,proto3" json:"result,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AskStreamResponse) Reset() {
+	*x = AskStreamResponse{}
+	mi := &file_gemini_wrapper_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AskStreamResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AskStreamResponse) ProtoMessage() {}
+
+func (x *AskStreamResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_gemini_wrapper_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AskStreamResponse.ProtoReflect.Descriptor instead.
+func (*AskStreamResponse) Descriptor() ([]byte, []int) {
+	return file_gemini_wrapper_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *AskStreamResponse) GetChunk() string {
+	if x != nil {
+		return x.Chunk
+	}
+	return ""
+}
+
+func (x *AskStreamResponse) GetResult() *AskResponse {
+	if x != nil {
+		return x.Result
+	}
+	return nil
+}
+
+type GetStatusRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetStatusRequest) Reset() {
+	*x = GetStatusRequest{}
+	mi := &file_gemini_wrapper_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetStatusRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetStatusRequest) ProtoMessage() {}
+
+func (x *GetStatusRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_gemini_wrapper_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetStatusRequest.ProtoReflect.Descriptor instead.
+func (*GetStatusRequest) Descriptor() ([]byte, []int) {
+	return file_gemini_wrapper_proto_rawDescGZIP(), []int{4}
+}
+
+type PoolStatus struct {
+	state             protoimpl.MessageState `protogen:"open.v1"`
+	Size              int32                  `protobuf:"varint,1,opt,name=size,proto3" json:"size,omitempty"`
+	Busy              int32                  `protobuf:"varint,2,opt,name=busy,proto3" json:"busy,omitempty"`
+	Waiting           int32                  `protobuf:"varint,3,opt,name=waiting,proto3" json:"waiting,omitempty"`
+	QueueLimit        int32                  `protobuf:"varint,4,opt,name=queue_limit,json=queueLimit,proto3" json:"queue_limit,omitempty"`
+	OldestWaitSeconds float64                `protobuf:"fixed64,5,opt,name=oldest_wait_seconds,json=oldestWaitSeconds,proto3" json:"oldest_wait_seconds,omitempty"`
+	unknownFields     protoimpl.UnknownFields
+	sizeCache         protoimpl.SizeCache
+}
+
+func (x *PoolStatus) Reset() {
+	*x = PoolStatus{}
+	mi := &file_gemini_wrapper_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *PoolStatus) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PoolStatus) ProtoMessage() {}
+
+func (x *PoolStatus) ProtoReflect() protoreflect.Message {
+	mi := &file_gemini_wrapper_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PoolStatus.ProtoReflect.Descriptor instead.
+func (*PoolStatus) Descriptor() ([]byte, []int) {
+	return file_gemini_wrapper_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *PoolStatus) GetSize() int32 {
+	if x != nil {
+		return x.Size
+	}
+	return 0
+}
+
+func (x *PoolStatus) GetBusy() int32 {
+	if x != nil {
+		return x.Busy
+	}
+	return 0
+}
+
+func (x *PoolStatus) GetWaiting() int32 {
+	if x != nil {
+		return x.Waiting
+	}
+	return 0
+}
+
+func (x *PoolStatus) GetQueueLimit() int32 {
+	if x != nil {
+		return x.QueueLimit
+	}
+	return 0
+}
+
+func (x *PoolStatus) GetOldestWaitSeconds() float64 {
+	if x != nil {
+		return x.OldestWaitSeconds
+	}
+	return 0
+}
+
+type GetStatusResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Ready         bool                   `protobuf:"varint,1,opt,name=ready,proto3" json:"ready,omitempty"`
+	Backend       string                 `protobuf:"bytes,2,opt,name=backend,proto3" json:"backend,omitempty"`
+	Version       string                 `protobuf:"bytes,3,opt,name=version,proto3" json:"version,omitempty"`
+	LastError     string                 `protobuf:"bytes,4,opt,name=last_error,json=lastError,proto3" json:"last_error,omitempty"`
+	Pool          *PoolStatus            `protobuf:"bytes,5,opt,name=pool,proto3" json:"pool,omitempty"`
+	CircuitState  string                 `protobuf:"bytes,6,opt,name=circuit_state,json=circuitState,proto3" json:"circuit_state,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetStatusResponse) Reset() {
+	*x = GetStatusResponse{}
+	mi := &file_gemini_wrapper_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetStatusResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetStatusResponse) ProtoMessage() {}
+
+func (x *GetStatusResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_gemini_wrapper_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetStatusResponse.ProtoReflect.Descriptor instead.
+func (*GetStatusResponse) Descriptor() ([]byte, []int) {
+	return file_gemini_wrapper_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *GetStatusResponse) GetReady() bool {
+	if x != nil {
+		return x.Ready
+	}
+	return false
+}
+
+func (x *GetStatusResponse) GetBackend() string {
+	if x != nil {
+		return x.Backend
+	}
+	return ""
+}
+
+func (x *GetStatusResponse) GetVersion() string {
+	if x != nil {
+		return x.Version
+	}
+	return ""
+}
+
+func (x *GetStatusResponse) GetLastError() string {
+	if x != nil {
+		return x.LastError
+	}
+	return ""
+}
+
+func (x *GetStatusResponse) GetPool() *PoolStatus {
+	if x != nil {
+		return x.Pool
+	}
+	return nil
+}
+
+func (x *GetStatusResponse) GetCircuitState() string {
+	if x != nil {
+		return x.CircuitState
+	}
+	return ""
+}
+
+var File_gemini_wrapper_proto protoreflect.FileDescriptor
+
+const file_gemini_wrapper_proto_rawDesc = "" +
+	"\n" +
+	"\x14gemini_wrapper.proto\x12\x10geminiwrapper.v1\"g\n" +
+	"\n" +
+	"AskRequest\x12\x1a\n" +
+	"\bquestion\x18\x01 \x01(\tR\bquestion\x12\x14\n" +
+	"\x05model\x18\x02 \x01(\tR\x05model\x12'\n" +
+	"\x0ftimeout_seconds\x18\x03 \x01(\x05R\x0etimeoutSeconds\"\x97\x01\n" +
+	"\x05Usage\x12,\n" +
+	"\x12prompt_token_count\x18\x01 \x01(\x05R\x10promptTokenCount\x124\n" +
+	"\x16candidates_token_count\x18\x02 \x01(\x05R\x14candidatesTokenCount\x12*\n" +
+	"\x11total_token_count\x18\x03 \x01(\x05R\x0ftotalTokenCount\"\xa9\x01\n" +
+	"\vAskResponse\x12\x16\n" +
+	"\x06answer\x18\x01 \x01(\tR\x06answer\x12\x14\n" +
+	"\x05model\x18\x02 \x01(\tR\x05model\x12-\n" +
+	"\x05usage\x18\x03 \x01(\v2\x17.geminiwrapper.v1.UsageR\x05usage\x12#\n" +
+	"\rfinish_reason\x18\x04 \x01(\tR\ffinishReason\x12\x18\n" +
+	"\aretries\x18\x05 \x01(\x05R\aretries\"`\n" +
+	"\x11AskStreamResponse\x12\x14\n" +
+	"\x05chunk\x18\x01 \x01(\tR\x05chunk\x125\n" +
+	"\x06result\x18\x02 \x01(\v2\x1d.geminiwrapper.v1.AskResponseR\x06result\"\x12\n" +
+	"\x10GetStatusRequest\"\x9f\x01\n" +
+	"\n" +
+	"PoolStatus\x12\x12\n" +
+	"\x04size\x18\x01 \x01(\x05R\x04size\x12\x12\n" +
+	"\x04busy\x18\x02 \x01(\x05R\x04busy\x12\x18\n" +
+	"\awaiting\x18\x03 \x01(\x05R\awaiting\x12\x1f\n" +
+	"\vqueue_limit\x18\x04 \x01(\x05R\n" +
+	"queueLimit\x12.\n" +
+	"\x13oldest_wait_seconds\x18\x05 \x01(\x01R\x11oldestWaitSeconds\"\xd3\x01\n" +
+	"\x11GetStatusResponse\x12\x14\n" +
+	"\x05ready\x18\x01 \x01(\bR\x05ready\x12\x18\n" +
+	"\abackend\x18\x02 \x01(\tR\abackend\x12\x18\n" +
+	"\aversion\x18\x03 \x01(\tR\aversion\x12\x1d\n" +
+	"\n" +
+	"last_error\x18\x04 \x01(\tR\tlastError\x120\n" +
+	"\x04pool\x18\x05 \x01(\v2\x1c.geminiwrapper.v1.PoolStatusR\x04pool\x12#\n" +
+	"\rcircuit_state\x18\x06 \x01(\tR\fcircuitState2\xfb\x01\n" +
+	"\rGeminiWrapper\x12B\n" +
+	"\x03Ask\x12\x1c.geminiwrapper.v1.AskRequest\x1a\x1d.geminiwrapper.v1.AskResponse\x12P\n" +
+	"\tAskStream\x12\x1c.geminiwrapper.v1.AskRequest\x1a#.geminiwrapper.v1.AskStreamResponse0\x01\x12T\n" +
+	"\tGetStatus\x12\".geminiwrapper.v1.GetStatusRequest\x1a#.geminiwrapper.v1.GetStatusResponseB Z\x1egemini-wrapper/proto/wrapperpbb\x06proto3"
+
+var (
+	file_gemini_wrapper_proto_rawDescOnce sync.Once
+	file_gemini_wrapper_proto_rawDescData []byte
+)
+
+func file_gemini_wrapper_proto_rawDescGZIP() []byte {
+	file_gemini_wrapper_proto_rawDescOnce.Do(func() {
+		file_gemini_wrapper_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_gemini_wrapper_proto_rawDesc), len(file_gemini_wrapper_proto_rawDesc)))
+	})
+	return file_gemini_wrapper_proto_rawDescData
+}
+
+var file_gemini_wrapper_proto_msgTypes = make([]protoimpl.MessageInfo, 7)
+var file_gemini_wrapper_proto_goTypes = []any{
+	(*AskRequest)(nil),        // 0: geminiwrapper.v1.AskRequest
+	(*Usage)(nil),             // 1: geminiwrapper.v1.Usage
+	(*AskResponse)(nil),       // 2: geminiwrapper.v1.AskResponse
+	(*AskStreamResponse)(nil), // 3: geminiwrapper.v1.AskStreamResponse
+	(*GetStatusRequest)(nil),  // 4: geminiwrapper.v1.GetStatusRequest
+	(*PoolStatus)(nil),        // 5: geminiwrapper.v1.PoolStatus
+	(*GetStatusResponse)(nil), // 6: geminiwrapper.v1.GetStatusResponse
+}
+var file_gemini_wrapper_proto_depIdxs = []int32{
+	1, // 0: geminiwrapper.v1.AskResponse.usage:type_name -> geminiwrapper.v1.Usage
+	2, // 1: geminiwrapper.v1.AskStreamResponse.result:type_name -> geminiwrapper.v1.AskResponse
+	5, // 2: geminiwrapper.v1.GetStatusResponse.pool:type_name -> geminiwrapper.v1.PoolStatus
+	0, // 3: geminiwrapper.v1.GeminiWrapper.Ask:input_type -> geminiwrapper.v1.AskRequest
+	0, // 4: geminiwrapper.v1.GeminiWrapper.AskStream:input_type -> geminiwrapper.v1.AskRequest
+	4, // 5: geminiwrapper.v1.GeminiWrapper.GetStatus:input_type -> geminiwrapper.v1.GetStatusRequest
+	2, // 6: geminiwrapper.v1.GeminiWrapper.Ask:output_type -> geminiwrapper.v1.AskResponse
+	3, // 7: geminiwrapper.v1.GeminiWrapper.AskStream:output_type -> geminiwrapper.v1.AskStreamResponse
+	6, // 8: geminiwrapper.v1.GeminiWrapper.GetStatus:output_type -> geminiwrapper.v1.GetStatusResponse
+	6, // [6:9] is the sub-list for method output_type
+	3, // [3:6] is the sub-list for method input_type
+	3, // [3:3] is the sub-list for extension type_name
+	3, // [3:3] is the sub-list for extension extendee
+	0, // [0:3] is the sub-list for field type_name
+}
+
+func init() { file_gemini_wrapper_proto_init() }
+func file_gemini_wrapper_proto_init() {
+	if File_gemini_wrapper_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_gemini_wrapper_proto_rawDesc), len(file_gemini_wrapper_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   7,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_gemini_wrapper_proto_goTypes,
+		DependencyIndexes: file_gemini_wrapper_proto_depIdxs,
+		MessageInfos:      file_gemini_wrapper_proto_msgTypes,
+	}.Build()
+	File_gemini_wrapper_proto = out.File
+	file_gemini_wrapper_proto_goTypes = nil
+	file_gemini_wrapper_proto_depIdxs = nil
+}
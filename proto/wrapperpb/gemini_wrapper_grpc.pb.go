@@ -0,0 +1,217 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: gemini_wrapper.proto
+
+package wrapperpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	GeminiWrapper_Ask_FullMethodName       = "/geminiwrapper.v1.GeminiWrapper/Ask"
+	GeminiWrapper_AskStream_FullMethodName = "/geminiwrapper.v1.GeminiWrapper/AskStream"
+	GeminiWrapper_GetStatus_FullMethodName = "/geminiwrapper.v1.GeminiWrapper/GetStatus"
+)
+
+// GeminiWrapperClient is the client API for GeminiWrapper service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// GeminiWrapper exposes the wrapper's ask API to internal services. Failures
+// use the gRPC status code matching the HTTP status of the REST API, for
+// example RESOURCE_EXHAUSTED for quota errors and a full queue.
+type GeminiWrapperClient interface {
+	// Ask answers a question once the answer is complete.
+	Ask(ctx context.Context, in *AskRequest, opts ...grpc.CallOption) (*AskResponse, error)
+	// AskStream sends the answer in chunks as the CLI prints it. The last
+	// message carries the result.
+	AskStream(ctx context.Context, in *AskRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[AskStreamResponse], error)
+	// GetStatus reports backend health, worker pool and circuit breaker state.
+	GetStatus(ctx context.Context, in *GetStatusRequest, opts ...grpc.CallOption) (*GetStatusResponse, error)
+}
+
+type geminiWrapperClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewGeminiWrapperClient(cc grpc.ClientConnInterface) GeminiWrapperClient {
+	return &geminiWrapperClient{cc}
+}
+
+func (c *geminiWrapperClient) Ask(ctx context.Context, in *AskRequest, opts ...grpc.CallOption) (*AskResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(AskResponse)
+	err := c.cc.Invoke(ctx, GeminiWrapper_Ask_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *geminiWrapperClient) AskStream(ctx context.Context, in *AskRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[AskStreamResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &GeminiWrapper_ServiceDesc.Streams[0], GeminiWrapper_AskStream_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[AskRequest, AskStreamResponse]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type GeminiWrapper_AskStreamClient = grpc.ServerStreamingClient[AskStreamResponse]
+
+func (c *geminiWrapperClient) GetStatus(ctx context.Context, in *GetStatusRequest, opts ...grpc.CallOption) (*GetStatusResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(GetStatusResponse)
+	err := c.cc.Invoke(ctx, GeminiWrapper_GetStatus_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// GeminiWrapperServer is the server API for GeminiWrapper service.
+// All implementations must embed UnimplementedGeminiWrapperServer
+// for forward compatibility.
+//
+// GeminiWrapper exposes the wrapper's ask API to internal services. Failures
+// use the gRPC status code matching the HTTP status of the REST API, for
+// example RESOURCE_EXHAUSTED for quota errors and a full queue.
+type GeminiWrapperServer interface {
+	// Ask answers a question once the answer is complete.
+	Ask(context.Context, *AskRequest) (*AskResponse, error)
+	// AskStream sends the answer in chunks as the CLI prints it. The last
+	// message carries the result.
+	AskStream(*AskRequest, grpc.ServerStreamingServer[AskStreamResponse]) error
+	// GetStatus reports backend health, worker pool and circuit breaker state.
+	GetStatus(context.Context, *GetStatusRequest) (*GetStatusResponse, error)
+	mustEmbedUnimplementedGeminiWrapperServer()
+}
+
+// UnimplementedGeminiWrapperServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedGeminiWrapperServer struct{}
+
+func (UnimplementedGeminiWrapperServer) Ask(context.Context, *AskRequest) (*AskResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Ask not implemented")
+}
+func (UnimplementedGeminiWrapperServer) AskStream(*AskRequest, grpc.ServerStreamingServer[AskStreamResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method AskStream not implemented")
+}
+func (UnimplementedGeminiWrapperServer) GetStatus(context.Context, *GetStatusRequest) (*GetStatusResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetStatus not implemented")
+}
+func (UnimplementedGeminiWrapperServer) mustEmbedUnimplementedGeminiWrapperServer() {}
+func (UnimplementedGeminiWrapperServer) testEmbeddedByValue()                       {}
+
+// UnsafeGeminiWrapperServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to GeminiWrapperServer will
+// result in compilation errors.
+type UnsafeGeminiWrapperServer interface {
+	mustEmbedUnimplementedGeminiWrapperServer()
+}
+
+func RegisterGeminiWrapperServer(s grpc.ServiceRegistrar, srv GeminiWrapperServer) {
+	// If the following call pancis, it indicates UnimplementedGeminiWrapperServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&GeminiWrapper_ServiceDesc, srv)
+}
+
+func _GeminiWrapper_Ask_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AskRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(GeminiWrapperServer).Ask(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: GeminiWrapper_Ask_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(GeminiWrapperServer).Ask(ctx, req.(*AskRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _GeminiWrapper_AskStream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(AskRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(GeminiWrapperServer).AskStream(m, &grpc.GenericServerStream[AskRequest, AskStreamResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type GeminiWrapper_AskStreamServer = grpc.ServerStreamingServer[AskStreamResponse]
+
+func _GeminiWrapper_GetStatus_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetStatusRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(GeminiWrapperServer).GetStatus(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: GeminiWrapper_GetStatus_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(GeminiWrapperServer).GetStatus(ctx, req.(*GetStatusRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// GeminiWrapper_ServiceDesc is the grpc.ServiceDesc for GeminiWrapper service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var GeminiWrapper_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "geminiwrapper.v1.GeminiWrapper",
+	HandlerType: (*GeminiWrapperServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Ask",
+			Handler:    _GeminiWrapper_Ask_Handler,
+		},
+		{
+			MethodName: "GetStatus",
+			Handler:    _GeminiWrapper_GetStatus_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "AskStream",
+			Handler:       _GeminiWrapper_AskStream_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "gemini_wrapper.proto",
+}
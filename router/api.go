@@ -5,36 +5,308 @@ import (
 
 	"gemini-wrapper/handler"
 	appmiddleware "gemini-wrapper/middleware"
+	"gemini-wrapper/service/accounting"
+	"gemini-wrapper/service/audit"
+	"gemini-wrapper/service/budget"
+	"gemini-wrapper/service/cluster"
+	"gemini-wrapper/service/idempotency"
+	"gemini-wrapper/service/ratelimit"
+	"gemini-wrapper/service/tenants"
 
 	"github.com/labstack/echo/v5"
 )
 
 type API struct {
-	Echo          *echo.Echo
-	GeminiHandler *handler.GeminiHandler
-	OpenAIHandler *handler.OpenAIHandler
-	OpenAIAPIKey  string
+	Echo           *echo.Echo
+	HealthHandler  *handler.HealthHandler
+	GeminiHandler  *handler.GeminiHandler
+	OpenAIHandler  *handler.OpenAIHandler
+	SessionHandler *handler.SessionHandler
+	JobHandler     *handler.JobHandler
+	// WorkspaceHandler enables /api/workspaces when set.
+	WorkspaceHandler *handler.WorkspaceHandler
+	// OllamaHandler enables /api/tags, /api/generate and /api/chat when set.
+	OllamaHandler *handler.OllamaHandler
+	// AnthropicHandler enables the Anthropic Messages API under /v1/messages
+	// when set.
+	AnthropicHandler *handler.AnthropicHandler
+	// FileHandler enables the Gemini Files API when set.
+	FileHandler *handler.FileHandler
+	// Passthrough receives the /v1beta requests no route serves locally,
+	// and the uploads when FileHandler is nil, when set.
+	Passthrough     http.Handler
+	TemplateHandler *handler.TemplateHandler
+	AdminHandler    *handler.AdminHandler
+	// VersionHandler enables /api/version when set.
+	VersionHandler *handler.VersionHandler
+	// DebugHandler enables /debug/pprof and /debug/state, for the admin
+	// keys, when set.
+	DebugHandler *handler.DebugHandler
+	AuditHandler *handler.AuditHandler
+	OpenAIAPIKey string
+	// IPFilter refuses clients by address on /api, /v1beta, /v1, /admin and
+	// /debug when set.
+	IPFilter *appmiddleware.IPFilter
+	// APIKeys protects /api, /v1beta and /v1 when non-empty.
+	APIKeys []appmiddleware.APIKey
+	// InFlight sheds requests to /api, /v1beta and /v1 beyond its limit when
+	// set.
+	InFlight *appmiddleware.InFlightLimiter
+	// RateLimiter applies per-client quotas to /api, /v1beta and /v1 when set.
+	RateLimiter *ratelimit.Limiter
+	// Tenants applies the profile of the tenant of the API key to /api,
+	// /v1beta and /v1 when set.
+	Tenants *tenants.Registry
+	// Budget applies the daily and monthly budgets to /api, /v1beta and /v1
+	// when set.
+	Budget *budget.Budget
+	// Idempotency replays the responses of repeated Idempotency-Keys on
+	// /api, /v1beta and /v1 when set.
+	Idempotency *idempotency.Store
+	// Accounting records per-client usage of /api, /v1beta and /v1 when set.
+	Accounting *accounting.Store
+	// Audit records the questions asked on /api, /v1beta and /v1 when set.
+	Audit *audit.Log
+	// Cluster forwards the requests for sessions held by other replicas to
+	// them when set.
+	Cluster *cluster.Cluster
+	// MaxBodyBytes caps how much of a body the stream scope check reads.
+	MaxBodyBytes int64
+	// AdminAPIKey enables the /admin routes, as does any API key with the
+	// admin scope.
+	AdminAPIKey string
 }
 
 func (api *API) SetupRouter() {
-	healthHandler := func(c *echo.Context) error {
-		return c.JSON(http.StatusOK, map[string]string{
-			"message": "Gemini Wrapper API",
-			"status":  "running",
-		})
+	healthHandler := api.HealthHandler.Root
+	if api.SessionHandler != nil && api.Cluster.Self() != "" {
+		api.Echo.Pre(appmiddleware.RouteSessions(api.Cluster))
 	}
 
 	api.Echo.GET("/", healthHandler)
 	api.Echo.HEAD("/", healthHandler)
-	api.Echo.POST("/api/ask", api.GeminiHandler.HandleAsk)
-	api.Echo.POST("/v1beta/models/:model", api.GeminiHandler.HandleGeminiAPI)
+	api.Echo.GET("/livez", api.HealthHandler.Livez)
+	api.Echo.GET("/readyz", api.HealthHandler.Readyz)
+	api.Echo.GET("/metrics", handler.Metrics)
+
+	geminiIPs := appmiddleware.FilterIPs(appmiddleware.IPFilterConfig{Filter: api.IPFilter, ErrorFormat: appmiddleware.ErrorFormatGemini})
+	geminiShed := appmiddleware.LimitInFlight(appmiddleware.InFlightConfig{Limiter: api.InFlight, ErrorFormat: appmiddleware.ErrorFormatGemini})
+	geminiAuth := appmiddleware.RequireAPIKey(appmiddleware.APIKeyAuthConfig{Keys: api.APIKeys, ErrorFormat: appmiddleware.ErrorFormatGemini})
+	geminiLimit := appmiddleware.RateLimit(appmiddleware.RateLimitConfig{Limiter: api.RateLimiter, ErrorFormat: appmiddleware.ErrorFormatGemini})
+	geminiBudget := appmiddleware.EnforceBudget(appmiddleware.BudgetConfig{Budget: api.Budget, ErrorFormat: appmiddleware.ErrorFormatGemini})
+	geminiIdempotency := appmiddleware.Idempotency(appmiddleware.IdempotencyConfig{Store: api.Idempotency, ErrorFormat: appmiddleware.ErrorFormatGemini})
+	accountUsage := appmiddleware.AccountUsage(api.Accounting)
+	auditRequests := appmiddleware.AuditRequests(api.Audit)
+	selectTenant := appmiddleware.SelectTenant(api.Tenants)
+	geminiFeature := func(feature string) echo.MiddlewareFunc {
+		return appmiddleware.RequireFeature(feature, appmiddleware.ErrorFormatGemini)
+	}
+	geminiScope := func(scope string) echo.MiddlewareFunc {
+		return appmiddleware.RequireScope(scope, appmiddleware.ErrorFormatGemini)
+	}
+	askScope := geminiScope(appmiddleware.ScopeAsk)
+	// Admins are the admin key and the API keys with the admin scope.
+	adminKeys := appmiddleware.KeysWithScope(api.APIKeys, appmiddleware.ScopeAdmin)
+	if api.AdminAPIKey != "" {
+		adminKeys = append([]appmiddleware.APIKey{{Key: api.AdminAPIKey, Label: "admin"}}, adminKeys...)
+	}
+	if api.VersionHandler != nil {
+		// Checking compatibility runs no prompt, so it is neither rate
+		// limited nor counted.
+		api.Echo.GET("/api/version", api.VersionHandler.Version, geminiIPs, geminiAuth)
+	}
+	// The self-test asks at most once per interval however often it is
+	// polled, so like the probes it is neither rate limited nor counted.
+	api.Echo.GET("/api/selftest", api.HealthHandler.SelfTest, geminiIPs, geminiAuth)
+	simple := api.Echo.Group("/api", geminiIPs, geminiShed, geminiAuth, appmiddleware.IdentifyClient(), selectTenant, geminiIdempotency, accountUsage, auditRequests, geminiLimit, geminiBudget)
+	ask := geminiFeature(tenants.FeatureAsk)
+	// A body with "stream": true streams the answer, which needs the stream
+	// scope like /api/ask/stream.
+	simple.POST("/ask", api.GeminiHandler.HandleAsk, ask, askScope, appmiddleware.RequireStreamScope(appmiddleware.ErrorFormatGemini, false, api.MaxBodyBytes))
+	simple.POST("/ask/stream", api.GeminiHandler.HandleAskStream, ask, askScope, geminiScope(appmiddleware.ScopeStream))
+	simple.POST("/ask/batch", api.GeminiHandler.HandleAskBatch, ask, askScope)
+	simple.POST("/ask/:request_id/cancel", api.GeminiHandler.CancelAsk, ask, askScope)
+	simple.POST("/embed", api.GeminiHandler.HandleEmbed, geminiFeature(tenants.FeatureEmbeddings), askScope)
+	if api.OllamaHandler != nil {
+		ollama := geminiFeature(tenants.FeatureOllama)
+		ollamaStream := appmiddleware.RequireStreamScope(appmiddleware.ErrorFormatGemini, true, api.MaxBodyBytes)
+		simple.GET("/tags", api.OllamaHandler.ListModels, ollama, askScope)
+		simple.POST("/generate", api.OllamaHandler.Generate, ollama, askScope, ollamaStream)
+		simple.POST("/chat", api.OllamaHandler.Chat, ollama, askScope, ollamaStream)
+	}
+
+	v1beta := api.Echo.Group("/v1beta", geminiIPs, geminiShed, geminiAuth, appmiddleware.IdentifyClient(), selectTenant, geminiIdempotency, accountUsage, auditRequests, geminiLimit, geminiBudget)
+	geminiAPI := geminiFeature(tenants.FeatureGeminiAPI)
+	v1beta.Use(askScope, appmiddleware.RequireStreamScope(appmiddleware.ErrorFormatGemini, false, api.MaxBodyBytes))
+	v1beta.GET("/models", api.GeminiHandler.ListModels, geminiAPI)
+	v1beta.GET("/models/:model", api.GeminiHandler.GetModel, geminiAPI)
+	v1beta.POST("/models/:model", api.GeminiHandler.HandleGeminiAPI, geminiAPI)
+
+	if api.FileHandler != nil {
+		files := geminiFeature(tenants.FeatureFiles)
+		v1beta.GET("/files", api.FileHandler.ListFiles, files)
+		v1beta.GET("/files/:name", api.FileHandler.GetFile, files)
+		v1beta.DELETE("/files/:name", api.FileHandler.DeleteFile, files)
+		// Uploads run no prompt, so they are not rate limited: a large file
+		// takes several requests.
+		upload := api.Echo.Group("/upload/v1beta", geminiIPs, geminiAuth, selectTenant, files, askScope)
+		upload.POST("/files", api.FileHandler.UploadFile)
+	}
+
+	if api.Passthrough != nil {
+		v1beta.Any("/*", echo.WrapHandler(api.Passthrough), geminiAPI)
+		if api.FileHandler == nil {
+			api.Echo.Group("/upload/v1beta", geminiIPs, geminiAuth, selectTenant, geminiAPI, askScope).Any("/*", echo.WrapHandler(api.Passthrough))
+		}
+	}
+
+	if api.SessionHandler != nil {
+		sessions := simple.Group("/sessions", geminiFeature(tenants.FeatureSessions), geminiScope(appmiddleware.ScopeSessions))
+		sessions.POST("", api.SessionHandler.CreateSession)
+		sessions.GET("", api.SessionHandler.ListSessions)
+		sessions.POST("/import", api.SessionHandler.ImportSession)
+		sessions.GET("/:id", api.SessionHandler.GetSession)
+		sessions.GET("/:id/history", api.SessionHandler.GetSessionHistory)
+		sessions.DELETE("/:id", api.SessionHandler.DeleteSession)
+		sessions.POST("/:id/restore", api.SessionHandler.RestoreSession)
+		sessions.POST("/:id/ask", api.SessionHandler.AskSession)
+		sessions.POST("/:id/compress", api.SessionHandler.CompressSession)
+		sessions.GET("/:id/context", api.SessionHandler.GetSessionContext)
+		sessions.PUT("/:id/context", api.SessionHandler.PutSessionContext)
+		sessions.DELETE("/:id/context", api.SessionHandler.DeleteSessionContext)
+	}
+
+	if api.JobHandler != nil {
+		jobs := simple.Group("/jobs", geminiFeature(tenants.FeatureJobs), askScope)
+		jobs.POST("", api.JobHandler.CreateJob)
+		jobs.GET("/:id", api.JobHandler.GetJob)
+		jobs.DELETE("/:id", api.JobHandler.CancelJob)
+		jobs.POST("/:id/cancel", api.JobHandler.CancelJob)
+	}
+
+	if api.WorkspaceHandler != nil {
+		workspaces := simple.Group("/workspaces", geminiFeature(tenants.FeatureWorkspaces), geminiScope(appmiddleware.ScopeWorkspaces))
+		workspaces.POST("", api.WorkspaceHandler.CreateWorkspace)
+		workspaces.GET("", api.WorkspaceHandler.ListWorkspaces)
+		workspaces.GET("/:id", api.WorkspaceHandler.GetWorkspace)
+		workspaces.DELETE("/:id", api.WorkspaceHandler.DeleteWorkspace)
+		workspaces.PUT("/:id/files/*", api.WorkspaceHandler.PutFile)
+		workspaces.GET("/:id/files/*", api.WorkspaceHandler.GetFile)
+		workspaces.DELETE("/:id/files/*", api.WorkspaceHandler.DeleteFile)
+		workspaces.GET("/:id/diff", api.WorkspaceHandler.GetDiff)
+		workspaces.GET("/:id/archive", api.WorkspaceHandler.GetArchive)
+		workspaces.POST("/:id/ask", api.WorkspaceHandler.AskWorkspace)
+		workspaces.GET("/:id/context", api.WorkspaceHandler.GetWorkspaceContext)
+		workspaces.PUT("/:id/context", api.WorkspaceHandler.PutWorkspaceContext)
+		workspaces.DELETE("/:id/context", api.WorkspaceHandler.DeleteWorkspaceContext)
+	}
+
+	if api.TemplateHandler != nil {
+		templates := simple.Group("/templates", geminiFeature(tenants.FeatureTemplates), askScope)
+		templates.POST("", api.TemplateHandler.CreateTemplate)
+		templates.GET("", api.TemplateHandler.ListTemplates)
+		templates.GET("/:name", api.TemplateHandler.GetTemplate)
+		templates.PUT("/:name", api.TemplateHandler.PutTemplate)
+		templates.DELETE("/:name", api.TemplateHandler.DeleteTemplate)
+	}
 
 	if api.OpenAIHandler != nil {
-		v1 := api.Echo.Group("/v1")
-		v1.Use(appmiddleware.RequireBearerAuth(appmiddleware.AuthConfig{APIKey: api.OpenAIAPIKey}))
+		v1 := api.Echo.Group("/v1",
+			appmiddleware.FilterIPs(appmiddleware.IPFilterConfig{Filter: api.IPFilter, ErrorFormat: appmiddleware.ErrorFormatOpenAI}),
+			appmiddleware.LimitInFlight(appmiddleware.InFlightConfig{Limiter: api.InFlight, ErrorFormat: appmiddleware.ErrorFormatOpenAI}),
+		)
+		if len(api.APIKeys) > 0 {
+			keys := api.APIKeys
+			if api.OpenAIAPIKey != "" {
+				keys = append(append([]appmiddleware.APIKey(nil), keys...), appmiddleware.APIKey{Key: api.OpenAIAPIKey, Label: "openai"})
+			}
+			v1.Use(appmiddleware.RequireAPIKey(appmiddleware.APIKeyAuthConfig{Keys: keys, ErrorFormat: appmiddleware.ErrorFormatOpenAI}))
+		} else {
+			v1.Use(appmiddleware.RequireBearerAuth(appmiddleware.AuthConfig{APIKey: api.OpenAIAPIKey}))
+		}
+		v1.Use(appmiddleware.IdentifyClient())
+		v1.Use(selectTenant)
+		v1.Use(appmiddleware.RequireFeature(tenants.FeatureOpenAI, appmiddleware.ErrorFormatOpenAI))
+		v1.Use(appmiddleware.RequireScope(appmiddleware.ScopeAsk, appmiddleware.ErrorFormatOpenAI))
+		v1.Use(appmiddleware.RequireStreamScope(appmiddleware.ErrorFormatOpenAI, false, api.MaxBodyBytes))
+		v1.Use(appmiddleware.Idempotency(appmiddleware.IdempotencyConfig{Store: api.Idempotency, ErrorFormat: appmiddleware.ErrorFormatOpenAI}))
+		v1.Use(accountUsage)
+		v1.Use(auditRequests)
+		v1.Use(appmiddleware.RateLimit(appmiddleware.RateLimitConfig{Limiter: api.RateLimiter, ErrorFormat: appmiddleware.ErrorFormatOpenAI}))
+		v1.Use(appmiddleware.EnforceBudget(appmiddleware.BudgetConfig{Budget: api.Budget, ErrorFormat: appmiddleware.ErrorFormatOpenAI}))
 		v1.GET("/models", api.OpenAIHandler.ListModels)
 		v1.POST("/chat/completions", api.OpenAIHandler.CreateChatCompletion)
 		v1.POST("/completions", api.OpenAIHandler.CreateCompletion)
 		v1.POST("/responses", api.OpenAIHandler.CreateResponse)
 	}
+
+	if api.AnthropicHandler != nil {
+		// Anthropic clients send their key as x-api-key. They share the keys
+		// of the OpenAI routes, but get errors in their own format.
+		keys := api.APIKeys
+		if api.OpenAIAPIKey != "" {
+			keys = append(append([]appmiddleware.APIKey(nil), keys...), appmiddleware.APIKey{Key: api.OpenAIAPIKey, Label: "openai"})
+		}
+		messages := api.Echo.Group("/v1/messages",
+			appmiddleware.FilterIPs(appmiddleware.IPFilterConfig{Filter: api.IPFilter, ErrorFormat: appmiddleware.ErrorFormatAnthropic}),
+			appmiddleware.LimitInFlight(appmiddleware.InFlightConfig{Limiter: api.InFlight, ErrorFormat: appmiddleware.ErrorFormatAnthropic}),
+			appmiddleware.RequireAPIKey(appmiddleware.APIKeyAuthConfig{Keys: keys, ErrorFormat: appmiddleware.ErrorFormatAnthropic}),
+			appmiddleware.IdentifyClient(),
+			selectTenant,
+			appmiddleware.RequireFeature(tenants.FeatureAnthropic, appmiddleware.ErrorFormatAnthropic),
+			appmiddleware.RequireScope(appmiddleware.ScopeAsk, appmiddleware.ErrorFormatAnthropic),
+			appmiddleware.RequireStreamScope(appmiddleware.ErrorFormatAnthropic, false, api.MaxBodyBytes),
+			appmiddleware.Idempotency(appmiddleware.IdempotencyConfig{Store: api.Idempotency, ErrorFormat: appmiddleware.ErrorFormatAnthropic}),
+			accountUsage,
+			auditRequests,
+			appmiddleware.RateLimit(appmiddleware.RateLimitConfig{Limiter: api.RateLimiter, ErrorFormat: appmiddleware.ErrorFormatAnthropic}),
+			appmiddleware.EnforceBudget(appmiddleware.BudgetConfig{Budget: api.Budget, ErrorFormat: appmiddleware.ErrorFormatAnthropic}),
+		)
+		messages.POST("", api.AnthropicHandler.CreateMessage)
+		messages.POST("/count_tokens", api.AnthropicHandler.CountTokens)
+	}
+
+	if api.AdminHandler != nil && len(adminKeys) > 0 {
+		admin := api.Echo.Group("/admin", geminiIPs, appmiddleware.RequireAPIKey(appmiddleware.APIKeyAuthConfig{
+			Keys:        adminKeys,
+			ErrorFormat: appmiddleware.ErrorFormatGemini,
+		}))
+		admin.GET("/usage", api.AdminHandler.Usage)
+		admin.DELETE("/cache", api.AdminHandler.PurgeCache)
+		admin.GET("/backend", api.AdminHandler.Backend)
+		admin.POST("/backend/restart", api.AdminHandler.RestartBackend)
+		admin.GET("/console", api.AdminHandler.Console)
+		admin.GET("/mcp", api.AdminHandler.MCPServers)
+		admin.GET("/auth", api.AdminHandler.Auth)
+		admin.GET("/context", api.AdminHandler.Context)
+		admin.PUT("/context", api.AdminHandler.SetContext)
+		admin.DELETE("/context", api.AdminHandler.DeleteContext)
+		admin.POST("/context/refresh", api.AdminHandler.RefreshContext)
+		admin.DELETE("/queue", api.AdminHandler.ClearQueue)
+		admin.GET("/log-level", api.AdminHandler.LogLevel)
+		admin.PUT("/log-level", api.AdminHandler.SetLogLevel)
+		admin.POST("/cli-patterns/test", api.AdminHandler.TestCLIPatterns)
+		admin.POST("/command", api.AdminHandler.Command)
+		admin.POST("/config/reload", api.AdminHandler.ReloadConfig)
+		if api.AuditHandler != nil {
+			admin.GET("/audit", api.AuditHandler.Export)
+			admin.POST("/audit/:id/replay", api.AuditHandler.Replay)
+		}
+	}
+
+	if api.DebugHandler != nil && len(adminKeys) > 0 {
+		debug := api.Echo.Group("/debug", geminiIPs, appmiddleware.RequireAPIKey(appmiddleware.APIKeyAuthConfig{
+			Keys:        adminKeys,
+			ErrorFormat: appmiddleware.ErrorFormatGemini,
+		}))
+		debug.GET("/state", api.DebugHandler.State)
+		debug.GET("/pprof/*", api.DebugHandler.Pprof)
+		debug.POST("/pprof/symbol", api.DebugHandler.Pprof)
+	}
+
+	// The document describes the routes registered above, so it is built
+	// last.
+	openAPI := handler.NewOpenAPIHandler(api.Echo.Router().Routes(), len(api.APIKeys) > 0)
+	api.Echo.GET("/openapi.json", openAPI.Spec)
+	api.Echo.GET("/docs", openAPI.Explorer)
 }
@@ -0,0 +1,51 @@
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gemini-wrapper/handler"
+	appmiddleware "gemini-wrapper/middleware"
+	"gemini-wrapper/pkg/gemini"
+
+	"github.com/labstack/echo/v5"
+)
+
+func TestAskNeedsTheStreamScopeToStream(t *testing.T) {
+	cfg := gemini.DefaultConfig()
+	cfg.Backend = "mock"
+	service := gemini.NewGeminiServiceWithConfig(cfg)
+	defer service.Close()
+	keys, err := appmiddleware.ScopeAPIKeys([]appmiddleware.APIKey{{Key: "chat-secret", Label: "chat"}}, map[string][]string{"chat": {appmiddleware.ScopeAsk}})
+	if err != nil {
+		t.Fatalf("ScopeAPIKeys: %v", err)
+	}
+	e := echo.New()
+	binder := handler.NewBinder(1 << 20)
+	e.Binder = binder
+	e.Validator = binder
+	api := &API{
+		Echo:          e,
+		HealthHandler: handler.NewHealthHandler(service, 0),
+		GeminiHandler: handler.NewGeminiHandler(service, nil, nil, nil, nil, nil, 0),
+		APIKeys:       keys,
+		MaxBodyBytes:  1 << 20,
+	}
+	api.SetupRouter()
+
+	for body, want := range map[string]int{
+		`{"question":"hi","stream":true}`: http.StatusForbidden,
+		`{"question":"hi"}`:               http.StatusOK,
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/api/ask", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer chat-secret")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Fatalf("%s: expected %d, got %d: %s", body, want, rec.Code, rec.Body)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+// Package accesslog writes one line per HTTP request with the fields
+// operators need for the Gemini API: the client, the model that answered and
+// the tokens it used, besides the usual method, path, status and latency.
+//
+// Lines are JSON or Apache combined format, written to stdout or to a file
+// that is rotated by size.
+package accesslog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gemini-wrapper/model"
+)
+
+const (
+	FormatJSON     = "json"
+	FormatCombined = "combined"
+)
+
+type Config struct {
+	Enabled bool `yaml:"enabled"`
+	// Format is "json" or "combined".
+	Format string `yaml:"format"`
+	// File is the path lines are appended to; empty writes to stdout.
+	File string `yaml:"file"`
+	// MaxSizeMB is the size at which File is rotated.
+	MaxSizeMB int `yaml:"max_size_mb"`
+	// MaxBackups is how many rotated files are kept next to File.
+	MaxBackups int `yaml:"max_backups"`
+	// SampleRate is the fraction of successful requests logged, from 0 to
+	// 1. Requests answered with 400 or above are always logged.
+	SampleRate float64 `yaml:"sample_rate"`
+}
+
+func DefaultConfig() Config {
+	return Config{Format: FormatJSON, MaxSizeMB: 100, MaxBackups: 5, SampleRate: 1}
+}
+
+// ApplyEnv overrides c with the ACCESS_LOG_* environment variables that are
+// set.
+func (c *Config) ApplyEnv() {
+	if raw := strings.TrimSpace(os.Getenv("ACCESS_LOG_ENABLED")); raw != "" {
+		if parsed, err := strconv.ParseBool(raw); err == nil {
+			c.Enabled = parsed
+		}
+	}
+	if format := strings.TrimSpace(os.Getenv("ACCESS_LOG_FORMAT")); format != "" {
+		c.Format = strings.ToLower(format)
+	}
+	if file := strings.TrimSpace(os.Getenv("ACCESS_LOG_FILE")); file != "" {
+		c.File = file
+	}
+	if raw := strings.TrimSpace(os.Getenv("ACCESS_LOG_MAX_SIZE_MB")); raw != "" {
+		if size, err := strconv.Atoi(raw); err == nil && size > 0 {
+			c.MaxSizeMB = size
+		}
+	}
+	if raw := strings.TrimSpace(os.Getenv("ACCESS_LOG_MAX_BACKUPS")); raw != "" {
+		if backups, err := strconv.Atoi(raw); err == nil && backups >= 0 {
+			c.MaxBackups = backups
+		}
+	}
+	if raw := strings.TrimSpace(os.Getenv("ACCESS_LOG_SAMPLE_RATE")); raw != "" {
+		if rate, err := strconv.ParseFloat(raw, 64); err == nil {
+			c.SampleRate = rate
+		}
+	}
+}
+
+// Validate rejects an unknown format and sample rates outside [0, 1].
+func (c Config) Validate() error {
+	if c.Format != FormatJSON && c.Format != FormatCombined {
+		return fmt.Errorf("format %q is not json or combined", c.Format)
+	}
+	if c.SampleRate < 0 || c.SampleRate > 1 {
+		return fmt.Errorf("sample_rate %v is not between 0 and 1", c.SampleRate)
+	}
+	return nil
+}
+
+// Entry is one request. APIKey is the label of the key the request
+// authenticated with; the key itself is never logged. Path leaves out the
+// query, which may carry the key.
+type Entry struct {
+	Time          time.Time            `json:"time"`
+	RequestID     string               `json:"requestId,omitempty"`
+	RemoteIP      string               `json:"remoteIp"`
+	Method        string               `json:"method"`
+	Path          string               `json:"path"`
+	Proto         string               `json:"proto"`
+	Status        int                  `json:"status"`
+	Bytes         int64                `json:"bytes"`
+	LatencyMillis int64                `json:"latencyMillis"`
+	APIKey        string               `json:"apiKey,omitempty"`
+	Model         string               `json:"model,omitempty"`
+	Usage         *model.UsageMetadata `json:"usage,omitempty"`
+	Cache         string               `json:"cache,omitempty"`
+	UserAgent     string               `json:"userAgent,omitempty"`
+	Referer       string               `json:"referer,omitempty"`
+}
+
+// Logger writes entries. A nil *Logger logs nothing.
+type Logger struct {
+	cfg    Config
+	sample func() float64
+
+	mu  sync.Mutex
+	out io.Writer
+}
+
+// Open validates cfg and opens its file, or stdout.
+func Open(cfg Config) (*Logger, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	var out io.Writer = os.Stdout
+	if cfg.File != "" {
+		file, err := openRotatingFile(cfg.File, int64(cfg.MaxSizeMB)<<20, cfg.MaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		out = file
+	}
+	return newLogger(cfg, out), nil
+}
+
+func newLogger(cfg Config, out io.Writer) *Logger {
+	return &Logger{cfg: cfg, sample: rand.Float64, out: out}
+}
+
+// Log writes e, unless it is a successful request left out by sampling.
+func (l *Logger) Log(e Entry) error {
+	if l == nil {
+		return nil
+	}
+	if e.Status < 400 && l.cfg.SampleRate < 1 && l.sample() >= l.cfg.SampleRate {
+		return nil
+	}
+	var line []byte
+	if l.cfg.Format == FormatCombined {
+		line = combinedLine(e)
+	} else {
+		var err error
+		if line, err = json.Marshal(e); err != nil {
+			return err
+		}
+		line = append(line, '\n')
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.out.Write(line); err != nil {
+		return fmt.Errorf("write access log: %w", err)
+	}
+	return nil
+}
+
+// Close closes the file of l, if it writes to one.
+func (l *Logger) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if file, ok := l.out.(*rotatingFile); ok {
+		return file.Close()
+	}
+	return nil
+}
+
+// combinedLine formats e in the Apache combined format, followed by the
+// Gemini fields as key=value pairs that combined parsers ignore.
+func combinedLine(e Entry) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s - %s [%s] %q %d %s %q %q",
+		orDash(e.RemoteIP), orDash(e.APIKey), e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		e.Method+" "+e.Path+" "+e.Proto, e.Status, bytesField(e.Bytes), orDash(e.Referer), orDash(e.UserAgent))
+	fmt.Fprintf(&b, " request_id=%s latency_ms=%d model=%s", orDash(e.RequestID), e.LatencyMillis, orDash(e.Model))
+	if e.Usage != nil {
+		fmt.Fprintf(&b, " prompt_tokens=%d candidates_tokens=%d total_tokens=%d", e.Usage.PromptTokenCount, e.Usage.CandidatesTokenCount, e.Usage.TotalTokenCount)
+	}
+	if e.Cache != "" {
+		fmt.Fprintf(&b, " cache=%s", e.Cache)
+	}
+	b.WriteByte('\n')
+	return []byte(b.String())
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// bytesField is %b: the response size, or "-" for an empty body.
+func bytesField(n int64) string {
+	if n <= 0 {
+		return "-"
+	}
+	return strconv.FormatInt(n, 10)
+}
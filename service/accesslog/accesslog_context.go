@@ -0,0 +1,67 @@
+package accesslog
+
+import (
+	"context"
+	"sync"
+
+	"gemini-wrapper/model"
+	"gemini-wrapper/service/usage"
+)
+
+// Report collects what the service learns about a request while serving
+// it: the model that answered and the tokens used.
+type Report struct {
+	mu    sync.Mutex
+	model string
+	usage *model.UsageMetadata
+}
+
+type reportKey struct{}
+
+// WithReport attaches a new Report to ctx. It adds up the usage recorded
+// with the returned context.
+func WithReport(ctx context.Context) (context.Context, *Report) {
+	report := &Report{}
+	ctx = usage.WithRecorder(ctx, func(u model.UsageMetadata) {
+		report.mu.Lock()
+		defer report.mu.Unlock()
+		if report.usage == nil {
+			report.usage = &model.UsageMetadata{}
+		}
+		report.usage.PromptTokenCount += u.PromptTokenCount
+		report.usage.CandidatesTokenCount += u.CandidatesTokenCount
+		report.usage.TotalTokenCount += u.TotalTokenCount
+		report.usage.CachedContentTokenCount += u.CachedContentTokenCount
+		report.usage.ThoughtsTokenCount += u.ThoughtsTokenCount
+		report.usage.ToolUsePromptTokenCount += u.ToolUsePromptTokenCount
+	})
+	return context.WithValue(ctx, reportKey{}, report), report
+}
+
+// RecordModel stores the model that answered in the Report attached to ctx,
+// if any. The last question of a request wins.
+func RecordModel(ctx context.Context, name string) {
+	if report, ok := ctx.Value(reportKey{}).(*Report); ok && name != "" {
+		report.mu.Lock()
+		report.model = name
+		report.mu.Unlock()
+	}
+}
+
+// Model returns the recorded model, or "".
+func (r *Report) Model() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.model
+}
+
+// Usage returns the tokens recorded so far, or nil when none were.
+func (r *Report) Usage() *model.UsageMetadata {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.usage == nil {
+		return nil
+	}
+	u := *r.usage
+	return &u
+}
@@ -0,0 +1,127 @@
+package accesslog
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gemini-wrapper/model"
+	"gemini-wrapper/service/usage"
+)
+
+func TestLogFormats(t *testing.T) {
+	entry := Entry{
+		Time:          time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC),
+		RequestID:     "req-1",
+		RemoteIP:      "10.0.0.7",
+		Method:        "POST",
+		Path:          "/v1beta/models/gemini-2.5-flash:generateContent",
+		Proto:         "HTTP/1.1",
+		Status:        200,
+		Bytes:         512,
+		LatencyMillis: 1250,
+		APIKey:        "web",
+		Model:         "gemini-2.5-flash",
+		Usage:         &model.UsageMetadata{PromptTokenCount: 10, CandidatesTokenCount: 20, TotalTokenCount: 30},
+		UserAgent:     "curl/8.0",
+	}
+
+	var out bytes.Buffer
+	if err := newLogger(Config{Format: FormatCombined, SampleRate: 1}, &out).Log(entry); err != nil {
+		t.Fatal(err)
+	}
+	want := `10.0.0.7 - web [10/Mar/2026:12:00:00 +0000] "POST /v1beta/models/gemini-2.5-flash:generateContent HTTP/1.1" 200 512 "-" "curl/8.0" request_id=req-1 latency_ms=1250 model=gemini-2.5-flash prompt_tokens=10 candidates_tokens=20 total_tokens=30` + "\n"
+	if out.String() != want {
+		t.Fatalf("unexpected combined line:\n got %q\nwant %q", out.String(), want)
+	}
+
+	out.Reset()
+	if err := newLogger(Config{Format: FormatJSON, SampleRate: 1}, &out).Log(entry); err != nil {
+		t.Fatal(err)
+	}
+	var logged Entry
+	if err := json.Unmarshal(out.Bytes(), &logged); err != nil {
+		t.Fatalf("expected a JSON line, got %q: %v", out.String(), err)
+	}
+	if logged.APIKey != "web" || logged.Model != "gemini-2.5-flash" || logged.Usage == nil || logged.Usage.TotalTokenCount != 30 || logged.LatencyMillis != 1250 {
+		t.Fatalf("unexpected JSON entry %#v", logged)
+	}
+}
+
+func TestLogSamplesOnlySuccessfulRequests(t *testing.T) {
+	var out bytes.Buffer
+	l := newLogger(Config{Format: FormatJSON, SampleRate: 0.5}, &out)
+	draws := []float64{0.7, 0.2}
+	l.sample = func() float64 {
+		draw := draws[0]
+		draws = draws[1:]
+		return draw
+	}
+
+	for _, status := range []int{200, 200, 503} {
+		if err := l.Log(Entry{Status: status}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[1], `"status":503`) {
+		t.Fatalf("expected one sampled success and the error, got %q", out.String())
+	}
+}
+
+func TestOpenRotatesTheFileBySize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	l, err := Open(Config{Format: FormatCombined, File: path, MaxBackups: 2, SampleRate: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	// Each line is about 110 bytes; rotate after every second one.
+	l.out.(*rotatingFile).maxSize = 250
+
+	for i := range 7 {
+		if err := l.Log(Entry{RemoteIP: "10.0.0.1", Method: "GET", Path: "/health", Proto: "HTTP/1.1", Status: 200 + i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for file, want := range map[string]string{path: " 206 ", path + ".1": " 205 ", path + ".2": " 203 "} {
+		data, err := os.ReadFile(file)
+		if err != nil || !strings.Contains(string(data), want) {
+			t.Fatalf("expected %s to hold status%s, got %q (%v)", file, want, data, err)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("expected only 2 backups, got %v", err)
+	}
+}
+
+func TestOpenRejectsInvalidConfig(t *testing.T) {
+	for _, cfg := range []Config{{Format: "xml", SampleRate: 1}, {Format: FormatJSON, SampleRate: 1.5}} {
+		if _, err := Open(cfg); err == nil {
+			t.Fatalf("expected %#v to be rejected", cfg)
+		}
+	}
+}
+
+func TestReportCollectsModelAndUsage(t *testing.T) {
+	RecordModel(context.Background(), "gemini-2.5-pro") // no report attached: must not panic
+
+	ctx, report := WithReport(context.Background())
+	if report.Model() != "" || report.Usage() != nil {
+		t.Fatalf("expected an empty report, got %q %#v", report.Model(), report.Usage())
+	}
+	usage.Record(ctx, model.UsageMetadata{PromptTokenCount: 3, CandidatesTokenCount: 4, TotalTokenCount: 7})
+	usage.Record(ctx, model.UsageMetadata{PromptTokenCount: 1, CandidatesTokenCount: 1, TotalTokenCount: 2})
+	RecordModel(ctx, "gemini-2.5-flash")
+	if report.Model() != "gemini-2.5-flash" {
+		t.Fatalf("expected the recorded model, got %q", report.Model())
+	}
+	if u := report.Usage(); u == nil || u.PromptTokenCount != 4 || u.CandidatesTokenCount != 5 || u.TotalTokenCount != 9 {
+		t.Fatalf("expected the usage to add up, got %#v", u)
+	}
+}
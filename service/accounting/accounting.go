@@ -0,0 +1,363 @@
+// Package accounting keeps per-client usage counters in a Bolt database so
+// operators can audit and bill who consumes the shared Gemini quota.
+//
+// Counters are kept per client and UTC hour. They are buffered in memory and
+// written every FlushInterval, so a crash loses at most that much usage.
+package accounting
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gemini-wrapper/service/storage"
+)
+
+// StoreName is the store of the counters in the database.
+const StoreName = "usage_hourly"
+
+type Config struct {
+	Enabled bool   `yaml:"enabled"`
+	Path    string `yaml:"path"`
+	// Retention is how long hourly counters are kept. 0 keeps them forever.
+	Retention     time.Duration `yaml:"retention"`
+	FlushInterval time.Duration `yaml:"flush_interval"`
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Path:          "/app/cache/usage.db",
+		Retention:     90 * 24 * time.Hour,
+		FlushInterval: 10 * time.Second,
+	}
+}
+
+// ApplyEnv overrides c with the USAGE_ACCOUNTING_* environment variables that are set.
+func (c *Config) ApplyEnv() {
+	if raw := strings.TrimSpace(os.Getenv("USAGE_ACCOUNTING_ENABLED")); raw != "" {
+		if parsed, err := strconv.ParseBool(raw); err == nil {
+			c.Enabled = parsed
+		}
+	}
+	if path := strings.TrimSpace(os.Getenv("USAGE_ACCOUNTING_PATH")); path != "" {
+		c.Path = path
+	}
+	if days := envInt("USAGE_ACCOUNTING_RETENTION_DAYS", -1); days >= 0 {
+		c.Retention = time.Duration(days) * 24 * time.Hour
+	}
+	if seconds := envInt("USAGE_ACCOUNTING_FLUSH_SECONDS", 0); seconds > 0 {
+		c.FlushInterval = time.Duration(seconds) * time.Second
+	}
+}
+
+// Counters is the usage of one client over some period. Latencies are in
+// milliseconds; LatencyMillis is their sum.
+type Counters struct {
+	Requests         int64 `json:"requests"`
+	Errors           int64 `json:"errors"`
+	PromptTokens     int64 `json:"promptTokens"`
+	CandidatesTokens int64 `json:"candidatesTokens"`
+	TotalTokens      int64 `json:"totalTokens"`
+	LatencyMillis    int64 `json:"latencyMillis"`
+	MaxLatencyMillis int64 `json:"maxLatencyMillis"`
+}
+
+func (c *Counters) add(other Counters) {
+	c.Requests += other.Requests
+	c.Errors += other.Errors
+	c.PromptTokens += other.PromptTokens
+	c.CandidatesTokens += other.CandidatesTokens
+	c.TotalTokens += other.TotalTokens
+	c.LatencyMillis += other.LatencyMillis
+	c.MaxLatencyMillis = max(c.MaxLatencyMillis, other.MaxLatencyMillis)
+}
+
+type hourKey struct {
+	hour   int64
+	client string
+}
+
+// encode orders keys by hour first so reports can scan a time range.
+func (k hourKey) encode() []byte {
+	key := make([]byte, 8, 8+len(k.client))
+	binary.BigEndian.PutUint64(key, uint64(k.hour))
+	return append(key, k.client...)
+}
+
+func decodeHourKey(key []byte) (hourKey, bool) {
+	if len(key) < 8 {
+		return hourKey{}, false
+	}
+	return hourKey{hour: int64(binary.BigEndian.Uint64(key[:8])), client: string(key[8:])}, true
+}
+
+// Store records and reports usage. A nil *Store records nothing.
+type Store struct {
+	cfg   Config
+	store storage.Store
+	// db holds the usage history when Open opened Config.Path. Close writes
+	// the buffered counters to it before closing it.
+	db  *storage.DB
+	now func() time.Time
+
+	mu      sync.Mutex
+	pending map[hourKey]*Counters
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Open opens or creates the database at cfg.Path and starts flushing to it.
+func Open(cfg Config) (*Store, error) {
+	db, err := storage.Open(cfg.Path)
+	if err != nil {
+		return nil, err
+	}
+	store, err := db.Store(StoreName)
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	s := OpenStorage(cfg, store)
+	s.db = db
+	return s, nil
+}
+
+// OpenStorage keeps the counters in store, such as a store of the database
+// all features share, and starts flushing to it.
+func OpenStorage(cfg Config, store storage.Store) *Store {
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = DefaultConfig().FlushInterval
+	}
+	s := &Store{
+		cfg:     cfg,
+		store:   store,
+		now:     time.Now,
+		pending: map[hourKey]*Counters{},
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go s.flushLoop()
+	return s
+}
+
+// Add charges counters to client in the current hour.
+func (s *Store) Add(client string, counters Counters) {
+	if s == nil {
+		return
+	}
+	key := hourKey{hour: s.now().UTC().Truncate(time.Hour).Unix(), client: client}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pending, ok := s.pending[key]
+	if !ok {
+		pending = &Counters{}
+		s.pending[key] = pending
+	}
+	pending.add(counters)
+}
+
+// Flush writes buffered counters to disk and drops counters older than the
+// retention.
+func (s *Store) Flush() error {
+	s.mu.Lock()
+	pending := s.pending
+	s.pending = map[hourKey]*Counters{}
+	s.mu.Unlock()
+
+	err := s.store.Update(func(tx storage.Store) error {
+		for key, counters := range pending {
+			encoded := string(key.encode())
+			stored := *counters
+			raw, err := tx.Get(encoded)
+			if err != nil {
+				return err
+			}
+			if raw != nil {
+				var previous Counters
+				if err := json.Unmarshal(raw, &previous); err == nil {
+					stored.add(previous)
+				}
+			}
+			if raw, err = json.Marshal(stored); err != nil {
+				return err
+			}
+			if err := tx.Put(encoded, raw); err != nil {
+				return err
+			}
+		}
+		if s.cfg.Retention <= 0 {
+			return nil
+		}
+		cutoff := hourKey{hour: s.now().Add(-s.cfg.Retention).Unix()}.encode()
+		var expired []string
+		if err := tx.ForEach("", string(cutoff), func(key string, _ []byte) error {
+			expired = append(expired, key)
+			return nil
+		}); err != nil {
+			return err
+		}
+		return tx.Delete(expired...)
+	})
+	if err != nil {
+		// Keep the counters for the next attempt.
+		s.mu.Lock()
+		for key, counters := range pending {
+			if current, ok := s.pending[key]; ok {
+				counters.add(*current)
+			}
+			s.pending[key] = counters
+		}
+		s.mu.Unlock()
+		return fmt.Errorf("flush usage counters: %w", err)
+	}
+	return nil
+}
+
+func (s *Store) flushLoop() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.cfg.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.Flush(); err != nil {
+				slog.Warn("usage accounting flush failed", "error", err)
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// Close writes the buffered counters and closes the database.
+func (s *Store) Close() error {
+	if s == nil {
+		return nil
+	}
+	close(s.stop)
+	<-s.done
+	return errors.Join(s.Flush(), s.db.Close())
+}
+
+// Report granularities.
+const (
+	BucketHour = "hour"
+	BucketDay  = "day"
+)
+
+// Query selects the usage to report. Client "" reports every client.
+type Query struct {
+	From   time.Time
+	To     time.Time
+	Bucket string
+	Client string
+}
+
+// Bucket is the usage of one client in one period starting at Start.
+type Bucket struct {
+	Start time.Time `json:"start"`
+	Counters
+	AvgLatencyMillis int64 `json:"avgLatencyMillis"`
+}
+
+type ClientReport struct {
+	Client  string   `json:"client"`
+	Total   Counters `json:"total"`
+	Buckets []Bucket `json:"buckets"`
+}
+
+type Report struct {
+	Bucket  string         `json:"bucket"`
+	From    time.Time      `json:"from"`
+	To      time.Time      `json:"to"`
+	Clients []ClientReport `json:"clients"`
+}
+
+// Report aggregates the hourly counters in [q.From, q.To) into q.Bucket
+// periods, including counters not flushed yet.
+func (s *Store) Report(q Query) (Report, error) {
+	if q.Bucket != BucketHour && q.Bucket != BucketDay {
+		return Report{}, fmt.Errorf("unknown bucket %q, expected %q or %q", q.Bucket, BucketHour, BucketDay)
+	}
+	from := q.From.UTC().Truncate(time.Hour).Unix()
+	to := q.To.UTC().Unix()
+	byClient := map[string]map[int64]*Counters{}
+	collect := func(key hourKey, counters Counters) {
+		if key.hour < from || key.hour >= to || (q.Client != "" && key.client != q.Client) {
+			return
+		}
+		buckets, ok := byClient[key.client]
+		if !ok {
+			buckets = map[int64]*Counters{}
+			byClient[key.client] = buckets
+		}
+		start := key.hour
+		if q.Bucket == BucketDay {
+			start = time.Unix(key.hour, 0).UTC().Truncate(24 * time.Hour).Unix()
+		}
+		bucket, ok := buckets[start]
+		if !ok {
+			bucket = &Counters{}
+			buckets[start] = bucket
+		}
+		bucket.add(counters)
+	}
+
+	s.mu.Lock()
+	for key, counters := range s.pending {
+		collect(key, *counters)
+	}
+	s.mu.Unlock()
+
+	err := s.store.ForEach(string(hourKey{hour: from}.encode()), string(hourKey{hour: to}.encode()), func(raw string, value []byte) error {
+		key, ok := decodeHourKey([]byte(raw))
+		if !ok {
+			return nil
+		}
+		var counters Counters
+		if err := json.Unmarshal(value, &counters); err != nil {
+			return nil
+		}
+		collect(key, counters)
+		return nil
+	})
+	if err != nil {
+		return Report{}, err
+	}
+
+	report := Report{Bucket: q.Bucket, From: q.From.UTC(), To: q.To.UTC(), Clients: []ClientReport{}}
+	for client, buckets := range byClient {
+		clientReport := ClientReport{Client: client, Buckets: []Bucket{}}
+		for start, counters := range buckets {
+			clientReport.Total.add(*counters)
+			bucket := Bucket{Start: time.Unix(start, 0).UTC(), Counters: *counters}
+			if counters.Requests > 0 {
+				bucket.AvgLatencyMillis = counters.LatencyMillis / counters.Requests
+			}
+			clientReport.Buckets = append(clientReport.Buckets, bucket)
+		}
+		sort.Slice(clientReport.Buckets, func(i, j int) bool {
+			return clientReport.Buckets[i].Start.Before(clientReport.Buckets[j].Start)
+		})
+		report.Clients = append(report.Clients, clientReport)
+	}
+	sort.Slice(report.Clients, func(i, j int) bool { return report.Clients[i].Client < report.Clients[j].Client })
+	return report, nil
+}
+
+func envInt(key string, defaultValue int) int {
+	parsed, err := strconv.Atoi(strings.TrimSpace(os.Getenv(key)))
+	if err != nil || parsed < 0 {
+		return defaultValue
+	}
+	return parsed
+}
@@ -0,0 +1,128 @@
+package accounting
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gemini-wrapper/model"
+	"gemini-wrapper/service/usage"
+)
+
+func openTestStore(t *testing.T, path string, now *time.Time) *Store {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.Path = path
+	cfg.FlushInterval = time.Hour
+	s, err := Open(cfg)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	s.now = func() time.Time { return *now }
+	return s
+}
+
+func TestTrackRecordsRequestsTokensAndLatency(t *testing.T) {
+	now := time.Date(2026, 3, 1, 10, 30, 0, 0, time.UTC)
+	s := openTestStore(t, filepath.Join(t.TempDir(), "usage.db"), &now)
+	defer s.Close()
+
+	ctx, finish := s.Track(context.Background(), "key:team-a")
+	usage.Record(ctx, model.UsageMetadata{PromptTokenCount: 3, CandidatesTokenCount: 7, TotalTokenCount: 10})
+	now = now.Add(200 * time.Millisecond)
+	finish(false)
+
+	_, finish = s.Track(context.Background(), "key:team-a")
+	now = now.Add(400 * time.Millisecond)
+	finish(true)
+	// Tokens reported after the request was answered still count.
+	usage.Record(ctx, model.UsageMetadata{TotalTokenCount: 5})
+
+	report, err := s.Report(Query{From: now.Add(-time.Hour), To: now.Add(time.Hour), Bucket: BucketHour})
+	if err != nil {
+		t.Fatalf("Report: %v", err)
+	}
+	if len(report.Clients) != 1 || len(report.Clients[0].Buckets) != 1 {
+		t.Fatalf("unexpected report: %#v", report)
+	}
+	bucket := report.Clients[0].Buckets[0]
+	if bucket.Requests != 2 || bucket.Errors != 1 || bucket.TotalTokens != 15 || bucket.PromptTokens != 3 {
+		t.Fatalf("unexpected counters: %#v", bucket)
+	}
+	if bucket.AvgLatencyMillis != 300 || bucket.MaxLatencyMillis != 400 {
+		t.Fatalf("unexpected latency: avg=%d max=%d", bucket.AvgLatencyMillis, bucket.MaxLatencyMillis)
+	}
+	if !bucket.Start.Equal(time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)) {
+		t.Fatalf("unexpected bucket start %s", bucket.Start)
+	}
+}
+
+func TestCountersSurviveReopenAndAggregateByDay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.db")
+	now := time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC)
+	s := openTestStore(t, path, &now)
+	s.Add("key:a", Counters{Requests: 1, TotalTokens: 10})
+	now = now.Add(5 * time.Hour)
+	s.Add("key:a", Counters{Requests: 2, TotalTokens: 20})
+	s.Add("key:b", Counters{Requests: 1})
+	now = now.Add(24 * time.Hour)
+	s.Add("key:a", Counters{Requests: 4})
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	s = openTestStore(t, path, &now)
+	defer s.Close()
+	s.Add("key:a", Counters{Requests: 8})
+
+	report, err := s.Report(Query{From: now.Add(-72 * time.Hour), To: now.Add(time.Hour), Bucket: BucketDay, Client: "key:a"})
+	if err != nil {
+		t.Fatalf("Report: %v", err)
+	}
+	if len(report.Clients) != 1 || report.Clients[0].Client != "key:a" {
+		t.Fatalf("expected only key:a, got %#v", report.Clients)
+	}
+	a := report.Clients[0]
+	if len(a.Buckets) != 2 || a.Buckets[0].Requests != 3 || a.Buckets[0].TotalTokens != 30 || a.Buckets[1].Requests != 12 {
+		t.Fatalf("unexpected daily buckets: %#v", a.Buckets)
+	}
+	if a.Total.Requests != 15 {
+		t.Fatalf("unexpected total: %#v", a.Total)
+	}
+}
+
+func TestFlushDropsExpiredCounters(t *testing.T) {
+	now := time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC)
+	s := openTestStore(t, filepath.Join(t.TempDir(), "usage.db"), &now)
+	defer s.Close()
+	s.cfg.Retention = 48 * time.Hour
+
+	s.Add("key:a", Counters{Requests: 1})
+	if err := s.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	now = now.Add(72 * time.Hour)
+	if err := s.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	report, err := s.Report(Query{From: now.Add(-100 * time.Hour), To: now, Bucket: BucketDay})
+	if err != nil {
+		t.Fatalf("Report: %v", err)
+	}
+	if len(report.Clients) != 0 {
+		t.Fatalf("expected expired counters to be dropped, got %#v", report.Clients)
+	}
+}
+
+func TestNilStoreRecordsNothing(t *testing.T) {
+	var s *Store
+	ctx, finish := s.Track(context.Background(), "ip:1.2.3.4")
+	finish(true)
+	if ctx == nil {
+		t.Fatal("expected the context back")
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
@@ -0,0 +1,52 @@
+package accounting
+
+import (
+	"context"
+	"sync"
+
+	"gemini-wrapper/model"
+	"gemini-wrapper/service/usage"
+)
+
+// Track starts accounting one request of client. The returned context
+// collects the tokens the request uses; finish records the request once it
+// is answered. Tokens reported after finish, by background jobs for example,
+// are still charged to client.
+func (s *Store) Track(ctx context.Context, client string) (context.Context, func(failed bool)) {
+	if s == nil {
+		return ctx, func(bool) {}
+	}
+	start := s.now()
+	var mu sync.Mutex
+	var counters Counters
+	finished := false
+	ctx = usage.WithRecorder(ctx, func(u model.UsageMetadata) {
+		mu.Lock()
+		defer mu.Unlock()
+		if finished {
+			s.Add(client, tokenCounters(u))
+			return
+		}
+		counters.add(tokenCounters(u))
+	})
+	return ctx, func(failed bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		finished = true
+		counters.Requests = 1
+		if failed {
+			counters.Errors = 1
+		}
+		counters.LatencyMillis = s.now().Sub(start).Milliseconds()
+		counters.MaxLatencyMillis = counters.LatencyMillis
+		s.Add(client, counters)
+	}
+}
+
+func tokenCounters(u model.UsageMetadata) Counters {
+	return Counters{
+		PromptTokens:     int64(u.PromptTokenCount),
+		CandidatesTokens: int64(u.CandidatesTokenCount),
+		TotalTokens:      int64(u.TotalTokenCount),
+	}
+}
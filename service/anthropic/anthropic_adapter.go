@@ -0,0 +1,338 @@
+// Package anthropic serves the Anthropic Messages API on top of the Gemini
+// service, so tooling built for Anthropic can be pointed at the wrapper.
+package anthropic
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"gemini-wrapper/model"
+	"gemini-wrapper/pkg/gemini"
+	"gemini-wrapper/service/geminiapi"
+)
+
+const defaultModel = "gemini-2.5-flash"
+
+// Asker is the part of the Gemini service the adapter needs.
+type Asker interface {
+	AskWithOptions(ctx context.Context, question string, opts model.AskOptions) (string, *model.GeminiStatus, error)
+	AskStreamWithOptions(ctx context.Context, question string, opts model.AskOptions, onChunk func(chunk string) error) (string, *model.GeminiStatus, error)
+}
+
+type GeminiAdapter struct {
+	geminiService Asker
+	modelAliases  gemini.ModelAliases
+}
+
+func NewGeminiAdapter(geminiService Asker) *GeminiAdapter {
+	return &GeminiAdapter{geminiService: geminiService}
+}
+
+// SetModelAliases replaces the aliases, model_aliases.anthropic in the
+// configuration, given as alias to model. Aliases match regardless of case.
+func (a *GeminiAdapter) SetModelAliases(aliases map[string]string) {
+	a.modelAliases.Set(aliases)
+}
+
+func (a *GeminiAdapter) CreateMessage(ctx context.Context, req model.AnthropicMessageRequest) (model.AnthropicMessageResponse, error) {
+	question, opts, err := a.prepare(ctx, req)
+	if err != nil {
+		return model.AnthropicMessageResponse{}, err
+	}
+	answer, status, err := a.geminiService.AskWithOptions(ctx, question, opts)
+	if err != nil {
+		return model.AnthropicMessageResponse{}, convertGeminiError(err, status)
+	}
+
+	resp := newMessage(resolvedModel(opts.Model, status), buildUsage(question, answer, status))
+	resp.Content = []model.AnthropicTextBlock{{Type: "text", Text: answer}}
+	stopReason := stopReasonFor(status)
+	resp.StopReason = &stopReason
+	return resp, nil
+}
+
+// CreateMessageStream emits the events of a streamed message as Gemini
+// produces the answer: message_start, one text block and message_stop.
+// Validation and upstream errors that occur before the first event are
+// returned so the caller can still reply with a JSON error.
+func (a *GeminiAdapter) CreateMessageStream(ctx context.Context, req model.AnthropicMessageRequest, onEvent func(model.AnthropicStreamEvent) error) error {
+	question, opts, err := a.prepare(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	index := 0
+	started := false
+	start := func() error {
+		started = true
+		message := newMessage(opts.Model, model.AnthropicUsage{InputTokens: gemini.EstimateTokens(question)})
+		if err := onEvent(model.AnthropicStreamEvent{Type: "message_start", Message: &message}); err != nil {
+			return err
+		}
+		return onEvent(model.AnthropicStreamEvent{Type: "content_block_start", Index: &index, ContentBlock: &model.AnthropicTextBlock{Type: "text"}})
+	}
+	answer, status, err := a.geminiService.AskStreamWithOptions(ctx, question, opts, func(text string) error {
+		if !started {
+			if err := start(); err != nil {
+				return err
+			}
+		}
+		return onEvent(model.AnthropicStreamEvent{Type: "content_block_delta", Index: &index, Delta: &model.AnthropicDelta{Type: "text_delta", Text: text}})
+	})
+	if err != nil {
+		return convertGeminiError(err, status)
+	}
+	if !started {
+		if err := start(); err != nil {
+			return err
+		}
+	}
+
+	usage := buildUsage(question, answer, status)
+	if err := onEvent(model.AnthropicStreamEvent{Type: "content_block_stop", Index: &index}); err != nil {
+		return err
+	}
+	if err := onEvent(model.AnthropicStreamEvent{Type: "message_delta", Delta: &model.AnthropicDelta{StopReason: stopReasonFor(status)}, Usage: &usage}); err != nil {
+		return err
+	}
+	return onEvent(model.AnthropicStreamEvent{Type: "message_stop"})
+}
+
+// CountTokens estimates the input tokens of a request as the prompt the CLI
+// would get. Attached media are not counted.
+func (a *GeminiAdapter) CountTokens(_ context.Context, req model.AnthropicMessageRequest) (model.AnthropicCountTokensResponse, error) {
+	geminiReq, err := convertRequest(req)
+	if err != nil {
+		return model.AnthropicCountTokensResponse{}, err
+	}
+	question, err := geminiapi.BuildPrompt(geminiReq)
+	if err != nil {
+		return model.AnthropicCountTokensResponse{}, invalidRequest(err.Error())
+	}
+	return model.AnthropicCountTokensResponse{InputTokens: gemini.EstimateTokens(question)}, nil
+}
+
+// prepare turns req into the CLI prompt and the options to ask it with. The
+// conversation is rendered as a Gemini API request would be, with images
+// and documents handed over as attachments.
+func (a *GeminiAdapter) prepare(ctx context.Context, req model.AnthropicMessageRequest) (string, model.AskOptions, error) {
+	if a.geminiService == nil {
+		return "", model.AskOptions{}, &APIError{HTTPStatus: 500, Type: "api_error", Message: "Gemini backend is not initialized"}
+	}
+	if req.MaxTokens < 1 {
+		return "", model.AskOptions{}, invalidRequest("max_tokens: must be at least 1")
+	}
+	if req.Temperature != nil && (*req.Temperature < 0 || *req.Temperature > 1) {
+		return "", model.AskOptions{}, invalidRequest("temperature: must be between 0 and 1")
+	}
+	if req.TopP != nil && (*req.TopP < 0 || *req.TopP > 1) {
+		return "", model.AskOptions{}, invalidRequest("top_p: must be between 0 and 1")
+	}
+	if req.TopK != nil && *req.TopK < 0 {
+		return "", model.AskOptions{}, invalidRequest("top_k: must not be negative")
+	}
+	geminiReq, err := convertRequest(req)
+	if err != nil {
+		return "", model.AskOptions{}, err
+	}
+	question, err := geminiapi.BuildPrompt(geminiReq)
+	if err != nil {
+		return "", model.AskOptions{}, invalidRequest(err.Error())
+	}
+	attachments, err := geminiapi.Attachments(ctx, geminiReq, nil)
+	if err != nil {
+		return "", model.AskOptions{}, invalidRequest(err.Error())
+	}
+	return question, model.AskOptions{
+		Model: a.resolveModel(req.Model),
+		GenerationConfig: &model.GenerationConfig{
+			Temperature:     req.Temperature,
+			TopP:            req.TopP,
+			TopK:            req.TopK,
+			MaxOutputTokens: req.MaxTokens,
+			StopSequences:   req.StopSequences,
+		},
+		Attachments: attachments,
+	}, nil
+}
+
+// convertRequest maps the messages and system prompt of req onto a Gemini
+// API request. Tool use is not supported: the CLI cannot hand tool calls
+// back to the client.
+func convertRequest(req model.AnthropicMessageRequest) (model.GeminiAPIRequest, error) {
+	if len(req.Tools) > 0 {
+		return model.GeminiAPIRequest{}, invalidRequest("tools are not supported")
+	}
+	if len(req.Messages) == 0 {
+		return model.GeminiAPIRequest{}, invalidRequest("messages: at least one message is required")
+	}
+	var geminiReq model.GeminiAPIRequest
+	if len(req.System) > 0 {
+		parts, err := convertContent("system", req.System)
+		if err != nil {
+			return model.GeminiAPIRequest{}, err
+		}
+		geminiReq.SystemInstruction = &model.GeminiContent{Parts: parts}
+	}
+	for i, message := range req.Messages {
+		role := ""
+		switch message.Role {
+		case "user":
+			role = "user"
+		case "assistant":
+			role = "model"
+		default:
+			return model.GeminiAPIRequest{}, invalidRequest(fmt.Sprintf("messages.%d.role: must be user or assistant", i))
+		}
+		parts, err := convertContent(fmt.Sprintf("messages.%d.content", i), message.Content)
+		if err != nil {
+			return model.GeminiAPIRequest{}, err
+		}
+		geminiReq.Contents = append(geminiReq.Contents, model.GeminiContent{Role: role, Parts: parts})
+	}
+	return geminiReq, nil
+}
+
+func convertContent(where string, content model.AnthropicContent) ([]model.GeminiPart, error) {
+	parts := make([]model.GeminiPart, 0, len(content))
+	for i, block := range content {
+		switch block.Type {
+		case "text":
+			parts = append(parts, model.GeminiPart{Text: block.Text})
+		case "image", "document":
+			if where == "system" {
+				return nil, invalidRequest(fmt.Sprintf("system.%d.type: must be text", i))
+			}
+			part, err := convertSource(block.Source)
+			if err != nil {
+				return nil, invalidRequest(fmt.Sprintf("%s.%d.source: %v", where, i, err))
+			}
+			parts = append(parts, part)
+		default:
+			return nil, invalidRequest(fmt.Sprintf("%s.%d.type: content blocks of type %q are not supported", where, i, block.Type))
+		}
+	}
+	return parts, nil
+}
+
+func convertSource(source *model.AnthropicSource) (model.GeminiPart, error) {
+	if source == nil {
+		return model.GeminiPart{}, fmt.Errorf("is required")
+	}
+	switch source.Type {
+	case "base64":
+		return model.GeminiPart{InlineData: &model.Blob{MimeType: source.MediaType, Data: source.Data}}, nil
+	case "url":
+		return model.GeminiPart{FileData: &model.FileData{MimeType: source.MediaType, FileURI: source.URL}}, nil
+	case "text":
+		mediaType := source.MediaType
+		if mediaType == "" {
+			mediaType = "text/plain"
+		}
+		data := base64.StdEncoding.EncodeToString([]byte(source.Data))
+		return model.GeminiPart{InlineData: &model.Blob{MimeType: mediaType, Data: data}}, nil
+	}
+	return model.GeminiPart{}, fmt.Errorf("type %q is not supported", source.Type)
+}
+
+// resolveModel applies ANTHROPIC_MODEL_ALIASES and the default model. Claude
+// models without an alias get the default model, so clients that hard-code
+// one keep working.
+func (a *GeminiAdapter) resolveModel(requested string) string {
+	requested = strings.TrimSpace(requested)
+	if alias, ok := a.modelAliases.Lookup(requested); ok {
+		return alias
+	}
+	if requested == "" || strings.HasPrefix(strings.ToLower(requested), "claude") {
+		return defaultModel
+	}
+	return requested
+}
+
+func newMessage(modelName string, usage model.AnthropicUsage) model.AnthropicMessageResponse {
+	return model.AnthropicMessageResponse{
+		ID:      fmt.Sprintf("msg_%d", time.Now().UnixNano()),
+		Type:    "message",
+		Role:    "assistant",
+		Model:   modelName,
+		Content: []model.AnthropicTextBlock{},
+		Usage:   usage,
+	}
+}
+
+func resolvedModel(modelName string, status *model.GeminiStatus) string {
+	if status != nil && strings.TrimSpace(status.Model) != "" {
+		return status.Model
+	}
+	return modelName
+}
+
+// stopReasonFor maps the Gemini finish reason onto an Anthropic stop reason.
+func stopReasonFor(status *model.GeminiStatus) string {
+	if status != nil {
+		switch status.FinishReason {
+		case "MAX_TOKENS":
+			return "max_tokens"
+		case "SAFETY", "RECITATION", "BLOCKLIST", "PROHIBITED_CONTENT":
+			return "refusal"
+		}
+	}
+	return "end_turn"
+}
+
+// buildUsage reports the token counts from the CLI stats when available and
+// falls back to a local estimate otherwise.
+func buildUsage(prompt string, answer string, status *model.GeminiStatus) model.AnthropicUsage {
+	if status != nil && status.Usage != nil {
+		return model.AnthropicUsage{InputTokens: status.Usage.PromptTokenCount, OutputTokens: status.Usage.CandidatesTokenCount}
+	}
+	return model.AnthropicUsage{InputTokens: gemini.EstimateTokens(prompt), OutputTokens: gemini.EstimateTokens(answer)}
+}
+
+func invalidRequest(message string) *APIError {
+	return &APIError{HTTPStatus: 400, Type: "invalid_request_error", Message: message}
+}
+
+func convertGeminiError(err error, status *model.GeminiStatus) error {
+	if err == nil {
+		return nil
+	}
+
+	httpStatus := 500
+	if status != nil && status.HTTPStatus > 0 {
+		httpStatus = status.HTTPStatus
+	}
+	errType := "api_error"
+	switch httpStatus {
+	case 400:
+		errType = "invalid_request_error"
+	case 401:
+		errType = "authentication_error"
+	case 403:
+		errType = "permission_error"
+	case 404:
+		errType = "not_found_error"
+	case 413:
+		errType = "request_too_large"
+	case 429:
+		errType = "rate_limit_error"
+	case 503, 529:
+		errType = "overloaded_error"
+	}
+
+	slog.Warn("anthropic adapter upstream error", "status", httpStatus, "type", errType, "error", err)
+
+	message := "Upstream processing error"
+	if httpStatus >= 500 {
+		message = "An internal service error occurred"
+	}
+	if local, ok := gemini.LocalRejection(status); ok {
+		message = local
+	}
+
+	return &APIError{HTTPStatus: httpStatus, Type: errType, Message: message}
+}
@@ -0,0 +1,209 @@
+package anthropic
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"gemini-wrapper/model"
+	"gemini-wrapper/pkg/gemini"
+)
+
+type fakeAsker struct {
+	answer   string
+	status   *model.GeminiStatus
+	err      error
+	question string
+	opts     model.AskOptions
+}
+
+func (f *fakeAsker) AskWithOptions(_ context.Context, question string, opts model.AskOptions) (string, *model.GeminiStatus, error) {
+	f.question, f.opts = question, opts
+	if f.err != nil {
+		return "", f.status, f.err
+	}
+	return f.answer, f.status, nil
+}
+
+func (f *fakeAsker) AskStreamWithOptions(ctx context.Context, question string, opts model.AskOptions, onChunk func(chunk string) error) (string, *model.GeminiStatus, error) {
+	answer, status, err := f.AskWithOptions(ctx, question, opts)
+	if err != nil {
+		return "", status, err
+	}
+	for _, line := range strings.SplitAfter(answer, "\n") {
+		if err := onChunk(line); err != nil {
+			return "", status, err
+		}
+	}
+	return answer, status, nil
+}
+
+func textRequest(text string) model.AnthropicMessageRequest {
+	return model.AnthropicMessageRequest{
+		Model:     "claude-sonnet-4-5",
+		MaxTokens: 256,
+		Messages:  []model.AnthropicMessage{{Role: "user", Content: model.AnthropicContent{{Type: "text", Text: text}}}},
+	}
+}
+
+func TestCreateMessageMapsRolesAndSystem(t *testing.T) {
+	svc := &fakeAsker{answer: "hello"}
+	adapter := NewGeminiAdapter(svc)
+
+	req := textRequest("say hi")
+	req.System = model.AnthropicContent{{Type: "text", Text: "Be brief."}}
+	req.Messages = append(req.Messages,
+		model.AnthropicMessage{Role: "assistant", Content: model.AnthropicContent{{Type: "text", Text: "Hi!"}}},
+		model.AnthropicMessage{Role: "user", Content: model.AnthropicContent{{Type: "text", Text: "again"}}},
+	)
+	resp, err := adapter.CreateMessage(context.Background(), req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp.Type != "message" || resp.Role != "assistant" || len(resp.Content) != 1 || resp.Content[0].Text != "hello" {
+		t.Fatalf("unexpected response: %+v", resp)
+	}
+	if resp.StopReason == nil || *resp.StopReason != "end_turn" {
+		t.Fatalf("expected end_turn, got %v", resp.StopReason)
+	}
+	for _, want := range []string{"Be brief.", "say hi", "Hi!", "again"} {
+		if !strings.Contains(svc.question, want) {
+			t.Fatalf("expected prompt to contain %q, got %q", want, svc.question)
+		}
+	}
+	if svc.opts.Model != defaultModel {
+		t.Fatalf("expected claude model to map to %q, got %q", defaultModel, svc.opts.Model)
+	}
+	if svc.opts.GenerationConfig == nil || svc.opts.GenerationConfig.MaxOutputTokens != 256 {
+		t.Fatalf("expected max_tokens to become maxOutputTokens, got %+v", svc.opts.GenerationConfig)
+	}
+}
+
+func TestCreateMessageReportsMaxTokens(t *testing.T) {
+	svc := &fakeAsker{answer: "cut", status: &model.GeminiStatus{FinishReason: "MAX_TOKENS"}}
+	resp, err := NewGeminiAdapter(svc).CreateMessage(context.Background(), textRequest("long"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp.StopReason == nil || *resp.StopReason != "max_tokens" {
+		t.Fatalf("expected max_tokens, got %v", resp.StopReason)
+	}
+}
+
+func TestCreateMessageRejectsInvalidRequests(t *testing.T) {
+	tooHot := 1.5
+	cases := map[string]func(*model.AnthropicMessageRequest){
+		"no max_tokens": func(r *model.AnthropicMessageRequest) { r.MaxTokens = 0 },
+		"no messages":   func(r *model.AnthropicMessageRequest) { r.Messages = nil },
+		"bad role":      func(r *model.AnthropicMessageRequest) { r.Messages[0].Role = "system" },
+		"temperature":   func(r *model.AnthropicMessageRequest) { r.Temperature = &tooHot },
+		"tool_result": func(r *model.AnthropicMessageRequest) {
+			r.Messages[0].Content = model.AnthropicContent{{Type: "tool_result"}}
+		},
+	}
+	for name, mutate := range cases {
+		t.Run(name, func(t *testing.T) {
+			svc := &fakeAsker{answer: "unused"}
+			req := textRequest("hi")
+			mutate(&req)
+			_, err := NewGeminiAdapter(svc).CreateMessage(context.Background(), req)
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) || apiErr.HTTPStatus != 400 || apiErr.Type != "invalid_request_error" {
+				t.Fatalf("expected invalid_request_error, got %v", err)
+			}
+			if svc.question != "" {
+				t.Fatalf("expected no call to Gemini, got %q", svc.question)
+			}
+		})
+	}
+}
+
+func TestCreateMessageAttachesImages(t *testing.T) {
+	svc := &fakeAsker{answer: "a cat"}
+	req := textRequest("what is this?")
+	req.Messages[0].Content = append(req.Messages[0].Content, model.AnthropicContentBlock{
+		Type:   "image",
+		Source: &model.AnthropicSource{Type: "base64", MediaType: "image/png", Data: "iVBORw0KGgo="},
+	})
+	if _, err := NewGeminiAdapter(svc).CreateMessage(context.Background(), req); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(svc.opts.Attachments) != 1 || !strings.HasSuffix(svc.opts.Attachments[0].Name, ".png") {
+		t.Fatalf("expected one png attachment, got %+v", svc.opts.Attachments)
+	}
+	if !strings.Contains(svc.question, "@"+svc.opts.Attachments[0].Name) {
+		t.Fatalf("expected prompt to reference the attachment, got %q", svc.question)
+	}
+}
+
+func TestCreateMessageStreamEmitsEvents(t *testing.T) {
+	svc := &fakeAsker{answer: "one\ntwo"}
+	var types []string
+	var text strings.Builder
+	err := NewGeminiAdapter(svc).CreateMessageStream(context.Background(), textRequest("count"), func(event model.AnthropicStreamEvent) error {
+		types = append(types, event.Type)
+		if event.Type == "content_block_delta" {
+			text.WriteString(event.Delta.Text)
+		}
+		if event.Type == "message_delta" && event.Delta.StopReason != "end_turn" {
+			t.Fatalf("expected end_turn, got %q", event.Delta.StopReason)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := "message_start,content_block_start,content_block_delta,content_block_delta,content_block_stop,message_delta,message_stop"
+	if got := strings.Join(types, ","); got != want {
+		t.Fatalf("expected events %s, got %s", want, got)
+	}
+	if text.String() != "one\ntwo" {
+		t.Fatalf("expected streamed text, got %q", text.String())
+	}
+}
+
+func TestCreateMessageStreamReturnsErrorsBeforeFirstEvent(t *testing.T) {
+	svc := &fakeAsker{err: errors.New("busy"), status: &model.GeminiStatus{HTTPStatus: 503, Code: gemini.QueueFullCode, Message: "queue is full"}}
+	called := false
+	err := NewGeminiAdapter(svc).CreateMessageStream(context.Background(), textRequest("hi"), func(model.AnthropicStreamEvent) error {
+		called = true
+		return nil
+	})
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.Type != "overloaded_error" || apiErr.Message != "queue is full" {
+		t.Fatalf("expected overloaded_error, got %v", err)
+	}
+	if called {
+		t.Fatal("expected no events before the error")
+	}
+}
+
+func TestResolveModelUsesAliasesAndDefault(t *testing.T) {
+	adapter := NewGeminiAdapter(&fakeAsker{})
+	adapter.SetModelAliases(map[string]string{"Claude-Opus-4-1": "gemini-2.5-pro"})
+	cases := map[string]string{
+		"":                  defaultModel,
+		"claude-opus-4-1":   "gemini-2.5-pro",
+		"claude-haiku-4-5":  defaultModel,
+		"gemini-2.5-pro":    "gemini-2.5-pro",
+		" gemini-2.0-flash": "gemini-2.0-flash",
+	}
+	for requested, want := range cases {
+		if got := adapter.resolveModel(requested); got != want {
+			t.Fatalf("resolveModel(%q) = %q, want %q", requested, got, want)
+		}
+	}
+}
+
+func TestCountTokensEstimatesPrompt(t *testing.T) {
+	req := textRequest("a fairly short question")
+	req.MaxTokens = 0
+	resp, err := NewGeminiAdapter(&fakeAsker{}).CountTokens(context.Background(), req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp.InputTokens <= 0 {
+		t.Fatalf("expected a positive estimate, got %d", resp.InputTokens)
+	}
+}
@@ -0,0 +1,28 @@
+package anthropic
+
+import (
+	"context"
+
+	"gemini-wrapper/model"
+)
+
+type Service interface {
+	CreateMessage(ctx context.Context, req model.AnthropicMessageRequest) (model.AnthropicMessageResponse, error)
+	CreateMessageStream(ctx context.Context, req model.AnthropicMessageRequest, onEvent func(model.AnthropicStreamEvent) error) error
+	CountTokens(ctx context.Context, req model.AnthropicMessageRequest) (model.AnthropicCountTokensResponse, error)
+}
+
+// APIError is an error in the terms of the Anthropic API. Type is one of its
+// error types, such as "invalid_request_error" or "overloaded_error".
+type APIError struct {
+	HTTPStatus int
+	Type       string
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	if e == nil {
+		return ""
+	}
+	return e.Message
+}
@@ -0,0 +1,257 @@
+// Package audit keeps an optional record of every question sent to the model
+// and the answer returned, so compliance teams can review what was shared.
+//
+// Entries are appended to one JSON Lines file per UTC day in Config.Dir;
+// files older than the retention are deleted.
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gemini-wrapper/model"
+)
+
+const (
+	filePrefix = "audit-"
+	fileSuffix = ".jsonl"
+	// maxLineSize bounds the entries Export reads back.
+	maxLineSize = 64 << 20
+)
+
+type Config struct {
+	Enabled bool   `yaml:"enabled"`
+	Dir     string `yaml:"dir"`
+	// Retention is how long daily files are kept. 0 keeps them forever.
+	Retention time.Duration `yaml:"retention"`
+}
+
+func DefaultConfig() Config {
+	return Config{Dir: "/app/cache/audit", Retention: 90 * 24 * time.Hour}
+}
+
+// ApplyEnv overrides c with the AUDIT_* environment variables that are set.
+func (c *Config) ApplyEnv() {
+	if raw := strings.TrimSpace(os.Getenv("AUDIT_ENABLED")); raw != "" {
+		if parsed, err := strconv.ParseBool(raw); err == nil {
+			c.Enabled = parsed
+		}
+	}
+	if dir := strings.TrimSpace(os.Getenv("AUDIT_DIR")); dir != "" {
+		c.Dir = dir
+	}
+	if raw := strings.TrimSpace(os.Getenv("AUDIT_RETENTION_DAYS")); raw != "" {
+		if days, err := strconv.Atoi(raw); err == nil && days >= 0 {
+			c.Retention = time.Duration(days) * 24 * time.Hour
+		}
+	}
+}
+
+// Entry is one question and its outcome. Client identifies the caller as
+// "key:<label>" or "ip:<address>"; API keys themselves are never recorded.
+// ID is unique per entry, where RequestID is shared by the questions of one
+// request.
+type Entry struct {
+	ID            string               `json:"id,omitempty"`
+	Time          time.Time            `json:"time"`
+	RequestID     string               `json:"requestId,omitempty"`
+	Client        string               `json:"client,omitempty"`
+	Model         string               `json:"model,omitempty"`
+	Prompt        string               `json:"prompt"`
+	Answer        string               `json:"answer,omitempty"`
+	Error         string               `json:"error,omitempty"`
+	Status        int                  `json:"status"`
+	LatencyMillis int64                `json:"latencyMillis"`
+	Usage         *model.UsageMetadata `json:"usage,omitempty"`
+}
+
+// Log appends entries to the daily files. A nil *Log records nothing.
+type Log struct {
+	cfg Config
+	now func() time.Time
+
+	mu   sync.Mutex
+	day  string
+	file *os.File
+}
+
+// Open creates cfg.Dir if needed and deletes expired files.
+func Open(cfg Config) (*Log, error) {
+	if err := os.MkdirAll(cfg.Dir, 0o700); err != nil {
+		return nil, err
+	}
+	l := &Log{cfg: cfg, now: time.Now}
+	l.prune()
+	return l, nil
+}
+
+func (l *Log) path(day string) string {
+	return filepath.Join(l.cfg.Dir, filePrefix+day+fileSuffix)
+}
+
+// Write appends e to the file of the day it happened.
+func (l *Log) Write(e Entry) error {
+	if l == nil {
+		return nil
+	}
+	if e.Time.IsZero() {
+		e.Time = l.now()
+	}
+	e.Time = e.Time.UTC()
+	if e.ID == "" {
+		e.ID = newID()
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	day := e.Time.Format(time.DateOnly)
+	if l.file == nil || day != l.day {
+		if l.file != nil {
+			_ = l.file.Close()
+			l.file = nil
+		}
+		file, err := os.OpenFile(l.path(day), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+		if err != nil {
+			return fmt.Errorf("open audit log: %w", err)
+		}
+		l.file, l.day = file, day
+		l.prune()
+	}
+	if _, err := l.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("write audit log: %w", err)
+	}
+	return nil
+}
+
+// days returns the dates of the files on disk, oldest first.
+func (l *Log) days() ([]string, error) {
+	entries, err := os.ReadDir(l.cfg.Dir)
+	if err != nil {
+		return nil, err
+	}
+	var days []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, filePrefix) || !strings.HasSuffix(name, fileSuffix) {
+			continue
+		}
+		day := strings.TrimSuffix(strings.TrimPrefix(name, filePrefix), fileSuffix)
+		if _, err := time.Parse(time.DateOnly, day); err == nil {
+			days = append(days, day)
+		}
+	}
+	sort.Strings(days)
+	return days, nil
+}
+
+// prune deletes the files whose whole day lies before the retention.
+func (l *Log) prune() {
+	if l.cfg.Retention <= 0 {
+		return
+	}
+	days, err := l.days()
+	if err != nil {
+		slog.Warn("audit log retention failed", "error", err)
+		return
+	}
+	cutoff := l.now().UTC().Add(-l.cfg.Retention)
+	for _, day := range days {
+		start, _ := time.Parse(time.DateOnly, day)
+		if !start.Add(24 * time.Hour).Before(cutoff) {
+			break
+		}
+		if err := os.Remove(l.path(day)); err != nil && !os.IsNotExist(err) {
+			slog.Warn("audit log retention failed", "file", l.path(day), "error", err)
+		}
+	}
+}
+
+// Close closes the current file.
+func (l *Log) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// Query selects the entries to export. Client "" exports every client.
+type Query struct {
+	From   time.Time
+	To     time.Time
+	Client string
+}
+
+// Export writes the entries in [q.From, q.To) to w as JSON Lines, oldest
+// first, and returns how many were written.
+func (l *Log) Export(w io.Writer, q Query) (int, error) {
+	days, err := l.days()
+	if err != nil {
+		return 0, err
+	}
+	from, to := q.From.UTC(), q.To.UTC()
+	written := 0
+	for _, day := range days {
+		start, _ := time.Parse(time.DateOnly, day)
+		if !start.Add(24*time.Hour).After(from) || !start.Before(to) {
+			continue
+		}
+		n, err := l.exportFile(w, l.path(day), from, to, q.Client)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+func (l *Log) exportFile(w io.Writer, path string, from, to time.Time, client string) (int, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	written := 0
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64<<10), maxLineSize)
+	for scanner.Scan() {
+		var e Entry
+		// A line still being appended does not parse yet; skip it.
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue
+		}
+		if e.Time.Before(from) || !e.Time.Before(to) || (client != "" && e.Client != client) {
+			continue
+		}
+		line := append(append([]byte(nil), scanner.Bytes()...), '\n')
+		if _, err := w.Write(line); err != nil {
+			return written, err
+		}
+		written++
+	}
+	return written, scanner.Err()
+}
@@ -0,0 +1,39 @@
+package audit
+
+import (
+	"context"
+	"log/slog"
+
+	"gemini-wrapper/logging"
+)
+
+type requestKey struct{}
+
+type request struct {
+	log    *Log
+	client string
+}
+
+// Track makes the questions asked with the returned context land in l,
+// attributed to client.
+func (l *Log) Track(ctx context.Context, client string) context.Context {
+	if l == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, requestKey{}, request{log: l, client: client})
+}
+
+// Record writes e to the log attached to ctx, if any, filling in the client
+// and request ID. Failures are logged, never returned: auditing must not
+// fail the question.
+func Record(ctx context.Context, e Entry) {
+	req, ok := ctx.Value(requestKey{}).(request)
+	if !ok {
+		return
+	}
+	e.Client = req.client
+	e.RequestID = logging.RequestID(ctx)
+	if err := req.log.Write(e); err != nil {
+		slog.WarnContext(ctx, "audit log write failed", "error", err)
+	}
+}
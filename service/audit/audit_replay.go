@@ -0,0 +1,149 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"slices"
+	"strings"
+)
+
+// ErrNotFound is returned by Find for an ID that is not in the log.
+var ErrNotFound = errors.New("audit entry not found")
+
+// maxDiffCells bounds the work of Diff; longer answers are shown as
+// replaced entirely.
+const maxDiffCells = 4 << 20
+
+func newID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Find returns the entry with id, searching the newest files first.
+// Entries written before entries had IDs cannot be found.
+func (l *Log) Find(id string) (Entry, error) {
+	days, err := l.days()
+	if err != nil {
+		return Entry{}, err
+	}
+	for _, day := range slices.Backward(days) {
+		e, ok, err := findInFile(l.path(day), id)
+		if err != nil || ok {
+			return e, err
+		}
+	}
+	return Entry{}, ErrNotFound
+}
+
+func findInFile(path, id string) (Entry, bool, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return Entry{}, false, nil
+	}
+	if err != nil {
+		return Entry{}, false, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64<<10), maxLineSize)
+	needle := []byte(`"id":"` + id + `"`)
+	for scanner.Scan() {
+		if !bytes.Contains(scanner.Bytes(), needle) {
+			continue
+		}
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err == nil && e.ID == id {
+			return e, true, nil
+		}
+	}
+	return Entry{}, false, scanner.Err()
+}
+
+// Replay is an audited question asked again, compared with the original.
+type Replay struct {
+	Original Entry `json:"original"`
+	Replayed Entry `json:"replayed"`
+	// Identical reports whether both got the same status and answer.
+	Identical bool `json:"identical"`
+	// Diff compares the answers line by line: "-" lines are only in the
+	// original, "+" lines only in the replay.
+	Diff string `json:"diff,omitempty"`
+}
+
+// Compare builds the Replay of original by replayed.
+func Compare(original, replayed Entry) Replay {
+	r := Replay{
+		Original:  original,
+		Replayed:  replayed,
+		Identical: original.Status == replayed.Status && original.Answer == replayed.Answer,
+	}
+	if original.Answer != replayed.Answer {
+		r.Diff = Diff(original.Answer, replayed.Answer)
+	}
+	return r
+}
+
+// Diff returns the lines of a and b, each prefixed with " " when both have
+// it, "-" when only a has it and "+" when only b has it.
+func Diff(a, b string) string {
+	x, y := strings.Split(a, "\n"), strings.Split(b, "\n")
+	var out strings.Builder
+	line := func(prefix, text string) {
+		out.WriteString(prefix)
+		out.WriteString(text)
+		out.WriteByte('\n')
+	}
+	if len(x)*len(y) > maxDiffCells {
+		for _, text := range x {
+			line("-", text)
+		}
+		for _, text := range y {
+			line("+", text)
+		}
+		return out.String()
+	}
+
+	// lcs[i][j] is the length of the longest common subsequence of x[i:]
+	// and y[j:].
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	i, j := 0, 0
+	for i < len(x) && j < len(y) {
+		switch {
+		case x[i] == y[j]:
+			line(" ", x[i])
+			i, j = i+1, j+1
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			line("-", x[i])
+			i++
+		default:
+			line("+", y[j])
+			j++
+		}
+	}
+	for ; i < len(x); i++ {
+		line("-", x[i])
+	}
+	for ; j < len(y); j++ {
+		line("+", y[j])
+	}
+	return out.String()
+}
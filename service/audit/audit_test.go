@@ -0,0 +1,133 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteExportAndRetention(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	stale := filepath.Join(dir, "audit-2026-01-01.jsonl")
+	if err := os.WriteFile(stale, []byte("{}\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := Open(Config{Dir: dir, Retention: 30 * 24 * time.Hour})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer l.Close()
+	l.now = func() time.Time { return now }
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Fatalf("expected files past the retention to be deleted, got %v", err)
+	}
+
+	entries := []Entry{
+		{Time: now.Add(-24 * time.Hour), Client: "key:a", Prompt: "yesterday", Status: 200},
+		{Time: now, Client: "key:a", Prompt: "today", Answer: "yes", Status: 200},
+		{Time: now.Add(time.Minute), Client: "key:b", Prompt: "failed", Error: "boom", Status: 503},
+	}
+	for _, e := range entries {
+		if err := l.Write(e); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	for _, day := range []string{"2026-03-09", "2026-03-10"} {
+		if _, err := os.Stat(filepath.Join(dir, "audit-"+day+".jsonl")); err != nil {
+			t.Fatalf("expected a file for %s: %v", day, err)
+		}
+	}
+
+	var out bytes.Buffer
+	n, err := l.Export(&out, Query{From: now.Add(-48 * time.Hour), To: now.Add(time.Hour), Client: "key:a"})
+	if err != nil || n != 2 {
+		t.Fatalf("Export = %d, %v", n, err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if !strings.Contains(lines[0], `"prompt":"yesterday"`) || !strings.Contains(lines[1], `"answer":"yes"`) {
+		t.Fatalf("unexpected export:\n%s", out.String())
+	}
+
+	out.Reset()
+	if n, _ := l.Export(&out, Query{From: now, To: now.Add(time.Hour)}); n != 2 {
+		t.Fatalf("expected the time range to exclude yesterday, got %d entries:\n%s", n, out.String())
+	}
+}
+
+func TestRecordNeedsATrackedContext(t *testing.T) {
+	l, err := Open(Config{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer l.Close()
+
+	Record(context.Background(), Entry{Prompt: "untracked"})
+	Record(l.Track(context.Background(), "key:a"), Entry{Prompt: "tracked"})
+	var nilLog *Log
+	Record(nilLog.Track(context.Background(), "key:a"), Entry{Prompt: "disabled"})
+
+	var out bytes.Buffer
+	if n, err := l.Export(&out, Query{From: time.Now().Add(-time.Hour), To: time.Now().Add(time.Hour)}); err != nil || n != 1 || !strings.Contains(out.String(), `"client":"key:a"`) {
+		t.Fatalf("Export = %d, %v:\n%s", n, err, out.String())
+	}
+}
+
+func TestFindReturnsEntriesByID(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(Config{Dir: dir})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer l.Close()
+	now := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	l.now = func() time.Time { return now }
+	if err := l.Write(Entry{Time: now.Add(-24 * time.Hour), Prompt: "yesterday", Answer: "a", Status: 200}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := l.Write(Entry{Prompt: "today", Status: 200}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	var out bytes.Buffer
+	if _, err := l.Export(&out, Query{From: now.Add(-48 * time.Hour), To: now.Add(time.Hour)}); err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+	var first Entry
+	if err := json.Unmarshal(bytes.SplitN(out.Bytes(), []byte("\n"), 2)[0], &first); err != nil || first.ID == "" {
+		t.Fatalf("expected entries to get an ID, got %#v (%v)", first, err)
+	}
+
+	found, err := l.Find(first.ID)
+	if err != nil || found.Prompt != "yesterday" || found.Answer != "a" {
+		t.Fatalf("Find = %#v, %v", found, err)
+	}
+	if _, err := l.Find("missing"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestCompareDiffsTheAnswers(t *testing.T) {
+	original := Entry{Answer: "one\ntwo\nthree", Status: 200}
+	if r := Compare(original, original); !r.Identical || r.Diff != "" {
+		t.Fatalf("expected identical entries, got %#v", r)
+	}
+
+	r := Compare(original, Entry{Answer: "one\n2\nthree\nfour", Status: 200})
+	if r.Identical {
+		t.Fatal("expected a changed answer to differ")
+	}
+	if want := " one\n-two\n+2\n three\n+four\n"; r.Diff != want {
+		t.Fatalf("unexpected diff:\n%s\nwant:\n%s", r.Diff, want)
+	}
+	if r := Compare(original, Entry{Answer: original.Answer, Status: 503}); r.Identical {
+		t.Fatal("expected another status to differ")
+	}
+}
@@ -0,0 +1,471 @@
+// Package budget caps how many requests and tokens the wrapper serves per UTC
+// day and month, in total and per client.
+//
+// Counters live in memory and are written to a Bolt database every
+// FlushInterval and on Close, so a restart does not hand out a fresh budget.
+// A crash forgets at most FlushInterval of usage.
+package budget
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gemini-wrapper/service/storage"
+)
+
+// StoreName is the store of the counters in the database.
+const StoreName = "budget_counters"
+
+// globalScope is the scope of the counters shared by every client.
+const globalScope = "*"
+
+// Limits are the caps of one scope. 0 disables a cap.
+type Limits struct {
+	RequestsPerDay   int64 `yaml:"requests_per_day" json:"requestsPerDay,omitempty"`
+	TokensPerDay     int64 `yaml:"tokens_per_day" json:"tokensPerDay,omitempty"`
+	RequestsPerMonth int64 `yaml:"requests_per_month" json:"requestsPerMonth,omitempty"`
+	TokensPerMonth   int64 `yaml:"tokens_per_month" json:"tokensPerMonth,omitempty"`
+}
+
+func (l Limits) enabled() bool {
+	return l.RequestsPerDay > 0 || l.TokensPerDay > 0 || l.RequestsPerMonth > 0 || l.TokensPerMonth > 0
+}
+
+type Config struct {
+	Path string `yaml:"path"`
+	// Global caps all clients together.
+	Global Limits `yaml:"global"`
+	// PerKey caps each client: its API key, or its IP address when no API
+	// keys are configured.
+	PerKey Limits `yaml:"per_key"`
+	// Keys replaces PerKey for the API keys with these labels.
+	Keys          map[string]Limits `yaml:"keys"`
+	FlushInterval time.Duration     `yaml:"flush_interval"`
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Path:          "/app/cache/budget.db",
+		FlushInterval: 10 * time.Second,
+	}
+}
+
+// ApplyEnv overrides c with the BUDGET_* environment variables that are set.
+// BUDGET_REQUESTS_PER_DAY and friends set the global caps,
+// BUDGET_KEY_REQUESTS_PER_DAY and friends the per-key caps.
+func (c *Config) ApplyEnv() {
+	if path := strings.TrimSpace(os.Getenv("BUDGET_PATH")); path != "" {
+		c.Path = path
+	}
+	c.Global.applyEnv("BUDGET_")
+	c.PerKey.applyEnv("BUDGET_KEY_")
+	if seconds := envInt("BUDGET_FLUSH_SECONDS", 0); seconds > 0 {
+		c.FlushInterval = time.Duration(seconds) * time.Second
+	}
+}
+
+func (l *Limits) applyEnv(prefix string) {
+	l.RequestsPerDay = envInt(prefix+"REQUESTS_PER_DAY", l.RequestsPerDay)
+	l.TokensPerDay = envInt(prefix+"TOKENS_PER_DAY", l.TokensPerDay)
+	l.RequestsPerMonth = envInt(prefix+"REQUESTS_PER_MONTH", l.RequestsPerMonth)
+	l.TokensPerMonth = envInt(prefix+"TOKENS_PER_MONTH", l.TokensPerMonth)
+}
+
+// Enabled reports whether any cap is configured.
+func (c Config) Enabled() bool {
+	if c.Global.enabled() || c.PerKey.enabled() {
+		return true
+	}
+	for _, limits := range c.Keys {
+		if limits.enabled() {
+			return true
+		}
+	}
+	return false
+}
+
+// limitsFor returns the caps of client, a "key:<label>" or "ip:<address>"
+// identifier.
+func (c Config) limitsFor(client string) Limits {
+	if label, ok := strings.CutPrefix(client, "key:"); ok {
+		if limits, ok := c.Keys[label]; ok {
+			return limits
+		}
+	}
+	return c.PerKey
+}
+
+// Period names.
+const (
+	PeriodDay   = "day"
+	PeriodMonth = "month"
+)
+
+// Scope names.
+const (
+	ScopeGlobal = "global"
+	ScopeKey    = "key"
+)
+
+// Exceeded describes the cap that refused a request.
+type Exceeded struct {
+	Scope  string
+	Period string
+	// Tokens is true for a token cap, false for a request cap.
+	Tokens bool
+	Reset  time.Time
+}
+
+// Message explains the refusal to the client.
+func (e Exceeded) Message() string {
+	period := "daily"
+	if e.Period == PeriodMonth {
+		period = "monthly"
+	}
+	resource := "request"
+	if e.Tokens {
+		resource = "token"
+	}
+	owner := "Your"
+	if e.Scope == ScopeGlobal {
+		owner = "The server's"
+	}
+	return fmt.Sprintf("%s %s %s budget is used up. It resets at %s.", owner, period, resource, e.Reset.UTC().Format(time.RFC3339))
+}
+
+// Counters are the consumption of one scope in one period.
+type Counters struct {
+	Requests int64 `json:"requests"`
+	Tokens   int64 `json:"tokens"`
+}
+
+// counterKey identifies the counters of scope in period, which is a UTC day
+// ("2006-01-02") or month ("2006-01").
+type counterKey struct {
+	period string
+	scope  string
+}
+
+func (k counterKey) encode() []byte {
+	return []byte(k.period + "\x00" + k.scope)
+}
+
+func decodeCounterKey(raw []byte) (counterKey, bool) {
+	period, scope, ok := strings.Cut(string(raw), "\x00")
+	return counterKey{period: period, scope: scope}, ok
+}
+
+// Budget enforces the caps. A nil *Budget allows everything.
+type Budget struct {
+	cfg   Config
+	store storage.Store
+	// db holds the spending counters when Open opened Config.Path. Close
+	// flushes the counters into it before closing it.
+	db  *storage.DB
+	now func() time.Time
+
+	mu       sync.Mutex
+	counters map[counterKey]*Counters
+	dirty    map[counterKey]bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Open opens or creates the database at cfg.Path, loads the counters kept by
+// the previous run and starts flushing to it.
+func Open(cfg Config) (*Budget, error) {
+	db, err := storage.Open(cfg.Path)
+	if err != nil {
+		return nil, err
+	}
+	store, err := db.Store(StoreName)
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	b, err := OpenStorage(cfg, store)
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	b.db = db
+	return b, nil
+}
+
+// OpenStorage keeps the counters in store, such as a store of the database
+// all features share, loads the counters kept by the previous run and starts
+// flushing to it.
+func OpenStorage(cfg Config, store storage.Store) (*Budget, error) {
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = DefaultConfig().FlushInterval
+	}
+	b := &Budget{
+		cfg:      cfg,
+		store:    store,
+		now:      time.Now,
+		counters: map[counterKey]*Counters{},
+		dirty:    map[counterKey]bool{},
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if err := store.ForEach("", "", func(raw string, value []byte) error {
+		// Counters of past periods are never looked up and go with the
+		// next flush.
+		key, ok := decodeCounterKey([]byte(raw))
+		if !ok {
+			return nil
+		}
+		var counters Counters
+		if err := json.Unmarshal(value, &counters); err == nil {
+			b.counters[key] = &counters
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	go b.flushLoop()
+	return b, nil
+}
+
+// Allow counts a request of client against the caps. When a cap is used up it
+// returns false and the cap that resets last, without counting the request.
+func (b *Budget) Allow(client string) (bool, Exceeded) {
+	if b == nil {
+		return true, Exceeded{}
+	}
+	now := b.now()
+	day, month := periods(now)
+	scopes := []struct {
+		name   string
+		scope  string
+		limits Limits
+	}{
+		{ScopeGlobal, globalScope, b.cfg.Global},
+		{ScopeKey, client, b.cfg.limitsFor(client)},
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var exceeded Exceeded
+	for _, s := range scopes {
+		checks := []struct {
+			period   string
+			key      counterKey
+			requests int64
+			tokens   int64
+			reset    time.Time
+		}{
+			{PeriodDay, counterKey{day, s.scope}, s.limits.RequestsPerDay, s.limits.TokensPerDay, nextDay(now)},
+			{PeriodMonth, counterKey{month, s.scope}, s.limits.RequestsPerMonth, s.limits.TokensPerMonth, nextMonth(now)},
+		}
+		for _, check := range checks {
+			used := b.peekLocked(check.key)
+			over := Exceeded{Scope: s.name, Period: check.period, Reset: check.reset}
+			switch {
+			case check.tokens > 0 && used.Tokens >= check.tokens:
+				over.Tokens = true
+			case check.requests > 0 && used.Requests >= check.requests:
+			default:
+				continue
+			}
+			if over.Reset.After(exceeded.Reset) {
+				exceeded = over
+			}
+		}
+	}
+	if !exceeded.Reset.IsZero() {
+		return false, exceeded
+	}
+	for _, s := range scopes {
+		b.addLocked(counterKey{day, s.scope}, Counters{Requests: 1})
+		b.addLocked(counterKey{month, s.scope}, Counters{Requests: 1})
+	}
+	return true, Exceeded{}
+}
+
+// AddTokens charges tokens to client and to the global budget. A request that
+// goes over a token cap is still served; the next one is refused.
+func (b *Budget) AddTokens(client string, tokens int) {
+	if b == nil || tokens <= 0 {
+		return
+	}
+	day, month := periods(b.now())
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, scope := range []string{globalScope, client} {
+		b.addLocked(counterKey{day, scope}, Counters{Tokens: int64(tokens)})
+		b.addLocked(counterKey{month, scope}, Counters{Tokens: int64(tokens)})
+	}
+}
+
+func (b *Budget) peekLocked(key counterKey) Counters {
+	if counters, ok := b.counters[key]; ok {
+		return *counters
+	}
+	return Counters{}
+}
+
+func (b *Budget) addLocked(key counterKey, delta Counters) {
+	counters, ok := b.counters[key]
+	if !ok {
+		counters = &Counters{}
+		b.counters[key] = counters
+	}
+	counters.Requests += delta.Requests
+	counters.Tokens += delta.Tokens
+	b.dirty[key] = true
+}
+
+// ClientUsage is the admin view of one client's budget.
+type ClientUsage struct {
+	Client string   `json:"client"`
+	Day    Counters `json:"day"`
+	Month  Counters `json:"month"`
+	Limits Limits   `json:"limits"`
+}
+
+type Report struct {
+	Day     string        `json:"day"`
+	Month   string        `json:"month"`
+	Global  ClientUsage   `json:"global"`
+	Clients []ClientUsage `json:"clients"`
+}
+
+// Usage returns the consumption of the current day and month.
+func (b *Budget) Usage() Report {
+	day, month := periods(b.now())
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	usageOf := func(scope string, limits Limits) ClientUsage {
+		return ClientUsage{
+			Client: scope,
+			Day:    b.peekLocked(counterKey{day, scope}),
+			Month:  b.peekLocked(counterKey{month, scope}),
+			Limits: limits,
+		}
+	}
+	report := Report{Day: day, Month: month, Global: usageOf(globalScope, b.cfg.Global), Clients: []ClientUsage{}}
+	report.Global.Client = ScopeGlobal
+	seen := map[string]bool{}
+	for key := range b.counters {
+		if key.scope == globalScope || seen[key.scope] || (key.period != day && key.period != month) {
+			continue
+		}
+		seen[key.scope] = true
+		report.Clients = append(report.Clients, usageOf(key.scope, b.cfg.limitsFor(key.scope)))
+	}
+	sort.Slice(report.Clients, func(i, j int) bool { return report.Clients[i].Client < report.Clients[j].Client })
+	return report
+}
+
+// Flush writes the changed counters to disk and drops the counters of past
+// days and months.
+func (b *Budget) Flush() error {
+	day, month := periods(b.now())
+	b.mu.Lock()
+	changed := make(map[counterKey]Counters, len(b.dirty))
+	for key := range b.dirty {
+		changed[key] = *b.counters[key]
+	}
+	b.dirty = map[counterKey]bool{}
+	for key := range b.counters {
+		if key.period != day && key.period != month {
+			delete(b.counters, key)
+		}
+	}
+	b.mu.Unlock()
+
+	err := b.store.Update(func(tx storage.Store) error {
+		for key, counters := range changed {
+			raw, err := json.Marshal(counters)
+			if err != nil {
+				return err
+			}
+			if err := tx.Put(string(key.encode()), raw); err != nil {
+				return err
+			}
+		}
+		var expired []string
+		if err := tx.ForEach("", "", func(raw string, _ []byte) error {
+			if key, ok := decodeCounterKey([]byte(raw)); !ok || (key.period != day && key.period != month) {
+				expired = append(expired, raw)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		return tx.Delete(expired...)
+	})
+	if err != nil {
+		// Write the counters again next time.
+		b.mu.Lock()
+		for key := range changed {
+			if _, ok := b.counters[key]; ok {
+				b.dirty[key] = true
+			}
+		}
+		b.mu.Unlock()
+		return fmt.Errorf("flush budget counters: %w", err)
+	}
+	return nil
+}
+
+func (b *Budget) flushLoop() {
+	defer close(b.done)
+	ticker := time.NewTicker(b.cfg.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := b.Flush(); err != nil {
+				slog.Warn("budget flush failed", "error", err)
+			}
+		case <-b.stop:
+			return
+		}
+	}
+}
+
+// Close writes the counters and closes the database.
+func (b *Budget) Close() error {
+	if b == nil {
+		return nil
+	}
+	close(b.stop)
+	<-b.done
+	return errors.Join(b.Flush(), b.db.Close())
+}
+
+// periods returns the UTC day and month now falls in.
+func periods(now time.Time) (day, month string) {
+	utc := now.UTC()
+	return utc.Format("2006-01-02"), utc.Format("2006-01")
+}
+
+func nextDay(now time.Time) time.Time {
+	utc := now.UTC()
+	return time.Date(utc.Year(), utc.Month(), utc.Day()+1, 0, 0, 0, 0, time.UTC)
+}
+
+func nextMonth(now time.Time) time.Time {
+	utc := now.UTC()
+	return time.Date(utc.Year(), utc.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+}
+
+func envInt(key string, defaultValue int64) int64 {
+	parsed, err := strconv.ParseInt(strings.TrimSpace(os.Getenv(key)), 10, 64)
+	if err != nil || parsed < 0 {
+		return defaultValue
+	}
+	return parsed
+}
@@ -0,0 +1,110 @@
+package budget
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func openTestBudget(t *testing.T, cfg Config, now *time.Time) *Budget {
+	t.Helper()
+	cfg.FlushInterval = time.Hour
+	b, err := Open(cfg)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	b.now = func() time.Time { return *now }
+	return b
+}
+
+func TestAllowRefusesAtTheCapUntilTheNextDay(t *testing.T) {
+	now := time.Date(2026, 3, 31, 22, 0, 0, 0, time.UTC)
+	cfg := DefaultConfig()
+	cfg.Path = filepath.Join(t.TempDir(), "budget.db")
+	cfg.PerKey = Limits{RequestsPerDay: 2}
+	cfg.Keys = map[string]Limits{"big": {RequestsPerDay: 3}}
+	b := openTestBudget(t, cfg, &now)
+	defer b.Close()
+
+	for range 2 {
+		if ok, _ := b.Allow("key:small"); !ok {
+			t.Fatal("request within the budget refused")
+		}
+	}
+	ok, over := b.Allow("key:small")
+	if ok || over.Scope != ScopeKey || over.Period != PeriodDay || over.Tokens {
+		t.Fatalf("third request: ok=%v over=%+v", ok, over)
+	}
+	if want := time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC); !over.Reset.Equal(want) {
+		t.Fatalf("reset %s, want %s", over.Reset, want)
+	}
+	if !strings.Contains(over.Message(), "2026-04-01T00:00:00Z") {
+		t.Fatalf("message without reset time: %s", over.Message())
+	}
+	if ok, _ := b.Allow("key:big"); !ok {
+		t.Fatal("key with its own budget refused")
+	}
+
+	now = now.Add(3 * time.Hour)
+	if ok, _ := b.Allow("key:small"); !ok {
+		t.Fatal("budget did not reset on the next day")
+	}
+}
+
+func TestTokenCapsCountEveryClientTowardsTheGlobalBudget(t *testing.T) {
+	now := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	cfg := DefaultConfig()
+	cfg.Path = filepath.Join(t.TempDir(), "budget.db")
+	cfg.Global = Limits{TokensPerMonth: 100}
+	b := openTestBudget(t, cfg, &now)
+	defer b.Close()
+
+	if ok, _ := b.Allow("key:a"); !ok {
+		t.Fatal("first request refused")
+	}
+	b.AddTokens("key:a", 60)
+	b.AddTokens("ip:10.0.0.1", 40)
+
+	ok, over := b.Allow("key:b")
+	if ok || over.Scope != ScopeGlobal || over.Period != PeriodMonth || !over.Tokens {
+		t.Fatalf("request over the global budget: ok=%v over=%+v", ok, over)
+	}
+	if want := time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC); !over.Reset.Equal(want) {
+		t.Fatalf("reset %s, want %s", over.Reset, want)
+	}
+	usage := b.Usage()
+	if usage.Global.Month.Tokens != 100 || usage.Global.Month.Requests != 1 || len(usage.Clients) != 2 {
+		t.Fatalf("unexpected usage: %+v", usage)
+	}
+}
+
+func TestCountersSurviveARestart(t *testing.T) {
+	now := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	cfg := DefaultConfig()
+	cfg.Path = filepath.Join(t.TempDir(), "budget.db")
+	cfg.PerKey = Limits{RequestsPerMonth: 2}
+
+	b := openTestBudget(t, cfg, &now)
+	b.Allow("key:a")
+	b.Allow("key:a")
+	if err := b.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	b = openTestBudget(t, cfg, &now)
+	if ok, _ := b.Allow("key:a"); ok {
+		t.Fatal("restart reset the monthly budget")
+	}
+	if err := b.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// Counters of past months are dropped.
+	now = time.Date(2026, 4, 1, 0, 0, 1, 0, time.UTC)
+	b = openTestBudget(t, cfg, &now)
+	defer b.Close()
+	if ok, _ := b.Allow("key:a"); !ok {
+		t.Fatal("budget did not reset in the next month")
+	}
+}
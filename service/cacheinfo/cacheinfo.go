@@ -0,0 +1,47 @@
+// Package cacheinfo carries the response-cache outcome of a request through
+// its context, so the HTTP layer can report it without the Gemini service
+// knowing about headers.
+package cacheinfo
+
+import (
+	"context"
+	"sync"
+)
+
+type Result string
+
+const (
+	Hit  Result = "HIT"
+	Miss Result = "MISS"
+)
+
+// Report collects the outcome of the cache lookups made for one request.
+type Report struct {
+	mu     sync.Mutex
+	result Result
+}
+
+type reportKey struct{}
+
+// WithReport attaches a new Report to ctx.
+func WithReport(ctx context.Context) (context.Context, *Report) {
+	report := &Report{}
+	return context.WithValue(ctx, reportKey{}, report), report
+}
+
+// Record stores result in the Report attached to ctx, if any. The last
+// lookup of a request wins.
+func Record(ctx context.Context, result Result) {
+	if report, ok := ctx.Value(reportKey{}).(*Report); ok {
+		report.mu.Lock()
+		report.result = result
+		report.mu.Unlock()
+	}
+}
+
+// Result returns the recorded outcome, or "" when no cache lookup happened.
+func (r *Report) Result() Result {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.result
+}
@@ -0,0 +1,20 @@
+package cacheinfo
+
+import (
+	"context"
+	"testing"
+)
+
+func TestRecordReachesAttachedReport(t *testing.T) {
+	Record(context.Background(), Hit) // no report attached: must not panic
+
+	ctx, report := WithReport(context.Background())
+	if report.Result() != "" {
+		t.Fatalf("expected empty result, got %q", report.Result())
+	}
+	Record(ctx, Miss)
+	Record(ctx, Hit)
+	if report.Result() != Hit {
+		t.Fatalf("expected last result to win, got %q", report.Result())
+	}
+}
@@ -0,0 +1,140 @@
+// Package cluster connects the replicas of the wrapper through Redis. With a
+// Redis server configured, rate limits, idempotency keys and cached answers
+// are shared between replicas, and the replica that holds a session serves
+// every request for it, so the wrapper can run behind a load balancer.
+package cluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// sessionTTL is how long a session stays routed to its replica after it was
+// last used.
+const sessionTTL = 30 * 24 * time.Hour
+
+type Config struct {
+	// RedisURL is the Redis server shared by the replicas, for example
+	// redis://:password@redis:6379/0. Empty runs a single replica.
+	RedisURL string `yaml:"redis_url"`
+	// KeyPrefix starts every key the wrapper writes, so several deployments
+	// can share a Redis server.
+	KeyPrefix string `yaml:"key_prefix"`
+	// AdvertiseURL is the base URL the other replicas reach this one at,
+	// such as http://10.0.0.5:8080. Sessions are only routed between
+	// replicas that set it.
+	AdvertiseURL string `yaml:"advertise_url"`
+}
+
+func DefaultConfig() Config {
+	return Config{KeyPrefix: "gemini-wrapper:"}
+}
+
+// ApplyEnv overrides c with REDIS_URL, REDIS_KEY_PREFIX and
+// CLUSTER_ADVERTISE_URL when set.
+func (c *Config) ApplyEnv() {
+	if url := strings.TrimSpace(os.Getenv("REDIS_URL")); url != "" {
+		c.RedisURL = url
+	}
+	if prefix := strings.TrimSpace(os.Getenv("REDIS_KEY_PREFIX")); prefix != "" {
+		c.KeyPrefix = prefix
+	}
+	if url := strings.TrimSpace(os.Getenv("CLUSTER_ADVERTISE_URL")); url != "" {
+		c.AdvertiseURL = url
+	}
+}
+
+// Enabled reports whether a Redis server is configured.
+func (c Config) Enabled() bool {
+	return c.RedisURL != ""
+}
+
+// Cluster is the connection to the shared Redis server. A nil *Cluster is a
+// single replica.
+type Cluster struct {
+	client *redis.Client
+	prefix string
+	self   string
+}
+
+// Open connects to cfg.RedisURL and checks that the server answers.
+func Open(cfg Config) (*Cluster, error) {
+	options, err := redis.ParseURL(cfg.RedisURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Redis URL: %w", err)
+	}
+	c := New(redis.NewClient(options), cfg)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.client.Ping(ctx).Err(); err != nil {
+		c.client.Close()
+		return nil, fmt.Errorf("connect to Redis: %w", err)
+	}
+	return c, nil
+}
+
+// New returns a cluster that uses client.
+func New(client *redis.Client, cfg Config) *Cluster {
+	return &Cluster{client: client, prefix: cfg.KeyPrefix, self: strings.TrimRight(cfg.AdvertiseURL, "/")}
+}
+
+func (c *Cluster) Client() *redis.Client {
+	return c.client
+}
+
+// Key returns the Redis key for parts, joined with ":" after the prefix.
+func (c *Cluster) Key(parts ...string) string {
+	return c.prefix + strings.Join(parts, ":")
+}
+
+// Self is the advertised URL of this replica, or "" when it has none.
+func (c *Cluster) Self() string {
+	if c == nil {
+		return ""
+	}
+	return c.self
+}
+
+// Close closes the connection.
+func (c *Cluster) Close() error {
+	if c == nil {
+		return nil
+	}
+	return c.client.Close()
+}
+
+// ClaimSession records this replica as the holder of session id. It does
+// nothing without an advertised URL.
+func (c *Cluster) ClaimSession(ctx context.Context, id string) error {
+	if c == nil || c.self == "" {
+		return nil
+	}
+	return c.client.Set(ctx, c.Key("session", id), c.self, sessionTTL).Err()
+}
+
+// SessionOwner returns the URL of the replica that holds session id, or ""
+// when no replica claimed it.
+func (c *Cluster) SessionOwner(ctx context.Context, id string) (string, error) {
+	if c == nil {
+		return "", nil
+	}
+	owner, err := c.client.Get(ctx, c.Key("session", id)).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", nil
+	}
+	return owner, err
+}
+
+// ReleaseSession forgets the holder of session id.
+func (c *Cluster) ReleaseSession(ctx context.Context, id string) error {
+	if c == nil {
+		return nil
+	}
+	return c.client.Del(ctx, c.Key("session", id)).Err()
+}
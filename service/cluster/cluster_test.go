@@ -0,0 +1,55 @@
+package cluster
+
+import (
+	"context"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestSessionsAreOwnedByTheReplicaThatClaimedThem(t *testing.T) {
+	server := miniredis.RunT(t)
+	cfg := DefaultConfig()
+	cfg.AdvertiseURL = "http://10.0.0.5:8080/"
+	owner := New(redis.NewClient(&redis.Options{Addr: server.Addr()}), cfg)
+	defer owner.Close()
+	other := New(redis.NewClient(&redis.Options{Addr: server.Addr()}), DefaultConfig())
+	defer other.Close()
+	ctx := context.Background()
+
+	if err := owner.ClaimSession(ctx, "sess_1"); err != nil {
+		t.Fatalf("ClaimSession: %v", err)
+	}
+	if got, err := other.SessionOwner(ctx, "sess_1"); err != nil || got != "http://10.0.0.5:8080" {
+		t.Fatalf("owner %q err=%v", got, err)
+	}
+	if !server.Exists("gemini-wrapper:session:sess_1") {
+		t.Fatal("session key not under the prefix")
+	}
+
+	// A replica without an advertised URL cannot be routed to, so it claims nothing.
+	if err := other.ClaimSession(ctx, "sess_2"); err != nil {
+		t.Fatalf("ClaimSession: %v", err)
+	}
+	if got, _ := other.SessionOwner(ctx, "sess_2"); got != "" {
+		t.Fatalf("unexpected owner %q", got)
+	}
+
+	if err := owner.ReleaseSession(ctx, "sess_1"); err != nil {
+		t.Fatalf("ReleaseSession: %v", err)
+	}
+	if got, _ := other.SessionOwner(ctx, "sess_1"); got != "" {
+		t.Fatalf("released session still owned by %q", got)
+	}
+}
+
+func TestNilClusterIsASingleReplica(t *testing.T) {
+	var c *Cluster
+	if c.Self() != "" || c.Close() != nil || c.ClaimSession(context.Background(), "s") != nil {
+		t.Fatal("nil cluster did not act as a single replica")
+	}
+	if owner, err := c.SessionOwner(context.Background(), "s"); owner != "" || err != nil {
+		t.Fatalf("owner %q err=%v", owner, err)
+	}
+}
@@ -0,0 +1,228 @@
+// Package embeddings serves text embeddings. Gemini CLI cannot embed, so
+// they come from the Gemini REST API with an API key, or from deterministic
+// vectors when the wrapper runs with the mock backend.
+package embeddings
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gemini-wrapper/model"
+)
+
+const (
+	defaultBaseURL = "https://generativelanguage.googleapis.com"
+	defaultModel   = "gemini-embedding-001"
+	// MaxBatchSize is the Gemini API's limit on the requests of one
+	// batchEmbedContents call.
+	MaxBatchSize = 100
+	// mockDimensions is the size of mock vectors that ask for no
+	// outputDimensionality.
+	mockDimensions = 768
+)
+
+var (
+	// ErrNotConfigured is returned when no API key is set.
+	ErrNotConfigured = errors.New("embeddings need an API key; set EMBEDDINGS_API_KEY or GEMINI_API_KEY")
+	// ErrInvalidRequest wraps the reasons a request is refused before it is
+	// sent.
+	ErrInvalidRequest = errors.New("invalid embedding request")
+)
+
+// APIError is an error the embeddings API answered with. Code is its HTTP
+// status and Status the canonical name, such as "INVALID_ARGUMENT".
+type APIError struct {
+	Code    int
+	Message string
+	Status  string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("embeddings API error %d: %s", e.Code, e.Message)
+}
+
+type Config struct {
+	// APIKey authenticates with the Gemini API. Without one only the mock
+	// backend embeds.
+	APIKey  string `yaml:"api_key"`
+	BaseURL string `yaml:"base_url"`
+	// DefaultModel is used when a request names no model.
+	DefaultModel string        `yaml:"default_model"`
+	Timeout      time.Duration `yaml:"timeout"`
+}
+
+func DefaultConfig() Config {
+	return Config{BaseURL: defaultBaseURL, DefaultModel: defaultModel, Timeout: 30 * time.Second}
+}
+
+// ApplyEnv overrides c with the EMBEDDINGS_* environment variables that are
+// set. GEMINI_API_KEY is used when EMBEDDINGS_API_KEY is not.
+func (c *Config) ApplyEnv() {
+	if key := strings.TrimSpace(os.Getenv("EMBEDDINGS_API_KEY")); key != "" {
+		c.APIKey = key
+	} else if key := strings.TrimSpace(os.Getenv("GEMINI_API_KEY")); key != "" && c.APIKey == "" {
+		c.APIKey = key
+	}
+	if baseURL := strings.TrimSpace(os.Getenv("EMBEDDINGS_BASE_URL")); baseURL != "" {
+		c.BaseURL = baseURL
+	}
+	if modelName := strings.TrimSpace(os.Getenv("EMBEDDINGS_MODEL")); modelName != "" {
+		c.DefaultModel = modelName
+	}
+	if seconds, err := strconv.Atoi(strings.TrimSpace(os.Getenv("EMBEDDINGS_TIMEOUT_SECONDS"))); err == nil && seconds > 0 {
+		c.Timeout = time.Duration(seconds) * time.Second
+	}
+}
+
+// Client embeds texts with the Gemini API.
+type Client struct {
+	cfg    Config
+	mock   bool
+	client *http.Client
+}
+
+// New returns a client for cfg. With mock it answers without calling the
+// API: every text gets a fixed unit vector derived from it, so equal texts
+// are equal and others almost orthogonal.
+func New(cfg Config, mock bool) *Client {
+	defaults := DefaultConfig()
+	if cfg.BaseURL == "" {
+		cfg.BaseURL = defaults.BaseURL
+	}
+	if cfg.DefaultModel == "" {
+		cfg.DefaultModel = defaults.DefaultModel
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaults.Timeout
+	}
+	cfg.BaseURL = strings.TrimRight(cfg.BaseURL, "/")
+	return &Client{cfg: cfg, mock: mock, client: &http.Client{Timeout: cfg.Timeout}}
+}
+
+// Model returns modelName without its "models/" prefix, or the default model
+// when it is empty.
+func (c *Client) Model(modelName string) string {
+	modelName = strings.TrimPrefix(strings.TrimSpace(modelName), "models/")
+	if modelName == "" {
+		return c.cfg.DefaultModel
+	}
+	return modelName
+}
+
+// Embed returns the embeddings of requests, in order, computed with
+// modelName. The requests are sent as one batchEmbedContents call.
+func (c *Client) Embed(ctx context.Context, modelName string, requests []model.EmbedContentRequest) ([]model.ContentEmbedding, error) {
+	modelName = c.Model(modelName)
+	if len(requests) == 0 {
+		return nil, fmt.Errorf("%w: nothing to embed", ErrInvalidRequest)
+	}
+	if len(requests) > MaxBatchSize {
+		return nil, fmt.Errorf("%w: at most %d texts per call", ErrInvalidRequest, MaxBatchSize)
+	}
+	batch := model.BatchEmbedContentsRequest{Requests: make([]model.EmbedContentRequest, len(requests))}
+	for i, req := range requests {
+		if embeddedText(req.Content) == "" {
+			return nil, fmt.Errorf("%w: requests[%d] has no text", ErrInvalidRequest, i)
+		}
+		if req.OutputDimensionality < 0 {
+			return nil, fmt.Errorf("%w: requests[%d].outputDimensionality must not be negative", ErrInvalidRequest, i)
+		}
+		req.Model = "models/" + modelName
+		batch.Requests[i] = req
+	}
+	if c.mock {
+		return mockEmbeddings(batch.Requests), nil
+	}
+	if c.cfg.APIKey == "" {
+		return nil, ErrNotConfigured
+	}
+
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return nil, err
+	}
+	endpoint := c.cfg.BaseURL + "/v1beta/models/" + url.PathEscape(modelName) + ":batchEmbedContents"
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("x-goog-api-key", c.cfg.APIKey)
+	resp, err := c.client.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("embeddings API: %w", err)
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("embeddings API: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, apiError(resp.StatusCode, raw)
+	}
+	var result model.BatchEmbedContentsResponse
+	if err := json.Unmarshal(raw, &result); err != nil {
+		return nil, fmt.Errorf("embeddings API: invalid response: %w", err)
+	}
+	if len(result.Embeddings) != len(requests) {
+		return nil, fmt.Errorf("embeddings API: %d embeddings for %d texts", len(result.Embeddings), len(requests))
+	}
+	return result.Embeddings, nil
+}
+
+func apiError(code int, body []byte) error {
+	var envelope model.GeminiErrorResponse
+	if err := json.Unmarshal(body, &envelope); err == nil && envelope.Error.Message != "" {
+		return &APIError{Code: code, Message: envelope.Error.Message, Status: envelope.Error.Status}
+	}
+	return &APIError{Code: code, Message: strings.TrimSpace(string(body))}
+}
+
+// embeddedText is the text of content the API embeds: its text parts.
+func embeddedText(content model.GeminiContent) string {
+	texts := make([]string, 0, len(content.Parts))
+	for _, part := range content.Parts {
+		if text := strings.TrimSpace(part.Text); text != "" {
+			texts = append(texts, text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+func mockEmbeddings(requests []model.EmbedContentRequest) []model.ContentEmbedding {
+	embeddings := make([]model.ContentEmbedding, len(requests))
+	for i, req := range requests {
+		dimensions := req.OutputDimensionality
+		if dimensions == 0 {
+			dimensions = mockDimensions
+		}
+		values := make([]float32, dimensions)
+		seed := sha256.Sum256([]byte(embeddedText(req.Content)))
+		var norm float64
+		for j := range values {
+			block := sha256.Sum256(append(seed[:], byte(j>>8), byte(j)))
+			value := float64(int32(binary.BigEndian.Uint32(block[:4]))) / math.MaxInt32
+			values[j] = float32(value)
+			norm += value * value
+		}
+		norm = math.Sqrt(norm)
+		for j := range values {
+			values[j] = float32(float64(values[j]) / norm)
+		}
+		embeddings[i] = model.ContentEmbedding{Values: values}
+	}
+	return embeddings
+}
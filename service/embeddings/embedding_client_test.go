@@ -0,0 +1,110 @@
+package embeddings
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gemini-wrapper/model"
+)
+
+func textRequest(text string) model.EmbedContentRequest {
+	return model.EmbedContentRequest{Content: model.GeminiContent{Parts: []model.GeminiPart{{Text: text}}}}
+}
+
+func TestEmbedCallsBatchEmbedContents(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1beta/models/text-embedding-004:batchEmbedContents" || r.Header.Get("x-goog-api-key") != "key" {
+			t.Errorf("unexpected request %s with key %q", r.URL.Path, r.Header.Get("x-goog-api-key"))
+		}
+		var batch model.BatchEmbedContentsRequest
+		if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+			t.Errorf("decode: %v", err)
+		}
+		resp := model.BatchEmbedContentsResponse{}
+		for i, req := range batch.Requests {
+			if req.Model != "models/text-embedding-004" || req.TaskType != "RETRIEVAL_QUERY" {
+				t.Errorf("unexpected request %#v", req)
+			}
+			resp.Embeddings = append(resp.Embeddings, model.ContentEmbedding{Values: []float32{float32(i), 1}})
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	}))
+	defer server.Close()
+
+	client := New(Config{APIKey: "key", BaseURL: server.URL}, false)
+	requests := []model.EmbedContentRequest{textRequest("a"), textRequest("b")}
+	for i := range requests {
+		requests[i].TaskType = "RETRIEVAL_QUERY"
+	}
+	result, err := client.Embed(context.Background(), "models/text-embedding-004", requests)
+	if err != nil {
+		t.Fatalf("Embed: %v", err)
+	}
+	if len(result) != 2 || result[1].Values[0] != 1 {
+		t.Fatalf("unexpected embeddings %#v", result)
+	}
+}
+
+func TestEmbedPassesAPIErrorsOn(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		_, _ = w.Write([]byte(`{"error": {"code": 429, "message": "Quota exceeded", "status": "RESOURCE_EXHAUSTED"}}`))
+	}))
+	defer server.Close()
+
+	_, err := New(Config{APIKey: "key", BaseURL: server.URL}, false).Embed(context.Background(), "", []model.EmbedContentRequest{textRequest("a")})
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.Code != http.StatusTooManyRequests || apiErr.Status != "RESOURCE_EXHAUSTED" || apiErr.Message != "Quota exceeded" {
+		t.Fatalf("expected the API error, got %#v", err)
+	}
+}
+
+func TestEmbedValidatesBeforeCalling(t *testing.T) {
+	client := New(Config{}, false)
+	if _, err := client.Embed(context.Background(), "", []model.EmbedContentRequest{textRequest("a")}); !errors.Is(err, ErrNotConfigured) {
+		t.Fatalf("expected ErrNotConfigured, got %v", err)
+	}
+	tooMany := make([]model.EmbedContentRequest, MaxBatchSize+1)
+	for _, requests := range [][]model.EmbedContentRequest{nil, {textRequest(" ")}, tooMany} {
+		if _, err := client.Embed(context.Background(), "", requests); !errors.Is(err, ErrInvalidRequest) {
+			t.Fatalf("expected ErrInvalidRequest for %d requests, got %v", len(requests), err)
+		}
+	}
+}
+
+func TestMockEmbeddingsAreDeterministicUnitVectors(t *testing.T) {
+	client := New(Config{}, true)
+	first, err := client.Embed(context.Background(), "", []model.EmbedContentRequest{textRequest("cat"), textRequest("dog")})
+	if err != nil {
+		t.Fatalf("Embed: %v", err)
+	}
+	again, _ := client.Embed(context.Background(), "", []model.EmbedContentRequest{textRequest("cat")})
+	if len(first[0].Values) != mockDimensions {
+		t.Fatalf("expected %d dimensions, got %d", mockDimensions, len(first[0].Values))
+	}
+	dot := func(a, b []float32) float64 {
+		var sum float64
+		for i := range a {
+			sum += float64(a[i]) * float64(b[i])
+		}
+		return sum
+	}
+	if math.Abs(dot(first[0].Values, again[0].Values)-1) > 1e-4 {
+		t.Fatal("expected equal texts to get the same unit vector")
+	}
+	if math.Abs(dot(first[0].Values, first[1].Values)) > 0.3 {
+		t.Fatal("expected different texts to get nearly orthogonal vectors")
+	}
+
+	short := textRequest("cat")
+	short.OutputDimensionality = 8
+	result, _ := client.Embed(context.Background(), "", []model.EmbedContentRequest{short})
+	if len(result[0].Values) != 8 {
+		t.Fatalf("expected 8 dimensions, got %d", len(result[0].Values))
+	}
+}
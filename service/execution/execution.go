@@ -0,0 +1,152 @@
+// Package execution decides how far the CLI may act on the machine for a
+// request: whether it runs in a sandbox and which tool calls, such as file
+// edits and shell commands, it makes without approval. Requests may ask for a
+// stricter policy than the configured one; only trusted clients may ask for a
+// more permissive one.
+package execution
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Approval modes of the CLI, from the most to the least restrictive.
+const (
+	// ModeDefault runs only tools that need no approval. Headless runs have
+	// nobody to approve the others, so the CLI cannot edit files or run
+	// shell commands.
+	ModeDefault = "default"
+	// ModeAutoEdit also approves file edits.
+	ModeAutoEdit = "auto_edit"
+	// ModeYolo approves every tool call.
+	ModeYolo = "yolo"
+)
+
+// Modes lists the approval modes, from the most to the least restrictive.
+var Modes = []string{ModeDefault, ModeAutoEdit, ModeYolo}
+
+var (
+	ErrInvalidMode = errors.New("invalid approval mode")
+	// ErrNotAllowed is returned when an untrusted client asks for a more
+	// permissive policy than the configured one.
+	ErrNotAllowed = errors.New("execution policy not allowed for this client")
+)
+
+type Config struct {
+	// ApprovalMode applies to requests that set none.
+	ApprovalMode string `yaml:"approval_mode"`
+	// Sandbox runs the CLI with --sandbox unless a request turns it off.
+	Sandbox bool `yaml:"sandbox"`
+	// TrustedClients may ask for any policy, like the clients marked by
+	// WithTrustedClient. Clients are named like in rate limits:
+	// "key:<label>" or "ip:<address>".
+	TrustedClients []string `yaml:"trusted_clients"`
+}
+
+func DefaultConfig() Config {
+	return Config{ApprovalMode: ModeDefault}
+}
+
+// ApplyEnv overrides c with the EXECUTION_* environment variables that are set.
+func (c *Config) ApplyEnv() {
+	if mode := strings.TrimSpace(os.Getenv("EXECUTION_APPROVAL_MODE")); mode != "" {
+		c.ApprovalMode = mode
+	}
+	if raw := strings.TrimSpace(os.Getenv("EXECUTION_SANDBOX")); raw != "" {
+		if parsed, err := strconv.ParseBool(raw); err == nil {
+			c.Sandbox = parsed
+		}
+	}
+	if raw := strings.TrimSpace(os.Getenv("EXECUTION_TRUSTED_CLIENTS")); raw != "" {
+		c.TrustedClients = nil
+		for _, client := range strings.Split(raw, ",") {
+			if client = strings.TrimSpace(client); client != "" {
+				c.TrustedClients = append(c.TrustedClients, client)
+			}
+		}
+	}
+}
+
+// Validate rejects an unknown approval mode.
+func (c Config) Validate() error {
+	if c.ApprovalMode != "" && !slices.Contains(Modes, c.ApprovalMode) {
+		return fmt.Errorf("%w %q (expected one of %s)", ErrInvalidMode, c.ApprovalMode, strings.Join(Modes, ", "))
+	}
+	return nil
+}
+
+// Policy is the execution policy of one CLI run.
+type Policy struct {
+	ApprovalMode string
+	Sandbox      bool
+}
+
+// Args returns the CLI flags that apply p.
+func (p Policy) Args() []string {
+	var args []string
+	if p.ApprovalMode != "" && p.ApprovalMode != ModeDefault {
+		args = append(args, "--approval-mode", p.ApprovalMode)
+	}
+	if p.Sandbox {
+		args = append(args, "--sandbox")
+	}
+	return args
+}
+
+// Resolve returns the policy of a request run with ctx that asks for mode
+// and sandbox; "" and nil keep the configured values. A policy more
+// permissive than the configured one needs a trusted client.
+func (c Config) Resolve(ctx context.Context, mode string, sandbox *bool) (Policy, error) {
+	policy := Policy{ApprovalMode: c.ApprovalMode, Sandbox: c.Sandbox}
+	if policy.ApprovalMode == "" {
+		policy.ApprovalMode = ModeDefault
+	}
+	configured := policy
+	if mode != "" {
+		if !slices.Contains(Modes, mode) {
+			return Policy{}, fmt.Errorf("%w %q (expected one of %s)", ErrInvalidMode, mode, strings.Join(Modes, ", "))
+		}
+		policy.ApprovalMode = mode
+	}
+	if sandbox != nil {
+		policy.Sandbox = *sandbox
+	}
+
+	looser := slices.Index(Modes, policy.ApprovalMode) > slices.Index(Modes, configured.ApprovalMode) ||
+		(configured.Sandbox && !policy.Sandbox)
+	if looser && !trusted(ctx) && !slices.Contains(c.TrustedClients, Client(ctx)) {
+		return Policy{}, fmt.Errorf("%w: approval mode %s, sandbox %t", ErrNotAllowed, policy.ApprovalMode, policy.Sandbox)
+	}
+	return policy, nil
+}
+
+type clientKey struct{}
+
+type trustedKey struct{}
+
+// WithClient records the client a request comes from for Resolve.
+func WithClient(ctx context.Context, client string) context.Context {
+	return context.WithValue(ctx, clientKey{}, client)
+}
+
+// Client returns the client recorded by WithClient, or "".
+func Client(ctx context.Context) string {
+	client, _ := ctx.Value(clientKey{}).(string)
+	return client
+}
+
+// WithTrustedClient lets the request run with ctx ask for any policy, like
+// the TrustedClients.
+func WithTrustedClient(ctx context.Context) context.Context {
+	return context.WithValue(ctx, trustedKey{}, true)
+}
+
+func trusted(ctx context.Context) bool {
+	ok, _ := ctx.Value(trustedKey{}).(bool)
+	return ok
+}
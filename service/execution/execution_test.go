@@ -0,0 +1,68 @@
+package execution
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	on, off := true, false
+	cfg := Config{ApprovalMode: ModeAutoEdit, Sandbox: true, TrustedClients: []string{"key:ci"}}
+	trusted := WithClient(context.Background(), "key:ci")
+	untrusted := WithClient(context.Background(), "key:web")
+
+	tests := map[string]struct {
+		ctx     context.Context
+		mode    string
+		sandbox *bool
+		want    Policy
+		err     error
+	}{
+		"configured":               {ctx: untrusted, want: Policy{ApprovalMode: ModeAutoEdit, Sandbox: true}},
+		"stricter mode":            {ctx: untrusted, mode: ModeDefault, want: Policy{ApprovalMode: ModeDefault, Sandbox: true}},
+		"looser mode untrusted":    {ctx: untrusted, mode: ModeYolo, err: ErrNotAllowed},
+		"no sandbox untrusted":     {ctx: untrusted, sandbox: &off, err: ErrNotAllowed},
+		"no client":                {ctx: context.Background(), mode: ModeYolo, err: ErrNotAllowed},
+		"looser mode trusted":      {ctx: trusted, mode: ModeYolo, sandbox: &off, want: Policy{ApprovalMode: ModeYolo}},
+		"trusted by its key":       {ctx: WithTrustedClient(untrusted), mode: ModeYolo, want: Policy{ApprovalMode: ModeYolo, Sandbox: true}},
+		"sandbox already on":       {ctx: untrusted, sandbox: &on, want: Policy{ApprovalMode: ModeAutoEdit, Sandbox: true}},
+		"unknown mode":             {ctx: trusted, mode: "plan-everything", err: ErrInvalidMode},
+		"unknown mode untrusted":   {ctx: untrusted, mode: "YOLO", err: ErrInvalidMode},
+		"stricter mode no sandbox": {ctx: untrusted, mode: ModeDefault, sandbox: &off, err: ErrNotAllowed},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := cfg.Resolve(tt.ctx, tt.mode, tt.sandbox)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected error %v, got %v", tt.err, err)
+			}
+			if got != tt.want {
+				t.Fatalf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveDefaultsToReadOnly(t *testing.T) {
+	got, err := Config{}.Resolve(context.Background(), "", nil)
+	if err != nil || got != (Policy{ApprovalMode: ModeDefault}) {
+		t.Fatalf("expected the default mode without sandbox, got %#v, %v", got, err)
+	}
+	if args := got.Args(); len(args) != 0 {
+		t.Fatalf("expected no flags for the default policy, got %q", args)
+	}
+	if args := (Policy{ApprovalMode: ModeYolo, Sandbox: true}).Args(); !reflect.DeepEqual(args, []string{"--approval-mode", "yolo", "--sandbox"}) {
+		t.Fatalf("unexpected flags: %q", args)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := DefaultConfig().Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := (Config{ApprovalMode: "always"}).Validate(); !errors.Is(err, ErrInvalidMode) {
+		t.Fatalf("expected ErrInvalidMode, got %v", err)
+	}
+}
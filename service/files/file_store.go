@@ -0,0 +1,518 @@
+// Package files stores the files clients upload through the Gemini Files API
+// so prompts can refer to them by name, as with the real API.
+package files
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gemini-wrapper/metrics"
+	"gemini-wrapper/model"
+)
+
+const (
+	namePrefix = "files/"
+	// uploadsDir holds the uploads still in progress.
+	uploadsDir = "uploads"
+	// uploadTTL is how long an unfinished upload is kept after its last chunk.
+	uploadTTL = time.Hour
+)
+
+var (
+	// ErrFileNotFound is returned when a file name is unknown or the file has
+	// expired.
+	ErrFileNotFound = errors.New("file not found")
+	// ErrUploadNotFound is returned for an unknown or expired upload ID.
+	ErrUploadNotFound = errors.New("upload not found")
+	// ErrInvalidOffset is returned for a chunk that does not continue the
+	// upload where it stands.
+	ErrInvalidOffset = errors.New("upload offset does not match the bytes received")
+	// ErrSizeMismatch is returned when a finished upload is not the size
+	// announced when it started.
+	ErrSizeMismatch = errors.New("upload size does not match the announced size")
+	// ErrTooLarge is returned for a file larger than MaxFileBytes.
+	ErrTooLarge = errors.New("file size limit exceeded")
+	// ErrStorageFull is returned when a file would exceed MaxTotalBytes.
+	ErrStorageFull = errors.New("file storage quota exceeded")
+)
+
+type Config struct {
+	Enabled bool   `yaml:"enabled"`
+	Dir     string `yaml:"dir"`
+	// TTL is how long a file is kept after its upload.
+	TTL time.Duration `yaml:"ttl"`
+	// MaxFileBytes caps the size of one file. 0 disables the limit.
+	MaxFileBytes int64 `yaml:"max_file_bytes"`
+	// MaxTotalBytes caps the size of all files together. 0 disables the
+	// limit.
+	MaxTotalBytes int64 `yaml:"max_total_bytes"`
+}
+
+func DefaultConfig() Config {
+	return Config{Enabled: true, Dir: "/app/cache/files", TTL: 48 * time.Hour, MaxFileBytes: 100 << 20, MaxTotalBytes: 2 << 30}
+}
+
+// ApplyEnv overrides c with the FILES_* environment variables that are set.
+func (c *Config) ApplyEnv() {
+	if raw := strings.TrimSpace(os.Getenv("FILES_ENABLED")); raw != "" {
+		if parsed, err := strconv.ParseBool(raw); err == nil {
+			c.Enabled = parsed
+		}
+	}
+	if dir := strings.TrimSpace(os.Getenv("FILES_DIR")); dir != "" {
+		c.Dir = dir
+	}
+	if seconds := envInt("FILES_TTL_SECONDS", 0); seconds > 0 {
+		c.TTL = time.Duration(seconds) * time.Second
+	}
+	c.MaxFileBytes = int64(envInt("FILES_MAX_FILE_BYTES", int(c.MaxFileBytes)))
+	c.MaxTotalBytes = int64(envInt("FILES_MAX_TOTAL_BYTES", int(c.MaxTotalBytes)))
+}
+
+// Metadata describes a file when its upload starts.
+type Metadata struct {
+	DisplayName string
+	MimeType    string
+	// Size is the announced size, or 0 when unknown.
+	Size int64
+}
+
+// Store keeps uploaded files under Config.Dir, each as its content and a
+// JSON sidecar with its metadata, so they outlive restarts until they expire.
+// Files never change and their names are never reused.
+type Store struct {
+	cfg Config
+	now func() time.Time
+
+	mu      sync.Mutex
+	files   map[string]model.GeminiFile
+	uploads map[string]*upload
+	// reserved counts the bytes of unfinished uploads against MaxTotalBytes.
+	reserved int64
+}
+
+type upload struct {
+	meta     Metadata
+	received int64
+	hash     hash.Hash
+	// busy is held while a chunk is written, so chunks of one upload cannot
+	// interleave.
+	busy     sync.Mutex
+	lastUsed time.Time
+}
+
+// Open creates cfg.Dir, loads the files kept there and drops the expired
+// ones and the uploads a previous process left unfinished.
+func Open(cfg Config) (*Store, error) {
+	defaults := DefaultConfig()
+	if cfg.Dir == "" {
+		cfg.Dir = defaults.Dir
+	}
+	if cfg.TTL <= 0 {
+		cfg.TTL = defaults.TTL
+	}
+	if err := os.RemoveAll(filepath.Join(cfg.Dir, uploadsDir)); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Join(cfg.Dir, uploadsDir), 0o700); err != nil {
+		return nil, err
+	}
+	s := &Store{cfg: cfg, now: time.Now, files: map[string]model.GeminiFile{}, uploads: map[string]*upload{}}
+	entries, err := os.ReadDir(cfg.Dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok || entry.IsDir() {
+			continue
+		}
+		raw, err := os.ReadFile(filepath.Join(cfg.Dir, entry.Name()))
+		var file model.GeminiFile
+		if err == nil {
+			err = json.Unmarshal(raw, &file)
+		}
+		if err != nil || file.Name != namePrefix+id {
+			slog.Warn("skipping unreadable file metadata", "file", entry.Name(), "error", err)
+			continue
+		}
+		s.files[id] = file
+	}
+	s.mu.Lock()
+	s.pruneLocked()
+	s.mu.Unlock()
+	return s, nil
+}
+
+// Get returns the file called name, either "files/<id>" or "<id>".
+func (s *Store) Get(name string) (model.GeminiFile, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pruneLocked()
+	file, ok := s.files[fileID(name)]
+	if !ok {
+		return model.GeminiFile{}, ErrFileNotFound
+	}
+	return file, nil
+}
+
+// Path returns the file called name and where its content is stored.
+func (s *Store) Path(name string) (model.GeminiFile, string, error) {
+	file, err := s.Get(name)
+	if err != nil {
+		return file, "", err
+	}
+	return file, s.contentPath(fileID(name)), nil
+}
+
+// List returns the files, newest first.
+func (s *Store) List() []model.GeminiFile {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pruneLocked()
+	list := make([]model.GeminiFile, 0, len(s.files))
+	for _, file := range s.files {
+		list = append(list, file)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].CreateTime.Equal(list[j].CreateTime) {
+			return list[i].CreateTime.After(list[j].CreateTime)
+		}
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// Delete removes the file called name.
+func (s *Store) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pruneLocked()
+	id := fileID(name)
+	if _, ok := s.files[id]; !ok {
+		return ErrFileNotFound
+	}
+	s.removeLocked(id)
+	return nil
+}
+
+// Create stores the content of r as a new file.
+func (s *Store) Create(meta Metadata, r io.Reader) (model.GeminiFile, error) {
+	uploadID, err := s.StartUpload(meta)
+	if err != nil {
+		return model.GeminiFile{}, err
+	}
+	_, file, err := s.WriteChunk(uploadID, 0, r, true)
+	if err != nil {
+		s.CancelUpload(uploadID)
+	}
+	return file, err
+}
+
+// StartUpload begins a resumable upload and returns its ID.
+func (s *Store) StartUpload(meta Metadata) (string, error) {
+	if meta.Size < 0 {
+		meta.Size = 0
+	}
+	if s.cfg.MaxFileBytes > 0 && meta.Size > s.cfg.MaxFileBytes {
+		return "", ErrTooLarge
+	}
+	id, err := randomID(16)
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(s.uploadPath(id), nil, 0o600); err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pruneLocked()
+	if err := s.reserveLocked(meta.Size); err != nil {
+		_ = os.Remove(s.uploadPath(id))
+		return "", err
+	}
+	s.uploads[id] = &upload{meta: meta, hash: sha256.New(), lastUsed: s.now()}
+	return id, nil
+}
+
+// UploadStatus returns how many bytes an upload has received.
+func (s *Store) UploadStatus(uploadID string) (int64, error) {
+	up, err := s.lookupUpload(uploadID)
+	if err != nil {
+		return 0, err
+	}
+	up.busy.Lock()
+	defer up.busy.Unlock()
+	return up.received, nil
+}
+
+// WriteChunk appends the content of r to an upload at offset, which must be
+// the number of bytes received so far. With finalize the upload becomes a
+// file, which is returned. It returns the bytes received.
+func (s *Store) WriteChunk(uploadID string, offset int64, r io.Reader, finalize bool) (int64, model.GeminiFile, error) {
+	up, err := s.lookupUpload(uploadID)
+	if err != nil {
+		return 0, model.GeminiFile{}, err
+	}
+	up.busy.Lock()
+	defer up.busy.Unlock()
+	if offset != up.received {
+		return up.received, model.GeminiFile{}, ErrInvalidOffset
+	}
+
+	f, err := os.OpenFile(s.uploadPath(uploadID), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return up.received, model.GeminiFile{}, ErrUploadNotFound
+	}
+	limit := s.chunkLimit(up)
+	n, err := io.Copy(io.MultiWriter(f, up.hash), io.LimitReader(r, limit+1))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && n > limit {
+		err = ErrTooLarge
+		if s.cfg.MaxFileBytes <= 0 || up.received+n <= s.cfg.MaxFileBytes {
+			err = ErrStorageFull
+		}
+	}
+	if err != nil {
+		// The chunk cannot be resumed from the middle: drop the upload.
+		s.CancelUpload(uploadID)
+		return up.received, model.GeminiFile{}, err
+	}
+	s.mu.Lock()
+	reserved := reservation(up)
+	up.received += n
+	s.reserved += reservation(up) - reserved
+	up.lastUsed = s.now()
+	s.mu.Unlock()
+	if !finalize {
+		return up.received, model.GeminiFile{}, nil
+	}
+	if up.meta.Size > 0 && up.received != up.meta.Size {
+		s.CancelUpload(uploadID)
+		return up.received, model.GeminiFile{}, ErrSizeMismatch
+	}
+	file, err := s.finish(uploadID, up)
+	return up.received, file, err
+}
+
+// CancelUpload drops an unfinished upload.
+func (s *Store) CancelUpload(uploadID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dropUploadLocked(uploadID)
+}
+
+// chunkLimit is how many more bytes up may receive within the limits.
+func (s *Store) chunkLimit(up *upload) int64 {
+	limit := int64(1<<63 - 1)
+	if s.cfg.MaxFileBytes > 0 {
+		limit = s.cfg.MaxFileBytes - up.received
+	}
+	if s.cfg.MaxTotalBytes > 0 {
+		s.mu.Lock()
+		// What up reserved beyond the bytes it received is its own.
+		free := s.cfg.MaxTotalBytes - s.usedLocked() + reservation(up) - up.received
+		s.mu.Unlock()
+		limit = min(limit, free)
+	}
+	return max(0, limit)
+}
+
+func (s *Store) finish(uploadID string, up *upload) (model.GeminiFile, error) {
+	id, err := randomID(6)
+	if err != nil {
+		return model.GeminiFile{}, err
+	}
+	now := s.now().UTC()
+	file := model.GeminiFile{
+		Name:           namePrefix + id,
+		DisplayName:    up.meta.DisplayName,
+		MimeType:       up.meta.MimeType,
+		SizeBytes:      up.received,
+		CreateTime:     now,
+		UpdateTime:     now,
+		ExpirationTime: now.Add(s.cfg.TTL),
+		SHA256Hash:     base64.StdEncoding.EncodeToString(up.hash.Sum(nil)),
+		State:          model.FileStateActive,
+		Source:         model.FileSourceUpload,
+	}
+	if file.MimeType == "" {
+		file.MimeType = "application/octet-stream"
+	}
+	raw, err := json.Marshal(file)
+	if err != nil {
+		return model.GeminiFile{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.uploads[uploadID]; !ok {
+		return model.GeminiFile{}, ErrUploadNotFound
+	}
+	if err := os.Rename(s.uploadPath(uploadID), s.contentPath(id)); err != nil {
+		s.dropUploadLocked(uploadID)
+		return model.GeminiFile{}, err
+	}
+	if err := os.WriteFile(s.metadataPath(id), raw, 0o600); err != nil {
+		_ = os.Remove(s.contentPath(id))
+		s.dropUploadLocked(uploadID)
+		return model.GeminiFile{}, err
+	}
+	s.releaseLocked(up)
+	delete(s.uploads, uploadID)
+	s.files[id] = file
+	return file, nil
+}
+
+func (s *Store) lookupUpload(uploadID string) (*upload, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pruneLocked()
+	up, ok := s.uploads[uploadID]
+	if !ok {
+		return nil, ErrUploadNotFound
+	}
+	up.lastUsed = s.now()
+	return up, nil
+}
+
+// reserveLocked sets size bytes aside for an upload, so concurrent uploads
+// cannot together exceed MaxTotalBytes.
+func (s *Store) reserveLocked(size int64) error {
+	if s.cfg.MaxTotalBytes > 0 && s.usedLocked()+size > s.cfg.MaxTotalBytes {
+		return ErrStorageFull
+	}
+	s.reserved += size
+	return nil
+}
+
+func (s *Store) releaseLocked(up *upload) {
+	s.reserved -= reservation(up)
+}
+
+// reservation is what up counts against MaxTotalBytes: its announced size,
+// or what it received when that is more.
+func reservation(up *upload) int64 {
+	return max(up.meta.Size, up.received)
+}
+
+// usedLocked is the size of the files plus what uploads reserved.
+func (s *Store) usedLocked() int64 {
+	used := s.reserved
+	for _, file := range s.files {
+		used += file.SizeBytes
+	}
+	return used
+}
+
+func (s *Store) dropUploadLocked(uploadID string) {
+	up, ok := s.uploads[uploadID]
+	if !ok {
+		return
+	}
+	s.releaseLocked(up)
+	delete(s.uploads, uploadID)
+	if err := os.Remove(s.uploadPath(uploadID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Warn("removing upload failed", "upload", uploadID, "error", err)
+	}
+}
+
+func (s *Store) removeLocked(id string) {
+	delete(s.files, id)
+	for _, path := range []string{s.metadataPath(id), s.contentPath(id)} {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("removing file failed", "file", namePrefix+id, "error", err)
+		}
+	}
+}
+
+// Reap deletes the expired files and idle uploads, which otherwise happens
+// only when the store is used.
+func (s *Store) Reap() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pruneLocked()
+}
+
+// pruneLocked deletes the expired files and the uploads idle for uploadTTL.
+// An upload writing a chunk is kept.
+func (s *Store) pruneLocked() {
+	now := s.now()
+	for id, file := range s.files {
+		if !now.Before(file.ExpirationTime) {
+			s.removeLocked(id)
+			metrics.Reclaimed.Inc("file")
+			metrics.ReclaimedBytes.Add(float64(file.SizeBytes), "file")
+		}
+	}
+	for id, up := range s.uploads {
+		if now.Sub(up.lastUsed) < uploadTTL || !up.busy.TryLock() {
+			continue
+		}
+		received := up.received
+		s.dropUploadLocked(id)
+		up.busy.Unlock()
+		metrics.Reclaimed.Inc("upload")
+		metrics.ReclaimedBytes.Add(float64(received), "upload")
+	}
+}
+
+func (s *Store) contentPath(id string) string {
+	return filepath.Join(s.cfg.Dir, id)
+}
+
+func (s *Store) metadataPath(id string) string {
+	return filepath.Join(s.cfg.Dir, id+".json")
+}
+
+func (s *Store) uploadPath(uploadID string) string {
+	return filepath.Join(s.cfg.Dir, uploadsDir, uploadID)
+}
+
+// fileID returns the ID of a file name, or "" when name is not one the
+// store could have made.
+func fileID(name string) string {
+	id := strings.TrimPrefix(name, namePrefix)
+	if id == "" || len(id) > 40 {
+		return ""
+	}
+	for _, r := range id {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '-' {
+			return ""
+		}
+	}
+	return id
+}
+
+func randomID(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generating an ID: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func envInt(key string, defaultValue int) int {
+	parsed, err := strconv.Atoi(strings.TrimSpace(os.Getenv(key)))
+	if err != nil || parsed < 0 {
+		return defaultValue
+	}
+	return parsed
+}
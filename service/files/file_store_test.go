@@ -0,0 +1,188 @@
+package files
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"gemini-wrapper/metrics"
+)
+
+func newTestStore(t *testing.T, cfg Config) *Store {
+	t.Helper()
+	cfg.Dir = t.TempDir()
+	s, err := Open(cfg)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	return s
+}
+
+func TestCreateGetAndDelete(t *testing.T) {
+	s := newTestStore(t, DefaultConfig())
+	file, err := s.Create(Metadata{DisplayName: "cat", MimeType: "image/png"}, strings.NewReader("png"))
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if !strings.HasPrefix(file.Name, "files/") || file.SizeBytes != 3 || file.State != "ACTIVE" || file.SHA256Hash == "" {
+		t.Fatalf("unexpected file %#v", file)
+	}
+	if !file.ExpirationTime.Equal(file.CreateTime.Add(48 * time.Hour)) {
+		t.Fatalf("expected the file to expire after 48h, got %v", file.ExpirationTime)
+	}
+
+	got, path, err := s.Path(file.Name)
+	if err != nil || got.Name != file.Name {
+		t.Fatalf("Path: %#v, %v", got, err)
+	}
+	if content, err := os.ReadFile(path); err != nil || string(content) != "png" {
+		t.Fatalf("expected the content at %s, got %q, %v", path, content, err)
+	}
+	if list := s.List(); len(list) != 1 {
+		t.Fatalf("expected one file, got %#v", list)
+	}
+
+	if err := s.Delete(strings.TrimPrefix(file.Name, "files/")); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := s.Get(file.Name); !errors.Is(err, ErrFileNotFound) {
+		t.Fatalf("expected ErrFileNotFound, got %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected the content to be removed, got %v", err)
+	}
+}
+
+func TestFilesSurviveReopenUntilExpired(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Dir = t.TempDir()
+	s, err := Open(cfg)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	file, err := s.Create(Metadata{MimeType: "text/plain"}, strings.NewReader("hello"))
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	reopened, err := Open(cfg)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if got, err := reopened.Get(file.Name); err != nil || got.SHA256Hash != file.SHA256Hash {
+		t.Fatalf("expected the file after reopening, got %#v, %v", got, err)
+	}
+
+	now := time.Now().Add(cfg.TTL + time.Second)
+	reopened.now = func() time.Time { return now }
+	if _, err := reopened.Get(file.Name); !errors.Is(err, ErrFileNotFound) {
+		t.Fatalf("expected the file to expire, got %v", err)
+	}
+}
+
+func TestReapRemovesExpiredFilesAndIdleUploads(t *testing.T) {
+	s := newTestStore(t, DefaultConfig())
+	file, err := s.Create(Metadata{MimeType: "text/plain"}, strings.NewReader("hello"))
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	uploadID, err := s.StartUpload(Metadata{MimeType: "text/plain", Size: 6})
+	if err != nil {
+		t.Fatalf("StartUpload: %v", err)
+	}
+	if _, _, err := s.WriteChunk(uploadID, 0, strings.NewReader("abc"), false); err != nil {
+		t.Fatalf("WriteChunk: %v", err)
+	}
+	files, fileBytes := metrics.Reclaimed.Value("file"), metrics.ReclaimedBytes.Value("file")
+	uploads, uploadBytes := metrics.Reclaimed.Value("upload"), metrics.ReclaimedBytes.Value("upload")
+
+	now := time.Now().Add(s.cfg.TTL + time.Second)
+	s.now = func() time.Time { return now }
+	s.Reap()
+	if len(s.files) != 0 || len(s.uploads) != 0 {
+		t.Fatalf("expected the file and the upload to be removed, got %d files and %d uploads", len(s.files), len(s.uploads))
+	}
+	if _, err := os.Stat(s.contentPath(strings.TrimPrefix(file.Name, "files/"))); !os.IsNotExist(err) {
+		t.Fatalf("expected the content to be removed, got %v", err)
+	}
+	if got := metrics.Reclaimed.Value("file") - files; got != 1 {
+		t.Fatalf("expected one reclaimed file, got %v", got)
+	}
+	if got := metrics.ReclaimedBytes.Value("file") - fileBytes; got != 5 {
+		t.Fatalf("expected 5 reclaimed file bytes, got %v", got)
+	}
+	if got := metrics.Reclaimed.Value("upload") - uploads; got != 1 {
+		t.Fatalf("expected one reclaimed upload, got %v", got)
+	}
+	if got := metrics.ReclaimedBytes.Value("upload") - uploadBytes; got != 3 {
+		t.Fatalf("expected 3 reclaimed upload bytes, got %v", got)
+	}
+}
+
+func TestResumableUploadInChunks(t *testing.T) {
+	s := newTestStore(t, DefaultConfig())
+	id, err := s.StartUpload(Metadata{MimeType: "application/pdf", Size: 6})
+	if err != nil {
+		t.Fatalf("StartUpload: %v", err)
+	}
+	if received, _, err := s.WriteChunk(id, 0, strings.NewReader("abc"), false); err != nil || received != 3 {
+		t.Fatalf("WriteChunk: %d, %v", received, err)
+	}
+	if _, _, err := s.WriteChunk(id, 0, strings.NewReader("abc"), false); !errors.Is(err, ErrInvalidOffset) {
+		t.Fatalf("expected ErrInvalidOffset for a repeated chunk, got %v", err)
+	}
+	if received, err := s.UploadStatus(id); err != nil || received != 3 {
+		t.Fatalf("UploadStatus: %d, %v", received, err)
+	}
+	_, file, err := s.WriteChunk(id, 3, strings.NewReader("def"), true)
+	if err != nil {
+		t.Fatalf("WriteChunk: %v", err)
+	}
+	_, path, _ := s.Path(file.Name)
+	if content, _ := os.ReadFile(path); string(content) != "abcdef" || file.MimeType != "application/pdf" {
+		t.Fatalf("unexpected file %#v with %q", file, content)
+	}
+	if _, err := s.UploadStatus(id); !errors.Is(err, ErrUploadNotFound) {
+		t.Fatalf("expected the finished upload to be gone, got %v", err)
+	}
+}
+
+func TestUploadSizeMismatch(t *testing.T) {
+	s := newTestStore(t, DefaultConfig())
+	id, _ := s.StartUpload(Metadata{Size: 10})
+	if _, _, err := s.WriteChunk(id, 0, strings.NewReader("short"), true); !errors.Is(err, ErrSizeMismatch) {
+		t.Fatalf("expected ErrSizeMismatch, got %v", err)
+	}
+	if len(s.List()) != 0 {
+		t.Fatal("expected no file from a mismatched upload")
+	}
+}
+
+func TestUploadLimits(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.MaxFileBytes = 8
+	cfg.MaxTotalBytes = 12
+	s := newTestStore(t, cfg)
+
+	if _, err := s.StartUpload(Metadata{Size: 9}); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("expected ErrTooLarge for an announced size, got %v", err)
+	}
+	if _, err := s.Create(Metadata{}, bytes.NewReader(make([]byte, 9))); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("expected ErrTooLarge for the content, got %v", err)
+	}
+	if _, err := s.Create(Metadata{}, bytes.NewReader(make([]byte, 8))); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err := s.StartUpload(Metadata{Size: 5}); !errors.Is(err, ErrStorageFull) {
+		t.Fatalf("expected ErrStorageFull for an announced size, got %v", err)
+	}
+	if _, err := s.Create(Metadata{}, bytes.NewReader(make([]byte, 5))); !errors.Is(err, ErrStorageFull) {
+		t.Fatalf("expected ErrStorageFull for the content, got %v", err)
+	}
+	if _, err := s.Create(Metadata{}, bytes.NewReader(make([]byte, 4))); err != nil {
+		t.Fatalf("Create within the quota: %v", err)
+	}
+}
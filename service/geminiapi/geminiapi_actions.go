@@ -0,0 +1,48 @@
+package geminiapi
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// Actions of POST /v1beta/models/{model}:{action}.
+const (
+	ActionGenerateContent       = "generateContent"
+	ActionStreamGenerateContent = "streamGenerateContent"
+	ActionCountTokens           = "countTokens"
+	ActionEmbedContent          = "embedContent"
+	ActionBatchEmbedContents    = "batchEmbedContents"
+)
+
+// supportedActions are the generation methods every model advertises.
+var supportedActions = []string{ActionGenerateContent, ActionStreamGenerateContent, ActionCountTokens}
+
+// embeddingActions are served for embedding models, which the embeddings
+// API rather than the CLI answers.
+var embeddingActions = []string{ActionEmbedContent, ActionBatchEmbedContents}
+
+// ErrUnsupportedAction is returned by ParseModelAction for an action the
+// wrapper does not serve.
+var ErrUnsupportedAction = errors.New("unsupported action")
+
+// ParseModelAction splits the path segment "gemini-2.5-flash:generateContent"
+// into model and action. Clients that escape the colon are understood too. A
+// segment without an action is a generateContent call, which the wrapper has
+// always accepted.
+func ParseModelAction(segment string) (string, string, error) {
+	if unescaped, err := url.PathUnescape(segment); err == nil {
+		segment = unescaped
+	}
+	modelName, action, found := strings.Cut(segment, ":")
+	if !found {
+		return modelName, ActionGenerateContent, nil
+	}
+	actions := append(append([]string(nil), supportedActions...), embeddingActions...)
+	if slices.Contains(actions, action) {
+		return modelName, action, nil
+	}
+	return modelName, action, fmt.Errorf("%w %q for models/%s; supported actions are %s", ErrUnsupportedAction, action, modelName, strings.Join(actions, ", "))
+}
@@ -0,0 +1,33 @@
+package geminiapi
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseModelAction(t *testing.T) {
+	cases := []struct {
+		segment string
+		model   string
+		action  string
+	}{
+		{"gemini-3-flash:generateContent", "gemini-3-flash", ActionGenerateContent},
+		{"gemini-2.5-pro:streamGenerateContent", "gemini-2.5-pro", ActionStreamGenerateContent},
+		{"gemini-2.5-flash%3AcountTokens", "gemini-2.5-flash", ActionCountTokens},
+		{"gemini-2.5-flash", "gemini-2.5-flash", ActionGenerateContent},
+		{"gemini-embedding-001:embedContent", "gemini-embedding-001", ActionEmbedContent},
+		{"gemini-embedding-001:batchEmbedContents", "gemini-embedding-001", ActionBatchEmbedContents},
+	}
+	for _, tc := range cases {
+		modelName, action, err := ParseModelAction(tc.segment)
+		if err != nil || modelName != tc.model || action != tc.action {
+			t.Fatalf("ParseModelAction(%q) = %q, %q, %v; want %q, %q", tc.segment, modelName, action, err, tc.model, tc.action)
+		}
+	}
+
+	for _, segment := range []string{"gemini-2.5-flash:predict", "gemini-2.5-flash:", "gemini-2.5-flash:generatecontent"} {
+		if _, _, err := ParseModelAction(segment); !errors.Is(err, ErrUnsupportedAction) {
+			t.Fatalf("expected ErrUnsupportedAction for %q, got %v", segment, err)
+		}
+	}
+}
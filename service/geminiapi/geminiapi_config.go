@@ -0,0 +1,84 @@
+package geminiapi
+
+import (
+	"fmt"
+	"strings"
+
+	"gemini-wrapper/model"
+	"gemini-wrapper/service/jsonschema"
+)
+
+// MaxCandidates is the most candidates a request may ask for, as in the
+// Gemini API.
+const MaxCandidates = 8
+
+// ValidateGenerationConfig rejects values outside the ranges the Gemini API accepts.
+func ValidateGenerationConfig(cfg *model.GenerationConfig) error {
+	if cfg == nil {
+		return nil
+	}
+	if cfg.Temperature != nil && (*cfg.Temperature < 0 || *cfg.Temperature > 2) {
+		return fmt.Errorf("generationConfig.temperature must be between 0 and 2")
+	}
+	if cfg.TopP != nil && (*cfg.TopP < 0 || *cfg.TopP > 1) {
+		return fmt.Errorf("generationConfig.topP must be between 0 and 1")
+	}
+	if cfg.TopK != nil && *cfg.TopK < 0 {
+		return fmt.Errorf("generationConfig.topK must not be negative")
+	}
+	if cfg.MaxOutputTokens < 0 {
+		return fmt.Errorf("generationConfig.maxOutputTokens must not be negative")
+	}
+	if len(cfg.StopSequences) > 5 {
+		return fmt.Errorf("generationConfig.stopSequences supports at most 5 entries")
+	}
+	if cfg.CandidateCount < 0 || cfg.CandidateCount > MaxCandidates {
+		return fmt.Errorf("generationConfig.candidateCount must be between 1 and %d", MaxCandidates)
+	}
+	if thinking := cfg.ThinkingConfig; thinking != nil {
+		if thinking.ThinkingBudget != nil && *thinking.ThinkingBudget < -1 {
+			return fmt.Errorf("generationConfig.thinkingConfig.thinkingBudget must be -1 (dynamic), 0 (off) or a positive token count")
+		}
+		switch strings.ToLower(strings.TrimSpace(thinking.ThinkingLevel)) {
+		case "", "minimal", "low", "medium", "high":
+		default:
+			return fmt.Errorf("generationConfig.thinkingConfig.thinkingLevel must be minimal, low, medium or high")
+		}
+		if thinking.ThinkingBudget != nil && thinking.ThinkingLevel != "" {
+			return fmt.Errorf("generationConfig.thinkingConfig accepts thinkingBudget or thinkingLevel, not both")
+		}
+	}
+	switch strings.ToLower(strings.TrimSpace(cfg.ResponseMimeType)) {
+	case "", "text/plain":
+		if len(cfg.ResponseSchema) > 0 {
+			return fmt.Errorf("generationConfig.responseSchema requires responseMimeType application/json")
+		}
+	case "application/json":
+	default:
+		return fmt.Errorf("generationConfig.responseMimeType must be text/plain or application/json")
+	}
+	if len(cfg.ResponseSchema) > 0 {
+		if _, err := jsonschema.Compile(cfg.ResponseSchema); err != nil {
+			return fmt.Errorf("generationConfig.responseSchema: %v", err)
+		}
+	}
+	return nil
+}
+
+// CandidateOptions returns the options of each candidate opts asks for. The
+// candidates are asked without candidateCount, each as its own question.
+func CandidateOptions(opts model.AskOptions) []model.AskOptions {
+	if opts.GenerationConfig == nil || opts.GenerationConfig.CandidateCount <= 1 {
+		return []model.AskOptions{opts}
+	}
+	cfg := *opts.GenerationConfig
+	n := cfg.CandidateCount
+	cfg.CandidateCount = 0
+	candidates := make([]model.AskOptions, n)
+	for i := range candidates {
+		candidates[i] = opts
+		candidates[i].GenerationConfig = &cfg
+		candidates[i].Candidate = i
+	}
+	return candidates
+}
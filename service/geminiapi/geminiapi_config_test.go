@@ -0,0 +1,65 @@
+package geminiapi
+
+import (
+	"testing"
+
+	"gemini-wrapper/model"
+)
+
+func TestValidateGenerationConfig(t *testing.T) {
+	temperature := 0.7
+	tooHot := 2.5
+	negativeTopK := -1
+	dynamicBudget := -1
+	tooLowBudget := -2
+
+	cases := []struct {
+		name    string
+		cfg     *model.GenerationConfig
+		wantErr bool
+	}{
+		{name: "nil", cfg: nil},
+		{name: "valid", cfg: &model.GenerationConfig{Temperature: &temperature, MaxOutputTokens: 100, StopSequences: []string{"END"}}},
+		{name: "temperature out of range", cfg: &model.GenerationConfig{Temperature: &tooHot}, wantErr: true},
+		{name: "negative topK", cfg: &model.GenerationConfig{TopK: &negativeTopK}, wantErr: true},
+		{name: "negative max tokens", cfg: &model.GenerationConfig{MaxOutputTokens: -1}, wantErr: true},
+		{name: "too many stop sequences", cfg: &model.GenerationConfig{StopSequences: []string{"a", "b", "c", "d", "e", "f"}}, wantErr: true},
+		{name: "candidates", cfg: &model.GenerationConfig{CandidateCount: 3}},
+		{name: "too many candidates", cfg: &model.GenerationConfig{CandidateCount: 9}, wantErr: true},
+		{name: "thinking budget", cfg: &model.GenerationConfig{ThinkingConfig: &model.ThinkingConfig{ThinkingBudget: &dynamicBudget, IncludeThoughts: true}}},
+		{name: "thinking level", cfg: &model.GenerationConfig{ThinkingConfig: &model.ThinkingConfig{ThinkingLevel: "HIGH"}}},
+		{name: "negative thinking budget", cfg: &model.GenerationConfig{ThinkingConfig: &model.ThinkingConfig{ThinkingBudget: &tooLowBudget}}, wantErr: true},
+		{name: "unknown thinking level", cfg: &model.GenerationConfig{ThinkingConfig: &model.ThinkingConfig{ThinkingLevel: "max"}}, wantErr: true},
+		{name: "thinking budget and level", cfg: &model.GenerationConfig{ThinkingConfig: &model.ThinkingConfig{ThinkingBudget: &dynamicBudget, ThinkingLevel: "low"}}, wantErr: true},
+		{name: "json with schema", cfg: &model.GenerationConfig{ResponseMimeType: "application/json", ResponseSchema: []byte(`{"type": "OBJECT"}`)}},
+		{name: "unsupported mime type", cfg: &model.GenerationConfig{ResponseMimeType: "text/x.enum"}, wantErr: true},
+		{name: "schema without json", cfg: &model.GenerationConfig{ResponseSchema: []byte(`{"type": "object"}`)}, wantErr: true},
+		{name: "invalid schema", cfg: &model.GenerationConfig{ResponseMimeType: "application/json", ResponseSchema: []byte(`{"type": "text"}`)}, wantErr: true},
+	}
+
+	for _, tc := range cases {
+		err := ValidateGenerationConfig(tc.cfg)
+		if (err != nil) != tc.wantErr {
+			t.Fatalf("%s: unexpected error state: %v", tc.name, err)
+		}
+	}
+}
+
+func TestCandidateOptions(t *testing.T) {
+	opts := model.AskOptions{Model: "m", GenerationConfig: &model.GenerationConfig{CandidateCount: 3, MaxOutputTokens: 10}}
+	candidates := CandidateOptions(opts)
+	if len(candidates) != 3 {
+		t.Fatalf("got %d candidates, want 3", len(candidates))
+	}
+	for i, candidate := range candidates {
+		if candidate.Candidate != i || candidate.Model != "m" || candidate.GenerationConfig.CandidateCount != 0 || candidate.GenerationConfig.MaxOutputTokens != 10 {
+			t.Fatalf("unexpected candidate %d: %+v", i, candidate)
+		}
+	}
+	if opts.GenerationConfig.CandidateCount != 3 {
+		t.Fatal("the request's config was changed")
+	}
+	if single := CandidateOptions(model.AskOptions{Model: "m"}); len(single) != 1 || single[0].Model != "m" {
+		t.Fatalf("unexpected options %+v", single)
+	}
+}
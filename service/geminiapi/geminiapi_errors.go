@@ -0,0 +1,43 @@
+package geminiapi
+
+import (
+	"net/http"
+
+	"gemini-wrapper/model"
+)
+
+// StatusName returns the canonical Google API status string for an HTTP
+// status code, as reported in error.status.
+func StatusName(code int) string {
+	switch code {
+	case http.StatusBadRequest:
+		return "INVALID_ARGUMENT"
+	case http.StatusUnauthorized:
+		return "UNAUTHENTICATED"
+	case http.StatusForbidden:
+		return "PERMISSION_DENIED"
+	case http.StatusNotFound:
+		return "NOT_FOUND"
+	case http.StatusConflict:
+		return "ABORTED"
+	case http.StatusTooManyRequests:
+		return "RESOURCE_EXHAUSTED"
+	case 499:
+		return "CANCELLED"
+	case http.StatusNotImplemented:
+		return "UNIMPLEMENTED"
+	case http.StatusServiceUnavailable:
+		return "UNAVAILABLE"
+	case http.StatusGatewayTimeout:
+		return "DEADLINE_EXCEEDED"
+	}
+	if code >= 400 && code < 500 {
+		return "FAILED_PRECONDITION"
+	}
+	return "INTERNAL"
+}
+
+// NewError builds the Google API error envelope for code.
+func NewError(code int, message string) model.GeminiErrorResponse {
+	return model.GeminiErrorResponse{Error: model.GeminiError{Code: code, Message: message, Status: StatusName(code)}}
+}
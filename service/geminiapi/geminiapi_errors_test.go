@@ -0,0 +1,23 @@
+package geminiapi
+
+import "testing"
+
+func TestNewErrorUsesCanonicalStatus(t *testing.T) {
+	cases := map[int]string{
+		400: "INVALID_ARGUMENT",
+		401: "UNAUTHENTICATED",
+		403: "PERMISSION_DENIED",
+		404: "NOT_FOUND",
+		429: "RESOURCE_EXHAUSTED",
+		500: "INTERNAL",
+		502: "INTERNAL",
+		503: "UNAVAILABLE",
+		504: "DEADLINE_EXCEEDED",
+	}
+	for code, want := range cases {
+		resp := NewError(code, "failed")
+		if resp.Error.Code != code || resp.Error.Status != want || resp.Error.Message != "failed" {
+			t.Fatalf("NewError(%d) = %#v, want status %s", code, resp.Error, want)
+		}
+	}
+}
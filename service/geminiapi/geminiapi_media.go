@@ -0,0 +1,286 @@
+package geminiapi
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"gemini-wrapper/model"
+)
+
+// The CLI takes no media in a prompt, but reads files named with @path.
+// inlineData and fileData parts are therefore written next to the prompt as
+// attachments and replaced by a reference to them.
+
+const (
+	attachmentDir = "attachments"
+	// maxAttachmentSize is the Gemini API's limit on inline data per request,
+	// applied to each part.
+	maxAttachmentSize = 20 << 20
+)
+
+// mediaExtensions names attachments so the CLI recognises their type; it
+// decides between text, image, PDF, audio and video by extension.
+var mediaExtensions = map[string]string{
+	"image/png":        ".png",
+	"image/jpeg":       ".jpg",
+	"image/webp":       ".webp",
+	"image/gif":        ".gif",
+	"image/heic":       ".heic",
+	"image/heif":       ".heif",
+	"application/pdf":  ".pdf",
+	"text/plain":       ".txt",
+	"text/markdown":    ".md",
+	"text/csv":         ".csv",
+	"text/html":        ".html",
+	"application/json": ".json",
+	"audio/wav":        ".wav",
+	"audio/mp3":        ".mp3",
+	"audio/mpeg":       ".mp3",
+	"audio/ogg":        ".ogg",
+	"audio/flac":       ".flac",
+	"video/mp4":        ".mp4",
+	"video/webm":       ".webm",
+	"video/quicktime":  ".mov",
+}
+
+// errPrivateAddress is returned when a fileUri resolves to an address of the
+// wrapper's own network.
+var errPrivateAddress = errors.New("fileUri must not point to a loopback, private or link-local address")
+
+// mediaClient downloads fileData parts. It only connects to public addresses
+// so clients cannot make the wrapper read from its own network.
+var mediaClient = &http.Client{
+	Timeout: 30 * time.Second,
+	Transport: &http.Transport{
+		DialContext:         (&net.Dialer{Timeout: 10 * time.Second, Control: publicAddressOnly}).DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+	},
+}
+
+func publicAddressOnly(_, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return errPrivateAddress
+	}
+	return nil
+}
+
+// FileSource finds the files uploaded through the Files API.
+type FileSource interface {
+	// Path returns the file called name and where its content is stored.
+	Path(name string) (model.GeminiFile, string, error)
+}
+
+// ResolveFiles checks that the fileData parts of req naming an uploaded file
+// refer to one of files, which may be nil when the Files API is disabled, and
+// fills in their mimeType when the client left it out. Call it before
+// BuildPrompt, which names attachments after their type.
+func ResolveFiles(req model.GeminiAPIRequest, files FileSource) error {
+	resolve := func(where string, parts []model.GeminiPart) error {
+		for i, part := range parts {
+			if part.FileData == nil {
+				continue
+			}
+			name := uploadedFileName(part.FileData.FileURI)
+			if name == "" {
+				continue
+			}
+			if files == nil {
+				return fmt.Errorf("%s.parts[%d].fileData: the Files API is disabled", where, i)
+			}
+			file, _, err := files.Path(name)
+			if err != nil {
+				return fmt.Errorf("%s.parts[%d].fileData: %s: %w", where, i, name, err)
+			}
+			if part.FileData.MimeType == "" {
+				part.FileData.MimeType = file.MimeType
+			}
+		}
+		return nil
+	}
+	if req.SystemInstruction != nil {
+		if err := resolve("systemInstruction", req.SystemInstruction.Parts); err != nil {
+			return err
+		}
+	}
+	for i, content := range req.Contents {
+		if err := resolve(fmt.Sprintf("contents[%d]", i), content.Parts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// uploadedFileName returns the name of the uploaded file uri refers to, as
+// "files/<id>" or by the URI of the Files API, or "" for other URIs.
+func uploadedFileName(uri string) string {
+	if strings.HasPrefix(uri, "files/") {
+		return uri
+	}
+	parsed, err := url.Parse(uri)
+	if err != nil || parsed.Host == "" {
+		return ""
+	}
+	_, id, ok := strings.Cut(parsed.Path, "/v1beta/files/")
+	if !ok || id == "" || strings.Contains(id, "/") {
+		return ""
+	}
+	return "files/" + id
+}
+
+// Attachments returns the files of the inlineData and fileData parts of req,
+// named as BuildPrompt refers to them. fileData refers to a file of files,
+// which may be nil, or is downloaded over http or https.
+func Attachments(ctx context.Context, req model.GeminiAPIRequest, files FileSource) ([]model.Attachment, error) {
+	var attachments []model.Attachment
+	seen := map[string]bool{}
+	add := func(attachment model.Attachment) {
+		if !seen[attachment.Name] {
+			seen[attachment.Name] = true
+			attachments = append(attachments, attachment)
+		}
+	}
+	collect := func(where string, parts []model.GeminiPart) error {
+		for i, part := range parts {
+			switch {
+			case part.InlineData != nil:
+				attachment, err := inlineAttachment(*part.InlineData)
+				if err != nil {
+					return fmt.Errorf("%s.parts[%d].inlineData: %w", where, i, err)
+				}
+				add(attachment)
+			case part.FileData != nil:
+				attachment, err := fileAttachment(ctx, *part.FileData, files)
+				if err != nil {
+					return fmt.Errorf("%s.parts[%d].fileData: %w", where, i, err)
+				}
+				add(attachment)
+			}
+		}
+		return nil
+	}
+	if req.SystemInstruction != nil {
+		if err := collect("systemInstruction", req.SystemInstruction.Parts); err != nil {
+			return nil, err
+		}
+	}
+	for i, content := range req.Contents {
+		if err := collect(fmt.Sprintf("contents[%d]", i), content.Parts); err != nil {
+			return nil, err
+		}
+	}
+	return attachments, nil
+}
+
+func inlineAttachment(blob model.Blob) (model.Attachment, error) {
+	if strings.TrimSpace(blob.MimeType) == "" {
+		return model.Attachment{}, errors.New("mimeType is required")
+	}
+	if base64.StdEncoding.DecodedLen(len(blob.Data)) > maxAttachmentSize+2 {
+		return model.Attachment{}, fmt.Errorf("data exceeds %d MiB", maxAttachmentSize>>20)
+	}
+	data, err := base64.StdEncoding.DecodeString(blob.Data)
+	if err != nil {
+		// The API also accepts URL-safe base64.
+		if data, err = base64.URLEncoding.DecodeString(blob.Data); err != nil {
+			return model.Attachment{}, errors.New("data is not valid base64")
+		}
+	}
+	if len(data) > maxAttachmentSize {
+		return model.Attachment{}, fmt.Errorf("data exceeds %d MiB", maxAttachmentSize>>20)
+	}
+	return model.Attachment{Name: attachmentName(blob.MimeType, blob.Data), MimeType: blob.MimeType, Data: data}, nil
+}
+
+func fileAttachment(ctx context.Context, file model.FileData, files FileSource) (model.Attachment, error) {
+	name := uploadedFileName(file.FileURI)
+	if name == "" {
+		return fetchAttachment(ctx, file)
+	}
+	if files == nil {
+		return model.Attachment{}, errors.New("the Files API is disabled")
+	}
+	uploaded, path, err := files.Path(name)
+	if err != nil {
+		return model.Attachment{}, fmt.Errorf("%s: %w", name, err)
+	}
+	return model.Attachment{Name: attachmentName(file.MimeType, file.FileURI), MimeType: uploaded.MimeType, Path: path}, nil
+}
+
+func fetchAttachment(ctx context.Context, file model.FileData) (model.Attachment, error) {
+	parsed, err := url.Parse(file.FileURI)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return model.Attachment{}, fmt.Errorf("fileUri %q must be an http or https URL", file.FileURI)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, file.FileURI, nil)
+	if err != nil {
+		return model.Attachment{}, err
+	}
+	resp, err := mediaClient.Do(req)
+	if err != nil {
+		return model.Attachment{}, fmt.Errorf("download %s: %w", file.FileURI, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return model.Attachment{}, fmt.Errorf("download %s: status %d", file.FileURI, resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxAttachmentSize+1))
+	if err != nil {
+		return model.Attachment{}, fmt.Errorf("download %s: %w", file.FileURI, err)
+	}
+	if len(data) > maxAttachmentSize {
+		return model.Attachment{}, fmt.Errorf("%s exceeds %d MiB", file.FileURI, maxAttachmentSize>>20)
+	}
+	mimeType := file.MimeType
+	if mimeType == "" {
+		mimeType, _, _ = mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	}
+	return model.Attachment{Name: attachmentName(file.MimeType, file.FileURI), MimeType: mimeType, Data: data}, nil
+}
+
+// attachmentName derives the name of an attachment from its MIME type and
+// the data or URI of its part, so equal parts share one file.
+func attachmentName(mimeType, key string) string {
+	sum := sha256.Sum256([]byte(mimeType + "\x00" + key))
+	return attachmentDir + "/" + hex.EncodeToString(sum[:8]) + mediaExtension(mimeType)
+}
+
+func mediaExtension(mimeType string) string {
+	mimeType = strings.ToLower(strings.TrimSpace(mimeType))
+	if ext, ok := mediaExtensions[mimeType]; ok {
+		return ext
+	}
+	if exts, err := mime.ExtensionsByType(mimeType); err == nil && len(exts) > 0 {
+		return exts[0]
+	}
+	return ".bin"
+}
+
+// mediaReference is how the prompt refers to the attachment of part, or ""
+// when part carries no media.
+func mediaReference(part model.GeminiPart) string {
+	switch {
+	case part.InlineData != nil:
+		return "@" + attachmentName(part.InlineData.MimeType, part.InlineData.Data)
+	case part.FileData != nil:
+		return "@" + attachmentName(part.FileData.MimeType, part.FileData.FileURI)
+	}
+	return ""
+}
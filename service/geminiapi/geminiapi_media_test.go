@@ -0,0 +1,146 @@
+package geminiapi
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gemini-wrapper/model"
+)
+
+func TestInlineDataIsReferencedAndAttached(t *testing.T) {
+	blob := &model.Blob{MimeType: "image/png", Data: base64.StdEncoding.EncodeToString([]byte("png bytes"))}
+	req := model.GeminiAPIRequest{Contents: []model.GeminiContent{
+		{Parts: []model.GeminiPart{{Text: "What is in this image?"}, {InlineData: blob}}},
+	}}
+
+	prompt, err := BuildPrompt(req)
+	if err != nil {
+		t.Fatalf("BuildPrompt: %v", err)
+	}
+	attachments, err := Attachments(context.Background(), req, nil)
+	if err != nil {
+		t.Fatalf("Attachments: %v", err)
+	}
+	if len(attachments) != 1 || string(attachments[0].Data) != "png bytes" || attachments[0].MimeType != "image/png" {
+		t.Fatalf("unexpected attachments: %#v", attachments)
+	}
+	name := attachments[0].Name
+	if !strings.HasPrefix(name, "attachments/") || !strings.HasSuffix(name, ".png") {
+		t.Fatalf("unexpected attachment name %q", name)
+	}
+	if prompt != "What is in this image?\n@"+name {
+		t.Fatalf("unexpected prompt: %q", prompt)
+	}
+}
+
+func TestInlineDataErrors(t *testing.T) {
+	for _, blob := range []model.Blob{
+		{Data: base64.StdEncoding.EncodeToString([]byte("x"))},
+		{MimeType: "image/png", Data: "not base64!"},
+		{MimeType: "image/png", Data: strings.Repeat("A", 4*(maxAttachmentSize/3+2))},
+	} {
+		req := model.GeminiAPIRequest{Contents: []model.GeminiContent{{Parts: []model.GeminiPart{{InlineData: &blob}}}}}
+		if _, err := Attachments(context.Background(), req, nil); err == nil {
+			t.Fatalf("expected an error for %.40q", blob.Data)
+		}
+	}
+}
+
+func TestFileDataIsDownloaded(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/doc" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/pdf")
+		_, _ = w.Write([]byte("%PDF-1.7"))
+	}))
+	defer server.Close()
+	original := mediaClient
+	mediaClient = server.Client()
+	defer func() { mediaClient = original }()
+
+	req := model.GeminiAPIRequest{Contents: []model.GeminiContent{{Parts: []model.GeminiPart{
+		{FileData: &model.FileData{FileURI: server.URL + "/doc"}},
+		{FileData: &model.FileData{FileURI: server.URL + "/doc"}},
+	}}}}
+	attachments, err := Attachments(context.Background(), req, nil)
+	if err != nil {
+		t.Fatalf("Attachments: %v", err)
+	}
+	if len(attachments) != 1 || string(attachments[0].Data) != "%PDF-1.7" || attachments[0].MimeType != "application/pdf" {
+		t.Fatalf("expected one shared attachment, got %#v", attachments)
+	}
+
+	req.Contents[0].Parts = []model.GeminiPart{{FileData: &model.FileData{FileURI: server.URL + "/missing"}}}
+	if _, err := Attachments(context.Background(), req, nil); err == nil {
+		t.Fatal("expected an error for a missing file")
+	}
+}
+
+func TestFileDataRejectsUnsupportedAndPrivateURIs(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("secret"))
+	}))
+	defer server.Close()
+
+	for _, uri := range []string{"gs://bucket/file.pdf", "file:///etc/passwd", "https://", server.URL} {
+		req := model.GeminiAPIRequest{Contents: []model.GeminiContent{{Parts: []model.GeminiPart{{FileData: &model.FileData{FileURI: uri}}}}}}
+		_, err := Attachments(context.Background(), req, nil)
+		if err == nil {
+			t.Fatalf("expected %q to be rejected", uri)
+		}
+		if uri == server.URL && !errors.Is(err, errPrivateAddress) {
+			t.Fatalf("expected a loopback URI to be refused, got %v", err)
+		}
+	}
+}
+
+type fakeFiles map[string]model.GeminiFile
+
+func (f fakeFiles) Path(name string) (model.GeminiFile, string, error) {
+	file, ok := f[name]
+	if !ok {
+		return model.GeminiFile{}, "", errors.New("file not found")
+	}
+	return file, "/store/" + strings.TrimPrefix(name, "files/"), nil
+}
+
+func TestUploadedFilesAreResolved(t *testing.T) {
+	files := fakeFiles{"files/abc123": {Name: "files/abc123", MimeType: "application/pdf"}}
+	for _, uri := range []string{"files/abc123", "http://localhost:8080/v1beta/files/abc123"} {
+		req := model.GeminiAPIRequest{Contents: []model.GeminiContent{{Parts: []model.GeminiPart{
+			{Text: "Summarize"}, {FileData: &model.FileData{FileURI: uri}},
+		}}}}
+		if err := ResolveFiles(req, files); err != nil {
+			t.Fatalf("ResolveFiles: %v", err)
+		}
+		prompt, err := BuildPrompt(req)
+		if err != nil {
+			t.Fatalf("BuildPrompt: %v", err)
+		}
+		attachments, err := Attachments(context.Background(), req, files)
+		if err != nil {
+			t.Fatalf("Attachments: %v", err)
+		}
+		if len(attachments) != 1 || attachments[0].Path != "/store/abc123" || !strings.HasSuffix(attachments[0].Name, ".pdf") {
+			t.Fatalf("unexpected attachments: %#v", attachments)
+		}
+		if !strings.HasSuffix(prompt, "@"+attachments[0].Name) {
+			t.Fatalf("expected the prompt to refer to %s, got %q", attachments[0].Name, prompt)
+		}
+	}
+
+	req := model.GeminiAPIRequest{Contents: []model.GeminiContent{{Parts: []model.GeminiPart{{FileData: &model.FileData{FileURI: "files/missing"}}}}}}
+	if err := ResolveFiles(req, files); err == nil {
+		t.Fatal("expected an unknown file to be rejected")
+	}
+	if err := ResolveFiles(req, nil); err == nil {
+		t.Fatal("expected uploaded files to be rejected without the Files API")
+	}
+}
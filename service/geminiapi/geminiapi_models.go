@@ -0,0 +1,65 @@
+package geminiapi
+
+import (
+	"strings"
+
+	"gemini-wrapper/model"
+	"gemini-wrapper/pkg/gemini"
+)
+
+// ListModels returns the supported models in the Gemini list-models format.
+func ListModels() model.GeminiModelListResponse {
+	names := gemini.SupportedModels()
+	models := make([]model.GeminiModelInfo, 0, len(names))
+	for _, name := range names {
+		models = append(models, describeModel(name))
+	}
+	return model.GeminiModelListResponse{Models: models}
+}
+
+// GetModel looks up a supported model by ID, with or without the "models/" prefix.
+func GetModel(name string) (model.GeminiModelInfo, bool) {
+	name = strings.TrimPrefix(strings.TrimSpace(name), "models/")
+	for _, supported := range gemini.SupportedModels() {
+		if supported == name {
+			return describeModel(name), true
+		}
+	}
+	return model.GeminiModelInfo{}, false
+}
+
+func describeModel(name string) model.GeminiModelInfo {
+	info := model.GeminiModelInfo{
+		Name:                       "models/" + name,
+		BaseModelID:                name,
+		Version:                    modelVersion(name),
+		DisplayName:                displayName(name),
+		Description:                "Served through Gemini CLI by gemini-wrapper",
+		SupportedGenerationMethods: append([]string(nil), supportedActions...),
+	}
+	if strings.HasPrefix(name, "gemini-2.5-") {
+		info.InputTokenLimit = 1048576
+		info.OutputTokenLimit = 65536
+	}
+	return info
+}
+
+// modelVersion extracts "2.5" from names like "gemini-2.5-flash".
+func modelVersion(name string) string {
+	for _, part := range strings.Split(name, "-") {
+		if part != "" && part[0] >= '0' && part[0] <= '9' {
+			return part
+		}
+	}
+	return "001"
+}
+
+func displayName(name string) string {
+	words := strings.Split(name, "-")
+	for i, w := range words {
+		if w != "" {
+			words[i] = strings.ToUpper(w[:1]) + w[1:]
+		}
+	}
+	return strings.Join(words, " ")
+}
@@ -0,0 +1,27 @@
+package geminiapi
+
+import "testing"
+
+func TestListModelsUsesConfiguredModels(t *testing.T) {
+	t.Setenv("GEMINI_MODELS", "gemini-2.5-pro,gemini-3-flash")
+
+	resp := ListModels()
+	if len(resp.Models) != 2 {
+		t.Fatalf("expected 2 models, got %d", len(resp.Models))
+	}
+	first := resp.Models[0]
+	if first.Name != "models/gemini-2.5-pro" || first.DisplayName != "Gemini 2.5 Pro" || first.Version != "2.5" {
+		t.Fatalf("unexpected model info: %#v", first)
+	}
+}
+
+func TestGetModelAcceptsPrefixedName(t *testing.T) {
+	t.Setenv("GEMINI_MODELS", "gemini-2.5-flash")
+
+	if _, ok := GetModel("models/gemini-2.5-flash"); !ok {
+		t.Fatal("expected prefixed model to be found")
+	}
+	if _, ok := GetModel("gemini-unknown"); ok {
+		t.Fatal("expected unknown model to be missing")
+	}
+}
@@ -0,0 +1,82 @@
+package geminiapi
+
+import (
+	"fmt"
+	"strings"
+
+	"gemini-wrapper/model"
+)
+
+// BuildPrompt flattens the contents of a Gemini API request into a single CLI
+// prompt. A lone user turn is sent verbatim; multi-turn conversations and
+// requests carrying a systemInstruction are rendered as "role: text" lines so
+// the model sees the full context. Function declarations are described in the
+// system line, and function calls and responses are written as JSON. Media
+// parts become @references to the files Attachments returns.
+func BuildPrompt(req model.GeminiAPIRequest) (string, error) {
+	if len(req.Contents) == 0 {
+		return "", fmt.Errorf("contents is required")
+	}
+
+	type turn struct {
+		role string
+		text string
+	}
+	turns := make([]turn, 0, len(req.Contents))
+	for _, content := range req.Contents {
+		text := joinParts(content.Parts)
+		if text == "" {
+			continue
+		}
+		turns = append(turns, turn{role: normalizeRole(content.Role), text: text})
+	}
+	if len(turns) == 0 {
+		return "", fmt.Errorf("text content cannot be empty")
+	}
+
+	system := ""
+	if req.SystemInstruction != nil {
+		system = joinParts(req.SystemInstruction.Parts)
+	}
+	if tools := toolInstructions(req); tools != "" {
+		system = strings.TrimSpace(system + "\n" + tools)
+	}
+	if system == "" && len(turns) == 1 && turns[0].role == "user" {
+		return turns[0].text, nil
+	}
+
+	lines := make([]string, 0, len(turns)+1)
+	if system != "" {
+		lines = append(lines, "system: "+system)
+	}
+	for _, t := range turns {
+		lines = append(lines, fmt.Sprintf("%s: %s", t.role, t.text))
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+func joinParts(parts []model.GeminiPart) string {
+	texts := make([]string, 0, len(parts))
+	for _, part := range parts {
+		if text := strings.TrimSpace(part.Text); text != "" {
+			texts = append(texts, text)
+		}
+		if ref := mediaReference(part); ref != "" {
+			texts = append(texts, ref)
+		}
+	}
+	texts = append(texts, renderFunctionParts(parts)...)
+	return strings.Join(texts, "\n")
+}
+
+// normalizeRole maps Gemini roles onto the user/assistant labels used in prompts.
+func normalizeRole(role string) string {
+	switch strings.ToLower(strings.TrimSpace(role)) {
+	case "model", "assistant":
+		return "assistant"
+	case "function", "tool":
+		return "tool"
+	default:
+		return "user"
+	}
+}
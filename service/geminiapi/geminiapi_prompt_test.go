@@ -0,0 +1,59 @@
+package geminiapi
+
+import (
+	"testing"
+
+	"gemini-wrapper/model"
+)
+
+func TestBuildPromptSingleTurnIsVerbatim(t *testing.T) {
+	got, err := BuildPrompt(model.GeminiAPIRequest{Contents: []model.GeminiContent{
+		{Parts: []model.GeminiPart{{Text: " hello "}, {Text: "world"}}},
+	}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got != "hello\nworld" {
+		t.Fatalf("unexpected prompt: %q", got)
+	}
+}
+
+func TestBuildPromptMultiTurnIncludesRoles(t *testing.T) {
+	got, err := BuildPrompt(model.GeminiAPIRequest{Contents: []model.GeminiContent{
+		{Role: "user", Parts: []model.GeminiPart{{Text: "hi"}}},
+		{Role: "model", Parts: []model.GeminiPart{{Text: "hello"}}},
+		{Role: "user", Parts: []model.GeminiPart{{Text: "how are you?"}}},
+	}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := "user: hi\nassistant: hello\nuser: how are you?"
+	if got != want {
+		t.Fatalf("unexpected prompt: got=%q want=%q", got, want)
+	}
+}
+
+func TestBuildPromptRejectsEmptyContents(t *testing.T) {
+	if _, err := BuildPrompt(model.GeminiAPIRequest{}); err == nil {
+		t.Fatal("expected error for missing contents")
+	}
+	if _, err := BuildPrompt(model.GeminiAPIRequest{Contents: []model.GeminiContent{{Parts: []model.GeminiPart{{Text: "  "}}}}}); err == nil {
+		t.Fatal("expected error for blank text")
+	}
+}
+
+func TestBuildPromptPrependsSystemInstruction(t *testing.T) {
+	got, err := BuildPrompt(model.GeminiAPIRequest{
+		SystemInstruction: &model.GeminiContent{Parts: []model.GeminiPart{{Text: "You are a pirate."}}},
+		Contents: []model.GeminiContent{
+			{Role: "user", Parts: []model.GeminiPart{{Text: "hello"}}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := "system: You are a pirate.\nuser: hello"
+	if got != want {
+		t.Fatalf("unexpected prompt: got=%q want=%q", got, want)
+	}
+}
@@ -0,0 +1,59 @@
+package geminiapi
+
+import (
+	"fmt"
+	"slices"
+
+	"gemini-wrapper/model"
+)
+
+// HarmCategories are the categories the Gemini API rates every candidate on.
+var HarmCategories = []string{
+	"HARM_CATEGORY_HATE_SPEECH",
+	"HARM_CATEGORY_SEXUALLY_EXPLICIT",
+	"HARM_CATEGORY_DANGEROUS_CONTENT",
+	"HARM_CATEGORY_HARASSMENT",
+}
+
+// settableCategories also accepts the categories that can be configured but
+// are not reported in ratings.
+var settableCategories = append([]string{"HARM_CATEGORY_CIVIC_INTEGRITY"}, HarmCategories...)
+
+var thresholds = []string{
+	"HARM_BLOCK_THRESHOLD_UNSPECIFIED",
+	"BLOCK_LOW_AND_ABOVE",
+	"BLOCK_MEDIUM_AND_ABOVE",
+	"BLOCK_ONLY_HIGH",
+	"BLOCK_NONE",
+	"OFF",
+}
+
+// ValidateSafetySettings rejects unknown categories and thresholds and
+// categories set twice, like the Gemini API.
+func ValidateSafetySettings(settings []model.SafetySetting) error {
+	seen := map[string]bool{}
+	for i, setting := range settings {
+		if !slices.Contains(settableCategories, setting.Category) {
+			return fmt.Errorf("safetySettings[%d].category %q is not a supported harm category", i, setting.Category)
+		}
+		if !slices.Contains(thresholds, setting.Threshold) {
+			return fmt.Errorf("safetySettings[%d].threshold %q is not a supported block threshold", i, setting.Threshold)
+		}
+		if seen[setting.Category] {
+			return fmt.Errorf("safetySettings has %s more than once", setting.Category)
+		}
+		seen[setting.Category] = true
+	}
+	return nil
+}
+
+// SafetyRatings returns the ratings of an answer that was not blocked. The CLI
+// does not pass the ratings it receives on, so every category is reported as
+// NEGLIGIBLE, which is what the Gemini API reports for ordinary answers.
+func SafetyRatings() []model.SafetyRating {
+	ratings := make([]model.SafetyRating, len(HarmCategories))
+	for i, category := range HarmCategories {
+		ratings[i] = model.SafetyRating{Category: category, Probability: "NEGLIGIBLE"}
+	}
+	return ratings
+}
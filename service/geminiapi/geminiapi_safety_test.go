@@ -0,0 +1,50 @@
+package geminiapi
+
+import (
+	"strings"
+	"testing"
+
+	"gemini-wrapper/model"
+)
+
+func TestValidateSafetySettings(t *testing.T) {
+	cases := []struct {
+		name     string
+		settings []model.SafetySetting
+		wantErr  string
+	}{
+		{name: "nil"},
+		{name: "valid", settings: []model.SafetySetting{
+			{Category: "HARM_CATEGORY_HARASSMENT", Threshold: "BLOCK_ONLY_HIGH"},
+			{Category: "HARM_CATEGORY_CIVIC_INTEGRITY", Threshold: "BLOCK_NONE"},
+		}},
+		{name: "unknown category", settings: []model.SafetySetting{{Category: "HARM_CATEGORY_UNKNOWN", Threshold: "BLOCK_NONE"}}, wantErr: "category"},
+		{name: "unknown threshold", settings: []model.SafetySetting{{Category: "HARM_CATEGORY_HARASSMENT", Threshold: "BLOCK_SOME"}}, wantErr: "threshold"},
+		{name: "duplicate category", settings: []model.SafetySetting{
+			{Category: "HARM_CATEGORY_HARASSMENT", Threshold: "BLOCK_NONE"},
+			{Category: "HARM_CATEGORY_HARASSMENT", Threshold: "OFF"},
+		}, wantErr: "more than once"},
+	}
+
+	for _, tc := range cases {
+		err := ValidateSafetySettings(tc.settings)
+		if tc.wantErr == "" && err != nil {
+			t.Fatalf("%s: unexpected error: %v", tc.name, err)
+		}
+		if tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)) {
+			t.Fatalf("%s: expected an error mentioning %q, got %v", tc.name, tc.wantErr, err)
+		}
+	}
+}
+
+func TestSafetyRatingsCoverEveryHarmCategory(t *testing.T) {
+	ratings := SafetyRatings()
+	if len(ratings) != len(HarmCategories) {
+		t.Fatalf("expected %d ratings, got %#v", len(HarmCategories), ratings)
+	}
+	for i, rating := range ratings {
+		if rating.Category != HarmCategories[i] || rating.Probability != "NEGLIGIBLE" || rating.Blocked {
+			t.Fatalf("unexpected rating %#v", rating)
+		}
+	}
+}
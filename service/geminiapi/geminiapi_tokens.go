@@ -0,0 +1,21 @@
+package geminiapi
+
+import (
+	"gemini-wrapper/model"
+	"gemini-wrapper/pkg/gemini"
+)
+
+// CountTokens estimates the prompt size of a countTokens request locally,
+// using the same prompt that generateContent would send to the CLI.
+func CountTokens(req model.GeminiCountTokensRequest) (model.GeminiCountTokensResponse, error) {
+	generateReq := model.GeminiAPIRequest{Contents: req.Contents, SystemInstruction: req.SystemInstruction}
+	if req.GenerateContentRequest != nil {
+		generateReq = *req.GenerateContentRequest
+	}
+
+	prompt, err := BuildPrompt(generateReq)
+	if err != nil {
+		return model.GeminiCountTokensResponse{}, err
+	}
+	return model.GeminiCountTokensResponse{TotalTokens: gemini.EstimateTokens(prompt)}, nil
+}
@@ -0,0 +1,39 @@
+package geminiapi
+
+import (
+	"testing"
+
+	"gemini-wrapper/model"
+)
+
+func TestCountTokensEstimatesPrompt(t *testing.T) {
+	resp, err := CountTokens(model.GeminiCountTokensRequest{Contents: []model.GeminiContent{
+		{Parts: []model.GeminiPart{{Text: "abcdefgh"}}},
+	}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp.TotalTokens != 2 {
+		t.Fatalf("expected 2 tokens, got %d", resp.TotalTokens)
+	}
+}
+
+func TestCountTokensUsesGenerateContentRequest(t *testing.T) {
+	resp, err := CountTokens(model.GeminiCountTokensRequest{GenerateContentRequest: &model.GeminiAPIRequest{
+		SystemInstruction: &model.GeminiContent{Parts: []model.GeminiPart{{Text: "be brief"}}},
+		Contents:          []model.GeminiContent{{Parts: []model.GeminiPart{{Text: "hi"}}}},
+	}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// "system: be brief\nuser: hi" is 25 characters.
+	if resp.TotalTokens != 7 {
+		t.Fatalf("expected 7 tokens, got %d", resp.TotalTokens)
+	}
+}
+
+func TestCountTokensRejectsEmptyRequest(t *testing.T) {
+	if _, err := CountTokens(model.GeminiCountTokensRequest{}); err == nil {
+		t.Fatal("expected error")
+	}
+}
@@ -0,0 +1,181 @@
+package geminiapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"gemini-wrapper/model"
+)
+
+// The CLI cannot hand function declarations to the model, so they are
+// described in the prompt and the model is asked to answer with a JSON object
+// when it wants to call one. Answers of that shape are returned as
+// functionCall parts.
+
+var (
+	functionName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.-]{0,63}$`)
+	callingModes = []string{"MODE_UNSPECIFIED", "AUTO", "ANY", "NONE", "VALIDATED"}
+	answerFence  = regexp.MustCompile("(?s)^```[A-Za-z]*\\s*\n(.*?)\n?```$")
+)
+
+// ValidateTools rejects invalid function names, names declared twice, unknown
+// calling modes and allowed names that are not declared.
+func ValidateTools(tools []model.Tool, cfg *model.ToolConfig) error {
+	declared := map[string]bool{}
+	for i, tool := range tools {
+		for j, decl := range tool.FunctionDeclarations {
+			if !functionName.MatchString(decl.Name) {
+				return fmt.Errorf("tools[%d].functionDeclarations[%d].name %q must start with a letter or underscore and contain at most 64 letters, digits, '_', '.' or '-'", i, j, decl.Name)
+			}
+			if decl.Parameters != nil && decl.ParametersJSONSchema != nil {
+				return fmt.Errorf("tools[%d].functionDeclarations[%d] sets both parameters and parametersJsonSchema", i, j)
+			}
+			if declared[decl.Name] {
+				return fmt.Errorf("function %s is declared more than once", decl.Name)
+			}
+			declared[decl.Name] = true
+		}
+	}
+	if cfg == nil || cfg.FunctionCallingConfig == nil {
+		return nil
+	}
+	calling := cfg.FunctionCallingConfig
+	if calling.Mode != "" && !slices.Contains(callingModes, calling.Mode) {
+		return fmt.Errorf("toolConfig.functionCallingConfig.mode %q is not one of %s", calling.Mode, strings.Join(callingModes, ", "))
+	}
+	if len(calling.AllowedFunctionNames) > 0 && calling.Mode != "ANY" {
+		return fmt.Errorf("toolConfig.functionCallingConfig.allowedFunctionNames requires mode ANY")
+	}
+	for _, name := range calling.AllowedFunctionNames {
+		if !declared[name] {
+			return fmt.Errorf("toolConfig.functionCallingConfig.allowedFunctionNames has undeclared function %q", name)
+		}
+	}
+	return nil
+}
+
+// callableFunctions returns the declarations the model may call: none in
+// mode NONE, the allowed ones in mode ANY when a list is given.
+func callableFunctions(req model.GeminiAPIRequest) []model.FunctionDeclaration {
+	mode, allowed := "", []string(nil)
+	if req.ToolConfig != nil && req.ToolConfig.FunctionCallingConfig != nil {
+		mode = req.ToolConfig.FunctionCallingConfig.Mode
+		allowed = req.ToolConfig.FunctionCallingConfig.AllowedFunctionNames
+	}
+	if mode == "NONE" {
+		return nil
+	}
+	var decls []model.FunctionDeclaration
+	for _, tool := range req.Tools {
+		for _, decl := range tool.FunctionDeclarations {
+			if len(allowed) == 0 || slices.Contains(allowed, decl.Name) {
+				decls = append(decls, decl)
+			}
+		}
+	}
+	return decls
+}
+
+// FunctionCallingEnabled reports whether the model may answer req with
+// function calls.
+func FunctionCallingEnabled(req model.GeminiAPIRequest) bool {
+	return len(callableFunctions(req)) > 0
+}
+
+// toolInstructions describes the callable functions of req and how to call
+// them, or returns "" when there are none.
+func toolInstructions(req model.GeminiAPIRequest) string {
+	decls := callableFunctions(req)
+	if len(decls) == 0 {
+		return ""
+	}
+	declared, err := json.Marshal(decls)
+	if err != nil {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString("You can call the functions declared in this JSON array:\n")
+	b.Write(declared)
+	b.WriteString("\nTo call functions, answer with only a JSON object of the form " +
+		`{"functionCalls": [{"name": "<function name>", "args": {<arguments>}}]}` +
+		" and nothing else. The results come back as functionResponse objects in a later turn.")
+	if req.ToolConfig != nil && req.ToolConfig.FunctionCallingConfig != nil && req.ToolConfig.FunctionCallingConfig.Mode == "ANY" {
+		b.WriteString(" You must call at least one function.")
+	} else {
+		b.WriteString(" If no function is needed, answer normally.")
+	}
+	return b.String()
+}
+
+// AnswerParts returns the candidate parts of an answer to req: the function
+// calls when the answer is a valid call of callable functions, and the answer
+// as text otherwise.
+func AnswerParts(answer string, req model.GeminiAPIRequest) []model.GeminiPart {
+	if calls, ok := parseFunctionCalls(answer, callableFunctions(req)); ok {
+		parts := make([]model.GeminiPart, len(calls))
+		for i := range calls {
+			parts[i] = model.GeminiPart{FunctionCall: &calls[i]}
+		}
+		return parts
+	}
+	return []model.GeminiPart{{Text: answer}}
+}
+
+func parseFunctionCalls(answer string, decls []model.FunctionDeclaration) ([]model.FunctionCall, bool) {
+	if len(decls) == 0 {
+		return nil, false
+	}
+	body := strings.TrimSpace(answer)
+	if match := answerFence.FindStringSubmatch(body); match != nil {
+		body = strings.TrimSpace(match[1])
+	}
+	if !strings.HasPrefix(body, "{") {
+		return nil, false
+	}
+	var parsed struct {
+		FunctionCalls []model.FunctionCall `json:"functionCalls"`
+		FunctionCall  *model.FunctionCall  `json:"functionCall"`
+	}
+	if err := json.Unmarshal([]byte(body), &parsed); err != nil {
+		return nil, false
+	}
+	calls := parsed.FunctionCalls
+	if parsed.FunctionCall != nil {
+		calls = append(calls, *parsed.FunctionCall)
+	}
+	if len(calls) == 0 {
+		return nil, false
+	}
+	for _, call := range calls {
+		if !slices.ContainsFunc(decls, func(decl model.FunctionDeclaration) bool { return decl.Name == call.Name }) {
+			return nil, false
+		}
+	}
+	return calls, true
+}
+
+// renderFunctionParts writes the function calls and responses of parts as
+// the JSON the model is asked to answer with, calls of one turn together.
+func renderFunctionParts(parts []model.GeminiPart) []string {
+	var calls []model.FunctionCall
+	var rendered []string
+	for _, part := range parts {
+		switch {
+		case part.FunctionCall != nil:
+			calls = append(calls, *part.FunctionCall)
+		case part.FunctionResponse != nil:
+			if raw, err := json.Marshal(map[string]any{"functionResponse": part.FunctionResponse}); err == nil {
+				rendered = append(rendered, string(raw))
+			}
+		}
+	}
+	if len(calls) > 0 {
+		if raw, err := json.Marshal(map[string]any{"functionCalls": calls}); err == nil {
+			rendered = append(rendered, string(raw))
+		}
+	}
+	return rendered
+}
@@ -0,0 +1,114 @@
+package geminiapi
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"gemini-wrapper/model"
+)
+
+func weatherRequest(cfg *model.FunctionCallingConfig) model.GeminiAPIRequest {
+	req := model.GeminiAPIRequest{
+		Contents: []model.GeminiContent{{Role: "user", Parts: []model.GeminiPart{{Text: "Weather in Paris?"}}}},
+		Tools: []model.Tool{{FunctionDeclarations: []model.FunctionDeclaration{
+			{Name: "get_weather", Description: "Current weather", Parameters: map[string]any{"type": "OBJECT"}},
+			{Name: "get_time"},
+		}}},
+	}
+	if cfg != nil {
+		req.ToolConfig = &model.ToolConfig{FunctionCallingConfig: cfg}
+	}
+	return req
+}
+
+func TestValidateTools(t *testing.T) {
+	req := weatherRequest(nil)
+	if err := ValidateTools(req.Tools, &model.ToolConfig{FunctionCallingConfig: &model.FunctionCallingConfig{Mode: "ANY", AllowedFunctionNames: []string{"get_time"}}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := map[string]struct {
+		tools []model.Tool
+		cfg   *model.FunctionCallingConfig
+	}{
+		"invalid name":        {tools: []model.Tool{{FunctionDeclarations: []model.FunctionDeclaration{{Name: "get weather"}}}}},
+		"duplicate name":      {tools: append(req.Tools, model.Tool{FunctionDeclarations: []model.FunctionDeclaration{{Name: "get_time"}}})},
+		"unknown mode":        {tools: req.Tools, cfg: &model.FunctionCallingConfig{Mode: "SOMETIMES"}},
+		"allowed without ANY": {tools: req.Tools, cfg: &model.FunctionCallingConfig{Mode: "AUTO", AllowedFunctionNames: []string{"get_time"}}},
+		"allowed undeclared":  {tools: req.Tools, cfg: &model.FunctionCallingConfig{Mode: "ANY", AllowedFunctionNames: []string{"get_date"}}},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			var cfg *model.ToolConfig
+			if tt.cfg != nil {
+				cfg = &model.ToolConfig{FunctionCallingConfig: tt.cfg}
+			}
+			if err := ValidateTools(tt.tools, cfg); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
+
+func TestBuildPromptDescribesCallableFunctions(t *testing.T) {
+	got, err := BuildPrompt(weatherRequest(&model.FunctionCallingConfig{Mode: "ANY", AllowedFunctionNames: []string{"get_weather"}}))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.HasPrefix(got, "system: You can call") || !strings.Contains(got, `"name":"get_weather"`) || strings.Contains(got, "get_time") {
+		t.Fatalf("expected only the allowed function in the system line, got %q", got)
+	}
+	if !strings.Contains(got, "You must call at least one function.") || !strings.HasSuffix(got, "\nuser: Weather in Paris?") {
+		t.Fatalf("unexpected prompt: %q", got)
+	}
+
+	got, err = BuildPrompt(weatherRequest(&model.FunctionCallingConfig{Mode: "NONE"}))
+	if err != nil || got != "Weather in Paris?" {
+		t.Fatalf("expected mode NONE to leave the prompt alone, got %q, %v", got, err)
+	}
+}
+
+func TestBuildPromptRendersFunctionTurns(t *testing.T) {
+	req := weatherRequest(nil)
+	req.Contents = append(req.Contents,
+		model.GeminiContent{Role: "model", Parts: []model.GeminiPart{{FunctionCall: &model.FunctionCall{Name: "get_weather", Args: map[string]any{"city": "Paris"}}}}},
+		model.GeminiContent{Role: "function", Parts: []model.GeminiPart{{FunctionResponse: &model.FunctionResponse{Name: "get_weather", Response: map[string]any{"temp": 21}}}}},
+	)
+	got, err := BuildPrompt(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := "\nuser: Weather in Paris?" +
+		"\nassistant: {\"functionCalls\":[{\"name\":\"get_weather\",\"args\":{\"city\":\"Paris\"}}]}" +
+		"\ntool: {\"functionResponse\":{\"name\":\"get_weather\",\"response\":{\"temp\":21}}}"
+	if !strings.HasSuffix(got, want) {
+		t.Fatalf("unexpected prompt: %q", got)
+	}
+}
+
+func TestAnswerParts(t *testing.T) {
+	req := weatherRequest(nil)
+	call := &model.FunctionCall{Name: "get_weather", Args: map[string]any{"city": "Paris"}}
+	tests := map[string]struct {
+		answer string
+		want   []model.GeminiPart
+	}{
+		"call":         {`{"functionCalls": [{"name": "get_weather", "args": {"city": "Paris"}}]}`, []model.GeminiPart{{FunctionCall: call}}},
+		"fenced call":  {"```json\n{\"functionCall\": {\"name\": \"get_weather\", \"args\": {\"city\": \"Paris\"}}}\n```", []model.GeminiPart{{FunctionCall: call}}},
+		"text":         {"It is sunny.", []model.GeminiPart{{Text: "It is sunny."}}},
+		"unknown call": {`{"functionCalls": [{"name": "rm_rf"}]}`, []model.GeminiPart{{Text: `{"functionCalls": [{"name": "rm_rf"}]}`}}},
+		"other json":   {`{"city": "Paris"}`, []model.GeminiPart{{Text: `{"city": "Paris"}`}}},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := AnswerParts(tt.answer, req); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+
+	if got := AnswerParts(`{"functionCalls": [{"name": "get_weather"}]}`, weatherRequest(&model.FunctionCallingConfig{Mode: "NONE"})); got[0].FunctionCall != nil {
+		t.Fatalf("expected mode NONE to return text, got %#v", got)
+	}
+}
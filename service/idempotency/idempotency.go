@@ -0,0 +1,318 @@
+// Package idempotency remembers the responses of requests sent with an
+// Idempotency-Key, so a client that retries after a timeout gets the
+// original answer instead of asking Gemini again.
+//
+// Responses are kept for TTL in a Bolt database, or in memory when the
+// database cannot be opened, or in Redis when replicas share them. A retry
+// that arrives while the original request is still running waits for it, on
+// any replica.
+package idempotency
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gemini-wrapper/service/cluster"
+	"gemini-wrapper/service/storage"
+)
+
+// StoreName is the store of the responses in the database.
+const StoreName = "idempotent_responses"
+
+// sweepInterval is how often expired responses are deleted.
+const sweepInterval = time.Minute
+
+// claimTTL is how long a replica holds a key in Redis while its request runs.
+// A retry after that runs the request again.
+const claimTTL = 10 * time.Minute
+
+// sharedPollInterval is how often a retry checks whether the request another
+// replica runs has completed.
+const sharedPollInterval = 250 * time.Millisecond
+
+// ErrMismatch is returned when a key is reused for a different request.
+var ErrMismatch = errors.New("idempotency key was used for a different request")
+
+type Config struct {
+	Enabled bool          `yaml:"enabled"`
+	TTL     time.Duration `yaml:"ttl"`
+	Path    string        `yaml:"path"`
+	// MaxBodyBytes caps the responses that are kept; larger ones are not.
+	MaxBodyBytes int `yaml:"max_body_bytes"`
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Enabled:      true,
+		TTL:          24 * time.Hour,
+		Path:         "/app/cache/idempotency.db",
+		MaxBodyBytes: 1 << 20,
+	}
+}
+
+// ApplyEnv overrides c with the IDEMPOTENCY_* environment variables that are set.
+func (c *Config) ApplyEnv() {
+	if raw := strings.TrimSpace(os.Getenv("IDEMPOTENCY_ENABLED")); raw != "" {
+		if parsed, err := strconv.ParseBool(raw); err == nil {
+			c.Enabled = parsed
+		}
+	}
+	if raw := strings.TrimSpace(os.Getenv("IDEMPOTENCY_TTL_SECONDS")); raw != "" {
+		if parsed, err := strconv.Atoi(raw); err == nil && parsed > 0 {
+			c.TTL = time.Duration(parsed) * time.Second
+		}
+	}
+	if path := strings.TrimSpace(os.Getenv("IDEMPOTENCY_PATH")); path != "" {
+		c.Path = path
+	}
+}
+
+// Response is a stored response. Fingerprint identifies the request that
+// produced it.
+type Response struct {
+	Fingerprint string    `json:"fingerprint"`
+	Status      int       `json:"status"`
+	ContentType string    `json:"contentType,omitempty"`
+	Body        []byte    `json:"body"`
+	ExpiresAt   time.Time `json:"expiresAt"`
+}
+
+// Store keeps responses by key. A nil *Store keeps nothing.
+type Store struct {
+	cfg   Config
+	store storage.Store
+	// db is the file Open keeps responses in. It is nil for responses kept
+	// in memory, in Redis or in a shared database.
+	db *storage.DB
+	// shared keeps responses and claims in Redis when set.
+	shared *cluster.Cluster
+	now    func() time.Time
+
+	mu        sync.Mutex
+	memory    map[string]Response
+	running   map[string]chan struct{}
+	lastSweep time.Time
+}
+
+// Open opens or creates the database at cfg.Path.
+func Open(cfg Config) (*Store, error) {
+	db, err := storage.Open(cfg.Path)
+	if err != nil {
+		return nil, err
+	}
+	store, err := db.Store(StoreName)
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	s := OpenStorage(cfg, store)
+	s.db = db
+	return s, nil
+}
+
+// OpenStorage returns a store that keeps responses in store, such as a
+// store of the database all features share.
+func OpenStorage(cfg Config, store storage.Store) *Store {
+	s := NewMemoryStore(cfg)
+	s.store = store
+	return s
+}
+
+// OpenShared returns a store that keeps responses in Redis, so a retry is
+// answered by whichever replica it reaches.
+func OpenShared(cfg Config, shared *cluster.Cluster) *Store {
+	s := NewMemoryStore(cfg)
+	s.shared = shared
+	return s
+}
+
+// NewMemoryStore returns a store that keeps responses until the process exits.
+func NewMemoryStore(cfg Config) *Store {
+	if cfg.TTL <= 0 {
+		cfg.TTL = DefaultConfig().TTL
+	}
+	if cfg.MaxBodyBytes <= 0 {
+		cfg.MaxBodyBytes = DefaultConfig().MaxBodyBytes
+	}
+	return &Store{cfg: cfg, now: time.Now, memory: map[string]Response{}, running: map[string]chan struct{}{}}
+}
+
+// Close closes the database Open opened.
+func (s *Store) Close() error {
+	if s == nil {
+		return nil
+	}
+	return s.db.Close()
+}
+
+// MaxBodyBytes is the size of the largest response that is kept.
+func (s *Store) MaxBodyBytes() int {
+	return s.cfg.MaxBodyBytes
+}
+
+// Claim returns the response stored for key, or claims key for the caller,
+// who must then call the returned complete function exactly once. A key held
+// by a running request is waited for until it completes or ctx ends. A
+// stored response of another fingerprint is ErrMismatch.
+func (s *Store) Claim(ctx context.Context, key, fingerprint string) (*Response, func(*Response), error) {
+	if s == nil {
+		return nil, func(*Response) {}, nil
+	}
+	for {
+		s.mu.Lock()
+		s.sweepLocked()
+		if stored, ok := s.getLocked(key); ok {
+			s.mu.Unlock()
+			if stored.Fingerprint != fingerprint {
+				return nil, nil, ErrMismatch
+			}
+			return &stored, nil, nil
+		}
+		done, running := s.running[key]
+		if !running && s.claimShared(ctx, key) {
+			done = make(chan struct{})
+			s.running[key] = done
+			s.mu.Unlock()
+			return nil, s.completer(key, fingerprint, done), nil
+		}
+		s.mu.Unlock()
+
+		// Another replica runs the request; check again shortly.
+		var poll <-chan time.Time
+		if !running {
+			poll = time.After(sharedPollInterval)
+		}
+		select {
+		case <-done:
+		case <-poll:
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+	}
+}
+
+// claimShared claims key among the replicas. Without Redis, or when Redis
+// fails, the key is only claimed on this replica.
+func (s *Store) claimShared(ctx context.Context, key string) bool {
+	if s.shared == nil {
+		return true
+	}
+	claimed, err := s.shared.Client().SetNX(ctx, s.shared.Key("idempotency", "claim", key), "1", claimTTL).Result()
+	if err != nil {
+		slog.Warn("claiming idempotency key in Redis failed", "error", err)
+		return true
+	}
+	return claimed
+}
+
+// completer returns the function that stores the response of a claimed key
+// and releases it. A nil response releases the key without storing, so the
+// next request with it runs again.
+func (s *Store) completer(key, fingerprint string, done chan struct{}) func(*Response) {
+	var once sync.Once
+	return func(res *Response) {
+		once.Do(func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if res != nil && len(res.Body) <= s.cfg.MaxBodyBytes {
+				stored := *res
+				stored.Fingerprint = fingerprint
+				stored.ExpiresAt = s.now().Add(s.cfg.TTL)
+				s.putLocked(key, stored)
+			}
+			if s.shared != nil {
+				if err := s.shared.Client().Del(context.Background(), s.shared.Key("idempotency", "claim", key)).Err(); err != nil {
+					slog.Warn("releasing idempotency key in Redis failed", "error", err)
+				}
+			}
+			delete(s.running, key)
+			close(done)
+		})
+	}
+}
+
+func (s *Store) getLocked(key string) (Response, bool) {
+	var stored Response
+	if s.shared != nil {
+		raw, err := s.shared.Client().Get(context.Background(), s.shared.Key("idempotency", "response", key)).Bytes()
+		if err != nil || json.Unmarshal(raw, &stored) != nil {
+			return Response{}, false
+		}
+	} else if s.store == nil {
+		var ok bool
+		stored, ok = s.memory[key]
+		if !ok {
+			return Response{}, false
+		}
+	} else {
+		raw, err := s.store.Get(key)
+		if err != nil || raw == nil || json.Unmarshal(raw, &stored) != nil {
+			return Response{}, false
+		}
+	}
+	if !s.now().Before(stored.ExpiresAt) {
+		return Response{}, false
+	}
+	return stored, true
+}
+
+func (s *Store) putLocked(key string, res Response) {
+	if s.shared != nil {
+		raw, err := json.Marshal(res)
+		if err != nil {
+			return
+		}
+		if err := s.shared.Client().Set(context.Background(), s.shared.Key("idempotency", "response", key), raw, res.ExpiresAt.Sub(s.now())).Err(); err != nil {
+			slog.Warn("storing idempotent response in Redis failed", "error", err)
+		}
+		return
+	}
+	if s.store == nil {
+		s.memory[key] = res
+		return
+	}
+	raw, err := json.Marshal(res)
+	if err != nil {
+		return
+	}
+	_ = s.store.Put(key, raw)
+}
+
+// sweepLocked deletes expired responses, at most once per sweepInterval.
+// Redis expires them itself.
+func (s *Store) sweepLocked() {
+	if s.shared != nil {
+		return
+	}
+	now := s.now()
+	if now.Sub(s.lastSweep) < sweepInterval {
+		return
+	}
+	s.lastSweep = now
+	if s.store == nil {
+		for key, res := range s.memory {
+			if !now.Before(res.ExpiresAt) {
+				delete(s.memory, key)
+			}
+		}
+		return
+	}
+	_ = s.store.Update(func(tx storage.Store) error {
+		var expired []string
+		_ = tx.ForEach("", "", func(key string, value []byte) error {
+			var res Response
+			if json.Unmarshal(value, &res) != nil || !now.Before(res.ExpiresAt) {
+				expired = append(expired, key)
+			}
+			return nil
+		})
+		return tx.Delete(expired...)
+	})
+}
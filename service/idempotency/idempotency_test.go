@@ -0,0 +1,124 @@
+package idempotency
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gemini-wrapper/service/cluster"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestClaimStoresAndReplaysResponses(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Path = filepath.Join(t.TempDir(), "idempotency.db")
+	s, err := Open(cfg)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	now := time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+
+	stored, complete, err := s.Claim(context.Background(), "k", "a")
+	if err != nil || stored != nil || complete == nil {
+		t.Fatalf("expected to claim a new key, got %#v %v", stored, err)
+	}
+	complete(&Response{Status: 200, ContentType: "application/json", Body: []byte(`{"answer":"x"}`)})
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = Open(cfg)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer s.Close()
+	s.now = func() time.Time { return now }
+	stored, _, err = s.Claim(context.Background(), "k", "a")
+	if err != nil || stored == nil || stored.Status != 200 || string(stored.Body) != `{"answer":"x"}` {
+		t.Fatalf("expected the stored response after reopening, got %#v %v", stored, err)
+	}
+	if _, _, err := s.Claim(context.Background(), "k", "b"); !errors.Is(err, ErrMismatch) {
+		t.Fatalf("expected ErrMismatch for another request, got %v", err)
+	}
+
+	now = now.Add(cfg.TTL)
+	if stored, complete, err := s.Claim(context.Background(), "k", "b"); err != nil || stored != nil || complete == nil {
+		t.Fatalf("expected an expired key to be claimable, got %#v %v", stored, err)
+	}
+}
+
+func TestClaimWaitsForTheRunningRequest(t *testing.T) {
+	s := NewMemoryStore(DefaultConfig())
+	_, complete, err := s.Claim(context.Background(), "k", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replayed := make(chan *Response)
+	go func() {
+		stored, _, _ := s.Claim(context.Background(), "k", "a")
+		replayed <- stored
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, _, err := s.Claim(ctx, "k", "a"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected to wait until the deadline, got %v", err)
+	}
+
+	complete(&Response{Status: 200, Body: []byte("ok")})
+	if stored := <-replayed; stored == nil || string(stored.Body) != "ok" {
+		t.Fatalf("expected the waiting retry to get the response, got %#v", stored)
+	}
+}
+
+func TestFailedRequestsReleaseTheirKey(t *testing.T) {
+	s := NewMemoryStore(Config{MaxBodyBytes: 4})
+	_, complete, _ := s.Claim(context.Background(), "failed", "a")
+	complete(nil)
+	_, complete, _ = s.Claim(context.Background(), "large", "a")
+	complete(&Response{Status: 200, Body: []byte("too large")})
+
+	for _, key := range []string{"failed", "large"} {
+		if stored, complete, err := s.Claim(context.Background(), key, "a"); err != nil || stored != nil || complete == nil {
+			t.Fatalf("%s: expected the key to run again, got %#v %v", key, stored, err)
+		}
+	}
+}
+
+func TestSharedStoreMakesOtherReplicasWaitAndReplay(t *testing.T) {
+	server := miniredis.RunT(t)
+	shared := cluster.New(redis.NewClient(&redis.Options{Addr: server.Addr()}), cluster.DefaultConfig())
+	defer shared.Close()
+	first := OpenShared(DefaultConfig(), shared)
+	second := OpenShared(DefaultConfig(), shared)
+
+	_, complete, err := first.Claim(context.Background(), "k", "a")
+	if err != nil || complete == nil {
+		t.Fatalf("expected to claim a new key, got %v", err)
+	}
+
+	replayed := make(chan *Response, 1)
+	go func() {
+		stored, _, err := second.Claim(context.Background(), "k", "a")
+		if err != nil {
+			t.Errorf("Claim on the second replica: %v", err)
+		}
+		replayed <- stored
+	}()
+	time.Sleep(50 * time.Millisecond)
+	complete(&Response{Status: 201, Body: []byte(`{"answer":"x"}`)})
+
+	select {
+	case stored := <-replayed:
+		if stored == nil || stored.Status != 201 || string(stored.Body) != `{"answer":"x"}` {
+			t.Fatalf("expected the first replica's response, got %#v", stored)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("second replica did not see the completed response")
+	}
+}
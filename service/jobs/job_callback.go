@@ -0,0 +1,204 @@
+package jobs
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"gemini-wrapper/model"
+	"gemini-wrapper/service/urlcontext"
+)
+
+// Headers of a callback delivery. The signature is the hex HMAC-SHA256 of
+// "<timestamp>.<body>" keyed with the callback secret, prefixed with "sha256=".
+const (
+	TimestampHeader = "X-Gemini-Wrapper-Timestamp"
+	SignatureHeader = "X-Gemini-Wrapper-Signature"
+)
+
+// Sign returns the SignatureHeader value for body sent at timestamp.
+func Sign(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (m *Manager) validateCallback(raw string) error {
+	if m.cfg.CallbackSecret == "" {
+		return fmt.Errorf("%w: callbacks are disabled because no callback secret is configured", ErrInvalidCallback)
+	}
+	parsed, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidCallback, err)
+	}
+	if (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("%w: expected an absolute http or https URL", ErrInvalidCallback)
+	}
+	if err := m.callbackHostAllowed(parsed); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidCallback, err)
+	}
+	return nil
+}
+
+// callbackHostAllowed rejects hosts outside CallbackAllowedHosts and, unless
+// private networks are allowed, addresses that are not public. Host names
+// are checked again for the addresses they resolve to when connecting.
+func (m *Manager) callbackHostAllowed(u *url.URL) error {
+	host := u.Hostname()
+	if len(m.cfg.CallbackAllowedHosts) > 0 && !urlcontext.HostAllowed(m.cfg.CallbackAllowedHosts, host) {
+		return fmt.Errorf("host %s is not allowed", host)
+	}
+	if m.cfg.CallbackPrivateNetworks {
+		return nil
+	}
+	if strings.EqualFold(host, "localhost") || strings.HasSuffix(strings.ToLower(host), ".localhost") {
+		return fmt.Errorf("host %s is not public", host)
+	}
+	if addr, err := netip.ParseAddr(host); err == nil && !publicAddress(addr) {
+		return fmt.Errorf("address %s is not public", host)
+	}
+	return nil
+}
+
+// callbackClient returns the client deliveries are sent with. Redirects must
+// stay on allowed hosts, and, unless private networks are allowed, it does
+// not connect to addresses that are not public, whatever a host name
+// resolves to at that moment.
+func (m *Manager) callbackClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if !m.cfg.CallbackPrivateNetworks {
+		dialer := &net.Dialer{
+			Timeout: 30 * time.Second,
+			Control: func(_, address string, _ syscall.RawConn) error {
+				addrPort, err := netip.ParseAddrPort(address)
+				if err != nil {
+					return err
+				}
+				if !publicAddress(addrPort.Addr()) {
+					return fmt.Errorf("callback address %s is not public", addrPort.Addr())
+				}
+				return nil
+			},
+		}
+		transport.DialContext = dialer.DialContext
+		// A proxy would connect on the client's behalf, unchecked.
+		transport.Proxy = nil
+	}
+	return &http.Client{
+		Timeout:   m.cfg.CallbackTimeout,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			return m.callbackHostAllowed(req.URL)
+		},
+	}
+}
+
+// sharedAddressSpace is the carrier-grade NAT range, private in practice.
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// publicAddress reports whether addr is a unicast address on the internet,
+// not loopback, private, link-local (like cloud metadata services) or
+// unspecified.
+func publicAddress(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsGlobalUnicast() && !addr.IsPrivate() && !sharedAddressSpace.Contains(addr)
+}
+
+// deliver POSTs the finished job to its callback URL, retrying failed
+// attempts with exponential backoff, and records the outcome on the job.
+func (m *Manager) deliver(ctx context.Context, j *job) {
+	m.mu.Lock()
+	body, err := json.Marshal(j.info)
+	m.mu.Unlock()
+	if err != nil {
+		m.recordDelivery(j, 0, model.CallbackFailed, err)
+		return
+	}
+
+	backoff := m.callbackBackoff
+	for attempt := 1; ; attempt++ {
+		err := m.post(ctx, j.callbackURL, body)
+		switch {
+		case err == nil:
+			m.recordDelivery(j, attempt, model.CallbackDelivered, nil)
+			return
+		case attempt > m.cfg.CallbackRetries:
+			slog.WarnContext(ctx, "job callback failed", "job", j.info.ID, "url", j.callbackURL, "attempts", attempt, "error", err)
+			m.recordDelivery(j, attempt, model.CallbackFailed, err)
+			return
+		}
+		m.recordDelivery(j, attempt, model.CallbackPending, err)
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			m.recordDelivery(j, attempt, model.CallbackFailed, ctx.Err())
+			return
+		}
+		backoff *= 2
+	}
+}
+
+func (m *Manager) post(ctx context.Context, callbackURL string, body []byte) error {
+	timestamp := strconv.FormatInt(m.now().Unix(), 10)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, callbackURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(SignatureHeader, Sign(m.cfg.CallbackSecret, timestamp, body))
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("callback returned %s", resp.Status)
+	}
+	return nil
+}
+
+// recordDelivery stores the state of a callback after attempts deliveries.
+// Deliveries interrupted by Close stay pending and are sent again by the next
+// process.
+func (m *Manager) recordDelivery(j *job, attempts int, state string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return
+	}
+	j.info.Callback.State = state
+	j.info.Callback.Attempts = attempts
+	j.info.Callback.LastError = ""
+	if err != nil {
+		j.info.Callback.LastError = err.Error()
+	}
+	if err := m.saveLocked(j); err != nil {
+		slog.Warn("saving job failed", "job", j.info.ID, "error", err)
+	}
+}
@@ -0,0 +1,166 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gemini-wrapper/model"
+)
+
+func callbackConfig() Config {
+	cfg := DefaultConfig()
+	cfg.CallbackSecret = "s3cret"
+	// The test servers listen on loopback.
+	cfg.CallbackPrivateNetworks = true
+	return cfg
+}
+
+func waitForCallback(t *testing.T, m *Manager, id string, state string) model.JobInfo {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		info, err := m.Get(id)
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		if info.Callback != nil && info.Callback.State == state {
+			return info
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected callback state %q, got %#v", state, info.Callback)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCallbackIsSignedAndRetried(t *testing.T) {
+	var mu sync.Mutex
+	var calls int
+	var delivered model.JobInfo
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		if got, want := r.Header.Get(SignatureHeader), Sign("s3cret", r.Header.Get(TimestampHeader), body); got != want {
+			t.Errorf("signature %q, want %q", got, want)
+		}
+		if err := json.Unmarshal(body, &delivered); err != nil {
+			t.Errorf("decode callback: %v", err)
+		}
+	}))
+	defer server.Close()
+
+	asker := &gatedAsker{release: make(chan struct{})}
+	close(asker.release)
+	m := NewManager(asker, callbackConfig())
+	m.callbackBackoff = time.Millisecond
+
+	info, err := m.Create(context.Background(), "q", model.AskOptions{}, server.URL)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	done := waitForCallback(t, m, info.ID, model.CallbackDelivered)
+	if done.Callback.Attempts != 2 || done.Callback.LastError != "" {
+		t.Fatalf("unexpected callback: %#v", done.Callback)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if delivered.ID != info.ID || delivered.State != model.JobSucceeded || delivered.Answer != "answer q" {
+		t.Fatalf("unexpected delivered job: %#v", delivered)
+	}
+}
+
+func TestCallbackGivesUpAfterRetries(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	asker := &gatedAsker{release: make(chan struct{})}
+	close(asker.release)
+	cfg := callbackConfig()
+	cfg.CallbackRetries = 1
+	m := NewManager(asker, cfg)
+	m.callbackBackoff = time.Millisecond
+
+	info, err := m.Create(context.Background(), "q", model.AskOptions{}, server.URL)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	done := waitForCallback(t, m, info.ID, model.CallbackFailed)
+	if done.Callback.Attempts != 2 || done.Callback.LastError == "" {
+		t.Fatalf("unexpected callback: %#v", done.Callback)
+	}
+}
+
+func TestCreateRejectsUnusableCallbacks(t *testing.T) {
+	asker := &gatedAsker{release: make(chan struct{})}
+	if _, err := NewManager(asker, DefaultConfig()).Create(context.Background(), "q", model.AskOptions{}, "https://example.com/hook"); !errors.Is(err, ErrInvalidCallback) {
+		t.Fatalf("expected callbacks without a secret to be rejected, got %v", err)
+	}
+	m := NewManager(asker, callbackConfig())
+	for _, raw := range []string{"ftp://example.com/hook", "/relative", "http://"} {
+		if _, err := m.Create(context.Background(), "q", model.AskOptions{}, raw); !errors.Is(err, ErrInvalidCallback) {
+			t.Fatalf("expected %q to be rejected, got %v", raw, err)
+		}
+	}
+}
+
+func TestCallbacksStayOffPrivateNetworks(t *testing.T) {
+	var received int
+	server := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) { received++ }))
+	defer server.Close()
+
+	cfg := callbackConfig()
+	cfg.CallbackPrivateNetworks = false
+	m := NewManager(&gatedAsker{release: make(chan struct{})}, cfg)
+	for _, raw := range []string{"http://127.0.0.1:8080/hook", "http://localhost/hook", "http://169.254.169.254/latest/meta-data", "http://10.0.0.7/hook", "http://[::1]/hook", "http://[::ffff:192.168.1.1]/hook"} {
+		if _, err := m.Create(context.Background(), "q", model.AskOptions{}, raw); !errors.Is(err, ErrInvalidCallback) {
+			t.Fatalf("expected %q to be rejected, got %v", raw, err)
+		}
+	}
+	// Host names are checked for the address they resolve to.
+	if err := m.post(context.Background(), server.URL, []byte("{}")); err == nil || !strings.Contains(err.Error(), "not public") {
+		t.Fatalf("expected the loopback delivery to be refused, got %v", err)
+	}
+	if received != 0 {
+		t.Fatalf("expected no delivery, got %d", received)
+	}
+}
+
+func TestCallbacksStayOnAllowedHosts(t *testing.T) {
+	var received int
+	target := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) { received++ }))
+	defer target.Close()
+	redirect := httptest.NewServer(http.RedirectHandler(strings.Replace(target.URL, "127.0.0.1", "localhost", 1), http.StatusTemporaryRedirect))
+	defer redirect.Close()
+
+	cfg := callbackConfig()
+	cfg.CallbackAllowedHosts = []string{"127.0.0.1", "*.example.com"}
+	m := NewManager(&gatedAsker{release: make(chan struct{})}, cfg)
+	if _, err := m.Create(context.Background(), "q", model.AskOptions{}, "https://example.org/hook"); !errors.Is(err, ErrInvalidCallback) {
+		t.Fatalf("expected a host outside the allowed ones to be rejected, got %v", err)
+	}
+	if err := m.validateCallback("https://hooks.example.com/done"); err != nil {
+		t.Fatalf("expected a subdomain of an allowed pattern, got %v", err)
+	}
+	if err := m.post(context.Background(), redirect.URL, []byte("{}")); err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Fatalf("expected the redirect off the allowed hosts to be refused, got %v", err)
+	}
+	if received != 0 {
+		t.Fatalf("expected no delivery, got %d", received)
+	}
+}
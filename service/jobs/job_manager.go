@@ -0,0 +1,398 @@
+// Package jobs runs questions in the background so clients can poll for
+// answers that take longer than their HTTP or load balancer timeouts allow.
+package jobs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gemini-wrapper/model"
+	"gemini-wrapper/service/storage"
+)
+
+var (
+	// ErrJobNotFound is returned when a job ID is unknown or has expired.
+	ErrJobNotFound = errors.New("job not found")
+	// ErrTooManyJobs is returned by Create while MaxRunning jobs are unfinished.
+	ErrTooManyJobs = errors.New("too many running jobs")
+	// ErrInvalidCallback is returned by Create for a callback URL that cannot
+	// be used.
+	ErrInvalidCallback = errors.New("invalid callback_url")
+)
+
+type Config struct {
+	// ResultTTL is how long a finished job can still be polled.
+	ResultTTL time.Duration `yaml:"result_ttl"`
+	// MaxRunning caps unfinished jobs. 0 disables the limit.
+	MaxRunning int `yaml:"max_running"`
+	// CallbackSecret signs callback deliveries. Callbacks are refused while
+	// it is empty.
+	CallbackSecret string `yaml:"callback_secret"`
+	// CallbackRetries is how often a failed delivery is retried.
+	CallbackRetries int           `yaml:"callback_retries"`
+	CallbackTimeout time.Duration `yaml:"callback_timeout"`
+	// CallbackAllowedHosts limits callbacks to these hosts, matched like
+	// the allowed hosts of url_context. Empty allows any host.
+	CallbackAllowedHosts []string `yaml:"callback_allowed_hosts"`
+	// CallbackPrivateNetworks allows callbacks to loopback, private and
+	// link-local addresses, such as services next to the server. Without
+	// it, clients could make the server probe its own network.
+	CallbackPrivateNetworks bool `yaml:"callback_private_networks"`
+	// Path is the database Open keeps jobs in, so they survive restarts.
+	// Empty keeps them in memory only.
+	Path string `yaml:"path"`
+	// MaxAttempts is how often a job is started before it is dead-lettered.
+	// Runs that fail with a transient error, such as an overloaded model,
+	// and runs interrupted by a restart are attempted again.
+	MaxAttempts int `yaml:"max_attempts"`
+}
+
+func DefaultConfig() Config {
+	return Config{
+		ResultTTL:       time.Hour,
+		MaxRunning:      100,
+		CallbackRetries: 3,
+		CallbackTimeout: 10 * time.Second,
+		Path:            "/app/cache/jobs.db",
+		MaxAttempts:     3,
+	}
+}
+
+// ApplyEnv overrides c with the JOBS_* environment variables that are set.
+func (c *Config) ApplyEnv() {
+	if seconds := envInt("JOBS_RESULT_TTL_SECONDS", 0); seconds > 0 {
+		c.ResultTTL = time.Duration(seconds) * time.Second
+	}
+	c.MaxRunning = envInt("JOBS_MAX_RUNNING", c.MaxRunning)
+	if secret := strings.TrimSpace(os.Getenv("JOBS_CALLBACK_SECRET")); secret != "" {
+		c.CallbackSecret = secret
+	}
+	c.CallbackRetries = envInt("JOBS_CALLBACK_RETRIES", c.CallbackRetries)
+	if seconds := envInt("JOBS_CALLBACK_TIMEOUT_SECONDS", 0); seconds > 0 {
+		c.CallbackTimeout = time.Duration(seconds) * time.Second
+	}
+	if raw, ok := os.LookupEnv("JOBS_CALLBACK_ALLOWED_HOSTS"); ok {
+		c.CallbackAllowedHosts = nil
+		for _, host := range strings.Split(raw, ",") {
+			if host = strings.TrimSpace(host); host != "" {
+				c.CallbackAllowedHosts = append(c.CallbackAllowedHosts, host)
+			}
+		}
+	}
+	if raw := strings.TrimSpace(os.Getenv("JOBS_CALLBACK_PRIVATE_NETWORKS")); raw != "" {
+		if parsed, err := strconv.ParseBool(raw); err == nil {
+			c.CallbackPrivateNetworks = parsed
+		}
+	}
+	if path, ok := os.LookupEnv("JOBS_PATH"); ok {
+		c.Path = strings.TrimSpace(path)
+	}
+	c.MaxAttempts = envInt("JOBS_MAX_ATTEMPTS", c.MaxAttempts)
+}
+
+// Asker is the part of the Gemini service the manager needs.
+type Asker interface {
+	AskWithOptions(ctx context.Context, question string, opts model.AskOptions) (string, *model.GeminiStatus, error)
+}
+
+// Manager keeps jobs in memory, and in a database when opened with Open.
+// Finished jobs are dropped ResultTTL after they finished.
+type Manager struct {
+	service Asker
+	cfg     Config
+	now     func() time.Time
+	// store is nil for a manager that keeps jobs in memory only.
+	store storage.Store
+	// db is the file at Config.Path when Open created the manager. Close
+	// closes it once the running jobs have stopped.
+	db *storage.DB
+
+	client *http.Client
+	// callbackBackoff is the wait before the first callback retry; it doubles
+	// with every further retry. retryBackoff does the same for job attempts.
+	callbackBackoff time.Duration
+	retryBackoff    time.Duration
+
+	mu   sync.Mutex
+	jobs map[string]*job
+	// closed stops recording outcomes, so the jobs Close interrupts stay
+	// running in the database and start again with the next process.
+	closed bool
+	wg     sync.WaitGroup
+}
+
+type job struct {
+	cancel      context.CancelFunc
+	question    string
+	opts        model.AskOptions
+	callbackURL string
+	info        model.JobInfo
+}
+
+func NewManager(service Asker, cfg Config) *Manager {
+	defaults := DefaultConfig()
+	if cfg.ResultTTL <= 0 {
+		cfg.ResultTTL = defaults.ResultTTL
+	}
+	if cfg.CallbackTimeout <= 0 {
+		cfg.CallbackTimeout = defaults.CallbackTimeout
+	}
+	cfg.MaxAttempts = max(cfg.MaxAttempts, 1)
+	m := &Manager{
+		service:         service,
+		cfg:             cfg,
+		now:             time.Now,
+		callbackBackoff: time.Second,
+		retryBackoff:    time.Second,
+		jobs:            map[string]*job{},
+	}
+	m.client = m.callbackClient()
+	return m
+}
+
+// Create starts answering question in the background and returns at once.
+// The job keeps the values of ctx, such as the usage recorder of the client,
+// but not its cancellation. A non-empty callbackURL receives the finished job.
+// Jobs queue with low priority unless opts asks for another.
+func (m *Manager) Create(ctx context.Context, question string, opts model.AskOptions, callbackURL string) (model.JobInfo, error) {
+	callbackURL = strings.TrimSpace(callbackURL)
+	if callbackURL != "" {
+		if err := m.validateCallback(callbackURL); err != nil {
+			return model.JobInfo{}, err
+		}
+	}
+	id, err := newJobID()
+	if err != nil {
+		return model.JobInfo{}, err
+	}
+
+	if opts.Priority == "" {
+		opts.Priority = model.PriorityLow
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pruneLocked()
+	if m.cfg.MaxRunning > 0 && m.runningLocked() >= m.cfg.MaxRunning {
+		return model.JobInfo{}, fmt.Errorf("%w: limit is %d", ErrTooManyJobs, m.cfg.MaxRunning)
+	}
+	j := &job{
+		question:    strings.TrimSpace(question),
+		opts:        opts,
+		callbackURL: callbackURL,
+		info:        model.JobInfo{ID: id, State: model.JobRunning, Model: opts.Model, CreatedAt: m.now()},
+	}
+	if callbackURL != "" {
+		j.info.Callback = &model.JobCallback{URL: callbackURL, State: model.CallbackPending}
+	}
+	if err := m.saveLocked(j); err != nil {
+		return model.JobInfo{}, err
+	}
+	m.jobs[id] = j
+	m.startLocked(context.WithoutCancel(ctx), j, m.run)
+	return j.info.Snapshot(), nil
+}
+
+// startLocked runs fn for j in the background with a context that Cancel
+// and Close end.
+func (m *Manager) startLocked(parent context.Context, j *job, fn func(context.Context, *job)) {
+	ctx, cancel := context.WithCancel(parent)
+	j.cancel = cancel
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		defer cancel()
+		fn(ctx, j)
+	}()
+}
+
+// run attempts j until it finishes, then delivers its callback.
+func (m *Manager) run(ctx context.Context, j *job) {
+	backoff := m.retryBackoff
+	for m.beginAttempt(j) {
+		answer, status, err := m.service.AskWithOptions(ctx, j.question, j.opts)
+		finished, retry := m.finish(j, answer, status, err)
+		if finished && j.callbackURL != "" {
+			m.deliver(ctx, j)
+		}
+		if !retry {
+			return
+		}
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+		backoff *= 2
+	}
+}
+
+// beginAttempt counts a new attempt of j, first on disk so a run cut short
+// by a crash counts too. It returns false once j is no longer running.
+func (m *Manager) beginAttempt(j *job) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed || j.info.State != model.JobRunning {
+		return false
+	}
+	j.info.Attempts++
+	if err := m.saveLocked(j); err != nil {
+		slog.Warn("saving job failed", "job", j.info.ID, "error", err)
+	}
+	return true
+}
+
+// finish records the outcome of an attempt of j. It reports whether the job
+// finished, which it does exactly once, and whether it should be attempted
+// again. Outcomes of cancelled jobs and of runs interrupted by Close are
+// dropped.
+func (m *Manager) finish(j *job, answer string, status *model.GeminiStatus, err error) (finished, retry bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed || j.info.State != model.JobRunning {
+		return false, false
+	}
+	if err != nil && transient(status) && j.info.Attempts < m.cfg.MaxAttempts {
+		j.info.Error = err.Error()
+		j.info.ErrorCode = status.Reason
+		if err := m.saveLocked(j); err != nil {
+			slog.Warn("saving job failed", "job", j.info.ID, "error", err)
+		}
+		return false, true
+	}
+	finishedAt := m.now()
+	j.info.FinishedAt = &finishedAt
+	j.info.Status = status
+	if status != nil {
+		j.info.Usage = status.Usage
+		if status.Model != "" {
+			j.info.Model = status.Model
+		}
+	}
+	if err != nil {
+		j.info.State = model.JobFailed
+		switch {
+		case transient(status):
+			j.info.State = model.JobDeadLetter
+		case status != nil && status.Reason == model.ReasonCancelled:
+			// Cancelled through the ID of the request that created it.
+			j.info.State = model.JobCancelled
+		}
+		j.info.Error = err.Error()
+		j.info.ErrorCode = model.ReasonInternalError
+		if status != nil && status.Reason != "" {
+			j.info.ErrorCode = status.Reason
+		}
+	} else {
+		j.info.State = model.JobSucceeded
+		j.info.Answer = answer
+		j.info.Error = ""
+		j.info.ErrorCode = ""
+	}
+	if err := m.saveLocked(j); err != nil {
+		slog.Warn("saving job failed", "job", j.info.ID, "error", err)
+	}
+	return true, false
+}
+
+// transient reports whether a run that failed with status may succeed when
+// attempted again.
+func transient(status *model.GeminiStatus) bool {
+	if status == nil {
+		return false
+	}
+	switch status.Reason {
+	case model.ReasonModelOverloaded, model.ReasonQueueFull, model.ReasonUnavailable,
+		model.ReasonBackendStarting, model.ReasonUpstreamError:
+		return true
+	}
+	return false
+}
+
+// Get returns the current state of a job.
+func (m *Manager) Get(id string) (model.JobInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pruneLocked()
+	j, ok := m.jobs[id]
+	if !ok {
+		return model.JobInfo{}, ErrJobNotFound
+	}
+	return j.info.Snapshot(), nil
+}
+
+// Cancel stops a running job and stops its CLI process. Finished jobs are
+// returned unchanged.
+func (m *Manager) Cancel(id string) (model.JobInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j, ok := m.jobs[id]
+	if !ok {
+		return model.JobInfo{}, ErrJobNotFound
+	}
+	if j.info.State == model.JobRunning {
+		finishedAt := m.now()
+		j.info.State = model.JobCancelled
+		j.info.FinishedAt = &finishedAt
+		j.cancel()
+		if j.info.Callback != nil {
+			j.info.Callback.State = model.CallbackSkipped
+		}
+		if err := m.saveLocked(j); err != nil {
+			slog.Warn("saving job failed", "job", j.info.ID, "error", err)
+		}
+	}
+	return j.info.Snapshot(), nil
+}
+
+func (m *Manager) runningLocked() int {
+	running := 0
+	for _, j := range m.jobs {
+		if j.info.State == model.JobRunning {
+			running++
+		}
+	}
+	return running
+}
+
+func (m *Manager) pruneLocked() {
+	cutoff := m.now().Add(-m.cfg.ResultTTL)
+	var expired []string
+	for id, j := range m.jobs {
+		if j.info.FinishedAt != nil && j.info.FinishedAt.Before(cutoff) {
+			delete(m.jobs, id)
+			expired = append(expired, id)
+		}
+	}
+	if err := m.deleteLocked(expired); err != nil {
+		slog.Warn("deleting expired jobs failed", "error", err)
+	}
+}
+
+func newJobID() (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "job_" + hex.EncodeToString(b), nil
+}
+
+func envInt(key string, defaultValue int) int {
+	parsed, err := strconv.Atoi(strings.TrimSpace(os.Getenv(key)))
+	if err != nil || parsed < 0 {
+		return defaultValue
+	}
+	return parsed
+}
@@ -0,0 +1,122 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"gemini-wrapper/model"
+)
+
+// gatedAsker answers once release is closed, or fails when ctx ends first.
+type gatedAsker struct {
+	release chan struct{}
+}
+
+func (a *gatedAsker) AskWithOptions(ctx context.Context, question string, opts model.AskOptions) (string, *model.GeminiStatus, error) {
+	select {
+	case <-a.release:
+		return "answer " + question, &model.GeminiStatus{Model: "gemini-2.5-flash"}, nil
+	case <-ctx.Done():
+		return "", nil, ctx.Err()
+	}
+}
+
+func waitForState(t *testing.T, m *Manager, id string, state string) model.JobInfo {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		info, err := m.Get(id)
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		if info.State == state {
+			return info
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected state %q, got %#v", state, info)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestJobRunsInBackground(t *testing.T) {
+	asker := &gatedAsker{release: make(chan struct{})}
+	m := NewManager(asker, DefaultConfig())
+
+	info, err := m.Create(context.Background(), "q", model.AskOptions{}, "")
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if info.State != model.JobRunning || info.ID == "" {
+		t.Fatalf("expected a running job, got %#v", info)
+	}
+
+	close(asker.release)
+	done := waitForState(t, m, info.ID, model.JobSucceeded)
+	if done.Answer != "answer q" || done.Model != "gemini-2.5-flash" || done.FinishedAt == nil {
+		t.Fatalf("unexpected finished job: %#v", done)
+	}
+}
+
+func TestJobOutlivesRequestContext(t *testing.T) {
+	asker := &gatedAsker{release: make(chan struct{})}
+	m := NewManager(asker, DefaultConfig())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	info, err := m.Create(ctx, "q", model.AskOptions{}, "")
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	cancel()
+	close(asker.release)
+	waitForState(t, m, info.ID, model.JobSucceeded)
+}
+
+func TestCancelStopsJob(t *testing.T) {
+	asker := &gatedAsker{release: make(chan struct{})}
+	m := NewManager(asker, Config{MaxRunning: 1})
+
+	info, err := m.Create(context.Background(), "q", model.AskOptions{}, "")
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err := m.Create(context.Background(), "q2", model.AskOptions{}, ""); !errors.Is(err, ErrTooManyJobs) {
+		t.Fatalf("expected ErrTooManyJobs, got %v", err)
+	}
+
+	cancelled, err := m.Cancel(info.ID)
+	if err != nil || cancelled.State != model.JobCancelled {
+		t.Fatalf("expected cancelled job, got %#v err=%v", cancelled, err)
+	}
+	// The job's late failure must not overwrite the cancellation.
+	time.Sleep(10 * time.Millisecond)
+	if got, _ := m.Get(info.ID); got.State != model.JobCancelled || got.Error != "" {
+		t.Fatalf("expected the job to stay cancelled, got %#v", got)
+	}
+	if _, err := m.Create(context.Background(), "q3", model.AskOptions{}, ""); err != nil {
+		t.Fatalf("expected room for a new job after cancel, got %v", err)
+	}
+}
+
+func TestFinishedJobsExpire(t *testing.T) {
+	asker := &gatedAsker{release: make(chan struct{})}
+	close(asker.release)
+	m := NewManager(asker, Config{ResultTTL: time.Minute})
+	now := time.Now()
+	m.now = func() time.Time { return now }
+
+	info, err := m.Create(context.Background(), "q", model.AskOptions{}, "")
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	waitForState(t, m, info.ID, model.JobSucceeded)
+
+	m.mu.Lock()
+	now = now.Add(2 * time.Minute)
+	m.mu.Unlock()
+	if _, err := m.Get(info.ID); !errors.Is(err, ErrJobNotFound) {
+		t.Fatalf("expected expired job to be gone, got %v", err)
+	}
+}
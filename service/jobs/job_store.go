@@ -0,0 +1,137 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+
+	"gemini-wrapper/model"
+	"gemini-wrapper/service/storage"
+)
+
+// StoreName is the store of the jobs in the database.
+const StoreName = "jobs"
+
+// record is a job as the database keeps it: enough to run it again.
+type record struct {
+	Info        model.JobInfo    `json:"info"`
+	Question    string           `json:"question"`
+	Options     model.AskOptions `json:"options"`
+	CallbackURL string           `json:"callback_url,omitempty"`
+}
+
+// Open returns a manager that keeps its jobs in the Bolt database at
+// cfg.Path, or in memory when the path is empty. Jobs the previous process
+// left running start again, without the usage recorders of the client that
+// created them, and the callbacks it had not delivered are sent. Jobs that
+// have used up cfg.MaxAttempts are dead-lettered instead.
+func Open(service Asker, cfg Config) (*Manager, error) {
+	if cfg.Path == "" {
+		return NewManager(service, cfg), nil
+	}
+	db, err := storage.Open(cfg.Path)
+	if err != nil {
+		return nil, err
+	}
+	store, err := db.Store(StoreName)
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	m, err := OpenStorage(service, cfg, store)
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	m.db = db
+	return m, nil
+}
+
+// OpenStorage is Open with the jobs kept in store, such as a store of the
+// database all features share.
+func OpenStorage(service Asker, cfg Config, store storage.Store) (*Manager, error) {
+	m := NewManager(service, cfg)
+	var records []record
+	if err := store.ForEach("", "", func(_ string, raw []byte) error {
+		var rec record
+		if err := json.Unmarshal(raw, &rec); err != nil {
+			return fmt.Errorf("decode job: %w", err)
+		}
+		records = append(records, rec)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	m.store = store
+	m.resume(records)
+	return m, nil
+}
+
+func (m *Manager) resume(records []record) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, rec := range records {
+		j := &job{cancel: func() {}, question: rec.Question, opts: rec.Options, callbackURL: rec.CallbackURL, info: rec.Info}
+		m.jobs[j.info.ID] = j
+		switch {
+		case j.info.State == model.JobRunning && j.info.Attempts >= m.cfg.MaxAttempts:
+			finishedAt := m.now()
+			j.info.State = model.JobDeadLetter
+			j.info.FinishedAt = &finishedAt
+			j.info.Error = fmt.Sprintf("interrupted by a restart on each of %d attempts", j.info.Attempts)
+			j.info.ErrorCode = model.ReasonInternalError
+			if err := m.saveLocked(j); err != nil {
+				slog.Warn("saving job failed", "job", j.info.ID, "error", err)
+			}
+			if j.callbackURL != "" {
+				m.startLocked(context.Background(), j, m.deliver)
+			}
+		case j.info.State == model.JobRunning:
+			m.startLocked(context.Background(), j, m.run)
+		case j.info.Callback != nil && j.info.Callback.State == model.CallbackPending:
+			m.startLocked(context.Background(), j, m.deliver)
+		}
+	}
+	m.pruneLocked()
+	if len(records) > 0 {
+		slog.Info("jobs restored", "jobs", len(m.jobs), "running", m.runningLocked())
+	}
+}
+
+// saveLocked writes j to the database, if any.
+func (m *Manager) saveLocked(j *job) error {
+	if m.store == nil || m.closed {
+		return nil
+	}
+	raw, err := json.Marshal(record{Info: j.info, Question: j.question, Options: j.opts, CallbackURL: j.callbackURL})
+	if err != nil {
+		return err
+	}
+	return m.store.Put(j.info.ID, raw)
+}
+
+func (m *Manager) deleteLocked(ids []string) error {
+	if m.store == nil || m.closed {
+		return nil
+	}
+	return m.store.Delete(ids...)
+}
+
+// Close stops the running jobs and callback deliveries and closes the
+// database. With a database, the jobs it stops run again after a restart.
+func (m *Manager) Close() error {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	m.closed = true
+	for _, j := range m.jobs {
+		if j.cancel != nil {
+			j.cancel()
+		}
+	}
+	m.mu.Unlock()
+	m.wg.Wait()
+	return m.db.Close()
+}
@@ -0,0 +1,132 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gemini-wrapper/model"
+)
+
+// countingAsker answers at once and counts its calls.
+type countingAsker struct {
+	calls atomic.Int32
+}
+
+func (a *countingAsker) AskWithOptions(ctx context.Context, question string, opts model.AskOptions) (string, *model.GeminiStatus, error) {
+	a.calls.Add(1)
+	return "answer " + question, &model.GeminiStatus{}, nil
+}
+
+// overloadedAsker always fails with an error worth retrying.
+type overloadedAsker struct {
+	calls atomic.Int32
+}
+
+func (a *overloadedAsker) AskWithOptions(ctx context.Context, question string, opts model.AskOptions) (string, *model.GeminiStatus, error) {
+	a.calls.Add(1)
+	return "", &model.GeminiStatus{Reason: model.ReasonModelOverloaded}, errors.New("model is overloaded")
+}
+
+func openTestManager(t *testing.T, asker Asker, path string, maxAttempts int) *Manager {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.Path = path
+	cfg.MaxAttempts = maxAttempts
+	m, err := Open(asker, cfg)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	return m
+}
+
+func TestOpenRunsInterruptedJobsAgainAndKeepsFinishedOnes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jobs.db")
+	m := openTestManager(t, &gatedAsker{release: make(chan struct{})}, path, 3)
+	interrupted, err := m.Create(context.Background(), "q", model.AskOptions{Model: "gemini-2.5-pro"}, "")
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	waitForAttempts(t, m, interrupted.ID, 1)
+	if err := m.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	asker := &countingAsker{}
+	m = openTestManager(t, asker, path, 3)
+	done := waitForState(t, m, interrupted.ID, model.JobSucceeded)
+	if done.Answer != "answer q" || done.Attempts != 2 || done.Model != "gemini-2.5-pro" {
+		t.Fatalf("unexpected resumed job: %#v", done)
+	}
+	if err := m.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// A finished job is polled again after a restart, but not run again.
+	m = openTestManager(t, asker, path, 3)
+	defer m.Close()
+	if got, err := m.Get(interrupted.ID); err != nil || got.State != model.JobSucceeded || got.Answer != "answer q" {
+		t.Fatalf("expected the finished job after a restart, got %#v err=%v", got, err)
+	}
+	if calls := asker.calls.Load(); calls != 1 {
+		t.Fatalf("expected the job to complete once, ran %d times", calls)
+	}
+}
+
+func TestOpenDeadLettersJobsInterruptedOnEveryAttempt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jobs.db")
+	m := openTestManager(t, &gatedAsker{release: make(chan struct{})}, path, 1)
+	info, err := m.Create(context.Background(), "q", model.AskOptions{}, "")
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	waitForAttempts(t, m, info.ID, 1)
+	m.Close()
+
+	asker := &countingAsker{}
+	m = openTestManager(t, asker, path, 1)
+	defer m.Close()
+	got, err := m.Get(info.ID)
+	if err != nil || got.State != model.JobDeadLetter || got.FinishedAt == nil || got.Error == "" {
+		t.Fatalf("expected a dead-lettered job, got %#v err=%v", got, err)
+	}
+	if asker.calls.Load() != 0 {
+		t.Fatal("dead-lettered job ran again")
+	}
+}
+
+func TestTransientFailuresAreRetriedThenDeadLettered(t *testing.T) {
+	asker := &overloadedAsker{}
+	m := NewManager(asker, Config{MaxAttempts: 3})
+	m.retryBackoff = time.Millisecond
+
+	info, err := m.Create(context.Background(), "q", model.AskOptions{}, "")
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	done := waitForState(t, m, info.ID, model.JobDeadLetter)
+	if done.Attempts != 3 || asker.calls.Load() != 3 || done.ErrorCode != model.ReasonModelOverloaded {
+		t.Fatalf("unexpected dead-lettered job after %d calls: %#v", asker.calls.Load(), done)
+	}
+}
+
+func waitForAttempts(t *testing.T, m *Manager, id string, attempts int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		info, err := m.Get(id)
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		if info.Attempts >= attempts {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d attempts, got %#v", attempts, info)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,474 @@
+// Package jsonschema checks JSON documents against the subset of JSON Schema
+// that the Gemini API accepts as responseSchema: type (in any case, so the
+// API's "OBJECT" works too), nullable, enum, const, properties, required,
+// additionalProperties, items, anyOf, allOf, oneOf and the length, size and
+// range bounds. Other keywords, such as description or format, are ignored.
+package jsonschema
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Schema is a parsed schema. Compile it once and validate any number of
+// documents with it.
+type Schema struct {
+	types        []string
+	nullable     bool
+	enum         []any
+	constant     *any
+	properties   map[string]*Schema
+	required     []string
+	additional   *Schema
+	noAdditional bool
+	items        *Schema
+	anyOf        []*Schema
+	allOf        []*Schema
+	oneOf        []*Schema
+
+	minLength, maxLength *int
+	minItems, maxItems   *int
+	minProps, maxProps   *int
+	minimum, maximum     *float64
+	exclusiveMin         *float64
+	exclusiveMax         *float64
+	pattern              *regexp.Regexp
+}
+
+// knownTypes are the values of "type", in lower case.
+var knownTypes = map[string]bool{
+	"object": true, "array": true, "string": true, "number": true,
+	"integer": true, "boolean": true, "null": true,
+}
+
+// ValidationError says where a document does not match its schema.
+type ValidationError struct {
+	// Path locates the offending value, like "$.items[2].name".
+	Path    string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Path + ": " + e.Message
+}
+
+// Compile parses raw, which must be a JSON object.
+func Compile(raw json.RawMessage) (*Schema, error) {
+	var doc any
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return nil, fmt.Errorf("invalid schema: %v", err)
+	}
+	return compile(doc, "$")
+}
+
+func compile(doc any, path string) (*Schema, error) {
+	if b, ok := doc.(bool); ok && b {
+		return &Schema{}, nil
+	}
+	obj, ok := doc.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("schema %s must be an object", path)
+	}
+
+	s := &Schema{}
+	switch t := obj["type"].(type) {
+	case nil:
+	case string:
+		s.types = []string{strings.ToLower(t)}
+	case []any:
+		for _, entry := range t {
+			name, ok := entry.(string)
+			if !ok {
+				return nil, fmt.Errorf("schema %s: type must name types", path)
+			}
+			s.types = append(s.types, strings.ToLower(name))
+		}
+	default:
+		return nil, fmt.Errorf("schema %s: type must be a string or an array", path)
+	}
+	for _, name := range s.types {
+		if !knownTypes[name] {
+			return nil, fmt.Errorf("schema %s: unknown type %q", path, name)
+		}
+	}
+	s.nullable, _ = obj["nullable"].(bool)
+
+	if raw, ok := obj["enum"]; ok {
+		values, ok := raw.([]any)
+		if !ok {
+			return nil, fmt.Errorf("schema %s: enum must be an array", path)
+		}
+		s.enum = values
+	}
+	if raw, ok := obj["const"]; ok {
+		s.constant = &raw
+	}
+
+	if raw, ok := obj["properties"]; ok {
+		props, ok := raw.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("schema %s: properties must be an object", path)
+		}
+		s.properties = map[string]*Schema{}
+		for name, prop := range props {
+			compiled, err := compile(prop, path+"."+name)
+			if err != nil {
+				return nil, err
+			}
+			s.properties[name] = compiled
+		}
+	}
+	if raw, ok := obj["required"]; ok {
+		names, ok := raw.([]any)
+		if !ok {
+			return nil, fmt.Errorf("schema %s: required must be an array", path)
+		}
+		for _, entry := range names {
+			name, ok := entry.(string)
+			if !ok {
+				return nil, fmt.Errorf("schema %s: required must name properties", path)
+			}
+			s.required = append(s.required, name)
+		}
+	}
+	switch raw := obj["additionalProperties"].(type) {
+	case nil:
+	case bool:
+		s.noAdditional = !raw
+	default:
+		compiled, err := compile(raw, path+".additionalProperties")
+		if err != nil {
+			return nil, err
+		}
+		s.additional = compiled
+	}
+	if raw, ok := obj["items"]; ok {
+		compiled, err := compile(raw, path+"[]")
+		if err != nil {
+			return nil, err
+		}
+		s.items = compiled
+	}
+
+	var err error
+	if s.anyOf, err = compileList(obj, "anyOf", path); err != nil {
+		return nil, err
+	}
+	if s.allOf, err = compileList(obj, "allOf", path); err != nil {
+		return nil, err
+	}
+	if s.oneOf, err = compileList(obj, "oneOf", path); err != nil {
+		return nil, err
+	}
+
+	for key, target := range map[string]**int{
+		"minLength": &s.minLength, "maxLength": &s.maxLength,
+		"minItems": &s.minItems, "maxItems": &s.maxItems,
+		"minProperties": &s.minProps, "maxProperties": &s.maxProps,
+	} {
+		if *target, err = intKeyword(obj, key, path); err != nil {
+			return nil, err
+		}
+	}
+	for key, target := range map[string]**float64{
+		"minimum": &s.minimum, "maximum": &s.maximum,
+		"exclusiveMinimum": &s.exclusiveMin, "exclusiveMaximum": &s.exclusiveMax,
+	} {
+		if *target, err = numberKeyword(obj, key, path); err != nil {
+			return nil, err
+		}
+	}
+	if raw, ok := obj["pattern"]; ok {
+		expr, ok := raw.(string)
+		if !ok {
+			return nil, fmt.Errorf("schema %s: pattern must be a string", path)
+		}
+		if s.pattern, err = regexp.Compile(expr); err != nil {
+			return nil, fmt.Errorf("schema %s: invalid pattern: %v", path, err)
+		}
+	}
+	return s, nil
+}
+
+func compileList(obj map[string]any, key, path string) ([]*Schema, error) {
+	raw, ok := obj[key]
+	if !ok {
+		return nil, nil
+	}
+	entries, ok := raw.([]any)
+	if !ok || len(entries) == 0 {
+		return nil, fmt.Errorf("schema %s: %s must be a non-empty array", path, key)
+	}
+	schemas := make([]*Schema, 0, len(entries))
+	for i, entry := range entries {
+		compiled, err := compile(entry, fmt.Sprintf("%s.%s[%d]", path, key, i))
+		if err != nil {
+			return nil, err
+		}
+		schemas = append(schemas, compiled)
+	}
+	return schemas, nil
+}
+
+// intKeyword reads a non-negative count. The Gemini API sends int64 counts
+// as strings, so those are accepted too.
+func intKeyword(obj map[string]any, key, path string) (*int, error) {
+	raw, ok := obj[key]
+	if !ok {
+		return nil, nil
+	}
+	var value float64
+	switch v := raw.(type) {
+	case float64:
+		value = v
+	case string:
+		if _, err := fmt.Sscan(v, &value); err != nil {
+			return nil, fmt.Errorf("schema %s: %s must be a number", path, key)
+		}
+	default:
+		return nil, fmt.Errorf("schema %s: %s must be a number", path, key)
+	}
+	if value < 0 || value != math.Trunc(value) {
+		return nil, fmt.Errorf("schema %s: %s must be a non-negative integer", path, key)
+	}
+	n := int(value)
+	return &n, nil
+}
+
+func numberKeyword(obj map[string]any, key, path string) (*float64, error) {
+	raw, ok := obj[key]
+	if !ok {
+		return nil, nil
+	}
+	switch v := raw.(type) {
+	case float64:
+		return &v, nil
+	case bool:
+		// Draft 4 spells exclusive bounds as booleans next to minimum and
+		// maximum; those are not supported and are ignored.
+		return nil, nil
+	}
+	return nil, fmt.Errorf("schema %s: %s must be a number", path, key)
+}
+
+// Validate parses data as a single JSON value and checks it against s.
+// Syntax errors are reported as a ValidationError at "$".
+func (s *Schema) Validate(data []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return &ValidationError{Path: "$", Message: "invalid JSON: " + err.Error()}
+	}
+	if decoder.More() {
+		return &ValidationError{Path: "$", Message: "invalid JSON: unexpected data after the top-level value"}
+	}
+	return s.ValidateValue(value)
+}
+
+// ValidateValue checks a value decoded by encoding/json into an any.
+func (s *Schema) ValidateValue(value any) error {
+	return s.validate(value, "$")
+}
+
+func (s *Schema) validate(value any, path string) error {
+	if value == nil && s.nullable {
+		return nil
+	}
+	if len(s.types) > 0 && !s.matchesType(value) {
+		return &ValidationError{Path: path, Message: fmt.Sprintf("expected %s, got %s", strings.Join(s.types, " or "), typeOf(value))}
+	}
+	if s.enum != nil && !containsValue(s.enum, value) {
+		return &ValidationError{Path: path, Message: fmt.Sprintf("must be one of %s", compactJSON(s.enum))}
+	}
+	if s.constant != nil && !reflect.DeepEqual(*s.constant, value) {
+		return &ValidationError{Path: path, Message: fmt.Sprintf("must be %s", compactJSON(*s.constant))}
+	}
+
+	switch v := value.(type) {
+	case map[string]any:
+		if err := s.validateObject(v, path); err != nil {
+			return err
+		}
+	case []any:
+		if err := s.validateArray(v, path); err != nil {
+			return err
+		}
+	case string:
+		length := utf8.RuneCountInString(v)
+		if s.minLength != nil && length < *s.minLength {
+			return &ValidationError{Path: path, Message: fmt.Sprintf("must be at least %d characters long", *s.minLength)}
+		}
+		if s.maxLength != nil && length > *s.maxLength {
+			return &ValidationError{Path: path, Message: fmt.Sprintf("must be at most %d characters long", *s.maxLength)}
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			return &ValidationError{Path: path, Message: fmt.Sprintf("must match %q", s.pattern.String())}
+		}
+	case float64:
+		if s.minimum != nil && v < *s.minimum {
+			return &ValidationError{Path: path, Message: fmt.Sprintf("must be at least %v", *s.minimum)}
+		}
+		if s.maximum != nil && v > *s.maximum {
+			return &ValidationError{Path: path, Message: fmt.Sprintf("must be at most %v", *s.maximum)}
+		}
+		if s.exclusiveMin != nil && v <= *s.exclusiveMin {
+			return &ValidationError{Path: path, Message: fmt.Sprintf("must be greater than %v", *s.exclusiveMin)}
+		}
+		if s.exclusiveMax != nil && v >= *s.exclusiveMax {
+			return &ValidationError{Path: path, Message: fmt.Sprintf("must be less than %v", *s.exclusiveMax)}
+		}
+	}
+
+	for _, sub := range s.allOf {
+		if err := sub.validate(value, path); err != nil {
+			return err
+		}
+	}
+	if len(s.anyOf) > 0 {
+		matched := false
+		var firstErr error
+		for _, sub := range s.anyOf {
+			err := sub.validate(value, path)
+			if err == nil {
+				matched = true
+				break
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		if !matched {
+			return &ValidationError{Path: path, Message: "matches none of anyOf: " + firstErr.Error()}
+		}
+	}
+	if len(s.oneOf) > 0 {
+		matches := 0
+		for _, sub := range s.oneOf {
+			if sub.validate(value, path) == nil {
+				matches++
+			}
+		}
+		if matches != 1 {
+			return &ValidationError{Path: path, Message: fmt.Sprintf("must match exactly one of oneOf, matches %d", matches)}
+		}
+	}
+	return nil
+}
+
+func (s *Schema) validateObject(obj map[string]any, path string) error {
+	for _, name := range s.required {
+		if _, ok := obj[name]; !ok {
+			return &ValidationError{Path: path, Message: fmt.Sprintf("missing required property %q", name)}
+		}
+	}
+	if s.minProps != nil && len(obj) < *s.minProps {
+		return &ValidationError{Path: path, Message: fmt.Sprintf("must have at least %d properties", *s.minProps)}
+	}
+	if s.maxProps != nil && len(obj) > *s.maxProps {
+		return &ValidationError{Path: path, Message: fmt.Sprintf("must have at most %d properties", *s.maxProps)}
+	}
+	// Sorted so the first error reported is the same every time.
+	names := make([]string, 0, len(obj))
+	for name := range obj {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		childPath := path + "." + name
+		if prop, ok := s.properties[name]; ok {
+			if err := prop.validate(obj[name], childPath); err != nil {
+				return err
+			}
+			continue
+		}
+		if s.noAdditional {
+			return &ValidationError{Path: childPath, Message: "is not allowed"}
+		}
+		if s.additional != nil {
+			if err := s.additional.validate(obj[name], childPath); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Schema) validateArray(items []any, path string) error {
+	if s.minItems != nil && len(items) < *s.minItems {
+		return &ValidationError{Path: path, Message: fmt.Sprintf("must have at least %d items", *s.minItems)}
+	}
+	if s.maxItems != nil && len(items) > *s.maxItems {
+		return &ValidationError{Path: path, Message: fmt.Sprintf("must have at most %d items", *s.maxItems)}
+	}
+	if s.items == nil {
+		return nil
+	}
+	for i, item := range items {
+		if err := s.items.validate(item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Schema) matchesType(value any) bool {
+	for _, name := range s.types {
+		switch name {
+		case "integer":
+			if n, ok := value.(float64); ok && n == math.Trunc(n) {
+				return true
+			}
+		case "number":
+			if _, ok := value.(float64); ok {
+				return true
+			}
+		default:
+			if typeOf(value) == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func typeOf(value any) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+func containsValue(values []any, value any) bool {
+	for _, candidate := range values {
+		if reflect.DeepEqual(candidate, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func compactJSON(value any) string {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(b)
+}
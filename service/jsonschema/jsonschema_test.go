@@ -0,0 +1,99 @@
+package jsonschema
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+const personSchema = `{
+	"type": "OBJECT",
+	"properties": {
+		"name": {"type": "STRING", "minLength": 1},
+		"age": {"type": "INTEGER", "minimum": 0},
+		"email": {"type": "string", "nullable": true},
+		"role": {"type": "string", "enum": ["admin", "user"]},
+		"tags": {"type": "array", "items": {"type": "string"}, "maxItems": "2"}
+	},
+	"required": ["name", "age"],
+	"additionalProperties": false
+}`
+
+func TestValidateReportsTheFirstMismatch(t *testing.T) {
+	schema, err := Compile([]byte(personSchema))
+	if err != nil {
+		t.Fatalf("compile failed: %v", err)
+	}
+
+	cases := []struct {
+		name     string
+		document string
+		wantPath string
+	}{
+		{name: "valid", document: `{"name": "Ada", "age": 36, "email": null, "role": "admin", "tags": ["x"]}`},
+		{name: "missing required", document: `{"name": "Ada"}`, wantPath: "$"},
+		{name: "wrong type", document: `{"name": "Ada", "age": "36"}`, wantPath: "$.age"},
+		{name: "fraction for integer", document: `{"name": "Ada", "age": 36.5}`, wantPath: "$.age"},
+		{name: "below minimum", document: `{"name": "Ada", "age": -1}`, wantPath: "$.age"},
+		{name: "empty string", document: `{"name": "", "age": 1}`, wantPath: "$.name"},
+		{name: "not in enum", document: `{"name": "Ada", "age": 1, "role": "root"}`, wantPath: "$.role"},
+		{name: "bad item", document: `{"name": "Ada", "age": 1, "tags": ["x", 2]}`, wantPath: "$.tags[1]"},
+		{name: "too many items", document: `{"name": "Ada", "age": 1, "tags": ["x", "y", "z"]}`, wantPath: "$.tags"},
+		{name: "extra property", document: `{"name": "Ada", "age": 1, "nick": "A"}`, wantPath: "$.nick"},
+		{name: "not JSON", document: `Sure! {"name": "Ada"}`, wantPath: "$"},
+		{name: "trailing data", document: `{"name": "Ada", "age": 1} {}`, wantPath: "$"},
+	}
+	for _, tc := range cases {
+		err := schema.Validate([]byte(tc.document))
+		if tc.wantPath == "" {
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %v", tc.name, err)
+			}
+			continue
+		}
+		var validationErr *ValidationError
+		if !errors.As(err, &validationErr) || validationErr.Path != tc.wantPath {
+			t.Fatalf("%s: expected an error at %s, got %v", tc.name, tc.wantPath, err)
+		}
+	}
+}
+
+func TestValidateCombinators(t *testing.T) {
+	schema, err := Compile([]byte(`{"anyOf": [{"type": "string"}, {"type": "number", "maximum": 10}]}`))
+	if err != nil {
+		t.Fatalf("compile failed: %v", err)
+	}
+	if err := schema.Validate([]byte(`"text"`)); err != nil {
+		t.Fatalf("expected a string to match: %v", err)
+	}
+	if err := schema.Validate([]byte(`11`)); err == nil || !strings.Contains(err.Error(), "anyOf") {
+		t.Fatalf("expected 11 to match no branch, got %v", err)
+	}
+
+	schema, err = Compile([]byte(`{"oneOf": [{"type": "integer"}, {"type": "number"}]}`))
+	if err != nil {
+		t.Fatalf("compile failed: %v", err)
+	}
+	if err := schema.Validate([]byte(`1.5`)); err != nil {
+		t.Fatalf("expected 1.5 to match one branch: %v", err)
+	}
+	if err := schema.Validate([]byte(`1`)); err == nil {
+		t.Fatal("expected 1 to match both branches and fail")
+	}
+}
+
+func TestCompileRejectsInvalidSchemas(t *testing.T) {
+	for _, raw := range []string{
+		`[]`,
+		`{"type": "text"}`,
+		`{"properties": {"a": 1}}`,
+		`{"required": "a"}`,
+		`{"minItems": -1}`,
+		`{"anyOf": []}`,
+		`{"pattern": "("}`,
+	} {
+		if _, err := Compile([]byte(raw)); err == nil {
+			t.Fatalf("expected %s to be rejected", raw)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+// Package language names and recognizes the languages answers can be asked
+// in. Recognition needs no model: it goes by the script of the letters and,
+// for the languages written in Latin letters, by their most common words. It
+// only answers when it is confident, since it is used to decide whether an
+// answer must be asked again.
+package language
+
+import (
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// Language is a language by ISO 639-1 code and English name.
+type Language struct {
+	Code string
+	Name string
+}
+
+// Languages lists the languages Lookup and Detect know.
+var Languages = []Language{
+	{"ar", "Arabic"}, {"cs", "Czech"}, {"da", "Danish"}, {"de", "German"}, {"el", "Greek"},
+	{"en", "English"}, {"es", "Spanish"}, {"fi", "Finnish"}, {"fr", "French"}, {"he", "Hebrew"},
+	{"hi", "Hindi"}, {"hu", "Hungarian"}, {"id", "Indonesian"}, {"it", "Italian"}, {"ja", "Japanese"},
+	{"ko", "Korean"}, {"nl", "Dutch"}, {"no", "Norwegian"}, {"pl", "Polish"}, {"pt", "Portuguese"},
+	{"ro", "Romanian"}, {"ru", "Russian"}, {"sv", "Swedish"}, {"th", "Thai"}, {"tr", "Turkish"},
+	{"uk", "Ukrainian"}, {"vi", "Vietnamese"}, {"zh", "Chinese"},
+}
+
+// Lookup finds a language by code or English name, ignoring case. Region
+// subtags such as "pt-BR" are ignored.
+func Lookup(value string) (Language, bool) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if code, _, ok := strings.Cut(strings.ReplaceAll(value, "_", "-"), "-"); ok && len(code) == 2 {
+		value = code
+	}
+	for _, language := range Languages {
+		if value == language.Code || value == strings.ToLower(language.Name) {
+			return language, true
+		}
+	}
+	return Language{}, false
+}
+
+// minWordHits is how many common words of a language Latin text needs
+// before Detect trusts it.
+const minWordHits = 3
+
+// minLetters is the length below which Detect does not guess.
+const minLetters = 12
+
+// commonWords are the frequent short words that tell apart the languages
+// written in Latin letters.
+var commonWords = map[string][]string{
+	"en": {"the", "and", "is", "are", "of", "to", "in", "that", "it", "with", "for", "this", "you", "was", "be", "on", "not", "have", "as", "by"},
+	"de": {"der", "die", "das", "und", "ist", "nicht", "ein", "eine", "zu", "mit", "sich", "auf", "für", "von", "dem", "den", "ich", "sie", "es", "auch", "wird"},
+	"fr": {"le", "la", "les", "et", "est", "des", "une", "un", "pour", "dans", "que", "qui", "pas", "sur", "au", "du", "avec", "ce", "sont", "vous", "nous"},
+	"es": {"el", "la", "los", "las", "y", "es", "de", "que", "en", "un", "una", "por", "para", "con", "no", "se", "del", "al", "como", "pero", "está", "son"},
+	"it": {"il", "la", "gli", "le", "e", "è", "di", "che", "per", "un", "una", "non", "con", "sono", "del", "della", "anche", "come", "ma", "questo", "nel"},
+	"pt": {"o", "a", "os", "as", "e", "é", "de", "que", "um", "uma", "para", "com", "não", "do", "da", "em", "no", "na", "por", "são", "mais", "também"},
+	"nl": {"de", "het", "een", "en", "is", "van", "dat", "niet", "op", "te", "zijn", "met", "voor", "er", "ook", "maar", "die", "wordt", "je"},
+	"sv": {"och", "är", "att", "det", "som", "en", "ett", "på", "för", "med", "inte", "av", "till", "den", "har", "jag", "om", "men", "också"},
+	"da": {"og", "er", "at", "det", "som", "en", "et", "på", "for", "med", "ikke", "af", "til", "den", "har", "jeg", "de", "også", "men"},
+	"no": {"og", "er", "at", "det", "som", "en", "et", "på", "for", "med", "ikke", "av", "til", "den", "har", "jeg", "også", "men", "ikkje"},
+	"fi": {"ja", "on", "ei", "se", "että", "ovat", "oli", "mutta", "kun", "myös", "tämä", "hän", "niin", "kuin", "jos", "voi", "sen", "ole"},
+	"pl": {"i", "w", "nie", "na", "się", "jest", "to", "że", "z", "do", "jak", "co", "ale", "od", "po", "są", "dla", "tak", "być"},
+	"cs": {"a", "v", "je", "se", "na", "že", "to", "s", "z", "do", "jak", "ale", "jsou", "pro", "by", "od", "co", "také", "není"},
+	"tr": {"ve", "bir", "bu", "da", "de", "için", "ile", "çok", "ne", "olarak", "daha", "gibi", "var", "değil", "ama", "en", "mi", "olan"},
+	"ro": {"și", "în", "este", "de", "la", "cu", "pe", "că", "un", "o", "nu", "care", "sunt", "pentru", "mai", "din", "ce", "ale"},
+	"hu": {"a", "az", "és", "hogy", "nem", "egy", "is", "van", "meg", "de", "ez", "már", "csak", "mint", "ami", "volt", "vagy"},
+	"id": {"dan", "yang", "di", "ini", "itu", "dengan", "untuk", "tidak", "dari", "ada", "dalam", "akan", "adalah", "ke", "juga", "saya"},
+	"vi": {"của", "và", "là", "các", "những", "không", "được", "trong", "có", "một", "cho", "với", "này", "người", "đã"},
+}
+
+// ukrainianLetters are Cyrillic letters Russian does not use.
+const ukrainianLetters = "іїєґ"
+
+// notProse matches what is not prose in an answer: code and URLs.
+var notProse = regexp.MustCompile("(?s)```.*?(```|$)|`[^`\n]*`|https?://\\S+")
+
+// Detect returns the language text is written in. It reports false when
+// the text is too short or too mixed to tell.
+func Detect(text string) (Language, bool) {
+	text = notProse.ReplaceAllString(text, " ")
+	scripts := map[string]int{}
+	letters := 0
+	for _, r := range text {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		letters++
+		scripts[scriptOf(r)]++
+	}
+	// Japanese and Chinese share the Han letters; kana tell Japanese.
+	if kana := scripts["kana"]; kana > 0 && kana*10 >= scripts["han"] {
+		scripts["kana"] += scripts["han"]
+		scripts["han"] = 0
+	}
+	if letters < minLetters {
+		return Language{}, false
+	}
+	dominant, count := "", 0
+	for script, n := range scripts {
+		if n > count {
+			dominant, count = script, n
+		}
+	}
+	if count*2 <= letters {
+		return Language{}, false
+	}
+
+	code := map[string]string{
+		"han": "zh", "kana": "ja", "hangul": "ko", "greek": "el", "arabic": "ar",
+		"hebrew": "he", "devanagari": "hi", "thai": "th",
+	}[dominant]
+	switch dominant {
+	case "cyrillic":
+		code = "ru"
+		if strings.ContainsAny(strings.ToLower(text), ukrainianLetters) {
+			code = "uk"
+		}
+	case "latin":
+		code = detectLatin(text)
+	}
+	if code == "" {
+		return Language{}, false
+	}
+	language, _ := Lookup(code)
+	return language, true
+}
+
+// detectLatin picks the language whose common words text uses most, or ""
+// when no language clearly wins.
+func detectLatin(text string) string {
+	hits := map[string]int{}
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool { return !unicode.IsLetter(r) }) {
+		for code, words := range commonWords {
+			if slices.Contains(words, word) {
+				hits[code]++
+			}
+		}
+	}
+	best, bestHits, secondHits := "", 0, 0
+	for code, n := range hits {
+		switch {
+		case n > bestHits:
+			best, bestHits, secondHits = code, n, bestHits
+		case n > secondHits:
+			secondHits = n
+		}
+	}
+	if bestHits < minWordHits || bestHits*2 < secondHits*3 {
+		return ""
+	}
+	return best
+}
+
+func scriptOf(r rune) string {
+	switch {
+	case unicode.Is(unicode.Latin, r):
+		return "latin"
+	case unicode.Is(unicode.Cyrillic, r):
+		return "cyrillic"
+	case unicode.Is(unicode.Greek, r):
+		return "greek"
+	case unicode.Is(unicode.Arabic, r):
+		return "arabic"
+	case unicode.Is(unicode.Hebrew, r):
+		return "hebrew"
+	case unicode.Is(unicode.Devanagari, r):
+		return "devanagari"
+	case unicode.Is(unicode.Thai, r):
+		return "thai"
+	case unicode.Is(unicode.Hangul, r):
+		return "hangul"
+	case unicode.Is(unicode.Hiragana, r), unicode.Is(unicode.Katakana, r):
+		return "kana"
+	case unicode.Is(unicode.Han, r):
+		return "han"
+	}
+	return "other"
+}
@@ -0,0 +1,41 @@
+package language
+
+import "testing"
+
+func TestLookupAcceptsCodesAndNames(t *testing.T) {
+	for _, value := range []string{"de", "German", " GERMAN ", "de-AT", "de_CH"} {
+		if language, ok := Lookup(value); !ok || language.Code != "de" {
+			t.Fatalf("Lookup(%q) = %+v, %v", value, language, ok)
+		}
+	}
+	if _, ok := Lookup("klingon"); ok {
+		t.Fatal("expected an unknown language to be rejected")
+	}
+}
+
+func TestDetect(t *testing.T) {
+	tests := map[string]string{
+		"The answer is in the second chapter of the book, and it is short.":           "en",
+		"Die Antwort steht im zweiten Kapitel, und sie ist nicht sehr lang.":          "de",
+		"La réponse est dans le deuxième chapitre, et elle est pour vous.":            "fr",
+		"La respuesta está en el segundo capítulo y es para todos los lectores.":      "es",
+		"Ответ находится во второй главе книги, и он довольно короткий.":              "ru",
+		"Відповідь знаходиться в другому розділі книги, і вона досить коротка.":       "uk",
+		"答案在这本书的第二章，而且很短。我们可以一起读。":                                                    "zh",
+		"答えはこの本の第二章にあります。とても短いです。":                                                    "ja",
+		"답은 이 책의 두 번째 장에 있습니다. 아주 짧습니다.":                                              "ko",
+		"Η απάντηση βρίσκεται στο δεύτερο κεφάλαιο του βιβλίου.":                      "el",
+		"Die Antwort ist `the value of the field` und nicht https://example.com/the.": "de",
+	}
+	for text, want := range tests {
+		if got, ok := Detect(text); !ok || got.Code != want {
+			t.Errorf("Detect(%q) = %+v, %v; want %s", text, got, ok, want)
+		}
+	}
+
+	for _, text := range []string{"OK", "```go\nfmt.Println(\"the answer is in the code\")\n```", "42 + 17 = 59"} {
+		if got, ok := Detect(text); ok {
+			t.Errorf("expected no language for %q, got %+v", text, got)
+		}
+	}
+}
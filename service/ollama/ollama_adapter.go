@@ -0,0 +1,335 @@
+// Package ollama serves the Ollama API on top of the Gemini service, so
+// frontends that only speak Ollama can use the wrapper as a local model
+// server.
+package ollama
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"gemini-wrapper/model"
+	"gemini-wrapper/pkg/gemini"
+	"gemini-wrapper/service/geminiapi"
+)
+
+const defaultModel = "gemini-2.5-flash"
+
+// Asker is the part of the Gemini service the adapter needs.
+type Asker interface {
+	AskWithOptions(ctx context.Context, question string, opts model.AskOptions) (string, *model.GeminiStatus, error)
+	AskStreamWithOptions(ctx context.Context, question string, opts model.AskOptions, onChunk func(chunk string) error) (string, *model.GeminiStatus, error)
+}
+
+type GeminiAdapter struct {
+	geminiService Asker
+	modelAliases  gemini.ModelAliases
+}
+
+func NewGeminiAdapter(geminiService Asker) *GeminiAdapter {
+	return &GeminiAdapter{geminiService: geminiService}
+}
+
+// SetModelAliases replaces the aliases, model_aliases.ollama in the
+// configuration, given as alias to model. Aliases match regardless of case.
+func (a *GeminiAdapter) SetModelAliases(aliases map[string]string) {
+	a.modelAliases.Set(aliases)
+}
+
+// ListModels lists the supported Gemini models as installed models. They
+// have no size or digest of their own, so the digest is derived from the
+// name.
+func (a *GeminiAdapter) ListModels() model.OllamaTagsResponse {
+	now := time.Now().UTC().Format(time.RFC3339)
+	names := gemini.SupportedModels()
+	models := make([]model.OllamaModel, 0, len(names))
+	for _, name := range names {
+		digest := sha256.Sum256([]byte(name))
+		models = append(models, model.OllamaModel{
+			Name:       name + ":latest",
+			Model:      name + ":latest",
+			ModifiedAt: now,
+			Digest:     hex.EncodeToString(digest[:]),
+			Details:    model.OllamaModelDetails{Format: "gemini", Family: "gemini", Families: []string{"gemini"}},
+		})
+	}
+	return model.OllamaTagsResponse{Models: models}
+}
+
+func (a *GeminiAdapter) Generate(ctx context.Context, req model.OllamaGenerateRequest) (model.OllamaGenerateResponse, error) {
+	var final model.OllamaGenerateResponse
+	err := a.generate(ctx, req, false, func(resp model.OllamaGenerateResponse) error {
+		final = resp
+		return nil
+	})
+	return final, err
+}
+
+// GenerateStream calls onChunk with each piece of the answer and finally
+// with the done response. Errors before the first chunk are returned
+// without calling onChunk.
+func (a *GeminiAdapter) GenerateStream(ctx context.Context, req model.OllamaGenerateRequest, onChunk func(model.OllamaGenerateResponse) error) error {
+	return a.generate(ctx, req, true, onChunk)
+}
+
+func (a *GeminiAdapter) generate(ctx context.Context, req model.OllamaGenerateRequest, stream bool, onChunk func(model.OllamaGenerateResponse) error) error {
+	modelName := a.resolveModel(req.Model)
+	// Ollama clients send an empty prompt to load a model before use.
+	if strings.TrimSpace(req.Prompt) == "" && len(req.Images) == 0 {
+		return onChunk(model.OllamaGenerateResponse{Model: req.Model, CreatedAt: createdAt(), Done: true, DoneReason: "load"})
+	}
+
+	user := model.GeminiContent{Role: "user", Parts: []model.GeminiPart{{Text: req.Prompt}}}
+	images, err := imageParts(req.Images)
+	if err != nil {
+		return err
+	}
+	user.Parts = append(user.Parts, images...)
+	geminiReq := model.GeminiAPIRequest{Contents: []model.GeminiContent{user}}
+	if strings.TrimSpace(req.System) != "" {
+		geminiReq.SystemInstruction = &model.GeminiContent{Parts: []model.GeminiPart{{Text: req.System}}}
+	}
+
+	return a.ask(ctx, geminiReq, modelName, req.Format, req.Options, stream, func(text string, done *doneInfo) error {
+		resp := model.OllamaGenerateResponse{Model: req.Model, CreatedAt: createdAt(), Response: text}
+		if done != nil {
+			resp.Done, resp.DoneReason, resp.OllamaMetrics = true, done.reason, done.metrics
+		}
+		return onChunk(resp)
+	})
+}
+
+func (a *GeminiAdapter) Chat(ctx context.Context, req model.OllamaChatRequest) (model.OllamaChatResponse, error) {
+	var final model.OllamaChatResponse
+	err := a.chat(ctx, req, false, func(resp model.OllamaChatResponse) error {
+		final = resp
+		return nil
+	})
+	return final, err
+}
+
+// ChatStream calls onChunk with each piece of the answer and finally with
+// the done response. Errors before the first chunk are returned without
+// calling onChunk.
+func (a *GeminiAdapter) ChatStream(ctx context.Context, req model.OllamaChatRequest, onChunk func(model.OllamaChatResponse) error) error {
+	return a.chat(ctx, req, true, onChunk)
+}
+
+func (a *GeminiAdapter) chat(ctx context.Context, req model.OllamaChatRequest, stream bool, onChunk func(model.OllamaChatResponse) error) error {
+	modelName := a.resolveModel(req.Model)
+	if len(req.Tools) > 0 {
+		return &APIError{HTTPStatus: 400, Message: "tools are not supported"}
+	}
+	// As with /api/generate, an empty conversation loads the model.
+	if len(req.Messages) == 0 {
+		return onChunk(model.OllamaChatResponse{Model: req.Model, CreatedAt: createdAt(), Message: model.OllamaChatMessage{Role: "assistant"}, Done: true, DoneReason: "load"})
+	}
+
+	var geminiReq model.GeminiAPIRequest
+	for i, message := range req.Messages {
+		parts := []model.GeminiPart{{Text: message.Content}}
+		images, err := imageParts(message.Images)
+		if err != nil {
+			return err
+		}
+		parts = append(parts, images...)
+		switch message.Role {
+		case "system":
+			if geminiReq.SystemInstruction == nil {
+				geminiReq.SystemInstruction = &model.GeminiContent{}
+			}
+			geminiReq.SystemInstruction.Parts = append(geminiReq.SystemInstruction.Parts, parts...)
+		case "user":
+			geminiReq.Contents = append(geminiReq.Contents, model.GeminiContent{Role: "user", Parts: parts})
+		case "assistant":
+			geminiReq.Contents = append(geminiReq.Contents, model.GeminiContent{Role: "model", Parts: parts})
+		default:
+			return &APIError{HTTPStatus: 400, Message: fmt.Sprintf("messages[%d]: role %q is not supported", i, message.Role)}
+		}
+	}
+	if len(geminiReq.Contents) == 0 {
+		return &APIError{HTTPStatus: 400, Message: "messages must contain a user message"}
+	}
+
+	return a.ask(ctx, geminiReq, modelName, req.Format, req.Options, stream, func(text string, done *doneInfo) error {
+		resp := model.OllamaChatResponse{Model: req.Model, CreatedAt: createdAt(), Message: model.OllamaChatMessage{Role: "assistant", Content: text}}
+		if done != nil {
+			resp.Done, resp.DoneReason, resp.OllamaMetrics = true, done.reason, done.metrics
+		}
+		return onChunk(resp)
+	})
+}
+
+// doneInfo is what the final response of a generation adds to its text.
+type doneInfo struct {
+	reason  string
+	metrics model.OllamaMetrics
+}
+
+// ask renders geminiReq as a CLI prompt and asks it. emit is called with
+// each chunk of a stream, then with the done response; without stream it
+// is called once, with the whole answer and the done information.
+func (a *GeminiAdapter) ask(ctx context.Context, geminiReq model.GeminiAPIRequest, modelName string, format json.RawMessage, options *model.OllamaOptions, stream bool, emit func(text string, done *doneInfo) error) error {
+	if a.geminiService == nil {
+		return &APIError{HTTPStatus: 500, Message: "Gemini backend is not initialized"}
+	}
+	if err := applyFormat(&geminiReq, format); err != nil {
+		return err
+	}
+	question, err := geminiapi.BuildPrompt(geminiReq)
+	if err != nil {
+		return &APIError{HTTPStatus: 400, Message: err.Error()}
+	}
+	attachments, err := geminiapi.Attachments(ctx, geminiReq, nil)
+	if err != nil {
+		return &APIError{HTTPStatus: 400, Message: err.Error()}
+	}
+	opts := model.AskOptions{Model: modelName, Attachments: attachments}
+	if options != nil {
+		opts.GenerationConfig = &model.GenerationConfig{
+			Temperature:     options.Temperature,
+			TopP:            options.TopP,
+			TopK:            options.TopK,
+			MaxOutputTokens: options.NumPredict,
+			StopSequences:   options.Stop,
+		}
+	}
+
+	started := time.Now()
+	var answer string
+	var status *model.GeminiStatus
+	if stream {
+		answer, status, err = a.geminiService.AskStreamWithOptions(ctx, question, opts, func(chunk string) error {
+			return emit(chunk, nil)
+		})
+	} else {
+		answer, status, err = a.geminiService.AskWithOptions(ctx, question, opts)
+	}
+	if err != nil {
+		return convertGeminiError(err, status)
+	}
+
+	done := &doneInfo{reason: "stop", metrics: buildMetrics(question, answer, status, time.Since(started))}
+	if status != nil && status.FinishReason == "MAX_TOKENS" {
+		done.reason = "length"
+	}
+	if stream {
+		answer = ""
+	}
+	return emit(answer, done)
+}
+
+// applyFormat asks for a JSON answer when format is "json" or a JSON
+// schema. The CLI has no structured output, so this is an instruction.
+func applyFormat(geminiReq *model.GeminiAPIRequest, format json.RawMessage) error {
+	format = bytes.TrimSpace(format)
+	if len(format) == 0 || bytes.Equal(format, []byte("null")) || bytes.Equal(format, []byte(`""`)) {
+		return nil
+	}
+	instruction := ""
+	if bytes.Equal(format, []byte(`"json"`)) {
+		instruction = "Respond only with valid JSON."
+	} else if format[0] == '{' {
+		instruction = "Respond only with valid JSON that matches this JSON schema: " + string(format)
+	} else {
+		return &APIError{HTTPStatus: 400, Message: `format must be "json" or a JSON schema`}
+	}
+	if geminiReq.SystemInstruction == nil {
+		geminiReq.SystemInstruction = &model.GeminiContent{}
+	}
+	geminiReq.SystemInstruction.Parts = append(geminiReq.SystemInstruction.Parts, model.GeminiPart{Text: instruction})
+	return nil
+}
+
+// imageParts turns base64 images, which Ollama sends without a media type,
+// into inline data parts. Data URLs are accepted too.
+func imageParts(images []string) ([]model.GeminiPart, error) {
+	parts := make([]model.GeminiPart, 0, len(images))
+	for i, image := range images {
+		mimeType := ""
+		if rest, ok := strings.CutPrefix(image, "data:"); ok {
+			header, data, found := strings.Cut(rest, ",")
+			if !found || !strings.HasSuffix(header, ";base64") {
+				return nil, &APIError{HTTPStatus: 400, Message: fmt.Sprintf("images[%d]: data URLs must be base64", i)}
+			}
+			mimeType, image = strings.TrimSuffix(header, ";base64"), data
+		}
+		if mimeType == "" {
+			data, err := base64.StdEncoding.DecodeString(image)
+			if err != nil {
+				return nil, &APIError{HTTPStatus: 400, Message: fmt.Sprintf("images[%d]: not valid base64", i)}
+			}
+			mimeType = http.DetectContentType(data)
+			mimeType, _, _ = strings.Cut(mimeType, ";")
+		}
+		parts = append(parts, model.GeminiPart{InlineData: &model.Blob{MimeType: mimeType, Data: image}})
+	}
+	return parts, nil
+}
+
+// resolveModel applies OLLAMA_MODEL_ALIASES and drops the tag Ollama
+// clients add to model names, such as ":latest".
+func (a *GeminiAdapter) resolveModel(requested string) string {
+	requested = strings.TrimSpace(requested)
+	if alias, ok := a.modelAliases.Lookup(requested); ok {
+		return alias
+	}
+	name, _, _ := strings.Cut(requested, ":")
+	if alias, ok := a.modelAliases.Lookup(name); ok {
+		return alias
+	}
+	if name == "" {
+		return defaultModel
+	}
+	return name
+}
+
+func createdAt() string {
+	return time.Now().UTC().Format(time.RFC3339Nano)
+}
+
+// buildMetrics reports the token counts from the CLI stats when available
+// and falls back to a local estimate otherwise. The whole call counts as
+// evaluation time.
+func buildMetrics(prompt string, answer string, status *model.GeminiStatus, elapsed time.Duration) model.OllamaMetrics {
+	metrics := model.OllamaMetrics{
+		TotalDuration:   elapsed.Nanoseconds(),
+		PromptEvalCount: gemini.EstimateTokens(prompt),
+		EvalCount:       gemini.EstimateTokens(answer),
+		EvalDuration:    elapsed.Nanoseconds(),
+	}
+	if status != nil && status.Usage != nil {
+		metrics.PromptEvalCount = status.Usage.PromptTokenCount
+		metrics.EvalCount = status.Usage.CandidatesTokenCount
+	}
+	return metrics
+}
+
+func convertGeminiError(err error, status *model.GeminiStatus) error {
+	if err == nil {
+		return nil
+	}
+
+	httpStatus := 500
+	if status != nil && status.HTTPStatus > 0 {
+		httpStatus = status.HTTPStatus
+	}
+	slog.Warn("ollama adapter upstream error", "status", httpStatus, "error", err)
+
+	message := "upstream processing error"
+	if httpStatus >= 500 {
+		message = "an internal service error occurred"
+	}
+	if local, ok := gemini.LocalRejection(status); ok {
+		message = local
+	}
+	return &APIError{HTTPStatus: httpStatus, Message: message}
+}
@@ -0,0 +1,179 @@
+package ollama
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"gemini-wrapper/model"
+)
+
+type fakeAsker struct {
+	answer   string
+	status   *model.GeminiStatus
+	err      error
+	question string
+	opts     model.AskOptions
+}
+
+func (f *fakeAsker) AskWithOptions(_ context.Context, question string, opts model.AskOptions) (string, *model.GeminiStatus, error) {
+	f.question, f.opts = question, opts
+	if f.err != nil {
+		return "", f.status, f.err
+	}
+	return f.answer, f.status, nil
+}
+
+func (f *fakeAsker) AskStreamWithOptions(ctx context.Context, question string, opts model.AskOptions, onChunk func(chunk string) error) (string, *model.GeminiStatus, error) {
+	answer, status, err := f.AskWithOptions(ctx, question, opts)
+	if err != nil {
+		return "", status, err
+	}
+	for _, line := range strings.SplitAfter(answer, "\n") {
+		if err := onChunk(line); err != nil {
+			return "", status, err
+		}
+	}
+	return answer, status, nil
+}
+
+func TestGenerateAnswersWithOptions(t *testing.T) {
+	svc := &fakeAsker{answer: "hello"}
+	temperature := 0.2
+	resp, err := NewGeminiAdapter(svc).Generate(context.Background(), model.OllamaGenerateRequest{
+		Model:   "gemini-2.5-pro:latest",
+		Prompt:  "say hi",
+		System:  "Be brief.",
+		Options: &model.OllamaOptions{Temperature: &temperature, NumPredict: 64},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !resp.Done || resp.DoneReason != "stop" || resp.Response != "hello" || resp.Model != "gemini-2.5-pro:latest" {
+		t.Fatalf("unexpected response: %+v", resp)
+	}
+	if resp.EvalCount == 0 || resp.TotalDuration == 0 {
+		t.Fatalf("expected metrics, got %+v", resp.OllamaMetrics)
+	}
+	if svc.opts.Model != "gemini-2.5-pro" {
+		t.Fatalf("expected the tag to be dropped, got %q", svc.opts.Model)
+	}
+	if svc.opts.GenerationConfig == nil || svc.opts.GenerationConfig.MaxOutputTokens != 64 || *svc.opts.GenerationConfig.Temperature != 0.2 {
+		t.Fatalf("unexpected generation config: %+v", svc.opts.GenerationConfig)
+	}
+	if !strings.Contains(svc.question, "Be brief.") || !strings.Contains(svc.question, "say hi") {
+		t.Fatalf("unexpected prompt: %q", svc.question)
+	}
+}
+
+func TestGenerateWithEmptyPromptLoadsModel(t *testing.T) {
+	svc := &fakeAsker{answer: "unused"}
+	resp, err := NewGeminiAdapter(svc).Generate(context.Background(), model.OllamaGenerateRequest{Model: "gemini-2.5-flash"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !resp.Done || resp.DoneReason != "load" || svc.question != "" {
+		t.Fatalf("expected a load response without asking, got %+v", resp)
+	}
+}
+
+func TestGenerateDetectsImageTypes(t *testing.T) {
+	svc := &fakeAsker{answer: "a pixel"}
+	png := "iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAQAAAC1HAwCAAAAC0lEQVR42mNkYAAAAAYAAjCB0C8AAAAASUVORK5CYII="
+	_, err := NewGeminiAdapter(svc).Generate(context.Background(), model.OllamaGenerateRequest{Prompt: "what is this?", Images: []string{png}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(svc.opts.Attachments) != 1 || svc.opts.Attachments[0].MimeType != "image/png" {
+		t.Fatalf("expected a png attachment, got %+v", svc.opts.Attachments)
+	}
+}
+
+func TestChatStreamEmitsChunksThenDone(t *testing.T) {
+	svc := &fakeAsker{answer: "one\ntwo", status: &model.GeminiStatus{FinishReason: "MAX_TOKENS"}}
+	var chunks []model.OllamaChatResponse
+	err := NewGeminiAdapter(svc).ChatStream(context.Background(), model.OllamaChatRequest{
+		Model: "gemini-2.5-flash",
+		Messages: []model.OllamaChatMessage{
+			{Role: "system", Content: "Be brief."},
+			{Role: "user", Content: "count"},
+			{Role: "assistant", Content: "ok"},
+			{Role: "user", Content: "again"},
+		},
+	}, func(resp model.OllamaChatResponse) error {
+		chunks = append(chunks, resp)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(chunks) != 3 || chunks[0].Message.Content != "one\n" || chunks[1].Message.Content != "two" || chunks[0].Done {
+		t.Fatalf("unexpected chunks: %+v", chunks)
+	}
+	last := chunks[2]
+	if !last.Done || last.DoneReason != "length" || last.Message.Content != "" || last.Message.Role != "assistant" {
+		t.Fatalf("unexpected final chunk: %+v", last)
+	}
+}
+
+func TestChatRejectsInvalidRequests(t *testing.T) {
+	cases := map[string]model.OllamaChatRequest{
+		"tools":     {Messages: []model.OllamaChatMessage{{Role: "user", Content: "hi"}}, Tools: []json.RawMessage{json.RawMessage(`{}`)}},
+		"role":      {Messages: []model.OllamaChatMessage{{Role: "tool", Content: "42"}}},
+		"no user":   {Messages: []model.OllamaChatMessage{{Role: "system", Content: "Be brief."}}},
+		"format":    {Messages: []model.OllamaChatMessage{{Role: "user", Content: "hi"}}, Format: json.RawMessage(`"yaml"`)},
+		"bad image": {Messages: []model.OllamaChatMessage{{Role: "user", Content: "hi", Images: []string{"%%%"}}}},
+	}
+	for name, req := range cases {
+		t.Run(name, func(t *testing.T) {
+			svc := &fakeAsker{answer: "unused"}
+			_, err := NewGeminiAdapter(svc).Chat(context.Background(), req)
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) || apiErr.HTTPStatus != 400 {
+				t.Fatalf("expected a 400, got %v", err)
+			}
+			if svc.question != "" {
+				t.Fatalf("expected no call to Gemini, got %q", svc.question)
+			}
+		})
+	}
+}
+
+func TestChatAsksForJSONFormat(t *testing.T) {
+	svc := &fakeAsker{answer: "{}"}
+	_, err := NewGeminiAdapter(svc).Chat(context.Background(), model.OllamaChatRequest{
+		Messages: []model.OllamaChatMessage{{Role: "user", Content: "list colors"}},
+		Format:   json.RawMessage(`{"type":"object"}`),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(svc.question, `{"type":"object"}`) {
+		t.Fatalf("expected the schema in the prompt, got %q", svc.question)
+	}
+}
+
+func TestResolveModelUsesAliasesAndDropsTags(t *testing.T) {
+	adapter := NewGeminiAdapter(&fakeAsker{})
+	adapter.SetModelAliases(map[string]string{"llama3": "gemini-2.5-pro"})
+	cases := map[string]string{
+		"":                        defaultModel,
+		"llama3":                  "gemini-2.5-pro",
+		"llama3:8b":               "gemini-2.5-pro",
+		"gemini-2.5-flash:latest": "gemini-2.5-flash",
+	}
+	for requested, want := range cases {
+		if got := adapter.resolveModel(requested); got != want {
+			t.Fatalf("resolveModel(%q) = %q, want %q", requested, got, want)
+		}
+	}
+}
+
+func TestListModelsTagsSupportedModels(t *testing.T) {
+	resp := NewGeminiAdapter(&fakeAsker{}).ListModels()
+	if len(resp.Models) == 0 || !strings.HasSuffix(resp.Models[0].Name, ":latest") || resp.Models[0].Digest == "" {
+		t.Fatalf("unexpected models: %+v", resp.Models)
+	}
+}
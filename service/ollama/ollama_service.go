@@ -0,0 +1,28 @@
+package ollama
+
+import (
+	"context"
+
+	"gemini-wrapper/model"
+)
+
+type Service interface {
+	ListModels() model.OllamaTagsResponse
+	Generate(ctx context.Context, req model.OllamaGenerateRequest) (model.OllamaGenerateResponse, error)
+	GenerateStream(ctx context.Context, req model.OllamaGenerateRequest, onChunk func(model.OllamaGenerateResponse) error) error
+	Chat(ctx context.Context, req model.OllamaChatRequest) (model.OllamaChatResponse, error)
+	ChatStream(ctx context.Context, req model.OllamaChatRequest, onChunk func(model.OllamaChatResponse) error) error
+}
+
+// APIError is an error to answer with; Ollama reports only a message.
+type APIError struct {
+	HTTPStatus int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	if e == nil {
+		return ""
+	}
+	return e.Message
+}
@@ -1,59 +1,57 @@
 package openai
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"log/slog"
 	"strings"
 	"time"
 
 	"gemini-wrapper/model"
-	"gemini-wrapper/service/gemini"
+	"gemini-wrapper/pkg/gemini"
 )
 
+const defaultModel = "gemini-2.5-flash"
+
 type GeminiAdapter struct {
-	geminiService gemini.GeminiService
+	geminiService gemini.Asker
+	modelAliases  gemini.ModelAliases
 }
 
-func NewGeminiAdapter(geminiService gemini.GeminiService) *GeminiAdapter {
+func NewGeminiAdapter(geminiService gemini.Asker) *GeminiAdapter {
 	return &GeminiAdapter{geminiService: geminiService}
 }
 
+// SetModelAliases replaces the aliases, model_aliases.openai in the
+// configuration, given as alias to model. Aliases match regardless of case.
+func (a *GeminiAdapter) SetModelAliases(aliases map[string]string) {
+	a.modelAliases.Set(aliases)
+}
+
 func (a *GeminiAdapter) ListModels() model.OpenAIModelListResponse {
 	now := time.Now().Unix()
+	names := gemini.SupportedModels()
+	data := make([]model.OpenAIModel, 0, len(names))
+	for _, name := range names {
+		data = append(data, model.OpenAIModel{ID: name, Object: "model", Created: now, OwnedBy: "google"})
+	}
 	return model.OpenAIModelListResponse{
 		Object: "list",
-		Data: []model.OpenAIModel{
-			{ID: "gemini-2.5-flash", Object: "model", Created: now, OwnedBy: "google"},
-			{ID: "gemini-2.5-flash-lite", Object: "model", Created: now, OwnedBy: "google"},
-			{ID: "gemini-2.5-pro", Object: "model", Created: now, OwnedBy: "google"},
-		},
+		Data:   data,
 	}
 }
 
-func (a *GeminiAdapter) CreateChatCompletion(req model.OpenAIChatCompletionRequest) (model.OpenAIChatCompletionResponse, error) {
-	if a.geminiService == nil {
-		return model.OpenAIChatCompletionResponse{}, &APIError{HTTPStatus: 500, Type: "server_error", Code: "backend_unavailable", Message: "Gemini backend is not initialized"}
-	}
-	if len(req.Messages) == 0 {
-		return model.OpenAIChatCompletionResponse{}, &APIError{HTTPStatus: 400, Type: "invalid_request_error", Code: "messages_required", Message: "messages is required"}
+func (a *GeminiAdapter) CreateChatCompletion(ctx context.Context, req model.OpenAIChatCompletionRequest) (model.OpenAIChatCompletionResponse, error) {
+	if err := a.validateChatCompletion(req); err != nil {
+		return model.OpenAIChatCompletionResponse{}, err
 	}
 	if req.Stream {
 		return model.OpenAIChatCompletionResponse{}, &APIError{HTTPStatus: 400, Type: "invalid_request_error", Code: "stream_not_supported", Message: "stream=true is not supported"}
 	}
-	if req.N < 0 {
-		return model.OpenAIChatCompletionResponse{}, &APIError{HTTPStatus: 400, Type: "invalid_request_error", Code: "n_not_supported", Message: "n<0 is not supported"}
-	}
-	if req.N > 1 {
-		return model.OpenAIChatCompletionResponse{}, &APIError{HTTPStatus: 400, Type: "invalid_request_error", Code: "n_not_supported", Message: "n>1 is not supported"}
-	}
-
-	modelName := req.Model
-	if modelName == "" {
-		modelName = "gemini-2.5-flash"
-	}
 
+	modelName := a.resolveModel(req.Model)
 	prompt := buildPromptFromMessages(req.Messages)
-	answer, status, err := a.geminiService.Ask(prompt, modelName)
+	answer, status, err := a.geminiService.Ask(ctx, prompt, modelName)
 	if err != nil {
 		return model.OpenAIChatCompletionResponse{}, convertGeminiError(err, status)
 	}
@@ -63,8 +61,7 @@ func (a *GeminiAdapter) CreateChatCompletion(req model.OpenAIChatCompletionReque
 	}
 
 	now := time.Now().Unix()
-	promptTokens := estimateTokens(prompt)
-	completionTokens := estimateTokens(answer)
+	usage := buildUsage(prompt, answer, status)
 
 	return model.OpenAIChatCompletionResponse{
 		ID:      fmt.Sprintf("chatcmpl-%d", now),
@@ -81,15 +78,83 @@ func (a *GeminiAdapter) CreateChatCompletion(req model.OpenAIChatCompletionReque
 				FinishReason: "stop",
 			},
 		},
-		Usage: model.OpenAIUsage{
-			PromptTokens:     promptTokens,
-			CompletionTokens: completionTokens,
-			TotalTokens:      promptTokens + completionTokens,
-		},
+		Usage: usage,
 	}, nil
 }
 
-func (a *GeminiAdapter) CreateCompletion(req model.OpenAICompletionRequest) (model.OpenAICompletionResponse, error) {
+// CreateChatCompletionStream emits chat.completion.chunk objects as Gemini
+// produces the answer. Validation and upstream errors that occur before the
+// first chunk are returned so the caller can still reply with a JSON error.
+func (a *GeminiAdapter) CreateChatCompletionStream(ctx context.Context, req model.OpenAIChatCompletionRequest, onChunk func(model.OpenAIChatCompletionChunk) error) error {
+	if err := a.validateChatCompletion(req); err != nil {
+		return err
+	}
+
+	// The model that answers is only known once the stream ends, so every
+	// chunk names the model asked for.
+	modelName := a.resolveModel(req.Model)
+	now := time.Now().Unix()
+	id := fmt.Sprintf("chatcmpl-%d", time.Now().UnixNano())
+	chunk := func(delta model.OpenAIChatMessageDelta, finishReason *string) model.OpenAIChatCompletionChunk {
+		return model.OpenAIChatCompletionChunk{
+			ID:      id,
+			Object:  "chat.completion.chunk",
+			Created: now,
+			Model:   modelName,
+			Choices: []model.OpenAIChatCompletionChunkChoice{
+				{Index: 0, Delta: delta, FinishReason: finishReason},
+			},
+		}
+	}
+
+	started := false
+	prompt := buildPromptFromMessages(req.Messages)
+	_, status, err := a.geminiService.AskStream(ctx, prompt, modelName, func(text string) error {
+		if !started {
+			started = true
+			if err := onChunk(chunk(model.OpenAIChatMessageDelta{Role: "assistant"}, nil)); err != nil {
+				return err
+			}
+		}
+		return onChunk(chunk(model.OpenAIChatMessageDelta{Content: text}, nil))
+	})
+	if err != nil {
+		return convertGeminiError(err, status)
+	}
+
+	finishReason := "stop"
+	return onChunk(chunk(model.OpenAIChatMessageDelta{}, &finishReason))
+}
+
+func (a *GeminiAdapter) validateChatCompletion(req model.OpenAIChatCompletionRequest) error {
+	if a.geminiService == nil {
+		return &APIError{HTTPStatus: 500, Type: "server_error", Code: "backend_unavailable", Message: "Gemini backend is not initialized"}
+	}
+	if len(req.Messages) == 0 {
+		return &APIError{HTTPStatus: 400, Type: "invalid_request_error", Code: "messages_required", Message: "messages is required"}
+	}
+	if req.N < 0 {
+		return &APIError{HTTPStatus: 400, Type: "invalid_request_error", Code: "n_not_supported", Message: "n<0 is not supported"}
+	}
+	if req.N > 1 {
+		return &APIError{HTTPStatus: 400, Type: "invalid_request_error", Code: "n_not_supported", Message: "n>1 is not supported"}
+	}
+	return nil
+}
+
+// resolveModel applies OPENAI_MODEL_ALIASES and the default model.
+func (a *GeminiAdapter) resolveModel(requested string) string {
+	requested = strings.TrimSpace(requested)
+	if alias, ok := a.modelAliases.Lookup(requested); ok {
+		return alias
+	}
+	if requested == "" {
+		return defaultModel
+	}
+	return requested
+}
+
+func (a *GeminiAdapter) CreateCompletion(ctx context.Context, req model.OpenAICompletionRequest) (model.OpenAICompletionResponse, error) {
 	if a.geminiService == nil {
 		return model.OpenAICompletionResponse{}, &APIError{HTTPStatus: 500, Type: "server_error", Code: "backend_unavailable", Message: "Gemini backend is not initialized"}
 	}
@@ -108,12 +173,9 @@ func (a *GeminiAdapter) CreateCompletion(req model.OpenAICompletionRequest) (mod
 		return model.OpenAICompletionResponse{}, &APIError{HTTPStatus: 400, Type: "invalid_request_error", Code: "prompt_invalid", Message: err.Error()}
 	}
 
-	modelName := req.Model
-	if modelName == "" {
-		modelName = "gemini-2.5-flash"
-	}
+	modelName := a.resolveModel(req.Model)
 
-	answer, status, askErr := a.geminiService.Ask(prompt, modelName)
+	answer, status, askErr := a.geminiService.Ask(ctx, prompt, modelName)
 	if askErr != nil {
 		return model.OpenAICompletionResponse{}, convertGeminiError(askErr, status)
 	}
@@ -123,8 +185,7 @@ func (a *GeminiAdapter) CreateCompletion(req model.OpenAICompletionRequest) (mod
 	}
 
 	now := time.Now().Unix()
-	promptTokens := estimateTokens(prompt)
-	completionTokens := estimateTokens(answer)
+	usage := buildUsage(prompt, answer, status)
 
 	return model.OpenAICompletionResponse{
 		ID:      fmt.Sprintf("cmpl-%d", now),
@@ -139,15 +200,11 @@ func (a *GeminiAdapter) CreateCompletion(req model.OpenAICompletionRequest) (mod
 				FinishReason: "stop",
 			},
 		},
-		Usage: model.OpenAIUsage{
-			PromptTokens:     promptTokens,
-			CompletionTokens: completionTokens,
-			TotalTokens:      promptTokens + completionTokens,
-		},
+		Usage: usage,
 	}, nil
 }
 
-func (a *GeminiAdapter) CreateResponse(req model.OpenAIResponseRequest) (model.OpenAIResponse, error) {
+func (a *GeminiAdapter) CreateResponse(ctx context.Context, req model.OpenAIResponseRequest) (model.OpenAIResponse, error) {
 	if a.geminiService == nil {
 		return model.OpenAIResponse{}, &APIError{HTTPStatus: 500, Type: "server_error", Code: "backend_unavailable", Message: "Gemini backend is not initialized"}
 	}
@@ -160,12 +217,9 @@ func (a *GeminiAdapter) CreateResponse(req model.OpenAIResponseRequest) (model.O
 		prompt = strings.TrimSpace(req.Instructions) + "\n\n" + prompt
 	}
 
-	modelName := req.Model
-	if modelName == "" {
-		modelName = "gemini-2.5-flash"
-	}
+	modelName := a.resolveModel(req.Model)
 
-	answer, status, askErr := a.geminiService.Ask(prompt, modelName)
+	answer, status, askErr := a.geminiService.Ask(ctx, prompt, modelName)
 	if askErr != nil {
 		return model.OpenAIResponse{}, convertGeminiError(askErr, status)
 	}
@@ -176,8 +230,7 @@ func (a *GeminiAdapter) CreateResponse(req model.OpenAIResponseRequest) (model.O
 
 	now := time.Now().Unix()
 	responseID := fmt.Sprintf("resp-%d", time.Now().UnixNano())
-	promptTokens := estimateTokens(prompt)
-	completionTokens := estimateTokens(answer)
+	usage := buildUsage(prompt, answer, status)
 
 	return model.OpenAIResponse{
 		ID:        responseID,
@@ -195,26 +248,32 @@ func (a *GeminiAdapter) CreateResponse(req model.OpenAIResponseRequest) (model.O
 			},
 		},
 		OutputText: answer,
-		Usage: model.OpenAIUsage{
-			PromptTokens:     promptTokens,
-			CompletionTokens: completionTokens,
-			TotalTokens:      promptTokens + completionTokens,
-		},
+		Usage:      usage,
 	}, nil
 }
 
 func buildPromptFromMessages(messages []model.OpenAIChatMessage) string {
 	parts := make([]string, 0, len(messages))
 	for _, m := range messages {
-		role := strings.TrimSpace(m.Role)
-		if role == "" {
-			role = "user"
-		}
-		parts = append(parts, fmt.Sprintf("%s: %s", role, strings.TrimSpace(m.Content)))
+		parts = append(parts, fmt.Sprintf("%s: %s", normalizeChatRole(m.Role), strings.TrimSpace(m.Content)))
 	}
 	return strings.Join(parts, "\n")
 }
 
+// normalizeChatRole maps OpenAI and Gemini role names onto system/user/assistant/tool.
+func normalizeChatRole(role string) string {
+	switch strings.ToLower(strings.TrimSpace(role)) {
+	case "system", "developer":
+		return "system"
+	case "assistant", "model":
+		return "assistant"
+	case "tool", "function":
+		return "tool"
+	default:
+		return "user"
+	}
+}
+
 func normalizePrompt(raw interface{}) (string, error) {
 	switch v := raw.(type) {
 	case string:
@@ -347,12 +406,15 @@ func convertGeminiError(err error, status *model.GeminiStatus) error {
 		}
 	}
 
-	log.Printf("openai adapter upstream error: status=%d type=%s code=%s err=%v", httpStatus, errType, errCode, err)
+	slog.Warn("openai adapter upstream error", "status", httpStatus, "type", errType, "code", errCode, "error", err)
 
 	message := "Upstream processing error"
 	if httpStatus >= 500 {
 		message = "An internal service error occurred"
 	}
+	if local, ok := gemini.LocalRejection(status); ok {
+		message = local
+	}
 
 	return &APIError{
 		HTTPStatus: httpStatus,
@@ -362,10 +424,21 @@ func convertGeminiError(err error, status *model.GeminiStatus) error {
 	}
 }
 
-func estimateTokens(text string) int {
-	trimmed := strings.TrimSpace(text)
-	if trimmed == "" {
-		return 0
+// buildUsage reports the token counts from the CLI stats when available and
+// falls back to a local estimate otherwise.
+func buildUsage(prompt string, answer string, status *model.GeminiStatus) model.OpenAIUsage {
+	if status != nil && status.Usage != nil {
+		return model.OpenAIUsage{
+			PromptTokens:     status.Usage.PromptTokenCount,
+			CompletionTokens: status.Usage.CandidatesTokenCount,
+			TotalTokens:      status.Usage.TotalTokenCount,
+		}
+	}
+	promptTokens := gemini.EstimateTokens(prompt)
+	completionTokens := gemini.EstimateTokens(answer)
+	return model.OpenAIUsage{
+		PromptTokens:     promptTokens,
+		CompletionTokens: completionTokens,
+		TotalTokens:      promptTokens + completionTokens,
 	}
-	return (len([]rune(trimmed)) + 3) / 4
 }
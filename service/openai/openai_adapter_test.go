@@ -1,6 +1,7 @@
 package openai
 
 import (
+	"context"
 	"errors"
 	"strings"
 	"testing"
@@ -14,7 +15,7 @@ type fakeGeminiService struct {
 	status *model.GeminiStatus
 }
 
-func (f *fakeGeminiService) Ask(_ string, modelName string) (string, *model.GeminiStatus, error) {
+func (f *fakeGeminiService) Ask(_ context.Context, _ string, modelName string) (string, *model.GeminiStatus, error) {
 	_ = modelName
 	if f.err != nil {
 		return "", &model.GeminiStatus{HTTPStatus: 500, Code: "internal_error", Message: f.err.Error()}, f.err
@@ -23,14 +24,31 @@ func (f *fakeGeminiService) Ask(_ string, modelName string) (string, *model.Gemi
 }
 
 func (f *fakeGeminiService) AskWithEnv(question string, modelName string, _ map[string]string) (string, *model.GeminiStatus, error) {
-	return f.Ask(question, modelName)
+	return f.Ask(context.Background(), question, modelName)
+}
+
+func (f *fakeGeminiService) AskWithOptions(ctx context.Context, question string, opts model.AskOptions) (string, *model.GeminiStatus, error) {
+	return f.Ask(ctx, question, opts.Model)
+}
+
+func (f *fakeGeminiService) AskStream(ctx context.Context, question string, modelName string, onChunk func(chunk string) error) (string, *model.GeminiStatus, error) {
+	answer, status, err := f.Ask(ctx, question, modelName)
+	if err != nil {
+		return "", status, err
+	}
+	for _, line := range strings.SplitAfter(answer, "\n") {
+		if err := onChunk(line); err != nil {
+			return "", status, err
+		}
+	}
+	return answer, status, nil
 }
 
 func TestCreateChatCompletionSuccess(t *testing.T) {
 	svc := &fakeGeminiService{answer: "hello"}
 	adapter := NewGeminiAdapter(svc)
 
-	resp, err := adapter.CreateChatCompletion(model.OpenAIChatCompletionRequest{
+	resp, err := adapter.CreateChatCompletion(context.Background(), model.OpenAIChatCompletionRequest{
 		Model: "gemini-2.5-flash",
 		Messages: []model.OpenAIChatMessage{
 			{Role: "user", Content: "say hi"},
@@ -48,7 +66,7 @@ func TestCreateCompletionError(t *testing.T) {
 	svc := &fakeGeminiService{err: errors.New("boom")}
 	adapter := NewGeminiAdapter(svc)
 
-	_, err := adapter.CreateCompletion(model.OpenAICompletionRequest{Prompt: "test"})
+	_, err := adapter.CreateCompletion(context.Background(), model.OpenAICompletionRequest{Prompt: "test"})
 	if err == nil {
 		t.Fatal("expected error")
 	}
@@ -58,7 +76,7 @@ func TestCreateChatCompletionRejectsNMoreThanOne(t *testing.T) {
 	svc := &fakeGeminiService{answer: "hello"}
 	adapter := NewGeminiAdapter(svc)
 
-	_, err := adapter.CreateChatCompletion(model.OpenAIChatCompletionRequest{
+	_, err := adapter.CreateChatCompletion(context.Background(), model.OpenAIChatCompletionRequest{
 		Model: "gemini-2.5-flash",
 		Messages: []model.OpenAIChatMessage{
 			{Role: "user", Content: "say hi"},
@@ -82,7 +100,7 @@ func TestCreateChatCompletionRejectsNNegative(t *testing.T) {
 	svc := &fakeGeminiService{answer: "hello"}
 	adapter := NewGeminiAdapter(svc)
 
-	_, err := adapter.CreateChatCompletion(model.OpenAIChatCompletionRequest{
+	_, err := adapter.CreateChatCompletion(context.Background(), model.OpenAIChatCompletionRequest{
 		Model: "gemini-2.5-flash",
 		Messages: []model.OpenAIChatMessage{
 			{Role: "user", Content: "say hi"},
@@ -106,7 +124,7 @@ func TestCreateCompletionRejectsNMoreThanOne(t *testing.T) {
 	svc := &fakeGeminiService{answer: "hello"}
 	adapter := NewGeminiAdapter(svc)
 
-	_, err := adapter.CreateCompletion(model.OpenAICompletionRequest{Prompt: "test", N: 2})
+	_, err := adapter.CreateCompletion(context.Background(), model.OpenAICompletionRequest{Prompt: "test", N: 2})
 	if err == nil {
 		t.Fatal("expected error")
 	}
@@ -124,7 +142,7 @@ func TestCreateCompletionRejectsNNegative(t *testing.T) {
 	svc := &fakeGeminiService{answer: "hello"}
 	adapter := NewGeminiAdapter(svc)
 
-	_, err := adapter.CreateCompletion(model.OpenAICompletionRequest{Prompt: "test", N: -1})
+	_, err := adapter.CreateCompletion(context.Background(), model.OpenAICompletionRequest{Prompt: "test", N: -1})
 	if err == nil {
 		t.Fatal("expected error")
 	}
@@ -142,7 +160,7 @@ func TestCreateResponseSuccess(t *testing.T) {
 	svc := &fakeGeminiService{answer: "hello"}
 	adapter := NewGeminiAdapter(svc)
 
-	resp, err := adapter.CreateResponse(model.OpenAIResponseRequest{Model: "gemini-2.5-flash", Input: "say hi"})
+	resp, err := adapter.CreateResponse(context.Background(), model.OpenAIResponseRequest{Model: "gemini-2.5-flash", Input: "say hi"})
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -155,7 +173,7 @@ func TestCreateResponseRejectsInvalidInput(t *testing.T) {
 	svc := &fakeGeminiService{answer: "hello"}
 	adapter := NewGeminiAdapter(svc)
 
-	_, err := adapter.CreateResponse(model.OpenAIResponseRequest{Input: []interface{}{123}})
+	_, err := adapter.CreateResponse(context.Background(), model.OpenAIResponseRequest{Input: []interface{}{123}})
 	if err == nil {
 		t.Fatal("expected error")
 	}
@@ -173,7 +191,7 @@ func TestCreateResponseRejectsObjectItemWithoutContentOrText(t *testing.T) {
 	svc := &fakeGeminiService{answer: "hello"}
 	adapter := NewGeminiAdapter(svc)
 
-	_, err := adapter.CreateResponse(model.OpenAIResponseRequest{Input: []interface{}{map[string]interface{}{"foo": "bar"}}})
+	_, err := adapter.CreateResponse(context.Background(), model.OpenAIResponseRequest{Input: []interface{}{map[string]interface{}{"foo": "bar"}}})
 	if err == nil {
 		t.Fatal("expected error")
 	}
@@ -191,7 +209,7 @@ func TestCreateResponseRejectsContentArrayUnsupportedElementType(t *testing.T) {
 	svc := &fakeGeminiService{answer: "hello"}
 	adapter := NewGeminiAdapter(svc)
 
-	_, err := adapter.CreateResponse(model.OpenAIResponseRequest{Input: []interface{}{
+	_, err := adapter.CreateResponse(context.Background(), model.OpenAIResponseRequest{Input: []interface{}{
 		map[string]interface{}{
 			"content": []interface{}{"ok", 123},
 		},
@@ -216,7 +234,7 @@ func TestCreateResponseRejectsContentArrayMapWithoutNonEmptyText(t *testing.T) {
 	svc := &fakeGeminiService{answer: "hello"}
 	adapter := NewGeminiAdapter(svc)
 
-	_, err := adapter.CreateResponse(model.OpenAIResponseRequest{Input: []interface{}{
+	_, err := adapter.CreateResponse(context.Background(), model.OpenAIResponseRequest{Input: []interface{}{
 		map[string]interface{}{
 			"content": []interface{}{map[string]interface{}{"foo": "bar"}},
 		},
@@ -244,7 +262,7 @@ func TestCreateChatCompletionUsesResolvedModelFromStatus(t *testing.T) {
 	}
 	adapter := NewGeminiAdapter(svc)
 
-	resp, err := adapter.CreateChatCompletion(model.OpenAIChatCompletionRequest{
+	resp, err := adapter.CreateChatCompletion(context.Background(), model.OpenAIChatCompletionRequest{
 		Model: "gemini-3.1-pro-preview",
 		Messages: []model.OpenAIChatMessage{
 			{Role: "user", Content: "say hi"},
@@ -257,3 +275,120 @@ func TestCreateChatCompletionUsesResolvedModelFromStatus(t *testing.T) {
 		t.Fatalf("expected fallback model in response, got %q", resp.Model)
 	}
 }
+
+func TestCreateChatCompletionStreamEmitsRoleContentAndFinish(t *testing.T) {
+	svc := &fakeGeminiService{answer: "hello\nworld"}
+	adapter := NewGeminiAdapter(svc)
+
+	var chunks []model.OpenAIChatCompletionChunk
+	err := adapter.CreateChatCompletionStream(context.Background(), model.OpenAIChatCompletionRequest{
+		Model:    "gemini-2.5-flash",
+		Messages: []model.OpenAIChatMessage{{Role: "user", Content: "say hi"}},
+		Stream:   true,
+	}, func(chunk model.OpenAIChatCompletionChunk) error {
+		chunks = append(chunks, chunk)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(chunks) != 4 {
+		t.Fatalf("expected role, two content and finish chunks, got %d", len(chunks))
+	}
+	if chunks[0].Choices[0].Delta.Role != "assistant" || chunks[1].Choices[0].Delta.Content != "hello\n" {
+		t.Fatalf("unexpected leading chunks: %#v", chunks[:2])
+	}
+	last := chunks[len(chunks)-1]
+	if last.Object != "chat.completion.chunk" || last.Choices[0].FinishReason == nil || *last.Choices[0].FinishReason != "stop" {
+		t.Fatalf("unexpected final chunk: %#v", last)
+	}
+}
+
+func TestCreateChatCompletionStreamNamesOneModelInEveryChunk(t *testing.T) {
+	svc := &fakeGeminiService{answer: "hello\nworld", status: &model.GeminiStatus{Model: "gemini-2.5-flash"}}
+	adapter := NewGeminiAdapter(svc)
+
+	var chunks []model.OpenAIChatCompletionChunk
+	err := adapter.CreateChatCompletionStream(context.Background(), model.OpenAIChatCompletionRequest{
+		Model:    "gemini-3.1-pro-preview",
+		Messages: []model.OpenAIChatMessage{{Role: "user", Content: "say hi"}},
+		Stream:   true,
+	}, func(chunk model.OpenAIChatCompletionChunk) error {
+		chunks = append(chunks, chunk)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, chunk := range chunks {
+		if chunk.Model != "gemini-3.1-pro-preview" {
+			t.Fatalf("expected every chunk to name the requested model, got %#v", chunks)
+		}
+	}
+}
+
+func TestCreateChatCompletionStreamReturnsValidationError(t *testing.T) {
+	adapter := NewGeminiAdapter(&fakeGeminiService{answer: "hello"})
+
+	err := adapter.CreateChatCompletionStream(context.Background(), model.OpenAIChatCompletionRequest{Stream: true}, func(model.OpenAIChatCompletionChunk) error {
+		t.Fatal("no chunk expected")
+		return nil
+	})
+	apiErr, ok := err.(*APIError)
+	if !ok || apiErr.Code != "messages_required" {
+		t.Fatalf("unexpected error: %#v", err)
+	}
+}
+
+func TestBuildPromptFromMessagesMapsRoles(t *testing.T) {
+	got := buildPromptFromMessages([]model.OpenAIChatMessage{
+		{Role: "developer", Content: "be brief"},
+		{Role: "", Content: "hi"},
+		{Role: "model", Content: "hello"},
+	})
+	want := "system: be brief\nuser: hi\nassistant: hello"
+	if got != want {
+		t.Fatalf("unexpected prompt: got=%q want=%q", got, want)
+	}
+}
+
+func TestResolveModelUsesAliasesAndDefault(t *testing.T) {
+	adapter := NewGeminiAdapter(&fakeGeminiService{})
+	adapter.SetModelAliases(map[string]string{"gpt-4o": "gemini-2.5-pro", "gpt-4o-mini": "gemini-2.5-flash-lite"})
+
+	if got := adapter.resolveModel("GPT-4o"); got != "gemini-2.5-pro" {
+		t.Fatalf("unexpected alias resolution: %q", got)
+	}
+	if got := adapter.resolveModel(""); got != defaultModel {
+		t.Fatalf("unexpected default model: %q", got)
+	}
+	if got := adapter.resolveModel("gemini-2.5-flash"); got != "gemini-2.5-flash" {
+		t.Fatalf("unexpected passthrough model: %q", got)
+	}
+
+	adapter.SetModelAliases(map[string]string{" GPT-4.1 ": "gemini-2.5-flash"})
+	if got := adapter.resolveModel("gpt-4.1"); got != "gemini-2.5-flash" {
+		t.Fatalf("unexpected alias resolution after SetModelAliases: %q", got)
+	}
+	if got := adapter.resolveModel("gpt-4o"); got != "gpt-4o" {
+		t.Fatalf("expected the old aliases to be replaced, got %q", got)
+	}
+}
+
+func TestCreateChatCompletionReportsCLIUsage(t *testing.T) {
+	svc := &fakeGeminiService{
+		answer: "hello",
+		status: &model.GeminiStatus{Usage: &model.UsageMetadata{PromptTokenCount: 12, CandidatesTokenCount: 3, TotalTokenCount: 20}},
+	}
+	adapter := NewGeminiAdapter(svc)
+
+	resp, err := adapter.CreateChatCompletion(context.Background(), model.OpenAIChatCompletionRequest{
+		Messages: []model.OpenAIChatMessage{{Role: "user", Content: "say hi"}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp.Usage.PromptTokens != 12 || resp.Usage.CompletionTokens != 3 || resp.Usage.TotalTokens != 20 {
+		t.Fatalf("unexpected usage: %#v", resp.Usage)
+	}
+}
@@ -1,12 +1,17 @@
 package openai
 
-import "gemini-wrapper/model"
+import (
+	"context"
+
+	"gemini-wrapper/model"
+)
 
 type Service interface {
 	ListModels() model.OpenAIModelListResponse
-	CreateChatCompletion(req model.OpenAIChatCompletionRequest) (model.OpenAIChatCompletionResponse, error)
-	CreateCompletion(req model.OpenAICompletionRequest) (model.OpenAICompletionResponse, error)
-	CreateResponse(req model.OpenAIResponseRequest) (model.OpenAIResponse, error)
+	CreateChatCompletion(ctx context.Context, req model.OpenAIChatCompletionRequest) (model.OpenAIChatCompletionResponse, error)
+	CreateChatCompletionStream(ctx context.Context, req model.OpenAIChatCompletionRequest, onChunk func(model.OpenAIChatCompletionChunk) error) error
+	CreateCompletion(ctx context.Context, req model.OpenAICompletionRequest) (model.OpenAICompletionResponse, error)
+	CreateResponse(ctx context.Context, req model.OpenAIResponseRequest) (model.OpenAIResponse, error)
 }
 
 type APIError struct {
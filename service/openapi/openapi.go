@@ -0,0 +1,171 @@
+// Package openapi describes the HTTP API of the wrapper as an OpenAPI 3.1
+// document. The schemas are generated from the request and response structs
+// the handlers bind and return, so the document follows them as they change.
+package openapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Operation describes one route. Request and Response are values of the
+// body types, like model.AskRequest{}; nil means no JSON body.
+type Operation struct {
+	Summary  string
+	Tag      string
+	Request  any
+	Response any
+	// Status is the status of a successful response; 0 is 200.
+	Status int
+	// Stream marks responses sent as server-sent events.
+	Stream bool
+}
+
+// Document is an OpenAPI document being built.
+type Document struct {
+	title   string
+	version string
+	secured bool
+	paths   map[string]map[string]Operation
+}
+
+func New(title, version string) *Document {
+	return &Document{title: title, version: version, paths: map[string]map[string]Operation{}}
+}
+
+// SetVersion sets the version of the API in the document's info.
+func (d *Document) SetVersion(version string) {
+	d.version = version
+}
+
+// RequireAPIKey declares that the routes need one of the wrapper's API keys.
+func (d *Document) RequireAPIKey() {
+	d.secured = true
+}
+
+// Add describes the route method path, in Echo syntax: ":name" parameters
+// and a trailing "*".
+func (d *Document) Add(method, path string, op Operation) {
+	path = openAPIPath(path)
+	if d.paths[path] == nil {
+		d.paths[path] = map[string]Operation{}
+	}
+	d.paths[path][strings.ToLower(method)] = op
+}
+
+// openAPIPath turns "/files/:name" into "/files/{name}" and a trailing "*"
+// into "{path}".
+func openAPIPath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		switch {
+		case strings.HasPrefix(segment, ":"):
+			segments[i] = "{" + segment[1:] + "}"
+		case segment == "*":
+			segments[i] = "{path}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// pathParameters returns the names of the {parameters} of path.
+func pathParameters(path string) []string {
+	var names []string
+	for _, segment := range strings.Split(path, "/") {
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+			names = append(names, segment[1:len(segment)-1])
+		}
+	}
+	return names
+}
+
+// MarshalJSON renders the document.
+func (d *Document) MarshalJSON() ([]byte, error) {
+	schemas := newSchemaSet()
+	paths := map[string]any{}
+	for path, methods := range d.paths {
+		item := map[string]any{}
+		for method, op := range methods {
+			item[method] = d.operation(schemas, path, method, op)
+		}
+		paths[path] = item
+	}
+	components := map[string]any{"schemas": schemas.components}
+	doc := map[string]any{
+		"openapi": "3.1.0",
+		"info":    map[string]any{"title": d.title, "version": d.version},
+		"paths":   paths,
+	}
+	if d.secured {
+		components["securitySchemes"] = map[string]any{
+			"bearer":     map[string]any{"type": "http", "scheme": "bearer"},
+			"googApiKey": map[string]any{"type": "apiKey", "in": "header", "name": "x-goog-api-key"},
+			"apiKey":     map[string]any{"type": "apiKey", "in": "header", "name": "x-api-key"},
+			"queryKey":   map[string]any{"type": "apiKey", "in": "query", "name": "key"},
+		}
+		doc["security"] = []any{
+			map[string]any{"bearer": []string{}},
+			map[string]any{"googApiKey": []string{}},
+			map[string]any{"apiKey": []string{}},
+			map[string]any{"queryKey": []string{}},
+		}
+	}
+	doc["components"] = components
+	return json.Marshal(doc)
+}
+
+func (d *Document) operation(schemas *schemaSet, path, method string, op Operation) map[string]any {
+	out := map[string]any{"operationId": operationID(method, path)}
+	if op.Summary != "" {
+		out["summary"] = op.Summary
+	}
+	if op.Tag != "" {
+		out["tags"] = []string{op.Tag}
+	}
+	var params []any
+	for _, name := range pathParameters(path) {
+		params = append(params, map[string]any{"name": name, "in": "path", "required": true, "schema": map[string]any{"type": "string"}})
+	}
+	if params != nil {
+		out["parameters"] = params
+	}
+	if op.Request != nil {
+		out["requestBody"] = map[string]any{
+			"required": true,
+			"content":  map[string]any{"application/json": map[string]any{"schema": schemas.of(op.Request)}},
+		}
+	}
+
+	status := op.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	response := map[string]any{"description": http.StatusText(status)}
+	switch {
+	case op.Stream:
+		event := map[string]any{"type": "string"}
+		if op.Response != nil {
+			event = map[string]any{"type": "string", "description": "The data of each event is one JSON document.", "contentMediaType": "application/json", "contentSchema": schemas.of(op.Response)}
+		}
+		response["content"] = map[string]any{"text/event-stream": map[string]any{"schema": event}}
+	case op.Response != nil:
+		response["content"] = map[string]any{"application/json": map[string]any{"schema": schemas.of(op.Response)}}
+	}
+	out["responses"] = map[string]any{strconv.Itoa(status): response}
+	return out
+}
+
+// operationID names an operation after its method and path, like
+// "get_api_sessions_id".
+func operationID(method, path string) string {
+	parts := []string{method}
+	for _, segment := range strings.Split(path, "/") {
+		segment = strings.Trim(segment, "{}")
+		if segment != "" {
+			parts = append(parts, strings.NewReplacer(".", "_", "-", "_", ":", "_").Replace(segment))
+		}
+	}
+	return strings.Join(parts, "_")
+}
@@ -0,0 +1,135 @@
+package openapi
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type testNode struct {
+	Name     string            `json:"name"`
+	Children []testNode        `json:"children,omitempty"`
+	Parent   *testNode         `json:"parent,omitempty"`
+	Created  time.Time         `json:"created"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	Data     []byte            `json:"data,omitempty"`
+	Extra    any               `json:"extra,omitempty"`
+	Hidden   string            `json:"-"`
+	internal string
+	testBase
+}
+
+type testBase struct {
+	ID int64 `json:"id"`
+}
+
+type testWords []string
+
+func (w *testWords) UnmarshalJSON([]byte) error { return nil }
+
+type testRequest struct {
+	Words testWords `json:"words"`
+	Count int       `json:"count"`
+	Ratio float64   `json:"ratio"`
+	Nodes []*testNode
+}
+
+func render(t *testing.T, doc *Document) map[string]any {
+	t.Helper()
+	raw, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out map[string]any
+	if err := json.Unmarshal(raw, &out); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func lookup(t *testing.T, v any, path ...string) any {
+	t.Helper()
+	for _, key := range path {
+		m, ok := v.(map[string]any)
+		if !ok {
+			t.Fatalf("expected an object at %q in %v", key, path)
+		}
+		v = m[key]
+	}
+	return v
+}
+
+func TestDocumentDescribesRoutesAndBodies(t *testing.T) {
+	doc := New("wrapper", "dev")
+	doc.Add("POST", "/api/items/:id", Operation{Summary: "Update an item", Tag: "items", Request: testRequest{}, Response: testNode{}})
+	doc.Add("POST", "/api/items/:id/stream", Operation{Request: testRequest{}, Response: testNode{}, Stream: true})
+	doc.Add("DELETE", "/api/files/*", Operation{Status: 204})
+	doc.SetVersion("v1.2.3")
+	spec := render(t, doc)
+
+	if spec["openapi"] != "3.1.0" || lookup(t, spec, "info", "version") != "v1.2.3" {
+		t.Fatalf("unexpected header %v %v", spec["openapi"], spec["info"])
+	}
+	op := lookup(t, spec, "paths", "/api/items/{id}", "post")
+	if lookup(t, op, "summary") != "Update an item" || lookup(t, op, "operationId") != "post_api_items_id" {
+		t.Fatalf("unexpected operation %v", op)
+	}
+	if params := lookup(t, op, "parameters").([]any); len(params) != 1 || lookup(t, params[0], "name") != "id" {
+		t.Fatalf("expected the id path parameter, got %v", params)
+	}
+	if ref := lookup(t, op, "requestBody", "content", "application/json", "schema", "$ref"); ref != "#/components/schemas/testRequest" {
+		t.Fatalf("expected the request to refer to its component, got %v", ref)
+	}
+	if ref := lookup(t, op, "responses", "200", "content", "application/json", "schema", "$ref"); ref != "#/components/schemas/testNode" {
+		t.Fatalf("expected the response to refer to its component, got %v", ref)
+	}
+	stream := lookup(t, spec, "paths", "/api/items/{id}/stream", "post", "responses", "200", "content", "text/event-stream", "schema")
+	if lookup(t, stream, "contentSchema", "$ref") != "#/components/schemas/testNode" {
+		t.Fatalf("expected the events to be described, got %v", stream)
+	}
+	if lookup(t, spec, "paths", "/api/files/{path}", "delete", "responses", "204", "description") != "No Content" {
+		t.Fatalf("expected a 204 without body, got %v", lookup(t, spec, "paths", "/api/files/{path}"))
+	}
+	if spec["security"] != nil {
+		t.Fatalf("expected no security without API keys, got %v", spec["security"])
+	}
+}
+
+func TestSchemasFollowTheJSONEncoding(t *testing.T) {
+	doc := New("wrapper", "dev")
+	doc.Add("POST", "/nodes", Operation{Request: testRequest{}, Response: testNode{}})
+	spec := render(t, doc)
+
+	node := lookup(t, spec, "components", "schemas", "testNode", "properties")
+	want := map[string]any{
+		"name":     map[string]any{"type": "string"},
+		"children": map[string]any{"type": "array", "items": map[string]any{"$ref": "#/components/schemas/testNode"}},
+		"parent":   map[string]any{"$ref": "#/components/schemas/testNode"},
+		"created":  map[string]any{"type": "string", "format": "date-time"},
+		"labels":   map[string]any{"type": "object", "additionalProperties": map[string]any{"type": "string"}},
+		"data":     map[string]any{"type": "string", "format": "byte"},
+		"extra":    map[string]any{},
+		"id":       map[string]any{"type": "integer", "format": "int64"},
+	}
+	if !reflect.DeepEqual(node, want) {
+		t.Fatalf("unexpected properties %v", node)
+	}
+
+	request := lookup(t, spec, "components", "schemas", "testRequest", "properties")
+	if words := lookup(t, request, "words"); !reflect.DeepEqual(words, map[string]any{}) {
+		t.Fatalf("expected a custom encoding to allow any value, got %v", words)
+	}
+	if lookup(t, request, "Nodes", "items", "$ref") != "#/components/schemas/testNode" || lookup(t, request, "ratio", "type") != "number" {
+		t.Fatalf("unexpected request properties %v", request)
+	}
+}
+
+func TestRequireAPIKeyDeclaresTheKeySchemes(t *testing.T) {
+	doc := New("wrapper", "dev")
+	doc.RequireAPIKey()
+	spec := render(t, doc)
+	if len(spec["security"].([]any)) != 4 || lookup(t, spec, "components", "securitySchemes", "googApiKey", "name") != "x-goog-api-key" {
+		t.Fatalf("expected the API key schemes, got %v %v", spec["security"], lookup(t, spec, "components"))
+	}
+}
@@ -0,0 +1,93 @@
+// Package passthrough forwards Gemini API requests the wrapper does not
+// serve itself to the real Gemini API, so SDK clients keep working for
+// routes such as cachedContents or tunedModels while generateContent is
+// still answered by the CLI.
+package passthrough
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"gemini-wrapper/service/geminiapi"
+)
+
+const defaultBaseURL = "https://generativelanguage.googleapis.com"
+
+// ErrNotConfigured is returned by New when forwarding is enabled without an
+// API key.
+var ErrNotConfigured = errors.New("passthrough needs an API key; set GEMINI_PASSTHROUGH_API_KEY or GEMINI_API_KEY")
+
+type Config struct {
+	Enabled bool `yaml:"enabled"`
+	// APIKey is sent upstream in place of the key the client authenticated
+	// to the wrapper with.
+	APIKey  string `yaml:"api_key"`
+	BaseURL string `yaml:"base_url"`
+}
+
+func DefaultConfig() Config {
+	return Config{BaseURL: defaultBaseURL}
+}
+
+// ApplyEnv overrides c with the GEMINI_PASSTHROUGH_* environment variables
+// that are set. GEMINI_API_KEY is used when no key is configured.
+func (c *Config) ApplyEnv() {
+	if enabled, err := strconv.ParseBool(strings.TrimSpace(os.Getenv("GEMINI_PASSTHROUGH_ENABLED"))); err == nil {
+		c.Enabled = enabled
+	}
+	if key := strings.TrimSpace(os.Getenv("GEMINI_PASSTHROUGH_API_KEY")); key != "" {
+		c.APIKey = key
+	} else if key := strings.TrimSpace(os.Getenv("GEMINI_API_KEY")); key != "" && c.APIKey == "" {
+		c.APIKey = key
+	}
+	if baseURL := strings.TrimSpace(os.Getenv("GEMINI_PASSTHROUGH_BASE_URL")); baseURL != "" {
+		c.BaseURL = baseURL
+	}
+}
+
+// New returns a handler that forwards requests to cfg.BaseURL under the same
+// path and query, or nil when forwarding is disabled.
+func New(cfg Config) (http.Handler, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	if cfg.APIKey == "" {
+		return nil, ErrNotConfigured
+	}
+	if cfg.BaseURL == "" {
+		cfg.BaseURL = defaultBaseURL
+	}
+	target, err := url.Parse(strings.TrimRight(cfg.BaseURL, "/"))
+	if err != nil || target.Scheme == "" || target.Host == "" {
+		return nil, fmt.Errorf("invalid passthrough base URL %q", cfg.BaseURL)
+	}
+	return &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(target)
+			r.Out.Host = target.Host
+			// The client's credentials belong to the wrapper and must not
+			// reach Google, in any of the forms the wrapper accepts them.
+			if query := r.Out.URL.Query(); query.Has("key") {
+				query.Del("key")
+				r.Out.URL.RawQuery = query.Encode()
+			}
+			r.Out.Header.Del("Authorization")
+			r.Out.Header.Del("X-Api-Key")
+			r.Out.Header.Set("X-Goog-Api-Key", cfg.APIKey)
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			slog.Warn("passthrough request failed", "path", r.URL.Path, "error", err)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadGateway)
+			json.NewEncoder(w).Encode(geminiapi.NewError(http.StatusBadGateway, "Gemini API unreachable"))
+		},
+	}, nil
+}
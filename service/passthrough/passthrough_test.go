@@ -0,0 +1,111 @@
+package passthrough
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gemini-wrapper/model"
+)
+
+func TestForwardsWithTheUpstreamKey(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/v1beta/cachedContents" || r.URL.Query().Get("pageSize") != "5" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		}
+		if r.URL.Query().Has("key") || r.Header.Get("Authorization") != "" || r.Header.Get("X-Goog-Api-Key") != "upstream" {
+			t.Errorf("client credentials leaked: query=%q auth=%q key=%q", r.URL.RawQuery, r.Header.Get("Authorization"), r.Header.Get("X-Goog-Api-Key"))
+		}
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write(body)
+	}))
+	defer upstream.Close()
+
+	proxy, err := New(Config{Enabled: true, APIKey: "upstream", BaseURL: upstream.URL + "/"})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/v1beta/cachedContents?pageSize=5&key=client", strings.NewReader(`{"model":"m"}`))
+	req.Header.Set("Authorization", "Bearer client")
+	req.Header.Set("X-Goog-Api-Key", "client")
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, req)
+	if rec.Code != http.StatusCreated || rec.Body.String() != `{"model":"m"}` {
+		t.Fatalf("unexpected response %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestNoClientCredentialReachesUpstream(t *testing.T) {
+	forms := map[string]func(*http.Request){
+		"authorization": func(req *http.Request) { req.Header.Set("Authorization", "Bearer client-secret") },
+		"query":         func(req *http.Request) { req.URL.RawQuery = "key=client-secret" },
+		"goog-api-key":  func(req *http.Request) { req.Header.Set("X-Goog-Api-Key", "client-secret") },
+		"api-key":       func(req *http.Request) { req.Header.Set("X-Api-Key", "client-secret") },
+	}
+	for name, authenticate := range forms {
+		t.Run(name, func(t *testing.T) {
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if strings.Contains(r.URL.RawQuery, "client-secret") {
+					t.Errorf("client key leaked in query %q", r.URL.RawQuery)
+				}
+				for header, values := range r.Header {
+					for _, value := range values {
+						if strings.Contains(value, "client-secret") {
+							t.Errorf("client key leaked in header %s", header)
+						}
+					}
+				}
+				if r.Header.Get("X-Goog-Api-Key") != "upstream" {
+					t.Errorf("expected the upstream key, got %q", r.Header.Get("X-Goog-Api-Key"))
+				}
+			}))
+			defer upstream.Close()
+
+			proxy, err := New(Config{Enabled: true, APIKey: "upstream", BaseURL: upstream.URL})
+			if err != nil {
+				t.Fatalf("New: %v", err)
+			}
+			req := httptest.NewRequest(http.MethodGet, "/v1beta/tunedModels", nil)
+			authenticate(req)
+			rec := httptest.NewRecorder()
+			proxy.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("unexpected response %d %s", rec.Code, rec.Body)
+			}
+		})
+	}
+}
+
+func TestUnreachableUpstreamAnswersBadGateway(t *testing.T) {
+	upstream := httptest.NewServer(http.NotFoundHandler())
+	upstream.Close()
+
+	proxy, err := New(Config{Enabled: true, APIKey: "upstream", BaseURL: upstream.URL})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1beta/tunedModels", nil))
+	var resp model.GeminiErrorResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || rec.Code != http.StatusBadGateway || resp.Error.Code != http.StatusBadGateway {
+		t.Fatalf("unexpected response %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestNewNeedsAnAPIKeyOnlyWhenEnabled(t *testing.T) {
+	if proxy, err := New(DefaultConfig()); proxy != nil || err != nil {
+		t.Fatalf("expected no proxy when disabled, got %v, %v", proxy, err)
+	}
+	if _, err := New(Config{Enabled: true}); !errors.Is(err, ErrNotConfigured) {
+		t.Fatalf("expected ErrNotConfigured, got %v", err)
+	}
+	if _, err := New(Config{Enabled: true, APIKey: "k", BaseURL: "not a url"}); err == nil {
+		t.Fatal("expected an invalid base URL to be rejected")
+	}
+}
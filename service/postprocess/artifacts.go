@@ -0,0 +1,116 @@
+package postprocess
+
+import (
+	"cmp"
+	"path"
+	"regexp"
+	"strings"
+
+	"gemini-wrapper/model"
+)
+
+var (
+	fenceOpen = regexp.MustCompile("^\\s{0,3}(`{3,}|~{3,})\\s*(.*)$")
+	// fileAttribute is a file name in the info string of a fence, like
+	// ```go title="main.go".
+	fileAttribute = regexp.MustCompile(`(?i)\b(?:title|file|filename|path)=["']?([^"'\s]+)`)
+	// fileHeading is a line before a fence that names its file, like
+	// **main.go**, `main.go`: or File: main.go.
+	fileHeading = regexp.MustCompile("(?i)^\\s*(?:#{1,6}\\s*)?(?:(?:file(?:name)?|path)\\s*:\\s*)?[*_`]*([\\w./-]+\\.\\w+)[*_`]*:?\\s*$")
+	// fileComment is a first line of code that names its file, like
+	// // main.go or <!-- index.html -->.
+	fileComment = regexp.MustCompile(`(?i)^\s*(?://|#|--|/\*|<!--)\s*(?:file(?:name)?:\s*)?([\w./-]+\.\w+)\s*(?:\*/|-->)?\s*$`)
+)
+
+// Artifacts returns the fenced code blocks of a markdown answer, so clients
+// need not parse the markdown themselves. The language comes from the info
+// string of the fence. The file name comes from the info string, from a
+// line right before the fence that only names a file, or from a comment on
+// the first line of the code; names that are absolute or leave their
+// directory are dropped. A block the answer does not close runs to its end.
+func Artifacts(text string) []model.Artifact {
+	var artifacts []model.Artifact
+	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+	previous := ""
+	for i := 0; i < len(lines); i++ {
+		match := fenceOpen.FindStringSubmatch(lines[i])
+		if match == nil {
+			if strings.TrimSpace(lines[i]) != "" {
+				previous = lines[i]
+			}
+			continue
+		}
+		fence, info := match[1], strings.TrimSpace(match[2])
+		if fence[0] == '`' && strings.Contains(info, "`") {
+			// Inline code that only starts like a fence.
+			previous = lines[i]
+			continue
+		}
+		var code []string
+		for i++; i < len(lines); i++ {
+			if closing := strings.TrimSpace(lines[i]); strings.HasPrefix(closing, fence) && strings.Trim(closing, fence[:1]) == "" {
+				break
+			}
+			code = append(code, lines[i])
+		}
+		artifact := model.Artifact{Content: strings.Join(code, "\n")}
+		if artifact.Content != "" {
+			artifact.Content += "\n"
+		}
+		artifact.Language, artifact.Filename = splitFenceInfo(info)
+		if artifact.Filename == "" {
+			if match := fileHeading.FindStringSubmatch(previous); match != nil {
+				artifact.Filename = match[1]
+			} else if len(code) > 0 {
+				if match := fileComment.FindStringSubmatch(code[0]); match != nil {
+					artifact.Filename = match[1]
+				}
+			}
+		}
+		artifact.Filename = safeFilename(artifact.Filename)
+		artifacts = append(artifacts, artifact)
+		previous = ""
+	}
+	return artifacts
+}
+
+// splitFenceInfo splits the info string of a fence into the language and a
+// file name, as in "go", "go main.go", "main.go", "go:main.go" or
+// "go title=main.go".
+func splitFenceInfo(info string) (language, filename string) {
+	if match := fileAttribute.FindStringSubmatch(info); match != nil {
+		filename = match[1]
+	}
+	fields := strings.Fields(info)
+	if len(fields) == 0 {
+		return "", filename
+	}
+	first := fields[0]
+	if lang, name, ok := strings.Cut(first, ":"); ok && looksLikeFile(name) {
+		return lang, cmp.Or(filename, name)
+	}
+	if looksLikeFile(first) && !strings.Contains(first, "=") {
+		return "", cmp.Or(filename, first)
+	}
+	if len(fields) > 1 && looksLikeFile(fields[1]) && !strings.Contains(fields[1], "=") {
+		filename = cmp.Or(filename, fields[1])
+	}
+	return first, filename
+}
+
+func looksLikeFile(name string) bool {
+	return strings.Contains(name, ".") || strings.Contains(name, "/")
+}
+
+// safeFilename cleans name, or returns "" for names that are absolute or
+// leave the directory they are written to.
+func safeFilename(name string) string {
+	if name == "" || path.IsAbs(name) {
+		return ""
+	}
+	name = path.Clean(name)
+	if name == ".." || strings.HasPrefix(name, "../") {
+		return ""
+	}
+	return name
+}
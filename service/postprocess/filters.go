@@ -0,0 +1,145 @@
+package postprocess
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// redacted replaces text masked by the redact filter.
+const redacted = "[REDACTED]"
+
+var (
+	fenceLine     = regexp.MustCompile("^\\s*(```|~~~)")
+	ruleLine      = regexp.MustCompile(`^\s*([-*_]\s*){3,}$`)
+	headingPrefix = regexp.MustCompile(`^\s{0,3}#{1,6}\s+`)
+	quotePrefix   = regexp.MustCompile(`^\s*>\s?`)
+	imageSyntax   = regexp.MustCompile(`!\[([^\]]*)\]\([^)]*\)`)
+	linkSyntax    = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)\)`)
+	boldStars     = regexp.MustCompile(`\*\*([^*]+)\*\*`)
+	boldUnders    = regexp.MustCompile(`__([^_]+)__`)
+	italicStars   = regexp.MustCompile(`\*([^*\s][^*]*)\*`)
+	inlineCode    = regexp.MustCompile("`([^`]+)`")
+)
+
+// defaultRedactPatterns mask emails and common API key formats.
+var defaultRedactPatterns = []string{
+	`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`,
+	`AIza[0-9A-Za-z_-]{35}`,
+	`\bsk-[A-Za-z0-9_-]{20,}`,
+	`(?i)\bbearer\s+[A-Za-z0-9._~+/-]{20,}=*`,
+	`\bgh[pousr]_[A-Za-z0-9]{36,}`,
+	`\bAKIA[0-9A-Z]{16}\b`,
+}
+
+// defaultProfanityWords are matched with any suffix, so "fuck" also masks
+// "fucking".
+var defaultProfanityWords = []string{"fuck", "shit", "bitch", "bastard", "asshole", "cunt", "motherfucker"}
+
+// newStripMarkdown turns markdown into plain text: fences and rules are
+// dropped, headings and quotes lose their markers and links keep their URL
+// in parentheses. It works line by line, so it also suits streamed chunks.
+func newStripMarkdown(Config) (Filter, error) {
+	return FilterFunc(func(text string) string {
+		var out strings.Builder
+		for _, line := range strings.SplitAfter(text, "\n") {
+			body := strings.TrimRight(line, "\r\n")
+			newline := line[len(body):]
+			if fenceLine.MatchString(body) {
+				continue
+			}
+			if ruleLine.MatchString(body) {
+				out.WriteString(newline)
+				continue
+			}
+			body = headingPrefix.ReplaceAllString(body, "")
+			body = quotePrefix.ReplaceAllString(body, "")
+			body = imageSyntax.ReplaceAllString(body, "$1")
+			body = linkSyntax.ReplaceAllString(body, "$1 ($2)")
+			body = boldStars.ReplaceAllString(body, "$1")
+			body = boldUnders.ReplaceAllString(body, "$1")
+			body = italicStars.ReplaceAllString(body, "$1")
+			body = inlineCode.ReplaceAllString(body, "$1")
+			out.WriteString(body)
+			out.WriteString(newline)
+		}
+		return out.String()
+	}), nil
+}
+
+func newRedact(cfg Config) (Filter, error) {
+	patterns := make([]*regexp.Regexp, 0, len(defaultRedactPatterns)+len(cfg.RedactPatterns))
+	for _, raw := range append(append([]string(nil), defaultRedactPatterns...), cfg.RedactPatterns...) {
+		pattern, err := regexp.Compile(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redact pattern %q: %w", raw, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return FilterFunc(func(text string) string {
+		for _, pattern := range patterns {
+			text = pattern.ReplaceAllString(text, redacted)
+		}
+		return text
+	}), nil
+}
+
+// truncate cuts answers after a number of characters.
+type truncate struct {
+	limit int
+}
+
+func newTruncate(cfg Config) (Filter, error) {
+	if cfg.MaxLength <= 0 {
+		return nil, errors.New("max_length must be positive")
+	}
+	return truncate{limit: cfg.MaxLength}, nil
+}
+
+func (t truncate) Apply(text string) string {
+	return t.NewStream()(text)
+}
+
+func (t truncate) NewStream() func(chunk string) string {
+	var mu sync.Mutex
+	remaining := t.limit
+	return func(chunk string) string {
+		mu.Lock()
+		defer mu.Unlock()
+		if remaining <= 0 {
+			return ""
+		}
+		runes := []rune(chunk)
+		if len(runes) > remaining {
+			runes = runes[:remaining]
+		}
+		remaining -= len(runes)
+		return string(runes)
+	}
+}
+
+// newProfanity masks listed words, keeping their first letter.
+func newProfanity(cfg Config) (Filter, error) {
+	words := cfg.ProfanityWords
+	if len(words) == 0 {
+		words = defaultProfanityWords
+	}
+	quoted := make([]string, 0, len(words))
+	for _, word := range words {
+		if word = strings.TrimSpace(word); word != "" {
+			quoted = append(quoted, regexp.QuoteMeta(word))
+		}
+	}
+	if len(quoted) == 0 {
+		return FilterFunc(func(text string) string { return text }), nil
+	}
+	pattern := regexp.MustCompile(`(?i)\b(?:` + strings.Join(quoted, "|") + `)\w*`)
+	return FilterFunc(func(text string) string {
+		return pattern.ReplaceAllStringFunc(text, func(word string) string {
+			runes := []rune(word)
+			return string(runes[0]) + strings.Repeat("*", len(runes)-1)
+		})
+	}), nil
+}
@@ -0,0 +1,244 @@
+package postprocess
+
+import (
+	"html"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Answer formats. The CLI answers in markdown; the others are converted
+// from it after the filters ran.
+const (
+	FormatMarkdown = "markdown"
+	FormatPlain    = "plain"
+	FormatHTML     = "html"
+)
+
+// Formats lists the answer formats.
+var Formats = []string{FormatMarkdown, FormatPlain, FormatHTML}
+
+var (
+	orderedItem  = regexp.MustCompile(`^\s*\d+[.)]\s+(.*)$`)
+	bulletItem   = regexp.MustCompile(`^\s*[-*+]\s+(.*)$`)
+	headingLine  = regexp.MustCompile(`^\s{0,3}(#{1,6})\s+(.*?)\s*#*\s*$`)
+	imageLink    = regexp.MustCompile(`!\[([^\]]*)\]\(([^)\s]+)\)`)
+	fenceInfo    = regexp.MustCompile("^\\s*(?:```|~~~)\\s*([\\w+-]*)")
+	italicUnders = regexp.MustCompile(`\b_([^_\s][^_]*)_\b`)
+)
+
+// Format converts a complete markdown answer to format. Markdown and
+// unknown formats return it unchanged.
+func Format(text, format string) string {
+	convert, flush := FormatStream(format)
+	return convert(text) + flush()
+}
+
+// FormatStream returns the functions that convert the chunks of one
+// streamed markdown answer to format. Chunks are converted line by line, so
+// convert holds back an unfinished line and flush returns what is left once
+// the stream ended.
+func FormatStream(format string) (convert func(chunk string) string, flush func() string) {
+	var render lineRenderer
+	switch format {
+	case FormatPlain:
+		strip, _ := newStripMarkdown(Config{})
+		render = plainRenderer{strip: strip}
+	case FormatHTML:
+		render = &htmlRenderer{}
+	default:
+		return func(chunk string) string { return chunk }, func() string { return "" }
+	}
+
+	var mu sync.Mutex
+	var pending strings.Builder
+	convert = func(chunk string) string {
+		mu.Lock()
+		defer mu.Unlock()
+		pending.WriteString(chunk)
+		buffered := pending.String()
+		end := strings.LastIndexByte(buffered, '\n')
+		if end < 0 {
+			return ""
+		}
+		pending.Reset()
+		pending.WriteString(buffered[end+1:])
+		var out strings.Builder
+		for _, line := range strings.SplitAfter(buffered[:end+1], "\n") {
+			if line != "" {
+				out.WriteString(render.line(strings.TrimRight(line, "\r\n"), true))
+			}
+		}
+		return out.String()
+	}
+	flush = func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		var out string
+		if pending.Len() > 0 {
+			out = render.line(strings.TrimRight(pending.String(), "\r"), false)
+			pending.Reset()
+		}
+		return out + render.close()
+	}
+	return convert, flush
+}
+
+// lineRenderer converts a markdown answer one line at a time. newline says
+// whether the line ended with one; the last line of an answer may not.
+type lineRenderer interface {
+	line(text string, newline bool) string
+	close() string
+}
+
+// plainRenderer strips the markdown like the strip_markdown filter.
+type plainRenderer struct {
+	strip Filter
+}
+
+func (r plainRenderer) line(text string, newline bool) string {
+	if newline {
+		text += "\n"
+	}
+	return r.strip.Apply(text)
+}
+
+func (r plainRenderer) close() string {
+	return ""
+}
+
+// htmlRenderer renders the markdown the CLI writes: headings, paragraphs,
+// lists, quotes, code blocks, rules and inline emphasis, code, links and
+// images. Text is escaped, and links only keep web and mail URLs.
+type htmlRenderer struct {
+	fence     bool
+	paragraph bool
+	// block is the open list or quote element: "ul", "ol" or "blockquote".
+	block string
+}
+
+func (r *htmlRenderer) line(text string, _ bool) string {
+	if r.fence {
+		if fenceLine.MatchString(text) {
+			r.fence = false
+			return "</code></pre>\n"
+		}
+		return html.EscapeString(text) + "\n"
+	}
+
+	switch {
+	case fenceLine.MatchString(text):
+		out := r.closeBlocks()
+		r.fence = true
+		if language := fenceInfo.FindStringSubmatch(text)[1]; language != "" {
+			return out + `<pre><code class="language-` + html.EscapeString(language) + `">`
+		}
+		return out + "<pre><code>"
+	case strings.TrimSpace(text) == "":
+		return r.closeBlocks()
+	case ruleLine.MatchString(text):
+		return r.closeBlocks() + "<hr>\n"
+	}
+	if match := headingLine.FindStringSubmatch(text); match != nil {
+		level := string(rune('0' + len(match[1])))
+		return r.closeBlocks() + "<h" + level + ">" + inlineHTML(match[2]) + "</h" + level + ">\n"
+	}
+	if match := bulletItem.FindStringSubmatch(text); match != nil {
+		return r.openBlock("ul") + "<li>" + inlineHTML(match[1]) + "</li>\n"
+	}
+	if match := orderedItem.FindStringSubmatch(text); match != nil {
+		return r.openBlock("ol") + "<li>" + inlineHTML(match[1]) + "</li>\n"
+	}
+	if quotePrefix.MatchString(text) {
+		return r.openBlock("blockquote") + "<p>" + inlineHTML(quotePrefix.ReplaceAllString(text, "")) + "</p>\n"
+	}
+	if r.paragraph {
+		return "\n" + inlineHTML(text)
+	}
+	out := r.closeBlocks()
+	r.paragraph = true
+	return out + "<p>" + inlineHTML(text)
+}
+
+func (r *htmlRenderer) close() string {
+	if r.fence {
+		r.fence = false
+		return "</code></pre>\n"
+	}
+	return r.closeBlocks()
+}
+
+// openBlock opens a list or quote element unless it is open already.
+func (r *htmlRenderer) openBlock(element string) string {
+	if r.block == element && !r.paragraph {
+		return ""
+	}
+	out := r.closeBlocks()
+	r.block = element
+	return out + "<" + element + ">\n"
+}
+
+func (r *htmlRenderer) closeBlocks() string {
+	var out string
+	if r.paragraph {
+		out += "</p>\n"
+		r.paragraph = false
+	}
+	if r.block != "" {
+		out += "</" + r.block + ">\n"
+		r.block = ""
+	}
+	return out
+}
+
+// inlineHTML escapes text and renders its inline markdown. Code spans are
+// kept verbatim.
+func inlineHTML(text string) string {
+	var out strings.Builder
+	parts := strings.Split(text, "`")
+	for i, part := range parts {
+		switch {
+		case i%2 == 0:
+			out.WriteString(emphasisHTML(part))
+		case i < len(parts)-1:
+			out.WriteString("<code>" + html.EscapeString(part) + "</code>")
+		default:
+			// An unclosed backtick is text.
+			out.WriteString("`" + emphasisHTML(part))
+		}
+	}
+	return out.String()
+}
+
+// emphasisHTML escapes text and renders its links, images and emphasis.
+func emphasisHTML(part string) string {
+	part = html.EscapeString(part)
+	part = imageLink.ReplaceAllStringFunc(part, func(match string) string {
+		sub := imageLink.FindStringSubmatch(match)
+		if !safeURL(sub[2]) {
+			return sub[1]
+		}
+		return `<img src="` + sub[2] + `" alt="` + sub[1] + `">`
+	})
+	part = linkSyntax.ReplaceAllStringFunc(part, func(match string) string {
+		sub := linkSyntax.FindStringSubmatch(match)
+		if !safeURL(sub[2]) {
+			return sub[1]
+		}
+		return `<a href="` + sub[2] + `">` + sub[1] + `</a>`
+	})
+	part = boldStars.ReplaceAllString(part, "<strong>$1</strong>")
+	part = boldUnders.ReplaceAllString(part, "<strong>$1</strong>")
+	part = italicStars.ReplaceAllString(part, "<em>$1</em>")
+	return italicUnders.ReplaceAllString(part, "<em>$1</em>")
+}
+
+// safeURL reports whether an escaped link target may be rendered: web and
+// mail URLs, and relative ones.
+func safeURL(escaped string) bool {
+	target := strings.ToLower(html.UnescapeString(escaped))
+	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") || strings.HasPrefix(target, "mailto:") {
+		return true
+	}
+	return !strings.Contains(target, ":")
+}
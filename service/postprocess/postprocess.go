@@ -0,0 +1,204 @@
+// Package postprocess rewrites answers before they reach clients: stripping
+// markdown, redacting secrets, truncating and masking profanity. Filters run
+// in the configured order; custom filters are added with Register.
+package postprocess
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Filter rewrites an answer. Apply must be safe for concurrent use.
+type Filter interface {
+	Apply(text string) string
+}
+
+// StreamFilter is implemented by filters that need state across the chunks
+// of one streamed answer, such as a length limit. Other filters see each
+// chunk on its own.
+type StreamFilter interface {
+	Filter
+	// NewStream returns the function that filters the chunks of one stream
+	// in order.
+	NewStream() func(chunk string) string
+}
+
+// FilterFunc adapts a function to Filter.
+type FilterFunc func(text string) string
+
+func (f FilterFunc) Apply(text string) string {
+	return f(text)
+}
+
+// Factory builds a filter from the post-processing config.
+type Factory func(cfg Config) (Filter, error)
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]Factory{
+		"strip_markdown": newStripMarkdown,
+		"redact":         newRedact,
+		"truncate":       newTruncate,
+		"profanity":      newProfanity,
+	}
+)
+
+// Register makes a filter available under name for Config.Filters. Call it
+// before New, for example from an init function; it replaces any filter
+// registered under the same name.
+func Register(name string, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry[name] = factory
+}
+
+// Registered returns the names of the available filters.
+func Registered() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	return registeredLocked()
+}
+
+type Config struct {
+	// Filters names the filters to run, in order. Empty disables
+	// post-processing.
+	Filters []string `yaml:"filters"`
+	// AllowOptOut lets requests skip post-processing with skip_postprocess.
+	AllowOptOut bool `yaml:"allow_opt_out"`
+	// MaxLength is the answer limit in characters of the truncate filter.
+	MaxLength int `yaml:"max_length"`
+	// RedactPatterns are regular expressions the redact filter masks in
+	// addition to emails and API keys.
+	RedactPatterns []string `yaml:"redact_patterns"`
+	// ProfanityWords replaces the word list of the profanity filter.
+	ProfanityWords []string `yaml:"profanity_words"`
+}
+
+func DefaultConfig() Config {
+	return Config{AllowOptOut: true, MaxLength: 4000}
+}
+
+// ApplyEnv overrides c with the POSTPROCESS_* environment variables that are set.
+func (c *Config) ApplyEnv() {
+	if raw := strings.TrimSpace(os.Getenv("POSTPROCESS_FILTERS")); raw != "" {
+		c.Filters = splitList(raw)
+	}
+	if raw := strings.TrimSpace(os.Getenv("POSTPROCESS_ALLOW_OPT_OUT")); raw != "" {
+		if parsed, err := strconv.ParseBool(raw); err == nil {
+			c.AllowOptOut = parsed
+		}
+	}
+	if raw := strings.TrimSpace(os.Getenv("POSTPROCESS_MAX_LENGTH")); raw != "" {
+		if parsed, err := strconv.Atoi(raw); err == nil && parsed > 0 {
+			c.MaxLength = parsed
+		}
+	}
+	if raw := strings.TrimSpace(os.Getenv("POSTPROCESS_PROFANITY_WORDS")); raw != "" {
+		c.ProfanityWords = splitList(raw)
+	}
+}
+
+// Pipeline runs the configured filters. A nil *Pipeline returns answers
+// unchanged.
+type Pipeline struct {
+	names       []string
+	filters     []Filter
+	allowOptOut bool
+}
+
+// New builds the filters named in cfg.Filters. It returns a nil pipeline
+// when no filter is configured and an error for unknown names.
+func New(cfg Config) (*Pipeline, error) {
+	if len(cfg.Filters) == 0 {
+		return nil, nil
+	}
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	p := &Pipeline{allowOptOut: cfg.AllowOptOut}
+	for _, name := range cfg.Filters {
+		name = strings.TrimSpace(name)
+		factory, ok := registry[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown post-processing filter %q (available: %s)", name, strings.Join(registeredLocked(), ", "))
+		}
+		filter, err := factory(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("post-processing filter %s: %w", name, err)
+		}
+		p.names = append(p.names, name)
+		p.filters = append(p.filters, filter)
+	}
+	return p, nil
+}
+
+func registeredLocked() []string {
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Names returns the filters in the order they run.
+func (p *Pipeline) Names() []string {
+	if p == nil {
+		return nil
+	}
+	return append([]string(nil), p.names...)
+}
+
+// skipped reports whether a request that asked to opt out skips the filters.
+func (p *Pipeline) skipped(optOut bool) bool {
+	return p == nil || (optOut && p.allowOptOut)
+}
+
+// Apply runs every filter over a complete answer.
+func (p *Pipeline) Apply(answer string, optOut bool) string {
+	if p.skipped(optOut) {
+		return answer
+	}
+	for _, filter := range p.filters {
+		answer = filter.Apply(answer)
+	}
+	return answer
+}
+
+// Stream returns the function that filters the chunks of one streamed
+// answer. A chunk filtered down to "" should not be sent.
+func (p *Pipeline) Stream(optOut bool) func(chunk string) string {
+	if p.skipped(optOut) {
+		return func(chunk string) string { return chunk }
+	}
+	steps := make([]func(string) string, len(p.filters))
+	for i, filter := range p.filters {
+		if streamFilter, ok := filter.(StreamFilter); ok {
+			steps[i] = streamFilter.NewStream()
+		} else {
+			steps[i] = filter.Apply
+		}
+	}
+	return func(chunk string) string {
+		for _, step := range steps {
+			if chunk == "" {
+				return ""
+			}
+			chunk = step(chunk)
+		}
+		return chunk
+	}
+}
+
+func splitList(raw string) []string {
+	var items []string
+	for _, item := range strings.Split(strings.Trim(raw, "[]"), ",") {
+		if item = strings.Trim(strings.TrimSpace(item), "\"'"); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
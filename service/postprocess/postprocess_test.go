@@ -0,0 +1,139 @@
+package postprocess
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"gemini-wrapper/model"
+)
+
+func newPipeline(t *testing.T, cfg Config) *Pipeline {
+	t.Helper()
+	p, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return p
+}
+
+func TestStripMarkdown(t *testing.T) {
+	p := newPipeline(t, Config{Filters: []string{"strip_markdown"}})
+	in := "# Title\n\nSome **bold**, *italic* and `code` with a [link](https://example.com).\n> quoted\n```go\nfmt.Println(snake_case)\n```\n---\n- item\n"
+	want := "Title\n\nSome bold, italic and code with a link (https://example.com).\nquoted\nfmt.Println(snake_case)\n\n- item\n"
+	if got := p.Apply(in, false); got != want {
+		t.Fatalf("unexpected output:\n%q\nwant\n%q", got, want)
+	}
+}
+
+func TestRedactMasksEmailsKeysAndCustomPatterns(t *testing.T) {
+	p := newPipeline(t, Config{Filters: []string{"redact"}, RedactPatterns: []string{`\b\d{3}-\d{2}-\d{4}\b`}})
+	in := "Mail jane.doe@example.com, key AIza" + strings.Repeat("x", 35) + ", token sk-" + strings.Repeat("a", 24) + ", ssn 123-45-6789."
+	want := "Mail [REDACTED], key [REDACTED], token [REDACTED], ssn [REDACTED]."
+	if got := p.Apply(in, false); got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	if _, err := New(Config{Filters: []string{"redact"}, RedactPatterns: []string{"("}}); err == nil {
+		t.Fatal("expected an invalid pattern to be rejected")
+	}
+}
+
+func TestTruncateLimitsAnswersAndStreams(t *testing.T) {
+	p := newPipeline(t, Config{Filters: []string{"truncate"}, MaxLength: 5})
+	if got := p.Apply("héllo world", false); got != "héllo" {
+		t.Fatalf("got %q", got)
+	}
+
+	stream := p.Stream(false)
+	var got []string
+	for _, chunk := range []string{"abc\n", "def\n", "ghi\n"} {
+		got = append(got, stream(chunk))
+	}
+	if strings.Join(got, "|") != "abc\n|d|" {
+		t.Fatalf("unexpected stream output %q", got)
+	}
+	if _, err := New(Config{Filters: []string{"truncate"}}); err == nil {
+		t.Fatal("expected truncate without max_length to be rejected")
+	}
+}
+
+func TestProfanityMasksWordsWithSuffixes(t *testing.T) {
+	p := newPipeline(t, Config{Filters: []string{"profanity"}})
+	if got := p.Apply("What the Fucking shitshow, said Dickens.", false); got != "What the F****** s*******, said Dickens." {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestOptOutAndCustomFilters(t *testing.T) {
+	Register("upper", func(Config) (Filter, error) { return FilterFunc(strings.ToUpper), nil })
+	defer func() {
+		registryMu.Lock()
+		delete(registry, "upper")
+		registryMu.Unlock()
+	}()
+
+	p := newPipeline(t, Config{Filters: []string{"upper", "truncate"}, MaxLength: 3, AllowOptOut: true})
+	if got := p.Apply("hello", false); got != "HEL" {
+		t.Fatalf("got %q", got)
+	}
+	if got := p.Apply("hello", true); got != "hello" {
+		t.Fatalf("expected opt-out to skip the filters, got %q", got)
+	}
+
+	p = newPipeline(t, Config{Filters: []string{"upper"}})
+	if got := p.Apply("hello", true); got != "HELLO" {
+		t.Fatalf("expected opt-out to be ignored when not allowed, got %q", got)
+	}
+
+	if _, err := New(Config{Filters: []string{"nope"}}); err == nil || !strings.Contains(err.Error(), "strip_markdown") {
+		t.Fatalf("expected an unknown filter error listing the available ones, got %v", err)
+	}
+	var nilPipeline *Pipeline
+	if got := nilPipeline.Apply("hello", false); got != "hello" {
+		t.Fatalf("nil pipeline changed the answer: %q", got)
+	}
+}
+
+func TestFormatConvertsMarkdown(t *testing.T) {
+	in := "# Title\n\nSome **bold** & `<code>` with a [link](https://example.com) and [no](javascript:void).\nSecond line\n- one\n- two\n\n```go\nif a < b {}\n```\n1. first"
+	html := "<h1>Title</h1>\n<p>Some <strong>bold</strong> &amp; <code>&lt;code&gt;</code> with a <a href=\"https://example.com\">link</a> and no.\nSecond line</p>\n<ul>\n<li>one</li>\n<li>two</li>\n</ul>\n<pre><code class=\"language-go\">if a &lt; b {}\n</code></pre>\n<ol>\n<li>first</li>\n</ol>\n"
+	if got := Format(in, FormatHTML); got != html {
+		t.Fatalf("unexpected html:\n%q\nwant\n%q", got, html)
+	}
+	if got := Format("Some **bold**\n> quoted", FormatPlain); got != "Some bold\nquoted" {
+		t.Fatalf("unexpected plain text %q", got)
+	}
+	if got := Format(in, FormatMarkdown); got != in {
+		t.Fatalf("expected markdown unchanged, got %q", got)
+	}
+
+	convert, flush := FormatStream(FormatHTML)
+	var streamed strings.Builder
+	for _, chunk := range []string{"# Ti", "tle\n\nSome **bo", "ld** & `<code>` with a [link](https://example.com) and [no](javascript:void).\nSecond", " line\n- one\n- two\n\n```go\nif a < b {}\n```\n1. fi", "rst"} {
+		streamed.WriteString(convert(chunk))
+	}
+	streamed.WriteString(flush())
+	if streamed.String() != html {
+		t.Fatalf("expected the stream to match the answer, got %q", streamed.String())
+	}
+}
+
+func TestArtifactsParsesCodeBlocks(t *testing.T) {
+	in := "Here you go.\n\n**main.go**\n```go\npackage main\n```\n\n```python title=\"tools/run.py\"\nprint(1)\n```\n\n" +
+		"````markdown\n```sh\nls\n```\n````\n\n```\n// util/strings.js\nexport {}\n```\n\n```sh:../../etc/passwd\nrm -rf /\n```\n\n```json\n{\"unterminated\": true"
+	want := []model.Artifact{
+		{Filename: "main.go", Language: "go", Content: "package main\n"},
+		{Filename: "tools/run.py", Language: "python", Content: "print(1)\n"},
+		{Language: "markdown", Content: "```sh\nls\n```\n"},
+		{Filename: "util/strings.js", Content: "// util/strings.js\nexport {}\n"},
+		{Language: "sh", Content: "rm -rf /\n"},
+		{Language: "json", Content: "{\"unterminated\": true\n"},
+	}
+	if got := Artifacts(in); !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected artifacts:\n%#v\nwant\n%#v", got, want)
+	}
+	if got := Artifacts("no code, only ```inline``` code"); got != nil {
+		t.Fatalf("expected no artifacts, got %#v", got)
+	}
+}
@@ -0,0 +1,221 @@
+// Package ratelimit enforces per-client request and token quotas.
+package ratelimit
+
+import (
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gemini-wrapper/service/cluster"
+)
+
+// pruneEvery controls how often idle clients are dropped from memory.
+const pruneEvery = 1000
+
+type Config struct {
+	// RequestsPerMinute caps requests in any sliding 60-second window. 0 disables it.
+	RequestsPerMinute int `yaml:"requests_per_minute"`
+	// TokensPerDay caps tokens per UTC day. 0 disables it.
+	TokensPerDay int `yaml:"tokens_per_day"`
+}
+
+// ConfigFromEnv reads RATE_LIMIT_RPM and RATE_LIMIT_TOKENS_PER_DAY.
+func ConfigFromEnv() Config {
+	var cfg Config
+	cfg.ApplyEnv()
+	return cfg
+}
+
+// ApplyEnv overrides c with RATE_LIMIT_RPM and RATE_LIMIT_TOKENS_PER_DAY when set.
+func (c *Config) ApplyEnv() {
+	c.RequestsPerMinute = envInt("RATE_LIMIT_RPM", c.RequestsPerMinute)
+	c.TokensPerDay = envInt("RATE_LIMIT_TOKENS_PER_DAY", c.TokensPerDay)
+}
+
+// Enabled reports whether any limit is configured.
+func (c Config) Enabled() bool {
+	return c.RequestsPerMinute > 0 || c.TokensPerDay > 0
+}
+
+// ClientUsage is the admin view of one client's consumption.
+type ClientUsage struct {
+	Client             string    `json:"client"`
+	RequestsLastMinute int       `json:"requestsLastMinute"`
+	RequestsToday      int       `json:"requestsToday"`
+	TokensToday        int       `json:"tokensToday"`
+	Day                string    `json:"day"`
+	LastSeen           time.Time `json:"lastSeen"`
+}
+
+type UsageReport struct {
+	Enabled           bool          `json:"enabled"`
+	RequestsPerMinute int           `json:"requestsPerMinute"`
+	TokensPerDay      int           `json:"tokensPerDay"`
+	Clients           []ClientUsage `json:"clients"`
+}
+
+type clientState struct {
+	recent        []time.Time
+	day           string
+	requestsToday int
+	tokensToday   int
+	lastSeen      time.Time
+}
+
+type Limiter struct {
+	now func() time.Time
+	// shared keeps the counters in Redis instead of clients when set.
+	shared *cluster.Cluster
+
+	mu      sync.Mutex
+	cfg     Config
+	clients map[string]*clientState
+	calls   int
+}
+
+func NewLimiter(cfg Config) *Limiter {
+	return &Limiter{cfg: cfg, now: time.Now, clients: map[string]*clientState{}}
+}
+
+// SetConfig replaces the limits. The counters are kept, so a client that
+// used up a lowered quota is refused at once.
+func (l *Limiter) SetConfig(cfg Config) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.cfg = cfg
+}
+
+// config returns the limits in force.
+func (l *Limiter) config() Config {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.cfg
+}
+
+// Allow records a request for client. When a limit is exhausted it returns
+// false and how long the client should wait before retrying.
+func (l *Limiter) Allow(client string) (bool, time.Duration) {
+	return l.AllowWith(client, l.config())
+}
+
+// AllowWith is Allow with the limits of cfg instead of the configured ones,
+// for clients such as tenants that have limits of their own.
+func (l *Limiter) AllowWith(client string, cfg Config) (bool, time.Duration) {
+	if l.shared != nil {
+		return l.allowShared(client, cfg)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.calls++
+	if l.calls%pruneEvery == 0 {
+		l.pruneLocked(now)
+	}
+	state := l.stateLocked(client, now)
+
+	if cfg.TokensPerDay > 0 && state.tokensToday >= cfg.TokensPerDay {
+		return false, untilNextUTCDay(now)
+	}
+	if cfg.RequestsPerMinute > 0 && len(state.recent) >= cfg.RequestsPerMinute {
+		return false, state.recent[0].Add(time.Minute).Sub(now)
+	}
+
+	state.recent = append(state.recent, now)
+	state.requestsToday++
+	return true, 0
+}
+
+// AddTokens charges tokens to client's daily quota.
+func (l *Limiter) AddTokens(client string, tokens int) {
+	if tokens <= 0 {
+		return
+	}
+	if l.shared != nil {
+		l.addTokensShared(client, tokens)
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.stateLocked(client, l.now()).tokensToday += tokens
+}
+
+// Usage returns the current consumption of every known client.
+func (l *Limiter) Usage() UsageReport {
+	if l.shared != nil {
+		return l.usageShared()
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	report := UsageReport{Enabled: true, RequestsPerMinute: l.cfg.RequestsPerMinute, TokensPerDay: l.cfg.TokensPerDay, Clients: []ClientUsage{}}
+	for client, state := range l.clients {
+		state.roll(now)
+		report.Clients = append(report.Clients, ClientUsage{
+			Client:             client,
+			RequestsLastMinute: len(state.recent),
+			RequestsToday:      state.requestsToday,
+			TokensToday:        state.tokensToday,
+			Day:                state.day,
+			LastSeen:           state.lastSeen,
+		})
+	}
+	sort.Slice(report.Clients, func(i, j int) bool { return report.Clients[i].Client < report.Clients[j].Client })
+	return report
+}
+
+// stateLocked returns client's state, creating it if needed, and marks the
+// client as seen.
+func (l *Limiter) stateLocked(client string, now time.Time) *clientState {
+	state, ok := l.clients[client]
+	if !ok {
+		state = &clientState{}
+		l.clients[client] = state
+	}
+	state.lastSeen = now
+	state.roll(now)
+	return state
+}
+
+// roll drops window entries older than a minute and resets the daily
+// counters when the UTC day changed.
+func (state *clientState) roll(now time.Time) {
+	cutoff := now.Add(-time.Minute)
+	expired := 0
+	for expired < len(state.recent) && !state.recent[expired].After(cutoff) {
+		expired++
+	}
+	state.recent = state.recent[expired:]
+
+	if day := now.UTC().Format("2006-01-02"); state.day != day {
+		state.day = day
+		state.requestsToday = 0
+		state.tokensToday = 0
+	}
+}
+
+func (l *Limiter) pruneLocked(now time.Time) {
+	for client, state := range l.clients {
+		if now.Sub(state.lastSeen) > 24*time.Hour {
+			delete(l.clients, client)
+		}
+	}
+}
+
+func untilNextUTCDay(now time.Time) time.Duration {
+	utc := now.UTC()
+	next := time.Date(utc.Year(), utc.Month(), utc.Day()+1, 0, 0, 0, 0, time.UTC)
+	return next.Sub(utc)
+}
+
+func envInt(key string, defaultValue int) int {
+	parsed, err := strconv.Atoi(strings.TrimSpace(os.Getenv(key)))
+	if err != nil || parsed < 0 {
+		return defaultValue
+	}
+	return parsed
+}
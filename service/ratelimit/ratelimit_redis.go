@@ -0,0 +1,155 @@
+package ratelimit
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"sort"
+	"strconv"
+	"time"
+
+	"gemini-wrapper/service/cluster"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// sharedTimeout bounds each Redis round trip. Requests are let through when
+// Redis does not answer in time, like when it fails.
+const sharedTimeout = time.Second
+
+// dayTTL keeps daily counters past the end of their day, for the usage report.
+const dayTTL = 48 * time.Hour
+
+// allowScript checks and records a request atomically. KEYS are the client's
+// window, requests today, tokens today and the last-seen hash. ARGV are now in
+// milliseconds, the two limits, a unique window member, the client and the
+// daily counter TTL in seconds. It returns {1, 0} when allowed and {0, wait
+// in milliseconds} when not, where a wait of -1 means until the next day.
+var allowScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local rpm = tonumber(ARGV[2])
+local tokensPerDay = tonumber(ARGV[3])
+redis.call('HSET', KEYS[4], ARGV[5], now)
+if tokensPerDay > 0 and tonumber(redis.call('GET', KEYS[3]) or '0') >= tokensPerDay then
+  return {0, -1}
+end
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now - 60000)
+if rpm > 0 and redis.call('ZCARD', KEYS[1]) >= rpm then
+  local oldest = redis.call('ZRANGE', KEYS[1], 0, 0, 'WITHSCORES')
+  return {0, tonumber(oldest[2]) + 60000 - now}
+end
+redis.call('ZADD', KEYS[1], now, ARGV[4])
+redis.call('PEXPIRE', KEYS[1], 60000)
+redis.call('INCR', KEYS[2])
+redis.call('EXPIRE', KEYS[2], ARGV[6])
+return {1, 0}
+`)
+
+// NewSharedLimiter returns a limiter that keeps its counters in Redis, so
+// every replica enforces the same quotas.
+func NewSharedLimiter(cfg Config, shared *cluster.Cluster) *Limiter {
+	l := NewLimiter(cfg)
+	l.shared = shared
+	return l
+}
+
+func (l *Limiter) keys(client string, now time.Time) (window, requests, tokens, seen string) {
+	day := now.UTC().Format("2006-01-02")
+	return l.shared.Key("ratelimit", "window", client),
+		l.shared.Key("ratelimit", "requests", day, client),
+		l.shared.Key("ratelimit", "tokens", day, client),
+		l.shared.Key("ratelimit", "seen")
+}
+
+func (l *Limiter) allowShared(client string, cfg Config) (bool, time.Duration) {
+	now := l.now()
+	window, requests, tokens, seen := l.keys(client, now)
+	member := make([]byte, 8)
+	rand.Read(member)
+
+	ctx, cancel := context.WithTimeout(context.Background(), sharedTimeout)
+	defer cancel()
+	result, err := allowScript.Run(ctx, l.shared.Client(), []string{window, requests, tokens, seen},
+		now.UnixMilli(), cfg.RequestsPerMinute, cfg.TokensPerDay, hex.EncodeToString(member), client, int(dayTTL.Seconds())).Int64Slice()
+	if err != nil || len(result) != 2 {
+		slog.Warn("shared rate limit unavailable, allowing request", "client", client, "error", err)
+		return true, 0
+	}
+	switch {
+	case result[0] == 1:
+		return true, 0
+	case result[1] < 0:
+		return false, untilNextUTCDay(now)
+	}
+	return false, time.Duration(result[1]) * time.Millisecond
+}
+
+func (l *Limiter) addTokensShared(client string, tokens int) {
+	_, _, key, _ := l.keys(client, l.now())
+	ctx, cancel := context.WithTimeout(context.Background(), sharedTimeout)
+	defer cancel()
+	pipe := l.shared.Client().TxPipeline()
+	pipe.IncrBy(ctx, key, int64(tokens))
+	pipe.Expire(ctx, key, dayTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		slog.Warn("charging tokens to the shared rate limit failed", "client", client, "error", err)
+	}
+}
+
+// usageShared reports the clients any replica saw in the last day.
+func (l *Limiter) usageShared() UsageReport {
+	now := l.now()
+	cfg := l.config()
+	report := UsageReport{Enabled: true, RequestsPerMinute: cfg.RequestsPerMinute, TokensPerDay: cfg.TokensPerDay, Clients: []ClientUsage{}}
+	ctx, cancel := context.WithTimeout(context.Background(), sharedTimeout)
+	defer cancel()
+	_, _, _, seenKey := l.keys("", now)
+	seen, err := l.shared.Client().HGetAll(ctx, seenKey).Result()
+	if err != nil {
+		slog.Warn("reading shared rate limits failed", "error", err)
+		return report
+	}
+
+	type counters struct {
+		recent           *redis.IntCmd
+		requests, tokens *redis.StringCmd
+	}
+	pipe := l.shared.Client().Pipeline()
+	pending := map[string]counters{}
+	lastSeen := map[string]time.Time{}
+	var stale []string
+	for client, raw := range seen {
+		millis, _ := strconv.ParseInt(raw, 10, 64)
+		lastSeen[client] = time.UnixMilli(millis)
+		if now.Sub(lastSeen[client]) > 24*time.Hour {
+			stale = append(stale, client)
+			continue
+		}
+		window, requests, tokens, _ := l.keys(client, now)
+		pending[client] = counters{
+			recent:   pipe.ZCount(ctx, window, strconv.FormatInt(now.Add(-time.Minute).UnixMilli()+1, 10), "+inf"),
+			requests: pipe.Get(ctx, requests),
+			tokens:   pipe.Get(ctx, tokens),
+		}
+	}
+	if len(stale) > 0 {
+		pipe.HDel(ctx, seenKey, stale...)
+	}
+	// Missing counters read as redis.Nil, which is zero.
+	_, _ = pipe.Exec(ctx)
+	for client, c := range pending {
+		requests, _ := c.requests.Int()
+		tokens, _ := c.tokens.Int()
+		report.Clients = append(report.Clients, ClientUsage{
+			Client:             client,
+			RequestsLastMinute: int(c.recent.Val()),
+			RequestsToday:      requests,
+			TokensToday:        tokens,
+			Day:                now.UTC().Format("2006-01-02"),
+			LastSeen:           lastSeen[client],
+		})
+	}
+	sort.Slice(report.Clients, func(i, j int) bool { return report.Clients[i].Client < report.Clients[j].Client })
+	return report
+}
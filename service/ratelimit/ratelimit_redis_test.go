@@ -0,0 +1,55 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"gemini-wrapper/service/cluster"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func newTestCluster(t *testing.T) *cluster.Cluster {
+	t.Helper()
+	server := miniredis.RunT(t)
+	shared := cluster.New(redis.NewClient(&redis.Options{Addr: server.Addr()}), cluster.DefaultConfig())
+	t.Cleanup(func() { shared.Close() })
+	return shared
+}
+
+func TestSharedLimiterCountsRequestsOfEveryReplica(t *testing.T) {
+	shared := newTestCluster(t)
+	now := time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+	replicas := []*Limiter{
+		NewSharedLimiter(Config{RequestsPerMinute: 2, TokensPerDay: 100}, shared),
+		NewSharedLimiter(Config{RequestsPerMinute: 2, TokensPerDay: 100}, shared),
+	}
+	for _, l := range replicas {
+		l.now = func() time.Time { return now }
+	}
+
+	if ok, _ := replicas[0].Allow("key:a"); !ok {
+		t.Fatal("first request refused")
+	}
+	now = now.Add(10 * time.Second)
+	if ok, _ := replicas[1].Allow("key:a"); !ok {
+		t.Fatal("second request refused")
+	}
+	ok, retryAfter := replicas[0].Allow("key:a")
+	if ok || retryAfter != 50*time.Second {
+		t.Fatalf("expected a refusal for 50s, got ok=%v retryAfter=%s", ok, retryAfter)
+	}
+
+	now = now.Add(time.Minute)
+	replicas[1].AddTokens("key:a", 100)
+	ok, retryAfter = replicas[0].Allow("key:a")
+	if ok || retryAfter != untilNextUTCDay(now) {
+		t.Fatalf("expected the daily token quota to refuse, got ok=%v retryAfter=%s", ok, retryAfter)
+	}
+
+	report := replicas[1].Usage()
+	if len(report.Clients) != 1 || report.Clients[0].RequestsToday != 2 || report.Clients[0].TokensToday != 100 {
+		t.Fatalf("unexpected usage report: %#v", report)
+	}
+}
@@ -0,0 +1,83 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestLimiter(cfg Config, now *time.Time) *Limiter {
+	l := NewLimiter(cfg)
+	l.now = func() time.Time { return *now }
+	return l
+}
+
+func TestAllowEnforcesRequestsPerMinute(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	l := newTestLimiter(Config{RequestsPerMinute: 2}, &now)
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.Allow("ip:1"); !ok {
+			t.Fatalf("request %d should be allowed", i)
+		}
+		now = now.Add(10 * time.Second)
+	}
+	ok, retryAfter := l.Allow("ip:1")
+	if ok || retryAfter != 40*time.Second {
+		t.Fatalf("expected rejection with 40s retry, got ok=%v retry=%s", ok, retryAfter)
+	}
+	if ok, _ := l.Allow("ip:2"); !ok {
+		t.Fatal("other clients must not be affected")
+	}
+
+	now = now.Add(41 * time.Second)
+	if ok, _ := l.Allow("ip:1"); !ok {
+		t.Fatal("expected window to slide")
+	}
+}
+
+func TestSetConfigKeepsCounters(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	l := newTestLimiter(Config{RequestsPerMinute: 5}, &now)
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.Allow("ip:1"); !ok {
+			t.Fatalf("request %d should be allowed", i)
+		}
+	}
+
+	l.SetConfig(Config{RequestsPerMinute: 3})
+	if ok, _ := l.Allow("ip:1"); ok {
+		t.Fatal("expected the lowered limit to apply to the requests already made")
+	}
+	if report := l.Usage(); report.RequestsPerMinute != 3 {
+		t.Fatalf("expected the usage report to show the new limit, got %d", report.RequestsPerMinute)
+	}
+
+	l.SetConfig(Config{RequestsPerMinute: 10})
+	if ok, _ := l.Allow("ip:1"); !ok {
+		t.Fatal("expected the raised limit to allow the request")
+	}
+}
+
+func TestAllowEnforcesTokensPerDay(t *testing.T) {
+	now := time.Date(2026, 1, 1, 23, 0, 0, 0, time.UTC)
+	l := newTestLimiter(Config{TokensPerDay: 100}, &now)
+
+	if ok, _ := l.Allow("key:a"); !ok {
+		t.Fatal("first request should be allowed")
+	}
+	l.AddTokens("key:a", 120)
+	ok, retryAfter := l.Allow("key:a")
+	if ok || retryAfter != time.Hour {
+		t.Fatalf("expected rejection until midnight, got ok=%v retry=%s", ok, retryAfter)
+	}
+
+	report := l.Usage()
+	if len(report.Clients) != 1 || report.Clients[0].TokensToday != 120 || report.Clients[0].RequestsToday != 1 {
+		t.Fatalf("unexpected usage: %#v", report)
+	}
+
+	now = now.Add(time.Hour)
+	if ok, _ := l.Allow("key:a"); !ok {
+		t.Fatal("expected quota to reset on the next UTC day")
+	}
+}
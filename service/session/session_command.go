@@ -0,0 +1,139 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"gemini-wrapper/model"
+	"gemini-wrapper/pkg/gemini"
+)
+
+// Commands are the CLI slash commands Command answers. Every question runs
+// in a fresh headless CLI process, so there is no interactive CLI to type
+// them into; the wrapper reports what it knows about their subject instead,
+// which is not what the CLI would print.
+var Commands = []string{"/stats", "/memory show", "/tools", "/about"}
+
+// ReportSource is the Source of every SessionCommandResponse: the wrapper
+// built the report, the CLI did not run the command.
+const ReportSource = "wrapper"
+
+// ErrInvalidCommand is returned by Command for commands other than
+// Commands, and for /stats without a session.
+var ErrInvalidCommand = errors.New("invalid command")
+
+// CLIInfo is what the commands read about the CLI besides the session.
+// *gemini.GeminiService implements it.
+type CLIInfo interface {
+	GlobalContext() (model.ContextFile, error)
+	MCPServers() ([]gemini.MCPServerInfo, error)
+	Capabilities() gemini.Capabilities
+}
+
+// Stats is the report of /stats.
+type Stats struct {
+	Model     string `json:"model,omitempty"`
+	Questions int    `json:"questions"`
+	Messages  int    `json:"messages"`
+	// HistoryTokens estimates the history replayed with every question.
+	HistoryTokens int       `json:"history_tokens"`
+	Recycles      int       `json:"recycles"`
+	Compressions  int       `json:"compressions"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// Memory is the report of /memory show: the GEMINI.md files the CLI reads
+// for the questions of the session, global first.
+type Memory struct {
+	Files []model.ContextFile `json:"files"`
+	// Tokens estimates the content of the files.
+	Tokens int `json:"tokens"`
+}
+
+// Tools is the report of /tools. The CLI discovers the tools of the MCP
+// servers itself on every run, so it lists the servers and their filters.
+type Tools struct {
+	MCPServers []gemini.MCPServerInfo `json:"mcp_servers"`
+}
+
+// Command answers a CLI slash command, like "/stats", for the session id
+// with the wrapper's report on its subject. /tools and /about need no
+// session; /memory show without one shows the global GEMINI.md.
+func (m *Manager) Command(id, command string, cli CLIInfo) (model.SessionCommandResponse, error) {
+	command = strings.Join(strings.Fields(command), " ")
+	if command == "/memory" {
+		command = "/memory show"
+	}
+	resp := model.SessionCommandResponse{SessionID: id, Command: command, Source: ReportSource}
+
+	var s *session
+	if id != "" {
+		var ok bool
+		if s, ok = m.lookup(id); !ok {
+			return resp, ErrSessionNotFound
+		}
+	}
+	var err error
+	switch command {
+	case "/stats":
+		if s == nil {
+			return resp, fmt.Errorf("%w: /stats needs a session_id", ErrInvalidCommand)
+		}
+		resp.Report = s.stats()
+	case "/memory show":
+		resp.Report, err = memory(s, cli)
+	case "/tools":
+		var tools Tools
+		tools.MCPServers, err = cli.MCPServers()
+		resp.Report = tools
+	case "/about":
+		resp.Report = cli.Capabilities()
+	default:
+		return resp, fmt.Errorf("%w %q: use one of %s", ErrInvalidCommand, command, strings.Join(Commands, ", "))
+	}
+	return resp, err
+}
+
+func (s *session) stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := Stats{
+		Model:         s.model,
+		Messages:      len(s.messages),
+		HistoryTokens: gemini.EstimateTokens(transcript(s.messages)),
+		Recycles:      s.recycles,
+		Compressions:  s.compressions,
+		CreatedAt:     s.createdAt,
+		UpdatedAt:     s.updatedAt,
+	}
+	for _, message := range s.messages {
+		if message.Role == "user" {
+			stats.Questions++
+		}
+	}
+	return stats
+}
+
+func memory(s *session, cli CLIInfo) (Memory, error) {
+	out := Memory{Files: []model.ContextFile{}}
+	global, err := cli.GlobalContext()
+	if err != nil {
+		return out, err
+	}
+	files := []model.ContextFile{global}
+	if s != nil {
+		s.mu.Lock()
+		files = append(files, s.contextFile())
+		s.mu.Unlock()
+	}
+	for _, file := range files {
+		if file.Content != "" {
+			out.Files = append(out.Files, file)
+			out.Tokens += gemini.EstimateTokens(file.Content)
+		}
+	}
+	return out, nil
+}
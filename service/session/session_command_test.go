@@ -0,0 +1,71 @@
+package session
+
+import (
+	"errors"
+	"testing"
+
+	"gemini-wrapper/model"
+	"gemini-wrapper/pkg/gemini"
+)
+
+type fakeCLI struct{ global string }
+
+func (f fakeCLI) GlobalContext() (model.ContextFile, error) {
+	return model.ContextFile{Scope: model.ContextGlobal, Content: f.global}, nil
+}
+
+func (fakeCLI) MCPServers() ([]gemini.MCPServerInfo, error) {
+	return []gemini.MCPServerInfo{{Name: "github", Transport: "stdio", Target: "github-mcp"}}, nil
+}
+
+func (fakeCLI) Capabilities() gemini.Capabilities {
+	return gemini.Capabilities{Backend: "mock"}
+}
+
+func TestCommandAnswersTheIntrospectionCommands(t *testing.T) {
+	manager := NewManager(&recordingGeminiService{answer: "ok"}, Config{})
+	info, err := manager.Create(model.CreateSessionRequest{Model: "gemini-2.5-pro", Context: "Answer in French."})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	for _, question := range []string{"first", "second"} {
+		if _, _, err := manager.Ask(t.Context(), info.ID, question); err != nil {
+			t.Fatalf("Ask: %v", err)
+		}
+	}
+	cli := fakeCLI{global: "Be brief."}
+
+	resp, err := manager.Command(info.ID, " /stats ", cli)
+	if err != nil {
+		t.Fatalf("/stats: %v", err)
+	}
+	stats := resp.Report.(Stats)
+	if resp.Command != "/stats" || resp.Source != ReportSource || stats.Model != "gemini-2.5-pro" || stats.Questions != 2 || stats.Messages != 4 || stats.HistoryTokens == 0 {
+		t.Fatalf("unexpected /stats: %+v", resp)
+	}
+
+	resp, err = manager.Command(info.ID, "/memory", cli)
+	if err != nil {
+		t.Fatalf("/memory: %v", err)
+	}
+	memory := resp.Report.(Memory)
+	if resp.Command != "/memory show" || len(memory.Files) != 2 || memory.Files[0].Content != "Be brief." || memory.Files[1].Content != "Answer in French." {
+		t.Fatalf("unexpected /memory show: %+v", resp)
+	}
+	if resp, err := manager.Command("", "/memory show", cli); err != nil || len(resp.Report.(Memory).Files) != 1 {
+		t.Fatalf("expected the global file alone without a session, got %+v %v", resp, err)
+	}
+	if resp, err := manager.Command("", "/tools", cli); err != nil || resp.Report.(Tools).MCPServers[0].Name != "github" {
+		t.Fatalf("unexpected /tools: %+v %v", resp, err)
+	}
+
+	if _, err := manager.Command(info.ID, "/quit", cli); !errors.Is(err, ErrInvalidCommand) {
+		t.Fatalf("expected ErrInvalidCommand, got %v", err)
+	}
+	if _, err := manager.Command("", "/stats", cli); !errors.Is(err, ErrInvalidCommand) {
+		t.Fatalf("expected /stats to need a session, got %v", err)
+	}
+	if _, err := manager.Command("sess_missing", "/stats", cli); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected ErrSessionNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,89 @@
+package session
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"gemini-wrapper/metrics"
+	"gemini-wrapper/model"
+)
+
+// closeLocked deletes s, or hides it until Reap removes it Retention later.
+// Either way the other replicas stop routing its requests here. The caller
+// holds m.mu.
+func (m *Manager) closeLocked(s *session) {
+	s.mu.Lock()
+	// Questions waiting for the session see it is gone.
+	s.deletedAt = m.now()
+	if m.cfg.Retention > 0 {
+		m.saveLocked(s)
+	}
+	s.mu.Unlock()
+	if m.cfg.Retention <= 0 {
+		m.removeLocked(s.id)
+	}
+	if err := m.shared.ReleaseSession(context.Background(), s.id); err != nil {
+		slog.Warn("releasing session in Redis failed", "session", s.id, "error", err)
+	}
+}
+
+// removeLocked deletes session id and its history for good. The caller holds
+// m.mu.
+func (m *Manager) removeLocked(id string) {
+	delete(m.sessions, id)
+	if m.store != nil {
+		if err := m.store.Delete(id); err != nil {
+			slog.Warn("deleting session failed", "session", id, "error", err)
+		}
+	}
+}
+
+// Restore brings back a session of tenant deleted, or closed for idleness,
+// less than Retention ago. A session that was not deleted is returned as is.
+func (m *Manager) Restore(id, tenant string) (model.SessionInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[id]
+	if !ok || s.tenant != tenant {
+		return model.SessionInfo{}, ErrSessionNotFound
+	}
+	if s.deleted() {
+		s.mu.Lock()
+		s.deletedAt = time.Time{}
+		s.updatedAt = m.now()
+		m.saveLocked(s)
+		s.mu.Unlock()
+		m.claim(id)
+	}
+	return s.info(), nil
+}
+
+// Reap closes the sessions unused for IdleTTL and removes the sessions
+// deleted Retention ago. Sessions answering a question are left alone.
+func (m *Manager) Reap() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	for id, s := range m.sessions {
+		s.mu.Lock()
+		deletedAt, updatedAt := s.deletedAt, s.updatedAt
+		s.mu.Unlock()
+		if !deletedAt.IsZero() {
+			if now.Sub(deletedAt) >= m.cfg.Retention {
+				m.removeLocked(id)
+				metrics.Reclaimed.Inc("session")
+			}
+			continue
+		}
+		if m.cfg.IdleTTL <= 0 || now.Sub(updatedAt) < m.cfg.IdleTTL || !s.askMu.TryLock() {
+			continue
+		}
+		m.closeLocked(s)
+		s.askMu.Unlock()
+		slog.Info("idle session closed", "session", id, "idle", now.Sub(updatedAt).Round(time.Second))
+		if m.cfg.Retention <= 0 {
+			metrics.Reclaimed.Inc("session")
+		}
+	}
+}
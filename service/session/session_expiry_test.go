@@ -0,0 +1,115 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gemini-wrapper/model"
+)
+
+func TestReapClosesIdleSessionsAndPurgesThemAfterRetention(t *testing.T) {
+	manager := NewManager(&recordingGeminiService{answer: "ok"}, Config{IdleTTL: time.Hour, Retention: 24 * time.Hour})
+	now := time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+	manager.now = func() time.Time { return now }
+
+	idle, _ := manager.Create(model.CreateSessionRequest{Tenant: "acme"})
+	busy, _ := manager.Create(model.CreateSessionRequest{})
+	now = now.Add(30 * time.Minute)
+	active, _ := manager.Create(model.CreateSessionRequest{})
+
+	// A session answering a question is not closed under it.
+	manager.sessions[busy.ID].askMu.Lock()
+	now = now.Add(45 * time.Minute)
+	manager.Reap()
+	manager.sessions[busy.ID].askMu.Unlock()
+
+	if _, err := manager.Get(idle.ID); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected the idle session to be closed, got %v", err)
+	}
+	if _, _, err := manager.Ask(context.Background(), idle.ID, "hi"); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected a closed session to refuse questions, got %v", err)
+	}
+	if len(manager.List()) != 2 {
+		t.Fatalf("expected the busy and the active session to be listed, got %+v", manager.List())
+	}
+	if _, err := manager.Get(active.ID); err != nil {
+		t.Fatalf("expected the active session to stay, got %v", err)
+	}
+
+	if _, err := manager.Restore(idle.ID, ""); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected another tenant's session not to be found, got %v", err)
+	}
+	restored, err := manager.Restore(idle.ID, "acme")
+	if err != nil || restored.ID != idle.ID {
+		t.Fatalf("Restore: %+v %v", restored, err)
+	}
+	if _, _, err := manager.Ask(context.Background(), idle.ID, "hi"); err != nil {
+		t.Fatalf("expected a restored session to answer, got %v", err)
+	}
+
+	if err := manager.Delete(active.ID); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	now = now.Add(23 * time.Hour)
+	manager.Reap()
+	if _, ok := manager.sessions[active.ID]; !ok {
+		t.Fatal("expected a deleted session to be kept for the retention period")
+	}
+	now = now.Add(2 * time.Hour)
+	manager.Reap()
+	if _, ok := manager.sessions[active.ID]; ok {
+		t.Fatal("expected a deleted session to be purged after the retention period")
+	}
+	if _, err := manager.Restore(active.ID, ""); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected a purged session not to be found, got %v", err)
+	}
+}
+
+func TestReapWithoutRetentionRemovesIdleSessions(t *testing.T) {
+	manager := NewManager(&recordingGeminiService{answer: "ok"}, Config{IdleTTL: time.Hour})
+	now := time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+	manager.now = func() time.Time { return now }
+
+	info, _ := manager.Create(model.CreateSessionRequest{})
+	now = now.Add(2 * time.Hour)
+	manager.Reap()
+	if len(manager.sessions) != 0 {
+		t.Fatalf("expected the idle session to be removed, got %d sessions", len(manager.sessions))
+	}
+	if _, err := manager.Restore(info.ID, ""); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected ErrSessionNotFound, got %v", err)
+	}
+}
+
+func TestDeletedSessionsCanBeRestoredAfterARestart(t *testing.T) {
+	cfg := Config{Path: filepath.Join(t.TempDir(), "sessions.db"), Retention: time.Hour}
+	manager, err := Open(&recordingGeminiService{answer: "ok"}, cfg)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	info, _ := manager.Create(model.CreateSessionRequest{})
+	if err := manager.Delete(info.ID); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := manager.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	restarted, err := Open(&recordingGeminiService{answer: "ok"}, cfg)
+	if err != nil {
+		t.Fatalf("Open again: %v", err)
+	}
+	defer restarted.Close()
+	if _, err := restarted.Get(info.ID); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected the deleted session to stay hidden, got %v", err)
+	}
+	if _, err := restarted.Restore(info.ID, ""); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	if _, err := restarted.Get(info.ID); err != nil {
+		t.Fatalf("expected the restored session, got %v", err)
+	}
+}
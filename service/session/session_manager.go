@@ -0,0 +1,524 @@
+package session
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gemini-wrapper/model"
+	"gemini-wrapper/pkg/gemini"
+	"gemini-wrapper/service/cluster"
+	"gemini-wrapper/service/storage"
+)
+
+// compressPrompt asks for the summary that replaces the history of a session,
+// the way the CLI's /compress command summarizes its chat.
+const compressPrompt = "Summarize the conversation below so the summary can replace it as the context of the next questions. " +
+	"Keep every fact, decision, name, number, preference and open question the next answers may depend on; drop repetition and small talk. " +
+	"Answer with the summary only.\n\n"
+
+// summaryPrefix introduces the summary in the compressed history.
+const summaryPrefix = "Summary of the conversation so far:\n"
+
+var (
+	// ErrSessionNotFound is returned when a session ID is unknown or was deleted.
+	ErrSessionNotFound = errors.New("session not found")
+	// ErrInvalidTranscript is returned by Import for transcripts it cannot replay.
+	ErrInvalidTranscript = errors.New("invalid transcript")
+	// ErrEnvNotAllowed is returned by Create for environment variables the
+	// server does not let sessions set.
+	ErrEnvNotAllowed = errors.New("environment variable not allowed")
+)
+
+// Config sets when a session is recycled: its history is cleared while its
+// ID, model, system prompt and context are kept, so the prompt replayed for
+// every question stops growing. Every question runs in a fresh CLI process,
+// so nothing else carries over between questions or sessions.
+type Config struct {
+	// MaxTurns recycles a session before a question once its history holds
+	// this many questions. 0 disables it.
+	MaxTurns int `yaml:"max_turns"`
+	// IdleReset recycles a session before a question when it was last used
+	// this long ago. 0 disables it.
+	IdleReset time.Duration `yaml:"idle_reset"`
+	// AllowedEnv are the environment variables a session may set for its
+	// CLI processes. The defaults select the account or project a session
+	// uses; anything that could change what the CLI runs is left out.
+	AllowedEnv []string `yaml:"allowed_env"`
+	// Path is the database Open keeps sessions in, so they survive
+	// restarts. Empty keeps them in memory only.
+	Path string `yaml:"path"`
+	// IdleTTL closes a session, when Reap runs, once it was last used this
+	// long ago. 0, the default, keeps sessions until they are deleted.
+	IdleTTL time.Duration `yaml:"idle_ttl"`
+	// Retention keeps deleted and closed sessions this long, hidden, so
+	// Restore can bring them back before Reap removes them for good. 0, the
+	// default, removes them at once.
+	Retention time.Duration `yaml:"retention"`
+}
+
+func DefaultConfig() Config {
+	return Config{
+		AllowedEnv: []string{"GEMINI_API_KEY", "GOOGLE_API_KEY", "GOOGLE_CLOUD_PROJECT", "GOOGLE_CLOUD_LOCATION", "GOOGLE_GENAI_USE_VERTEXAI"},
+		Path:       "/app/cache/sessions.db",
+	}
+}
+
+// ApplyEnv overrides c with the SESSION_* environment variables that are set.
+func (c *Config) ApplyEnv() {
+	c.MaxTurns = envInt("SESSION_MAX_TURNS", c.MaxTurns)
+	c.IdleReset = envSeconds("SESSION_IDLE_RESET_SECONDS", c.IdleReset)
+	if raw, ok := os.LookupEnv("SESSION_ALLOWED_ENV"); ok {
+		c.AllowedEnv = nil
+		for _, name := range strings.Split(raw, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				c.AllowedEnv = append(c.AllowedEnv, name)
+			}
+		}
+	}
+	if path, ok := os.LookupEnv("SESSION_PATH"); ok {
+		c.Path = strings.TrimSpace(path)
+	}
+	c.IdleTTL = envSeconds("SESSION_IDLE_TTL_SECONDS", c.IdleTTL)
+	c.Retention = envSeconds("SESSION_RETENTION_SECONDS", c.Retention)
+}
+
+// Manager keeps multi-turn conversations and replays the history of a
+// session as context for every new question.
+type Manager struct {
+	mu            sync.Mutex
+	geminiService gemini.Asker
+	cfg           Config
+	now           func() time.Time
+	sessions      map[string]*session
+	// store is nil for a manager that keeps sessions in memory only.
+	store storage.Store
+	// db is the sessions file of Config.Path, set by Open only; a manager
+	// from OpenStorage does not own its database.
+	db *storage.DB
+	// shared routes the requests for these sessions from other replicas
+	// here when set.
+	shared *cluster.Cluster
+}
+
+type session struct {
+	askMu sync.Mutex // serializes questions within the session
+
+	mu      sync.Mutex
+	id      string
+	tenant  string
+	model   string
+	system  string
+	context string
+	// env is set on the CLI process of every question of the session.
+	env       map[string]string
+	createdAt time.Time
+	updatedAt time.Time
+	messages  []model.SessionMessage
+	recycles  int
+	// compressions counts the histories replaced by their summary.
+	compressions int
+	// deletedAt is set once the session is deleted or closed for idleness;
+	// it is kept for Retention from then on.
+	deletedAt time.Time
+}
+
+func NewManager(geminiService gemini.Asker, cfg Config) *Manager {
+	return &Manager{
+		geminiService: geminiService,
+		cfg:           cfg,
+		now:           time.Now,
+		sessions:      map[string]*session{},
+	}
+}
+
+// SetCluster makes the manager claim its sessions in Redis, so the other
+// replicas forward their requests to this one. Call it before serving
+// requests.
+func (m *Manager) SetCluster(shared *cluster.Cluster) {
+	m.shared = shared
+}
+
+// claim records this replica as the holder of session id, and keeps the
+// record alive while the session is used.
+func (m *Manager) claim(id string) {
+	if err := m.shared.ClaimSession(context.Background(), id); err != nil {
+		slog.Warn("claiming session in Redis failed", "session", id, "error", err)
+	}
+}
+
+// Create starts a new empty session.
+func (m *Manager) Create(req model.CreateSessionRequest) (model.SessionInfo, error) {
+	for name := range req.Env {
+		if !slices.Contains(m.cfg.AllowedEnv, name) {
+			return model.SessionInfo{}, fmt.Errorf("%w: %s", ErrEnvNotAllowed, name)
+		}
+	}
+	id, err := newSessionID()
+	if err != nil {
+		return model.SessionInfo{}, err
+	}
+
+	now := m.now()
+	s := &session{
+		id:        id,
+		tenant:    req.Tenant,
+		model:     strings.TrimSpace(req.Model),
+		system:    strings.TrimSpace(req.System),
+		context:   req.Context,
+		env:       maps.Clone(req.Env),
+		createdAt: now,
+		updatedAt: now,
+	}
+	s.mu.Lock()
+	m.saveLocked(s)
+	s.mu.Unlock()
+
+	m.mu.Lock()
+	m.sessions[id] = s
+	m.mu.Unlock()
+	m.claim(id)
+	return s.info(), nil
+}
+
+// List returns all sessions ordered by creation time.
+func (m *Manager) List() []model.SessionInfo {
+	m.mu.Lock()
+	sessions := make([]*session, 0, len(m.sessions))
+	for _, s := range m.sessions {
+		if !s.deleted() {
+			sessions = append(sessions, s)
+		}
+	}
+	m.mu.Unlock()
+
+	infos := make([]model.SessionInfo, 0, len(sessions))
+	for _, s := range sessions {
+		infos = append(infos, s.info())
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].CreatedAt.Before(infos[j].CreatedAt)
+	})
+	return infos
+}
+
+// Get returns a single session.
+func (m *Manager) Get(id string) (model.SessionInfo, error) {
+	s, ok := m.lookup(id)
+	if !ok {
+		return model.SessionInfo{}, ErrSessionNotFound
+	}
+	return s.info(), nil
+}
+
+// History returns a session with all its messages.
+func (m *Manager) History(id string) (model.SessionTranscript, error) {
+	s, ok := m.lookup(id)
+	if !ok {
+		return model.SessionTranscript{}, ErrSessionNotFound
+	}
+	info := s.info()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return model.SessionTranscript{SessionInfo: info, Messages: append([]model.SessionMessage{}, s.messages...)}, nil
+}
+
+// Import starts a new session seeded with the tenant, model, system prompt,
+// context and messages of transcript, typically exported from another
+// instance. The transcript's ID and counters are ignored; messages without a
+// timestamp get the current time.
+func (m *Manager) Import(transcript model.SessionTranscript) (model.SessionInfo, error) {
+	now := m.now()
+	messages := make([]model.SessionMessage, 0, len(transcript.Messages))
+	for i, message := range transcript.Messages {
+		if message.Role != "user" && message.Role != "assistant" {
+			return model.SessionInfo{}, fmt.Errorf("%w: messages[%d].role must be \"user\" or \"assistant\"", ErrInvalidTranscript, i)
+		}
+		if strings.TrimSpace(message.Content) == "" {
+			return model.SessionInfo{}, fmt.Errorf("%w: messages[%d].content must not be empty", ErrInvalidTranscript, i)
+		}
+		if message.CreatedAt.IsZero() {
+			message.CreatedAt = now
+		}
+		messages = append(messages, message)
+	}
+
+	id, err := newSessionID()
+	if err != nil {
+		return model.SessionInfo{}, err
+	}
+	s := &session{
+		id:        id,
+		tenant:    transcript.Tenant,
+		model:     strings.TrimSpace(transcript.Model),
+		system:    strings.TrimSpace(transcript.System),
+		context:   transcript.Context,
+		createdAt: now,
+		updatedAt: now,
+		messages:  messages,
+	}
+	s.mu.Lock()
+	m.saveLocked(s)
+	s.mu.Unlock()
+
+	m.mu.Lock()
+	m.sessions[id] = s
+	m.mu.Unlock()
+	m.claim(id)
+	return s.info(), nil
+}
+
+// Delete removes a session and its history, or hides them for Retention.
+func (m *Manager) Delete(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[id]
+	if !ok || s.deleted() {
+		return ErrSessionNotFound
+	}
+	m.closeLocked(s)
+	return nil
+}
+
+// Ask sends question with the session history as context and records both
+// turns on success. Questions within one session are serialized. A session
+// due for recycling starts the question with an empty history.
+func (m *Manager) Ask(ctx context.Context, id string, question string) (string, *model.GeminiStatus, error) {
+	s, ok := m.lookup(id)
+	if !ok {
+		return "", nil, ErrSessionNotFound
+	}
+	question = strings.TrimSpace(question)
+	m.claim(id)
+
+	s.askMu.Lock()
+	defer s.askMu.Unlock()
+	// The session may have been closed while the question waited.
+	if s.deleted() {
+		return "", nil, ErrSessionNotFound
+	}
+
+	s.mu.Lock()
+	m.recycleLocked(s)
+	prompt := buildPrompt(s.system, s.messages, question)
+	opts := model.AskOptions{Model: s.model, Context: s.context, Env: s.env, SessionID: id}
+	s.mu.Unlock()
+
+	answer, status, err := m.geminiService.AskWithOptions(ctx, prompt, opts)
+	if err != nil {
+		return "", status, err
+	}
+
+	now := m.now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = append(s.messages,
+		model.SessionMessage{Role: "user", Content: question, CreatedAt: now},
+		model.SessionMessage{Role: "assistant", Content: answer, CreatedAt: now},
+	)
+	s.updatedAt = now
+	m.saveLocked(s)
+	return answer, status, nil
+}
+
+// Compress replaces the history of a session by a summary the model writes
+// of it, so the prompt replayed for its next questions shrinks while what
+// they need to know is kept. It waits for a question in progress. The
+// history is kept when it is empty or the summary is not shorter.
+func (m *Manager) Compress(ctx context.Context, id string) (model.SessionCompressResponse, *model.GeminiStatus, error) {
+	s, ok := m.lookup(id)
+	if !ok {
+		return model.SessionCompressResponse{}, nil, ErrSessionNotFound
+	}
+	m.claim(id)
+
+	s.askMu.Lock()
+	defer s.askMu.Unlock()
+	if s.deleted() {
+		return model.SessionCompressResponse{}, nil, ErrSessionNotFound
+	}
+
+	s.mu.Lock()
+	history := transcript(s.messages)
+	result := model.SessionCompressResponse{
+		SessionID:      id,
+		TokensBefore:   gemini.EstimateTokens(history),
+		MessagesBefore: len(s.messages),
+	}
+	opts := model.AskOptions{Model: s.model, Context: s.context, Env: s.env, SessionID: id}
+	s.mu.Unlock()
+	result.TokensAfter, result.MessagesAfter = result.TokensBefore, result.MessagesBefore
+	if result.MessagesBefore == 0 {
+		return result, nil, nil
+	}
+
+	summary, status, err := m.geminiService.AskWithOptions(ctx, compressPrompt+history, opts)
+	if err != nil {
+		return result, status, err
+	}
+	compressed := []model.SessionMessage{{Role: "user", Content: summaryPrefix + strings.TrimSpace(summary), CreatedAt: m.now()}}
+	tokens := gemini.EstimateTokens(transcript(compressed))
+	if strings.TrimSpace(summary) == "" || tokens >= result.TokensBefore {
+		slog.InfoContext(ctx, "session history not compressed: the summary is not shorter", "session", id, "tokens", result.TokensBefore, "summary_tokens", tokens)
+		return result, status, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = compressed
+	s.compressions++
+	s.updatedAt = m.now()
+	m.saveLocked(s)
+	result.Compressed, result.TokensAfter, result.MessagesAfter = true, tokens, len(compressed)
+	return result, status, nil
+}
+
+// Context returns the GEMINI.md of a session.
+func (m *Manager) Context(id string) (model.ContextFile, error) {
+	s, ok := m.lookup(id)
+	if !ok {
+		return model.ContextFile{}, ErrSessionNotFound
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.contextFile(), nil
+}
+
+// SetContext replaces the GEMINI.md of a session for its next questions. A
+// blank content removes it.
+func (m *Manager) SetContext(id, content string) (model.ContextFile, error) {
+	s, ok := m.lookup(id)
+	if !ok {
+		return model.ContextFile{}, ErrSessionNotFound
+	}
+	if strings.TrimSpace(content) == "" {
+		content = ""
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.context = content
+	s.updatedAt = m.now()
+	m.saveLocked(s)
+	return s.contextFile(), nil
+}
+
+// recycleLocked clears the history of s when it reached MaxTurns questions or
+// was idle for IdleReset. The caller holds s.mu.
+func (m *Manager) recycleLocked(s *session) {
+	if len(s.messages) == 0 {
+		return
+	}
+	turns := 0
+	for _, message := range s.messages {
+		if message.Role == "user" {
+			turns++
+		}
+	}
+	full := m.cfg.MaxTurns > 0 && turns >= m.cfg.MaxTurns
+	idle := m.cfg.IdleReset > 0 && m.now().Sub(s.updatedAt) >= m.cfg.IdleReset
+	if !full && !idle {
+		return
+	}
+	s.messages = nil
+	s.recycles++
+}
+
+func (s *session) contextFile() model.ContextFile {
+	file := model.ContextFile{Scope: model.ContextSession, ID: s.id, Content: s.context}
+	if s.context != "" {
+		updatedAt := s.updatedAt
+		file.UpdatedAt = &updatedAt
+	}
+	return file
+}
+
+// lookup returns session id unless it was deleted.
+func (m *Manager) lookup(id string) (*session, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[id]
+	if !ok || s.deleted() {
+		return nil, false
+	}
+	return s, true
+}
+
+func (s *session) deleted() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.deletedAt.IsZero()
+}
+
+func (s *session) info() model.SessionInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return model.SessionInfo{
+		ID:           s.id,
+		Tenant:       s.tenant,
+		Model:        s.model,
+		System:       s.system,
+		Context:      s.context,
+		Env:          slices.Sorted(maps.Keys(s.env)),
+		CreatedAt:    s.createdAt,
+		UpdatedAt:    s.updatedAt,
+		MessageCount: len(s.messages),
+		Recycles:     s.recycles,
+		Compressions: s.compressions,
+	}
+}
+
+func buildPrompt(system string, history []model.SessionMessage, question string) string {
+	parts := make([]string, 0, len(history)+2)
+	if system != "" {
+		parts = append(parts, "system: "+system)
+	}
+	if len(history) > 0 {
+		parts = append(parts, transcript(history))
+	}
+	parts = append(parts, "user: "+question)
+	return strings.Join(parts, "\n")
+}
+
+// transcript renders history the way it is replayed to the model.
+func transcript(history []model.SessionMessage) string {
+	lines := make([]string, 0, len(history))
+	for _, m := range history {
+		lines = append(lines, fmt.Sprintf("%s: %s", m.Role, m.Content))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func newSessionID() (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "sess_" + hex.EncodeToString(b), nil
+}
+
+func envInt(key string, defaultValue int) int {
+	parsed, err := strconv.Atoi(strings.TrimSpace(os.Getenv(key)))
+	if err != nil || parsed < 0 {
+		return defaultValue
+	}
+	return parsed
+}
+
+func envSeconds(key string, defaultValue time.Duration) time.Duration {
+	parsed, err := strconv.Atoi(strings.TrimSpace(os.Getenv(key)))
+	if err != nil || parsed < 0 {
+		return defaultValue
+	}
+	return time.Duration(parsed) * time.Second
+}
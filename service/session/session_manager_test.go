@@ -0,0 +1,341 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gemini-wrapper/model"
+)
+
+type recordingGeminiService struct {
+	prompts  []string
+	models   []string
+	contexts []string
+	envs     []map[string]string
+	sessions []string
+	answer   string
+	err      error
+}
+
+func (r *recordingGeminiService) Ask(_ context.Context, question string, modelName string) (string, *model.GeminiStatus, error) {
+	r.prompts = append(r.prompts, question)
+	r.models = append(r.models, modelName)
+	if r.err != nil {
+		return "", nil, r.err
+	}
+	return r.answer, nil, nil
+}
+
+func (r *recordingGeminiService) AskWithEnv(question string, modelName string, _ map[string]string) (string, *model.GeminiStatus, error) {
+	return r.Ask(context.Background(), question, modelName)
+}
+
+func (r *recordingGeminiService) AskWithOptions(ctx context.Context, question string, opts model.AskOptions) (string, *model.GeminiStatus, error) {
+	r.contexts = append(r.contexts, opts.Context)
+	r.envs = append(r.envs, opts.Env)
+	r.sessions = append(r.sessions, opts.SessionID)
+	return r.Ask(ctx, question, opts.Model)
+}
+
+func (r *recordingGeminiService) AskStream(ctx context.Context, question string, modelName string, onChunk func(chunk string) error) (string, *model.GeminiStatus, error) {
+	answer, status, err := r.Ask(ctx, question, modelName)
+	if err == nil {
+		err = onChunk(answer)
+	}
+	return answer, status, err
+}
+
+func TestAskReplaysHistory(t *testing.T) {
+	svc := &recordingGeminiService{answer: "ok"}
+	manager := NewManager(svc, Config{})
+
+	info, err := manager.Create(model.CreateSessionRequest{Model: "gemini-2.5-pro", System: "be brief"})
+	if err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	if _, _, err := manager.Ask(context.Background(), info.ID, "first"); err != nil {
+		t.Fatalf("first ask failed: %v", err)
+	}
+	if _, _, err := manager.Ask(context.Background(), info.ID, "second"); err != nil {
+		t.Fatalf("second ask failed: %v", err)
+	}
+
+	want := "system: be brief\nuser: first\nassistant: ok\nuser: second"
+	if svc.prompts[1] != want {
+		t.Fatalf("unexpected replayed prompt: got=%q want=%q", svc.prompts[1], want)
+	}
+	if svc.models[1] != "gemini-2.5-pro" {
+		t.Fatalf("expected session model, got %q", svc.models[1])
+	}
+	if svc.sessions[1] != info.ID {
+		t.Fatalf("expected the session ID in the options, got %q", svc.sessions[1])
+	}
+
+	got, err := manager.Get(info.ID)
+	if err != nil || got.MessageCount != 4 {
+		t.Fatalf("unexpected session info: %#v err=%v", got, err)
+	}
+}
+
+func TestAskFailureDoesNotRecordHistory(t *testing.T) {
+	svc := &recordingGeminiService{err: errors.New("boom")}
+	manager := NewManager(svc, Config{})
+
+	info, _ := manager.Create(model.CreateSessionRequest{})
+	if _, _, err := manager.Ask(context.Background(), info.ID, "question"); err == nil {
+		t.Fatal("expected error")
+	}
+	got, _ := manager.Get(info.ID)
+	if got.MessageCount != 0 {
+		t.Fatalf("expected empty history, got %d messages", got.MessageCount)
+	}
+}
+
+func TestDeleteAndUnknownSession(t *testing.T) {
+	manager := NewManager(&recordingGeminiService{answer: "ok"}, Config{})
+
+	info, _ := manager.Create(model.CreateSessionRequest{})
+	if !strings.HasPrefix(info.ID, "sess_") {
+		t.Fatalf("unexpected session id: %q", info.ID)
+	}
+	if len(manager.List()) != 1 {
+		t.Fatal("expected one session")
+	}
+	if err := manager.Delete(info.ID); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	if err := manager.Delete(info.ID); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected ErrSessionNotFound, got %v", err)
+	}
+	if _, _, err := manager.Ask(context.Background(), info.ID, "hi"); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected ErrSessionNotFound, got %v", err)
+	}
+}
+
+func TestHistoryExportsAndImportSeedsNewSession(t *testing.T) {
+	svc := &recordingGeminiService{answer: "ok"}
+	source := NewManager(svc, Config{})
+	info, _ := source.Create(model.CreateSessionRequest{Model: "gemini-2.5-pro", System: "be brief"})
+	if _, _, err := source.Ask(context.Background(), info.ID, "first"); err != nil {
+		t.Fatalf("ask failed: %v", err)
+	}
+
+	transcript, err := source.History(info.ID)
+	if err != nil || len(transcript.Messages) != 2 || transcript.Messages[1].Content != "ok" || transcript.System != "be brief" {
+		t.Fatalf("unexpected history: %#v err=%v", transcript, err)
+	}
+
+	target := NewManager(svc, Config{})
+	imported, err := target.Import(transcript)
+	if err != nil {
+		t.Fatalf("import failed: %v", err)
+	}
+	if imported.ID == info.ID || imported.MessageCount != 2 || imported.Model != "gemini-2.5-pro" {
+		t.Fatalf("unexpected imported session: %#v", imported)
+	}
+	if _, _, err := target.Ask(context.Background(), imported.ID, "second"); err != nil {
+		t.Fatalf("ask on imported session failed: %v", err)
+	}
+	if want := "system: be brief\nuser: first\nassistant: ok\nuser: second"; svc.prompts[1] != want {
+		t.Fatalf("imported history not replayed: got=%q want=%q", svc.prompts[1], want)
+	}
+
+	if _, err := target.History("sess_missing"); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected ErrSessionNotFound, got %v", err)
+	}
+	bad := model.SessionTranscript{Messages: []model.SessionMessage{{Role: "system", Content: "x"}}}
+	if _, err := target.Import(bad); !errors.Is(err, ErrInvalidTranscript) {
+		t.Fatalf("expected ErrInvalidTranscript, got %v", err)
+	}
+}
+
+func TestSessionContextReachesEveryQuestion(t *testing.T) {
+	svc := &recordingGeminiService{answer: "ok"}
+	manager := NewManager(svc, Config{})
+	info, err := manager.Create(model.CreateSessionRequest{Context: "Answer in French."})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, _, err := manager.Ask(context.Background(), info.ID, "hello"); err != nil {
+		t.Fatalf("Ask: %v", err)
+	}
+
+	file, err := manager.SetContext(info.ID, "Answer in German.")
+	if err != nil || file.Scope != model.ContextSession || file.ID != info.ID || file.UpdatedAt == nil {
+		t.Fatalf("unexpected context %#v, %v", file, err)
+	}
+	if _, _, err := manager.Ask(context.Background(), info.ID, "again"); err != nil {
+		t.Fatalf("Ask: %v", err)
+	}
+	if _, err := manager.SetContext(info.ID, "  "); err != nil {
+		t.Fatalf("SetContext: %v", err)
+	}
+	if _, _, err := manager.Ask(context.Background(), info.ID, "last"); err != nil {
+		t.Fatalf("Ask: %v", err)
+	}
+
+	want := []string{"Answer in French.", "Answer in German.", ""}
+	if strings.Join(svc.contexts, "|") != strings.Join(want, "|") {
+		t.Fatalf("expected contexts %q, got %q", want, svc.contexts)
+	}
+	if _, err := manager.Context("sess_missing"); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected ErrSessionNotFound, got %v", err)
+	}
+}
+
+func TestSessionEnvReachesEveryQuestion(t *testing.T) {
+	svc := &recordingGeminiService{answer: "ok"}
+	manager := NewManager(svc, DefaultConfig())
+	env := map[string]string{"GEMINI_API_KEY": "key-b", "GOOGLE_CLOUD_PROJECT": "proj"}
+	info, err := manager.Create(model.CreateSessionRequest{Env: env})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if strings.Join(info.Env, ",") != "GEMINI_API_KEY,GOOGLE_CLOUD_PROJECT" {
+		t.Fatalf("expected the env names only, got %q", info.Env)
+	}
+	env["GEMINI_API_KEY"] = "changed"
+	if _, _, err := manager.Ask(context.Background(), info.ID, "hello"); err != nil {
+		t.Fatalf("Ask: %v", err)
+	}
+	if len(svc.envs) != 1 || svc.envs[0]["GEMINI_API_KEY"] != "key-b" {
+		t.Fatalf("unexpected envs %v", svc.envs)
+	}
+
+	if _, err := manager.Create(model.CreateSessionRequest{Env: map[string]string{"NODE_OPTIONS": "--require /tmp/x.js"}}); !errors.Is(err, ErrEnvNotAllowed) {
+		t.Fatalf("expected ErrEnvNotAllowed, got %v", err)
+	}
+}
+
+func TestAskRecyclesSessionsAfterMaxTurnsAndWhenIdle(t *testing.T) {
+	svc := &recordingGeminiService{answer: "ok"}
+	manager := NewManager(svc, Config{MaxTurns: 2, IdleReset: time.Hour})
+	now := time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+	manager.now = func() time.Time { return now }
+
+	info, _ := manager.Create(model.CreateSessionRequest{System: "be brief"})
+	for _, question := range []string{"one", "two", "three"} {
+		if _, _, err := manager.Ask(context.Background(), info.ID, question); err != nil {
+			t.Fatalf("Ask: %v", err)
+		}
+	}
+	if want := "system: be brief\nuser: three"; svc.prompts[2] != want {
+		t.Fatalf("expected a recycled history after two turns, got %q", svc.prompts[2])
+	}
+
+	now = now.Add(2 * time.Hour)
+	if _, _, err := manager.Ask(context.Background(), info.ID, "four"); err != nil {
+		t.Fatalf("Ask: %v", err)
+	}
+	if want := "system: be brief\nuser: four"; svc.prompts[3] != want {
+		t.Fatalf("expected a recycled history after the idle time, got %q", svc.prompts[3])
+	}
+	got, _ := manager.Get(info.ID)
+	if got.Recycles != 2 || got.MessageCount != 2 {
+		t.Fatalf("expected two recycles and one turn, got %#v", got)
+	}
+}
+
+func TestCompressReplacesHistoryWithItsSummary(t *testing.T) {
+	svc := &recordingGeminiService{answer: strings.Repeat("a long answer ", 20)}
+	manager := NewManager(svc, Config{})
+	info, _ := manager.Create(model.CreateSessionRequest{System: "be brief"})
+
+	result, _, err := manager.Compress(context.Background(), info.ID)
+	if err != nil || result.Compressed || result.MessagesBefore != 0 || len(svc.prompts) != 0 {
+		t.Fatalf("empty history: result %#v err=%v prompts %d", result, err, len(svc.prompts))
+	}
+
+	for _, question := range []string{"one", "two"} {
+		if _, _, err := manager.Ask(context.Background(), info.ID, question); err != nil {
+			t.Fatalf("Ask: %v", err)
+		}
+	}
+	svc.answer = "We talked about one and two."
+	result, _, err = manager.Compress(context.Background(), info.ID)
+	if err != nil {
+		t.Fatalf("Compress: %v", err)
+	}
+	if !result.Compressed || result.MessagesBefore != 4 || result.MessagesAfter != 1 || result.TokensAfter >= result.TokensBefore {
+		t.Fatalf("unexpected result %#v", result)
+	}
+	if prompt := svc.prompts[2]; !strings.HasPrefix(prompt, compressPrompt) || !strings.Contains(prompt, "user: two") || strings.Contains(prompt, "be brief") {
+		t.Fatalf("unexpected compress prompt %q", prompt)
+	}
+
+	if _, _, err := manager.Ask(context.Background(), info.ID, "three"); err != nil {
+		t.Fatalf("Ask: %v", err)
+	}
+	if want := "system: be brief\nuser: " + summaryPrefix + "We talked about one and two.\nuser: three"; svc.prompts[3] != want {
+		t.Fatalf("expected the summary to be replayed, got %q", svc.prompts[3])
+	}
+	if got, _ := manager.Get(info.ID); got.Compressions != 1 {
+		t.Fatalf("expected one compression, got %#v", got)
+	}
+
+	// A summary that is not shorter keeps the history.
+	svc.answer = strings.Repeat("longer than the history ", 50)
+	result, _, err = manager.Compress(context.Background(), info.ID)
+	if err != nil || result.Compressed || result.MessagesAfter != 3 || result.TokensAfter != result.TokensBefore {
+		t.Fatalf("unexpected result %#v err=%v", result, err)
+	}
+
+	if _, _, err := manager.Compress(context.Background(), "missing"); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected ErrSessionNotFound, got %v", err)
+	}
+}
+
+func TestSessionsSurviveARestart(t *testing.T) {
+	cfg := Config{Path: filepath.Join(t.TempDir(), "sessions.db"), AllowedEnv: []string{"GEMINI_API_KEY"}}
+	svc := &recordingGeminiService{answer: "4"}
+	manager, err := Open(svc, cfg)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	kept, err := manager.Create(model.CreateSessionRequest{Model: "gemini-2.5-pro", System: "Be terse.", Env: map[string]string{"GEMINI_API_KEY": "k"}})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, _, err := manager.Ask(context.Background(), kept.ID, "2+2?"); err != nil {
+		t.Fatalf("Ask: %v", err)
+	}
+	if _, err := manager.SetContext(kept.ID, "# Notes"); err != nil {
+		t.Fatalf("SetContext: %v", err)
+	}
+	deleted, _ := manager.Create(model.CreateSessionRequest{})
+	if err := manager.Delete(deleted.ID); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := manager.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	restarted, err := Open(svc, cfg)
+	if err != nil {
+		t.Fatalf("Open again: %v", err)
+	}
+	defer restarted.Close()
+	if _, err := restarted.Get(deleted.ID); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected the deleted session to stay deleted, got %v", err)
+	}
+	history, err := restarted.History(kept.ID)
+	if err != nil {
+		t.Fatalf("History: %v", err)
+	}
+	if history.Model != "gemini-2.5-pro" || history.Context != "# Notes" || len(history.Messages) != 2 || history.Messages[1].Content != "4" {
+		t.Fatalf("unexpected restored session: %+v", history)
+	}
+	if _, _, err := restarted.Ask(context.Background(), kept.ID, "and 3+3?"); err != nil {
+		t.Fatalf("Ask: %v", err)
+	}
+	if prompt := svc.prompts[len(svc.prompts)-1]; !strings.Contains(prompt, "system: Be terse.\nuser: 2+2?\nassistant: 4\nuser: and 3+3?") {
+		t.Fatalf("expected the restored history in the prompt, got %q", prompt)
+	}
+	if env := svc.envs[len(svc.envs)-1]; env["GEMINI_API_KEY"] != "k" {
+		t.Fatalf("expected the restored env, got %v", env)
+	}
+}
@@ -0,0 +1,132 @@
+package session
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"gemini-wrapper/model"
+	"gemini-wrapper/pkg/gemini"
+	"gemini-wrapper/service/storage"
+)
+
+// StoreName is the store of the sessions in the database.
+const StoreName = "sessions"
+
+// record is a session as the database keeps it.
+type record struct {
+	ID           string                 `json:"id"`
+	Tenant       string                 `json:"tenant,omitempty"`
+	Model        string                 `json:"model,omitempty"`
+	System       string                 `json:"system,omitempty"`
+	Context      string                 `json:"context,omitempty"`
+	Env          map[string]string      `json:"env,omitempty"`
+	CreatedAt    time.Time              `json:"created_at"`
+	UpdatedAt    time.Time              `json:"updated_at"`
+	Messages     []model.SessionMessage `json:"messages,omitempty"`
+	Recycles     int                    `json:"recycles,omitempty"`
+	Compressions int                    `json:"compressions,omitempty"`
+	// DeletedAt is set on the sessions kept for Config.Retention.
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+// Open returns a manager that keeps its sessions in the Bolt database at
+// cfg.Path, or in memory when the path is empty, with the sessions of the
+// previous process restored.
+func Open(geminiService gemini.Asker, cfg Config) (*Manager, error) {
+	if cfg.Path == "" {
+		return NewManager(geminiService, cfg), nil
+	}
+	db, err := storage.Open(cfg.Path)
+	if err != nil {
+		return nil, err
+	}
+	store, err := db.Store(StoreName)
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	m, err := OpenStorage(geminiService, cfg, store)
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	m.db = db
+	return m, nil
+}
+
+// OpenStorage is Open with the sessions kept in store, such as a store of
+// the database all features share.
+func OpenStorage(geminiService gemini.Asker, cfg Config, store storage.Store) (*Manager, error) {
+	m := NewManager(geminiService, cfg)
+	if err := store.ForEach("", "", func(_ string, raw []byte) error {
+		var rec record
+		if err := json.Unmarshal(raw, &rec); err != nil {
+			return fmt.Errorf("decode session: %w", err)
+		}
+		m.sessions[rec.ID] = &session{
+			id:           rec.ID,
+			tenant:       rec.Tenant,
+			model:        rec.Model,
+			system:       rec.System,
+			context:      rec.Context,
+			env:          rec.Env,
+			createdAt:    rec.CreatedAt,
+			updatedAt:    rec.UpdatedAt,
+			messages:     rec.Messages,
+			recycles:     rec.Recycles,
+			compressions: rec.Compressions,
+		}
+		if rec.DeletedAt != nil {
+			m.sessions[rec.ID].deletedAt = *rec.DeletedAt
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	m.store = store
+	if len(m.sessions) > 0 {
+		slog.Info("sessions restored", "sessions", len(m.sessions))
+	}
+	return m, nil
+}
+
+// saveLocked writes s to the database, if any. The caller holds s.mu.
+func (m *Manager) saveLocked(s *session) {
+	if m.store == nil {
+		return
+	}
+	rec := record{
+		ID:           s.id,
+		Tenant:       s.tenant,
+		Model:        s.model,
+		System:       s.system,
+		Context:      s.context,
+		Env:          s.env,
+		CreatedAt:    s.createdAt,
+		UpdatedAt:    s.updatedAt,
+		Messages:     s.messages,
+		Recycles:     s.recycles,
+		Compressions: s.compressions,
+	}
+	if !s.deletedAt.IsZero() {
+		deletedAt := s.deletedAt
+		rec.DeletedAt = &deletedAt
+	}
+	raw, err := json.Marshal(rec)
+	if err == nil {
+		err = m.store.Put(s.id, raw)
+	}
+	if err != nil {
+		slog.Warn("saving session failed", "session", s.id, "error", err)
+	}
+}
+
+// Close closes the database Open opened.
+func (m *Manager) Close() error {
+	if m == nil {
+		return nil
+	}
+	return m.db.Close()
+}
@@ -0,0 +1,244 @@
+// Package storage keeps the state of the server in one embedded Bolt
+// database, so sessions, jobs, templates, idempotency keys and usage
+// counters survive restarts. Each feature gets a Store of its own: a sorted
+// key-value collection in a bucket named after it. Stores bring migrations
+// that run once when they are opened, recorded by name in the database.
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// schemaBucket records the migrations applied to each store, keyed by
+// "<store>/<migration>".
+const schemaBucket = "_schema"
+
+// Config selects the database the stores of the server share.
+type Config struct {
+	// Path is the Bolt database shared by all stores. Empty keeps every
+	// feature in the database its own path names.
+	Path string `yaml:"path"`
+}
+
+func DefaultConfig() Config {
+	return Config{}
+}
+
+// ApplyEnv overrides c with the STORAGE_* environment variables that are set.
+func (c *Config) ApplyEnv() {
+	if path, ok := os.LookupEnv("STORAGE_PATH"); ok {
+		c.Path = strings.TrimSpace(path)
+	}
+}
+
+// Store is a collection of values ordered by key. Values passed to
+// callbacks are only valid until the callback returns.
+type Store interface {
+	// Get returns the value of key, or nil when there is none.
+	Get(key string) ([]byte, error)
+	Put(key string, value []byte) error
+	Delete(keys ...string) error
+	// ForEach calls fn in key order for the keys from from up to, not
+	// including, to. Empty bounds leave that end open.
+	ForEach(from, to string, fn func(key string, value []byte) error) error
+	// Update runs fn in one transaction: its writes are applied together
+	// or, when it fails, not at all.
+	Update(fn func(tx Store) error) error
+}
+
+// Migration changes the data of a store once. Migrations are applied in the
+// order they are passed to DB.Store, each in the transaction that records
+// it, and are known by their names.
+type Migration struct {
+	Name string
+	Up   func(tx Store) error
+}
+
+// DB is a Bolt database holding stores.
+type DB struct {
+	path string
+	bolt *bbolt.DB
+}
+
+// Open opens the Bolt database at path, creating it and its directory if
+// needed.
+func Open(path string) (*DB, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	db, err := bbolt.Open(path, 0o600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	return &DB{path: path, bolt: db}, nil
+}
+
+// Path returns the file of the database.
+func (d *DB) Path() string {
+	return d.path
+}
+
+// Store returns the store called name, creating it if needed, after applying
+// the migrations it has not seen yet.
+func (d *DB) Store(name string, migrations ...Migration) (Store, error) {
+	err := d.bolt.Update(func(tx *bbolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(name))
+		if err != nil {
+			return err
+		}
+		schema, err := tx.CreateBucketIfNotExists([]byte(schemaBucket))
+		if err != nil {
+			return err
+		}
+		for _, migration := range migrations {
+			key := []byte(name + "/" + migration.Name)
+			if schema.Get(key) != nil {
+				continue
+			}
+			if err := migration.Up(txStore{bucket}); err != nil {
+				return fmt.Errorf("migrate %s: %s: %w", name, migration.Name, err)
+			}
+			if err := schema.Put(key, []byte(time.Now().UTC().Format(time.RFC3339))); err != nil {
+				return err
+			}
+			slog.Info("storage migration applied", "store", name, "migration", migration.Name, "path", d.path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return boltStore{db: d.bolt, bucket: []byte(name)}, nil
+}
+
+// Close closes the database. It is a no-op for a nil DB.
+func (d *DB) Close() error {
+	if d == nil {
+		return nil
+	}
+	return d.bolt.Close()
+}
+
+// Import is the migration that copies the bucket called name of the Bolt
+// database at path, such as the database a feature kept before the stores
+// were shared. It does nothing when the file does not exist.
+func Import(path, name string) Migration {
+	return Migration{
+		Name: "import " + path,
+		Up: func(tx Store) error {
+			if path == "" {
+				return nil
+			}
+			if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			source, err := bbolt.Open(path, 0o600, &bbolt.Options{Timeout: time.Second, ReadOnly: true})
+			if err != nil {
+				return err
+			}
+			defer source.Close()
+			return source.View(func(sourceTx *bbolt.Tx) error {
+				bucket := sourceTx.Bucket([]byte(name))
+				if bucket == nil {
+					return nil
+				}
+				return bucket.ForEach(func(key, value []byte) error {
+					// Bolt keeps the value until the commit, after the
+					// source is closed.
+					return tx.Put(string(key), bytes.Clone(value))
+				})
+			})
+		},
+	}
+}
+
+// boltStore is a bucket of a database; every call is a transaction.
+type boltStore struct {
+	db     *bbolt.DB
+	bucket []byte
+}
+
+func (s boltStore) Get(key string) ([]byte, error) {
+	var value []byte
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		value = bytes.Clone(tx.Bucket(s.bucket).Get([]byte(key)))
+		return nil
+	})
+	return value, err
+}
+
+func (s boltStore) Put(key string, value []byte) error {
+	return s.Update(func(tx Store) error { return tx.Put(key, value) })
+}
+
+func (s boltStore) Delete(keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	return s.Update(func(tx Store) error { return tx.Delete(keys...) })
+}
+
+func (s boltStore) ForEach(from, to string, fn func(key string, value []byte) error) error {
+	return s.db.View(func(tx *bbolt.Tx) error {
+		return txStore{tx.Bucket(s.bucket)}.ForEach(from, to, fn)
+	})
+}
+
+func (s boltStore) Update(fn func(tx Store) error) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return fn(txStore{tx.Bucket(s.bucket)})
+	})
+}
+
+// txStore is a bucket within a transaction.
+type txStore struct {
+	bucket *bbolt.Bucket
+}
+
+func (s txStore) Get(key string) ([]byte, error) {
+	return bytes.Clone(s.bucket.Get([]byte(key))), nil
+}
+
+func (s txStore) Put(key string, value []byte) error {
+	return s.bucket.Put([]byte(key), value)
+}
+
+func (s txStore) Delete(keys ...string) error {
+	for _, key := range keys {
+		if err := s.bucket.Delete([]byte(key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s txStore) ForEach(from, to string, fn func(key string, value []byte) error) error {
+	cursor := s.bucket.Cursor()
+	key, value := cursor.First()
+	if from != "" {
+		key, value = cursor.Seek([]byte(from))
+	}
+	for ; key != nil; key, value = cursor.Next() {
+		if to != "" && string(key) >= to {
+			return nil
+		}
+		if err := fn(string(key), value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Update runs fn in the transaction already open.
+func (s txStore) Update(fn func(tx Store) error) error {
+	return fn(s)
+}
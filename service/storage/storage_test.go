@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func keys(t *testing.T, store Store, from, to string) string {
+	t.Helper()
+	var got []string
+	if err := store.ForEach(from, to, func(key string, value []byte) error {
+		got = append(got, key+"="+string(value))
+		return nil
+	}); err != nil {
+		t.Fatalf("ForEach: %v", err)
+	}
+	return strings.Join(got, ",")
+}
+
+func TestStoreKeepsValuesInKeyOrder(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer db.Close()
+	store, err := db.Store("things")
+	if err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	for _, key := range []string{"c", "a", "b", "d"} {
+		if err := store.Put(key, []byte(strings.ToUpper(key))); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+	if value, err := store.Get("b"); err != nil || string(value) != "B" {
+		t.Fatalf("expected B, got %q %v", value, err)
+	}
+	if value, err := store.Get("missing"); err != nil || value != nil {
+		t.Fatalf("expected nothing, got %q %v", value, err)
+	}
+	if got := keys(t, store, "b", "d"); got != "b=B,c=C" {
+		t.Fatalf("unexpected range: %s", got)
+	}
+	if err := store.Delete("a", "c"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if got := keys(t, store, "", ""); got != "b=B,d=D" {
+		t.Fatalf("unexpected entries: %s", got)
+	}
+
+	boom := errors.New("boom")
+	err = store.Update(func(tx Store) error {
+		if err := tx.Put("e", []byte("E")); err != nil {
+			return err
+		}
+		return boom
+	})
+	if !errors.Is(err, boom) {
+		t.Fatalf("expected the error of the update, got %v", err)
+	}
+	if value, _ := store.Get("e"); value != nil {
+		t.Fatalf("expected a failed update to write nothing, got %q", value)
+	}
+}
+
+func TestMigrationsRunOnceAndImportOldDatabases(t *testing.T) {
+	dir := t.TempDir()
+	legacy, err := Open(filepath.Join(dir, "templates.db"))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	old, err := legacy.Store("templates")
+	if err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	if err := old.Put("greeting", []byte("hello")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	legacy.Close()
+
+	runs := 0
+	migrations := []Migration{
+		Import(filepath.Join(dir, "templates.db"), "templates"),
+		Import(filepath.Join(dir, "missing.db"), "templates"),
+		{Name: "uppercase", Up: func(tx Store) error {
+			runs++
+			value, err := tx.Get("greeting")
+			if err != nil {
+				return err
+			}
+			return tx.Put("greeting", []byte(strings.ToUpper(string(value))))
+		}},
+	}
+	path := filepath.Join(dir, "state.db")
+	for range 2 {
+		db, err := Open(path)
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		store, err := db.Store("templates", migrations...)
+		if err != nil {
+			t.Fatalf("Store: %v", err)
+		}
+		if got := keys(t, store, "", ""); got != "greeting=HELLO" {
+			t.Fatalf("unexpected entries: %s", got)
+		}
+		db.Close()
+	}
+	if runs != 1 {
+		t.Fatalf("expected the migration to run once, ran %d times", runs)
+	}
+
+	db, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer db.Close()
+	failing := Migration{Name: "broken", Up: func(tx Store) error {
+		_ = tx.Put("half", []byte("done"))
+		return errors.New("boom")
+	}}
+	if _, err := db.Store("templates", failing); err == nil || !strings.Contains(err.Error(), "broken") {
+		t.Fatalf("expected the failed migration, got %v", err)
+	}
+	store, err := db.Store("templates")
+	if err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	if value, _ := store.Get("half"); value != nil {
+		t.Fatalf("expected a failed migration to write nothing, got %q", value)
+	}
+}
@@ -0,0 +1,275 @@
+// Package templates stores the prompt templates served under /api/templates
+// and renders them into questions, so teams can keep their prompt engineering
+// in the wrapper instead of in every client.
+package templates
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"gemini-wrapper/model"
+	"gemini-wrapper/service/storage"
+)
+
+const (
+	// StoreName is the store of the templates in the database.
+	StoreName = "templates"
+	// maxTemplateSize bounds a stored template and maxPromptSize a rendered
+	// prompt, so a template looping over a large range cannot exhaust memory.
+	maxTemplateSize = 64 << 10
+	maxPromptSize   = 1 << 20
+)
+
+var (
+	ErrTemplateNotFound = errors.New("template not found")
+	ErrTemplateExists   = errors.New("template already exists")
+	ErrInvalidTemplate  = errors.New("invalid template")
+
+	validName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,63}$`)
+)
+
+type Config struct {
+	// Path is the Bolt database holding the templates. Empty keeps them in
+	// memory only.
+	Path string `yaml:"path"`
+}
+
+func DefaultConfig() Config {
+	return Config{Path: "/app/cache/templates.db"}
+}
+
+// ApplyEnv overrides c with the TEMPLATES_* environment variables that are set.
+func (c *Config) ApplyEnv() {
+	if path, ok := os.LookupEnv("TEMPLATES_PATH"); ok {
+		c.Path = strings.TrimSpace(path)
+	}
+}
+
+type entry struct {
+	info   model.PromptTemplate
+	parsed *template.Template
+}
+
+// Store keeps templates in memory, backed by a Bolt database when opened with
+// a path.
+type Store struct {
+	store storage.Store
+	// db is set when the templates have a file of their own, opened by
+	// Open; templates in a shared database leave it to its owner.
+	db  *storage.DB
+	now func() time.Time
+
+	mu        sync.RWMutex
+	templates map[string]*entry
+}
+
+// NewMemoryStore returns a store that loses its templates on restart.
+func NewMemoryStore() *Store {
+	return &Store{now: time.Now, templates: map[string]*entry{}}
+}
+
+// Open loads the templates stored at cfg.Path, creating the database if
+// needed. An empty path returns a memory store.
+func Open(cfg Config) (*Store, error) {
+	if cfg.Path == "" {
+		return NewMemoryStore(), nil
+	}
+	db, err := storage.Open(cfg.Path)
+	if err != nil {
+		return nil, err
+	}
+	store, err := db.Store(StoreName)
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	s, err := OpenStorage(store)
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	s.db = db
+	return s, nil
+}
+
+// OpenStorage loads the templates kept in store, such as a store of the
+// database all features share.
+func OpenStorage(store storage.Store) (*Store, error) {
+	s := NewMemoryStore()
+	err := store.ForEach("", "", func(key string, value []byte) error {
+		var info model.PromptTemplate
+		if err := json.Unmarshal(value, &info); err != nil {
+			return fmt.Errorf("template %s: %w", key, err)
+		}
+		parsed, err := parse(info.Name, info.Template)
+		if err != nil {
+			return err
+		}
+		s.templates[info.Name] = &entry{info: info, parsed: parsed}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.store = store
+	return s, nil
+}
+
+// Close closes the database Open opened. It is a no-op for other stores.
+func (s *Store) Close() error {
+	if s == nil {
+		return nil
+	}
+	return s.db.Close()
+}
+
+func parse(name, text string) (*template.Template, error) {
+	if strings.TrimSpace(text) == "" {
+		return nil, fmt.Errorf("%w: template must not be empty", ErrInvalidTemplate)
+	}
+	if len(text) > maxTemplateSize {
+		return nil, fmt.Errorf("%w: template exceeds %d bytes", ErrInvalidTemplate, maxTemplateSize)
+	}
+	parsed, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidTemplate, err)
+	}
+	return parsed, nil
+}
+
+// List returns the templates ordered by name.
+func (s *Store) List() []model.PromptTemplate {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := make([]model.PromptTemplate, 0, len(s.templates))
+	for _, e := range s.templates {
+		list = append(list, e.info)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+func (s *Store) Get(name string) (model.PromptTemplate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	e, ok := s.templates[name]
+	if !ok {
+		return model.PromptTemplate{}, fmt.Errorf("%w: %s", ErrTemplateNotFound, name)
+	}
+	return e.info, nil
+}
+
+// Create stores a new template and fails with ErrTemplateExists if the name
+// is taken.
+func (s *Store) Create(name, description, text string) (model.PromptTemplate, error) {
+	info, _, err := s.save(name, description, text, false)
+	return info, err
+}
+
+// Put creates or replaces a template and reports whether it was created.
+func (s *Store) Put(name, description, text string) (model.PromptTemplate, bool, error) {
+	return s.save(name, description, text, true)
+}
+
+func (s *Store) save(name, description, text string, replace bool) (model.PromptTemplate, bool, error) {
+	if !validName.MatchString(name) {
+		return model.PromptTemplate{}, false, fmt.Errorf("%w: name must be 1-64 letters, digits, '.', '_' or '-'", ErrInvalidTemplate)
+	}
+	parsed, err := parse(name, text)
+	if err != nil {
+		return model.PromptTemplate{}, false, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now().UTC()
+	info := model.PromptTemplate{Name: name, Description: description, Template: text, CreatedAt: now, UpdatedAt: now}
+	previous, exists := s.templates[name]
+	if exists {
+		if !replace {
+			return model.PromptTemplate{}, false, fmt.Errorf("%w: %s", ErrTemplateExists, name)
+		}
+		info.CreatedAt = previous.info.CreatedAt
+	}
+	if err := s.persist(name, &info); err != nil {
+		return model.PromptTemplate{}, false, err
+	}
+	s.templates[name] = &entry{info: info, parsed: parsed}
+	return info, !exists, nil
+}
+
+func (s *Store) persist(name string, info *model.PromptTemplate) error {
+	if s.store == nil {
+		return nil
+	}
+	if info == nil {
+		return s.store.Delete(name)
+	}
+	raw, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return s.store.Put(name, raw)
+}
+
+func (s *Store) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.templates[name]; !ok {
+		return fmt.Errorf("%w: %s", ErrTemplateNotFound, name)
+	}
+	if err := s.persist(name, nil); err != nil {
+		return err
+	}
+	delete(s.templates, name)
+	return nil
+}
+
+// Render executes the named template with variables. question is available
+// as {{.question}} unless variables set it. Missing variables are an error.
+func (s *Store) Render(name string, variables map[string]any, question string) (string, error) {
+	if s == nil {
+		return "", fmt.Errorf("%w: templates are not enabled", ErrTemplateNotFound)
+	}
+	s.mu.RLock()
+	e, ok := s.templates[name]
+	s.mu.RUnlock()
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrTemplateNotFound, name)
+	}
+
+	data := make(map[string]any, len(variables)+1)
+	if question != "" {
+		data["question"] = question
+	}
+	for key, value := range variables {
+		data[key] = value
+	}
+	out := &limitedBuffer{limit: maxPromptSize}
+	if err := e.parsed.Execute(out, data); err != nil {
+		return "", fmt.Errorf("%w: render %s: %w", ErrInvalidTemplate, name, err)
+	}
+	return out.String(), nil
+}
+
+// limitedBuffer fails writes past limit bytes.
+type limitedBuffer struct {
+	bytes.Buffer
+	limit int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.Len()+len(p) > b.limit {
+		return 0, fmt.Errorf("rendered prompt exceeds %d bytes", b.limit)
+	}
+	return b.Buffer.Write(p)
+}
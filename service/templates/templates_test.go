@@ -0,0 +1,77 @@
+package templates
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStorePersistsTemplates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "templates.db")
+	s, err := Open(Config{Path: path})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if _, err := s.Create("summarize", "Short summary", "Summarize in {{.words}} words:\n{{.question}}"); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err := s.Create("summarize", "", "again"); !errors.Is(err, ErrTemplateExists) {
+		t.Fatalf("expected ErrTemplateExists, got %v", err)
+	}
+	if _, err := s.Create("drop-me", "", "x"); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if err := s.Delete("drop-me"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	s, err = Open(Config{Path: path})
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer s.Close()
+	list := s.List()
+	if len(list) != 1 || list[0].Name != "summarize" || list[0].Description != "Short summary" {
+		t.Fatalf("unexpected templates after reopening: %#v", list)
+	}
+
+	prompt, err := s.Render("summarize", map[string]any{"words": 20}, "Go is fun.")
+	if err != nil || prompt != "Summarize in 20 words:\nGo is fun." {
+		t.Fatalf("Render = %q, %v", prompt, err)
+	}
+
+	updated, created, err := s.Put("summarize", "", "Summarize: {{.question}}")
+	if err != nil || created || !updated.CreatedAt.Equal(list[0].CreatedAt) {
+		t.Fatalf("Put = %#v, created=%v, err=%v", updated, created, err)
+	}
+}
+
+func TestRenderAndValidationErrors(t *testing.T) {
+	s := NewMemoryStore()
+	if _, err := s.Create("bad name", "", "x"); !errors.Is(err, ErrInvalidTemplate) {
+		t.Fatalf("expected an invalid name to be rejected, got %v", err)
+	}
+	if _, err := s.Create("broken", "", "{{.x"); !errors.Is(err, ErrInvalidTemplate) {
+		t.Fatalf("expected a parse error, got %v", err)
+	}
+	if _, _, err := s.Put("greet", "", "Hello {{.name}}"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	if _, err := s.Render("greet", nil, ""); !errors.Is(err, ErrInvalidTemplate) || !strings.Contains(err.Error(), "name") {
+		t.Fatalf("expected a missing variable error, got %v", err)
+	}
+	if _, err := s.Render("nope", nil, ""); !errors.Is(err, ErrTemplateNotFound) {
+		t.Fatalf("expected ErrTemplateNotFound, got %v", err)
+	}
+	if _, _, err := s.Put("loop", "", "{{range .n}}0123456789{{end}}"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if _, err := s.Render("loop", map[string]any{"n": maxPromptSize}, ""); err == nil {
+		t.Fatal("expected oversized prompts to be rejected")
+	}
+}
@@ -0,0 +1,152 @@
+// Package tenants serves several teams from one instance. A tenant is a named
+// profile selected by the API key of the request: it carries its own keys,
+// default model, system prompt, rate limits and the features it may use, and
+// its sessions are invisible to the other tenants.
+package tenants
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"gemini-wrapper/service/ratelimit"
+)
+
+// Features a tenant may be allowed to use.
+const (
+	FeatureAsk        = "ask"
+	FeatureGeminiAPI  = "gemini_api"
+	FeatureOpenAI     = "openai"
+	FeatureAnthropic  = "anthropic"
+	FeatureOllama     = "ollama"
+	FeatureEmbeddings = "embeddings"
+	FeatureFiles      = "files"
+	FeatureSessions   = "sessions"
+	FeatureJobs       = "jobs"
+	FeatureWorkspaces = "workspaces"
+	FeatureTemplates  = "templates"
+)
+
+// Features lists every feature name.
+var Features = []string{
+	FeatureAsk, FeatureGeminiAPI, FeatureOpenAI, FeatureAnthropic, FeatureOllama, FeatureEmbeddings,
+	FeatureFiles, FeatureSessions, FeatureJobs, FeatureWorkspaces, FeatureTemplates,
+}
+
+var ErrInvalidTenant = errors.New("invalid tenant")
+
+type Tenant struct {
+	Name string `yaml:"name"`
+	// APIKeys select the tenant, in the syntax of auth.api_keys: "label:key"
+	// or a bare key. Their labels become "<name>/<label>".
+	APIKeys []string `yaml:"api_keys"`
+	// DefaultModel applies to requests that name no model.
+	DefaultModel string `yaml:"default_model"`
+	// SystemPrompt is put before the context of every question.
+	SystemPrompt string `yaml:"system_prompt"`
+	// RateLimit replaces the global limits. Its quotas are shared by all the
+	// keys of the tenant; without any the global per-key limits apply.
+	RateLimit ratelimit.Config `yaml:"rate_limit"`
+	// Features the tenant may use. Empty allows all of them.
+	Features []string `yaml:"features"`
+}
+
+// Allows reports whether the tenant may use feature.
+func (t *Tenant) Allows(feature string) bool {
+	return len(t.Features) == 0 || slices.Contains(t.Features, feature)
+}
+
+// Label returns the API key label of a key labelled label in tenant name.
+func Label(name, label string) string {
+	return name + "/" + label
+}
+
+// Registry finds the tenant of an API key label. The nil Registry has no
+// tenants.
+type Registry struct {
+	tenants []*Tenant
+}
+
+// New checks tenants and returns their registry. Names must be unique and
+// must not contain "/"; features must be known.
+func New(tenants []Tenant) (*Registry, error) {
+	r := &Registry{}
+	for i := range tenants {
+		t := tenants[i]
+		t.Name = strings.TrimSpace(t.Name)
+		if t.Name == "" || strings.Contains(t.Name, "/") {
+			return nil, fmt.Errorf("%w: tenants[%d].name must be set and must not contain \"/\"", ErrInvalidTenant, i)
+		}
+		if r.Get(t.Name) != nil {
+			return nil, fmt.Errorf("%w: duplicate tenant %q", ErrInvalidTenant, t.Name)
+		}
+		for _, feature := range t.Features {
+			if !slices.Contains(Features, feature) {
+				return nil, fmt.Errorf("%w: tenant %q has unknown feature %q (expected one of %s)", ErrInvalidTenant, t.Name, feature, strings.Join(Features, ", "))
+			}
+		}
+		r.tenants = append(r.tenants, &t)
+	}
+	return r, nil
+}
+
+// Tenants returns the tenants in configuration order.
+func (r *Registry) Tenants() []*Tenant {
+	if r == nil {
+		return nil
+	}
+	return r.tenants
+}
+
+// Get returns the tenant called name, or nil.
+func (r *Registry) Get(name string) *Tenant {
+	for _, t := range r.Tenants() {
+		if t.Name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+// ForLabel returns the tenant of the API key labelled label, or nil when the
+// key belongs to no tenant.
+func (r *Registry) ForLabel(label string) *Tenant {
+	name, _, ok := strings.Cut(label, "/")
+	if !ok {
+		return nil
+	}
+	return r.Get(name)
+}
+
+// RateLimited reports whether any tenant has rate limits.
+func (r *Registry) RateLimited() bool {
+	for _, t := range r.Tenants() {
+		if t.RateLimit.Enabled() {
+			return true
+		}
+	}
+	return false
+}
+
+type contextKey struct{}
+
+// WithTenant returns a copy of ctx carrying t.
+func WithTenant(ctx context.Context, t *Tenant) context.Context {
+	return context.WithValue(ctx, contextKey{}, t)
+}
+
+// FromContext returns the tenant of the request, or nil.
+func FromContext(ctx context.Context) *Tenant {
+	t, _ := ctx.Value(contextKey{}).(*Tenant)
+	return t
+}
+
+// Name returns the name of the tenant of the request, or "".
+func Name(ctx context.Context) string {
+	if t := FromContext(ctx); t != nil {
+		return t.Name
+	}
+	return ""
+}
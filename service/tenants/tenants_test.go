@@ -0,0 +1,67 @@
+package tenants
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"gemini-wrapper/service/ratelimit"
+)
+
+func TestNewRejectsInvalidTenants(t *testing.T) {
+	tests := map[string][]Tenant{
+		"no name":         {{}},
+		"slash in name":   {{Name: "a/b"}},
+		"duplicate name":  {{Name: "team"}, {Name: "team"}},
+		"unknown feature": {{Name: "team", Features: []string{"shell"}}},
+	}
+	for name, tenants := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := New(tenants); !errors.Is(err, ErrInvalidTenant) {
+				t.Fatalf("expected ErrInvalidTenant, got %v", err)
+			}
+		})
+	}
+}
+
+func TestForLabelFindsTheTenantOfAKey(t *testing.T) {
+	registry, err := New([]Tenant{
+		{Name: "search", Features: []string{FeatureAsk}},
+		{Name: "support", RateLimit: ratelimit.Config{RequestsPerMinute: 5}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := registry.ForLabel(Label("support", "key-1")); got == nil || got.Name != "support" {
+		t.Fatalf("expected tenant support, got %+v", got)
+	}
+	for _, label := range []string{"ci", "", "billing/key-1"} {
+		if got := registry.ForLabel(label); got != nil {
+			t.Fatalf("expected no tenant for %q, got %+v", label, got)
+		}
+	}
+	if !registry.RateLimited() {
+		t.Fatal("expected the registry to be rate limited")
+	}
+
+	search := registry.Get("search")
+	if !search.Allows(FeatureAsk) || search.Allows(FeatureSessions) {
+		t.Fatalf("expected search to allow only ask, got %v", search.Features)
+	}
+	if support := registry.Get("support"); !support.Allows(FeatureSessions) {
+		t.Fatal("expected a tenant without features to allow every feature")
+	}
+
+	ctx := WithTenant(context.Background(), search)
+	if Name(ctx) != "search" || Name(context.Background()) != "" {
+		t.Fatalf("unexpected tenant names %q and %q", Name(ctx), Name(context.Background()))
+	}
+}
+
+func TestNilRegistryHasNoTenants(t *testing.T) {
+	var registry *Registry
+	if registry.ForLabel(Label("team", "key-1")) != nil || registry.RateLimited() || len(registry.Tenants()) != 0 {
+		t.Fatal("expected the nil registry to be empty")
+	}
+}
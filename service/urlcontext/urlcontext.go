@@ -0,0 +1,330 @@
+// Package urlcontext fetches the web pages a request names and reduces them
+// to text, which is put before the question as context. Pages are only
+// fetched from the hosts an operator allows, so clients cannot make the
+// server reach arbitrary addresses.
+package urlcontext
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+)
+
+var (
+	// ErrDisabled is returned when a request names URLs but no host is
+	// allowed.
+	ErrDisabled = errors.New("urls are disabled on this server")
+	// ErrInvalidURL is returned for URLs that are malformed, not allowed or
+	// too many. It is the client's mistake.
+	ErrInvalidURL = errors.New("invalid url")
+	// ErrFetch is returned when an allowed page cannot be fetched or read.
+	ErrFetch = errors.New("fetching url failed")
+)
+
+type Config struct {
+	// AllowedHosts are the hosts pages may be fetched from. "*.example.com"
+	// matches the subdomains of example.com. Empty disables urls.
+	AllowedHosts []string `yaml:"allowed_hosts"`
+	// MaxURLs caps the URLs of one request.
+	MaxURLs int `yaml:"max_urls"`
+	// MaxPageBytes caps the size of a downloaded page.
+	MaxPageBytes int64 `yaml:"max_page_bytes"`
+	// MaxTextChars truncates the text of a page to this many characters.
+	MaxTextChars int `yaml:"max_text_chars"`
+	// Timeout bounds fetching all pages of a request.
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+func DefaultConfig() Config {
+	return Config{MaxURLs: 5, MaxPageBytes: 2 << 20, MaxTextChars: 20000, Timeout: 15 * time.Second}
+}
+
+// ApplyEnv overrides c with the URL_CONTEXT_* environment variables that are
+// set.
+func (c *Config) ApplyEnv() {
+	if raw, ok := os.LookupEnv("URL_CONTEXT_ALLOWED_HOSTS"); ok {
+		c.AllowedHosts = nil
+		for _, host := range strings.Split(raw, ",") {
+			if host = strings.TrimSpace(host); host != "" {
+				c.AllowedHosts = append(c.AllowedHosts, host)
+			}
+		}
+	}
+	if n, err := strconv.Atoi(strings.TrimSpace(os.Getenv("URL_CONTEXT_MAX_URLS"))); err == nil && n > 0 {
+		c.MaxURLs = n
+	}
+	if n, err := strconv.ParseInt(strings.TrimSpace(os.Getenv("URL_CONTEXT_MAX_PAGE_BYTES")), 10, 64); err == nil && n > 0 {
+		c.MaxPageBytes = n
+	}
+	if n, err := strconv.Atoi(strings.TrimSpace(os.Getenv("URL_CONTEXT_MAX_TEXT_CHARS"))); err == nil && n > 0 {
+		c.MaxTextChars = n
+	}
+	if seconds, err := strconv.Atoi(strings.TrimSpace(os.Getenv("URL_CONTEXT_TIMEOUT_SECONDS"))); err == nil && seconds > 0 {
+		c.Timeout = time.Duration(seconds) * time.Second
+	}
+}
+
+// Page is the text of a fetched page.
+type Page struct {
+	URL   string
+	Title string
+	Text  string
+	// Truncated is set when Text was cut at MaxTextChars.
+	Truncated bool
+}
+
+// Fetcher fetches pages from the allowed hosts.
+type Fetcher struct {
+	cfg    Config
+	client *http.Client
+}
+
+// New returns a Fetcher for cfg. Zero limits fall back to the defaults.
+func New(cfg Config) *Fetcher {
+	defaults := DefaultConfig()
+	if cfg.MaxURLs <= 0 {
+		cfg.MaxURLs = defaults.MaxURLs
+	}
+	if cfg.MaxPageBytes <= 0 {
+		cfg.MaxPageBytes = defaults.MaxPageBytes
+	}
+	if cfg.MaxTextChars <= 0 {
+		cfg.MaxTextChars = defaults.MaxTextChars
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaults.Timeout
+	}
+	f := &Fetcher{cfg: cfg}
+	f.client = &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 5 {
+			return errors.New("too many redirects")
+		}
+		// A redirect must not lead out of the allowed hosts.
+		if !f.allowed(req.URL) {
+			return fmt.Errorf("redirect to %s is not allowed", req.URL.Host)
+		}
+		return nil
+	}}
+	return f
+}
+
+// Enabled reports whether any host is allowed. A nil Fetcher is disabled.
+func (f *Fetcher) Enabled() bool {
+	return f != nil && len(f.cfg.AllowedHosts) > 0
+}
+
+// Fetch returns the text of the pages at urls, in order. It fails if any
+// URL is not allowed or any page cannot be fetched.
+func (f *Fetcher) Fetch(ctx context.Context, urls []string) ([]Page, error) {
+	if len(urls) == 0 {
+		return nil, nil
+	}
+	if !f.Enabled() {
+		return nil, ErrDisabled
+	}
+	if len(urls) > f.cfg.MaxURLs {
+		return nil, fmt.Errorf("%w: at most %d urls are allowed", ErrInvalidURL, f.cfg.MaxURLs)
+	}
+	parsed := make([]*url.URL, len(urls))
+	for i, raw := range urls {
+		u, err := url.Parse(strings.TrimSpace(raw))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("%w: urls[%d] %q must be an http or https URL", ErrInvalidURL, i, raw)
+		}
+		if !f.allowed(u) {
+			return nil, fmt.Errorf("%w: urls[%d] host %s is not allowed", ErrInvalidURL, i, u.Hostname())
+		}
+		parsed[i] = u
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, f.cfg.Timeout)
+	defer cancel()
+	pages := make([]Page, len(parsed))
+	errs := make([]error, len(parsed))
+	var wg sync.WaitGroup
+	for i, u := range parsed {
+		wg.Go(func() {
+			pages[i], errs[i] = f.fetch(ctx, u)
+		})
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return pages, nil
+}
+
+// allowed reports whether u is on an allowed host.
+func (f *Fetcher) allowed(u *url.URL) bool {
+	return HostAllowed(f.cfg.AllowedHosts, u.Hostname())
+}
+
+// HostAllowed reports whether host is one of patterns, where "*.example.com"
+// matches the subdomains of example.com.
+func HostAllowed(patterns []string, host string) bool {
+	host = strings.ToLower(host)
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+			if strings.HasSuffix(host, "."+suffix) {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *Fetcher) fetch(ctx context.Context, u *url.URL) (Page, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return Page{}, fmt.Errorf("%w: %s: %v", ErrFetch, u, err)
+	}
+	req.Header.Set("Accept", "text/html, text/plain;q=0.9, */*;q=0.1")
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return Page{}, fmt.Errorf("%w: %s: %v", ErrFetch, u, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Page{}, fmt.Errorf("%w: %s: status %d", ErrFetch, u, resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, f.cfg.MaxPageBytes+1))
+	if err != nil {
+		return Page{}, fmt.Errorf("%w: %s: %v", ErrFetch, u, err)
+	}
+	if int64(len(body)) > f.cfg.MaxPageBytes {
+		return Page{}, fmt.Errorf("%w: %s exceeds %d bytes", ErrFetch, u, f.cfg.MaxPageBytes)
+	}
+
+	page := Page{URL: u.String()}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	switch {
+	case mediaType == "text/html" || mediaType == "application/xhtml+xml":
+		page.Title, page.Text = htmlText(string(body))
+	case mediaType == "" || strings.HasPrefix(mediaType, "text/") || mediaType == "application/json" || strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml") || mediaType == "application/xml":
+		if !utf8.Valid(body) {
+			return Page{}, fmt.Errorf("%w: %s is not text", ErrFetch, u)
+		}
+		page.Text = strings.TrimSpace(string(body))
+	default:
+		return Page{}, fmt.Errorf("%w: %s has unsupported content type %s", ErrFetch, u, mediaType)
+	}
+	if utf8.RuneCountInString(page.Text) > f.cfg.MaxTextChars {
+		page.Text = strings.TrimSpace(string([]rune(page.Text)[:f.cfg.MaxTextChars]))
+		page.Truncated = true
+	}
+	return page, nil
+}
+
+// skippedElements hold no text a reader of the page would see.
+var skippedElements = map[string]bool{
+	"script": true, "style": true, "noscript": true, "template": true,
+	"svg": true, "iframe": true, "head": true, "nav": true, "footer": true,
+}
+
+// blockElements start a new line of text.
+var blockElements = map[string]bool{
+	"p": true, "div": true, "br": true, "li": true, "tr": true, "section": true, "article": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"pre": true, "blockquote": true, "table": true, "ul": true, "ol": true, "header": true, "main": true,
+}
+
+// htmlText returns the title and the visible text of an HTML page, one
+// block per line.
+func htmlText(page string) (string, string) {
+	tokens := html.NewTokenizer(strings.NewReader(page))
+	var title, text strings.Builder
+	skipped, inTitle := 0, false
+	for {
+		switch kind := tokens.Next(); kind {
+		case html.ErrorToken:
+			return collapse(title.String()), collapseLines(text.String())
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, _ := tokens.TagName()
+			tag := string(name)
+			switch {
+			case tag == "title":
+				inTitle = kind == html.StartTagToken
+			case skippedElements[tag]:
+				if kind == html.StartTagToken {
+					skipped++
+				}
+			case blockElements[tag]:
+				text.WriteByte('\n')
+			}
+		case html.EndTagToken:
+			name, _ := tokens.TagName()
+			tag := string(name)
+			switch {
+			case tag == "title":
+				inTitle = false
+			case skippedElements[tag] && skipped > 0:
+				skipped--
+			case blockElements[tag]:
+				text.WriteByte('\n')
+			}
+		case html.TextToken:
+			if inTitle {
+				title.Write(tokens.Text())
+			} else if skipped == 0 {
+				text.Write(tokens.Text())
+				text.WriteByte(' ')
+			}
+		}
+	}
+}
+
+// collapse joins the words of s with single spaces.
+func collapse(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// collapseLines collapses each line of s and drops the empty ones.
+func collapseLines(s string) string {
+	var lines []string
+	for _, line := range strings.Split(s, "\n") {
+		if line = collapse(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Prompt puts pages before question, each delimited so the model can tell
+// them from the question and name their URLs.
+func Prompt(pages []Page, question string) string {
+	if len(pages) == 0 {
+		return question
+	}
+	var b strings.Builder
+	b.WriteString("Use these web pages as context for the question after them.\n\n")
+	for _, page := range pages {
+		b.WriteString("--- Page: " + page.URL)
+		if page.Title != "" {
+			b.WriteString(" (" + page.Title + ")")
+		}
+		b.WriteString(" ---\n")
+		b.WriteString(page.Text)
+		if page.Truncated {
+			b.WriteString("\n[truncated]")
+		}
+		b.WriteString("\n--- End of page ---\n\n")
+	}
+	b.WriteString("Question: ")
+	b.WriteString(question)
+	return b.String()
+}
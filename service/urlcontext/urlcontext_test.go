@@ -0,0 +1,94 @@
+package urlcontext
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestFetchStripsPagesToText(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/article":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			_, _ = w.Write([]byte(`<html><head><title>Release  notes</title><style>p{}</style></head>
+<body><nav>Home | Blog</nav><h1>Version 2</h1><p>Adds <b>grounding</b> &amp; urls.</p><script>track()</script><br/><p>Second paragraph</p></body></html>`))
+		case "/notes.txt":
+			w.Header().Set("Content-Type", "text/plain")
+			_, _ = w.Write([]byte(strings.Repeat("x", 50)))
+		case "/image":
+			w.Header().Set("Content-Type", "image/png")
+			_, _ = w.Write([]byte{0x89, 'P', 'N', 'G'})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	host := mustHost(t, server.URL)
+
+	fetcher := New(Config{AllowedHosts: []string{host}, MaxTextChars: 15})
+	pages, err := fetcher.Fetch(context.Background(), []string{server.URL + "/article", server.URL + "/notes.txt"})
+	if err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	if pages[0].Title != "Release notes" || pages[0].Text != "Version 2\nAdds" || !pages[0].Truncated {
+		t.Fatalf("unexpected html page %#v", pages[0])
+	}
+	if pages[1].Text != strings.Repeat("x", 15) || !pages[1].Truncated {
+		t.Fatalf("unexpected text page %#v", pages[1])
+	}
+
+	full := New(Config{AllowedHosts: []string{host}})
+	pages, err = full.Fetch(context.Background(), []string{server.URL + "/article"})
+	if err != nil || pages[0].Text != "Version 2\nAdds grounding & urls.\nSecond paragraph" {
+		t.Fatalf("unexpected page %#v err=%v", pages, err)
+	}
+	prompt := Prompt(pages, "What changed?")
+	if !strings.Contains(prompt, "--- Page: "+server.URL+"/article (Release notes) ---\nVersion 2") || !strings.HasSuffix(prompt, "\nQuestion: What changed?") {
+		t.Fatalf("unexpected prompt %q", prompt)
+	}
+
+	for _, path := range []string{"/image", "/missing"} {
+		if _, err := full.Fetch(context.Background(), []string{server.URL + path}); !errors.Is(err, ErrFetch) {
+			t.Fatalf("%s: expected ErrFetch, got %v", path, err)
+		}
+	}
+}
+
+func TestFetchOnlyReachesAllowedHosts(t *testing.T) {
+	redirect := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://elsewhere.invalid/", http.StatusFound)
+	}))
+	defer redirect.Close()
+	fetcher := New(Config{AllowedHosts: []string{"*.example.com", mustHost(t, redirect.URL)}, MaxURLs: 2})
+
+	for _, urls := range [][]string{
+		{"http://example.com/"},
+		{"http://evil.com/?q=.example.com"},
+		{"file:///etc/passwd"},
+		{"https://a.example.com/", "https://b.example.com/", "https://c.example.com/"},
+	} {
+		if _, err := fetcher.Fetch(context.Background(), urls); !errors.Is(err, ErrInvalidURL) {
+			t.Fatalf("%v: expected ErrInvalidURL, got %v", urls, err)
+		}
+	}
+	if _, err := fetcher.Fetch(context.Background(), []string{redirect.URL}); !errors.Is(err, ErrFetch) || !strings.Contains(err.Error(), "not allowed") {
+		t.Fatalf("expected the redirect to be refused, got %v", err)
+	}
+	if _, err := New(Config{}).Fetch(context.Background(), []string{"https://example.com/"}); !errors.Is(err, ErrDisabled) {
+		t.Fatalf("expected ErrDisabled, got %v", err)
+	}
+}
+
+func mustHost(t *testing.T, raw string) string {
+	t.Helper()
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.Hostname()
+}
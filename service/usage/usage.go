@@ -0,0 +1,34 @@
+// Package usage carries per-request token accounting hooks through contexts so
+// the Gemini service can report consumption without knowing who is listening.
+package usage
+
+import (
+	"context"
+
+	"gemini-wrapper/model"
+)
+
+// Recorder receives the token usage of one backend run.
+type Recorder func(usage model.UsageMetadata)
+
+type recorderKey struct{}
+
+// WithRecorder returns a context whose Record calls reach r as well as any
+// recorder already attached to ctx.
+func WithRecorder(ctx context.Context, r Recorder) context.Context {
+	if parent, ok := ctx.Value(recorderKey{}).(Recorder); ok {
+		next := r
+		r = func(u model.UsageMetadata) {
+			parent(u)
+			next(u)
+		}
+	}
+	return context.WithValue(ctx, recorderKey{}, r)
+}
+
+// Record reports usage to the recorders attached to ctx, if any.
+func Record(ctx context.Context, u model.UsageMetadata) {
+	if r, ok := ctx.Value(recorderKey{}).(Recorder); ok {
+		r(u)
+	}
+}
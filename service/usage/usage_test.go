@@ -0,0 +1,21 @@
+package usage
+
+import (
+	"context"
+	"testing"
+
+	"gemini-wrapper/model"
+)
+
+func TestRecordReachesAllRecorders(t *testing.T) {
+	var outer, inner int
+	ctx := WithRecorder(context.Background(), func(u model.UsageMetadata) { outer += u.TotalTokenCount })
+	ctx = WithRecorder(ctx, func(u model.UsageMetadata) { inner += u.TotalTokenCount })
+
+	Record(ctx, model.UsageMetadata{TotalTokenCount: 7})
+	Record(context.Background(), model.UsageMetadata{TotalTokenCount: 100})
+
+	if outer != 7 || inner != 7 {
+		t.Fatalf("unexpected totals: outer=%d inner=%d", outer, inner)
+	}
+}
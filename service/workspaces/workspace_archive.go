@@ -0,0 +1,105 @@
+package workspaces
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+
+	"gemini-wrapper/model"
+)
+
+// Archive formats.
+const (
+	ArchiveTarGz = "tar.gz"
+	ArchiveZip   = "zip"
+)
+
+// ErrInvalidFormat is returned by Archive for formats other than tar.gz and
+// zip.
+var ErrInvalidFormat = errors.New("unsupported archive format")
+
+// Archive returns the current files of the workspace as a tar.gz or zip
+// archive, or only the files added or modified since they were uploaded
+// when changedOnly is set. Deleted files cannot be in an archive; the diff
+// lists them.
+func (m *Manager) Archive(id, format string, changedOnly bool) ([]byte, error) {
+	if format != ArchiveTarGz && format != ArchiveZip {
+		return nil, fmt.Errorf("%w %q: use %s or %s", ErrInvalidFormat, format, ArchiveTarGz, ArchiveZip)
+	}
+	ws, _, err := m.lookup(id)
+	if err != nil {
+		return nil, err
+	}
+	files, err := ws.files()
+	if err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	archive := newArchiveWriter(&out, format)
+	for _, file := range files {
+		if file.State == model.FileDeleted || changedOnly && file.State == model.FileUnchanged {
+			continue
+		}
+		content, err := readFile(filepath.Join(ws.dir, filesDir), file.Path)
+		if err != nil {
+			return nil, err
+		}
+		if err := archive.add(file, content); err != nil {
+			return nil, err
+		}
+	}
+	if err := archive.close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// archiveWriter writes files to a tar.gz or a zip archive.
+type archiveWriter struct {
+	gzip *gzip.Writer
+	tar  *tar.Writer
+	zip  *zip.Writer
+}
+
+func newArchiveWriter(w io.Writer, format string) *archiveWriter {
+	if format == ArchiveZip {
+		return &archiveWriter{zip: zip.NewWriter(w)}
+	}
+	compressed := gzip.NewWriter(w)
+	return &archiveWriter{gzip: compressed, tar: tar.NewWriter(compressed)}
+}
+
+func (a *archiveWriter) add(file model.WorkspaceFile, content []byte) error {
+	if a.zip != nil {
+		header := &zip.FileHeader{Name: file.Path, Method: zip.Deflate, Modified: file.ModifiedAt}
+		header.SetMode(0o644)
+		w, err := a.zip.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(content)
+		return err
+	}
+	header := &tar.Header{Typeflag: tar.TypeReg, Name: file.Path, Mode: 0o644, Size: int64(len(content)), ModTime: file.ModifiedAt}
+	if err := a.tar.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := a.tar.Write(content)
+	return err
+}
+
+func (a *archiveWriter) close() error {
+	if a.zip != nil {
+		return a.zip.Close()
+	}
+	if err := a.tar.Close(); err != nil {
+		return err
+	}
+	return a.gzip.Close()
+}
@@ -0,0 +1,120 @@
+package workspaces
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gemini-wrapper/model"
+)
+
+func readTarGz(t *testing.T, archive []byte) map[string]string {
+	t.Helper()
+	compressed, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatalf("gzip: %v", err)
+	}
+	files := map[string]string{}
+	reader := tar.NewReader(compressed)
+	for {
+		header, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			return files
+		}
+		if err != nil {
+			t.Fatalf("tar: %v", err)
+		}
+		content, err := io.ReadAll(reader)
+		if err != nil {
+			t.Fatalf("tar: %v", err)
+		}
+		files[header.Name] = string(content)
+	}
+}
+
+func readZip(t *testing.T, archive []byte) map[string]string {
+	t.Helper()
+	reader, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatalf("zip: %v", err)
+	}
+	files := map[string]string{}
+	for _, file := range reader.File {
+		r, err := file.Open()
+		if err != nil {
+			t.Fatalf("zip: %v", err)
+		}
+		content, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatalf("zip: %v", err)
+		}
+		files[file.Name] = string(content)
+	}
+	return files
+}
+
+func TestArchiveHoldsTheFilesOfTheWorkspace(t *testing.T) {
+	asker := &editingAsker{edit: func(dir string) error {
+		if err := os.MkdirAll(filepath.Join(dir, ".gemini"), 0o700); err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(dir, ".gemini", "settings.json"), []byte("{}"), 0o600); err != nil {
+			return err
+		}
+		if err := os.Remove(filepath.Join(dir, "old.txt")); err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(dir, "main.go"), []byte("package main\n\nfunc main() {}\n"), 0o600); err != nil {
+			return err
+		}
+		return os.WriteFile(filepath.Join(dir, "docs", "new.md"), []byte("# New\n"), 0o600)
+	}}
+	m := newTestManager(t, asker)
+	ws, err := m.Create()
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	for name, content := range map[string]string{"main.go": "package main\n", "old.txt": "old\n", "docs/keep.md": "keep\n"} {
+		if _, err := m.WriteFile(ws.ID, name, strings.NewReader(content)); err != nil {
+			t.Fatalf("WriteFile %s: %v", name, err)
+		}
+	}
+	if _, _, _, err := m.Ask(context.Background(), ws.ID, "edit", model.AskOptions{}); err != nil {
+		t.Fatalf("Ask: %v", err)
+	}
+
+	all := map[string]string{"main.go": "package main\n\nfunc main() {}\n", "docs/keep.md": "keep\n", "docs/new.md": "# New\n"}
+	archive, err := m.Archive(ws.ID, ArchiveTarGz, false)
+	if err != nil {
+		t.Fatalf("Archive: %v", err)
+	}
+	if got := readTarGz(t, archive); !reflect.DeepEqual(got, all) {
+		t.Fatalf("expected %v, got %v", all, got)
+	}
+
+	changed := map[string]string{"main.go": "package main\n\nfunc main() {}\n", "docs/new.md": "# New\n"}
+	archive, err = m.Archive(ws.ID, ArchiveZip, true)
+	if err != nil {
+		t.Fatalf("Archive: %v", err)
+	}
+	if got := readZip(t, archive); !reflect.DeepEqual(got, changed) {
+		t.Fatalf("expected %v, got %v", changed, got)
+	}
+
+	if _, err := m.Archive(ws.ID, "rar", false); !errors.Is(err, ErrInvalidFormat) {
+		t.Fatalf("expected ErrInvalidFormat, got %v", err)
+	}
+	if _, err := m.Archive("ws_missing", ArchiveZip, false); !errors.Is(err, ErrWorkspaceNotFound) {
+		t.Fatalf("expected ErrWorkspaceNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,56 @@
+package workspaces
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gemini-wrapper/model"
+)
+
+// ContextFileName is the GEMINI.md the CLI reads from the root of a
+// workspace. It is a workspace file like any other, so it is also listed,
+// downloaded and diffed with them.
+const ContextFileName = "GEMINI.md"
+
+// Context returns the GEMINI.md of a workspace.
+func (m *Manager) Context(id string) (model.ContextFile, error) {
+	ws, _, err := m.lookup(id)
+	if err != nil {
+		return model.ContextFile{}, err
+	}
+	file := model.ContextFile{Scope: model.ContextWorkspace, ID: id}
+	root, err := os.OpenRoot(filepath.Join(ws.dir, filesDir))
+	if err != nil {
+		return model.ContextFile{}, err
+	}
+	defer root.Close()
+	info, err := root.Stat(ContextFileName)
+	if errors.Is(err, os.ErrNotExist) {
+		return file, nil
+	}
+	if err != nil {
+		return model.ContextFile{}, err
+	}
+	content, err := root.ReadFile(ContextFileName)
+	if err != nil {
+		return model.ContextFile{}, err
+	}
+	updatedAt := info.ModTime().UTC()
+	file.Content, file.UpdatedAt = string(content), &updatedAt
+	return file, nil
+}
+
+// SetContext replaces the GEMINI.md of a workspace, or removes it when
+// content is blank.
+func (m *Manager) SetContext(id, content string) (model.ContextFile, error) {
+	if strings.TrimSpace(content) == "" {
+		if err := m.DeleteFile(id, ContextFileName); err != nil && !errors.Is(err, ErrFileNotFound) {
+			return model.ContextFile{}, err
+		}
+	} else if _, err := m.WriteFile(id, ContextFileName, strings.NewReader(content)); err != nil {
+		return model.ContextFile{}, err
+	}
+	return m.Context(id)
+}
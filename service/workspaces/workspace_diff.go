@@ -0,0 +1,228 @@
+package workspaces
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"gemini-wrapper/model"
+)
+
+const (
+	// diffContext is the number of unchanged lines around each hunk.
+	diffContext = 3
+	// maxDiffCells bounds the line table of one file diff. Files whose
+	// changed parts are larger are shown as replaced as a whole.
+	maxDiffCells = 4 << 20
+	// binarySniffLen is how much of a file is searched for a NUL byte, as
+	// git does, to tell binary files apart.
+	binarySniffLen = 8000
+)
+
+// Diff returns a unified diff, in the format git apply reads, from the files
+// as they were uploaded to the files now in the workspace.
+func (m *Manager) Diff(id string) ([]byte, error) {
+	ws, _, err := m.lookup(id)
+	if err != nil {
+		return nil, err
+	}
+	files, err := ws.files()
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	for _, file := range files {
+		if file.State == model.FileUnchanged {
+			continue
+		}
+		var before, after []byte
+		if file.State != model.FileAdded {
+			if before, err = readFile(filepath.Join(ws.dir, baseDir), file.Path); err != nil {
+				return nil, err
+			}
+		}
+		if file.State != model.FileDeleted {
+			if after, err = readFile(filepath.Join(ws.dir, filesDir), file.Path); err != nil {
+				return nil, err
+			}
+		}
+		writeFileDiff(&out, file.Path, file.State, before, after)
+	}
+	return out.Bytes(), nil
+}
+
+// writeFileDiff writes the git-style diff of one file.
+func writeFileDiff(out *bytes.Buffer, name, state string, before, after []byte) {
+	fmt.Fprintf(out, "diff --git a/%s b/%s\n", name, name)
+	from, to := "a/"+name, "b/"+name
+	switch state {
+	case model.FileAdded:
+		out.WriteString("new file mode 100644\n")
+		from = "/dev/null"
+	case model.FileDeleted:
+		out.WriteString("deleted file mode 100644\n")
+		to = "/dev/null"
+	}
+	if isBinary(before) || isBinary(after) {
+		fmt.Fprintf(out, "Binary files %s and %s differ\n", from, to)
+		return
+	}
+	fmt.Fprintf(out, "--- %s\n+++ %s\n", from, to)
+	writeHunks(out, diffLines(splitLines(before), splitLines(after)))
+}
+
+func isBinary(content []byte) bool {
+	return bytes.IndexByte(content[:min(len(content), binarySniffLen)], 0) >= 0
+}
+
+// splitLines splits content after each newline. A last line without one is
+// kept as it is, so it differs from the same line with a newline.
+func splitLines(content []byte) []string {
+	if len(content) == 0 {
+		return nil
+	}
+	lines := strings.SplitAfter(string(content), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// edit is one line of a diff: kept (' '), removed ('-') or added ('+').
+type edit struct {
+	op   byte
+	line string
+}
+
+// diffLines returns the edits that turn a into b, keeping a longest common
+// subsequence of lines.
+func diffLines(a, b []string) []edit {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	edits := make([]edit, 0, len(a)+len(b))
+	for _, line := range a[:prefix] {
+		edits = append(edits, edit{' ', line})
+	}
+	midA, midB := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	if (len(midA)+1)*(len(midB)+1) > maxDiffCells {
+		for _, line := range midA {
+			edits = append(edits, edit{'-', line})
+		}
+		for _, line := range midB {
+			edits = append(edits, edit{'+', line})
+		}
+	} else {
+		edits = append(edits, lcsEdits(midA, midB)...)
+	}
+	for _, line := range a[len(a)-suffix:] {
+		edits = append(edits, edit{' ', line})
+	}
+	return edits
+}
+
+func lcsEdits(a, b []string) []edit {
+	width := len(b) + 1
+	// lcs[i*width+j] is the length of the longest common subsequence of
+	// a[i:] and b[j:].
+	lcs := make([]int32, (len(a)+1)*width)
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i*width+j] = lcs[(i+1)*width+j+1] + 1
+			} else {
+				lcs[i*width+j] = max(lcs[(i+1)*width+j], lcs[i*width+j+1])
+			}
+		}
+	}
+
+	edits := make([]edit, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			edits = append(edits, edit{' ', a[i]})
+			i++
+			j++
+		case lcs[(i+1)*width+j] >= lcs[i*width+j+1]:
+			edits = append(edits, edit{'-', a[i]})
+			i++
+		default:
+			edits = append(edits, edit{'+', b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		edits = append(edits, edit{'-', a[i]})
+	}
+	for ; j < len(b); j++ {
+		edits = append(edits, edit{'+', b[j]})
+	}
+	return edits
+}
+
+// writeHunks writes the changed edits with diffContext lines around them,
+// joining changes that are close enough to share their context.
+func writeHunks(out *bytes.Buffer, edits []edit) {
+	// oldLine and newLine count the lines of each side before edits[k].
+	oldLine := make([]int, len(edits)+1)
+	newLine := make([]int, len(edits)+1)
+	for k, e := range edits {
+		oldLine[k+1], newLine[k+1] = oldLine[k], newLine[k]
+		if e.op != '+' {
+			oldLine[k+1]++
+		}
+		if e.op != '-' {
+			newLine[k+1]++
+		}
+	}
+
+	for k := 0; k < len(edits); {
+		if edits[k].op == ' ' {
+			k++
+			continue
+		}
+		start := max(0, k-diffContext)
+		end := k
+		for next := k; next < len(edits); next++ {
+			if edits[next].op != ' ' {
+				if next-end > 2*diffContext {
+					break
+				}
+				end = next + 1
+			}
+		}
+		stop := min(len(edits), end+diffContext)
+
+		fmt.Fprintf(out, "@@ -%s +%s @@\n",
+			hunkRange(oldLine[start], oldLine[stop]-oldLine[start]),
+			hunkRange(newLine[start], newLine[stop]-newLine[start]))
+		for _, e := range edits[start:stop] {
+			out.WriteByte(e.op)
+			out.WriteString(e.line)
+			if !strings.HasSuffix(e.line, "\n") {
+				out.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		k = stop
+	}
+}
+
+// hunkRange formats the range of a hunk side that starts after before lines
+// and has count lines.
+func hunkRange(before, count int) string {
+	switch count {
+	case 0:
+		return fmt.Sprintf("%d,0", before)
+	case 1:
+		return fmt.Sprintf("%d", before+1)
+	}
+	return fmt.Sprintf("%d,%d", before+1, count)
+}
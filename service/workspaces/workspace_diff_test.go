@@ -0,0 +1,65 @@
+package workspaces
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"gemini-wrapper/model"
+)
+
+func TestWriteFileDiffHunks(t *testing.T) {
+	before := "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n13\n14\n15\n"
+	after := "1\n2\nthree\n4\n5\n6\n7\n8\n9\n10\n11\n12\n13\nfourteen\n15\n"
+	var out bytes.Buffer
+	writeFileDiff(&out, "n.txt", model.FileModified, []byte(before), []byte(after))
+
+	want := `diff --git a/n.txt b/n.txt
+--- a/n.txt
++++ b/n.txt
+@@ -1,6 +1,6 @@
+ 1
+ 2
+-3
++three
+ 4
+ 5
+ 6
+@@ -11,5 +11,5 @@
+ 11
+ 12
+ 13
+-14
++fourteen
+ 15
+`
+	if out.String() != want {
+		t.Fatalf("unexpected diff:\n%s\nwant:\n%s", out.String(), want)
+	}
+}
+
+func TestWriteFileDiffNewFileWithoutTrailingNewline(t *testing.T) {
+	var out bytes.Buffer
+	writeFileDiff(&out, "a.txt", model.FileAdded, nil, []byte("one\ntwo"))
+
+	want := `diff --git a/a.txt b/a.txt
+new file mode 100644
+--- /dev/null
++++ b/a.txt
+@@ -0,0 +1,2 @@
++one
++two
+\ No newline at end of file
+`
+	if out.String() != want {
+		t.Fatalf("unexpected diff:\n%s\nwant:\n%s", out.String(), want)
+	}
+}
+
+func TestWriteFileDiffBinary(t *testing.T) {
+	var out bytes.Buffer
+	writeFileDiff(&out, "img.png", model.FileModified, []byte("\x89PNG\x00a"), []byte("\x89PNG\x00b"))
+	if !strings.HasSuffix(out.String(), "Binary files a/img.png and b/img.png differ\n") {
+		t.Fatalf("unexpected diff:\n%s", out.String())
+	}
+}
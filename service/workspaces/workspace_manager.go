@@ -0,0 +1,588 @@
+// Package workspaces keeps working directories that clients upload files into
+// and run prompts in, so the CLI can read and edit a project and the client
+// can download the result or a diff of what changed.
+package workspaces
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gemini-wrapper/metrics"
+	"gemini-wrapper/model"
+)
+
+const (
+	idPrefix = "ws_"
+	// filesDir holds the files the CLI works on; baseDir holds them as they
+	// were uploaded, for the diff.
+	filesDir = "files"
+	baseDir  = "base"
+)
+
+var (
+	// ErrWorkspaceNotFound is returned when a workspace ID is unknown or the
+	// workspace has expired.
+	ErrWorkspaceNotFound = errors.New("workspace not found")
+	ErrFileNotFound      = errors.New("file not found")
+	// ErrInvalidPath is returned for file paths that are absolute, leave the
+	// workspace or point into the CLI's .gemini settings.
+	ErrInvalidPath = errors.New("invalid file path")
+	// ErrBusy is returned while a prompt runs in the workspace.
+	ErrBusy = errors.New("workspace is busy running a prompt")
+	// ErrTooLarge is returned when an upload would exceed MaxBytes.
+	ErrTooLarge = errors.New("workspace size limit exceeded")
+	// ErrTooManyWorkspaces is returned by Create while MaxWorkspaces exist.
+	ErrTooManyWorkspaces = errors.New("too many workspaces")
+)
+
+type Config struct {
+	Enabled bool   `yaml:"enabled"`
+	Dir     string `yaml:"dir"`
+	// IdleTTL is how long a workspace is kept after it was last used.
+	IdleTTL time.Duration `yaml:"idle_ttl"`
+	// MaxWorkspaces caps the workspaces kept at once. 0 disables the limit.
+	MaxWorkspaces int `yaml:"max_workspaces"`
+	// MaxBytes caps the size of the files uploaded into one workspace. 0
+	// disables the limit.
+	MaxBytes int64 `yaml:"max_bytes"`
+}
+
+func DefaultConfig() Config {
+	return Config{Dir: "/app/cache/workspaces", IdleTTL: 24 * time.Hour, MaxWorkspaces: 50, MaxBytes: 50 << 20}
+}
+
+// ApplyEnv overrides c with the WORKSPACES_* environment variables that are
+// set.
+func (c *Config) ApplyEnv() {
+	if raw := strings.TrimSpace(os.Getenv("WORKSPACES_ENABLED")); raw != "" {
+		if parsed, err := strconv.ParseBool(raw); err == nil {
+			c.Enabled = parsed
+		}
+	}
+	if dir := strings.TrimSpace(os.Getenv("WORKSPACES_DIR")); dir != "" {
+		c.Dir = dir
+	}
+	if seconds := envInt("WORKSPACES_IDLE_TTL_SECONDS", 0); seconds > 0 {
+		c.IdleTTL = time.Duration(seconds) * time.Second
+	}
+	c.MaxWorkspaces = envInt("WORKSPACES_MAX", c.MaxWorkspaces)
+	c.MaxBytes = int64(envInt("WORKSPACES_MAX_BYTES", int(c.MaxBytes)))
+}
+
+// Asker is the part of the Gemini service the manager needs.
+type Asker interface {
+	AskWithOptions(ctx context.Context, question string, opts model.AskOptions) (string, *model.GeminiStatus, error)
+}
+
+// Manager keeps the workspaces of this process under Config.Dir. Workspaces
+// are dropped IdleTTL after they were last used.
+type Manager struct {
+	service Asker
+	cfg     Config
+	now     func() time.Time
+
+	mu         sync.Mutex
+	workspaces map[string]*workspace
+}
+
+type workspace struct {
+	dir string
+	// busy is held while the workspace is changed: for the whole run of a
+	// prompt and for every upload or deletion. Holders that would have to
+	// wait get ErrBusy instead.
+	busy    sync.Mutex
+	removed bool
+
+	info model.WorkspaceInfo
+}
+
+// Open creates cfg.Dir and deletes the workspaces a previous process left in
+// it, since their metadata was kept in memory.
+func Open(service Asker, cfg Config) (*Manager, error) {
+	defaults := DefaultConfig()
+	if cfg.Dir == "" {
+		cfg.Dir = defaults.Dir
+	}
+	if cfg.IdleTTL <= 0 {
+		cfg.IdleTTL = defaults.IdleTTL
+	}
+	if err := os.MkdirAll(cfg.Dir, 0o700); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(cfg.Dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && strings.HasPrefix(entry.Name(), idPrefix) {
+			if err := os.RemoveAll(filepath.Join(cfg.Dir, entry.Name())); err != nil {
+				slog.Warn("removing stale workspace failed", "workspace", entry.Name(), "error", err)
+			}
+		}
+	}
+	return &Manager{service: service, cfg: cfg, now: time.Now, workspaces: map[string]*workspace{}}, nil
+}
+
+// Create makes an empty workspace.
+func (m *Manager) Create() (model.WorkspaceInfo, error) {
+	id, err := newWorkspaceID()
+	if err != nil {
+		return model.WorkspaceInfo{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pruneLocked()
+	if m.cfg.MaxWorkspaces > 0 && len(m.workspaces) >= m.cfg.MaxWorkspaces {
+		return model.WorkspaceInfo{}, fmt.Errorf("%w: limit is %d", ErrTooManyWorkspaces, m.cfg.MaxWorkspaces)
+	}
+	ws := &workspace{dir: filepath.Join(m.cfg.Dir, id)}
+	for _, sub := range []string{filesDir, baseDir} {
+		if err := os.MkdirAll(filepath.Join(ws.dir, sub), 0o700); err != nil {
+			_ = os.RemoveAll(ws.dir)
+			return model.WorkspaceInfo{}, err
+		}
+	}
+	now := m.now()
+	ws.info = model.WorkspaceInfo{ID: id, CreatedAt: now, LastUsedAt: now}
+	m.workspaces[id] = ws
+	return ws.info, nil
+}
+
+// List returns the workspaces without their files, oldest first.
+func (m *Manager) List() []model.WorkspaceInfo {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pruneLocked()
+	list := make([]model.WorkspaceInfo, 0, len(m.workspaces))
+	for _, ws := range m.workspaces {
+		list = append(list, ws.info)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	return list
+}
+
+// Get returns a workspace with its files.
+func (m *Manager) Get(id string) (model.WorkspaceInfo, error) {
+	ws, info, err := m.lookup(id)
+	if err != nil {
+		return model.WorkspaceInfo{}, err
+	}
+	files, err := ws.files()
+	if err != nil {
+		return model.WorkspaceInfo{}, err
+	}
+	info.Files = files
+	info.Bytes = 0
+	for _, file := range files {
+		if file.State != model.FileDeleted {
+			info.Bytes += file.Size
+		}
+	}
+	return info, nil
+}
+
+// Delete removes a workspace and its files.
+func (m *Manager) Delete(id string) error {
+	m.mu.Lock()
+	ws, ok := m.workspaces[id]
+	if !ok {
+		m.mu.Unlock()
+		return ErrWorkspaceNotFound
+	}
+	if !ws.busy.TryLock() {
+		m.mu.Unlock()
+		return ErrBusy
+	}
+	delete(m.workspaces, id)
+	m.mu.Unlock()
+
+	// busy stays locked: callers still holding ws see it removed.
+	ws.removed = true
+	return os.RemoveAll(ws.dir)
+}
+
+// WriteFile stores the content of r at name in the workspace, creating
+// parent directories. The file also becomes the base its diff starts from.
+func (m *Manager) WriteFile(id, name string, r io.Reader) (model.WorkspaceFile, error) {
+	name, err := cleanPath(name)
+	if err != nil {
+		return model.WorkspaceFile{}, err
+	}
+	ws, release, err := m.acquire(id)
+	if err != nil {
+		return model.WorkspaceFile{}, err
+	}
+	defer release()
+
+	limit := int64(-1)
+	if m.cfg.MaxBytes > 0 {
+		used, err := ws.size(name)
+		if err != nil {
+			return model.WorkspaceFile{}, err
+		}
+		limit = m.cfg.MaxBytes - used
+	}
+	content, err := readLimited(r, limit)
+	if err != nil {
+		return model.WorkspaceFile{}, err
+	}
+	for _, sub := range []string{filesDir, baseDir} {
+		if err := writeFile(filepath.Join(ws.dir, sub), name, content); err != nil {
+			return model.WorkspaceFile{}, err
+		}
+	}
+	m.touch(ws)
+	return model.WorkspaceFile{Path: name, Size: int64(len(content)), ModifiedAt: m.now().UTC(), State: model.FileUnchanged}, nil
+}
+
+// ReadFile returns the current content of the file at name.
+func (m *Manager) ReadFile(id, name string) ([]byte, error) {
+	name, err := cleanPath(name)
+	if err != nil {
+		return nil, err
+	}
+	ws, _, err := m.lookup(id)
+	if err != nil {
+		return nil, err
+	}
+	content, err := readFile(filepath.Join(ws.dir, filesDir), name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrFileNotFound, name)
+	}
+	return content, err
+}
+
+// DeleteFile removes the file at name from the workspace and its base.
+func (m *Manager) DeleteFile(id, name string) error {
+	name, err := cleanPath(name)
+	if err != nil {
+		return err
+	}
+	ws, release, err := m.acquire(id)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	found := false
+	for _, sub := range []string{filesDir, baseDir} {
+		err := removeFile(filepath.Join(ws.dir, sub), name)
+		if err == nil {
+			found = true
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	if !found {
+		return fmt.Errorf("%w: %s", ErrFileNotFound, name)
+	}
+	m.touch(ws)
+	return nil
+}
+
+// Ask runs question with the CLI working in the workspace and returns the
+// answer and the files that differ from the uploaded ones afterwards. One
+// prompt runs in a workspace at a time.
+func (m *Manager) Ask(ctx context.Context, id, question string, opts model.AskOptions) (string, *model.GeminiStatus, []model.WorkspaceFile, error) {
+	ws, release, err := m.acquire(id)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	defer release()
+
+	m.setRunning(ws, true)
+	defer m.setRunning(ws, false)
+	opts.WorkDir = filepath.Join(ws.dir, filesDir)
+	answer, status, err := m.service.AskWithOptions(ctx, question, opts)
+	if err != nil {
+		return "", status, nil, err
+	}
+	files, err := ws.files()
+	if err != nil {
+		return answer, status, nil, err
+	}
+	changes := make([]model.WorkspaceFile, 0, len(files))
+	for _, file := range files {
+		if file.State != model.FileUnchanged {
+			changes = append(changes, file)
+		}
+	}
+	return answer, status, changes, nil
+}
+
+// lookup returns a workspace and marks it used.
+func (m *Manager) lookup(id string) (*workspace, model.WorkspaceInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pruneLocked()
+	ws, ok := m.workspaces[id]
+	if !ok {
+		return nil, model.WorkspaceInfo{}, ErrWorkspaceNotFound
+	}
+	ws.info.LastUsedAt = m.now()
+	return ws, ws.info, nil
+}
+
+// acquire returns a workspace to change and the function that releases it.
+func (m *Manager) acquire(id string) (*workspace, func(), error) {
+	ws, _, err := m.lookup(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !ws.busy.TryLock() {
+		return nil, nil, ErrBusy
+	}
+	if ws.removed {
+		ws.busy.Unlock()
+		return nil, nil, ErrWorkspaceNotFound
+	}
+	return ws, ws.busy.Unlock, nil
+}
+
+func (m *Manager) touch(ws *workspace) {
+	m.mu.Lock()
+	ws.info.LastUsedAt = m.now()
+	m.mu.Unlock()
+}
+
+func (m *Manager) setRunning(ws *workspace, running bool) {
+	m.mu.Lock()
+	ws.info.Running = running
+	ws.info.LastUsedAt = m.now()
+	m.mu.Unlock()
+}
+
+// Reap deletes the workspaces unused for IdleTTL, which otherwise happens
+// only when workspaces are created or listed.
+func (m *Manager) Reap() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pruneLocked()
+}
+
+// pruneLocked deletes the workspaces unused for IdleTTL. A workspace running
+// a prompt is kept.
+func (m *Manager) pruneLocked() {
+	cutoff := m.now().Add(-m.cfg.IdleTTL)
+	for id, ws := range m.workspaces {
+		if !ws.info.LastUsedAt.Before(cutoff) || !ws.busy.TryLock() {
+			continue
+		}
+		delete(m.workspaces, id)
+		ws.removed = true
+		size := diskUsage(ws.dir)
+		if err := os.RemoveAll(ws.dir); err != nil {
+			slog.Warn("removing expired workspace failed", "workspace", id, "error", err)
+			continue
+		}
+		metrics.Reclaimed.Inc("workspace")
+		metrics.ReclaimedBytes.Add(float64(size), "workspace")
+	}
+}
+
+// diskUsage returns the size of the regular files under dir, as far as it
+// can be read.
+func diskUsage(dir string) int64 {
+	var total int64
+	_ = filepath.WalkDir(dir, func(_ string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.Type().IsRegular() {
+			return nil
+		}
+		if info, err := entry.Info(); err == nil {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total
+}
+
+// files lists the current and the deleted files of ws, ordered by path.
+func (ws *workspace) files() ([]model.WorkspaceFile, error) {
+	current, err := walkFiles(filepath.Join(ws.dir, filesDir))
+	if err != nil {
+		return nil, err
+	}
+	base, err := walkFiles(filepath.Join(ws.dir, baseDir))
+	if err != nil {
+		return nil, err
+	}
+	files := make([]model.WorkspaceFile, 0, len(current))
+	for name, info := range current {
+		file := model.WorkspaceFile{Path: name, Size: info.Size(), ModifiedAt: info.ModTime().UTC(), State: model.FileAdded}
+		if _, ok := base[name]; ok {
+			file.State = model.FileModified
+			if same, err := ws.unchanged(name); err != nil {
+				return nil, err
+			} else if same {
+				file.State = model.FileUnchanged
+			}
+		}
+		files = append(files, file)
+	}
+	for name, info := range base {
+		if _, ok := current[name]; !ok {
+			files = append(files, model.WorkspaceFile{Path: name, Size: info.Size(), ModifiedAt: info.ModTime().UTC(), State: model.FileDeleted})
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return files, nil
+}
+
+// unchanged reports whether the file at name still has its uploaded content.
+func (ws *workspace) unchanged(name string) (bool, error) {
+	current, err := readFile(filepath.Join(ws.dir, filesDir), name)
+	if err != nil {
+		return false, err
+	}
+	base, err := readFile(filepath.Join(ws.dir, baseDir), name)
+	if err != nil {
+		return false, err
+	}
+	return string(current) == string(base), nil
+}
+
+// size returns the size of the current files of ws except the one at skip,
+// which an upload is about to replace.
+func (ws *workspace) size(skip string) (int64, error) {
+	current, err := walkFiles(filepath.Join(ws.dir, filesDir))
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for name, info := range current {
+		if name != skip {
+			total += info.Size()
+		}
+	}
+	return total, nil
+}
+
+// cleanPath turns a client file path into a slash-separated path inside the
+// workspace.
+func cleanPath(name string) (string, error) {
+	name = strings.ReplaceAll(strings.TrimSpace(name), "\\", "/")
+	if name == "" || strings.HasPrefix(name, "/") {
+		return "", fmt.Errorf("%w %q", ErrInvalidPath, name)
+	}
+	name = path.Clean(name)
+	if name == "." || name == ".." || strings.HasPrefix(name, "../") {
+		return "", fmt.Errorf("%w %q", ErrInvalidPath, name)
+	}
+	if first, _, _ := strings.Cut(name, "/"); first == ".gemini" {
+		return "", fmt.Errorf("%w %q: .gemini holds CLI settings", ErrInvalidPath, name)
+	}
+	return name, nil
+}
+
+// walkFiles returns the regular files under dir by slash-separated path.
+// The CLI's .gemini directory is left out.
+func walkFiles(dir string) (map[string]fs.FileInfo, error) {
+	files := map[string]fs.FileInfo{}
+	err := filepath.WalkDir(dir, func(p string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if entry.IsDir() {
+			if rel == ".gemini" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		files[rel] = info
+		return nil
+	})
+	return files, err
+}
+
+// readLimited reads r, failing with ErrTooLarge past limit bytes. A negative
+// limit reads everything.
+func readLimited(r io.Reader, limit int64) ([]byte, error) {
+	if limit < 0 {
+		return io.ReadAll(r)
+	}
+	content, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(content)) > limit {
+		return nil, ErrTooLarge
+	}
+	return content, nil
+}
+
+// writeFile, readFile and removeFile work on name inside dir through an
+// os.Root, so symlinks the CLI created cannot lead outside the workspace.
+func writeFile(dir, name string, content []byte) error {
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+	if parent := path.Dir(name); parent != "." {
+		if err := root.MkdirAll(parent, 0o700); err != nil {
+			return err
+		}
+	}
+	return root.WriteFile(name, content, 0o600)
+}
+
+func readFile(dir, name string) ([]byte, error) {
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer root.Close()
+	return root.ReadFile(name)
+}
+
+func removeFile(dir, name string) error {
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+	return root.Remove(name)
+}
+
+func newWorkspaceID() (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return idPrefix + hex.EncodeToString(b), nil
+}
+
+func envInt(key string, defaultValue int) int {
+	parsed, err := strconv.Atoi(strings.TrimSpace(os.Getenv(key)))
+	if err != nil || parsed < 0 {
+		return defaultValue
+	}
+	return parsed
+}
@@ -0,0 +1,272 @@
+package workspaces
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gemini-wrapper/metrics"
+	"gemini-wrapper/model"
+)
+
+// editingAsker stands in for the CLI: it edits the files of the directory it
+// runs in, or waits for release when set.
+type editingAsker struct {
+	edit    func(dir string) error
+	release chan struct{}
+	workDir string
+}
+
+func (a *editingAsker) AskWithOptions(ctx context.Context, question string, opts model.AskOptions) (string, *model.GeminiStatus, error) {
+	a.workDir = opts.WorkDir
+	if a.release != nil {
+		select {
+		case <-a.release:
+		case <-ctx.Done():
+			return "", nil, ctx.Err()
+		}
+	}
+	if a.edit != nil {
+		if err := a.edit(opts.WorkDir); err != nil {
+			return "", nil, err
+		}
+	}
+	return "done " + question, &model.GeminiStatus{}, nil
+}
+
+func newTestManager(t *testing.T, asker Asker) *Manager {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.Dir = t.TempDir()
+	m, err := Open(asker, cfg)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	return m
+}
+
+func TestAskRunsInWorkspaceAndReportsChanges(t *testing.T) {
+	asker := &editingAsker{edit: func(dir string) error {
+		if err := os.WriteFile(filepath.Join(dir, "main.go"), []byte("package main\n\nfunc main() {}\n"), 0o600); err != nil {
+			return err
+		}
+		if err := os.Remove(filepath.Join(dir, "old.txt")); err != nil {
+			return err
+		}
+		return os.WriteFile(filepath.Join(dir, "docs", "new.md"), []byte("# New\n"), 0o600)
+	}}
+	m := newTestManager(t, asker)
+	ws, err := m.Create()
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	for name, content := range map[string]string{"main.go": "package main\n", "old.txt": "old\n", "docs/keep.md": "keep\n"} {
+		if _, err := m.WriteFile(ws.ID, name, strings.NewReader(content)); err != nil {
+			t.Fatalf("WriteFile %s: %v", name, err)
+		}
+	}
+
+	answer, _, changes, err := m.Ask(context.Background(), ws.ID, "edit", model.AskOptions{})
+	if err != nil {
+		t.Fatalf("Ask: %v", err)
+	}
+	if answer != "done edit" || asker.workDir == "" {
+		t.Fatalf("unexpected answer %q in %q", answer, asker.workDir)
+	}
+	got := map[string]string{}
+	for _, change := range changes {
+		got[change.Path] = change.State
+	}
+	want := map[string]string{"main.go": model.FileModified, "old.txt": model.FileDeleted, "docs/new.md": model.FileAdded}
+	if len(got) != len(want) {
+		t.Fatalf("expected changes %v, got %v", want, got)
+	}
+	for path, state := range want {
+		if got[path] != state {
+			t.Fatalf("expected changes %v, got %v", want, got)
+		}
+	}
+
+	content, err := m.ReadFile(ws.ID, "main.go")
+	if err != nil || !strings.Contains(string(content), "func main") {
+		t.Fatalf("expected the edited file, got %q, %v", content, err)
+	}
+	diff, err := m.Diff(ws.ID)
+	if err != nil {
+		t.Fatalf("Diff: %v", err)
+	}
+	for _, want := range []string{"--- /dev/null\n+++ b/docs/new.md\n", "--- a/old.txt\n+++ /dev/null\n", "+func main() {}\n"} {
+		if !strings.Contains(string(diff), want) {
+			t.Fatalf("expected %q in diff:\n%s", want, diff)
+		}
+	}
+	if strings.Contains(string(diff), "keep.md") {
+		t.Fatalf("unchanged file in diff:\n%s", diff)
+	}
+}
+
+func TestWriteFileRejectsPathsOutsideWorkspace(t *testing.T) {
+	m := newTestManager(t, &editingAsker{})
+	ws, err := m.Create()
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	for _, name := range []string{"", "/etc/passwd", "../escape", "a/../../escape", ".gemini/settings.json", "./.gemini/x"} {
+		if _, err := m.WriteFile(ws.ID, name, strings.NewReader("x")); !errors.Is(err, ErrInvalidPath) {
+			t.Fatalf("expected ErrInvalidPath for %q, got %v", name, err)
+		}
+	}
+}
+
+func TestWriteFileSymlinkCannotEscape(t *testing.T) {
+	m := newTestManager(t, &editingAsker{})
+	ws, err := m.Create()
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	outside := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(m.cfg.Dir, ws.ID, filesDir, "link")); err != nil {
+		t.Skipf("symlinks unavailable: %v", err)
+	}
+	if _, err := m.WriteFile(ws.ID, "link/evil.txt", strings.NewReader("x")); err == nil {
+		t.Fatal("expected writing through a symlink out of the workspace to fail")
+	}
+	if _, err := os.Stat(filepath.Join(outside, "evil.txt")); !os.IsNotExist(err) {
+		t.Fatalf("file written outside the workspace: %v", err)
+	}
+}
+
+func TestWriteFileEnforcesMaxBytes(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Dir = t.TempDir()
+	cfg.MaxBytes = 10
+	m, err := Open(&editingAsker{}, cfg)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	ws, _ := m.Create()
+	if _, err := m.WriteFile(ws.ID, "a", strings.NewReader("123456")); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if _, err := m.WriteFile(ws.ID, "b", strings.NewReader("123456")); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("expected ErrTooLarge, got %v", err)
+	}
+	// Replacing a file only counts its new size.
+	if _, err := m.WriteFile(ws.ID, "a", strings.NewReader("1234567890")); err != nil {
+		t.Fatalf("WriteFile replacing a: %v", err)
+	}
+}
+
+func TestWorkspaceIsBusyWhileAsking(t *testing.T) {
+	asker := &editingAsker{release: make(chan struct{})}
+	m := newTestManager(t, asker)
+	ws, _ := m.Create()
+
+	done := make(chan error, 1)
+	go func() {
+		_, _, _, err := m.Ask(context.Background(), ws.ID, "q", model.AskOptions{})
+		done <- err
+	}()
+	deadline := time.Now().Add(time.Second)
+	for {
+		info, err := m.Get(ws.ID)
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		if info.Running {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the workspace to be running")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, _, _, err := m.Ask(context.Background(), ws.ID, "q", model.AskOptions{}); !errors.Is(err, ErrBusy) {
+		t.Fatalf("expected ErrBusy for a second prompt, got %v", err)
+	}
+	if _, err := m.WriteFile(ws.ID, "a", strings.NewReader("x")); !errors.Is(err, ErrBusy) {
+		t.Fatalf("expected ErrBusy for an upload, got %v", err)
+	}
+	if err := m.Delete(ws.ID); !errors.Is(err, ErrBusy) {
+		t.Fatalf("expected ErrBusy for a deletion, got %v", err)
+	}
+
+	close(asker.release)
+	if err := <-done; err != nil {
+		t.Fatalf("Ask: %v", err)
+	}
+	if err := m.Delete(ws.ID); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := m.Get(ws.ID); !errors.Is(err, ErrWorkspaceNotFound) {
+		t.Fatalf("expected ErrWorkspaceNotFound, got %v", err)
+	}
+}
+
+func TestIdleWorkspacesArePruned(t *testing.T) {
+	m := newTestManager(t, &editingAsker{})
+	now := time.Now()
+	m.now = func() time.Time { return now }
+	ws, _ := m.Create()
+
+	now = now.Add(m.cfg.IdleTTL + time.Second)
+	if _, err := m.Get(ws.ID); !errors.Is(err, ErrWorkspaceNotFound) {
+		t.Fatalf("expected the idle workspace to be pruned, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(m.cfg.Dir, ws.ID)); !os.IsNotExist(err) {
+		t.Fatalf("expected the workspace directory to be removed, got %v", err)
+	}
+}
+
+func TestReapDeletesIdleWorkspacesAndCountsTheirBytes(t *testing.T) {
+	m := newTestManager(t, &editingAsker{})
+	now := time.Now()
+	m.now = func() time.Time { return now }
+	ws, _ := m.Create()
+	if _, err := m.WriteFile(ws.ID, "main.go", strings.NewReader("package main\n")); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	reclaimed, reclaimedBytes := metrics.Reclaimed.Value("workspace"), metrics.ReclaimedBytes.Value("workspace")
+
+	m.Reap()
+	if _, err := m.Get(ws.ID); err != nil {
+		t.Fatalf("expected a used workspace to stay, got %v", err)
+	}
+	now = now.Add(m.cfg.IdleTTL + time.Second)
+	m.Reap()
+	if _, err := os.Stat(filepath.Join(m.cfg.Dir, ws.ID)); !os.IsNotExist(err) {
+		t.Fatalf("expected the workspace directory to be removed, got %v", err)
+	}
+	if got := metrics.Reclaimed.Value("workspace") - reclaimed; got != 1 {
+		t.Fatalf("expected one reclaimed workspace, got %v", got)
+	}
+	// The file is kept twice: as uploaded and as the base of the diff.
+	if got := metrics.ReclaimedBytes.Value("workspace") - reclaimedBytes; got != 2*13 {
+		t.Fatalf("expected 26 reclaimed bytes, got %v", got)
+	}
+}
+
+func TestWorkspaceContextIsGeminiMD(t *testing.T) {
+	m := newTestManager(t, &editingAsker{})
+	ws, _ := m.Create()
+
+	file, err := m.SetContext(ws.ID, "Use tabs.")
+	if err != nil || file.Content != "Use tabs." || file.Scope != model.ContextWorkspace || file.UpdatedAt == nil {
+		t.Fatalf("unexpected context %#v, %v", file, err)
+	}
+	content, err := m.ReadFile(ws.ID, ContextFileName)
+	if err != nil || string(content) != "Use tabs." {
+		t.Fatalf("expected GEMINI.md in the workspace, got %q, %v", content, err)
+	}
+	if _, err := m.SetContext(ws.ID, ""); err != nil {
+		t.Fatalf("SetContext: %v", err)
+	}
+	if file, err := m.Context(ws.ID); err != nil || file.Content != "" {
+		t.Fatalf("expected the context to be removed, got %#v, %v", file, err)
+	}
+}